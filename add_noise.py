@@ -13,6 +13,21 @@ import numpy as np
 from typing import Dict, Optional
 
 
+def record_format_version(metadata_line: str) -> int:
+    """
+    Return the format version of an upload file from its metadata line.
+    
+    Files without a format_version are v1.
+    """
+    try:
+        metadata = json.loads(metadata_line)
+    except json.JSONDecodeError:
+        return 1
+    if not isinstance(metadata, dict):
+        return 1
+    return metadata.get('format_version') or 1
+
+
 class NoiseAdder:
     def __init__(self, position_std: float = 0.01, rotation_std: float = 0.01):
         """
@@ -113,17 +128,21 @@ class NoiseAdder:
             if lines:
                 f_out.write(lines[0])
             
+            # v1 record lines are index,json; v2 ones are
+            # index,received_ms,type,device_id,json
+            columns = 5 if record_format_version(lines[0] if lines else '') >= 2 else 2
+            
             # Process remaining lines
             for line in lines[1:]:
-                parts = line.strip().split(',', 1)
-                if len(parts) < 2:
+                parts = line.strip().split(',', columns - 1)
+                if len(parts) < columns:
                     f_out.write(line)
                     continue
                 
-                line_num = parts[0]
+                prefix = ','.join(parts[:-1])
                 
                 try:
-                    data = json.loads(parts[1])
+                    data = json.loads(parts[-1])
                     
                     # Add noise to position if present
                     if 'position' in data:
@@ -134,7 +153,7 @@ class NoiseAdder:
                         data['rotation'] = self.add_noise_to_rotation(data['rotation'])
                     
                     # Write modified line
-                    f_out.write(f"{line_num},{json.dumps(data)}\n")
+                    f_out.write(f"{prefix},{json.dumps(data)}\n")
                     processed_count += 1
                     
                 except json.JSONDecodeError:
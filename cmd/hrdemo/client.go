@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	requestTimeout = 30 * time.Second
+	minBackoff     = time.Second
+	maxBackoff     = time.Minute
+)
+
+// client calls the API of one server.
+type client struct {
+	base string // e.g. https://example.org, without a trailing slash
+	http *http.Client
+}
+
+func newClient(server string) (*client, error) {
+	u, err := url.Parse(strings.TrimSuffix(server, "/"))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, fmt.Errorf("invalid server %q: must be an http or https URL", server)
+	}
+	return &client{base: u.String(), http: &http.Client{Timeout: requestTimeout}}, nil
+}
+
+// apiURL returns the URL of an API endpoint, given relative to /api/v1.
+func (c *client) apiURL(path string, query url.Values) string {
+	u := c.base + "/api/v1" + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// apiError is an error response, with the server's error code if it sent one.
+type apiError struct {
+	Status     int
+	Code       string
+	Message    string
+	RetryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("%s (%d %s)", e.Message, e.Status, e.Code)
+	}
+	return fmt.Sprintf("%d %s: %s", e.Status, http.StatusText(e.Status), e.Message)
+}
+
+// temporary reports whether a request that failed with err may succeed
+// when sent again later.
+func temporary(err error) bool {
+	var apiErr *apiError
+	if !errors.As(err, &apiErr) {
+		// the request didn't get an answer, e.g. the network is down
+		return true
+	}
+	return apiErr.Status == http.StatusTooManyRequests || apiErr.Status == http.StatusRequestTimeout || apiErr.Status >= 500
+}
+
+// do sends a request and decodes a JSON response into response, which may
+// be nil. Error responses come back as *apiError.
+func (c *client) do(method, u, contentType, uploadKey string, body io.Reader, response any) error {
+	resp, err := c.send(method, u, contentType, uploadKey, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if response == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(response)
+}
+
+// send sends a request, with uploadKey in its header if not empty, and
+// returns a successful response for the caller to read and close. Error
+// responses come back as *apiError.
+func (c *client) send(method, u, contentType, uploadKey string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if uploadKey != "" {
+		req.Header.Set("X-Upload-Key", uploadKey)
+	}
+	req.Header.Set("User-Agent", "hrdemo")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		defer resp.Body.Close()
+		apiErr := &apiError{Status: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		var errorResponse struct {
+			Error struct{ Code, Message string } `json:"error"`
+		}
+		if json.Unmarshal(data, &errorResponse) == nil && errorResponse.Error.Message != "" {
+			apiErr.Code, apiErr.Message = errorResponse.Error.Code, errorResponse.Error.Message
+		} else {
+			apiErr.Message = strings.TrimSpace(string(data))
+		}
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && seconds > 0 {
+			apiErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return nil, apiErr
+	}
+	return resp, nil
+}
+
+// newUploadKey asks the server for a fresh upload key and returns it with
+// the upload's name.
+func (c *client) newUploadKey() (key, name string, err error) {
+	var response struct {
+		UploadKey string `json:"upload_key"`
+		Name      string `json:"name"`
+	}
+	if err := c.do(http.MethodPost, c.apiURL("/new-upload-key", nil), "", "", nil, &response); err != nil {
+		return "", "", fmt.Errorf("create upload key: %w", err)
+	}
+	return response.UploadKey, response.Name, nil
+}
+
+// retryDelay is how long to wait before sending a request again after it
+// failed with err, given the previous delay.
+func retryDelay(err error, previous time.Duration) time.Duration {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter
+	}
+	if previous == 0 {
+		return minBackoff
+	}
+	return min(previous*2, maxBackoff)
+}
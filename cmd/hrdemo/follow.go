@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var uploadKeyPattern = regexp.MustCompile(`^[0-9a-f]{128}$`)
+
+// followPageSize is the most records fetched by one poll.
+const followPageSize = 1000
+
+// follower polls an upload for new records and prints them.
+type follower struct {
+	client   *client
+	query    url.Values // identifies the upload by name
+	key      string     // or by key
+	raw      bool
+	trackers map[string]bool // empty to print every record
+	out      io.Writer
+}
+
+// runFollow implements "follow": print the records of an upload as they
+// arrive, until interrupted.
+func runFollow(args []string) {
+	flags := flag.NewFlagSet("follow", flag.ExitOnError)
+	serverURL := flags.String("server", defaultServer, "Base URL of the server")
+	ref := flags.String("key", os.Getenv("HRDEMO_UPLOAD_KEY"), "Upload key or name of the upload to follow (default: $HRDEMO_UPLOAD_KEY)")
+	raw := flags.Bool("raw", false, "Print the records as NDJSON instead of formatting them")
+	fromStart := flags.Bool("from-start", false, "Print the records already stored too, not just new ones")
+	trackers := flags.String("tracker", "", "Comma-separated tracker keys to print the records of (default: all records)")
+	interval := flags.Duration("interval", time.Second, "How often to poll for new records")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s follow -key <key or name> [-raw] [-from-start] [-tracker head,left] [flags]\n\nPrints the records of an upload as they arrive, to check that a rig's data gets through.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *ref == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	c, err := newClient(*serverURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	f := &follower{client: c, query: url.Values{}, raw: *raw, trackers: map[string]bool{}, out: os.Stdout}
+	if uploadKeyPattern.MatchString(*ref) {
+		f.key = *ref
+	} else {
+		f.query.Set("upload_name", *ref)
+	}
+	for _, tracker := range strings.Split(*trackers, ",") {
+		if tracker = strings.TrimSpace(tracker); tracker != "" {
+			f.trackers[tracker] = true
+		}
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	position := 0
+	if !*fromStart {
+		if position, err = f.lastIndex(*ref); err != nil {
+			log.Fatal(err)
+		}
+	}
+	if err := f.follow(ctx, position, *interval); err != nil && !errors.Is(err, context.Canceled) {
+		log.Fatal(err)
+	}
+}
+
+// lastIndex returns the index of the last stored record, 0 if the upload
+// has none yet.
+func (f *follower) lastIndex(ref string) (int, error) {
+	var status struct {
+		Records int `json:"records"`
+	}
+	err := f.client.do(http.MethodGet, f.client.apiURL("/uploads/"+url.PathEscape(ref)+"/status", nil), "", "", nil, &status)
+	var apiErr *apiError
+	if errors.As(err, &apiErr) && apiErr.Status == http.StatusNotFound {
+		// nothing uploaded yet, so everything is new
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("read upload status: %w", err)
+	}
+	return status.Records, nil
+}
+
+// follow prints the records after position, polling every interval, until
+// ctx is done. Temporary failures are retried with backoff.
+func (f *follower) follow(ctx context.Context, position int, interval time.Duration) error {
+	var delay time.Duration
+	for {
+		next, err := f.poll(position)
+		wait := interval
+		switch {
+		case err == nil:
+			delay = 0
+			if next != position {
+				// there may be more right away
+				position, wait = next, 0
+			}
+		case temporary(err):
+			delay = retryDelay(err, delay)
+			wait = delay
+			log.Printf("follow failed, retrying in %s: %v", delay, err)
+		default:
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+}
+
+// poll fetches and prints the records after position and returns the new
+// position.
+func (f *follower) poll(position int) (int, error) {
+	// a long backlog comes in pages, fetched one after the other
+	query := url.Values{"position": {strconv.Itoa(position)}, "limit": {strconv.Itoa(followPageSize)}, "format": {"raw"}}
+	for name, values := range f.query {
+		query[name] = values
+	}
+	resp, err := f.client.send(http.MethodGet, f.client.apiURL("/follow", query), "", f.key, nil)
+	if err != nil {
+		return position, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNoContent {
+		return position, nil
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		// lines are index,payload
+		index, payload, ok := strings.Cut(scanner.Text(), ",")
+		if !ok {
+			continue
+		}
+		n, err := strconv.Atoi(index)
+		if err != nil {
+			continue
+		}
+		f.print(n, []byte(payload))
+		position = max(position, n)
+	}
+	if err := scanner.Err(); err != nil {
+		// the records read so far were printed, so carry on after them
+		return position, err
+	}
+	if next, err := strconv.Atoi(resp.Header.Get("X-Follow-Position")); err == nil {
+		position = max(position, next)
+	}
+	return position, nil
+}
+
+// print writes a record, unless the tracker filter leaves it out.
+func (f *follower) print(index int, payload []byte) {
+	var record map[string]json.RawMessage
+	if json.Unmarshal(payload, &record) != nil {
+		record = nil
+	}
+	if len(f.trackers) > 0 {
+		var tracker string
+		json.Unmarshal(record["trackerKey"], &tracker)
+		if !f.trackers[tracker] {
+			return
+		}
+	}
+	if f.raw {
+		fmt.Fprintf(f.out, "%s\n", payload)
+		return
+	}
+	if record == nil {
+		fmt.Fprintf(f.out, "%6d  %s\n", index, payload)
+		return
+	}
+	fmt.Fprintf(f.out, "%6d  %s\n", index, formatRecord(record))
+}
+
+// formatRecord renders a record on one line for reading in a terminal: its
+// time and tracker first, then the other fields sorted by name, with
+// vectors and quaternions shortened.
+func formatRecord(record map[string]json.RawMessage) string {
+	var parts []string
+	var epoch float64
+	if json.Unmarshal(record["epoch"], &epoch) == nil && epoch > 0 {
+		parts = append(parts, time.UnixMilli(int64(epoch)).Format("15:04:05.000"))
+	}
+	var tracker string
+	if json.Unmarshal(record["trackerKey"], &tracker) == nil && tracker != "" {
+		parts = append(parts, fmt.Sprintf("%-10s", tracker))
+	}
+
+	names := make([]string, 0, len(record))
+	for name := range record {
+		if name != "epoch" && name != "trackerKey" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		parts = append(parts, name+"="+formatValue(record[name]))
+	}
+	return strings.Join(parts, "  ")
+}
+
+func formatValue(value json.RawMessage) string {
+	var number float64
+	if json.Unmarshal(value, &number) == nil {
+		return strconv.FormatFloat(number, 'f', -1, 64)
+	}
+	var vector struct{ X, Y, Z, W *float64 }
+	if json.Unmarshal(value, &vector) == nil && vector.X != nil && vector.Y != nil && vector.Z != nil {
+		components := []*float64{vector.X, vector.Y, vector.Z}
+		if vector.W != nil {
+			components = append(components, vector.W)
+		}
+		var formatted []string
+		for _, component := range components {
+			formatted = append(formatted, strconv.FormatFloat(*component, 'f', 3, 64))
+		}
+		return "(" + strings.Join(formatted, ", ") + ")"
+	}
+	var compact bytes.Buffer
+	if json.Compact(&compact, value) != nil {
+		return string(value)
+	}
+	return compact.String()
+}
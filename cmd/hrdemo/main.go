@@ -0,0 +1,51 @@
+// Command hrdemo is the client-side companion to the server: it talks to a
+// running server over its HTTP API.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+)
+
+// defaultServer is the public server, used unless -server says otherwise.
+const defaultServer = "https://hr-demo-app-server.vrsa.2kendon.ca"
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: %s <command> [flags]
+
+Commands:
+  upload    stream records from a local NDJSON file to an upload
+  follow    print the records of an upload as they arrive
+  simulate  upload made-up sessions, for demos and load testing
+  replay    send traced upload requests to a server again
+
+Run "%[1]s <command> -h" for the flags of a command.
+`, os.Args[0])
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("hrdemo: ")
+
+	if len(os.Args) < 2 {
+		usage()
+		os.Exit(2)
+	}
+	switch os.Args[1] {
+	case "upload":
+		runUpload(os.Args[2:])
+	case "follow":
+		runFollow(os.Args[2:])
+	case "simulate":
+		runSimulate(os.Args[2:])
+	case "replay":
+		runReplay(os.Args[2:])
+	case "-h", "-help", "--help", "help":
+		usage()
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", os.Args[1])
+		usage()
+		os.Exit(2)
+	}
+}
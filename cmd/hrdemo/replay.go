@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// traceEntry is a request recorded by a server started with
+// -trace-uploads.
+type traceEntry struct {
+	Time          time.Time   `json:"time"`
+	Method        string      `json:"method"`
+	Path          string      `json:"path"`
+	Query         string      `json:"query"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body"`
+	BodyTruncated bool        `json:"body_truncated"`
+	Status        int         `json:"status"`
+}
+
+// unreplayedHeaders are set by the HTTP client for the new request.
+var unreplayedHeaders = []string{"Host", "Content-Length", "Connection", "Transfer-Encoding", "Accept-Encoding"}
+
+// runReplay implements "replay": send the requests of an upload trace to a
+// server again, byte for byte, and compare the statuses it answers with to
+// the recorded ones.
+func runReplay(args []string) {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	serverURL := flags.String("server", "http://localhost:8000", "Base URL of the server to replay the trace against")
+	key := flags.String("key", "", "Upload key to send the requests with (default: a new key; \"original\" keeps the traced one)")
+	timing := flags.Bool("timing", false, "Wait between requests as long as the client originally did")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s replay [-server URL] [-key KEY] trace.ndjson\n\nSends the upload requests recorded by a server started with -trace-uploads to another server, to reproduce client bugs. Exits with status 1 if any request gets a different status than it did originally.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() != 1 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	c, err := newClient(*serverURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	entries, err := readTrace(flags.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *key == "" {
+		var name string
+		if *key, name, err = c.newUploadKey(); err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("replaying into upload %s", name)
+	}
+
+	differences := 0
+	for i, entry := range entries {
+		if *timing && i > 0 {
+			time.Sleep(entry.Time.Sub(entries[i-1].Time))
+		}
+		status, message, err := replayEntry(c, entry, *key)
+		if err != nil {
+			log.Fatalf("request %d: %v", i+1, err)
+		}
+		note := ""
+		if entry.BodyTruncated {
+			note = " (body was truncated in the trace)"
+		}
+		if status != entry.Status {
+			differences++
+			note += " DIFFERENT: " + message
+		}
+		fmt.Printf("%d  %s  %s %s  %d bytes  original %d  replayed %d%s\n", i+1, entry.Time.Format(time.RFC3339), entry.Method, entry.Path, len(entry.Body), entry.Status, status, note)
+	}
+	log.Printf("replayed %d requests, %d with a different status", len(entries), differences)
+	if differences > 0 {
+		os.Exit(1)
+	}
+}
+
+func readTrace(path string) ([]traceEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []traceEntry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		var entry traceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// replayEntry sends a traced request with its upload key replaced by key,
+// unless key is "original", and returns the status and body of the response.
+func replayEntry(c *client, entry traceEntry, key string) (int, string, error) {
+	query, err := url.ParseQuery(entry.Query)
+	if err != nil {
+		return 0, "", fmt.Errorf("invalid traced query: %w", err)
+	}
+	if key != "original" {
+		// the key goes in a header, however the traced request sent it
+		query.Del("upload_key")
+	}
+	u := c.base + entry.Path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(entry.Method, u, bytes.NewReader(entry.Body))
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header = entry.Header.Clone()
+	if req.Header == nil {
+		req.Header = http.Header{}
+	}
+	for _, name := range unreplayedHeaders {
+		req.Header.Del(name)
+	}
+	if key != "original" {
+		req.Header.Set("X-Upload-Key", key)
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	return resp.StatusCode, string(bytes.TrimSpace(body)), nil
+}
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"math/rand"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type vec3 struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+type quat struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+	W float64 `json:"w"`
+}
+
+// trackerRecord is a positional record as sent by the browser recorders
+// (posrot.html): epoch in Unix milliseconds, timestamp in milliseconds
+// since the recording started.
+type trackerRecord struct {
+	TrackerKey string  `json:"trackerKey"`
+	Epoch      int64   `json:"epoch"`
+	Timestamp  float64 `json:"timestamp"`
+	Position   vec3    `json:"position"`
+	Rotation   quat    `json:"rotation"`
+}
+
+type heartRateRecord struct {
+	BPM   int   `json:"bpm"`
+	Epoch int64 `json:"epoch"`
+}
+
+const (
+	roomRadius   = 3.0 // meters the walk keeps within
+	walkSpeed    = 1.2 // meters per second
+	circleRadius = 1.5
+	circleSpeed  = 0.8 // meters per second
+	eyeHeight    = 1.65
+)
+
+// simulation moves a person through a room, tracking their headset and
+// controllers. Positions are in meters with y up and -z forward, as in
+// A-Frame.
+type simulation struct {
+	rng      *rand.Rand
+	motion   string // "circle" or "walk"
+	trackers []string
+	noise    float64 // standard deviation of position noise, in meters
+
+	t        float64 // seconds since the start
+	phase    float64 // where on the circle the session starts, in radians
+	position vec3    // of the body, on the floor
+	heading  float64 // yaw in radians, 0 facing -z
+	turnRate float64 // radians per second, for walking
+	bpm      float64
+}
+
+func newSimulation(seed int64, motion string, trackers []string, noise float64) *simulation {
+	rng := rand.New(rand.NewSource(seed))
+	s := &simulation{rng: rng, motion: motion, trackers: trackers, noise: noise, bpm: 70 + 10*rng.Float64()}
+	// start somewhere different on the circle or in the room
+	s.phase = rng.Float64() * 2 * math.Pi
+	s.position = vec3{X: (rng.Float64()*2 - 1) * roomRadius / 2, Z: (rng.Float64()*2 - 1) * roomRadius / 2}
+	s.heading = rng.Float64() * 2 * math.Pi
+	s.step(0)
+	return s
+}
+
+// step advances the body by dt seconds.
+func (s *simulation) step(dt float64) {
+	s.t += dt
+	switch s.motion {
+	case "circle":
+		angle := s.phase + s.t*circleSpeed/circleRadius
+		s.position = vec3{X: circleRadius * math.Cos(angle), Z: circleRadius * math.Sin(angle)}
+		// facing along the circle: forward is (-sin θ, 0, -cos θ)
+		s.heading = math.Atan2(math.Sin(angle), -math.Cos(angle))
+	case "walk":
+		// the turn rate wanders, pulled back toward straight ahead, and
+		// turns toward the middle of the room near its edge
+		s.turnRate += (-0.5*s.turnRate + 0.8*s.rng.NormFloat64()) * dt
+		if math.Hypot(s.position.X, s.position.Z) > roomRadius {
+			toCenter := math.Atan2(s.position.X, s.position.Z)
+			s.turnRate += 2 * math.Remainder(toCenter-s.heading, 2*math.Pi) * dt
+		}
+		s.heading += s.turnRate * dt
+		s.position.X -= math.Sin(s.heading) * walkSpeed * dt
+		s.position.Z -= math.Cos(s.heading) * walkSpeed * dt
+	}
+	// heart rate drifts toward a level that depends on the effort
+	target := 75.0
+	if s.motion == "walk" {
+		target = 100
+	}
+	s.bpm += ((target-s.bpm)*0.05 + s.rng.NormFloat64()*0.5) * dt
+}
+
+// local converts a point relative to the body (x right, y up, z back) to
+// room coordinates.
+func (s *simulation) local(x, y, z float64) vec3 {
+	sin, cos := math.Sin(s.heading), math.Cos(s.heading)
+	return vec3{
+		X: s.position.X + x*cos + z*sin,
+		Y: s.position.Y + y,
+		Z: s.position.Z - x*sin + z*cos,
+	}
+}
+
+func (s *simulation) jitter(v vec3) vec3 {
+	return vec3{
+		X: v.X + s.rng.NormFloat64()*s.noise,
+		Y: v.Y + s.rng.NormFloat64()*s.noise,
+		Z: v.Z + s.rng.NormFloat64()*s.noise,
+	}
+}
+
+// yawPitch returns the rotation turning by yaw about y, then pitching by
+// pitch about x.
+func yawPitch(yaw, pitch float64) quat {
+	sy, cy := math.Sin(yaw/2), math.Cos(yaw/2)
+	sp, cp := math.Sin(pitch/2), math.Cos(pitch/2)
+	return quat{X: cy * sp, Y: sy * cp, Z: -sy * sp, W: cy * cp}
+}
+
+// sample returns the tracker records for the current time.
+func (s *simulation) sample(epoch int64) []trackerRecord {
+	stride := 2 * math.Pi * 1.8 * s.t // steps per second while walking
+	bob, swing := 0.0, 0.0
+	if s.motion == "walk" {
+		bob, swing = 0.02*math.Sin(2*stride), 0.15*math.Sin(stride)
+	}
+	look := 0.3 * math.Sin(0.4*s.t) // glancing around
+
+	records := make([]trackerRecord, 0, len(s.trackers))
+	for _, tracker := range s.trackers {
+		record := trackerRecord{TrackerKey: tracker, Epoch: epoch, Timestamp: math.Round(s.t*1e4) / 10}
+		switch tracker {
+		case "left":
+			record.Position = s.local(-0.22, 1.05+bob, -0.25-swing)
+			record.Rotation = yawPitch(s.heading, -0.6+swing)
+		case "right":
+			record.Position = s.local(0.22, 1.05+bob, -0.25+swing)
+			record.Rotation = yawPitch(s.heading, -0.6-swing)
+		default:
+			// a headset, or a tracker worn on the body
+			record.Position = s.local(0, eyeHeight+bob, 0)
+			record.Rotation = yawPitch(s.heading+look, -0.1+0.05*math.Sin(0.7*s.t))
+		}
+		record.Position = s.jitter(record.Position)
+		records = append(records, record)
+	}
+	return records
+}
+
+// runSimulate implements "simulate": generate tracker and heart rate
+// records for made-up sessions and upload them, in real time for demos or
+// as fast as the server takes them for load testing.
+func runSimulate(args []string) {
+	flags := flag.NewFlagSet("simulate", flag.ExitOnError)
+	serverURL := flags.String("server", defaultServer, "Base URL of the server")
+	trackers := flags.String("trackers", "headset,left,right", "Comma-separated trackers to simulate; left and right are hand controllers, anything else is worn at eye height")
+	rate := flags.Float64("rate", 72, "Samples per second per tracker")
+	duration := flags.Duration("duration", time.Minute, "Length of each simulated session")
+	motion := flags.String("motion", "walk", "Movement to simulate: walk (wandering about a room) or circle")
+	noise := flags.Float64("noise", 0.002, "Standard deviation of tracking noise in meters")
+	heartRate := flags.Bool("heart-rate", true, "Add a heart rate record every second")
+	sessions := flags.Int("sessions", 1, "Number of sessions to upload at once, each to its own new upload")
+	batchInterval := flags.Duration("batch-interval", time.Second, "Simulated time covered by each upload request")
+	realtime := flags.Bool("realtime", true, "Send records as they would be recorded; false sends them as fast as possible, for load testing")
+	seed := flags.Int64("seed", 0, "Seed for the random movement (default: from the clock)")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s simulate [-trackers headset,left,right] [-rate 72] [-duration 10m] [flags]\n\nUploads made-up VR sessions, for demos without hardware and for load testing.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	var trackerKeys []string
+	for _, tracker := range strings.Split(*trackers, ",") {
+		if tracker = strings.TrimSpace(tracker); tracker != "" {
+			trackerKeys = append(trackerKeys, tracker)
+		}
+	}
+	switch {
+	case len(trackerKeys) == 0:
+		log.Fatal("-trackers must name at least one tracker")
+	case *rate <= 0 || *rate > 1000:
+		log.Fatal("-rate must be more than 0 and at most 1000")
+	case *duration <= 0 || *batchInterval <= 0:
+		log.Fatal("-duration and -batch-interval must be positive")
+	case *motion != "walk" && *motion != "circle":
+		log.Fatalf("invalid -motion %q: must be walk or circle", *motion)
+	case *sessions < 1:
+		log.Fatal("-sessions must be at least 1")
+	}
+	if *seed == 0 {
+		*seed = time.Now().UnixNano()
+	}
+	c, err := newClient(*serverURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	started := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	total, failed := 0, 0
+	for i := range *sessions {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key, name, err := c.newUploadKey()
+			if err != nil {
+				log.Print(err)
+				mu.Lock()
+				failed++
+				mu.Unlock()
+				return
+			}
+			log.Printf("simulating %s upload %s", *motion, name)
+			u := &uploader{client: c, key: key, query: url.Values{"timestamp_unit": {"ms"}}}
+			sim := newSimulation(*seed+int64(i), *motion, trackerKeys, *noise)
+			err = sim.upload(ctx, u, *rate, *duration, *batchInterval, *heartRate, *realtime)
+			mu.Lock()
+			defer mu.Unlock()
+			total += u.uploaded
+			if err != nil && !errors.Is(err, context.Canceled) {
+				log.Printf("upload %s: %v", name, err)
+				failed++
+			}
+		}()
+	}
+	wg.Wait()
+
+	elapsed := time.Since(started)
+	log.Printf("uploaded %d records in %s (%.0f records/s), %d of %d sessions failed", total, elapsed.Round(time.Millisecond), float64(total)/elapsed.Seconds(), failed, *sessions)
+	if failed > 0 {
+		os.Exit(1)
+	}
+}
+
+// upload generates the session batch by batch and uploads each batch.
+func (s *simulation) upload(ctx context.Context, u *uploader, rate float64, duration, batchInterval time.Duration, heartRate, realtime bool) error {
+	start := time.Now()
+	dt := 1 / rate
+	samples := int(duration.Seconds() * rate)
+	nextHeartRate := 0.0
+	for sample := 0; sample < samples; {
+		batchEnd := min(sample+max(int(batchInterval.Seconds()*rate), 1), samples)
+		for ; sample < batchEnd; sample++ {
+			epoch := start.Add(time.Duration(s.t * float64(time.Second))).UnixMilli()
+			for _, record := range s.sample(epoch) {
+				u.add(mustMarshal(record))
+			}
+			if heartRate && s.t >= nextHeartRate {
+				u.add(mustMarshal(heartRateRecord{BPM: int(math.Round(s.bpm)), Epoch: epoch}))
+				nextHeartRate += 1
+			}
+			s.step(dt)
+		}
+
+		if realtime {
+			// the batch is sent once its last sample would have been taken
+			wait := time.Until(start.Add(time.Duration(s.t * float64(time.Second))))
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(wait):
+			}
+		}
+		if err := u.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func mustMarshal(v any) string {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// uploader sends the lines of a capture file to an upload in batches.
+type uploader struct {
+	client   *client
+	key      string
+	query    url.Values
+	pending  []string
+	since    time.Time // when the oldest pending line was read
+	uploaded int
+}
+
+// runUpload implements "upload": stream the records of a local NDJSON file,
+// one JSON record per line, to an upload. With -follow it keeps reading as
+// the file grows, like tail -f, until interrupted.
+func runUpload(args []string) {
+	flags := flag.NewFlagSet("upload", flag.ExitOnError)
+	serverURL := flags.String("server", defaultServer, "Base URL of the server")
+	key := flags.String("key", os.Getenv("HRDEMO_UPLOAD_KEY"), "Upload key to add the records to (default: $HRDEMO_UPLOAD_KEY, or a new key)")
+	file := flags.String("file", "", "NDJSON file to upload, one JSON record per line")
+	follow := flags.Bool("follow", false, "Keep uploading lines appended to the file until interrupted")
+	batchLines := flags.Int("batch-lines", 500, "Most lines to send in one request")
+	batchInterval := flags.Duration("batch-interval", time.Second, "With -follow, longest time a line waits for a batch to fill before it is sent")
+	pollInterval := flags.Duration("poll", 250*time.Millisecond, "With -follow, how often to check the file for new lines")
+	timestampUnit := flags.String("timestamp-unit", "", "Unit of the record timestamps: s, ms, us or auto (default: the server's)")
+	deviceID := flags.String("device-id", "", "Device id to tag the records with")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s upload -file session.ndjson [-follow] [flags]\n\nStreams the lines of a local capture file to an upload, retrying with backoff while the server is unreachable.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if *file == "" || flags.NArg() > 0 {
+		flags.Usage()
+		os.Exit(2)
+	}
+	if *batchLines < 1 {
+		log.Fatal("-batch-lines must be at least 1")
+	}
+	c, err := newClient(*serverURL)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if *key == "" {
+		var name string
+		if *key, name, err = c.newUploadKey(); err != nil {
+			log.Fatal(err)
+		}
+		// the key is the only way to add to the upload later, so show it
+		log.Printf("created upload %s with key %s", name, *key)
+	}
+	query := url.Values{}
+	if *timestampUnit != "" {
+		query.Set("timestamp_unit", *timestampUnit)
+	}
+	if *deviceID != "" {
+		query.Set("device_id", *deviceID)
+	}
+	u := &uploader{client: c, key: *key, query: query}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	err = u.tail(ctx, *file, *follow, *batchLines, *batchInterval, *pollInterval)
+	log.Printf("uploaded %d records", u.uploaded)
+	if err != nil && (!errors.Is(err, context.Canceled) || len(u.pending) > 0) {
+		log.Fatal(err)
+	}
+}
+
+// tail reads the file line by line and uploads its lines in batches of at
+// most batchLines. Without follow it stops at the end of the file; with
+// follow it waits for more until ctx is done, sending what it has after
+// batchInterval. A file that shrinks is taken to be a new capture and is
+// read again from the start.
+func (u *uploader) tail(ctx context.Context, path string, follow bool, batchLines int, batchInterval, pollInterval time.Duration) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	reader := bufio.NewReader(f)
+	var offset int64
+	var partial string // a line still being written
+
+	for {
+		chunk, err := reader.ReadString('\n')
+		offset += int64(len(chunk))
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if err == nil {
+			u.add(partial + chunk)
+			partial = ""
+			if len(u.pending) >= batchLines {
+				if err := u.flush(ctx); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		partial += chunk
+
+		// at the end of what has been written so far
+		if !follow {
+			u.add(partial)
+			return u.flush(ctx)
+		}
+		if len(u.pending) > 0 && time.Since(u.since) >= batchInterval {
+			if err := u.flush(ctx); err != nil {
+				return err
+			}
+		}
+		if info, err := f.Stat(); err == nil && info.Size() < offset {
+			log.Printf("%s was truncated, reading it from the start", path)
+			if _, err := f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			reader.Reset(f)
+			offset, partial = 0, ""
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			// give the last lines a moment to get through when interrupted
+			flushCtx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			defer cancel()
+			if err := u.flush(flushCtx); err != nil {
+				return err
+			}
+			return ctx.Err()
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// add queues a line for the next batch, skipping blank lines.
+func (u *uploader) add(line string) {
+	line = strings.TrimSpace(line)
+	if line == "" {
+		return
+	}
+	if len(u.pending) == 0 {
+		u.since = time.Now()
+	}
+	u.pending = append(u.pending, line)
+}
+
+// flush sends the pending lines as one batch, retrying with backoff while
+// the failure is temporary, until ctx is done.
+func (u *uploader) flush(ctx context.Context) error {
+	if len(u.pending) == 0 {
+		return nil
+	}
+	body := strings.Join(u.pending, "\n") + "\n"
+	var delay time.Duration
+	for {
+		err := u.client.do(http.MethodPost, u.client.apiURL("/upload", u.query), "application/x-ndjson", u.key, strings.NewReader(body), nil)
+		if err == nil {
+			u.uploaded += len(u.pending)
+			u.pending = u.pending[:0]
+			return nil
+		}
+		if !temporary(err) {
+			return fmt.Errorf("upload refused: %w", err)
+		}
+		delay = retryDelay(err, delay)
+		log.Printf("upload failed, retrying in %s: %v", delay, err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%d lines not uploaded: %w", len(u.pending), ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
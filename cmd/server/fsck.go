@@ -0,0 +1,31 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/VR-state-analysis/HR-Demo-App/server"
+)
+
+// runFsck implements "fsck": check uploads, either those given as paths or
+// all of them, and optionally repair them. It exits with status 1 if
+// problems remain.
+func runFsck(args []string) {
+	flags := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := flags.Bool("repair", false, "Rewrite uploads with problems without their torn tail and bad lines, renumbered, keeping a .bak copy of each")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s fsck [-repair] [upload.csv ...]\n\nChecks upload files for unreadable metadata, bad record lines and torn tails. Stop the server before repairing.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	unresolved, err := server.Fsck(flags.Args(), *repair)
+	if err != nil {
+		log.Fatalf("fsck: %v", err)
+	}
+	if unresolved > 0 {
+		os.Exit(1)
+	}
+}
@@ -1,67 +1,526 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
 	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/VR-state-analysis/HR-Demo-App/server"
+	"golang.org/x/crypto/acme/autocert"
 )
 
 func main() {
+	// upload keys are secrets; log lines only ever show their hash
+	log.SetOutput(server.RedactUploadKeys(os.Stderr))
+
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "migrate":
+			runMigrate(os.Args[2:])
+			return
+		case "fsck":
+			runFsck(os.Args[2:])
+			return
+		}
+	}
+
 	host := flag.String("host", "", "Host address to bind to (default: all interfaces)")
 	port := flag.Int("port", 8000, "Port number to bind to")
 	certPath := flag.String("cert", "cert.pem", "Path to SSL certificate file")
 	keyPath := flag.String("key", "key.pem", "Path to SSL private key file")
 	useTLS := flag.Bool("tls", false, "Enable TLS")
+	var listens listenFlag
+	flag.Var(&listens, "listen", "Listener as http://host:port, https://host:port or unix:///path/to.sock; repeat for several (overrides -host, -port, -tls and -listen-unix)")
+	listenUnix := flag.String("listen-unix", "", "Serve plain HTTP on this Unix domain socket instead of a TCP port, e.g. /run/hrdemo.sock")
+	unixMode := flag.String("unix-mode", "0660", "File permissions for the -listen-unix socket")
+	useAutocert := flag.Bool("autocert", false, "Obtain TLS certificates from Let's Encrypt (implies -tls, ignores -cert and -key)")
+	autocertDomains := flag.String("domains", "", "Comma-separated domains to obtain certificates for with -autocert")
+	autocertCache := flag.String("autocert-cache", "", "Directory to cache Let's Encrypt certificates and the account key in (default: hrdemo/autocert in the user cache directory)")
+	autocertEmail := flag.String("autocert-email", "", "Contact email for the Let's Encrypt account (optional)")
+	acmeHTTPAddr := flag.String("acme-http-addr", ":80", "Address for the ACME HTTP-01 challenge listener with -autocert; other requests there redirect to https")
+	clientCA := flag.String("client-ca", "", "PEM file of CAs for device client certificates; uploads then require a verified certificate (needs TLS)")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated IPs or CIDR ranges of reverse proxies whose X-Forwarded-For/X-Real-IP headers are trusted")
+	debugAddr := flag.String("debug-addr", "", "Serve pprof and expvar on this address, e.g. localhost:6060 (keep it private)")
+	mqttBroker := flag.String("mqtt-broker", "", "MQTT broker to ingest records from, e.g. tcp://localhost:1883")
+	mqttTopic := flag.String("mqtt-topic", "hr-demo/{key}/records", "MQTT topic to subscribe to; {key} marks the level holding the upload key")
+	uploadDir := flag.String("upload-dir", "uploads", "Directory to store uploads in")
+	var labels labelFlag
+	flag.Var(&labels, "label", "Label stored with every new upload and added to its exports as name=value, e.g. venue=lab-2; repeat for several (keys generated with label parameters override them)")
+	bindUploadKeys := flag.Bool("bind-upload-keys", false, "Bind each upload key to the client of its first upload (its client certificate, else its IP and User-Agent) and refuse uploads from other clients with 403")
+	uploadKeyQuery := flag.Bool("allow-upload-key-query", false, "Also accept upload keys as upload_key query parameter, for old clients; query strings end up in logs and browser history, so clients should send an X-Upload-Key or Authorization: Bearer header")
+	signedUploads := flag.Bool("signed-uploads", false, "Give new upload keys a signing id and secret and require uploads to be HMAC-signed with them instead of passing upload_key")
+	uploadKeyTTL := flag.Duration("upload-key-ttl", 0, "How long new upload keys accept uploads, e.g. 720h (0 for ever)")
+	wordlist := flag.String("wordlist", "", "File with the words for upload names, one per line (default: built-in English list)")
+	nameWords := flag.Int("name-words", 4, "Number of words in upload names")
+	compressStorage := flag.Bool("compress-storage", false, "Store new uploads as seekable zstd, one frame per appended batch, with a .frames index next to each file")
+	quantizePosition := flag.Float64("quantize-position", 0, "Round stored positions of new uploads to this step in meters, e.g. 0.0001 for 0.1mm (0 keeps full precision)")
+	timestampUnit := flag.String("timestamp-unit", "auto", "Unit of record timestamps for uploads that don't pass timestamp_unit: s, ms, us or auto (detect Unix times by magnitude, relative times are ms)")
+	timestampOrder := flag.String("timestamp-order", "off", "What to do with uploads whose timestamps go backwards per tracker, unless they pass timestamp_order: off, reject or reorder")
+	dedupeWindow := flag.Int("dedupe-window", 0, "Drop uploaded records whose tracker and timestamp repeat one of the last N records of their upload (0 disables)")
+	recordReceiveTime := flag.Bool("record-receive-time", false, "Add the server receive time to every record of new uploads as server_received_at (changes the stored records)")
+	formatVersion := flag.Int("format-version", 2, "File format of new uploads: 2, or 1 for tools that only read the older index,json record lines")
+	fsckMode := flag.String("fsck", "check", "Check upload files at startup: off, check (log problems and report them on /api/admin/fsck) or repair (also fix them, keeping .bak copies)")
+	adminToken := flag.String("admin-token", "", "Bearer token for the /api/admin endpoints (empty disables them)")
+	erasureKey := flag.String("erasure-key", "", "File with the Ed25519 key that signs the reports of /api/admin/erase, created if missing (default: a new key every start)")
+	accessPolicy := flag.String("access-policy", "", "File of role tokens and per-endpoint roles (device, viewer, researcher, admin); enforces roles on every endpoint, as does -oidc-issuer")
+	oidcIssuer := flag.String("oidc-issuer", "", "OpenID Connect issuer URL; people then sign in there to use the dashboard and the API with the role of -oidc-roles (uploads keep using upload keys)")
+	oidcClientID := flag.String("oidc-client-id", "", "Client id of this server at the -oidc-issuer; its secret is read from OIDC_CLIENT_SECRET, and OIDC_SESSION_SECRET keeps sessions valid across restarts")
+	oidcRedirectURL := flag.String("oidc-redirect-url", "", "Callback URL registered at the -oidc-issuer, e.g. https://example.org/api/v1/auth/callback")
+	oidcRoleClaim := flag.String("oidc-role-claim", "groups", "ID token claim whose values -oidc-roles maps to roles")
+	oidcRoles := flag.String("oidc-roles", "", "Comma-separated value=role pairs mapping -oidc-role-claim values to roles, e.g. hr-admins=admin,lab=researcher (others get -oidc-default-role)")
+	oidcDefaultRole := flag.String("oidc-default-role", "", "Role of people whose -oidc-role-claim values -oidc-roles doesn't map, e.g. viewer (empty refuses them sign-in)")
+	oidcPages := flag.String("oidc-pages", "/viewer.html", "Comma-separated dashboard pages that require sign-in with -oidc-issuer")
+	userAgentPolicy := flag.String("user-agent", "keep", "What to store and log of client User-Agents: keep, hash (a SHA-256 prefix) or omit")
+	dropClientIPs := flag.Bool("drop-client-ips", false, "Don't store client IPs in upload metadata or log them per request")
+	quotaUploadRecords := flag.Int64("quota-upload-records", 0, "Most records an upload key may store (0 for no limit)")
+	quotaUploadBytes := flag.Int64("quota-upload-bytes", 0, "Most bytes of records an upload key may store (0 for no limit)")
+	quotaTenantRecords := flag.Int64("quota-tenant-records", 0, "Most records the uploads of a tenant may store together (0 for no limit)")
+	quotaTenantBytes := flag.Int64("quota-tenant-bytes", 0, "Most bytes of records the uploads of a tenant may store together (0 for no limit)")
+	minFreeSpace := flag.Int64("min-free-space", 0, "Refuse uploads with 507 once fewer than this many bytes would stay free on the upload volume (0 disables)")
+	diskAlertWebhook := flag.String("disk-alert-webhook", "", "URL to POST a JSON event to when free space falls below -min-free-space and when it recovers")
+	coldStorage := flag.String("cold-storage", "", "Move closed, idle uploads to this directory or s3://bucket/prefix?region=...&endpoint=... (credentials from AWS_* variables), leaving a stub behind")
+	coldAfterDays := flag.Float64("cold-after", 30, "Days an upload must go without writes before -cold-storage moves it")
+	recordScript := flag.String("record-script", "", "Starlark script file whose ingest function filters and transforms records and whose export function adds computed fields to NDJSON exports")
+	analysisPlugins := flag.String("analysis-plugins", "", "Directory of WASM analysis plugins (<name>.wasm) runnable with POST /api/uploads/{key}/analyze?plugin=<name>")
+	wasmRuntime := flag.String("wasm-runtime", "wasmtime run", "WASI runtime command line that analysis plugins are run with, followed by the plugin path; the runtime is a separate program that must be installed, and the server refuses to start without it")
+	relayUpstreams := flag.String("relay", "", "Comma-separated base URLs of upstream servers that every stored batch is also sent to")
+	relayQueue := flag.String("relay-queue", "", "Directory that batches wait in until the -relay upstreams accept them (default: hrdemo/relay-queue in the user cache directory)")
+	traceUploadsDir := flag.String("trace-uploads", "", "Record the headers and raw bodies of upload requests in this directory, one trace per upload key, for replaying with \"hrdemo replay\" (traces hold upload keys and records)")
+	adminEventQueue := flag.Int("admin-event-queue", 256, "How many events an admin event stream can fall behind before -admin-event-overflow applies")
+	adminEventOverflow := flag.String("admin-event-overflow", "drop-oldest", "What to do with admin event streams that fall further behind: drop-oldest (and send a dropped event) or disconnect")
+	followMinInterval := flag.Duration("follow-min-interval", 0, "Refuse follow polls of an upload by one client with 429 when sustained faster than this, e.g. 500ms (0 disables)")
+	followBurst := flag.Int("follow-burst", 10, "How many follow polls a client may make faster than -follow-min-interval, e.g. to page through a backlog")
+	maxConcurrentUploads := flag.Int("max-concurrent-uploads", 0, "Most upload requests handled at once; more wait in -upload-queue or get 503 with Retry-After (0 for no limit)")
+	uploadQueue := flag.Int("upload-queue", 100, "With -max-concurrent-uploads, how many upload requests may wait for their turn, for up to 10s")
+	writeBehind := flag.Duration("write-behind", 0, "Acknowledge uploads once buffered in memory and write them every this often, e.g. 200ms, to save disk writes with many small batches; records not yet written are lost if the server crashes (0 writes every batch before acknowledging it)")
+	writeBehindRecords := flag.Int("write-behind-records", 1000, "With -write-behind, write an upload's buffered records early once this many are waiting")
+	streamKeepalive := flag.Duration("stream-keepalive", 15*time.Second, "How often quiet event streams (admin events, replay) send a keepalive comment so proxies don't drop them (0 disables)")
+	streamIdleTimeout := flag.Duration("stream-idle-timeout", 0, "End event streams that sent no event for this long; clients reconnect and resume (0 keeps them open)")
+	publishTarget := flag.String("publish", "", "Forward ingested batches to nats://host:port/subject or kafka+http://rest-proxy:port/topic")
 
 	flag.Parse()
 
-	if (*certPath != "" || *keyPath != "") && !*useTLS {
-		log.Print("TLS cert and/or key path provided but not using TLS.")
+	if err := server.SetTrustedProxies(*trustedProxies); err != nil {
+		log.Fatal(err)
+	}
+
+	server.SetUploadDir(*uploadDir)
+	if err := server.LoadUploadKeyState(); err != nil {
+		log.Fatalf("failed to load upload key state: %v", err)
+	}
+
+	if *wordlist != "" {
+		if err := server.LoadUploadNameWords(*wordlist); err != nil {
+			log.Fatalf("failed to load wordlist: %v", err)
+		}
+	}
+	if err := server.SetUploadKeyTTL(*uploadKeyTTL); err != nil {
+		log.Fatal(err)
+	}
+	server.SetUploadKeyBinding(*bindUploadKeys)
+	server.SetSignedUploads(*signedUploads)
+	server.SetUploadKeyQuery(*uploadKeyQuery)
+	if err := server.SetUploadLabels(labels); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetUploadNameWordCount(*nameWords); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.RestoreUploadNameSuffixes(); err != nil {
+		log.Fatalf("failed to restore upload names: %v", err)
+	}
+
+	if *compressStorage {
+		server.EnableCompressedStorage()
+	}
+
+	if err := server.SetTimestampUnit(*timestampUnit); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetPositionQuantization(*quantizePosition); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetUploadFormatVersion(*formatVersion); err != nil {
+		log.Fatal(err)
+	}
+	if *recordReceiveTime {
+		server.EnableRecordReceiveTime()
+	}
+	if err := server.SetDedupeWindow(*dedupeWindow); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetTimestampOrder(*timestampOrder); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := server.SetIngestConcurrency(*maxConcurrentUploads, *uploadQueue); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetWriteBehind(*writeBehind, *writeBehindRecords); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetFollowRateLimit(*followMinInterval, *followBurst); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetStreamKeepalive(*streamKeepalive); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetStreamIdleTimeout(*streamIdleTimeout); err != nil {
+		log.Fatal(err)
+	}
+
+	server.SetAdminToken(*adminToken)
+	if *erasureKey != "" {
+		if err := server.SetErasureSigningKey(*erasureKey); err != nil {
+			log.Fatalf("invalid -erasure-key: %v", err)
+		}
+	}
+	if *accessPolicy != "" {
+		if err := server.LoadAccessPolicy(*accessPolicy); err != nil {
+			log.Fatalf("invalid -access-policy: %v", err)
+		}
+	}
+	if *oidcIssuer != "" {
+		roles, err := parseRoleMap(*oidcRoles)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// secrets stay out of the process list
+		err = server.EnableOIDC(server.OIDCConfig{
+			Issuer:        *oidcIssuer,
+			ClientID:      *oidcClientID,
+			ClientSecret:  os.Getenv("OIDC_CLIENT_SECRET"),
+			RedirectURL:   *oidcRedirectURL,
+			RoleClaim:     *oidcRoleClaim,
+			Roles:         roles,
+			DefaultRole:   *oidcDefaultRole,
+			SessionSecret: os.Getenv("OIDC_SESSION_SECRET"),
+		})
+		if err != nil {
+			log.Fatalf("failed to enable OIDC: %v", err)
+		}
+	}
+	if err := server.SetAdminEventQueue(*adminEventQueue, *adminEventOverflow); err != nil {
+		log.Fatal(err)
+	}
+
+	if err := server.SetUserAgentPolicy(*userAgentPolicy); err != nil {
+		log.Fatal(err)
+	}
+	if *dropClientIPs {
+		server.DropClientIPs()
+	}
+	if err := server.SetUploadQuota(*quotaUploadRecords, *quotaUploadBytes); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetTenantQuota(*quotaTenantRecords, *quotaTenantBytes); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetMinFreeSpace(*minFreeSpace); err != nil {
+		log.Fatal(err)
+	}
+	if err := server.SetDiskAlertWebhook(*diskAlertWebhook); err != nil {
+		log.Fatal(err)
+	}
+	if *recordScript != "" {
+		if err := server.SetRecordScript(*recordScript); err != nil {
+			log.Fatalf("invalid -record-script: %v", err)
+		}
+	}
+	if *analysisPlugins != "" {
+		if err := server.SetAnalysisPlugins(*analysisPlugins, *wasmRuntime); err != nil {
+			log.Fatalf("invalid -analysis-plugins: %v", err)
+		}
+	}
+	if *coldStorage != "" {
+		if err := server.SetColdStorage(*coldStorage, time.Duration(*coldAfterDays*24*float64(time.Hour))); err != nil {
+			log.Fatalf("invalid -cold-storage: %v", err)
+		}
+	}
+
+	if *traceUploadsDir != "" {
+		if err := server.SetUploadTraceDir(*traceUploadsDir); err != nil {
+			log.Fatalf("invalid -trace-uploads: %v", err)
+		}
+	}
+
+	switch *fsckMode {
+	case "off":
+	case "check", "repair":
+		if _, err := server.Fsck(nil, *fsckMode == "repair"); err != nil {
+			log.Fatalf("failed to check uploads: %v", err)
+		}
+	default:
+		log.Fatalf("invalid -fsck %q: must be off, check or repair", *fsckMode)
+	}
+	if err := server.BuildUploadIndex(); err != nil {
+		log.Fatalf("failed to index uploads: %v", err)
+	}
+
+	if *publishTarget != "" {
+		if err := server.StartPublisher(*publishTarget); err != nil {
+			log.Fatalf("failed to start publisher: %v", err)
+		}
 	}
 
-	addr := fmt.Sprintf("%s:%d", *host, *port)
-	if *host == "" {
-		addr = fmt.Sprintf(":%d", *port)
+	if *relayUpstreams != "" {
+		if *relayQueue == "" {
+			*relayQueue = userCacheDir("relay-queue", "-relay-queue")
+		}
+		if err := server.StartRelay(strings.Split(*relayUpstreams, ","), *relayQueue); err != nil {
+			log.Fatalf("failed to start relay: %v", err)
+		}
+	}
+
+	if *mqttBroker != "" {
+		if err := server.StartMQTTIngest(*mqttBroker, *mqttTopic); err != nil {
+			log.Fatalf("failed to start mqtt ingest: %v", err)
+		}
+	}
+
+	if *debugAddr != "" {
+		go func() {
+			log.Printf("Serving debug endpoints on %s", *debugAddr)
+			if err := http.ListenAndServe(*debugAddr, server.DebugHandler()); err != nil {
+				log.Fatalf("debug server error: %v", err)
+			}
+		}()
+	}
+
+	if len(listens) == 0 {
+		// without -listen, a single listener is described by the older flags
+		switch {
+		case *listenUnix != "":
+			if *useTLS {
+				log.Print("TLS is not used on the unix socket; terminate TLS in the reverse proxy.")
+			}
+			listens = append(listens, listenSpec{scheme: "unix", addr: *listenUnix})
+		case *useTLS || *useAutocert:
+			listens = append(listens, listenSpec{scheme: "https", addr: net.JoinHostPort(*host, strconv.Itoa(*port))})
+		default:
+			listens = append(listens, listenSpec{scheme: "http", addr: net.JoinHostPort(*host, strconv.Itoa(*port))})
+		}
+	}
+
+	anyTLS := false
+	for _, l := range listens {
+		anyTLS = anyTLS || l.scheme == "https"
+	}
+
+	if (*certPath != "" || *keyPath != "") && !anyTLS {
+		log.Print("TLS cert and/or key path provided but not using TLS.")
 	}
 
 	mux := http.NewServeMux()
-	mux.HandleFunc("POST /api/new-upload-key", server.NewUploadKeyHandler)
-	mux.HandleFunc("POST /api/upload", server.UploadHandler)
-	mux.HandleFunc("GET /api/follow", server.FollowHandler)
+	server.RegisterRoutes(mux)
+
+	mux.Handle("/", server.RequireLoginForPages(server.StaticFiles("."), strings.Split(*oidcPages, ",")))
 
-	fileServer := http.FileServer(http.Dir("."))
-	mux.Handle("/", fileServer)
+	handler := server.RequestLogger(mux)
 
-	hs := &http.Server{
-		Addr:    addr,
-		Handler: mux,
+	var tlsConfig *tls.Config
+	if *useAutocert {
+		domains := strings.FieldsFunc(*autocertDomains, func(r rune) bool { return r == ',' || r == ' ' })
+		if len(domains) == 0 {
+			log.Fatal("-autocert requires -domains")
+		}
+		if *autocertCache == "" {
+			*autocertCache = userCacheDir("autocert", "-autocert-cache")
+		}
+		certManager := &autocert.Manager{
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(domains...),
+			Cache:      autocert.DirCache(*autocertCache),
+			Email:      *autocertEmail,
+		}
+		tlsConfig = certManager.TLSConfig()
+
+		go func() {
+			log.Printf("Serving ACME HTTP-01 challenges on %s for %s", *acmeHTTPAddr, strings.Join(domains, ", "))
+			if err := http.ListenAndServe(*acmeHTTPAddr, certManager.HTTPHandler(nil)); err != nil {
+				log.Fatalf("acme challenge server error: %v", err)
+			}
+		}()
+	} else if anyTLS {
+		cert, err := tls.LoadX509KeyPair(*certPath, *keyPath)
+		if err != nil {
+			log.Fatalf("failed to load TLS certificate: %v", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+	}
+	if tlsConfig != nil {
+		tlsConfig.MinVersion = tls.VersionTLS12
 	}
 
-	scheme := "http"
-	if *useTLS {
-		hs.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
-		scheme = "https"
+	if *clientCA != "" {
+		if tlsConfig == nil {
+			log.Fatal("-client-ca requires a TLS listener")
+		}
+		pool, err := server.LoadClientCAs(*clientCA)
+		if err != nil {
+			log.Fatalf("failed to load client CAs: %v", err)
+		}
+		// certificates are optional at the TLS layer so that viewers can still
+		// follow sessions; the upload handler enforces them
+		tlsConfig.ClientCAs = pool
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		server.EnableClientCertAuth()
 	}
 
-	displayHost := *host
-	if displayHost == "" {
-		displayHost = "all interfaces"
+	log.Printf("HR-Demo-App server %s", server.VersionString())
+
+	unixFileMode, err := strconv.ParseUint(*unixMode, 8, 32)
+	if err != nil {
+		log.Fatalf("invalid -unix-mode %q: must be octal, e.g. 0660", *unixMode)
 	}
 
-	log.Printf("Serving %s on %s:%d", scheme, displayHost, *port)
+	// stop serving and let background jobs finish on SIGINT or SIGTERM
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	server.StartJobs()
 
-	if *useTLS {
-		if err := hs.ListenAndServeTLS(*certPath, *keyPath); err != nil {
-			log.Fatalf("http server error: %v", err)
+	// all listeners share one handler; the first one to fail stops the server
+	errs := make(chan error, len(listens))
+	var servers []*http.Server
+	for _, l := range listens {
+		var listener net.Listener
+		if l.scheme == "unix" {
+			listener, err = server.ListenUnix(l.addr, os.FileMode(unixFileMode))
+		} else {
+			listener, err = net.Listen("tcp", l.addr)
+		}
+		if err != nil {
+			log.Fatalf("failed to listen on %s: %v", l, err)
 		}
-		return
+
+		hs := &http.Server{Handler: handler, TLSConfig: tlsConfig}
+		servers = append(servers, hs)
+
+		log.Printf("Serving %s", l)
+		go func() {
+			if l.scheme == "https" {
+				errs <- fmt.Errorf("%s: %w", l, hs.ServeTLS(listener, "", ""))
+				return
+			}
+			errs <- fmt.Errorf("%s: %w", l, hs.Serve(listener))
+		}()
 	}
 
-	if err := hs.ListenAndServe(); err != nil {
+	select {
+	case err := <-errs:
 		log.Fatalf("http server error: %v", err)
+	case <-ctx.Done():
+	}
+
+	log.Print("Shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, hs := range servers {
+		if err := hs.Shutdown(shutdownCtx); err != nil {
+			log.Printf("failed to shut down http server: %v", err)
+		}
+	}
+	if err := server.StopJobs(shutdownCtx); err != nil {
+		log.Printf("failed to stop background jobs: %v", err)
+	}
+	// uploads acknowledged during shutdown may still be buffered
+	if err := server.FlushWriteBehind(); err != nil {
+		log.Printf("failed to write buffered uploads: %v", err)
+	}
+}
+
+// shutdownTimeout is how long requests and background jobs get to finish
+// when the server is stopped.
+const shutdownTimeout = 10 * time.Second
+
+// listenSpec is one address the server listens on.
+type listenSpec struct {
+	scheme string // http, https or unix
+	addr   string
+}
+
+func (l listenSpec) String() string {
+	if l.scheme == "unix" {
+		return "unix://" + l.addr
+	}
+	return l.scheme + "://" + l.addr
+}
+
+// listenFlag collects repeated -listen flags.
+type listenFlag []listenSpec
+
+func (f *listenFlag) String() string {
+	specs := make([]string, len(*f))
+	for i, l := range *f {
+		specs[i] = l.String()
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *listenFlag) Set(value string) error {
+	scheme, addr, ok := strings.Cut(value, "://")
+	if !ok || addr == "" {
+		return fmt.Errorf("invalid listener %q: expected http://host:port, https://host:port or unix:///path", value)
+	}
+	switch scheme {
+	case "http", "https":
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return fmt.Errorf("invalid listener %q: %w", value, err)
+		}
+	case "unix":
+	default:
+		return fmt.Errorf("invalid listener scheme %q: must be http, https or unix", scheme)
+	}
+	*f = append(*f, listenSpec{scheme: scheme, addr: addr})
+	return nil
+}
+
+// labelFlag collects repeated -label flags; the server validates them.
+type labelFlag []string
+
+func (f *labelFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *labelFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
+
+// parseRoleMap parses -oidc-roles; the server validates the roles.
+func parseRoleMap(list string) (map[string]string, error) {
+	roles := make(map[string]string)
+	for _, pair := range strings.Split(list, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		value, role, ok := strings.Cut(pair, "=")
+		if !ok || value == "" {
+			return nil, fmt.Errorf("invalid -oidc-roles entry %q: expected value=role", pair)
+		}
+		roles[value] = role
+	}
+	return roles, nil
+}
+
+// userCacheDir returns the default directory name, in the hrdemo directory
+// of the user cache directory. The server's state stays out of the working
+// directory, which the dashboard is served from; flagName overrides it.
+func userCacheDir(name, flagName string) string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		log.Fatalf("failed to find a directory for %s: %v; pass %s", name, err, flagName)
 	}
+	return filepath.Join(dir, "hrdemo", name)
 }
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/VR-state-analysis/HR-Demo-App/server"
+)
+
+// runMigrate implements "migrate": rewrite uploads in the current file
+// format, either those given as paths or all of them.
+func runMigrate(args []string) {
+	flags := flag.NewFlagSet("migrate", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only list the uploads that would be migrated")
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage: %s migrate [-dry-run] [upload.csv ...]\n\nRewrites v1 uploads in the v2 file format. Stop the server first.\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	flags.Parse(args)
+
+	if flags.NArg() == 0 {
+		migrated, err := server.MigrateUploads(*dryRun)
+		for _, filePath := range migrated {
+			fmt.Println(filePath)
+		}
+		if err != nil {
+			log.Fatalf("migrate: %v", err)
+		}
+		return
+	}
+
+	for _, filePath := range flags.Args() {
+		migrated, err := server.MigrateUpload(filePath, *dryRun)
+		if err != nil {
+			log.Fatalf("migrate %s: %v", filePath, err)
+		}
+		if migrated {
+			fmt.Println(filePath)
+		}
+	}
+}
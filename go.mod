@@ -1,3 +1,16 @@
 module github.com/VR-state-analysis/HR-Demo-App
 
 go 1.24.6
+
+require (
+	github.com/cespare/xxhash/v2 v2.1.2
+	github.com/klauspost/compress v1.18.0
+	go.starlark.net v0.0.0-20231121155337-90ade8b19d09
+	golang.org/x/crypto v0.41.0
+)
+
+require (
+	golang.org/x/net v0.42.0 // indirect
+	golang.org/x/sys v0.35.0 // indirect
+	golang.org/x/text v0.28.0 // indirect
+)
@@ -67,9 +67,10 @@ def download_data(upload_key: str, min_records: int = 100, start_position: int =
     """
     position = start_position
     
-    url = f"{BASE_URL}/api/follow?upload_key={upload_key}&position={position}"
+    url = f"{BASE_URL}/api/follow?position={position}"
+    req = Request(url, headers={'X-Upload-Key': upload_key})
     
-    with urlopen(url, timeout=10) as response:
+    with urlopen(req, timeout=10) as response:
         status_code = response.status
         
         if status_code == 204:
@@ -194,13 +195,13 @@ def upload_results(upload_key: str, predictions: List[Tuple[Any, float]], sdnn:
         lines.append(json.dumps(record))
     
     # Upload in batches
-    url = f"{BASE_URL}/api/upload?upload_key={upload_key}"
+    url = f"{BASE_URL}/api/upload"
     body = '\n'.join(lines).encode('utf-8')
     
     req = Request(
         url,
         data=body,
-        headers={'Content-Type': 'application/x-ndjson'},
+        headers={'Content-Type': 'application/x-ndjson', 'X-Upload-Key': upload_key},
         method='POST'
     )
     
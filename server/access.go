@@ -0,0 +1,164 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+)
+
+// Every API endpoint needs a role, from least to most privileged:
+//
+//   - device: anyone; the endpoint checks an upload key itself
+//   - viewer: follow and look at sessions, but not download raw records,
+//     as exports, trajectories, replays and tails do
+//   - researcher: also export, replay, analyze and annotate sessions
+//   - admin: also the admin API, which alone can revoke and delete
+//
+// Requests get their role from an OIDC session, the admin token or a token
+// of the access policy; anything else, including requests that only carry
+// an upload key, is a device. Access control is enforced while OIDC is
+// enabled or an access policy is loaded. Otherwise the server stays open as
+// it always was, and only the admin API needs the admin role.
+
+const (
+	roleDevice     = "device"
+	roleViewer     = "viewer"
+	roleResearcher = "researcher"
+	roleAdmin      = "admin"
+)
+
+// roles is every role, least privileged first.
+var roles = []string{roleDevice, roleViewer, roleResearcher, roleAdmin}
+
+func validRole(role string) bool {
+	return slices.Contains(roles, role)
+}
+
+// roleAtLeast reports whether role has all permissions of required.
+func roleAtLeast(role, required string) bool {
+	return slices.Index(roles, role) >= slices.Index(roles, required)
+}
+
+// accessPolicy is a loaded access policy file. Set by LoadAccessPolicy.
+var accessPolicy *policy
+
+type policy struct {
+	routes map[string]string // route pattern -> role, overriding the default
+	tokens map[string]string // SHA-256 of token -> role
+}
+
+// LoadAccessPolicy enforces roles on every endpoint and reads the tokens
+// and per-endpoint roles in path. Blank lines and lines starting with # are
+// ignored; other lines are one of
+//
+//	token <role> <token>
+//	route <method> <pattern> <role>
+//
+// where patterns are those of the API relative to /api/v1, e.g.
+// "route GET /follow device" lets devices follow their own uploads.
+func LoadAccessPolicy(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	p := &policy{routes: map[string]string{}, tokens: map[string]string{}}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		switch {
+		case fields[0] == "token" && len(fields) == 3:
+			if !validRole(fields[1]) {
+				return fmt.Errorf("%s:%d: invalid role %q: must be one of %s", path, line, fields[1], strings.Join(roles, ", "))
+			}
+			p.tokens[tokenHash(fields[2])] = fields[1]
+		case fields[0] == "route" && len(fields) == 4:
+			pattern := fields[1] + " " + fields[2]
+			if !slices.ContainsFunc(apiRoutes, func(route apiRoute) bool { return route.pattern == pattern }) {
+				return fmt.Errorf("%s:%d: no endpoint %q", path, line, pattern)
+			}
+			if !validRole(fields[3]) {
+				return fmt.Errorf("%s:%d: invalid role %q: must be one of %s", path, line, fields[3], strings.Join(roles, ", "))
+			}
+			p.routes[pattern] = fields[3]
+		default:
+			return fmt.Errorf("%s:%d: expected \"token <role> <token>\" or \"route <method> <pattern> <role>\"", path, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+	accessPolicy = p
+	return nil
+}
+
+func tokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// accessControlled reports whether roles are enforced on every endpoint.
+func accessControlled() bool {
+	return oidc != nil || accessPolicy != nil
+}
+
+// requestRole returns the role of r and whether r identified itself with a
+// session or token at all.
+func requestRole(r *http.Request) (string, bool) {
+	if id, ok := sessionIdentity(r); ok {
+		return id.Role, true
+	}
+	if token, ok := bearerToken(r); ok {
+		if adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1 {
+			return roleAdmin, true
+		}
+		if accessPolicy != nil {
+			if role, ok := accessPolicy.tokens[tokenHash(token)]; ok {
+				return role, true
+			}
+		}
+	}
+	return roleDevice, false
+}
+
+// authorize serves the endpoint pattern only to requests with at least its
+// role: the one in the access policy, else role.
+func authorize(pattern, role string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		required := role
+		if accessPolicy != nil {
+			if policyRole, ok := accessPolicy.routes[pattern]; ok {
+				required = policyRole
+			}
+		}
+		if required == roleAdmin && adminToken == "" && !accessControlled() {
+			writeError(w, http.StatusForbidden, errCodeAdminDisabled, "admin API is disabled; start the server with -admin-token, -access-policy or -oidc-issuer")
+			return
+		}
+		if required != roleAdmin && !accessControlled() {
+			handler(w, r)
+			return
+		}
+
+		got, identified := requestRole(r)
+		switch {
+		case roleAtLeast(got, required):
+			handler(w, r)
+		case !identified:
+			w.Header().Set("WWW-Authenticate", `Bearer realm="hrdemo"`)
+			writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "this endpoint needs the "+required+" role: sign in at /api/v"+apiVersion+"/auth/login or pass a token")
+		default:
+			writeError(w, http.StatusForbidden, errCodeForbidden, "this endpoint needs the "+required+" role, not "+got)
+		}
+	}
+}
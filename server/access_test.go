@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAccessPolicy(t *testing.T) {
+	chdirTemp(t)
+	policy := strings.Join([]string{
+		"# tokens of the study team",
+		"token viewer watch",
+		"token researcher study",
+		"",
+		"route GET /uploads/{key}/summary device",
+	}, "\n")
+	if err := os.WriteFile("policy", []byte(policy), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadAccessPolicy("policy"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { accessPolicy = nil })
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+
+	for _, test := range []struct {
+		token, method, path string
+		want                int
+	}{
+		{"", "GET", "/api/v1/uploads/" + key + "/export", http.StatusUnauthorized},
+		{"watch", "GET", "/api/v1/uploads/" + key + "/export", http.StatusForbidden},
+		{"study", "GET", "/api/v1/uploads/" + key + "/export", http.StatusOK},
+		{"wrong", "GET", "/api/v1/uploads/" + key + "/trajectory", http.StatusUnauthorized},
+		{"watch", "GET", "/api/v1/uploads/" + key + "/trajectory", http.StatusForbidden},
+		{"watch", "GET", "/api/v1/uploads/" + key + "/replay", http.StatusForbidden},
+		{"watch", "GET", "/api/v1/uploads/" + key + "/tail", http.StatusForbidden},
+		{"study", "GET", "/api/v1/uploads/" + key + "/trajectory", http.StatusOK},
+		{"", "GET", "/api/v1/uploads/" + key + "/summary", http.StatusOK},
+		{"study", "GET", "/api/v1/admin/quotas", http.StatusForbidden},
+		{"", "GET", "/api/v1/version", http.StatusOK},
+	} {
+		req := httptest.NewRequest(test.method, test.path, nil)
+		if test.token != "" {
+			req.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		if rec.Code != test.want {
+			t.Errorf("%s %s with token %q: status = %d, want %d: %s", test.method, test.path, test.token, rec.Code, test.want, rec.Body)
+		}
+	}
+}
+
+func TestLoadAccessPolicyErrors(t *testing.T) {
+	chdirTemp(t)
+	t.Cleanup(func() { accessPolicy = nil })
+	for _, policy := range []string{
+		"token owner secret",
+		"token viewer",
+		"route GET /nope viewer",
+		"route GET /follow superuser",
+		"allow everyone",
+	} {
+		if err := os.WriteFile("policy", []byte(policy), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadAccessPolicy("policy"); err == nil {
+			t.Errorf("policy %q loaded", policy)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+package server
+
+// adminToken is the bearer token of the admin API. Empty disables it. Set by
+// SetAdminToken.
+var adminToken string
+
+// SetAdminToken enables the /api/admin endpoints for requests carrying
+// "Authorization: Bearer <token>".
+func SetAdminToken(token string) {
+	adminToken = token
+}
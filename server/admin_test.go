@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAuthorizeAdmin(t *testing.T) {
+	handler := authorize("GET /admin/fsck", roleAdmin, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	request := func(authorization string) int {
+		req := httptest.NewRequest("GET", "/api/admin/fsck", nil)
+		if authorization != "" {
+			req.Header.Set("Authorization", authorization)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	if code := request("Bearer secret"); code != http.StatusForbidden {
+		t.Fatalf("disabled admin API status = %d", code)
+	}
+
+	SetAdminToken("secret")
+	t.Cleanup(func() { SetAdminToken("") })
+	for authorization, want := range map[string]int{
+		"":              http.StatusUnauthorized,
+		"Bearer wrong":  http.StatusUnauthorized,
+		"Basic secret":  http.StatusUnauthorized,
+		"Bearer secret": http.StatusNoContent,
+		"bearer secret": http.StatusNoContent,
+	} {
+		if code := request(authorization); code != want {
+			t.Fatalf("Authorization %q: status = %d, want %d", authorization, code, want)
+		}
+	}
+}
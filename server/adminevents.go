@@ -0,0 +1,195 @@
+package server
+
+import (
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Server-wide activity is published as admin events, which
+// AdminEventsHandler streams to the ops dashboard.
+const (
+	adminEventKeyCreated       = "key_created"
+	adminEventSessionStarted   = "session_started"
+	adminEventSessionEnded     = "session_ended"
+	adminEventUploadRejected   = "upload_rejected"
+	adminEventUploadArchived   = "upload_archived"
+	adminEventUploadRehydrated = "upload_rehydrated"
+	adminEventUploadErased     = "upload_erased"
+)
+
+// Subscribers that fall behind by more than their queue, e.g. a dashboard
+// tab left in the background, lose events as the overflow policy says, so
+// a stalled one can't make the queue grow without bound.
+const (
+	// adminEventsDropOldest drops the oldest queued event for the new one
+	// and tells the subscriber how many it missed.
+	adminEventsDropOldest = "drop-oldest"
+	// adminEventsDisconnect ends the stream of the subscriber; its
+	// EventSource reconnects.
+	adminEventsDisconnect = "disconnect"
+)
+
+var (
+	// adminEventQueueSize is how many events a subscriber can fall behind.
+	adminEventQueueSize = 256
+	adminEventOverflow  = adminEventsDropOldest
+)
+
+// SetAdminEventQueue sets how many events an admin event subscriber can
+// fall behind and what happens when it falls further: drop-oldest or
+// disconnect.
+func SetAdminEventQueue(size int, overflow string) error {
+	if size < 1 {
+		return fmt.Errorf("invalid admin event queue size %d: must be at least 1", size)
+	}
+	switch overflow {
+	case adminEventsDropOldest, adminEventsDisconnect:
+	default:
+		return fmt.Errorf("invalid admin event overflow policy %q: must be drop-oldest or disconnect", overflow)
+	}
+	adminEventQueueSize, adminEventOverflow = size, overflow
+	return nil
+}
+
+// adminEvent is one event. Details depend on the type.
+type adminEvent struct {
+	ID         int64          `json:"id"`
+	Type       string         `json:"type"`
+	Time       time.Time      `json:"time"`
+	UploadName string         `json:"upload_name,omitempty"`
+	KeyHash    string         `json:"key_hash,omitempty"`
+	Details    map[string]any `json:"details,omitempty"`
+}
+
+// adminEventSubscriber is the queue of one admin event stream.
+type adminEventSubscriber struct {
+	events chan adminEvent
+	// dropped counts the events dropped since the last one received
+	dropped atomic.Int64
+	// overflowed is closed when the subscriber is disconnected
+	overflowed chan struct{}
+}
+
+var (
+	adminEventSubscribers = map[*adminEventSubscriber]struct{}{}
+	adminEventsMutex      sync.Mutex
+	lastAdminEventID      int64
+
+	adminEventsDropped          = expvar.NewInt("admin_events_dropped")
+	adminEventSubscribersClosed = expvar.NewInt("admin_event_subscribers_disconnected")
+)
+
+// publishAdminEvent sends an event about uploadKey, which may be empty, to
+// every subscriber. It never blocks: subscribers that are too far behind
+// lose events by the overflow policy.
+func publishAdminEvent(eventType, uploadKey string, details map[string]any) {
+	event := adminEvent{Type: eventType, Time: time.Now().UTC(), Details: details}
+	if uploadKey != "" {
+		event.UploadName, event.KeyHash = uploadNameFromKey(uploadKey), uploadKeyHash(uploadKey)
+	}
+
+	adminEventsMutex.Lock()
+	defer adminEventsMutex.Unlock()
+	lastAdminEventID++
+	event.ID = lastAdminEventID
+	for subscriber := range adminEventSubscribers {
+		select {
+		case subscriber.events <- event:
+			continue
+		default:
+		}
+
+		if adminEventOverflow == adminEventsDisconnect {
+			adminEventsDropped.Add(int64(len(subscriber.events)) + 1)
+			adminEventSubscribersClosed.Add(1)
+			close(subscriber.overflowed)
+			delete(adminEventSubscribers, subscriber)
+			continue
+		}
+		// the only sender holds the mutex, so once one is taken out there
+		// is room, unless the subscriber emptied the queue in between
+		select {
+		case <-subscriber.events:
+			subscriber.dropped.Add(1)
+			adminEventsDropped.Add(1)
+		default:
+		}
+		subscriber.events <- event
+	}
+}
+
+func subscribeAdminEvents() *adminEventSubscriber {
+	subscriber := &adminEventSubscriber{
+		events:     make(chan adminEvent, adminEventQueueSize),
+		overflowed: make(chan struct{}),
+	}
+	adminEventsMutex.Lock()
+	adminEventSubscribers[subscriber] = struct{}{}
+	adminEventsMutex.Unlock()
+	return subscriber
+}
+
+func unsubscribeAdminEvents(subscriber *adminEventSubscriber) {
+	adminEventsMutex.Lock()
+	delete(adminEventSubscribers, subscriber)
+	adminEventsMutex.Unlock()
+}
+
+// AdminEventsHandler streams admin events as server-sent events, from the
+// time of the request on: upload keys created, sessions started and ended,
+// uploads rejected and uploads moved to and from cold storage. Each event is
+// sent with its type as the SSE event name and as JSON data.
+func AdminEventsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	subscriber := subscribeAdminEvents()
+	defer unsubscribeAdminEvents(subscriber)
+
+	stream := newEventStream(w)
+	defer stream.stop()
+	w.WriteHeader(http.StatusOK)
+	if err := stream.flush(); err != nil {
+		log.Printf("failed to start admin event stream: %v", err)
+		return
+	}
+
+	ctx := r.Context()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-stream.idle():
+			return
+		case <-subscriber.overflowed:
+			log.Printf("admin event stream fell more than %d events behind, disconnecting", adminEventQueueSize)
+			return
+		case <-stream.keepalive():
+			if err := stream.ping(); err != nil {
+				return
+			}
+		case event := <-subscriber.events:
+			if dropped := subscriber.dropped.Swap(0); dropped > 0 {
+				// ids skip the dropped events too; this says so explicitly
+				if err := stream.send("event: dropped\ndata: {\"count\":%d}\n\n", dropped); err != nil {
+					return
+				}
+			}
+			data, err := json.Marshal(event)
+			if err != nil {
+				log.Printf("failed to encode admin event: %v", err)
+				continue
+			}
+			if err := stream.send("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// readAdminEvent reads the next event from an admin event stream.
+func readAdminEvent(t *testing.T, stream *bufio.Reader) adminEvent {
+	t.Helper()
+	var name string
+	for {
+		line, err := stream.ReadString('\n')
+		if err != nil {
+			t.Fatalf("read event stream: %v", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if after, ok := strings.CutPrefix(line, "event: "); ok {
+			name = after
+		}
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			var event adminEvent
+			if err := json.Unmarshal([]byte(data), &event); err != nil {
+				t.Fatal(err)
+			}
+			if event.Type != name {
+				t.Fatalf("event %q sent as %q", event.Type, name)
+			}
+			return event
+		}
+	}
+}
+
+func TestAdminEventsHandler(t *testing.T) {
+	chdirTemp(t)
+	server := httptest.NewServer(http.HandlerFunc(AdminEventsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.Header.Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("content type = %q", resp.Header.Get("Content-Type"))
+	}
+	stream := bufio.NewReader(resp.Body)
+
+	rec := httptest.NewRecorder()
+	NewUploadKeyHandler(rec, httptest.NewRequest("POST", "/api/new-upload-key", nil))
+	var created struct {
+		UploadKey string `json:"upload_key"`
+	}
+	json.NewDecoder(rec.Body).Decode(&created)
+	key := created.UploadKey
+	if event := readAdminEvent(t, stream); event.Type != adminEventKeyCreated || event.KeyHash != uploadKeyHash(key) {
+		t.Fatalf("first event = %+v", event)
+	}
+
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+	if event := readAdminEvent(t, stream); event.Type != adminEventSessionStarted || event.UploadName != uploadNameFromKey(key) {
+		t.Fatalf("second event = %+v", event)
+	}
+
+	rec = httptest.NewRecorder()
+	UploadHandler(rec, withUploadKey(httptest.NewRequest("POST", "/api/upload?timestamp_unit=parsecs", strings.NewReader(`{"bpm":70}`)), key))
+	event := readAdminEvent(t, stream)
+	if event.Type != adminEventUploadRejected || event.KeyHash != uploadKeyHash(key) || event.Details["code"] != errCodeInvalidParameter || event.Details["status"] != float64(400) {
+		t.Fatalf("rejection event = %+v", event)
+	}
+
+	// sessions left over from other tests end too
+	reapIdleSessions(time.Now().Add(time.Hour))
+	for event = readAdminEvent(t, stream); event.KeyHash != uploadKeyHash(key); event = readAdminEvent(t, stream) {
+	}
+	if event.Type != adminEventSessionEnded || event.Details["records"] != float64(1) {
+		t.Fatalf("session end event = %+v", event)
+	}
+	if strings.Contains(event.UploadName+event.KeyHash, key) {
+		t.Fatal("event contains the upload key")
+	}
+}
+
+func TestAdminEventOverflow(t *testing.T) {
+	oldSize, oldOverflow := adminEventQueueSize, adminEventOverflow
+	defer func() { adminEventQueueSize, adminEventOverflow = oldSize, oldOverflow }()
+
+	if err := SetAdminEventQueue(2, adminEventsDropOldest); err != nil {
+		t.Fatal(err)
+	}
+	subscriber := subscribeAdminEvents()
+	defer unsubscribeAdminEvents(subscriber)
+	dropped := adminEventsDropped.Value()
+	for range 5 {
+		publishAdminEvent(adminEventKeyCreated, "", nil)
+	}
+	first, second := <-subscriber.events, <-subscriber.events
+	if second.ID != first.ID+1 || subscriber.dropped.Load() != 3 || adminEventsDropped.Value()-dropped != 3 {
+		t.Fatalf("drop-oldest kept events %d and %d, dropped %d", first.ID, second.ID, subscriber.dropped.Load())
+	}
+	if second.ID != lastAdminEventID {
+		t.Fatalf("drop-oldest kept event %d, not the newest %d", second.ID, lastAdminEventID)
+	}
+
+	if err := SetAdminEventQueue(2, adminEventsDisconnect); err != nil {
+		t.Fatal(err)
+	}
+	slow := subscribeAdminEvents()
+	defer unsubscribeAdminEvents(slow)
+	for range 3 {
+		publishAdminEvent(adminEventKeyCreated, "", nil)
+		<-subscriber.events
+	}
+	select {
+	case <-slow.overflowed:
+	default:
+		t.Fatal("overflowing subscriber not disconnected")
+	}
+	// a subscriber keeping up stays
+	select {
+	case <-subscriber.overflowed:
+		t.Fatal("subscriber keeping up disconnected")
+	default:
+	}
+
+	if SetAdminEventQueue(0, adminEventsDropOldest) == nil || SetAdminEventQueue(1, "block") == nil {
+		t.Fatal("invalid admin event queue accepted")
+	}
+}
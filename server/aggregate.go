@@ -0,0 +1,226 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"math"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+)
+
+// Study-level summaries take one metric over every session a filter
+// selects, the same filter GET /uploads takes, and report it per session
+// and as a distribution. The values come from the cached session summaries,
+// so sessions that didn't change are not read again.
+
+// aggregateMetrics are the metrics POST /analysis/aggregate computes, with
+// their unit.
+var aggregateMetrics = map[string]string{
+	"total_distance": "m",
+	"mean_speed":     "m/s",
+	"session_length": "s",
+}
+
+type aggregateRequest struct {
+	Filter  map[string]any `json:"filter"`
+	Metric  string         `json:"metric"`
+	Tracker string         `json:"tracker"`
+}
+
+type aggregateValue struct {
+	UploadName  string  `json:"upload_name"`
+	KeyHash     string  `json:"key_hash"`
+	Participant string  `json:"participant,omitempty"`
+	Value       float64 `json:"value"`
+}
+
+type aggregateSkipped struct {
+	UploadName string `json:"upload_name"`
+	KeyHash    string `json:"key_hash"`
+	Reason     string `json:"reason"`
+}
+
+// distribution describes a set of values. Quantiles interpolate linearly
+// between the closest values.
+type distribution struct {
+	Count  int     `json:"count"`
+	Mean   float64 `json:"mean"`
+	StdDev float64 `json:"stddev"`
+	Min    float64 `json:"min"`
+	P25    float64 `json:"p25"`
+	Median float64 `json:"median"`
+	P75    float64 `json:"p75"`
+	Max    float64 `json:"max"`
+}
+
+func describeDistribution(values []float64) *distribution {
+	if len(values) == 0 {
+		return nil
+	}
+	sorted := slices.Sorted(slices.Values(values))
+	d := &distribution{Count: len(sorted), Min: sorted[0], Max: sorted[len(sorted)-1]}
+	for _, v := range sorted {
+		d.Mean += v
+	}
+	d.Mean /= float64(len(sorted))
+	if len(sorted) > 1 {
+		var squares float64
+		for _, v := range sorted {
+			squares += (v - d.Mean) * (v - d.Mean)
+		}
+		d.StdDev = math.Sqrt(squares / float64(len(sorted)-1))
+	}
+	d.P25, d.Median, d.P75 = sortedQuantile(sorted, 0.25), sortedQuantile(sorted, 0.5), sortedQuantile(sorted, 0.75)
+	return d
+}
+
+// sortedQuantile returns quantile q of sorted values, interpolating
+// linearly between the closest two.
+func sortedQuantile(sorted []float64, q float64) float64 {
+	pos := q * float64(len(sorted)-1)
+	lower := int(math.Floor(pos))
+	if lower+1 >= len(sorted) {
+		return sorted[lower]
+	}
+	return sorted[lower] + (pos-float64(lower))*(sorted[lower+1]-sorted[lower])
+}
+
+// filterQuery turns the filter object of a request into the query GET
+// /uploads takes. Values are strings, numbers or lists of them.
+func filterQuery(filter map[string]any) (url.Values, error) {
+	query := url.Values{}
+	add := func(name string, value any) error {
+		switch v := value.(type) {
+		case string:
+			query.Add(name, v)
+		case json.Number:
+			query.Add(name, v.String())
+		default:
+			return fmt.Errorf("invalid filter %q: values must be strings, numbers or lists of them", name)
+		}
+		return nil
+	}
+	for name, value := range filter {
+		values, ok := value.([]any)
+		if !ok {
+			values = []any{value}
+		}
+		for _, v := range values {
+			if err := add(name, v); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return query, nil
+}
+
+// aggregateValueOf returns metric of a session, or an error saying why the
+// session has none.
+func aggregateValueOf(summary sessionSummary, metric, tracker string) (float64, error) {
+	if metric == "session_length" {
+		if summary.Records == 0 {
+			return 0, errors.New("no tracker samples")
+		}
+		return summary.DurationMs / 1000, nil
+	}
+	ts, ok := summary.Trackers[tracker]
+	if !ok {
+		return 0, fmt.Errorf("no samples for tracker %q", tracker)
+	}
+	if metric == "total_distance" {
+		return ts.Distance, nil
+	}
+	if ts.DurationMs <= 0 {
+		return 0, fmt.Errorf("tracker %q has no duration", tracker)
+	}
+	return ts.Distance / (ts.DurationMs / 1000), nil
+}
+
+// AggregateHandler computes a metric over the sessions a filter selects:
+// {"filter": {"label": "study=a", "from": "2024-06-01"}, "metric":
+// "mean_speed", "tracker": "headset"}. The tracker defaults to the
+// headset; session_length covers all trackers.
+func AggregateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	var request aggregateRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024))
+	decoder.UseNumber()
+	if err := decoder.Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid aggregate request JSON: %v", err))
+		return
+	}
+	unit, ok := aggregateMetrics[request.Metric]
+	if !ok {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid metric %q: must be one of %v", request.Metric, slices.Sorted(maps.Keys(aggregateMetrics))))
+		return
+	}
+	if request.Tracker == "" {
+		request.Tracker = defaultTracker
+	}
+	query, err := filterQuery(request.Filter)
+	var filter uploadFilter
+	if err == nil {
+		filter, err = parseUploadFilter(query)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+
+	entries, err := indexedUploads()
+	if err != nil {
+		log.Printf("failed to list uploads for aggregate: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to list uploads")
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].receivedAt.Before(entries[j].receivedAt)
+	})
+
+	sessions := []aggregateValue{}
+	skipped := []aggregateSkipped{}
+	var values []float64
+	for _, entry := range entries {
+		if !filter.matches(entry) {
+			continue
+		}
+		name, keyHash := uploadNameFromKey(entry.uploadKey), uploadKeyHash(entry.uploadKey)
+		summary, err := cachedSessionSummary(entry.uploadKey, defaultGapThresholdMs)
+		if err != nil {
+			log.Printf("failed to summarize upload for aggregate key_hash=%s: %v", keyHash, err)
+			skipped = append(skipped, aggregateSkipped{UploadName: name, KeyHash: keyHash, Reason: "failed to read upload"})
+			continue
+		}
+		value, err := aggregateValueOf(summary, request.Metric, request.Tracker)
+		if err != nil {
+			skipped = append(skipped, aggregateSkipped{UploadName: name, KeyHash: keyHash, Reason: err.Error()})
+			continue
+		}
+		sessions = append(sessions, aggregateValue{UploadName: name, KeyHash: keyHash, Participant: entry.labels[participantLabel], Value: value})
+		values = append(values, value)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":   "ok",
+		"metric":   request.Metric,
+		"unit":     unit,
+		"sessions": sessions,
+		"skipped":  skipped,
+		"stats":    describeDistribution(values),
+	}
+	if request.Metric != "session_length" {
+		response["tracker"] = request.Tracker
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write aggregate response: %v", err)
+	}
+}
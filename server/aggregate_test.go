@@ -0,0 +1,79 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestDescribeDistribution(t *testing.T) {
+	d := describeDistribution([]float64{4, 1, 3, 2})
+	if d.Count != 4 || d.Mean != 2.5 || d.Min != 1 || d.Max != 4 || d.Median != 2.5 || d.P25 != 1.75 || d.P75 != 3.25 {
+		t.Fatalf("distribution = %+v", d)
+	}
+	if math.Abs(d.StdDev-math.Sqrt(5.0/3)) > 1e-9 {
+		t.Fatalf("stddev = %v", d.StdDev)
+	}
+	if describeDistribution(nil) != nil {
+		t.Fatal("distribution of no values")
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	chdirTemp(t)
+	walk := func(metres float64) []string {
+		return []string{
+			`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":1.7,"z":0}}`,
+			`{"trackerKey":"headset","timestamp":2000,"position":{"x":` + strconv.FormatFloat(metres, 'f', -1, 64) + `,"y":1.7,"z":0}}`,
+		}
+	}
+	first, second, other, empty := newTestUploadKey(t), newTestUploadKey(t), newTestUploadKey(t), newTestUploadKey(t)
+	simulateUpload(t, first, walk(2))
+	simulateUpload(t, second, walk(4))
+	simulateUpload(t, other, walk(100))
+	simulateUpload(t, empty, []string{`{"bpm":70}`})
+	for _, key := range []string{first, second, empty} {
+		patchLabels(t, key, `{"labels":{"study":"a"}}`)
+	}
+
+	aggregate := func(body string) (int, map[string]any) {
+		rec := httptest.NewRecorder()
+		AggregateHandler(rec, httptest.NewRequest("POST", "/api/analysis/aggregate", strings.NewReader(body)))
+		var response map[string]any
+		json.Unmarshal(rec.Body.Bytes(), &response)
+		return rec.Code, response
+	}
+
+	status, response := aggregate(`{"filter":{"label":"study=a"},"metric":"mean_speed"}`)
+	if status != 200 {
+		t.Fatalf("aggregate status = %d: %v", status, response)
+	}
+	stats := response["stats"].(map[string]any)
+	if stats["count"] != 2.0 || stats["mean"] != 1.5 || stats["min"] != 1.0 || stats["max"] != 2.0 {
+		t.Fatalf("mean_speed stats = %v", stats)
+	}
+	if sessions := response["sessions"].([]any); len(sessions) != 2 {
+		t.Fatalf("sessions = %v", sessions)
+	}
+	if skipped := response["skipped"].([]any); len(skipped) != 1 || skipped[0].(map[string]any)["key_hash"] != uploadKeyHash(empty) {
+		t.Fatalf("skipped = %v", skipped)
+	}
+
+	status, response = aggregate(`{"filter":{"min_records":2},"metric":"session_length"}`)
+	if stats, _ := response["stats"].(map[string]any); status != 200 || stats["count"] != 3.0 || stats["median"] != 2.0 {
+		t.Fatalf("session_length = %d %v", status, response)
+	}
+
+	for _, body := range []string{
+		`{"metric":"max_speed"}`,
+		`{"filter":{"from":"June"},"metric":"total_distance"}`,
+		`{"filter":{"label":{"study":"a"}},"metric":"total_distance"}`,
+	} {
+		if status, _ := aggregate(body); status != 400 {
+			t.Errorf("aggregate %s: status = %d, want 400", body, status)
+		}
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// annotation labels a time interval of a session. Start and End use the
+// same clock as the records' timestamp field.
+type annotation struct {
+	ID        int     `json:"id"`
+	Label     string  `json:"label"`
+	Start     float64 `json:"start"`
+	End       float64 `json:"end"`
+	Note      string  `json:"note,omitempty"`
+	CreatedAt string  `json:"created_at"`
+}
+
+var annotationsMutex sync.Mutex
+
+func annotationsFilePath(uploadKey string) string {
+	return strings.TrimSuffix(uploadFilePath(uploadKey), ".csv") + ".annotations.json"
+}
+
+func loadAnnotations(uploadKey string) ([]annotation, error) {
+	data, err := os.ReadFile(annotationsFilePath(uploadKey))
+	if os.IsNotExist(err) {
+		return []annotation{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read annotations: %w", err)
+	}
+
+	var annotations []annotation
+	if err := json.Unmarshal(data, &annotations); err != nil {
+		return nil, fmt.Errorf("decode annotations: %w", err)
+	}
+	return annotations, nil
+}
+
+func addAnnotation(uploadKey string, a annotation) (annotation, error) {
+	annotationsMutex.Lock()
+	defer annotationsMutex.Unlock()
+
+	annotations, err := loadAnnotations(uploadKey)
+	if err != nil {
+		return annotation{}, err
+	}
+
+	a.ID = 1
+	for _, existing := range annotations {
+		a.ID = max(a.ID, existing.ID+1)
+	}
+	annotations = append(annotations, a)
+
+	data, err := json.MarshalIndent(annotations, "", "  ")
+	if err != nil {
+		return annotation{}, fmt.Errorf("encode annotations: %w", err)
+	}
+
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return annotation{}, fmt.Errorf("create upload directory: %w", err)
+	}
+
+	// write to a temporary file first so a crash never leaves a torn file
+	filePath := annotationsFilePath(uploadKey)
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return annotation{}, fmt.Errorf("write annotations: %w", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return annotation{}, fmt.Errorf("replace annotations: %w", err)
+	}
+
+	return a, nil
+}
+
+// annotationLabels returns the labels of all annotations covering timestamp.
+func annotationLabels(annotations []annotation, timestamp float64) []string {
+	var labels []string
+	for _, a := range annotations {
+		if timestamp >= a.Start && timestamp <= a.End {
+			labels = append(labels, a.Label)
+		}
+	}
+	return labels
+}
+
+// labelPayload adds a "labels" field to a stored JSON payload whose
+// timestamp falls into any annotation. Other payloads are returned as-is.
+func labelPayload(payload []byte, annotations []annotation) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	var timestamp float64
+	if raw, ok := fields["timestamp"]; !ok || json.Unmarshal(raw, &timestamp) != nil {
+		return payload
+	}
+
+	labels := annotationLabels(annotations, timestamp)
+	if len(labels) == 0 {
+		return payload
+	}
+
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return payload
+	}
+	fields["labels"] = encoded
+
+	labeled, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return labeled
+}
+
+// labelStage sets the labels of every sample covered by an annotation.
+func labelStage(annotations []annotation, next sampleStage) sampleStage {
+	return mapStage{next: next, fn: func(s trackerSample) trackerSample {
+		s.Labels = annotationLabels(annotations, s.Timestamp)
+		return s
+	}}
+}
+
+func AnnotationsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		panic("only GET and POST allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	if r.Method == http.MethodGet {
+		annotationsMutex.Lock()
+		annotations, err := loadAnnotations(uploadKey)
+		annotationsMutex.Unlock()
+		if err != nil {
+			log.Printf("failed to load annotations: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read annotations")
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		response := map[string]any{
+			"status":      "ok",
+			"upload_name": uploadNameFromKey(uploadKey),
+			"annotations": annotations,
+		}
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			log.Printf("failed to write annotations response: %v", err)
+		}
+		return
+	}
+
+	var request struct {
+		Label string   `json:"label"`
+		Start *float64 `json:"start"`
+		End   *float64 `json:"end"`
+		Note  string   `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid annotation JSON: %v", err))
+		return
+	}
+
+	request.Label = strings.TrimSpace(request.Label)
+	if request.Label == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, "missing annotation label")
+		return
+	}
+	if request.Start == nil || request.End == nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, "missing annotation start or end")
+		return
+	}
+	if *request.End < *request.Start {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, "invalid annotation interval: end is before start")
+		return
+	}
+
+	created, err := addAnnotation(uploadKey, annotation{
+		Label:     request.Label,
+		Start:     *request.Start,
+		End:       *request.End,
+		Note:      request.Note,
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		log.Printf("failed to store annotation: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to store annotation")
+		return
+	}
+
+	log.Printf("annotation added upload_name=%q id=%d label=%q start=%v end=%v", uploadNameFromKey(uploadKey), created.ID, created.Label, created.Start, created.End)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	response := map[string]any{
+		"status":     "ok",
+		"annotation": created,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write annotation response: %v", err)
+	}
+}
+
+// readSessionAnnotations loads annotations for export, logging failures
+// instead of failing the export.
+func readSessionAnnotations(uploadKey string) []annotation {
+	annotationsMutex.Lock()
+	defer annotationsMutex.Unlock()
+	annotations, err := loadAnnotations(uploadKey)
+	if err != nil {
+		log.Printf("failed to load annotations for export: %v", err)
+		return nil
+	}
+	return annotations
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postAnnotation(t *testing.T, key, body string) int {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/uploads/"+key+"/annotations", bytes.NewBufferString(body))
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	AnnotationsHandler(rec, req)
+	return rec.Code
+}
+
+func TestAnnotations(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":100,"position":{"x":1,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":200,"position":{"x":2,"y":0,"z":0}}`,
+	})
+
+	if code := postAnnotation(t, key, `{"label":"tutorial","start":0,"end":50}`); code != 201 {
+		t.Fatalf("post annotation status = %d", code)
+	}
+	if code := postAnnotation(t, key, `{"label":"task 1","start":90,"end":300,"note":"first try"}`); code != 201 {
+		t.Fatalf("post annotation status = %d", code)
+	}
+	if code := postAnnotation(t, key, `{"label":"bad","start":10,"end":5}`); code != 400 {
+		t.Fatalf("post inverted annotation status = %d, want 400", code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/annotations", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	AnnotationsHandler(rec, req)
+	var payload struct {
+		Annotations []annotation `json:"annotations"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode annotations response: %v", err)
+	}
+	if len(payload.Annotations) != 2 || payload.Annotations[1].ID != 2 || payload.Annotations[1].Note != "first try" {
+		t.Fatalf("unexpected annotations: %+v", payload.Annotations)
+	}
+
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/export", nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	ExportHandler(rec, req)
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	var labels []string
+	for _, line := range lines {
+		var record struct {
+			Labels []string `json:"labels"`
+		}
+		if err := json.Unmarshal([]byte(line), &record); err != nil {
+			t.Fatalf("decode export line: %v", err)
+		}
+		labels = append(labels, strings.Join(record.Labels, "|"))
+	}
+	if strings.Join(labels, ",") != "tutorial,task 1,task 1" {
+		t.Fatalf("export labels = %q", labels)
+	}
+}
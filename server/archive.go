@@ -0,0 +1,224 @@
+package server
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type archiveManifestEntry struct {
+	UploadKey   string `json:"upload_key"`
+	UploadName  string `json:"upload_name"`
+	File        string `json:"file"`
+	Annotations string `json:"annotations,omitempty"`
+	Size        int64  `json:"size"`
+	Checksum    string `json:"checksum"`
+	UserAgent   string `json:"user_agent"`
+	ReceivedAt  string `json:"received_at"`
+}
+
+// parseArchiveTime accepts either a date (YYYY-MM-DD) or an RFC 3339
+// timestamp. endOfDay moves a plain date to the start of the next day, so
+// that "to" includes the whole day.
+func parseArchiveTime(value string, endOfDay bool) (time.Time, error) {
+	if t, err := time.Parse(time.DateOnly, value); err == nil {
+		if endOfDay {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Parse(time.RFC3339Nano, value)
+}
+
+// selectArchiveKeys returns the requested keys, or, if none were given,
+// every stored upload first received within [from, to).
+func selectArchiveKeys(keys []string, from, to time.Time) ([]string, error) {
+	if len(keys) > 0 {
+		selected := make([]string, 0, len(keys))
+		for _, raw := range keys {
+			uploadKey, err := parseUploadKey(raw)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := os.Stat(uploadFilePath(uploadKey)); os.IsNotExist(err) {
+				return nil, fmt.Errorf("%w: %s", errUploadNotFound, uploadNameFromKey(uploadKey))
+			}
+			selected = append(selected, uploadKey)
+		}
+		return selected, nil
+	}
+
+	all, err := listUploadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var selected []string
+	for _, uploadKey := range all {
+		metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+		if err != nil {
+			log.Printf("skipping upload with unreadable metadata upload_name=%q: %v", uploadNameFromKey(uploadKey), err)
+			continue
+		}
+		receivedAt, err := time.Parse(time.RFC3339Nano, metadata.ReceivedAt)
+		if err != nil {
+			continue
+		}
+		if (!from.IsZero() && receivedAt.Before(from)) || (!to.IsZero() && !receivedAt.Before(to)) {
+			continue
+		}
+		selected = append(selected, uploadKey)
+	}
+	return selected, nil
+}
+
+// addFileToArchive adds a stored file to the archive, decompressing uploads
+// stored compressed so the archive always holds plain CSV. It returns the
+// size and checksum of what it added.
+func addFileToArchive(archive *zip.Writer, filePath string) (int64, uploadChecksum, error) {
+	if err := ensureHot(filePath); err != nil {
+		return 0, uploadChecksum{}, err
+	}
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return 0, uploadChecksum{}, err
+	}
+
+	file, err := openUploadFile(filePath)
+	if err != nil {
+		return 0, uploadChecksum{}, err
+	}
+	defer file.Close()
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return 0, uploadChecksum{}, err
+	}
+	header.Name = filepath.Base(filePath)
+	header.Method = zip.Deflate
+
+	entry, err := archive.CreateHeader(header)
+	if err != nil {
+		return 0, uploadChecksum{}, err
+	}
+	hash := crc32.New(crc32cTable)
+	size, err := io.Copy(io.MultiWriter(entry, hash), file)
+	return size, uploadChecksum{CRC32C: hash.Sum32(), Size: size}, err
+}
+
+// ArchiveHandler streams a zip of the selected uploads, their annotations and
+// a manifest.json describing them. The request body is a JSON object with
+// either "keys" or a "from"/"to" date range on when uploads started.
+func ArchiveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	var request struct {
+		Keys []string `json:"keys"`
+		From string   `json:"from"`
+		To   string   `json:"to"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid archive request JSON: %v", err))
+		return
+	}
+
+	var from, to time.Time
+	var err error
+	if request.From != "" {
+		if from, err = parseArchiveTime(request.From, false); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid from: must be YYYY-MM-DD or an RFC 3339 timestamp")
+			return
+		}
+	}
+	if request.To != "" {
+		if to, err = parseArchiveTime(request.To, true); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid to: must be YYYY-MM-DD or an RFC 3339 timestamp")
+			return
+		}
+	}
+	if len(request.Keys) == 0 && from.IsZero() && to.IsZero() {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "archive request needs keys or a from/to range")
+		return
+	}
+
+	keys, err := selectArchiveKeys(request.Keys, from, to)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidUploadKey, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "uploads-"+time.Now().UTC().Format("20060102-150405")+".zip"))
+
+	archive := zip.NewWriter(w)
+	manifest := make([]archiveManifestEntry, 0, len(keys))
+	for _, uploadKey := range keys {
+		filePath := uploadFilePath(uploadKey)
+		metadata, err := readUploadMetadata(filePath)
+		if err != nil {
+			log.Printf("failed to read metadata for archive upload_name=%q: %v", uploadNameFromKey(uploadKey), err)
+		}
+
+		size, checksum, err := addFileToArchive(archive, filePath)
+		if err != nil {
+			// headers are already sent; abort so the client sees a broken zip
+			// rather than silently missing data
+			log.Printf("failed to add upload to archive upload_name=%q: %v", uploadNameFromKey(uploadKey), err)
+			return
+		}
+
+		entry := archiveManifestEntry{
+			UploadKey:  uploadKey,
+			UploadName: uploadNameFromKey(uploadKey),
+			File:       filepath.Base(filePath),
+			Size:       size,
+			Checksum:   checksum.String(),
+			UserAgent:  metadata.UserAgent,
+			ReceivedAt: metadata.ReceivedAt,
+		}
+
+		annotationsPath := annotationsFilePath(uploadKey)
+		if _, err := os.Stat(annotationsPath); err == nil {
+			if _, _, err := addFileToArchive(archive, annotationsPath); err != nil {
+				log.Printf("failed to add annotations to archive upload_name=%q: %v", uploadNameFromKey(uploadKey), err)
+				return
+			}
+			entry.Annotations = filepath.Base(annotationsPath)
+		}
+
+		manifest = append(manifest, entry)
+	}
+
+	manifestEntry, err := archive.Create("manifest.json")
+	if err == nil {
+		encoder := json.NewEncoder(manifestEntry)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(map[string]any{
+			"created_at": time.Now().UTC().Format(time.RFC3339Nano),
+			"uploads":    manifest,
+		})
+	}
+	if err == nil {
+		err = archive.Close()
+	}
+	if err != nil {
+		log.Printf("failed to write archive: %v", err)
+		return
+	}
+
+	log.Printf("archive exported uploads=%d", len(manifest))
+}
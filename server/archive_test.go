@@ -0,0 +1,86 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestArchive(t *testing.T) {
+	chdirTemp(t)
+	keyA := newTestUploadKey(t)
+	keyB := newTestUploadKey(t)
+
+	simulateUpload(t, keyA, []string{`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`})
+	simulateUpload(t, keyB, []string{`{"trackerKey":"headset","timestamp":0,"position":{"x":1,"y":0,"z":0}}`})
+	if code := postAnnotation(t, keyA, `{"label":"tutorial","start":0,"end":50}`); code != 201 {
+		t.Fatalf("post annotation status = %d", code)
+	}
+
+	body, _ := json.Marshal(map[string]any{"keys": []string{keyA, keyB}})
+	req := httptest.NewRequest("POST", "/api/export/archive", bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	ArchiveHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	archive, err := zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil {
+		t.Fatalf("open zip: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range archive.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("open %s: %v", f.Name, err)
+		}
+		files[f.Name], _ = io.ReadAll(rc)
+		rc.Close()
+	}
+	if len(files) != 4 {
+		t.Fatalf("expected 2 uploads, 1 annotations file and a manifest, got %d files", len(files))
+	}
+
+	var manifest struct {
+		Uploads []archiveManifestEntry `json:"uploads"`
+	}
+	if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+		t.Fatalf("decode manifest: %v", err)
+	}
+	if len(manifest.Uploads) != 2 || manifest.Uploads[0].Annotations == "" || manifest.Uploads[1].Annotations != "" {
+		t.Fatalf("unexpected manifest: %+v", manifest.Uploads)
+	}
+	for _, entry := range manifest.Uploads {
+		if int64(len(files[entry.File])) != entry.Size || entry.ReceivedAt == "" {
+			t.Fatalf("manifest entry does not match archived file: %+v", entry)
+		}
+	}
+
+	// a date range selects by when the upload was first received
+	req = httptest.NewRequest("POST", "/api/export/archive", bytes.NewBufferString(`{"from":"2000-01-01","to":"2000-12-31"}`))
+	rec = httptest.NewRecorder()
+	ArchiveHandler(rec, req)
+	archive, err = zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil || len(archive.File) != 1 {
+		t.Fatalf("expected only a manifest for an empty range, got %v files (err %v)", len(archive.File), err)
+	}
+
+	req = httptest.NewRequest("POST", "/api/export/archive", bytes.NewBufferString(`{"from":"2000-01-01"}`))
+	rec = httptest.NewRecorder()
+	ArchiveHandler(rec, req)
+	archive, err = zip.NewReader(bytes.NewReader(rec.Body.Bytes()), int64(rec.Body.Len()))
+	if err != nil || len(archive.File) != 4 {
+		t.Fatalf("expected both uploads for an open range, got %v files (err %v)", len(archive.File), err)
+	}
+
+	req = httptest.NewRequest("POST", "/api/export/archive", bytes.NewBufferString(`{}`))
+	rec = httptest.NewRecorder()
+	ArchiveHandler(rec, req)
+	if rec.Code != 400 {
+		t.Fatalf("empty request status = %d, want 400", rec.Code)
+	}
+}
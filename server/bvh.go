@@ -0,0 +1,182 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"iter"
+	"math"
+	"strings"
+)
+
+const defaultBVHFrameMs = 1000.0 / 30
+
+// bvhJointNames maps the tracker keys sent by the VR clients onto the joint
+// names animation tools expect. Other trackers keep a sanitized version of
+// their key.
+var bvhJointNames = map[string]string{
+	"headset":         "Head",
+	"leftController":  "LeftHand",
+	"rightController": "RightHand",
+}
+
+func bvhJointName(tracker string) string {
+	if name, ok := bvhJointNames[tracker]; ok {
+		return name
+	}
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' {
+			return r
+		}
+		return '_'
+	}, tracker)
+}
+
+// bvhEulerZXY converts q into the angles, in degrees, of the rotation
+// Rz·Rx·Ry that matches the "Zrotation Xrotation Yrotation" channel order.
+func bvhEulerZXY(q quat) (z, x, y float64) {
+	m01 := 2 * (q.X*q.Y - q.Z*q.W)
+	m11 := 1 - 2*(q.X*q.X+q.Z*q.Z)
+	m20 := 2 * (q.X*q.Z - q.Y*q.W)
+	m21 := 2 * (q.Y*q.Z + q.X*q.W)
+	m22 := 1 - 2*(q.X*q.X+q.Y*q.Y)
+
+	x = math.Asin(math.Max(-1, math.Min(1, m21)))
+	if math.Abs(m21) < 0.9999 {
+		z = math.Atan2(-m01, m11)
+		y = math.Atan2(-m20, m22)
+	} else {
+		// gimbal lock: only z+y is determined, attribute it all to z
+		m00 := 1 - 2*(q.Y*q.Y+q.Z*q.Z)
+		m10 := 2 * (q.X*q.Y + q.Z*q.W)
+		z = math.Atan2(m10, m00)
+	}
+
+	const deg = 180 / math.Pi
+	return z * deg, x * deg, y * deg
+}
+
+// writeBVH writes the trackers as a BVH motion capture file: a static root
+// at the origin with one joint per tracker, each carrying its world position
+// and rotation. Trackers are resampled onto a shared grid of frameMs, and
+// hold their first or last pose outside their own time span. The export is
+// scanned once for the span of the trackers and then streamed, one pose of
+// each tracker at a time.
+func writeBVH(w io.Writer, e *sampleExport, frameMs float64) error {
+	var trackers []string
+	var firsts []trackerSample
+	origin, end := math.Inf(1), math.Inf(-1)
+	for _, tracker := range e.trackers {
+		var first trackerSample
+		found := false
+		err := e.each(tracker, func(s trackerSample) error {
+			if !found {
+				first, found = s, true
+			}
+			end = math.Max(end, s.Timestamp)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if found {
+			trackers = append(trackers, tracker)
+			firsts = append(firsts, first)
+			origin = math.Min(origin, first.Timestamp)
+		}
+	}
+
+	frames := 0
+	if len(trackers) > 0 {
+		frames = int(math.Floor((end-origin)/frameMs)) + 1
+	}
+
+	// each tracker's resampled poses, read as the frames reach them
+	type pose struct {
+		next    func() (trackerSample, error, bool)
+		cur     trackerSample
+		started bool
+		peek    trackerSample
+		ok      bool
+	}
+	frameOf := func(s trackerSample) int { return int(math.Round((s.Timestamp - origin) / frameMs)) }
+	poses := make([]pose, len(trackers))
+	for i, tracker := range trackers {
+		next, stop := iter.Pull2(func(yield func(trackerSample, error) bool) {
+			stage := &resampleStage{next: sampleSink(func(s trackerSample) error {
+				if !yield(s, nil) {
+					return errStopScan
+				}
+				return nil
+			}), origin: origin, step: frameMs, method: resampleLinear}
+			err := e.each(tracker, stage.push)
+			if err == nil {
+				err = stage.flush()
+			}
+			if err != nil && err != errStopScan {
+				yield(trackerSample{}, err)
+			}
+		})
+		defer stop()
+		var err error
+		poses[i].next = next
+		if poses[i].peek, err, poses[i].ok = next(); err != nil {
+			return err
+		}
+		if !poses[i].ok {
+			// shorter than one frame: a single pose at its first sample
+			poses[i].cur, poses[i].started = firsts[i], true
+		}
+	}
+
+	out := bufio.NewWriter(w)
+	fmt.Fprintln(out, "HIERARCHY")
+	fmt.Fprintln(out, "ROOT Origin")
+	fmt.Fprintln(out, "{")
+	fmt.Fprintln(out, "\tOFFSET 0.000000 0.000000 0.000000")
+	fmt.Fprintln(out, "\tCHANNELS 6 Xposition Yposition Zposition Zrotation Xrotation Yrotation")
+	for _, tracker := range trackers {
+		fmt.Fprintf(out, "\tJOINT %s\n", bvhJointName(tracker))
+		fmt.Fprintln(out, "\t{")
+		fmt.Fprintln(out, "\t\tOFFSET 0.000000 0.000000 0.000000")
+		fmt.Fprintln(out, "\t\tCHANNELS 6 Xposition Yposition Zposition Zrotation Xrotation Yrotation")
+		fmt.Fprintln(out, "\t\tEnd Site")
+		fmt.Fprintln(out, "\t\t{")
+		fmt.Fprintln(out, "\t\t\tOFFSET 0.000000 0.100000 0.000000")
+		fmt.Fprintln(out, "\t\t}")
+		fmt.Fprintln(out, "\t}")
+	}
+	fmt.Fprintln(out, "}")
+
+	fmt.Fprintln(out, "MOTION")
+	fmt.Fprintf(out, "Frames: %d\n", frames)
+	fmt.Fprintf(out, "Frame Time: %.6f\n", frameMs/1000)
+
+	for frame := 0; frame < frames; frame++ {
+		out.WriteString("0.000000 0.000000 0.000000 0.000000 0.000000 0.000000")
+		for i := range poses {
+			p := &poses[i]
+			for p.ok && frameOf(p.peek) <= frame {
+				var err error
+				p.cur, p.started = p.peek, true
+				if p.peek, err, p.ok = p.next(); err != nil {
+					return err
+				}
+			}
+			s := p.cur
+			if !p.started {
+				s = p.peek
+			}
+			var z, x, y float64
+			if s.Rotation != nil {
+				z, x, y = bvhEulerZXY(*s.Rotation)
+			}
+			fmt.Fprintf(out, " %.6f %.6f %.6f %.6f %.6f %.6f", s.Position.X, s.Position.Y, s.Position.Z, z, x, y)
+		}
+		if err := out.WriteByte('\n'); err != nil {
+			return err
+		}
+	}
+
+	return out.Flush()
+}
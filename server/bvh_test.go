@@ -0,0 +1,70 @@
+package server
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBVHEulerZXY(t *testing.T) {
+	// 90° about Y
+	z, x, y := bvhEulerZXY(quat{Y: math.Sqrt2 / 2, W: math.Sqrt2 / 2})
+	if math.Abs(z) > 1e-9 || math.Abs(x) > 1e-9 || math.Abs(y-90) > 1e-9 {
+		t.Fatalf("euler = %v %v %v, want 0 0 90", z, x, y)
+	}
+
+	// Rz(30)·Rx(20)·Ry(10) must round-trip
+	half := func(deg float64) (float64, float64) {
+		r := deg * math.Pi / 360
+		return math.Sin(r), math.Cos(r)
+	}
+	sz, cz := half(30)
+	sx, cx := half(20)
+	sy, cy := half(10)
+	q := quat{Z: sz, W: cz}.mul(quat{X: sx, W: cx}).mul(quat{Y: sy, W: cy})
+	z, x, y = bvhEulerZXY(q)
+	if math.Abs(z-30) > 1e-9 || math.Abs(x-20) > 1e-9 || math.Abs(y-10) > 1e-9 {
+		t.Fatalf("euler = %v %v %v, want 30 20 10", z, x, y)
+	}
+}
+
+func TestExportBVH(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":1.6,"z":0},"rotation":{"_x":0,"_y":0,"_z":0,"_w":1}}`,
+		`{"trackerKey":"rightController","timestamp":50,"position":{"x":0.3,"y":1.2,"z":-0.3}}`,
+		`{"trackerKey":"headset","timestamp":100,"position":{"x":0.1,"y":1.6,"z":0},"rotation":{"_x":0,"_y":0,"_z":0,"_w":1}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export?format=bvh&resample=50ms", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	ExportHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("bvh export status = %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	body := rec.Body.String()
+	for _, want := range []string{"JOINT Head\n", "JOINT RightHand\n", "Frames: 3\n", "Frame Time: 0.050000\n"} {
+		if !strings.Contains(body, want) {
+			t.Fatalf("bvh export is missing %q:\n%s", want, body)
+		}
+	}
+
+	motion := strings.Split(strings.TrimSpace(body[strings.Index(body, "Frame Time"):]), "\n")[1:]
+	if len(motion) != 3 {
+		t.Fatalf("motion lines = %d, want 3", len(motion))
+	}
+	// root + head + right hand, 6 channels each; the right hand holds its
+	// only pose in the first frame
+	fields := strings.Fields(motion[0])
+	if len(fields) != 18 || fields[6] != "0.000000" || fields[13] != "1.200000" {
+		t.Fatalf("unexpected first frame: %q", motion[0])
+	}
+	if fields := strings.Fields(motion[1]); fields[6] != "0.050000" {
+		t.Fatalf("unexpected second frame: %q", motion[1])
+	}
+}
@@ -0,0 +1,232 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Every upload has a CRC-32C checksum of its plain CSV content, kept in a
+// .sum file next to it and extended on each append rather than recomputed.
+// It is computed over the decompressed data, so it stays the same when an
+// upload is archived, which stores uploads uncompressed, and can be checked
+// when the archive is imported elsewhere.
+
+// checksumAlgorithm prefixes checksums so that a different one can be
+// introduced later.
+const checksumAlgorithm = "crc32c"
+
+// checksumHeader carries the expected checksum of a single-file import.
+const checksumHeader = "X-Upload-Checksum"
+
+var crc32cTable = crc32.MakeTable(crc32.Castagnoli)
+
+// uploadChecksum is the content of a .sum file.
+type uploadChecksum struct {
+	CRC32C     uint32 `json:"crc32c"`
+	Size       int64  `json:"size"`        // plain CSV bytes covered
+	StoredSize int64  `json:"stored_size"` // size of the upload file they were read from
+}
+
+// String formats the checksum as "crc32c:<hex>", the form used in ETags,
+// archive manifests and the import header.
+func (c uploadChecksum) String() string {
+	return fmt.Sprintf("%s:%08x", checksumAlgorithm, c.CRC32C)
+}
+
+func checksumPath(filePath string) string {
+	return strings.TrimSuffix(filePath, ".csv") + ".sum"
+}
+
+func readChecksumFile(filePath string) (uploadChecksum, error) {
+	data, err := os.ReadFile(checksumPath(filePath))
+	if err != nil {
+		return uploadChecksum{}, err
+	}
+	var checksum uploadChecksum
+	if err := json.Unmarshal(data, &checksum); err != nil {
+		return uploadChecksum{}, fmt.Errorf("decode checksum file: %w", err)
+	}
+	return checksum, nil
+}
+
+func writeChecksumFile(filePath string, checksum uploadChecksum) error {
+	return writeFileAtomic(checksumPath(filePath), func(w *bufio.Writer) error {
+		return json.NewEncoder(w).Encode(checksum)
+	})
+}
+
+// computeUploadChecksum reads a whole upload to checksum it.
+func computeUploadChecksum(filePath string) (uploadChecksum, error) {
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return uploadChecksum{}, errUploadNotFound
+	}
+	if err != nil {
+		return uploadChecksum{}, fmt.Errorf("stat upload file: %w", err)
+	}
+	file, err := openUploadFile(filePath)
+	if err != nil {
+		return uploadChecksum{}, fmt.Errorf("open upload file: %w", err)
+	}
+	defer file.Close()
+
+	hash := crc32.New(crc32cTable)
+	size, err := io.Copy(hash, file)
+	if err != nil {
+		return uploadChecksum{}, fmt.Errorf("read upload file: %w", err)
+	}
+	return uploadChecksum{CRC32C: hash.Sum32(), Size: size, StoredSize: info.Size()}, nil
+}
+
+// refreshUploadChecksum recomputes the checksum of an upload that was
+// written from scratch.
+func refreshUploadChecksum(filePath string) {
+	checksum, err := computeUploadChecksum(filePath)
+	if err == nil {
+		err = writeChecksumFile(filePath, checksum)
+	}
+	if err != nil {
+		log.Printf("failed to update checksum of %s: %v", filePath, err)
+	}
+}
+
+// extendUploadChecksum adds plain, the CSV text just appended, to the
+// checksum of an upload whose file was storedSize bytes before the append.
+// If the checksum doesn't cover exactly that, it is recomputed instead.
+func extendUploadChecksum(filePath string, storedSize int64, plain []byte) {
+	checksum, err := readChecksumFile(filePath)
+	if storedSize == 0 {
+		checksum, err = uploadChecksum{}, nil
+	}
+	if err != nil || checksum.StoredSize != storedSize {
+		refreshUploadChecksum(filePath)
+		return
+	}
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		log.Printf("failed to update checksum of %s: %v", filePath, err)
+		return
+	}
+	checksum.CRC32C = crc32.Update(checksum.CRC32C, crc32cTable, plain)
+	checksum.Size += int64(len(plain))
+	checksum.StoredSize = info.Size()
+	if err := writeChecksumFile(filePath, checksum); err != nil {
+		log.Printf("failed to update checksum of %s: %v", filePath, err)
+	}
+}
+
+// uploadFileChecksum returns the checksum of an upload, recomputing it if the
+// .sum file is missing or stale, e.g. for uploads stored before checksums
+// were kept. Cold uploads have theirs in the .cold file.
+func uploadFileChecksum(filePath string) (uploadChecksum, error) {
+	if cold, err := readColdInfo(filePath); err == nil {
+		return cold.Checksum, nil
+	}
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		return uploadChecksum{}, errUploadNotFound
+	}
+	if err != nil {
+		return uploadChecksum{}, fmt.Errorf("stat upload file: %w", err)
+	}
+	if checksum, err := readChecksumFile(filePath); err == nil && checksum.StoredSize == info.Size() {
+		return checksum, nil
+	}
+
+	checksum, err := computeUploadChecksum(filePath)
+	if err != nil {
+		return uploadChecksum{}, err
+	}
+	if err := writeChecksumFile(filePath, checksum); err != nil {
+		log.Printf("failed to store checksum of %s: %v", filePath, err)
+	}
+	return checksum, nil
+}
+
+// uploadETag is the strong ETag of an upload's stored data.
+func uploadETag(filePath string) (string, error) {
+	checksum, err := uploadFileChecksum(filePath)
+	if err != nil {
+		return "", err
+	}
+	return strconv.Quote(checksum.String()), nil
+}
+
+// exportETag is the weak ETag of a download derived from an upload: it
+// changes with the stored data, with the annotations and linked labels,
+// which exports include, and with the record script that adds computed
+// fields.
+func exportETag(uploadKey string) (string, error) {
+	checksum, err := uploadFileChecksum(uploadFilePath(uploadKey))
+	if err != nil {
+		return "", err
+	}
+	crc := checksum.CRC32C
+	if annotations, err := os.ReadFile(annotationsFilePath(uploadKey)); err == nil {
+		crc = crc32.Update(crc, crc32cTable, annotations)
+	}
+	if linked, err := os.ReadFile(linkedLabelsPath(uploadKey)); err == nil {
+		crc = crc32.Update(crc, crc32cTable, linked)
+	}
+	if exportScript != nil {
+		crc = crc32.Update(crc, crc32cTable, []byte(exportScript.source))
+	}
+	return fmt.Sprintf(`W/"%s:%08x"`, checksumAlgorithm, crc), nil
+}
+
+// etagMatches reports whether an If-None-Match header lists etag, comparing
+// weakly as RFC 9110 asks for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	if ifNoneMatch == "" {
+		return false
+	}
+	etag = strings.TrimPrefix(etag, "W/")
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// parseChecksum parses a checksum in the form produced by
+// uploadChecksum.String.
+func parseChecksum(raw string) (uint32, error) {
+	algorithm, digest, ok := strings.Cut(strings.TrimSpace(raw), ":")
+	if !ok || algorithm != checksumAlgorithm {
+		return 0, fmt.Errorf("invalid checksum %q: must be %s:<8 hex digits>", raw, checksumAlgorithm)
+	}
+	crc, err := strconv.ParseUint(digest, 16, 32)
+	if err != nil || len(digest) != 8 {
+		return 0, fmt.Errorf("invalid checksum %q: must be %s:<8 hex digits>", raw, checksumAlgorithm)
+	}
+	return uint32(crc), nil
+}
+
+var errChecksumMismatch = errors.New("checksum mismatch")
+
+// verifyChecksum checks data against an expected checksum.
+func verifyChecksum(expected string, data io.Reader) error {
+	want, err := parseChecksum(expected)
+	if err != nil {
+		return err
+	}
+	hash := crc32.New(crc32cTable)
+	if _, err := io.Copy(hash, data); err != nil {
+		return err
+	}
+	if got := hash.Sum32(); got != want {
+		return fmt.Errorf("%w: got %s:%08x, want %s", errChecksumMismatch, checksumAlgorithm, got, expected)
+	}
+	return nil
+}
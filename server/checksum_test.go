@@ -0,0 +1,168 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"hash/crc32"
+	"io"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestUploadChecksumFollowsAppends(t *testing.T) {
+	chdirTemp(t)
+	for _, compressed := range []bool{false, true} {
+		compressStorage = compressed
+		key := newTestUploadKey(t)
+		filePath := uploadFilePath(key)
+		simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":71}`})
+		simulateUpload(t, key, []string{`{"bpm":72}`})
+
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if compressed {
+			if data, err = io.ReadAll(newZstdReader(bytes.NewReader(data))); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		stored, err := readChecksumFile(filePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := crc32.Checksum(data, crc32cTable); stored.CRC32C != want || stored.Size != int64(len(data)) {
+			t.Fatalf("compressed=%v: checksum = %+v, want crc %08x over %d bytes", compressed, stored, want, len(data))
+		}
+	}
+	compressStorage = false
+}
+
+func TestUploadETags(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"trackerKey":"head","timestamp":1,"position":{"x":0,"y":0,"z":0}}`})
+	checksum, err := computeUploadChecksum(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/status", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	StatusHandler(rec, req)
+	if rec.Header().Get("ETag") != `"`+checksum.String()+`"` || !strings.Contains(rec.Body.String(), checksum.String()) {
+		t.Fatalf("status ETag = %q, body %s", rec.Header().Get("ETag"), rec.Body)
+	}
+
+	export := func(ifNoneMatch string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export", nil)
+		req.SetPathValue("key", key)
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		return rec
+	}
+	etag := export("").Header().Get("ETag")
+	if !strings.HasPrefix(etag, `W/"crc32c:`) {
+		t.Fatalf("export ETag = %q", etag)
+	}
+	if rec := export(etag); rec.Code != 304 || rec.Body.Len() != 0 {
+		t.Fatalf("revalidation: status %d, body %q", rec.Code, rec.Body)
+	}
+
+	// annotations are part of the export
+	if code := postAnnotation(t, key, `{"label":"warmup","start":0,"end":5}`); code != 201 {
+		t.Fatalf("post annotation status = %d", code)
+	}
+	if rec := export(etag); rec.Code != 200 || rec.Header().Get("ETag") == etag {
+		t.Fatalf("after annotating: status %d, ETag %q", rec.Code, rec.Header().Get("ETag"))
+	}
+}
+
+func TestImportVerifiesChecksums(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":71}`})
+
+	rec := httptest.NewRecorder()
+	ArchiveHandler(rec, httptest.NewRequest("POST", "/api/export/archive", strings.NewReader(`{"keys":["`+key+`"]}`)))
+	archive := rec.Body.Bytes()
+
+	// the same archive with one record changed
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tampered bytes.Buffer
+	writer := zip.NewWriter(&tampered)
+	for _, entry := range reader.File {
+		rc, err := entry.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(rc)
+		rc.Close()
+		if strings.HasSuffix(entry.Name, ".csv") {
+			data = bytes.Replace(data, []byte(`"bpm":71`), []byte(`"bpm":17`), 1)
+		}
+		w, _ := writer.Create(entry.Name)
+		w.Write(data)
+	}
+	writer.Close()
+
+	req := httptest.NewRequest("POST", "/api/import?new_key=1", bytes.NewReader(tampered.Bytes()))
+	rec = httptest.NewRecorder()
+	ImportHandler(rec, req)
+	var response errorResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	if rec.Code != 400 || response.Error.Code != errCodeChecksumMismatch {
+		t.Fatalf("tampered archive: status %d, body %s", rec.Code, rec.Body)
+	}
+	if code, results := postImport(t, "?new_key=1", archive); code != 200 || len(results) != 1 {
+		t.Fatalf("intact archive: status %d, %+v", code, results)
+	}
+
+	// a single session file is checked against the header
+	data, err := os.ReadFile(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, err := uploadFileChecksum(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for expected, want := range map[string]int{checksum.String(): 200, "crc32c:00000000": 400, "md5:abc": 400} {
+		req := httptest.NewRequest("POST", "/api/import?new_key=1", bytes.NewReader(data))
+		req.Header.Set(checksumHeader, expected)
+		rec := httptest.NewRecorder()
+		ImportHandler(rec, req)
+		if rec.Code != want {
+			t.Fatalf("import with checksum %s: status %d, body %s", expected, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestEtagMatches(t *testing.T) {
+	for _, tc := range []struct {
+		header, etag string
+		want         bool
+	}{
+		{"", `"a"`, false},
+		{`"a"`, `"a"`, true},
+		{`W/"a"`, `"a"`, true},
+		{`"b", W/"a"`, `W/"a"`, true},
+		{`*`, `"a"`, true},
+		{`"b"`, `"a"`, false},
+	} {
+		if got := etagMatches(tc.header, tc.etag); got != tc.want {
+			t.Fatalf("etagMatches(%q, %q) = %v", tc.header, tc.etag, got)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+// clientCertRequired makes /api/upload reject requests without a verified
+// client certificate. It is set by EnableClientCertAuth.
+var clientCertRequired bool
+
+// clientIdentity describes the client certificate an upload was made with.
+// The first upload of a key records it in the metadata line, which binds the
+// key to that certificate.
+type clientIdentity struct {
+	CommonName  string   `json:"common_name"`
+	SANs        []string `json:"sans,omitempty"`
+	Fingerprint string   `json:"fingerprint"`
+}
+
+// LoadClientCAs reads a PEM bundle of CAs that device certificates must
+// chain to.
+func LoadClientCAs(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("client CA file contains no PEM certificates")
+	}
+	return pool, nil
+}
+
+// EnableClientCertAuth requires a client certificate for uploads. The TLS
+// listener must be configured to verify client certificates against the CAs
+// from LoadClientCAs.
+func EnableClientCertAuth() {
+	clientCertRequired = true
+}
+
+// requestClientIdentity returns the identity of the verified client
+// certificate of r, or nil if there is none.
+func requestClientIdentity(r *http.Request) *clientIdentity {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return nil
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+
+	identity := &clientIdentity{CommonName: cert.Subject.CommonName}
+	identity.SANs = append(identity.SANs, cert.DNSNames...)
+	identity.SANs = append(identity.SANs, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		identity.SANs = append(identity.SANs, uri.String())
+	}
+	sum := sha256.Sum256(cert.Raw)
+	identity.Fingerprint = hex.EncodeToString(sum[:])
+	return identity
+}
+
+// checkClientCert enforces client certificate authentication for an upload.
+// It returns the metadata to record for a new upload, or a non-zero error
+// status with its code and message if the request must be rejected.
+func checkClientCert(r *http.Request, uploadKey string) (metadata map[string]any, status int, code, message string) {
+	if !clientCertRequired {
+		return nil, 0, "", ""
+	}
+
+	identity := requestClientIdentity(r)
+	if identity == nil {
+		return nil, http.StatusUnauthorized, errCodeClientCertRequired, "a client certificate is required to upload"
+	}
+
+	existing, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if err != nil && !errors.Is(err, errUploadNotFound) {
+		log.Printf("failed to read upload metadata for client certificate check: %v", err)
+		return nil, http.StatusInternalServerError, errCodeInternal, "failed to read upload file"
+	}
+	if err == nil && existing.ClientCert != nil && existing.ClientCert.Fingerprint != identity.Fingerprint {
+		return nil, http.StatusForbidden, errCodeClientCertMismatch, "upload_key is bound to a different client certificate"
+	}
+
+	return map[string]any{"client_cert": identity}, 0, "", ""
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestCert(t *testing.T, cn string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     []string{cn + ".devices.example"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+func TestClientCertUpload(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	EnableClientCertAuth()
+	t.Cleanup(func() { clientCertRequired = false })
+
+	ca, caKey := newTestCert(t, "test ca", nil, nil)
+	headsetA, headsetAKey := newTestCert(t, "headset-a", ca, caKey)
+	headsetB, headsetBKey := newTestCert(t, "headset-b", ca, caKey)
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca)
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(UploadHandler))
+	srv.TLS = &tls.Config{ClientCAs: pool, ClientAuth: tls.VerifyClientCertIfGiven}
+	srv.StartTLS()
+	defer srv.Close()
+
+	upload := func(cert *x509.Certificate, certKey *ecdsa.PrivateKey) int {
+		t.Helper()
+		transport := srv.Client().Transport.(*http.Transport).Clone()
+		if cert != nil {
+			transport.TLSClientConfig.Certificates = []tls.Certificate{{Certificate: [][]byte{cert.Raw}, PrivateKey: certKey}}
+		}
+		client := &http.Client{Transport: transport}
+		req, err := http.NewRequest("POST", srv.URL+"/api/upload", strings.NewReader(`{"bpm":70}`+"\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("X-Upload-Key", key)
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := upload(nil, nil); code != http.StatusUnauthorized {
+		t.Fatalf("upload without certificate status = %d, want 401", code)
+	}
+	if code := upload(headsetA, headsetAKey); code != http.StatusOK {
+		t.Fatalf("upload with certificate status = %d, want 200", code)
+	}
+
+	metadata, err := readUploadMetadata(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.ClientCert == nil || metadata.ClientCert.CommonName != "headset-a" || metadata.ClientCert.SANs[0] != "headset-a.devices.example" {
+		t.Fatalf("client certificate not recorded: %+v", metadata.ClientCert)
+	}
+
+	if code := upload(headsetA, headsetAKey); code != http.StatusOK {
+		t.Fatalf("second upload with the bound certificate status = %d, want 200", code)
+	}
+	if code := upload(headsetB, headsetBKey); code != http.StatusForbidden {
+		t.Fatalf("upload with another device's certificate status = %d, want 403", code)
+	}
+}
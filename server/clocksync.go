@@ -0,0 +1,165 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Devices of a multi-device session each stamp records with their own clock.
+// To merge them, a device measures its offset to the server clock NTP-style:
+// it calls GET /time a few times, noting when it sent each request and
+// received the response, and posts those samples for its binding. The
+// estimated offset is stored with the binding and applied to the device's
+// record times when a merge asks for align_clocks.
+//
+// Samples must use the same clock as the device's record timestamps, in
+// seconds.
+
+// maxClockSamples bounds the samples of one offset estimate.
+const maxClockSamples = 64
+
+var serverStart = time.Now()
+
+// clockSample is one round trip to GET /time: the device's clock when it
+// sent the request and received the response, and the server's when it
+// received and answered it.
+type clockSample struct {
+	ClientSend    float64 `json:"client_send"`
+	ServerReceive float64 `json:"server_receive"`
+	ServerSend    float64 `json:"server_send"`
+	ClientReceive float64 `json:"client_receive"`
+}
+
+// clockOffset is what is added to a device's times to get server time.
+type clockOffset struct {
+	OffsetSeconds    float64 `json:"offset_seconds"`
+	RoundTripSeconds float64 `json:"round_trip_seconds"`
+	Samples          int     `json:"samples"`
+	EstimatedAt      string  `json:"estimated_at"`
+}
+
+func unixSeconds(t time.Time) float64 {
+	return float64(t.UnixNano()) / 1e9
+}
+
+// estimateClockOffset computes the offset from the sample with the shortest
+// round trip, whose delays are the most likely to be symmetric.
+func estimateClockOffset(samples []clockSample) (clockOffset, error) {
+	if len(samples) == 0 {
+		return clockOffset{}, errors.New("missing clock samples")
+	}
+	if len(samples) > maxClockSamples {
+		return clockOffset{}, fmt.Errorf("too many clock samples: at most %d are allowed", maxClockSamples)
+	}
+
+	best := clockOffset{RoundTripSeconds: math.Inf(1), Samples: len(samples)}
+	for i, s := range samples {
+		for _, v := range []float64{s.ClientSend, s.ServerReceive, s.ServerSend, s.ClientReceive} {
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				return clockOffset{}, fmt.Errorf("invalid clock sample %d: times must be finite", i)
+			}
+		}
+		roundTrip := (s.ClientReceive - s.ClientSend) - (s.ServerSend - s.ServerReceive)
+		if roundTrip < 0 || s.ServerSend < s.ServerReceive {
+			return clockOffset{}, fmt.Errorf("invalid clock sample %d: times are out of order", i)
+		}
+		if roundTrip < best.RoundTripSeconds {
+			best.RoundTripSeconds = roundTrip
+			best.OffsetSeconds = ((s.ServerReceive - s.ClientSend) + (s.ServerSend - s.ClientReceive)) / 2
+		}
+	}
+	return best, nil
+}
+
+// TimeHandler returns the server's wall clock, as Unix seconds, when it
+// received and answered the request, and its monotonic uptime. A client_send
+// parameter is echoed back so that clients can match responses to samples.
+func TimeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+	received := time.Now()
+
+	response := map[string]any{
+		"status":         "ok",
+		"server_receive": unixSeconds(received),
+	}
+	if raw := r.URL.Query().Get("client_send"); raw != "" {
+		clientSend, err := strconv.ParseFloat(raw, 64)
+		if err != nil || math.IsNaN(clientSend) || math.IsInf(clientSend, 0) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid client_send parameter: must be a number")
+			return
+		}
+		response["client_send"] = clientSend
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	sent := time.Now()
+	response["server_send"] = unixSeconds(sent)
+	response["monotonic_seconds"] = sent.Sub(serverStart).Seconds()
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write time response: %v", err)
+	}
+}
+
+// DeviceClockHandler estimates the clock offset of a bound device from the
+// samples posted as {"samples": [...]} and stores it with the binding.
+func DeviceClockHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	session, ok := multiDeviceSessionFromPath(w, r)
+	if !ok {
+		return
+	}
+	deviceID, err := parseDeviceID(r.PathValue("device"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	var request struct {
+		Samples []clockSample `json:"samples"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 16*1024)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid clock samples JSON: %v", err))
+		return
+	}
+	offset, err := estimateClockOffset(request.Samples)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+		return
+	}
+	offset.EstimatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+
+	err = setDeviceClock(session.SessionID, deviceID, offset)
+	if errors.Is(err, errDeviceNotFound) {
+		writeError(w, http.StatusNotFound, errCodeDeviceNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to store device clock: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to store session")
+		return
+	}
+
+	log.Printf("device clock estimated session_id=%q device_id=%q offset=%v round_trip=%v", session.SessionID, deviceID, offset.OffsetSeconds, offset.RoundTripSeconds)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":    "ok",
+		"device_id": deviceID,
+		"clock":     offset,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write device clock response: %v", err)
+	}
+}
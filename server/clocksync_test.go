@@ -0,0 +1,114 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestEstimateClockOffset(t *testing.T) {
+	// the device clock is 100s behind the server; the second sample has the
+	// shortest round trip but asymmetric delays would skew the others
+	offset, err := estimateClockOffset([]clockSample{
+		{ClientSend: 0, ServerReceive: 100.3, ServerSend: 100.3, ClientReceive: 0.4},
+		{ClientSend: 1, ServerReceive: 101.05, ServerSend: 101.06, ClientReceive: 1.11},
+		{ClientSend: 2, ServerReceive: 102.01, ServerSend: 102.01, ClientReceive: 2.5},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(offset.OffsetSeconds-100) > 1e-9 || math.Abs(offset.RoundTripSeconds-0.1) > 1e-9 || offset.Samples != 3 {
+		t.Fatalf("offset = %+v", offset)
+	}
+
+	if _, err := estimateClockOffset(nil); err == nil {
+		t.Fatal("no samples accepted")
+	}
+	if _, err := estimateClockOffset([]clockSample{{ClientSend: 5, ServerReceive: 1, ServerSend: 1, ClientReceive: 4}}); err == nil {
+		t.Fatal("negative round trip accepted")
+	}
+}
+
+func TestTimeHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	TimeHandler(rec, httptest.NewRequest("GET", "/api/time?client_send=12.5", nil))
+	var response struct {
+		ClientSend       float64 `json:"client_send"`
+		ServerReceive    float64 `json:"server_receive"`
+		ServerSend       float64 `json:"server_send"`
+		MonotonicSeconds float64 `json:"monotonic_seconds"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 200 || response.ClientSend != 12.5 || response.ServerSend < response.ServerReceive || response.MonotonicSeconds <= 0 {
+		t.Fatalf("time: status %d %+v", rec.Code, response)
+	}
+
+	rec = httptest.NewRecorder()
+	TimeHandler(rec, httptest.NewRequest("GET", "/api/time?client_send=soon", nil))
+	if rec.Code != 400 {
+		t.Fatalf("invalid client_send: status %d", rec.Code)
+	}
+}
+
+func TestAlignedSessionExport(t *testing.T) {
+	chdirTemp(t)
+
+	rec := httptest.NewRecorder()
+	NewMultiDeviceSessionHandler(rec, httptest.NewRequest("POST", "/api/sessions/new", nil))
+	var created struct {
+		SessionID string `json:"session_id"`
+	}
+	json.NewDecoder(rec.Body).Decode(&created)
+	id := created.SessionID
+
+	// the headset clock runs 10s ahead of the strap's
+	headset, strap := newTestUploadKey(t), newTestUploadKey(t)
+	simulateUpload(t, headset, []string{`{"timestamp":11}`, `{"timestamp":13}`})
+	simulateUpload(t, strap, []string{`{"timestamp":2}`})
+	sessionRequest(t, SessionDevicesHandler, "POST", id, "/devices", `{"device_id":"headset","upload_key":"`+headset+`"}`)
+	sessionRequest(t, SessionDevicesHandler, "POST", id, "/devices", `{"device_id":"strap","upload_key":"`+strap+`"}`)
+
+	clock := func(device string, offset float64) int {
+		body := fmt.Sprintf(`{"samples":[{"client_send":0,"server_receive":%v,"server_send":%v,"client_receive":0}]}`, offset, offset)
+		req := httptest.NewRequest("POST", "/api/sessions/"+id+"/devices/"+device+"/clock", strings.NewReader(body))
+		req.SetPathValue("id", id)
+		req.SetPathValue("device", device)
+		rec := httptest.NewRecorder()
+		DeviceClockHandler(rec, req)
+		return rec.Code
+	}
+	if code := clock("headset", 1000); code != 200 {
+		t.Fatalf("headset clock: status %d", code)
+	}
+	if code := clock("strap", 1010); code != 200 {
+		t.Fatalf("strap clock: status %d", code)
+	}
+	if code := clock("chest", 0); code != 404 {
+		t.Fatalf("unbound device clock: status %d", code)
+	}
+
+	export := func(query string) string {
+		req := httptest.NewRequest("GET", "/api/sessions/"+id+"/export"+query, nil)
+		req.SetPathValue("id", id)
+		rec := httptest.NewRecorder()
+		SessionExportHandler(rec, req)
+		return rec.Body.String()
+	}
+	if got, want := export(""), `{"device_id":"strap","timestamp":2}
+{"device_id":"headset","timestamp":11}
+{"device_id":"headset","timestamp":13}
+`; got != want {
+		t.Fatalf("unaligned export:\n%s", got)
+	}
+	if got, want := export("?align_clocks=1"), `{"aligned_time":1011,"device_id":"headset","timestamp":11}
+{"aligned_time":1012,"device_id":"strap","timestamp":2}
+{"aligned_time":1013,"device_id":"headset","timestamp":13}
+`; got != want {
+		t.Fatalf("aligned export:\n%s", got)
+	}
+}
@@ -0,0 +1,355 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Uploads whose session has ended and that haven't been written to for a
+// while can be moved to cold storage: a local archive directory or an S3
+// bucket. The upload file is replaced by a stub holding only its metadata
+// line, so listings, metadata and status keep working, and a .cold file next
+// to it records where the data went. Anything that reads the records, and an
+// append to the upload, first brings the data back. Rehydrated uploads are
+// stored uncompressed, whatever they were before.
+
+// coldStore is where cold uploads are kept.
+type coldStore interface {
+	put(name string, body io.Reader, size int64) error
+	get(name string) (io.ReadCloser, error)
+	remove(name string) error
+}
+
+// coldInfo is the content of a .cold file. It carries what status, quota
+// accounting and the upload index need, so that they don't rehydrate the
+// upload.
+type coldInfo struct {
+	Target              string         `json:"target"`
+	Object              string         `json:"object"`
+	ArchivedAt          time.Time      `json:"archived_at"`
+	LastUploadAt        time.Time      `json:"last_upload_at"`
+	Records             int            `json:"records"`
+	RecordBytes         int64          `json:"record_bytes"`
+	LastRecordTimestamp *float64       `json:"last_record_timestamp"`
+	Checksum            uploadChecksum `json:"checksum"`
+	Trackers            []string       `json:"trackers,omitempty"`
+}
+
+var (
+	coldTarget string // empty if cold storage is off
+	coldAfter  time.Duration
+
+	// coldMutex serializes moving uploads to and from cold storage
+	coldMutex sync.Mutex
+)
+
+// SetColdStorage moves uploads whose session has ended to target once they
+// haven't been written to for idle. target is a directory, or
+// s3://bucket/prefix?region=...&endpoint=... for S3 and S3-compatible
+// services, with credentials taken from the AWS_* environment variables.
+func SetColdStorage(target string, idle time.Duration) error {
+	if idle <= 0 {
+		return errors.New("cold storage idle time must be positive")
+	}
+	if !strings.HasPrefix(target, "s3://") {
+		abs, err := filepath.Abs(target)
+		if err != nil {
+			return fmt.Errorf("invalid cold storage directory: %w", err)
+		}
+		target = abs
+	}
+	if _, err := openColdStore(target); err != nil {
+		return err
+	}
+	enable := coldTarget == ""
+	coldTarget, coldAfter = target, idle
+	if enable {
+		registerJob("cold_storage", time.Hour, 10*time.Minute, sweepColdStorage)
+	}
+	return nil
+}
+
+// openColdStore returns the store for a target given to SetColdStorage.
+func openColdStore(target string) (coldStore, error) {
+	if strings.HasPrefix(target, "s3://") {
+		u, err := url.Parse(target)
+		if err != nil {
+			return nil, fmt.Errorf("invalid s3 target: %w", err)
+		}
+		return newS3Store(u)
+	}
+	if err := os.MkdirAll(target, 0o755); err != nil {
+		return nil, fmt.Errorf("create cold storage directory: %w", err)
+	}
+	return dirStore(target), nil
+}
+
+// dirStore keeps cold uploads in a local directory, such as a mounted
+// network or archive volume.
+type dirStore string
+
+func (d dirStore) put(name string, body io.Reader, _ int64) error {
+	return writeFileAtomic(filepath.Join(string(d), name), func(w *bufio.Writer) error {
+		_, err := io.Copy(w, body)
+		return err
+	})
+}
+
+func (d dirStore) get(name string) (io.ReadCloser, error) {
+	return os.Open(filepath.Join(string(d), name))
+}
+
+func (d dirStore) remove(name string) error {
+	err := os.Remove(filepath.Join(string(d), name))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func coldInfoPath(filePath string) string {
+	return strings.TrimSuffix(filePath, ".csv") + ".cold"
+}
+
+// readColdInfo returns the .cold file of an upload, or an error satisfying
+// os.IsNotExist if the upload isn't cold.
+func readColdInfo(filePath string) (coldInfo, error) {
+	data, err := os.ReadFile(coldInfoPath(filePath))
+	if err != nil {
+		return coldInfo{}, err
+	}
+	var info coldInfo
+	if err := json.Unmarshal(data, &info); err != nil {
+		return coldInfo{}, fmt.Errorf("decode cold storage file: %w", err)
+	}
+	return info, nil
+}
+
+// ensureHot brings a cold upload back from cold storage. For uploads that
+// aren't cold it costs a stat.
+func ensureHot(filePath string) error {
+	if _, err := os.Stat(coldInfoPath(filePath)); err != nil {
+		return nil
+	}
+
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	info, err := readColdInfo(filePath)
+	if os.IsNotExist(err) {
+		// rehydrated while we waited
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	store, err := openColdStore(info.Target)
+	if err != nil {
+		return fmt.Errorf("rehydrate upload: %w", err)
+	}
+	object, err := store.get(info.Object)
+	if err != nil {
+		return fmt.Errorf("rehydrate upload: %w", err)
+	}
+	defer object.Close()
+	plain, err := gzip.NewReader(object)
+	if err != nil {
+		return fmt.Errorf("rehydrate upload: %w", err)
+	}
+	err = writeFileAtomic(filePath, func(w *bufio.Writer) error {
+		_, err := io.Copy(w, plain)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("rehydrate upload: %w", err)
+	}
+	os.Chtimes(filePath, time.Time{}, info.LastUploadAt)
+
+	if err := rebuildRecordIndex(filePath); err != nil {
+		log.Printf("failed to rebuild record index of %s: %v", filePath, err)
+	}
+	refreshUploadChecksum(filePath)
+	if err := os.Remove(coldInfoPath(filePath)); err != nil {
+		return fmt.Errorf("rehydrate upload: %w", err)
+	}
+	if err := store.remove(info.Object); err != nil {
+		log.Printf("failed to remove %s from cold storage: %v", info.Object, err)
+	}
+	log.Printf("rehydrated upload from cold storage object=%s", info.Object)
+	base := strings.TrimSuffix(filepath.Base(filePath), ".csv")
+	publishAdminEvent(adminEventUploadRehydrated, base[strings.LastIndexByte(base, '_')+1:], map[string]any{"object": info.Object})
+	return nil
+}
+
+// sweepColdStorage moves every upload that is due to cold storage.
+func sweepColdStorage(ctx context.Context) error {
+	keys, err := listUploadKeys()
+	if err != nil {
+		return err
+	}
+	var failed int
+	for _, uploadKey := range keys {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := freezeUpload(uploadKey, time.Now()); err != nil {
+			log.Printf("failed to move upload to cold storage key_hash=%s: %v", uploadKeyHash(uploadKey), err)
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d uploads could not be moved to cold storage", failed)
+	}
+	return nil
+}
+
+// freezeUpload moves an upload to cold storage if its session has ended and
+// it hasn't been written to for coldAfter at now.
+func freezeUpload(uploadKey string, now time.Time) error {
+	filePath := uploadFilePath(uploadKey)
+	if sessionActive(uploadKey) {
+		return nil
+	}
+	if _, err := os.Stat(coldInfoPath(filePath)); err == nil {
+		return nil
+	}
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if now.Sub(stat.ModTime()) < coldAfter {
+		return nil
+	}
+
+	store, err := openColdStore(coldTarget)
+	if err != nil {
+		return err
+	}
+	info := coldInfo{
+		Target:       coldTarget,
+		Object:       strings.TrimSuffix(filepath.Base(filePath), ".csv") + ".csv.gz",
+		ArchivedAt:   now.UTC(),
+		LastUploadAt: stat.ModTime().UTC(),
+	}
+	if info.Checksum, err = uploadFileChecksum(filePath); err != nil {
+		return err
+	}
+	var metadataLine []byte
+	if metadataLine, err = compressForColdStorage(filePath, &info, func(gzipped *os.File, size int64) error {
+		return store.put(info.Object, gzipped, size)
+	}); err != nil {
+		return err
+	}
+
+	coldMutex.Lock()
+	defer coldMutex.Unlock()
+	if current, err := os.Stat(filePath); err != nil || current.Size() != stat.Size() || !current.ModTime().Equal(stat.ModTime()) {
+		// written to meanwhile; try again next time
+		store.remove(info.Object)
+		return err
+	}
+	// the .cold file goes first, so a crash never leaves a stub without it
+	err = writeFileAtomic(coldInfoPath(filePath), func(w *bufio.Writer) error {
+		return json.NewEncoder(w).Encode(info)
+	})
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(filePath, func(w *bufio.Writer) error {
+		_, err := w.Write(metadataLine)
+		return err
+	})
+	if err != nil {
+		os.Remove(coldInfoPath(filePath))
+		return err
+	}
+	os.Chtimes(filePath, time.Time{}, info.LastUploadAt)
+	for _, companion := range []string{recordIndexPath(filePath), frameIndexPath(filePath), checksumPath(filePath)} {
+		os.Remove(companion)
+	}
+	log.Printf("moved upload to cold storage key_hash=%s records=%d object=%s", uploadKeyHash(uploadKey), info.Records, info.Object)
+	publishAdminEvent(adminEventUploadArchived, uploadKey, map[string]any{"records": info.Records, "object": info.Object})
+	return nil
+}
+
+// compressForColdStorage gzips the plain CSV of an upload into a temporary
+// file and passes it to put, counting its records into info on the way. It
+// returns the metadata line, which stays behind in the stub.
+func compressForColdStorage(filePath string, info *coldInfo, put func(gzipped *os.File, size int64) error) ([]byte, error) {
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), ".cold-*.gz")
+	if err != nil {
+		return nil, fmt.Errorf("create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	file, err := openUploadFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	compressed := gzip.NewWriter(tmp)
+	reader := bufio.NewReaderSize(io.TeeReader(file, compressed), 64*1024)
+	metadataLine, err := reader.ReadBytes('\n')
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("read upload file: %w", err)
+	}
+	version := metadataFormatVersion(metadataLine)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if trimmed := bytes.TrimSpace(line); len(trimmed) > 0 {
+			record, perr := parseRecordLine(trimmed, version)
+			if perr != nil {
+				return nil, perr
+			}
+			info.Records++
+			info.RecordBytes += int64(len(record.Payload)) + 1
+			info.LastRecordTimestamp = nil
+			if t, ok := payloadTime(record.Payload); ok {
+				info.LastRecordTimestamp = &t
+			}
+			if tracker := payloadTrackerKey(record.Payload); tracker != "" && !slices.Contains(info.Trackers, tracker) {
+				info.Trackers = append(info.Trackers, tracker)
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read upload file: %w", err)
+		}
+	}
+	if err := compressed.Close(); err != nil {
+		return nil, err
+	}
+
+	size, err := tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	if err := put(tmp, size); err != nil {
+		return nil, err
+	}
+	if !bytes.HasSuffix(metadataLine, []byte("\n")) {
+		metadataLine = append(metadataLine, '\n')
+	}
+	return metadataLine, nil
+}
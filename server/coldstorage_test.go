@@ -0,0 +1,167 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// setTestColdStorage points cold storage at target for one test, without
+// scheduling the sweep.
+func setTestColdStorage(t *testing.T, target string) {
+	t.Helper()
+	coldTarget, coldAfter = target, 24*time.Hour
+	t.Cleanup(func() { coldTarget, coldAfter = "", 0 })
+}
+
+func exportRawUpload(t *testing.T, key string) string {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	ExportHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("export status = %d body=%s", rec.Code, rec.Body)
+	}
+	return rec.Body.String()
+}
+
+func TestColdStorage(t *testing.T) {
+	chdirTemp(t)
+	archiveDir, _ := filepath.Abs("archive")
+	setTestColdStorage(t, archiveDir)
+
+	key := newTestUploadKey(t)
+	entries := []string{
+		`{"bpm":70}`,
+		`{"trackerKey":"headset","timestamp":1000,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1100,"position":{"x":1,"y":0,"z":0}}`,
+	}
+	filePath := simulateUpload(t, key, entries)
+	checksum, err := uploadFileChecksum(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// still recording, then not idle for long enough
+	if err := freezeUpload(key, time.Now().Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	endTestSession(key)
+	if err := freezeUpload(key, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(coldInfoPath(filePath)); !os.IsNotExist(err) {
+		t.Fatal("upload moved to cold storage too early")
+	}
+
+	if err := freezeUpload(key, time.Now().Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	object := filepath.Join(archiveDir, strings.TrimSuffix(filepath.Base(filePath), ".csv")+".csv.gz")
+	if _, err := os.Stat(object); err != nil {
+		t.Fatalf("archived object: %v", err)
+	}
+	_, metadata, lines := readUploadFile(t, filePath)
+	if len(lines) != 0 || metadata["user_agent"] != "test-agent" {
+		t.Fatalf("stub = %v, %v", metadata, lines)
+	}
+	if _, err := os.Stat(recordIndexPath(filePath)); !os.IsNotExist(err) {
+		t.Fatal("record index of a cold upload kept")
+	}
+
+	// status comes from the .cold file and leaves the upload cold
+	code, status := getStatus(t, key, "")
+	if code != 200 || status["records"] != float64(3) || status["last_record_timestamp"] != float64(1100) || status["checksum"] != checksum.String() || status["cold_storage"] == nil {
+		t.Fatalf("status of cold upload: %d %v", code, status)
+	}
+	if _, err := os.Stat(coldInfoPath(filePath)); err != nil {
+		t.Fatal("status rehydrated the upload")
+	}
+
+	if raw := exportRawUpload(t, key); raw != strings.Join(entries, "\n")+"\n" {
+		t.Fatalf("export of cold upload = %q", raw)
+	}
+	if _, err := os.Stat(coldInfoPath(filePath)); !os.IsNotExist(err) {
+		t.Fatal("upload still cold after export")
+	}
+	if _, err := os.Stat(object); !os.IsNotExist(err) {
+		t.Fatal("archived object kept after rehydration")
+	}
+	if rehydrated, err := uploadFileChecksum(filePath); err != nil || rehydrated.CRC32C != checksum.CRC32C {
+		t.Fatalf("checksum after rehydration = %v, %v; want %v", rehydrated, err, checksum)
+	}
+
+	// appending to a cold upload brings it back first
+	endTestSession(key)
+	if err := freezeUpload(key, time.Now().Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	simulateUpload(t, key, []string{`{"bpm":71}`})
+	_, _, lines = readUploadFile(t, filePath)
+	assertRecords(t, lines, append(entries, `{"bpm":71}`))
+}
+
+func TestColdStorageS3(t *testing.T) {
+	chdirTemp(t)
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIDEXAMPLE")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_SESSION_TOKEN", "")
+
+	var mu sync.Mutex
+	objects := map[string][]byte{}
+	bucket := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/") || r.Header.Get("X-Amz-Date") == "" {
+			http.Error(w, "unsigned request", http.StatusForbidden)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodPut:
+			objects[r.URL.Path], _ = io.ReadAll(r.Body)
+		case http.MethodGet:
+			data, ok := objects[r.URL.Path]
+			if !ok {
+				http.NotFound(w, r)
+				return
+			}
+			w.Write(data)
+		case http.MethodDelete:
+			delete(objects, r.URL.Path)
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer bucket.Close()
+	setTestColdStorage(t, "s3://recordings/cold?region=eu-central-1&endpoint="+bucket.URL)
+
+	key := newTestUploadKey(t)
+	filePath := simulateUpload(t, key, []string{`{"bpm":70,"epoch":1000}`, `{"bpm":72,"epoch":2000}`})
+	endTestSession(key)
+	if err := freezeUpload(key, time.Now().Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	name := "/recordings/cold/" + strings.TrimSuffix(filepath.Base(filePath), ".csv") + ".csv.gz"
+	mu.Lock()
+	_, stored := objects[name]
+	mu.Unlock()
+	if !stored {
+		t.Fatalf("objects = %v, want %s", objects, name)
+	}
+
+	samples, err := readHeartRateSamples(key)
+	if err != nil || len(samples) != 2 {
+		t.Fatalf("heart rate of cold upload = %v, %v", samples, err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(objects) != 0 {
+		t.Fatal("object not deleted after rehydration")
+	}
+}
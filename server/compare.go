@@ -0,0 +1,257 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+const (
+	defaultCompareStep     = 100 * time.Millisecond
+	defaultCompareWindowMs = 1000
+	maxDTWCells            = 20_000_000
+)
+
+type compareWindow struct {
+	Start        float64 `json:"start"`
+	MeanDistance float64 `json:"mean_distance"`
+}
+
+// alignedPair is one matched pair of grid points, as offsets into the
+// resampled series of session a and b.
+type alignedPair struct {
+	A, B int
+}
+
+// relativeSeries resamples samples onto a grid starting at their first
+// timestamp and expresses positions relative to the first sample, so that
+// sessions recorded at different times and play-space spots can be compared.
+func relativeSeries(samples []trackerSample, stepMs float64) []vec3 {
+	if len(samples) == 0 {
+		return nil
+	}
+	resampled := resampleTracker(samples, samples[0].Timestamp, stepMs, resampleLinear)
+	origin := samples[0].Position
+	series := make([]vec3, len(resampled))
+	for i, s := range resampled {
+		series[i] = s.Position.sub(origin)
+	}
+	return series
+}
+
+// alignByTime pairs up grid points with the same offset from the start.
+func alignByTime(a, b []vec3) []alignedPair {
+	pairs := make([]alignedPair, min(len(a), len(b)))
+	for i := range pairs {
+		pairs[i] = alignedPair{i, i}
+	}
+	return pairs
+}
+
+// alignDTW computes a dynamic time warping path between a and b, restricted
+// to a Sakoe-Chiba band of the given width around the diagonal.
+func alignDTW(a, b []vec3, band int) []alignedPair {
+	n, m := len(a), len(b)
+	if n == 0 || m == 0 {
+		return nil
+	}
+	band = max(band, absInt(n-m))
+
+	// cost[i][j-lo(i)] for j in [lo(i), hi(i)]
+	lo := func(i int) int { return max(0, i*m/n-band) }
+	hi := func(i int) int { return min(m-1, i*m/n+band) }
+	cost := make([][]float64, n)
+	at := func(i, j int) float64 {
+		if i < 0 || j < lo(i) || j > hi(i) {
+			return math.Inf(1)
+		}
+		return cost[i][j-lo(i)]
+	}
+
+	for i := 0; i < n; i++ {
+		cost[i] = make([]float64, hi(i)-lo(i)+1)
+		for j := lo(i); j <= hi(i); j++ {
+			d := a[i].sub(b[j]).length()
+			if i == 0 && j == 0 {
+				cost[i][0] = d
+				continue
+			}
+			cost[i][j-lo(i)] = d + math.Min(at(i-1, j-1), math.Min(at(i-1, j), at(i, j-1)))
+		}
+	}
+
+	path := []alignedPair{{n - 1, m - 1}}
+	for i, j := n-1, m-1; i > 0 || j > 0; {
+		diag, up, left := at(i-1, j-1), at(i-1, j), at(i, j-1)
+		switch {
+		case diag <= up && diag <= left:
+			i, j = i-1, j-1
+		case up <= left:
+			i--
+		default:
+			j--
+		}
+		path = append(path, alignedPair{i, j})
+	}
+	for l, r := 0, len(path)-1; l < r; l, r = l+1, r-1 {
+		path[l], path[r] = path[r], path[l]
+	}
+	return path
+}
+
+func absInt(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// compareSeries returns the mean distance over all aligned pairs and its
+// breakdown into windows of session a's timeline.
+func compareSeries(a, b []vec3, pairs []alignedPair, stepMs, windowMs float64) (float64, []compareWindow) {
+	windows := []compareWindow{}
+	if len(pairs) == 0 {
+		return math.NaN(), windows
+	}
+
+	var total, windowSum float64
+	windowCount := 0
+	current := -1
+	for _, p := range pairs {
+		d := a[p.A].sub(b[p.B]).length()
+		total += d
+
+		n := int(float64(p.A) * stepMs / windowMs)
+		if n != current && windowCount > 0 {
+			windows = append(windows, compareWindow{Start: float64(current) * windowMs, MeanDistance: windowSum / float64(windowCount)})
+			windowSum, windowCount = 0, 0
+		}
+		current = n
+		windowSum += d
+		windowCount++
+	}
+	windows = append(windows, compareWindow{Start: float64(current) * windowMs, MeanDistance: windowSum / float64(windowCount)})
+
+	return total / float64(len(pairs)), windows
+}
+
+func readComparedTracker(w http.ResponseWriter, param, rawKey, tracker string) ([]trackerSample, bool) {
+	uploadKey, err := parseUploadKey(rawKey)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidUploadKey, param+": "+err.Error())
+		return nil, false
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, param+": "+err.Error())
+		return nil, false
+	}
+	if err != nil {
+		log.Printf("failed to read upload for compare: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return nil, false
+	}
+
+	trackerSamples, ok := samples[tracker]
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, fmt.Sprintf("%s: no samples for tracker %q", param, tracker))
+		return nil, false
+	}
+
+	return trackerSamples, true
+}
+
+// CompareHandler scores how similar the movement of a tracker is between two
+// sessions. Both are resampled, expressed relative to their first position
+// and, with dtw=1, aligned by dynamic time warping to tolerate differences
+// in pace. similarity is 1/(1+mean distance), so identical movement scores 1.
+func CompareHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	query := r.URL.Query()
+	tracker := query.Get("tracker")
+	if tracker == "" {
+		tracker = defaultTracker
+	}
+
+	step := defaultCompareStep
+	if resample := query.Get("resample"); resample != "" {
+		var err error
+		step, err = time.ParseDuration(resample)
+		if err != nil || step <= 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("invalid resample parameter %q: must be a positive duration such as 50ms", resample))
+			return
+		}
+	}
+	stepMs := float64(step) / float64(time.Millisecond)
+
+	windowMs, err := parsePositiveFloatParam(r, "window_ms", defaultCompareWindowMs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	useDTW := query.Get("dtw") == "1" || query.Get("dtw") == "true"
+
+	samplesA, ok := readComparedTracker(w, "a", query.Get("a"), tracker)
+	if !ok {
+		return
+	}
+	samplesB, ok := readComparedTracker(w, "b", query.Get("b"), tracker)
+	if !ok {
+		return
+	}
+
+	for _, samples := range [][]trackerSample{samplesA, samplesB} {
+		if len(samples) == 0 {
+			continue
+		}
+		span := trackerSpan{first: samples[0].Timestamp, last: samples[len(samples)-1].Timestamp}
+		if err := checkResamplePoints(span, stepMs, step.String()); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
+		}
+	}
+	a, b := relativeSeries(samplesA, stepMs), relativeSeries(samplesB, stepMs)
+
+	var pairs []alignedPair
+	if useDTW {
+		band := max(len(a), len(b)) / 10
+		if cells := len(a) * (2*max(band, absInt(len(a)-len(b))) + 1); cells > maxDTWCells {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "sessions too long for dtw at this resample rate: use a larger resample interval")
+			return
+		}
+		pairs = alignDTW(a, b, band)
+	} else {
+		pairs = alignByTime(a, b)
+	}
+
+	meanDistance, windows := compareSeries(a, b, pairs, stepMs, windowMs)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":        "ok",
+		"tracker":       tracker,
+		"resample_ms":   stepMs,
+		"dtw":           useDTW,
+		"pairs":         len(pairs),
+		"mean_distance": nil,
+		"similarity":    nil,
+		"windows":       windows,
+	}
+	if !math.IsNaN(meanDistance) {
+		response["mean_distance"] = meanDistance
+		response["similarity"] = 1 / (1 + meanDistance)
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write compare response: %v", err)
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func uploadCircle(t *testing.T, key string, samples int, periodMs, offsetX float64) {
+	t.Helper()
+	var entries []string
+	for i := 0; i < samples; i++ {
+		ts := float64(i) * 20
+		angle := 2 * math.Pi * ts / periodMs
+		entries = append(entries, fmt.Sprintf(`{"trackerKey":"headset","timestamp":%g,"position":{"x":%g,"y":1.6,"z":%g}}`, ts+5000, math.Cos(angle)+offsetX, math.Sin(angle)))
+	}
+	simulateUpload(t, key, entries)
+}
+
+func compareSessions(t *testing.T, query string) (similarity float64, pairs int) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/compare?"+query, nil)
+	rec := httptest.NewRecorder()
+	CompareHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("compare status = %d body=%s", rec.Code, rec.Body.String())
+	}
+	var payload struct {
+		Similarity float64         `json:"similarity"`
+		Pairs      int             `json:"pairs"`
+		Windows    []compareWindow `json:"windows"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode compare response: %v", err)
+	}
+	if len(payload.Windows) == 0 {
+		t.Fatalf("no windows in compare response")
+	}
+	return payload.Similarity, payload.Pairs
+}
+
+func TestCompareHandler(t *testing.T) {
+	chdirTemp(t)
+	a, b, slow := newTestUploadKey(t), newTestUploadKey(t), newTestUploadKey(t)
+
+	// same circle walked in a different spot of the room, and at half pace
+	uploadCircle(t, a, 200, 2000, 0)
+	uploadCircle(t, b, 200, 2000, 3)
+	uploadCircle(t, slow, 400, 4000, 0)
+
+	if similarity, _ := compareSessions(t, "a="+a+"&b="+b); math.Abs(similarity-1) > 1e-6 {
+		t.Fatalf("similarity of identical movement = %v, want 1", similarity)
+	}
+
+	plain, _ := compareSessions(t, "a="+a+"&b="+slow)
+	warped, pairs := compareSessions(t, "a="+a+"&b="+slow+"&dtw=1")
+	if pairs <= 40 {
+		t.Fatalf("dtw pairs = %d, want more than the shorter series", pairs)
+	}
+	if warped <= plain {
+		t.Fatalf("dtw similarity %v not better than plain %v", warped, plain)
+	}
+}
@@ -0,0 +1,427 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// compressStorage makes new uploads store each appended batch as its own
+// zstd frame. Set by EnableCompressedStorage.
+var compressStorage bool
+
+// EnableCompressedStorage stores new uploads compressed. Existing uploads
+// keep the format they were created with.
+//
+// A compressed upload is in the zstd seekable format: a zstd frame per batch
+// (the first also holds the metadata line), followed by a seek table in a
+// skippable frame that lists the size and checksum of every frame. The file
+// as a whole is a valid zstd stream that decompresses to the usual CSV.
+// Readers go through openUploadFile, which detects the format. A frame index
+// next to the file records where each frame starts and which records it
+// holds, so appends don't have to decompress the upload to continue its
+// record numbering.
+func EnableCompressedStorage() {
+	compressStorage = true
+}
+
+// frameIndexEntry describes one zstd frame of a compressed upload.
+type frameIndexEntry struct {
+	Offset      uint64 // start of the frame in the upload file
+	Length      uint32 // compressed size of the frame
+	FirstRecord uint32 // index the frame's first record has, or would have
+	Records     uint32
+}
+
+const frameIndexEntrySize = 20
+
+func frameIndexPath(filePath string) string {
+	return strings.TrimSuffix(filePath, ".csv") + ".frames"
+}
+
+// openUploadFile opens a stored upload for reading as plain CSV text,
+// decompressing it if it was stored compressed. Open errors are returned
+// unwrapped so callers can test them with os.IsNotExist.
+func openUploadFile(filePath string) (io.ReadCloser, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+	if magic, _ := reader.Peek(len(zstdMagic)); !bytes.Equal(magic, zstdMagic) {
+		return struct {
+			io.Reader
+			io.Closer
+		}{reader, file}, nil
+	}
+	decompressed := newZstdReader(reader)
+	return struct {
+		io.Reader
+		io.Closer
+	}{decompressed, closerFunc(func() error {
+		decompressed.Close()
+		return file.Close()
+	})}, nil
+}
+
+type closerFunc func() error
+
+func (f closerFunc) Close() error { return f() }
+
+// isCompressedUpload reports whether appends to filePath should be stored
+// compressed: the upload already is, or it is new and compression is on.
+func isCompressedUpload(filePath string) (bool, error) {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return compressStorage, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("open upload file: %w", err)
+	}
+	defer file.Close()
+
+	magic := make([]byte, len(zstdMagic))
+	n, err := io.ReadFull(file, magic)
+	if n == 0 {
+		return compressStorage, nil
+	}
+	if err != nil {
+		return false, nil
+	}
+	return bytes.Equal(magic, zstdMagic), nil
+}
+
+// seekTableEntry describes one frame in the seek table of a compressed
+// upload.
+type seekTableEntry struct {
+	Compressed   uint32
+	Decompressed uint32
+	Checksum     uint32 // low 32 bits of the XXH64 of the decompressed data
+}
+
+const (
+	seekTableMagic        = zstdSkippableMagic | 0xe
+	seekableMagic         = 0x8f92eab1
+	seekTableEntrySize    = 12
+	seekTableFooterSize   = 9
+	seekTableChecksumFlag = 1 << 7
+)
+
+// appendSeekTable appends the skippable frame holding the seek table of
+// entries.
+func appendSeekTable(dst []byte, entries []seekTableEntry) []byte {
+	dst = binary.LittleEndian.AppendUint32(dst, seekTableMagic)
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(entries)*seekTableEntrySize+seekTableFooterSize))
+	for _, entry := range entries {
+		dst = binary.LittleEndian.AppendUint32(dst, entry.Compressed)
+		dst = binary.LittleEndian.AppendUint32(dst, entry.Decompressed)
+		dst = binary.LittleEndian.AppendUint32(dst, entry.Checksum)
+	}
+	dst = binary.LittleEndian.AppendUint32(dst, uint32(len(entries)))
+	dst = append(dst, seekTableChecksumFlag)
+	return binary.LittleEndian.AppendUint32(dst, seekableMagic)
+}
+
+// readSeekTable reads the seek table at the end of a compressed upload of
+// size bytes.
+func readSeekTable(file io.ReaderAt, size int64) ([]seekTableEntry, error) {
+	footer := make([]byte, seekTableFooterSize)
+	if size < 8+seekTableFooterSize {
+		return nil, errors.New("no seek table")
+	}
+	if _, err := file.ReadAt(footer, size-seekTableFooterSize); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(footer[5:]) != seekableMagic {
+		return nil, errors.New("no seek table")
+	}
+	entrySize := 8
+	if footer[4]&seekTableChecksumFlag != 0 {
+		entrySize = seekTableEntrySize
+	}
+	frames := int64(binary.LittleEndian.Uint32(footer))
+	tableSize := frames*int64(entrySize) + seekTableFooterSize
+	if 8+tableSize > size {
+		return nil, errors.New("seek table larger than the file")
+	}
+
+	table := make([]byte, 8+tableSize)
+	if _, err := file.ReadAt(table, size-int64(len(table))); err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(table) != seekTableMagic || int64(binary.LittleEndian.Uint32(table[4:])) != tableSize {
+		return nil, errors.New("malformed seek table frame")
+	}
+	entries := make([]seekTableEntry, frames)
+	data := int64(0)
+	for i := range entries {
+		entry := table[8+i*entrySize:]
+		entries[i].Compressed = binary.LittleEndian.Uint32(entry)
+		entries[i].Decompressed = binary.LittleEndian.Uint32(entry[4:])
+		if entrySize == seekTableEntrySize {
+			entries[i].Checksum = binary.LittleEndian.Uint32(entry[8:])
+		}
+		data += int64(entries[i].Compressed)
+	}
+	if data != size-int64(len(table)) {
+		return nil, fmt.Errorf("seek table covers %d bytes of frames, file has %d", data, size-int64(len(table)))
+	}
+	return entries, nil
+}
+
+// rebuildSeekTable decompresses the frames of a compressed upload whose seek
+// table is missing or unreadable, e.g. after an interrupted append, and
+// returns their entries. A torn seek table at the end is dropped; a torn
+// frame is an error, left for fsck to repair.
+func rebuildSeekTable(file io.ReaderAt, size int64) ([]seekTableEntry, error) {
+	var entries []seekTableEntry
+	var tableMagic [4]byte
+	binary.LittleEndian.PutUint32(tableMagic[:], seekTableMagic)
+	for offset := int64(0); offset < size; {
+		head := make([]byte, min(size-offset, 4))
+		if _, err := file.ReadAt(head, offset); err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(tableMagic[:], head) {
+			break
+		}
+
+		counter := &countingReader{r: io.NewSectionReader(file, offset, size-offset)}
+		reader := bufio.NewReader(counter)
+		content, err := readZstdFrame(reader)
+		if err != nil {
+			return nil, fmt.Errorf("frame at offset %d: %w", offset, err)
+		}
+		length := counter.n - int64(reader.Buffered())
+		entries = append(entries, seekTableEntry{Compressed: uint32(length), Decompressed: uint32(len(content)), Checksum: uint32(xxhash.Sum64(content))})
+		offset += length
+	}
+	return entries, nil
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// uploadSeekTable returns the seek table of a compressed upload of size
+// bytes and where its frames end. A missing or unreadable table is rebuilt
+// and what is left of it cut off, so the file holds only whole frames.
+func uploadSeekTable(file *os.File, size int64) (entries []seekTableEntry, dataEnd int64, err error) {
+	if size == 0 {
+		return nil, 0, nil
+	}
+	entries, err = readSeekTable(file, size)
+	if err != nil {
+		log.Printf("rebuilding seek table of %s: %v", file.Name(), err)
+		if entries, err = rebuildSeekTable(file, size); err != nil {
+			return nil, 0, fmt.Errorf("rebuild seek table: %w", err)
+		}
+	}
+	for _, entry := range entries {
+		dataEnd += int64(entry.Compressed)
+	}
+	if dataEnd+int64(len(appendSeekTable(nil, entries))) != size {
+		if err := file.Truncate(dataEnd); err != nil {
+			return nil, 0, fmt.Errorf("truncate torn seek table: %w", err)
+		}
+	}
+	return entries, dataEnd, nil
+}
+
+// compressedFrame is where a frame of a compressed upload starts, in the
+// file and in the decompressed data.
+type compressedFrame struct {
+	Offset      int64
+	PlainOffset int64
+}
+
+// compressedFrames lists the frames of a compressed upload from its seek
+// table.
+func compressedFrames(filePath string) ([]compressedFrame, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := readSeekTable(file, info.Size())
+	if err != nil {
+		return nil, err
+	}
+
+	frames := make([]compressedFrame, len(entries))
+	var offset, plainOffset int64
+	for i, entry := range entries {
+		frames[i] = compressedFrame{Offset: offset, PlainOffset: plainOffset}
+		offset += int64(entry.Compressed)
+		plainOffset += int64(entry.Decompressed)
+	}
+	return frames, nil
+}
+
+func readFrameIndex(filePath string) ([]frameIndexEntry, error) {
+	data, err := os.ReadFile(frameIndexPath(filePath))
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%frameIndexEntrySize != 0 {
+		return nil, errors.New("truncated frame index")
+	}
+
+	entries := make([]frameIndexEntry, len(data)/frameIndexEntrySize)
+	for i := range entries {
+		entry := data[i*frameIndexEntrySize:]
+		entries[i] = frameIndexEntry{
+			Offset:      binary.LittleEndian.Uint64(entry),
+			Length:      binary.LittleEndian.Uint32(entry[8:]),
+			FirstRecord: binary.LittleEndian.Uint32(entry[12:]),
+			Records:     binary.LittleEndian.Uint32(entry[16:]),
+		}
+	}
+	return entries, nil
+}
+
+// compressedRecordCount returns the number of records in a compressed
+// upload whose frames end at dataEnd. The frame index is used if it covers
+// all frames; otherwise (an append was interrupted, or the index is missing)
+// the upload is decompressed and counted.
+func compressedRecordCount(filePath string, dataEnd int64) (int, error) {
+	entries, err := readFrameIndex(filePath)
+	if err == nil && len(entries) > 0 {
+		last := entries[len(entries)-1]
+		if int64(last.Offset)+int64(last.Length) == dataEnd {
+			return int(last.FirstRecord+last.Records) - 1, nil
+		}
+	}
+	if err != nil && !os.IsNotExist(err) {
+		log.Printf("ignoring unreadable frame index %s: %v", frameIndexPath(filePath), err)
+	}
+
+	records := 0
+	err = scanUploadFile(filePath, func(int, []byte) error {
+		records++
+		return nil
+	})
+	return records, err
+}
+
+// appendCompressedBatch stores lines as one zstd frame after the last frame
+// of a compressed upload, preceded by the metadata line if the upload is new,
+// rewrites the seek table after it and records the frame in the frame index.
+// The upload file is locked throughout, as appends read where the last frame
+// ends and how many records there are.
+func appendCompressedBatch(filePath string, metadataLine []byte, columns recordColumns, lines []string) (err error) {
+	upload, err := acquireUploadFile(filePath, true)
+	if err != nil {
+		return fmt.Errorf("open upload file: %w", err)
+	}
+	upload.mu.Lock()
+	defer func() {
+		// the entry only caches what plain appends learn
+		upload.size = -1
+		upload.mu.Unlock()
+		upload.release()
+	}()
+	file := upload.file
+
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("stat upload file: %w", err)
+	}
+	isNew := info.Size() == 0
+	seekTable, dataEnd, err := uploadSeekTable(file, info.Size())
+	if err != nil {
+		return err
+	}
+
+	existingRecords := 0
+	version := metadataFormatVersion(metadataLine)
+	if !isNew {
+		if existingRecords, err = compressedRecordCount(filePath, dataEnd); err != nil {
+			return fmt.Errorf("count existing records: %w", err)
+		}
+		if version, err = uploadFormat(filePath); err != nil {
+			return err
+		}
+	}
+
+	var plain bytes.Buffer
+	writer := bufio.NewWriter(&plain)
+	if isNew {
+		writer.Write(metadataLine)
+		writer.WriteByte('\n')
+	}
+	if err := writeRecordLines(writer, formatRecordLines(version, existingRecords+1, columns, lines)); err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("compress upload data: %w", err)
+	}
+
+	frame := zstdCompress(plain.Bytes())
+	seekTable = append(seekTable, seekTableEntry{Compressed: uint32(len(frame)), Decompressed: uint32(plain.Len()), Checksum: uint32(xxhash.Sum64(plain.Bytes()))})
+	tail := appendSeekTable(frame, seekTable)
+	_, err = file.WriteAt(tail, dataEnd)
+	if err == nil {
+		err = file.Truncate(dataEnd + int64(len(tail)))
+	}
+	if err != nil {
+		// without a seek table the next append rebuilds it
+		if isNew {
+			forgetUploadFile(upload)
+			os.Remove(filePath)
+		} else if terr := file.Truncate(dataEnd); terr != nil {
+			log.Printf("failed to truncate partial frame in %s: %v", filePath, terr)
+		}
+		return fmt.Errorf("write upload frame: %w", err)
+	}
+
+	entry := make([]byte, frameIndexEntrySize)
+	binary.LittleEndian.PutUint64(entry, uint64(dataEnd))
+	binary.LittleEndian.PutUint32(entry[8:], uint32(len(frame)))
+	binary.LittleEndian.PutUint32(entry[12:], uint32(existingRecords+1))
+	binary.LittleEndian.PutUint32(entry[16:], uint32(len(lines)))
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_APPEND
+	if isNew {
+		flags |= os.O_TRUNC // drop the index of an earlier upload at this path
+	}
+	index, err := os.OpenFile(frameIndexPath(filePath), flags, 0o644)
+	if err != nil {
+		// the data is stored; the next append recounts without the index
+		log.Printf("failed to open frame index for %s: %v", filePath, err)
+		return nil
+	}
+	if _, err := index.Write(entry); err != nil {
+		log.Printf("failed to write frame index for %s: %v", filePath, err)
+	}
+	index.Close()
+
+	records := make([]recordIndexEntry, len(lines))
+	for i, line := range lines {
+		records[i] = recordIndexEntry{Offset: dataEnd, Time: recordTime(line)}
+	}
+	appendRecordIndex(filePath, existingRecords, records)
+	extendUploadChecksum(filePath, info.Size(), plain.Bytes())
+
+	return nil
+}
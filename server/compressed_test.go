@@ -0,0 +1,179 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+func TestCompressedStorage(t *testing.T) {
+	chdirTemp(t)
+	compressStorage = true
+	t.Cleanup(func() { compressStorage = false })
+
+	key := newTestUploadKey(t)
+	filePath := uploadFilePath(key)
+	first := []string{
+		`{"trackerKey":"headset","timestamp":1,"position":{"x":1,"y":2,"z":3}}`,
+		`{"trackerKey":"left","timestamp":2,"position":{"x":4,"y":5,"z":6}}`,
+	}
+	second := []string{`{"trackerKey":"headset","timestamp":3,"position":{"x":1,"y":2,"z":4}}`}
+	simulateUpload(t, key, first)
+	simulateUpload(t, key, second)
+
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, zstdMagic) {
+		t.Fatalf("upload not stored compressed: %q", data[:16])
+	}
+
+	// the whole file is one zstd stream of the usual CSV
+	plain, err := io.ReadAll(newZstdReader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(plain)), "\n")
+	assertRecords(t, payloadRecordLines(t, lines[0], lines[1:]), append(first, second...))
+
+	entries, err := readFrameIndex(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	seekTable, err := readSeekTable(bytes.NewReader(data), int64(len(data)))
+	if err != nil || len(seekTable) != 2 {
+		t.Fatalf("seek table = %+v, %v", seekTable, err)
+	}
+	if len(entries) != 2 || entries[1].FirstRecord != 3 || entries[1].Records != 1 ||
+		entries[1].Offset != uint64(seekTable[0].Compressed) || entries[1].Length != seekTable[1].Compressed {
+		t.Fatalf("frame index = %+v, seek table %+v", entries, seekTable)
+	}
+	if got := seekTable[0].Decompressed + seekTable[1].Decompressed; int(got) != len(plain) ||
+		seekTable[1].Checksum != uint32(xxhash.Sum64(plain[seekTable[0].Decompressed:])) {
+		t.Fatalf("seek table %+v doesn't describe %d bytes", seekTable, len(plain))
+	}
+
+	metadata, err := readUploadMetadata(filePath)
+	if err != nil || metadata.UploadKey != key {
+		t.Fatalf("metadata = %+v, %v", metadata, err)
+	}
+
+	followRec := httptest.NewRecorder()
+	FollowHandler(followRec, withUploadKey(httptest.NewRequest("GET", "/api/follow?position=2", nil), key))
+	if followRec.Code != 200 || followRec.Header().Get("X-Follow-Position") != "3" {
+		t.Fatalf("follow: status %d position %s", followRec.Code, followRec.Header().Get("X-Follow-Position"))
+	}
+	if body := strings.TrimSpace(followRec.Body.String()); body != "3,"+second[0] {
+		t.Fatalf("follow body = %q", body)
+	}
+
+	// the record index points into the second frame, also when rebuilt
+	if err := rebuildRecordIndex(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if entry, _, err := readRecordIndexEntry(filePath, 2); err != nil || entry.Offset != int64(seekTable[0].Compressed) {
+		t.Fatalf("rebuilt index entry of record 3 = %+v, %v", entry, err)
+	}
+	var after []int
+	if err := scanUploadFileFrom(filePath, 2, func(index int, _ []byte) error {
+		after = append(after, index)
+		return nil
+	}); err != nil || len(after) != 1 || after[0] != 3 {
+		t.Fatalf("scan from compressed frame = %v, %v", after, err)
+	}
+
+	// without a usable index or seek table, appends recount the records
+	// and rebuild the table
+	if err := os.Remove(frameIndexPath(filePath)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filePath, int64(len(data)-5)); err != nil {
+		t.Fatal(err)
+	}
+	simulateUpload(t, key, second)
+	if data, err = os.ReadFile(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if seekTable, err := readSeekTable(bytes.NewReader(data), int64(len(data))); err != nil || len(seekTable) != 3 {
+		t.Fatalf("seek table after rebuild = %+v, %v", seekTable, err)
+	}
+	var indexes []int
+	if err := scanUploadFile(filePath, func(index int, _ []byte) error {
+		indexes = append(indexes, index)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(indexes) != 4 || indexes[3] != 4 {
+		t.Fatalf("record indexes after recount = %v", indexes)
+	}
+
+	// uploads created before compression was enabled stay plain
+	compressStorage = false
+	plainKey := newTestUploadKey(t)
+	simulateUpload(t, plainKey, first)
+	compressStorage = true
+	simulateUpload(t, plainKey, second)
+	_, _, records := readUploadFile(t, uploadFilePath(plainKey))
+	assertRecords(t, records, append(first, second...))
+}
+
+func TestCompressedStorageConcurrent(t *testing.T) {
+	chdirTemp(t)
+	compressStorage = true
+	t.Cleanup(func() { compressStorage = false })
+	procs := runtime.GOMAXPROCS(8)
+	t.Cleanup(func() { runtime.GOMAXPROCS(procs) })
+
+	key := newTestUploadKey(t)
+	const writers, batches = 8, 20
+	var wg sync.WaitGroup
+	for w := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				line := fmt.Sprintf(`{"trackerKey":"t%d","timestamp":%d}`, w, b+1)
+				if _, err := saveUpload(key, "test-agent", recordColumns{}, []string{line}, nil); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	filePath := uploadFilePath(key)
+	seen := map[int]bool{}
+	err := scanUploadFile(filePath, func(index int, payload []byte) error {
+		if seen[index] {
+			return fmt.Errorf("record %d stored twice", index)
+		}
+		seen[index] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(seen) != writers*batches {
+		t.Fatalf("stored %d records, want %d", len(seen), writers*batches)
+	}
+	entries, err := readFrameIndex(filePath)
+	if err != nil || len(entries) != writers*batches {
+		t.Fatalf("frame index has %d entries, want %d: %v", len(entries), writers*batches, err)
+	}
+	for i, entry := range entries {
+		if int(entry.FirstRecord) != i+1 || (i > 0 && entry.Offset != entries[i-1].Offset+uint64(entries[i-1].Length)) {
+			t.Fatalf("frame index entry %d = %+v after %+v", i, entry, entries[max(i-1, 0)])
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"strings"
+)
+
+// coordinateTransform converts positions from the clients' convention
+// (WebXR: meters, right-handed, Y up) into the one a consumer expects.
+type coordinateTransform struct {
+	// recenterTracker moves the origin to the first sample of this tracker
+	recenterTracker string
+	origin          vec3
+	haveOrigin      bool
+
+	zUp   bool
+	scale float64
+}
+
+var unitScales = map[string]float64{
+	"m":  1,
+	"cm": 100,
+	"mm": 1000,
+}
+
+// parseCoordinateTransform parses recenter=<tracker>, up=y|z and
+// units=m|cm|mm. It returns nil if no conversion was requested.
+func parseCoordinateTransform(query url.Values) (*coordinateTransform, error) {
+	transform := &coordinateTransform{
+		recenterTracker: query.Get("recenter"),
+		scale:           1,
+	}
+
+	switch up := strings.ToLower(query.Get("up")); up {
+	case "", "y":
+	case "z":
+		transform.zUp = true
+	default:
+		return nil, fmt.Errorf("invalid up parameter %q: must be y or z", up)
+	}
+
+	if units := query.Get("units"); units != "" {
+		scale, ok := unitScales[strings.ToLower(units)]
+		if !ok {
+			return nil, fmt.Errorf("invalid units parameter %q: must be m, cm or mm", units)
+		}
+		transform.scale = scale
+	}
+
+	if transform.recenterTracker == "" && !transform.zUp && transform.scale == 1 {
+		return nil, nil
+	}
+
+	return transform, nil
+}
+
+func (c *coordinateTransform) apply(p vec3) vec3 {
+	if c.haveOrigin {
+		p = p.sub(c.origin)
+	}
+	if c.zUp {
+		// rotate +90° about X: Y becomes Z, Z becomes -Y
+		p = vec3{p.X, -p.Z, p.Y}
+	}
+	return p.scale(c.scale)
+}
+
+// zUpRotation is the +90° rotation about X applied to orientations by up=z.
+var zUpRotation = quat{X: math.Sqrt2 / 2, W: math.Sqrt2 / 2}
+
+func (c *coordinateTransform) applyRotation(q quat) quat {
+	if c.zUp {
+		return zUpRotation.mul(q)
+	}
+	return q
+}
+
+// observe records the recentering origin from a stored "index,json" line if
+// it is still needed. Lines must be observed in stored order.
+func (c *coordinateTransform) observe(line string) {
+	if c.recenterTracker == "" || c.haveOrigin {
+		return
+	}
+	_, payload, _ := strings.Cut(line, ",")
+	var record struct {
+		TrackerKey string `json:"trackerKey"`
+		Position   *vec3  `json:"position"`
+	}
+	if json.Unmarshal([]byte(payload), &record) == nil && record.TrackerKey == c.recenterTracker && record.Position != nil {
+		c.origin, c.haveOrigin = *record.Position, true
+	}
+}
+
+// rewriteLine applies the transform to the position of a stored
+// "index,json" line. Lines without a position are returned unchanged.
+func (c *coordinateTransform) rewriteLine(line string) string {
+	index, payload, ok := strings.Cut(line, ",")
+	if !ok {
+		return line
+	}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(payload), &fields); err != nil {
+		return line
+	}
+	var position vec3
+	if raw, ok := fields["position"]; !ok || json.Unmarshal(raw, &position) != nil {
+		return line
+	}
+
+	encoded, err := json.Marshal(c.apply(position))
+	if err != nil {
+		return line
+	}
+	fields["position"] = encoded
+
+	var rotation quat
+	if raw, ok := fields["rotation"]; ok && c.zUp && json.Unmarshal(raw, &rotation) == nil {
+		if encoded, err := json.Marshal(c.applyRotation(rotation)); err == nil {
+			fields["rotation"] = encoded
+		}
+	}
+
+	rewritten, err := json.Marshal(fields)
+	if err != nil {
+		return line
+	}
+	return index + "," + string(rewritten)
+}
+
+// trackerTransform adapts the conversion to the export pipeline. The origin
+// is where the recenter tracker's samples begin after the transforms before.
+func (c *coordinateTransform) trackerTransform() trackerTransform {
+	var recentered bool
+	return func(p samplePipeline, next sampleStage) (sampleStage, error) {
+		if c.recenterTracker != "" && !recentered {
+			first, ok, err := p.first(c.recenterTracker)
+			if err != nil {
+				return nil, err
+			}
+			c.origin, c.haveOrigin, recentered = first.Position, ok, true
+		}
+		return mapStage{next: next, fn: func(s trackerSample) trackerSample {
+			s.Position = c.apply(s.Position)
+			if s.Rotation != nil {
+				rotation := c.applyRotation(*s.Rotation)
+				s.Rotation = &rotation
+			}
+			return s
+		}}, nil
+	}
+}
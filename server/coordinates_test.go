@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCoordinateTransformOnFollowAndExport(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"leftController","timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":1,"y":1.5,"z":-2}}`,
+		`{"trackerKey":"headset","timestamp":10,"position":{"x":1,"y":1.75,"z":-3}}`,
+		`{"bpm":70}`,
+	})
+
+	query := "recenter=headset&up=z&units=cm"
+	want := vec3{0, 100, 25}
+
+	req := withUploadKey(httptest.NewRequest("GET", "/api/follow?position=2&"+query, nil), key)
+	rec := httptest.NewRecorder()
+	FollowHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("follow status = %d body=%s", rec.Code, rec.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 2 || lines[1] != `4,{"bpm":70}` {
+		t.Fatalf("unexpected follow lines: %q", lines)
+	}
+	var record struct {
+		TrackerKey string `json:"trackerKey"`
+		Position   vec3   `json:"position"`
+	}
+	if err := json.Unmarshal([]byte(strings.SplitN(lines[0], ",", 2)[1]), &record); err != nil {
+		t.Fatalf("decode follow line: %v", err)
+	}
+	if record.TrackerKey != "headset" || record.Position != want {
+		t.Fatalf("follow record = %+v, want position %+v", record, want)
+	}
+
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/trajectory?tracker=headset&"+query, nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	TrajectoryHandler(rec, req)
+	var payload struct {
+		Trackers map[string][]trackerSample `json:"trackers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode trajectory response: %v", err)
+	}
+	headset := payload.Trackers["headset"]
+	if headset[0].Position != (vec3{}) || headset[1].Position != want {
+		t.Fatalf("trajectory positions = %+v", headset)
+	}
+
+	if _, err := parseCoordinateTransform(map[string][]string{"units": {"ft"}}); err == nil {
+		t.Fatalf("unknown units accepted")
+	}
+}
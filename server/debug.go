@@ -0,0 +1,34 @@
+package server
+
+import (
+	"expvar"
+	"net/http"
+	"net/http/pprof"
+	"time"
+)
+
+// Counters published on /debug/vars.
+var (
+	ingestedRecords    = expvar.NewInt("ingested_records")
+	followRequests     = expvar.NewInt("follow_requests")
+	followLatencyNanos = expvar.NewInt("follow_latency_ns_total")
+)
+
+// DebugHandler serves pprof profiles under /debug/pprof/ and expvar counters
+// under /debug/vars. It is meant for a separate, non-public listener.
+func DebugHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	mux.Handle("/debug/vars", expvar.Handler())
+	return mux
+}
+
+// observeFollow records one follow request and how long it took to serve.
+func observeFollow(start time.Time) {
+	followRequests.Add(1)
+	followLatencyNanos.Add(int64(time.Since(start)))
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+)
+
+// dedupeWindowSize is how many of the most recent (tracker, timestamp) pairs
+// of each upload are remembered to drop records that a retrying client sends
+// again. Zero disables the check. Set by SetDedupeWindow.
+var dedupeWindowSize int
+
+// maxDedupeWindowSize bounds the memory of each uploading session.
+const maxDedupeWindowSize = 1 << 20
+
+// dedupeWindow remembers the sample keys of the last records of an upload,
+// oldest first in a ring.
+type dedupeWindow struct {
+	mu   sync.Mutex
+	ring []string
+	next int
+	seen map[string]int
+}
+
+var (
+	dedupeWindows      = map[string]*dedupeWindow{}
+	dedupeWindowsMutex sync.Mutex
+)
+
+// SetDedupeWindow makes ingest drop records whose tracker and timestamp
+// match one of the last n records of their upload.
+func SetDedupeWindow(n int) error {
+	if n < 0 || n > maxDedupeWindowSize {
+		return fmt.Errorf("invalid dedupe window %d: must be between 0 and %d records", n, maxDedupeWindowSize)
+	}
+	dedupeWindowSize = n
+	return nil
+}
+
+// sampleKey identifies a record by its tracker and timestamp. Records
+// without a numeric timestamp have none and are never duplicates.
+func sampleKey(payload []byte) (string, bool) {
+	tracker, t, ok := recordTrackerTime(payload)
+	if !ok {
+		return "", false
+	}
+	return tracker + "\x00" + strconv.FormatFloat(t, 'g', -1, 64), true
+}
+
+func (d *dedupeWindow) add(key string) {
+	if old := d.ring[d.next]; old != "" {
+		if d.seen[old]--; d.seen[old] == 0 {
+			delete(d.seen, old)
+		}
+	}
+	d.ring[d.next] = key
+	d.seen[key]++
+	d.next = (d.next + 1) % len(d.ring)
+}
+
+// uploadDedupeWindow returns the window of an upload, seeding a new one from
+// the upload's last stored records so that retries still match after a
+// restart.
+func uploadDedupeWindow(uploadKey string) (*dedupeWindow, error) {
+	dedupeWindowsMutex.Lock()
+	defer dedupeWindowsMutex.Unlock()
+
+	if window, ok := dedupeWindows[uploadKey]; ok && len(window.ring) == dedupeWindowSize {
+		return window, nil
+	}
+
+	window := &dedupeWindow{ring: make([]string, dedupeWindowSize), seen: map[string]int{}}
+	tail, err := readTailRecords(uploadFilePath(uploadKey), dedupeWindowSize)
+	if err != nil && !errors.Is(err, errUploadNotFound) {
+		return nil, err
+	}
+	for _, record := range tail {
+		if key, ok := sampleKey(record.Record); ok {
+			window.add(key)
+		}
+	}
+	dedupeWindows[uploadKey] = window
+	return window, nil
+}
+
+// forgetDedupeWindow drops the window of an upload that stopped uploading.
+func forgetDedupeWindow(uploadKey string) {
+	dedupeWindowsMutex.Lock()
+	delete(dedupeWindows, uploadKey)
+	dedupeWindowsMutex.Unlock()
+}
+
+// dropDuplicateRecords removes the records of a batch that repeat a recent
+// record of the upload, or an earlier one of the same batch, and returns the
+// rest with the number dropped. The kept records only enter the window when
+// the returned remember is called, once they are stored, so that the retry
+// of a batch refused later on isn't dropped as a repeat of itself.
+func dropDuplicateRecords(uploadKey string, lines []string) (kept []string, dropped int, remember func(), err error) {
+	if dedupeWindowSize == 0 {
+		return lines, 0, func() {}, nil
+	}
+	window, err := uploadDedupeWindow(uploadKey)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+
+	window.mu.Lock()
+	defer window.mu.Unlock()
+
+	// the keys the kept records would push out of the window, so that the
+	// batch is checked against the window as it will be once stored
+	evicted := map[string]int{}
+	inBatch := map[string]bool{}
+	var keys []string
+	kept = make([]string, 0, len(lines))
+	for _, line := range lines {
+		key, ok := sampleKey([]byte(line))
+		if ok {
+			if inBatch[key] || window.seen[key]-evicted[key] > 0 {
+				continue
+			}
+			if len(keys) < len(window.ring) {
+				if old := window.ring[(window.next+len(keys))%len(window.ring)]; old != "" {
+					evicted[old]++
+				}
+			}
+			inBatch[key] = true
+			keys = append(keys, key)
+		}
+		kept = append(kept, line)
+	}
+
+	remember = func() {
+		window.mu.Lock()
+		defer window.mu.Unlock()
+		for _, key := range keys {
+			window.add(key)
+		}
+	}
+	return kept, len(lines) - len(kept), remember, nil
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDedupeWindow(t *testing.T) {
+	chdirTemp(t)
+	if err := SetDedupeWindow(3); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetDedupeWindow(0) })
+	key := newTestUploadKey(t)
+
+	upload := func(entries ...string) int {
+		t.Helper()
+		req := withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader(strings.Join(entries, "\n"))), key)
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+		var response struct {
+			DuplicatesDropped int `json:"duplicates_dropped"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil || rec.Code != 200 {
+			t.Fatalf("upload: status %d, %v", rec.Code, err)
+		}
+		return response.DuplicatesDropped
+	}
+
+	head1 := `{"trackerKey":"head","timestamp":1}`
+	hand1 := `{"trackerKey":"hand","timestamp":1}`
+	if dropped := upload(head1, hand1, head1, `{"heartRate":70}`, `{"heartRate":70}`); dropped != 1 {
+		t.Fatalf("dropped %d in first batch", dropped)
+	}
+	// a retry of the whole batch
+	if dropped := upload(head1, hand1); dropped != 2 {
+		t.Fatalf("dropped %d of retry", dropped)
+	}
+	// head1 has left the window of three
+	head2, head3 := `{"trackerKey":"head","timestamp":2}`, `{"trackerKey":"head","timestamp":3}`
+	if dropped := upload(head2, head3, head1); dropped != 0 {
+		t.Fatalf("dropped %d outside the window", dropped)
+	}
+
+	// after a restart the window is seeded from the stored records
+	forgetDedupeWindow(key)
+	if dropped := upload(head3, `{"trackerKey":"head","timestamp":4}`); dropped != 1 {
+		t.Fatalf("dropped %d after restart", dropped)
+	}
+
+	_, _, records := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, records, []string{head1, hand1, `{"heartRate":70}`, `{"heartRate":70}`, head2, head3, head1, `{"trackerKey":"head","timestamp":4}`})
+}
+
+func TestDedupeWindowRefusedBatch(t *testing.T) {
+	chdirTemp(t)
+	if err := SetDedupeWindow(10); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetDedupeWindow(0) })
+	key := newTestUploadKey(t)
+	setTestQuotas(t, quotaUsage{Records: 1}, quotaUsage{})
+
+	batch := []string{`{"trackerKey":"head","timestamp":1}`, `{"trackerKey":"head","timestamp":2}`}
+	if code, _ := postTenantUpload(t, key, "", batch); code != 413 {
+		t.Fatalf("batch over the quota: status %d", code)
+	}
+	// the retry once the quota is raised isn't a duplicate of the refused batch
+	setTestQuotas(t, quotaUsage{}, quotaUsage{})
+	if code, _ := postTenantUpload(t, key, "", batch); code != 200 {
+		t.Fatalf("retry: status %d", code)
+	}
+	_, _, records := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, records, batch)
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// minFreeSpace is how many bytes must stay free on the upload volume after
+// a batch is stored; 0 disables the guard. Set by SetMinFreeSpace.
+var minFreeSpace int64
+
+// diskAlertWebhook is POSTed to when free space falls below minFreeSpace and
+// when it recovers. Set by SetDiskAlertWebhook.
+var diskAlertWebhook string
+
+// Disk space metrics published on /debug/vars.
+var (
+	diskFreeBytes      = expvar.NewInt("disk_free_bytes")
+	diskFullRejections = expvar.NewInt("uploads_refused_disk_full")
+)
+
+var (
+	diskSpaceLow        bool // whether the last check was below the floor
+	diskSpaceLowMutex   sync.Mutex
+	diskAlertHTTPClient = &http.Client{Timeout: 10 * time.Second}
+	diskAlerts          chan diskAlert
+	startDiskAlerts     sync.Once
+)
+
+// diskSpace is freeDiskSpace, replaced in tests.
+var diskSpace = freeDiskSpace
+
+var errInsufficientStorage = errors.New("insufficient storage")
+
+// SetMinFreeSpace makes ingestion refuse batches with 507 Insufficient
+// Storage once storing them would leave less than bytes free on the volume
+// holding the uploads, rather than failing in the middle of a write. 0
+// disables the check.
+func SetMinFreeSpace(bytes int64) error {
+	if bytes < 0 {
+		return errors.New("invalid minimum free space: must not be negative")
+	}
+	if bytes > 0 {
+		if _, err := diskSpace(diskSpaceDir()); err != nil {
+			return fmt.Errorf("can't guard free disk space: %w", err)
+		}
+	}
+	minFreeSpace = bytes
+	return nil
+}
+
+// SetDiskAlertWebhook sets a URL that gets a JSON POST when free space falls
+// below the floor of SetMinFreeSpace, and another when it recovers.
+func SetDiskAlertWebhook(rawURL string) error {
+	if rawURL != "" {
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid disk alert webhook %q: must be an http or https URL", rawURL)
+		}
+	}
+	diskAlertWebhook = rawURL
+	return nil
+}
+
+// diskSpaceDir is the directory whose volume is checked: the upload
+// directory, or its parent before the first upload creates it.
+func diskSpaceDir() string {
+	if _, err := os.Stat(uploadDir); err == nil {
+		return uploadDir
+	}
+	return filepath.Dir(uploadDir)
+}
+
+// checkDiskSpace returns an errInsufficientStorage error if storing size more
+// bytes would leave less free space than the floor. A failure to determine
+// the free space is logged and lets the batch through.
+func checkDiskSpace(size int64) error {
+	if minFreeSpace == 0 {
+		return nil
+	}
+	free, err := diskSpace(diskSpaceDir())
+	if err != nil {
+		log.Printf("failed to check free disk space: %v", err)
+		return nil
+	}
+	diskFreeBytes.Set(free)
+
+	low := free < minFreeSpace
+	diskSpaceLowMutex.Lock()
+	changed := low != diskSpaceLow
+	diskSpaceLow = low
+	diskSpaceLowMutex.Unlock()
+	if changed {
+		notifyDiskSpace(low, free)
+	}
+
+	if free-size < minFreeSpace {
+		diskFullRejections.Add(1)
+		return fmt.Errorf("%w: %d bytes free on the upload volume, at least %d must stay free", errInsufficientStorage, free, minFreeSpace)
+	}
+	return nil
+}
+
+// notifyDiskSpace logs that free space fell below the floor, or recovered,
+// and tells the webhook if there is one.
+func notifyDiskSpace(low bool, free int64) {
+	event := "disk_space_recovered"
+	if low {
+		event = "disk_space_low"
+		log.Printf("free disk space low, refusing uploads: free=%d min_free=%d", free, minFreeSpace)
+	} else {
+		log.Printf("free disk space recovered, accepting uploads: free=%d min_free=%d", free, minFreeSpace)
+	}
+	if diskAlertWebhook == "" {
+		return
+	}
+
+	message, err := json.Marshal(map[string]any{
+		"event":          event,
+		"free_bytes":     free,
+		"min_free_bytes": minFreeSpace,
+		"at":             time.Now().UTC().Format(time.RFC3339Nano),
+	})
+	if err != nil {
+		log.Printf("failed to encode disk alert: %v", err)
+		return
+	}
+	startDiskAlerts.Do(func() {
+		// one sender, so that the webhook gets events in order
+		diskAlerts = make(chan diskAlert, 16)
+		go func() {
+			for alert := range diskAlerts {
+				sendDiskAlert(alert)
+			}
+		}()
+	})
+	select {
+	case diskAlerts <- diskAlert{webhook: diskAlertWebhook, message: message}:
+	default:
+		log.Printf("disk alert queue full, dropping %s event", event)
+	}
+}
+
+type diskAlert struct {
+	webhook string
+	message []byte
+}
+
+func sendDiskAlert(alert diskAlert) {
+	resp, err := diskAlertHTTPClient.Post(alert.webhook, "application/json", bytes.NewReader(alert.message))
+	if err != nil {
+		log.Printf("failed to send disk alert: %v", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("failed to send disk alert: webhook returned %s", resp.Status)
+	}
+}
@@ -0,0 +1,76 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFreeDiskSpace(t *testing.T) {
+	free, err := freeDiskSpace(t.TempDir())
+	if err != nil || free <= 0 {
+		t.Skipf("free disk space unavailable: %d, %v", free, err)
+	}
+}
+
+func TestDiskSpaceGuard(t *testing.T) {
+	chdirTemp(t)
+	free := int64(1 << 20)
+	diskSpace = func(string) (int64, error) { return free, nil }
+
+	events := make(chan map[string]any, 2)
+	webhook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event map[string]any
+		body, _ := io.ReadAll(r.Body)
+		json.Unmarshal(body, &event)
+		events <- event
+	}))
+	defer webhook.Close()
+
+	t.Cleanup(func() {
+		diskSpace = freeDiskSpace
+		minFreeSpace, diskAlertWebhook, diskSpaceLow = 0, "", false
+	})
+	if err := SetMinFreeSpace(1000); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetDiskAlertWebhook(webhook.URL); err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+
+	free = 500
+	rejected := diskFullRejections.Value()
+	code, response := postTenantUpload(t, key, "", []string{`{"bpm":71}`})
+	if code != 507 || response.Error.Code != errCodeInsufficientStorage {
+		t.Fatalf("upload on a full disk: status %d, %+v", code, response)
+	}
+	if diskFullRejections.Value() != rejected+1 || diskFreeBytes.Value() != 500 {
+		t.Fatalf("metrics: rejections %d, free %d", diskFullRejections.Value(), diskFreeBytes.Value())
+	}
+	_, _, lines := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, lines, []string{`{"bpm":70}`})
+
+	free = 1 << 20
+	simulateUpload(t, key, []string{`{"bpm":71}`})
+
+	for _, want := range []string{"disk_space_low", "disk_space_recovered"} {
+		select {
+		case event := <-events:
+			if event["event"] != want || event["min_free_bytes"] != float64(1000) {
+				t.Fatalf("webhook event = %v, want %s", event, want)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s webhook", want)
+		}
+	}
+
+	if err := SetDiskAlertWebhook("ftp://example.com"); err == nil {
+		t.Fatal("SetDiskAlertWebhook accepted a non-HTTP URL")
+	}
+}
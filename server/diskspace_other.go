@@ -0,0 +1,11 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+import "errors"
+
+// freeDiskSpace isn't implemented on this platform; SetMinFreeSpace refuses
+// to enable the disk space guard here.
+func freeDiskSpace(path string) (int64, error) {
+	return 0, errors.New("free disk space can't be determined on this platform")
+}
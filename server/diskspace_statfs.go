@@ -0,0 +1,15 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import "syscall"
+
+// freeDiskSpace returns how many bytes unprivileged processes can still
+// write to the file system holding path.
+func freeDiskSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+	return int64(uint64(stat.Bavail) * uint64(stat.Bsize)), nil
+}
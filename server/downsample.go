@@ -0,0 +1,298 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// Long sessions have far more records than a browser can draw. downsample=
+// thins them out as they stream, the same way for follow, trajectory,
+// export and replay, per series: each tracker, and the records without a
+// tracker, on their own. downsample=10hz keeps at most 10 records a second,
+// by capture time; downsample=4 keeps every 4th record. With :minmax, e.g.
+// downsample=10hz:minmax, every bucket of records keeps its first and last
+// record and those with the smallest and largest value of each coordinate,
+// or of the heart rate, so peaks survive. Records without a capture time
+// pass through in rate mode.
+//
+// Records are still sent in stored order. In minmax mode the records of a
+// bucket are only known once it ends, so a stream holds back the records of
+// the buckets open at the time. A bucket ends when the next record of its
+// series falls in another one, or when the stream moves on without it: in
+// rate mode once any record is past the bucket's time, and in either mode
+// once the bucket began more than maxDownsampleSpan records ago. A series
+// that stops, such as a tracker that disconnected, thus doesn't hold back
+// the other series until the end.
+
+// maxDownsampleSpan is how many records after its first a minmax bucket is
+// ended anyway.
+const maxDownsampleSpan = 10000
+
+type downsample struct {
+	rateHz float64 // 0 when decimating
+	factor int     // 0 when downsampling to a rate
+	minMax bool
+}
+
+// parseDownsample reads the downsample query parameter, returning nil if
+// there is none.
+func parseDownsample(query url.Values) (*downsample, error) {
+	spec := query.Get("downsample")
+	if spec == "" {
+		return nil, nil
+	}
+	value, mode, hasMode := strings.Cut(spec, ":")
+	d := &downsample{}
+	switch {
+	case !hasMode:
+	case mode == "minmax":
+		d.minMax = true
+	default:
+		return nil, fmt.Errorf("invalid downsample parameter %q: the only mode is minmax", spec)
+	}
+	if rate, ok := strings.CutSuffix(strings.ToLower(value), "hz"); ok {
+		hz, err := strconv.ParseFloat(rate, 64)
+		if err != nil || hz <= 0 || math.IsInf(hz, 0) {
+			return nil, fmt.Errorf("invalid downsample parameter %q: rate must be a positive number of hz", spec)
+		}
+		d.rateHz = hz
+		return d, nil
+	}
+	factor, err := strconv.Atoi(value)
+	if err != nil || factor < 1 {
+		return nil, fmt.Errorf("invalid downsample parameter %q: must be a rate such as 10hz or a decimation factor such as 4", spec)
+	}
+	d.factor = factor
+	return d, nil
+}
+
+// downsamplePoint is what a downsampling stream needs to know of a record.
+type downsamplePoint struct {
+	index   int
+	series  string
+	time    float64
+	hasTime bool
+	values  []float64
+}
+
+// payloadDownsamplePoint reads a stored payload as a downsamplePoint: its
+// series is the tracker and its values the position, or the heart rate.
+func payloadDownsamplePoint(index int, payload []byte) downsamplePoint {
+	var record struct {
+		TrackerKey string   `json:"trackerKey"`
+		Position   *vec3    `json:"position"`
+		BPM        *float64 `json:"bpm"`
+		HeartRate  *float64 `json:"heartRate"`
+	}
+	json.Unmarshal(payload, &record)
+	p := downsamplePoint{index: index, series: record.TrackerKey}
+	p.time, p.hasTime = payloadTime(payload)
+	switch {
+	case record.Position != nil:
+		p.values = []float64{record.Position.X, record.Position.Y, record.Position.Z}
+	case record.BPM != nil:
+		p.values = []float64{*record.BPM}
+	case record.HeartRate != nil:
+		p.values = []float64{*record.HeartRate}
+	}
+	return p
+}
+
+type downsampleItem[T any] struct {
+	index int
+	item  T
+}
+
+// downsampleBucket is the open bucket of one series.
+type downsampleBucket[T any] struct {
+	id    int
+	count int // records in the series so far, when decimating
+	first downsampleItem[T]
+	last  downsampleItem[T]
+	// per value, the items with the smallest and largest value
+	mins, maxs []downsampleItem[T]
+	minV, maxV []float64
+	open       bool
+}
+
+// downsampleStream downsamples records pushed in stored order and passes
+// those it keeps to emit, in the same order.
+type downsampleStream[T any] struct {
+	d      downsample
+	emit   func(T) error
+	series map[string]*downsampleBucket[T]
+	ready  []downsampleItem[T] // kept, waiting for older open buckets
+}
+
+func newDownsampleStream[T any](d downsample, emit func(T) error) *downsampleStream[T] {
+	return &downsampleStream[T]{d: d, emit: emit, series: map[string]*downsampleBucket[T]{}}
+}
+
+// push adds a record to the stream.
+func (s *downsampleStream[T]) push(p downsamplePoint, item T) error {
+	if s.d.minMax {
+		s.closeStale(p)
+	}
+
+	b, ok := s.series[p.series]
+	if !ok {
+		b = &downsampleBucket[T]{id: math.MinInt}
+		s.series[p.series] = b
+	}
+
+	var id int
+	switch {
+	case s.d.factor > 0:
+		id = b.count / s.d.factor
+		b.count++
+	case p.hasTime:
+		id = int(math.Floor(p.time * s.d.rateHz / 1000))
+	default:
+		// nothing to bucket by
+		return s.keep(downsampleItem[T]{p.index, item})
+	}
+
+	if !s.d.minMax {
+		if id == b.id && b.open {
+			return nil
+		}
+		b.id, b.open = id, true
+		return s.emit(item)
+	}
+
+	if id != b.id || !b.open {
+		s.close(b)
+		*b = downsampleBucket[T]{id: id, count: b.count, first: downsampleItem[T]{p.index, item}, open: true}
+	}
+	current := downsampleItem[T]{p.index, item}
+	b.last = current
+	for i, v := range p.values {
+		if i >= len(b.mins) {
+			b.mins, b.maxs = append(b.mins, current), append(b.maxs, current)
+			b.minV, b.maxV = append(b.minV, v), append(b.maxV, v)
+			continue
+		}
+		if v < b.minV[i] {
+			b.mins[i], b.minV[i] = current, v
+		}
+		if v > b.maxV[i] {
+			b.maxs[i], b.maxV[i] = current, v
+		}
+	}
+	return s.release()
+}
+
+// close moves the records kept from an open bucket to the ready ones.
+func (s *downsampleStream[T]) close(b *downsampleBucket[T]) {
+	if !b.open || !s.d.minMax {
+		return
+	}
+	b.open = false
+	kept := append([]downsampleItem[T]{b.first, b.last}, b.mins...)
+	kept = append(kept, b.maxs...)
+	for _, item := range kept {
+		i, found := slices.BinarySearchFunc(s.ready, item.index, func(r downsampleItem[T], index int) int { return r.index - index })
+		if !found {
+			s.ready = slices.Insert(s.ready, i, item)
+		}
+	}
+}
+
+// closeStale ends the open buckets the stream has moved past by the time
+// of p, whatever their series.
+func (s *downsampleStream[T]) closeStale(p downsamplePoint) {
+	id, timed := 0, s.d.rateHz > 0 && p.hasTime
+	if timed {
+		id = int(math.Floor(p.time * s.d.rateHz / 1000))
+	}
+	for _, b := range s.series {
+		if b.open && (timed && b.id < id || p.index-b.first.index > maxDownsampleSpan) {
+			s.close(b)
+		}
+	}
+}
+
+// keep passes on a record kept regardless of buckets.
+func (s *downsampleStream[T]) keep(item downsampleItem[T]) error {
+	if !s.d.minMax {
+		return s.emit(item.item)
+	}
+	i, _ := slices.BinarySearchFunc(s.ready, item.index, func(r downsampleItem[T], index int) int { return r.index - index })
+	s.ready = slices.Insert(s.ready, i, item)
+	return s.release()
+}
+
+// release emits the ready records older than any open bucket.
+func (s *downsampleStream[T]) release() error {
+	oldest := math.MaxInt
+	for _, b := range s.series {
+		if b.open {
+			oldest = min(oldest, b.first.index)
+		}
+	}
+	n := 0
+	for n < len(s.ready) && s.ready[n].index < oldest {
+		if err := s.emit(s.ready[n].item); err != nil {
+			return err
+		}
+		n++
+	}
+	s.ready = s.ready[n:]
+	return nil
+}
+
+// flush ends every open bucket and emits what is left.
+func (s *downsampleStream[T]) flush() error {
+	for _, b := range s.series {
+		s.close(b)
+	}
+	return s.release()
+}
+
+// scan wraps a scanUploadFile callback so that it only sees the records
+// kept; the returned flush has to be called after the scan.
+func (d *downsample) scan(fn func(index int, payload []byte) error) (func(index int, payload []byte) error, func() error) {
+	type record struct {
+		index   int
+		payload []byte
+	}
+	stream := newDownsampleStream(*d, func(r record) error { return fn(r.index, r.payload) })
+	push := func(index int, payload []byte) error {
+		// the scanner reuses its buffer for the next line
+		payload = slices.Clone(payload)
+		return stream.push(payloadDownsamplePoint(index, payload), record{index, payload})
+	}
+	return push, stream.flush
+}
+
+// stage downsamples the samples of one tracker, passing those it keeps to
+// next.
+func (d *downsample) stage(tracker string, next sampleStage) sampleStage {
+	return &downsampleStage{stream: newDownsampleStream(*d, next.push), next: next, tracker: tracker}
+}
+
+type downsampleStage struct {
+	stream  *downsampleStream[trackerSample]
+	next    sampleStage
+	tracker string
+	count   int
+}
+
+func (st *downsampleStage) push(s trackerSample) error {
+	// samples are in order, but not all carry a record index
+	p := downsamplePoint{index: st.count, series: st.tracker, time: s.Timestamp, hasTime: true, values: []float64{s.Position.X, s.Position.Y, s.Position.Z}}
+	st.count++
+	return st.stream.push(p, s)
+}
+
+func (st *downsampleStage) flush() error {
+	if err := st.stream.flush(); err != nil {
+		return err
+	}
+	return st.next.flush()
+}
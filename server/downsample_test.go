@@ -0,0 +1,217 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestParseDownsample(t *testing.T) {
+	for spec, want := range map[string]downsample{
+		"10hz":        {rateHz: 10},
+		"0.5Hz":       {rateHz: 0.5},
+		"4":           {factor: 4},
+		"10hz:minmax": {rateHz: 10, minMax: true},
+		"1:minmax":    {factor: 1, minMax: true},
+	} {
+		d, err := parseDownsample(url.Values{"downsample": {spec}})
+		if err != nil || d == nil || *d != want {
+			t.Errorf("parseDownsample(%q) = %+v, %v", spec, d, err)
+		}
+	}
+	if d, err := parseDownsample(url.Values{}); d != nil || err != nil {
+		t.Errorf("parseDownsample() = %+v, %v", d, err)
+	}
+	for _, spec := range []string{"0hz", "-2hz", "hz", "0", "2.5", "fast", "10hz:max", "4:"} {
+		if _, err := parseDownsample(url.Values{"downsample": {spec}}); err == nil {
+			t.Errorf("parseDownsample(%q) accepted", spec)
+		}
+	}
+}
+
+// headsetWalk returns one headset record every 10 ms for a second, walking
+// along x, with a spike in y at 450 ms.
+func headsetWalk() []string {
+	var lines []string
+	for i := range 100 {
+		y := 1.6
+		if i == 45 {
+			y = 2.5
+		}
+		lines = append(lines, fmt.Sprintf(`{"trackerKey":"headset","timestamp":%d,"position":{"x":%g,"y":%g,"z":0}}`, i*10, float64(i)/100, y))
+	}
+	return lines
+}
+
+func TestExportDownsample(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	lines := headsetWalk()
+	// a second tracker and heart rate records, which are downsampled on
+	// their own
+	lines = append(lines[:50:50], append([]string{
+		`{"trackerKey":"leftController","timestamp":500,"position":{"x":0,"y":1,"z":0}}`,
+		`{"bpm":70}`,
+		`{"trackerKey":"leftController","timestamp":510,"position":{"x":0,"y":1,"z":0}}`,
+		`{"bpm":71}`,
+	}, lines[50:]...)...)
+	simulateUpload(t, key, lines)
+
+	export := func(query string) []map[string]any {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export?"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("export?%s status = %d body=%s", query, rec.Code, rec.Body.String())
+		}
+		var records []map[string]any
+		for _, line := range strings.Split(strings.TrimSpace(rec.Body.String()), "\n") {
+			var record map[string]any
+			if err := json.Unmarshal([]byte(line), &record); err != nil {
+				t.Fatalf("decode export line %q: %v", line, err)
+			}
+			records = append(records, record)
+		}
+		return records
+	}
+	count := func(records []map[string]any, tracker string) int {
+		n := 0
+		for _, record := range records {
+			if key, _ := record["trackerKey"].(string); key == tracker {
+				n++
+			}
+		}
+		return n
+	}
+
+	decimated := export("downsample=4")
+	if count(decimated, "headset") != 25 || count(decimated, "leftController") != 1 || count(decimated, "") != 1 {
+		t.Fatalf("downsample=4 kept %d headset, %d controller and %d other records", count(decimated, "headset"), count(decimated, "leftController"), count(decimated, ""))
+	}
+
+	// records without a capture time pass through
+	rate := export("downsample=10hz")
+	if count(rate, "headset") != 10 || count(rate, "leftController") != 1 || count(rate, "") != 2 {
+		t.Fatalf("downsample=10hz kept %d headset, %d controller and %d other records", count(rate, "headset"), count(rate, "leftController"), count(rate, ""))
+	}
+	if rate[1]["timestamp"] != float64(100) {
+		t.Fatalf("second record at %v, want 100", rate[1]["timestamp"])
+	}
+	for _, record := range rate {
+		if y := record["position"]; y != nil && y.(map[string]any)["y"] == 2.5 {
+			t.Fatalf("spike survived downsample=10hz")
+		}
+	}
+
+	minMax := export("downsample=2hz:minmax")
+	spike := false
+	last := -1.0
+	for _, record := range minMax {
+		if record["trackerKey"] != "headset" {
+			continue
+		}
+		if ts := record["timestamp"].(float64); ts <= last {
+			t.Fatalf("records out of order: %v after %v", ts, last)
+		} else {
+			last = ts
+		}
+		spike = spike || record["position"].(map[string]any)["y"] == 2.5
+	}
+	if !spike {
+		t.Fatalf("spike lost with minmax: %v", minMax)
+	}
+	// per bucket the first, last, and extremes of x and y
+	if n := count(minMax, "headset"); n < 4 || n > 8 {
+		t.Fatalf("downsample=2hz:minmax kept %d headset records", n)
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export?downsample=fast", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	ExportHandler(rec, req)
+	if rec.Code != 400 {
+		t.Fatalf("invalid downsample status = %d, want 400", rec.Code)
+	}
+}
+
+func TestTrajectoryDownsample(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, headsetWalk())
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/trajectory?downsample=20hz:minmax", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	TrajectoryHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("trajectory status = %d body=%s", rec.Code, rec.Body.String())
+	}
+	var payload struct {
+		Trackers map[string][]trackerSample `json:"trackers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode trajectory response: %v", err)
+	}
+	headset := payload.Trackers["headset"]
+	if len(headset) >= 100 || len(headset) < 20 {
+		t.Fatalf("trajectory kept %d samples", len(headset))
+	}
+	spike := false
+	for i, s := range headset {
+		if i > 0 && s.Timestamp <= headset[i-1].Timestamp {
+			t.Fatalf("samples out of order at %d: %+v", i, headset)
+		}
+		spike = spike || s.Position.Y == 2.5
+	}
+	if !spike {
+		t.Fatalf("spike lost with minmax")
+	}
+}
+
+func TestFollowDownsample(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, headsetWalk())
+
+	// the limit counts records read, so the position still advances by it
+	rec := httptest.NewRecorder()
+	FollowHandler(rec, withUploadKey(httptest.NewRequest("GET", "/api/follow?limit=40&downsample=10", nil), key))
+	if rec.Code != 200 {
+		t.Fatalf("follow status = %d body=%s", rec.Code, rec.Body.String())
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 4 || !strings.HasPrefix(lines[1], "11,") {
+		t.Fatalf("follow lines = %q", lines)
+	}
+	if position := rec.Header().Get("X-Follow-Position"); position != "40" {
+		t.Fatalf("follow position = %s, want 40", position)
+	}
+}
+
+func TestDownsampleStoppedSeries(t *testing.T) {
+	for _, d := range []downsample{{rateHz: 10, minMax: true}, {factor: 4, minMax: true}} {
+		emitted := 0
+		stream := newDownsampleStream(d, func(int) error {
+			emitted++
+			return nil
+		})
+		// the hand tracker sends one record and disconnects
+		stream.push(downsamplePoint{index: 1, series: "hand", time: 0, hasTime: true, values: []float64{0}}, 1)
+		held := 0
+		for i := 2; i < 3*maxDownsampleSpan; i++ {
+			p := downsamplePoint{index: i, series: "headset", time: float64(i * 10), hasTime: true, values: []float64{float64(i % 7)}}
+			if err := stream.push(p, i); err != nil {
+				t.Fatal(err)
+			}
+			held = max(held, len(stream.ready))
+		}
+		if emitted == 0 || held > maxDownsampleSpan {
+			t.Errorf("%+v: emitted %d records before the end, held back up to %d", d, emitted, held)
+		}
+	}
+}
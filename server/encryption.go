@@ -0,0 +1,130 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// encryptedUploadType is the Content-Type of end-to-end encrypted uploads:
+// one ciphertext per line, in a printable encoding of the client's choice
+// such as base64 or JWE compact serialization. The server can't read the
+// records, so it stores them as sent: no JSON validation, timestamp
+// checks, dedupe, reordering, quantization or receive time. Follow relays
+// the ciphertext, and analyses find no samples in such uploads.
+const encryptedUploadType = "application/x-hrdemo-encrypted"
+
+// maxKeyIDLength is the longest key_id accepted.
+const maxKeyIDLength = 128
+
+// encryptionInfo is the metadata of an encrypted upload. The key ID names
+// the client's key so that readers know which one to decrypt with; the
+// server never sees the key itself.
+type encryptionInfo struct {
+	KeyID string `json:"key_id"`
+}
+
+var errEncryptionMismatch = errors.New("encryption mismatch")
+
+// parseKeyID validates the key_id of an encrypted upload.
+func parseKeyID(raw string) (string, error) {
+	if raw == "" || len(raw) > maxKeyIDLength {
+		return "", fmt.Errorf("invalid key_id: must be 1 to %d characters", maxKeyIDLength)
+	}
+	for _, c := range raw {
+		if !('a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.ContainsRune("._:-", c)) {
+			return "", fmt.Errorf("invalid key_id %q: must only contain letters, digits, '.', '_', ':' and '-'", raw)
+		}
+	}
+	return raw, nil
+}
+
+// parseUploadKeyID returns the key_id of an upload request, which encrypted
+// bodies must have and other bodies must not.
+func parseUploadKeyID(r *http.Request) (string, error) {
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	raw := r.URL.Query().Get("key_id")
+	switch {
+	case mediaType == encryptedUploadType && raw == "":
+		return "", fmt.Errorf("missing key_id parameter: required for %s bodies", encryptedUploadType)
+	case mediaType != encryptedUploadType && raw != "":
+		return "", fmt.Errorf("key_id parameter is only allowed with Content-Type %s", encryptedUploadType)
+	case raw == "":
+		return "", nil
+	}
+	return parseKeyID(raw)
+}
+
+// validCiphertext reports whether a line can be stored as an encrypted
+// record: non-empty printable ASCII without spaces, so that it fits on one
+// record line whatever the format version.
+func validCiphertext(line []byte) bool {
+	if len(line) == 0 {
+		return false
+	}
+	for _, c := range line {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// validPayload reports whether a stored payload is well-formed: a ciphertext
+// in encrypted uploads, JSON otherwise.
+func validPayload(payload []byte, encrypted bool) bool {
+	if encrypted {
+		return validCiphertext(payload)
+	}
+	return json.Valid(payload)
+}
+
+// readCiphertextLines reads the body of an encrypted upload, one ciphertext
+// per line.
+func readCiphertextLines(body io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 0, 1024*1024), 16*1024*1024)
+
+	lines := make([]string, 0, 200)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !validCiphertext([]byte(line)) {
+			return nil, fmt.Errorf("invalid ciphertext on line %d: must be printable ASCII without spaces", len(lines)+1)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading request body: %v", err)
+	}
+	return lines, nil
+}
+
+// checkUploadEncryption checks that a batch matches the mode of its upload:
+// an upload is encrypted, with a single key, or not, from its first batch
+// on. keyID is empty for plaintext batches.
+func checkUploadEncryption(uploadKey, keyID string) error {
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if errors.Is(err, errUploadNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	switch {
+	case metadata.Encryption == nil && keyID != "":
+		return fmt.Errorf("%w: upload stores plaintext records", errEncryptionMismatch)
+	case metadata.Encryption != nil && keyID == "":
+		return fmt.Errorf("%w: upload is encrypted, send %s bodies with key_id %q", errEncryptionMismatch, encryptedUploadType, metadata.Encryption.KeyID)
+	case metadata.Encryption != nil && metadata.Encryption.KeyID != keyID:
+		return fmt.Errorf("%w: upload is encrypted with key_id %q", errEncryptionMismatch, metadata.Encryption.KeyID)
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func postEncrypted(t *testing.T, key, query, contentType, body string) (int, errorResponse) {
+	t.Helper()
+	req := withUploadKey(httptest.NewRequest("POST", "/api/upload?"+query, strings.NewReader(body)), key)
+	req.Header.Set("Content-Type", contentType)
+	rec := httptest.NewRecorder()
+	UploadHandler(rec, req)
+	var response errorResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return rec.Code, response
+}
+
+func TestEncryptedUpload(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	ciphertexts := []string{"eyJhbGciOiJkaXIifQ..bm9uY2U.Y2lwaGVy.dGFn", "AAECAwQFBgcICQ=="}
+
+	if code, _ := postEncrypted(t, key, "&key_id=partner:2024-1", encryptedUploadType, strings.Join(ciphertexts, "\n")); code != 200 {
+		t.Fatalf("encrypted upload status = %d", code)
+	}
+
+	_, _, lines := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, lines, ciphertexts)
+	metadata, err := readUploadMetadata(uploadFilePath(key))
+	if err != nil || metadata.Encryption == nil || metadata.Encryption.KeyID != "partner:2024-1" {
+		t.Fatalf("metadata = %+v, %v", metadata, err)
+	}
+	tail, err := readTailRecords(uploadFilePath(key), 1)
+	if err != nil || len(tail) != 1 || string(tail[0].Record) != ciphertexts[1] {
+		t.Fatalf("tail = %+v, %v", tail, err)
+	}
+
+	// follow relays the ciphertext
+	req := withUploadKey(httptest.NewRequest("GET", "/api/follow", nil), key)
+	rec := httptest.NewRecorder()
+	FollowHandler(rec, req)
+	if rec.Code != 200 || rec.Body.String() != "1,"+ciphertexts[0]+"\n2,"+ciphertexts[1]+"\n" {
+		t.Fatalf("follow status %d, body %q", rec.Code, rec.Body)
+	}
+
+	// and so does the raw export
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/export", nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	ExportHandler(rec, req)
+	if rec.Header().Get("Content-Type") != encryptedUploadType || rec.Header().Get("X-Encryption-Key-Id") != "partner:2024-1" ||
+		rec.Body.String() != strings.Join(ciphertexts, "\n")+"\n" {
+		t.Fatalf("export headers %v, body %q", rec.Header(), rec.Body)
+	}
+
+	if report, err := checkUploadFile(uploadFilePath(key)); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("fsck report = %+v, %v", report, err)
+	}
+}
+
+func TestEncryptedUploadMismatch(t *testing.T) {
+	chdirTemp(t)
+	encrypted := newTestUploadKey(t)
+	if code, _ := postEncrypted(t, encrypted, "&key_id=k1", encryptedUploadType, "Y2lwaGVy"); code != 200 {
+		t.Fatalf("encrypted upload status = %d", code)
+	}
+	plain := newTestUploadKey(t)
+	simulateUpload(t, plain, []string{`{"bpm":70}`})
+
+	for _, tc := range []struct {
+		key, query, contentType, body string
+	}{
+		{encrypted, "&key_id=k2", encryptedUploadType, "Y2lwaGVy"},
+		{encrypted, "", "application/x-ndjson", `{"bpm":70}`},
+		{plain, "&key_id=k1", encryptedUploadType, "Y2lwaGVy"},
+	} {
+		code, response := postEncrypted(t, tc.key, tc.query, tc.contentType, tc.body)
+		if code != 409 || response.Error.Code != errCodeEncryptionMismatch {
+			t.Fatalf("upload %s%s as %s: status %d, %+v", tc.key, tc.query, tc.contentType, code, response)
+		}
+	}
+
+	for _, tc := range []struct {
+		query, contentType, body string
+	}{
+		{"", encryptedUploadType, "Y2lwaGVy"},
+		{"&key_id=k1", "application/x-ndjson", `{"bpm":70}`},
+		{"&key_id=" + url.QueryEscape("k 1"), encryptedUploadType, "Y2lwaGVy"},
+		{"&key_id=k1", encryptedUploadType, "not ciphertext"},
+	} {
+		if code, response := postEncrypted(t, newTestUploadKey(t), tc.query, tc.contentType, tc.body); code != 400 {
+			t.Fatalf("upload%s as %s: status %d, %+v", tc.query, tc.contentType, code, response)
+		}
+	}
+}
@@ -0,0 +1,572 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A participant can ask for their data to be erased (GDPR Art. 17). The
+// admin erase endpoint finds their uploads by upload key or by a label such
+// as participant=P017 and either deletes them or anonymizes them, keeping
+// the records for research under a fresh key that nothing links to the old
+// one. Anonymized records lose their device ids and the fields the server
+// added, and keep their receive time only to the day. Everything else the
+// server holds about the uploads goes too: annotations, fsck backups, cold
+// storage objects, upload traces, batches waiting for relay upstreams,
+// multi-device bindings and what is kept in memory about the key. The key
+// itself is revoked so that a device still holding it can't start the
+// upload again.
+//
+// Each erasure is answered with a report signed with Ed25519, which the
+// operator keeps as evidence. Log lines of past requests only ever name the
+// key hash and are left alone.
+
+const (
+	eraseDelete    = "delete"
+	eraseAnonymize = "anonymize"
+)
+
+// anonymizedMetadata are the metadata fields anonymized uploads keep;
+// others, such as the user agent, client IP and labels, could identify the
+// participant. received_at is kept only to the day.
+var anonymizedMetadata = []string{
+	"server_version", "format_version", "timestamp_unit",
+	"quantization", "encryption", "tenant",
+}
+
+// anonymizedReceiveTime is how precisely anonymized uploads keep when the
+// server received them.
+const anonymizedReceiveTime = 24 * time.Hour
+
+// erasureSigningKey signs erasure reports. Set by SetErasureSigningKey at
+// startup, else generated once when first needed, see erasureKey.
+var (
+	erasureSigningKey     ed25519.PrivateKey
+	erasureSigningKeyOnce sync.Once
+)
+
+// SetErasureSigningKey signs erasure reports with the Ed25519 key whose
+// hex-encoded seed is in path, creating the file with a new key if it
+// doesn't exist. Without one, reports are signed with a key that lasts
+// until the server restarts.
+func SetErasureSigningKey(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		seed := make([]byte, ed25519.SeedSize)
+		rand.Read(seed)
+		if err := os.WriteFile(path, []byte(hex.EncodeToString(seed)+"\n"), 0o600); err != nil {
+			return fmt.Errorf("create erasure signing key: %w", err)
+		}
+		erasureSigningKey = ed25519.NewKeyFromSeed(seed)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return fmt.Errorf("invalid erasure signing key %s: expected %d hex-encoded bytes", path, ed25519.SeedSize)
+	}
+	erasureSigningKey = ed25519.NewKeyFromSeed(seed)
+	return nil
+}
+
+// erasureReport says what an erasure removed. Signature signs the JSON
+// encoding of the report without it.
+type erasureReport struct {
+	ID          string         `json:"id"`
+	ErasedAt    time.Time      `json:"erased_at"`
+	Mode        string         `json:"mode"`
+	Subject     string         `json:"subject"`
+	RequestedBy string         `json:"requested_by"`
+	Uploads     []erasedUpload `json:"uploads"`
+	PublicKey   string         `json:"public_key"`
+	Signature   string         `json:"signature,omitempty"`
+}
+
+// erasedUpload is what was removed of one upload. Keys are only named by
+// their hash, which is how the logs name them too.
+type erasedUpload struct {
+	KeyHash    string   `json:"key_hash"`
+	Anonymized bool     `json:"anonymized,omitempty"`
+	Removed    []string `json:"removed"`
+	Errors     []string `json:"errors,omitempty"`
+}
+
+// erasureKey returns the key erasure reports are signed with, generating a
+// temporary one if none was set. Concurrent erasures get the same key.
+func erasureKey() ed25519.PrivateKey {
+	erasureSigningKeyOnce.Do(func() {
+		if erasureSigningKey == nil {
+			_, erasureSigningKey, _ = ed25519.GenerateKey(rand.Reader)
+			log.Print("signing erasure reports with a temporary key; set -erasure-key to keep it across restarts")
+		}
+	})
+	return erasureSigningKey
+}
+
+// sign sets the public key and signature of the report.
+func (report *erasureReport) sign() {
+	key := erasureKey()
+	report.PublicKey = base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey))
+	report.Signature = ""
+	data, _ := json.Marshal(report)
+	report.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+}
+
+// verify reports whether the report carries a valid signature by its
+// public key.
+func (report erasureReport) verify() bool {
+	publicKey, err := base64.StdEncoding.DecodeString(report.PublicKey)
+	if err != nil || len(publicKey) != ed25519.PublicKeySize {
+		return false
+	}
+	signature, err := base64.StdEncoding.DecodeString(report.Signature)
+	if err != nil {
+		return false
+	}
+	report.Signature = ""
+	data, _ := json.Marshal(report)
+	return ed25519.Verify(publicKey, data, signature)
+}
+
+// EraseHandler erases the uploads of a participant, given as
+// {"upload_key": ...}, which also takes an upload name as GET /uploads
+// lists it, or {"label": "name=value"}, with "mode" delete (the default) or
+// anonymize, and returns the signed erasure report.
+func EraseHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	var request struct {
+		UploadKey string `json:"upload_key"`
+		Label     string `json:"label"`
+		Mode      string `json:"mode"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid erase JSON: %v", err))
+		return
+	}
+	mode := cmp.Or(request.Mode, eraseDelete)
+	if mode != eraseDelete && mode != eraseAnonymize {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid mode: must be delete or anonymize")
+		return
+	}
+
+	report := erasureReport{ID: newRequestID(), ErasedAt: time.Now().UTC(), Mode: mode, RequestedBy: "admin token"}
+	if id, ok := sessionIdentity(r); ok {
+		report.RequestedBy = cmp.Or(id.Email, id.Subject)
+	}
+
+	var keys []string
+	switch {
+	case (request.UploadKey == "") == (request.Label == ""):
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "give either upload_key or label")
+		return
+	case request.UploadKey != "":
+		uploadKey, status, code, err := resolveUploadRef(request.UploadKey)
+		if err != nil {
+			writeError(w, status, code, err.Error())
+			return
+		}
+		report.Subject = "upload " + uploadKeyHash(uploadKey)
+		keys = []string{uploadKey}
+	default:
+		name, value, err := parseUploadLabel(request.Label)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
+		}
+		report.Subject = "label " + name + "=" + value
+		if keys, err = uploadKeysWithLabel(name, value); err != nil {
+			log.Printf("failed to find uploads to erase: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to find uploads")
+			return
+		}
+		if len(keys) == 0 {
+			writeError(w, http.StatusNotFound, errCodeUploadNotFound, "no upload has label "+request.Label)
+			return
+		}
+	}
+
+	report.Uploads = []erasedUpload{}
+	for _, uploadKey := range keys {
+		erased := eraseUpload(uploadKey, mode)
+		report.Uploads = append(report.Uploads, erased)
+		log.Printf("erased upload key_hash=%s mode=%s removed=%d errors=%d report=%s", erased.KeyHash, mode, len(erased.Removed), len(erased.Errors), report.ID)
+		publishAdminEvent(adminEventUploadErased, "", map[string]any{"key_hash": erased.KeyHash, "mode": mode, "report": report.ID})
+	}
+	report.sign()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		log.Printf("failed to write erasure report: %v", err)
+	}
+}
+
+// uploadKeysWithLabel returns the stored uploads and the handed out keys
+// that have the label name=value.
+func uploadKeysWithLabel(name, value string) ([]string, error) {
+	stored, err := listUploadKeys()
+	if err != nil {
+		return nil, err
+	}
+	var found []string
+	for _, uploadKey := range stored {
+		metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+		if err != nil {
+			return nil, err
+		}
+		if sessionLabels(uploadKey, metadata.Labels)[name] == value {
+			found = append(found, uploadKey)
+		}
+	}
+	uploadKeys.each(func(uploadKey string, info uploadKeyInfo) {
+		if info.Labels[name] == value && !slices.Contains(found, uploadKey) {
+			found = append(found, uploadKey)
+		}
+	})
+	slices.Sort(found)
+	return found, nil
+}
+
+// eraseUpload deletes or anonymizes one upload and everything that refers
+// to it. It carries on past failures, which end up in the report.
+func eraseUpload(uploadKey, mode string) erasedUpload {
+	erased := erasedUpload{KeyHash: uploadKeyHash(uploadKey), Removed: []string{}}
+	removed := func(what string) { erased.Removed = append(erased.Removed, what) }
+	failed := func(err error) { erased.Errors = append(erased.Errors, err.Error()) }
+
+	// the key goes first, so no upload recreates what is being erased
+	if _, err := uploadKeys.revoke(uploadKey, time.Now()); err != nil {
+		failed(err)
+	}
+	uploadKeys.setLabels(uploadKey, nil)
+	if n := discardWriteBehind(uploadKey); n > 0 {
+		removed(fmt.Sprintf("%d buffered records", n))
+	}
+	forgetUploadKeyState(uploadKey)
+	removed("in-memory key state")
+
+	filePath := uploadFilePath(uploadKey)
+	if mode == eraseAnonymize {
+		if _, err := os.Stat(filePath); err == nil {
+			if err := anonymizeUpload(filePath); err != nil {
+				failed(fmt.Errorf("anonymize upload: %w", err))
+			} else {
+				erased.Anonymized = true
+				removed("identifying metadata and device ids")
+			}
+		}
+	} else if info, err := readColdInfo(filePath); err == nil {
+		store, err := openColdStore(info.Target)
+		if err == nil {
+			err = store.remove(info.Object)
+		}
+		if err != nil {
+			failed(fmt.Errorf("remove cold storage object: %w", err))
+		} else {
+			removed("cold storage object")
+		}
+	}
+
+	files := []struct{ what, path string }{
+		{"annotations", annotationsFilePath(uploadKey)},
+		{"linked labels", linkedLabelsPath(uploadKey)},
+	}
+	if !erased.Anonymized {
+		files = append(files,
+			struct{ what, path string }{"upload file", filePath},
+			struct{ what, path string }{"record index", recordIndexPath(filePath)},
+			struct{ what, path string }{"frame index", frameIndexPath(filePath)},
+			struct{ what, path string }{"checksum", checksumPath(filePath)},
+			struct{ what, path string }{"cold storage stub", coldInfoPath(filePath)},
+		)
+	}
+	backups, _ := filepath.Glob(filePath + ".*.bak")
+	for _, backup := range backups {
+		files = append(files, struct{ what, path string }{"fsck backup", backup})
+	}
+	if traceDir != "" {
+		files = append(files,
+			struct{ what, path string }{"upload trace", filepath.Join(traceDir, uploadKeyHash(uploadKey)+".ndjson")},
+			struct{ what, path string }{"signed upload trace", filepath.Join(traceDir, "signed-"+uploadSigningID(uploadKey)+".ndjson")},
+		)
+	}
+	for _, file := range files {
+		err := os.Remove(file.path)
+		switch {
+		case err == nil:
+			removed(file.what)
+		case !os.IsNotExist(err):
+			failed(fmt.Errorf("remove %s: %w", file.what, err))
+		}
+	}
+	uploadKeys.forgetStoredFile(uploadKey)
+	forgetQuotaUsage()
+
+	n, err := removeRelayedBatches(uploadKey)
+	if err != nil {
+		failed(fmt.Errorf("remove relay batches: %w", err))
+	}
+	if n > 0 {
+		removed(fmt.Sprintf("%d relay batches", n))
+	}
+	n, err = unbindErasedDevice(uploadKey)
+	if err != nil {
+		failed(fmt.Errorf("unbind from multi-device sessions: %w", err))
+	}
+	if n > 0 {
+		removed(fmt.Sprintf("%d multi-device session bindings", n))
+	}
+	return erased
+}
+
+// discardWriteBehind drops the batches of an upload waiting to be written
+// and returns how many records they had.
+func discardWriteBehind(uploadKey string) int {
+	writeBehindBuffersMutex.Lock()
+	buffer, ok := writeBehindBuffers[uploadKey]
+	delete(writeBehindBuffers, uploadKey)
+	writeBehindBuffersMutex.Unlock()
+	if !ok {
+		return 0
+	}
+	buffer.mu.Lock()
+	defer buffer.mu.Unlock()
+	records := buffer.records
+	for _, release := range buffer.releases {
+		release()
+	}
+	buffer.batches, buffer.records, buffer.releases, buffer.closed = nil, 0, nil, true
+	return records
+}
+
+// forgetUploadKeyState drops what the server keeps in memory about an
+// upload key, apart from the key store entry that marks it revoked.
+func forgetUploadKeyState(uploadKey string) {
+	filePath := uploadFilePath(uploadKey)
+	uploadFilesMutex.Lock()
+	if u, ok := uploadFiles[filePath]; ok {
+		uploadFilesMutex.Unlock()
+		forgetUploadFile(u)
+	} else {
+		uploadFilesMutex.Unlock()
+	}
+
+	activeSessionsMutex.Lock()
+	delete(activeSessions, uploadKey)
+	activeSessionsMutex.Unlock()
+
+	pairingsMutex.Lock()
+	for code, p := range pairings {
+		if p.uploadKey == uploadKey {
+			delete(pairings, code)
+		}
+	}
+	for token, key := range followTokens {
+		if key == uploadKey {
+			delete(followTokens, token)
+		}
+	}
+	pairingsMutex.Unlock()
+
+	uploadKeys.forgetSigningID(uploadKey)
+
+	forgetDedupeWindow(uploadKey)
+	forgetTrackerClock(uploadKey)
+
+	followStatesMutex.Lock()
+	delete(followStates, uploadKey)
+	followStatesMutex.Unlock()
+}
+
+// anonymizeUpload moves an upload to a new random key, keeping only the
+// metadata in anonymizedMetadata. Records lose their device id, the
+// server_received_at field and the fields record scripts set, and their
+// receive time is truncated to the day. Cold uploads are brought back first.
+func anonymizeUpload(filePath string) error {
+	if err := ensureHot(filePath); err != nil {
+		return err
+	}
+	metadata, err := readUploadMetadataMap(filePath)
+	if err != nil {
+		return err
+	}
+	newKey, err := generateUploadKey()
+	if err != nil {
+		return err
+	}
+	kept := map[string]any{
+		"upload_key":    newKey,
+		"upload_name":   uploadNameFromKey(newKey),
+		"anonymized_at": time.Now().UTC().Format(time.RFC3339Nano),
+	}
+	for _, field := range anonymizedMetadata {
+		if v, ok := metadata[field]; ok {
+			kept[field] = v
+		}
+	}
+	if received, ok := metadata["received_at"].(string); ok {
+		if receivedAt, err := time.Parse(time.RFC3339Nano, received); err == nil {
+			kept["received_at"] = receivedAt.UTC().Truncate(anonymizedReceiveTime).Format(time.RFC3339Nano)
+		}
+	}
+
+	// fields of scripts loaded since the upload was created are stripped too
+	stripped := map[string]bool{"server_received_at": true}
+	if fields, ok := metadata["script_fields"].([]any); ok {
+		for _, field := range fields {
+			if name, ok := field.(string); ok {
+				stripped[name] = true
+			}
+		}
+	}
+	for _, field := range ingestScriptFields() {
+		stripped[field] = true
+	}
+	metadataJSON, err := json.Marshal(kept)
+	if err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+
+	err = rewriteUpload(filePath, metadataJSON, func(yield func(recordLine) error) error {
+		_, err := scanUploadFileLenient(filePath, func(record recordLine) error {
+			record.DeviceID = ""
+			if record.ReceivedAt != 0 {
+				record.ReceivedAt = time.UnixMilli(record.ReceivedAt).UTC().Truncate(anonymizedReceiveTime).UnixMilli()
+			}
+			record.Payload = removeObjectFields(record.Payload, stripped)
+			return yield(record)
+		}, func(fsckProblem) {})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	newPath := uploadFilePath(newKey)
+	for _, move := range [][2]string{
+		{recordIndexPath(filePath), recordIndexPath(newPath)},
+		{frameIndexPath(filePath), frameIndexPath(newPath)},
+		{filePath, newPath},
+	} {
+		if err := os.Rename(move[0], move[1]); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	os.Remove(checksumPath(filePath))
+	refreshUploadChecksum(newPath)
+	return nil
+}
+
+// removeObjectFields removes the top-level fields in names from a JSON
+// object record, keeping the others in order. Other records are returned
+// as they are.
+func removeObjectFields(record []byte, names map[string]bool) []byte {
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return record
+	}
+	var kept [][]byte
+	removed := false
+	for decoder.More() {
+		keyStart := decoder.InputOffset()
+		key, err := decoder.Token()
+		if err != nil {
+			return record
+		}
+		// the key as written, after the comma before it
+		rawKey := bytes.TrimLeft(record[keyStart:decoder.InputOffset()], ", \t\r\n")
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return record
+		}
+		if names[key.(string)] {
+			removed = true
+			continue
+		}
+		kept = append(kept, slices.Concat(rawKey, []byte(":"), value))
+	}
+	if _, err := decoder.Token(); err != nil || !removed {
+		return record
+	}
+	return slices.Concat([]byte("{"), bytes.Join(kept, []byte(",")), []byte("}"))
+}
+
+// removeRelayedBatches removes the batches of an upload that wait for, or
+// were refused by, relay upstreams, and returns how many there were.
+func removeRelayedBatches(uploadKey string) (int, error) {
+	var removed int
+	for _, relay := range relayUpstreams {
+		for _, dir := range []string{relay.queueDir, filepath.Join(relay.queueDir, "failed")} {
+			paths, err := filepath.Glob(filepath.Join(dir, "*.json"))
+			if err != nil {
+				return removed, err
+			}
+			for _, path := range paths {
+				data, err := os.ReadFile(path)
+				if err != nil {
+					// sent meanwhile
+					continue
+				}
+				var batch relayedBatch
+				if json.Unmarshal(data, &batch) != nil || batch.UploadKey != uploadKey {
+					continue
+				}
+				if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+					return removed, err
+				}
+				removed++
+			}
+		}
+	}
+	return removed, nil
+}
+
+// unbindErasedDevice removes an upload from every multi-device session it
+// is bound to and returns how many bindings there were.
+func unbindErasedDevice(uploadKey string) (int, error) {
+	paths, err := filepath.Glob(multiDeviceSessionPath("*"))
+	if err != nil {
+		return 0, err
+	}
+	multiDeviceSessionsMutex.Lock()
+	defer multiDeviceSessionsMutex.Unlock()
+	var unbound int
+	for _, path := range paths {
+		session, err := loadMultiDeviceSession(strings.TrimSuffix(filepath.Base(path), ".json"))
+		if errors.Is(err, errSessionNotFound) {
+			continue
+		}
+		if err != nil {
+			return unbound, err
+		}
+		n := len(session.Devices)
+		session.Devices = slices.DeleteFunc(session.Devices, func(device boundDevice) bool { return device.UploadKey == uploadKey })
+		if len(session.Devices) == n {
+			continue
+		}
+		if err := storeMultiDeviceSession(session); err != nil {
+			return unbound, err
+		}
+		unbound += n - len(session.Devices)
+	}
+	return unbound, nil
+}
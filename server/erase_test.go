@@ -0,0 +1,174 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func erase(t *testing.T, body string) erasureReport {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	EraseHandler(rec, httptest.NewRequest("POST", "/api/admin/erase", strings.NewReader(body)))
+	if rec.Code != 200 {
+		t.Fatalf("erase %s: status = %d: %s", body, rec.Code, rec.Body)
+	}
+	var report erasureReport
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil {
+		t.Fatal(err)
+	}
+	if !report.verify() {
+		t.Fatalf("erasure report signature does not verify: %s", rec.Body)
+	}
+	return report
+}
+
+func TestEraseByLabel(t *testing.T) {
+	chdirTemp(t)
+	participant, other := newTestUploadKey(t), newTestUploadKey(t)
+	registerUploadKey(participant)
+	uploadKeys.setLabels(participant, map[string]string{"participant": "P017"})
+	filePath := simulateUpload(t, participant, []string{`{"bpm":70}`, `{"bpm":71}`})
+	otherPath := simulateUpload(t, other, []string{`{"bpm":80}`})
+	if _, err := addAnnotation(participant, annotation{Label: "sneezed", Start: 1, End: 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	report := erase(t, `{"label":"participant=P017"}`)
+	if len(report.Uploads) != 1 || report.Uploads[0].KeyHash != uploadKeyHash(participant) || len(report.Uploads[0].Errors) > 0 {
+		t.Fatalf("report uploads = %+v", report.Uploads)
+	}
+	for _, path := range []string{filePath, recordIndexPath(filePath), annotationsFilePath(participant)} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("%s still exists", path)
+		}
+	}
+	if _, err := os.Stat(otherPath); err != nil {
+		t.Fatalf("other upload: %v", err)
+	}
+	if err := uploadKeys.check(participant, report.ErasedAt); err != errUploadKeyRevoked {
+		t.Fatalf("erased key check = %v", err)
+	}
+
+	tampered := report
+	tampered.Mode = eraseAnonymize
+	if tampered.verify() {
+		t.Fatal("tampered report verifies")
+	}
+}
+
+func TestEraseAnonymize(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	filePath := simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":71}`})
+
+	report := erase(t, `{"upload_key":"`+key+`","mode":"anonymize"}`)
+	if len(report.Uploads) != 1 || !report.Uploads[0].Anonymized {
+		t.Fatalf("report uploads = %+v", report.Uploads)
+	}
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatal("upload is still stored under its old key")
+	}
+
+	matches, _ := filepath.Glob(filepath.Join(uploadDir, "*.csv"))
+	if len(matches) != 1 {
+		t.Fatalf("uploads after anonymizing: %v", matches)
+	}
+	_, metadata, lines := readUploadFile(t, matches[0])
+	if metadata["user_agent"] != nil || metadata["anonymized_at"] == nil || metadata["upload_key"] == key {
+		t.Fatalf("anonymized metadata = %v", metadata)
+	}
+	if len(lines) != 2 || !strings.HasSuffix(lines[1], `{"bpm":71}`) {
+		t.Fatalf("anonymized records = %q", lines)
+	}
+}
+
+func TestEraseAnonymizeStripsServerFields(t *testing.T) {
+	chdirTemp(t)
+	setTestIngestHooks(t)
+	t.Cleanup(func() { ingestScript, recordReceiveTime = nil, false })
+	if err := os.WriteFile("study.star", []byte("def ingest(record):\n    record[\"site\"] = \"lab-2\"\n    return record\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetRecordScript("study.star"); err != nil {
+		t.Fatal(err)
+	}
+	EnableRecordReceiveTime()
+
+	key := newTestUploadKey(t)
+	registerUploadKey(key)
+	uploadKeys.setLabels(key, map[string]string{"venue": "lab-2"})
+	simulateUpload(t, key, []string{`{"timestamp":5,"bpm":70}`})
+	// anonymizing goes by the fields the upload noted, not the loaded script
+	ingestScript = nil
+
+	erase(t, `{"upload_key":"`+key+`","mode":"anonymize"}`)
+	matches, _ := filepath.Glob(filepath.Join(uploadDir, "*.csv"))
+	if len(matches) != 1 {
+		t.Fatalf("uploads after anonymizing: %v", matches)
+	}
+	_, metadata, lines := readUploadFile(t, matches[0])
+	for _, field := range []string{"labels", "script_fields", "record_receive_time", "user_agent"} {
+		if _, ok := metadata[field]; ok {
+			t.Errorf("anonymized metadata has %s: %v", field, metadata)
+		}
+	}
+	receivedAt, err := time.Parse(time.RFC3339Nano, metadata["received_at"].(string))
+	if err != nil || !receivedAt.Equal(receivedAt.Truncate(24*time.Hour)) {
+		t.Errorf("anonymized received_at = %v", metadata["received_at"])
+	}
+
+	var records []recordLine
+	_, err = scanUploadFileLenient(matches[0], func(record recordLine) error {
+		records = append(records, record)
+		return nil
+	}, func(fsckProblem) {})
+	if err != nil || len(records) != 1 {
+		t.Fatalf("anonymized records = %+v, %v", records, err)
+	}
+	record := records[0]
+	if string(record.Payload) != `{"bpm":70,"timestamp":5}` || record.DeviceID != "" || record.ReceivedAt%(24*60*60*1000) != 0 {
+		t.Fatalf("anonymized record = %+v %s", record, record.Payload)
+	}
+	for _, leak := range []string{"lab-2", "server_received_at"} {
+		if strings.Contains(strings.Join(lines, "\n"), leak) {
+			t.Errorf("anonymized records contain %s: %q", leak, lines)
+		}
+	}
+
+	if got := string(removeObjectFields([]byte(` { "a" : 1 , "b" : [2], "c":"x" } `), map[string]bool{"b": true})); got != `{"a":1,"c":"x"}` {
+		t.Errorf("removeObjectFields = %s", got)
+	}
+}
+
+func TestErasureReportsConcurrent(t *testing.T) {
+	procs := runtime.GOMAXPROCS(8)
+	t.Cleanup(func() { runtime.GOMAXPROCS(procs) })
+
+	reports := make([]erasureReport, 16)
+	var wg sync.WaitGroup
+	for i := range reports {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reports[i] = erasureReport{ID: fmt.Sprint(i), Mode: eraseDelete}
+			reports[i].sign()
+		}()
+	}
+	wg.Wait()
+	for _, report := range reports {
+		if !report.verify() {
+			t.Fatalf("report %s does not verify", report.ID)
+		}
+		if report.PublicKey != reports[0].PublicKey {
+			t.Fatalf("reports signed with different keys: %s and %s", report.PublicKey, reports[0].PublicKey)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+)
+
+// Error codes returned in the "code" field of error responses. Clients
+// should branch on these rather than on the human-readable message.
+const (
+	errCodeInvalidUploadKey          = "invalid_upload_key"
+	errCodeUploadKeyRevoked          = "upload_key_revoked"
+	errCodeUploadKeyExpired          = "upload_key_expired"
+	errCodeUploadKeyInQuery          = "upload_key_in_query"
+	errCodeInvalidParameter          = "invalid_parameter"
+	errCodeInvalidBody               = "invalid_body"
+	errCodeInvalidTimestamp          = "invalid_timestamp"
+	errCodeTimestampOutOfOrder       = "timestamp_out_of_order"
+	errCodeUnsupportedMediaType      = "unsupported_media_type"
+	errCodeUploadNotFound            = "upload_not_found"
+	errCodeAmbiguousUploadName       = "ambiguous_upload_name"
+	errCodeTrackerNotFound           = "tracker_not_found"
+	errCodeUnsupportedVersion        = "unsupported_api_version"
+	errCodeClientCertRequired        = "client_cert_required"
+	errCodeClientCertMismatch        = "client_cert_mismatch"
+	errCodeClientFingerprintMismatch = "client_fingerprint_mismatch"
+	errCodeSignatureRequired         = "signature_required"
+	errCodeSignatureInvalid          = "signature_invalid"
+	errCodeSignatureExpired          = "signature_expired"
+	errCodePairingNotFound           = "pairing_not_found"
+	errCodeInvalidFollowToken        = "invalid_follow_token"
+	errCodeSessionNotFound           = "session_not_found"
+	errCodeDeviceAlreadyBound        = "device_already_bound"
+	errCodeDeviceNotFound            = "device_not_found"
+	errCodeChecksumMismatch          = "checksum_mismatch"
+	errCodeEncryptionMismatch        = "encryption_mismatch"
+	errCodeTenantMismatch            = "tenant_mismatch"
+	errCodeRecordRejected            = "record_rejected"
+	errCodePluginNotFound            = "plugin_not_found"
+	errCodePluginFailed              = "plugin_failed"
+	errCodeRateLimited               = "rate_limited"
+	errCodeServerBusy                = "server_busy"
+	errCodeQuotaExceeded             = "quota_exceeded"
+	errCodeBatchOverQuota            = "batch_over_quota"
+	errCodeInsufficientStorage       = "insufficient_storage"
+	errCodeBufferedRecordsLost       = "buffered_records_lost"
+	errCodeTooManyTrackers           = "too_many_trackers"
+	errCodeAdminDisabled             = "admin_disabled"
+	errCodeUnauthorized              = "unauthorized"
+	errCodeForbidden                 = "forbidden"
+	errCodeOIDCDisabled              = "oidc_disabled"
+	errCodeInternal                  = "internal_error"
+)
+
+type apiError struct {
+	Code      string `json:"code"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"`
+}
+
+type errorResponse struct {
+	Error apiError `json:"error"`
+}
+
+// writeError sends an error response in the JSON envelope shared by all
+// handlers: {"error":{"code":...,"message":...}}. The request id assigned by
+// RequestLogger is included so failures can be matched to the server log.
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeErrorWith(w, status, code, message, nil)
+}
+
+// writeErrorWith is writeError for failures that leave part of the work
+// done, which fields report next to "error", e.g. the sessions an import
+// stored before it failed.
+func writeErrorWith(w http.ResponseWriter, status int, code, message string, fields map[string]any) {
+	h := w.Header()
+	requestID := h.Get(requestIDHeader)
+	h.Del("Content-Length")
+	h.Del("Content-Disposition")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+
+	apiErr := apiError{Code: code, Message: message, RequestID: requestID}
+	var response any = errorResponse{Error: apiErr}
+	if len(fields) > 0 {
+		body := map[string]any{"error": apiErr}
+		for name, value := range fields {
+			body[name] = value
+		}
+		response = body
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write error response: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestErrorEnvelope(t *testing.T) {
+	chdirTemp(t)
+
+	decode := func(t *testing.T, body []byte) apiError {
+		t.Helper()
+		var response errorResponse
+		if err := json.Unmarshal(body, &response); err != nil {
+			t.Fatalf("decode error response %q: %v", body, err)
+		}
+		return response.Error
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/nope/summary", nil)
+	req.SetPathValue("key", "nope")
+	rec := httptest.NewRecorder()
+	SummaryHandler(rec, req)
+	if got := decode(t, rec.Body.Bytes()); rec.Code != 400 || got.Code != errCodeInvalidUploadKey || got.Message == "" {
+		t.Fatalf("invalid key: status = %d, error = %+v", rec.Code, got)
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "application/json" {
+		t.Fatalf("Content-Type = %q", ct)
+	}
+
+	key := newTestUploadKey(t)
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/summary", nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	SummaryHandler(rec, req)
+	if got := decode(t, rec.Body.Bytes()); rec.Code != 404 || got.Code != errCodeUploadNotFound {
+		t.Fatalf("missing upload: status = %d, error = %+v", rec.Code, got)
+	}
+
+	simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`})
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/gaps?tracker=tail", nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	GapsHandler(rec, req)
+	if got := decode(t, rec.Body.Bytes()); rec.Code != 404 || got.Code != errCodeTrackerNotFound {
+		t.Fatalf("missing tracker: status = %d, error = %+v", rec.Code, got)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Event streams (server-sent events) can go quiet for minutes, e.g. while
+// a participant takes a break. Proxies and mobile networks drop idle
+// connections without telling either end, so quiet streams send comment
+// frames, which EventSource clients ignore.
+var (
+	// streamKeepalive is how often a quiet stream sends a comment frame;
+	// 0 sends none.
+	streamKeepalive = 15 * time.Second
+	// streamIdleTimeout ends streams that sent no event for this long; 0
+	// keeps them open. EventSource clients reconnect with Last-Event-ID.
+	streamIdleTimeout time.Duration
+)
+
+// SetStreamKeepalive sets how often quiet event streams send a keepalive
+// comment, 0 to send none.
+func SetStreamKeepalive(interval time.Duration) error {
+	if interval < 0 {
+		return fmt.Errorf("invalid stream keepalive %s: must not be negative", interval)
+	}
+	streamKeepalive = interval
+	return nil
+}
+
+// SetStreamIdleTimeout makes event streams end after sending no event for
+// timeout, 0 to keep them open.
+func SetStreamIdleTimeout(timeout time.Duration) error {
+	if timeout < 0 {
+		return fmt.Errorf("invalid stream idle timeout %s: must not be negative", timeout)
+	}
+	streamIdleTimeout = timeout
+	return nil
+}
+
+// eventStream writes server-sent events. Handlers select on keepalive() and
+// idle() while waiting for something to send.
+type eventStream struct {
+	w          http.ResponseWriter
+	controller *http.ResponseController
+	ticker     *time.Ticker
+	timer      *time.Timer
+}
+
+// newEventStream sets the event stream headers and starts the keepalive and
+// idle timers. Call stop when done.
+func newEventStream(w http.ResponseWriter) *eventStream {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// nginx buffers responses, which would hold back events and keepalives
+	w.Header().Set("X-Accel-Buffering", "no")
+	s := &eventStream{w: w, controller: http.NewResponseController(w)}
+	if streamKeepalive > 0 {
+		s.ticker = time.NewTicker(streamKeepalive)
+	}
+	if streamIdleTimeout > 0 {
+		s.timer = time.NewTimer(streamIdleTimeout)
+	}
+	return s
+}
+
+func (s *eventStream) stop() {
+	if s.ticker != nil {
+		s.ticker.Stop()
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+}
+
+// keepalive fires when a keepalive comment is due, never if disabled.
+func (s *eventStream) keepalive() <-chan time.Time {
+	if s.ticker == nil {
+		return nil
+	}
+	return s.ticker.C
+}
+
+// idle fires when the stream has sent no event for the idle timeout, never
+// if disabled.
+func (s *eventStream) idle() <-chan time.Time {
+	if s.timer == nil {
+		return nil
+	}
+	return s.timer.C
+}
+
+// flush sends what was written so far, e.g. the headers at the start.
+func (s *eventStream) flush() error {
+	return s.controller.Flush()
+}
+
+// send writes and flushes an event frame and restarts the idle timeout.
+func (s *eventStream) send(format string, args ...any) error {
+	if _, err := fmt.Fprintf(s.w, format, args...); err != nil {
+		return err
+	}
+	if s.timer != nil {
+		s.timer.Reset(streamIdleTimeout)
+	}
+	return s.controller.Flush()
+}
+
+// ping writes and flushes a keepalive comment. It doesn't count as an
+// event for the idle timeout.
+func (s *eventStream) ping() error {
+	if _, err := fmt.Fprint(s.w, ": keepalive\n\n"); err != nil {
+		return err
+	}
+	return s.controller.Flush()
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func setTestStreamTimeouts(t *testing.T, keepalive, idleTimeout time.Duration) {
+	t.Helper()
+	oldKeepalive, oldIdleTimeout := streamKeepalive, streamIdleTimeout
+	t.Cleanup(func() { streamKeepalive, streamIdleTimeout = oldKeepalive, oldIdleTimeout })
+	if err := SetStreamKeepalive(keepalive); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetStreamIdleTimeout(idleTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReplayKeepalive(t *testing.T) {
+	chdirTemp(t)
+	setTestStreamTimeouts(t, 20*time.Millisecond, 0)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1000,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1200,"position":{"x":1,"y":0,"z":0}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/replay", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	ReplayHandler(rec, req)
+
+	// the 200ms pause between the records is filled with keepalives
+	body := rec.Body.String()
+	first, rest, _ := strings.Cut(body, "id: 2\n")
+	if strings.Count(first, ": keepalive\n\n") < 3 || strings.Contains(rest, "keepalive") {
+		t.Fatalf("replay body: %q", body)
+	}
+	if rec.Header().Get("X-Accel-Buffering") != "no" {
+		t.Fatal("event stream may be buffered by proxies")
+	}
+}
+
+func TestReplayIdleTimeout(t *testing.T) {
+	chdirTemp(t)
+	setTestStreamTimeouts(t, 0, 50*time.Millisecond)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1000,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":61000,"position":{"x":1,"y":0,"z":0}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/replay", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	ReplayHandler(rec, req)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Fatalf("replay waited out the pause (%v)", elapsed)
+	}
+	if body := rec.Body.String(); !strings.HasPrefix(body, "id: 1\n") || strings.Contains(body, "id: 2\n") || strings.Contains(body, "event: end") {
+		t.Fatalf("replay body: %q", body)
+	}
+}
+
+func TestAdminEventsKeepalive(t *testing.T) {
+	chdirTemp(t)
+	setTestStreamTimeouts(t, 10*time.Millisecond, 100*time.Millisecond)
+	server := httptest.NewServer(http.HandlerFunc(AdminEventsHandler))
+	defer server.Close()
+
+	resp, err := http.Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	// no events come, so the stream sends keepalives until the idle timeout
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(body), ": keepalive\n\n") || strings.Contains(string(body), "data:") {
+		t.Fatalf("admin event stream: %q", body)
+	}
+
+	if SetStreamKeepalive(-time.Second) == nil || SetStreamIdleTimeout(-time.Second) == nil {
+		t.Fatal("negative durations accepted")
+	}
+}
@@ -0,0 +1,506 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// parseTrackerTransforms builds the transforms requested through query
+// parameters, in the order they are applied.
+func parseTrackerTransforms(query url.Values) ([]trackerTransform, error) {
+	var transforms []trackerTransform
+
+	// glitches go first, before they are smeared into neighbouring samples
+	if filter := query.Get("filter"); filter != "" {
+		transform, err := parseOutlierFilter(filter, query.Get("outlier_speed"))
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, transform)
+	}
+
+	if resample := query.Get("resample"); resample != "" {
+		transform, err := parseResample(resample, query.Get("method"))
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, transform)
+	}
+
+	if smooth := query.Get("smooth"); smooth != "" {
+		transform, err := parseSmooth(smooth)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, transform)
+	}
+
+	if simplify := query.Get("simplify"); simplify != "" {
+		transform, err := parseSimplify(simplify)
+		if err != nil {
+			return nil, err
+		}
+		transforms = append(transforms, transform)
+	}
+
+	// coordinate conversion runs last so that the parameters above are
+	// always expressed in the clients' units
+	coordinates, err := parseCoordinateTransform(query)
+	if err != nil {
+		return nil, err
+	}
+	if coordinates != nil {
+		transforms = append(transforms, coordinates.trackerTransform())
+	}
+
+	return transforms, nil
+}
+
+// writeSampleExportError sends the error of newSampleExport.
+func writeSampleExportError(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+	case errors.Is(err, errTooManyTrackers):
+		writeError(w, http.StatusUnprocessableEntity, errCodeTooManyTrackers, err.Error())
+	case errors.Is(err, errTrackerNotFound):
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, err.Error())
+	default:
+		log.Printf("failed to read upload for export: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+	}
+}
+
+// exportFilename is the download name of an export, based on the upload name
+// so that the secret key doesn't end up in the user's downloads folder.
+func exportFilename(uploadKey, extension string) string {
+	return strings.ReplaceAll(uploadNameFromKey(uploadKey), " ", "-") + "." + extension
+}
+
+// ExportHandler downloads an upload as NDJSON (the default), a JSON array,
+// Parquet, BVH, InfluxDB line protocol or a Timescale SQL script.
+// Without transforms, NDJSON and JSON stream the stored payloads unchanged,
+// in memory that doesn't grow with the upload; with transforms, and always
+// for the other formats, only positional samples are exported, interleaved
+// by timestamp. Records covered by an annotation get
+// labels in NDJSON and Parquet, and the upload's labels are added to every
+// format but BVH. filter=outliers drops the samples of tracking glitches, or
+// interpolates over them with filter=outliers:interpolate, and simplify=
+// keeps only the samples a path needs to stay within that many metres.
+// downsample= thins out the records, stored payloads included; encrypted
+// uploads are exported whole. layout=frames, with resample, exports NDJSON
+// or Parquet with one row per timestamp and the trackers in columns. Every
+// format streams, scanning the upload once per tracker when it has to
+// interleave them; uploads with more than maxExportTrackers trackers are
+// only exported raw or one tracker at a time.
+func ExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	switch format {
+	case "", "ndjson", "json", "parquet", "bvh", "influx", "sql":
+	default:
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("invalid format parameter %q: must be ndjson, json, parquet, bvh, influx or sql", format))
+		return
+	}
+
+	layout := r.URL.Query().Get("layout")
+	switch {
+	case layout == "":
+	case layout != framesLayout:
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("invalid layout parameter %q: must be %s", layout, framesLayout))
+		return
+	case format != "" && format != "ndjson" && format != "parquet":
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("layout=%s is exported as ndjson or parquet", framesLayout))
+		return
+	case r.URL.Query().Get("resample") == "":
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("layout=%s needs resample to put the trackers on one grid", framesLayout))
+		return
+	}
+
+	transforms, err := parseTrackerTransforms(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	downsample, err := parseDownsample(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	// exports only change with the upload and its annotations
+	if etag, err := exportETag(uploadKey); err == nil {
+		w.Header().Set("ETag", etag)
+		if etagMatches(r.Header.Get("If-None-Match"), etag) {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+	}
+
+	if len(transforms) == 0 && layout == "" && (format == "" || format == "ndjson" || format == "json") {
+		exportRaw(w, uploadKey, format, downsample)
+		return
+	}
+
+	export, err := newSampleExport(uploadKey, r.URL.Query().Get("tracker"), transforms, downsample)
+	if err != nil {
+		writeSampleExportError(w, err)
+		return
+	}
+	if err := export.check(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if err != nil {
+		log.Printf("failed to read metadata for export: %v", err)
+	}
+	metadata.Labels = sessionLabels(uploadKey, metadata.Labels)
+
+	if layout == framesLayout {
+		exportFrames(w, uploadKey, format, metadata.Labels, export)
+		return
+	}
+
+	switch format {
+	case "parquet":
+		exportParquet(w, uploadKey, metadata.Labels, export.merged)
+		return
+	case "bvh":
+		exportBVH(w, r, uploadKey, export)
+		return
+	case "influx", "sql":
+		exportTimeSeries(w, uploadKey, format, metadata, export)
+		return
+	}
+
+	writer := newExportWriter(w, uploadKey, format)
+	err = export.merged(func(sample trackerSample) error {
+		payload, err := json.Marshal(sample)
+		if err != nil {
+			return err
+		}
+		return writer.record(addUploadLabels(payload, metadata.Labels))
+	})
+	if err == nil {
+		err = writer.close()
+	}
+	if err != nil {
+		log.Printf("failed to write export: %v", err)
+	}
+}
+
+// exportWriter writes exported records as NDJSON lines, or with format=json
+// as the elements of one JSON array, without holding on to any of them.
+type exportWriter struct {
+	*bufio.Writer
+	array   bool
+	records int
+}
+
+// newExportWriter sets the headers of an NDJSON or JSON export and returns
+// a writer for its records.
+func newExportWriter(w http.ResponseWriter, uploadKey, format string) *exportWriter {
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(uploadKey, "json")))
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(uploadKey, "ndjson")))
+	}
+	return &exportWriter{Writer: bufio.NewWriter(w), array: format == "json"}
+}
+
+func (e *exportWriter) record(payload []byte) error {
+	if e.array {
+		separator := byte(',')
+		if e.records == 0 {
+			separator = '['
+		}
+		if err := e.WriteByte(separator); err != nil {
+			return err
+		}
+	}
+	e.records++
+	if _, err := e.Write(payload); err != nil {
+		return err
+	}
+	if e.array {
+		return nil
+	}
+	return e.WriteByte('\n')
+}
+
+// close ends the array of a JSON export and flushes the writer.
+func (e *exportWriter) close() error {
+	if e.array {
+		if e.records == 0 {
+			e.WriteByte('[')
+		}
+		e.WriteString("]\n")
+	}
+	return e.Flush()
+}
+
+// exportRaw streams the stored payloads of an upload line by line, so that
+// memory use doesn't grow with the upload.
+func exportRaw(w http.ResponseWriter, uploadKey, format string, downsample *downsample) {
+	filePath := uploadFilePath(uploadKey)
+
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, errUploadNotFound.Error())
+		return
+	}
+
+	// encrypted uploads are exported as they were uploaded, one ciphertext
+	// per line, whatever the format
+	metadata, err := readUploadMetadata(filePath)
+	if err != nil {
+		log.Printf("failed to read metadata for export: %v", err)
+	}
+	var writer *exportWriter
+	if metadata.Encryption != nil {
+		w.Header().Set("Content-Type", encryptedUploadType)
+		w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(uploadKey, "txt")))
+		w.Header().Set("X-Encryption-Key-Id", metadata.Encryption.KeyID)
+		writer = &exportWriter{Writer: bufio.NewWriter(w)}
+	} else {
+		writer = newExportWriter(w, uploadKey, format)
+	}
+
+	annotations := readSessionAnnotations(uploadKey)
+
+	labels := sessionLabels(uploadKey, metadata.Labels)
+	if metadata.Encryption != nil {
+		labels = nil
+	}
+
+	write := func(_ int, payload []byte) error {
+		if len(annotations) > 0 {
+			payload = labelPayload(payload, annotations)
+		}
+		payload = addUploadLabels(payload, labels)
+		return writer.record(applyExportScript(payload))
+	}
+	flush := func() error { return nil }
+	if downsample != nil && metadata.Encryption == nil {
+		write, flush = downsample.scan(write)
+	}
+	err = scanUploadFile(filePath, write)
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = writer.close()
+	}
+	if err != nil {
+		log.Printf("failed to write export: %v", err)
+	}
+}
+
+// TrajectoryHandler returns the positional samples of an upload grouped by
+// tracker, after applying any requested transforms and downsample=. The
+// response is streamed one tracker at a time.
+func TrajectoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	transforms, err := parseTrackerTransforms(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	downsample, err := parseDownsample(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	export, err := newSampleExport(uploadKey, r.URL.Query().Get("tracker"), transforms, downsample)
+	if err != nil {
+		writeSampleExportError(w, err)
+		return
+	}
+	if err := export.check(); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := writeTrajectory(w, uploadKey, export); err != nil {
+		log.Printf("failed to write trajectory response: %v", err)
+	}
+}
+
+// writeTrajectory writes the body of a trajectory response, the JSON object
+// json.Encoder would make of it, without holding more than one sample.
+func writeTrajectory(w io.Writer, uploadKey string, export *sampleExport) error {
+	writer := bufio.NewWriter(w)
+	annotations, err := json.Marshal(export.annotations)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(writer, `{"annotations":%s,"status":"ok","trackers":{`, annotations)
+	for i, tracker := range export.trackers {
+		name, _ := json.Marshal(tracker)
+		if i > 0 {
+			writer.WriteByte(',')
+		}
+		writer.Write(name)
+		writer.WriteString(":[")
+		first := true
+		err := export.each(tracker, func(s trackerSample) error {
+			payload, err := json.Marshal(s)
+			if err != nil {
+				return err
+			}
+			if !first {
+				writer.WriteByte(',')
+			}
+			first = false
+			_, err = writer.Write(payload)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		writer.WriteByte(']')
+	}
+	name, _ := json.Marshal(uploadNameFromKey(uploadKey))
+	fmt.Fprintf(writer, "},\"upload_name\":%s}\n", name)
+	return writer.Flush()
+}
+
+var exportParquetColumns = []parquetColumn{
+	{Name: "index", Type: parquetInt64, Optional: true},
+	{Name: "tracker", Type: parquetByteArray, UTF8: true},
+	{Name: "timestamp", Type: parquetDouble},
+	{Name: "epoch", Type: parquetDouble, Optional: true},
+	{Name: "x", Type: parquetDouble},
+	{Name: "y", Type: parquetDouble},
+	{Name: "z", Type: parquetDouble},
+	{Name: "qx", Type: parquetDouble, Optional: true},
+	{Name: "qy", Type: parquetDouble, Optional: true},
+	{Name: "qz", Type: parquetDouble, Optional: true},
+	{Name: "qw", Type: parquetDouble, Optional: true},
+	{Name: "labels", Type: parquetByteArray, Optional: true, UTF8: true},
+}
+
+// exportParquet writes the samples each passes on as flat Parquet rows.
+// index is null for samples synthesized by resampling, and labels are joined
+// with ";". Each upload label is a column of its own, with the same value in
+// every row.
+func exportParquet(w http.ResponseWriter, uploadKey string, uploadLabels map[string]string, each func(func(trackerSample) error) error) {
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(uploadKey, "parquet")))
+
+	writer := bufio.NewWriter(w)
+	labelNames := sortedLabelNames(uploadLabels)
+	columns := slices.Clone(exportParquetColumns)
+	labelValues := make([]any, len(labelNames))
+	for i, name := range labelNames {
+		columns = append(columns, parquetColumn{Name: name, Type: parquetByteArray, UTF8: true})
+		labelValues[i] = uploadLabels[name]
+	}
+
+	pw, err := newParquetWriter(writer, columns)
+	if err != nil {
+		log.Printf("failed to write parquet export: %v", err)
+		return
+	}
+
+	err = each(func(s trackerSample) error {
+		var index, epoch, qx, qy, qz, qw, labels any
+		if s.Index != 0 {
+			index = int64(s.Index)
+		}
+		if s.Epoch != 0 {
+			epoch = s.Epoch
+		}
+		if s.Rotation != nil {
+			qx, qy, qz, qw = s.Rotation.X, s.Rotation.Y, s.Rotation.Z, s.Rotation.W
+		}
+		if len(s.Labels) > 0 {
+			labels = strings.Join(s.Labels, ";")
+		}
+		row := append([]any{index, s.TrackerKey, s.Timestamp, epoch, s.Position.X, s.Position.Y, s.Position.Z, qx, qy, qz, qw, labels}, labelValues...)
+		return pw.writeRow(row...)
+	})
+	if err != nil {
+		log.Printf("failed to write parquet export: %v", err)
+		return
+	}
+
+	err = pw.close([][2]string{{"upload_name", uploadNameFromKey(uploadKey)}})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		log.Printf("failed to write parquet export: %v", err)
+	}
+}
+
+// exportBVH writes samples as a BVH file with one frame per resample
+// interval, 30 fps if none was requested.
+func exportBVH(w http.ResponseWriter, r *http.Request, uploadKey string, export *sampleExport) {
+	frameMs := defaultBVHFrameMs
+	if resample := r.URL.Query().Get("resample"); resample != "" {
+		// already validated by parseTrackerTransforms
+		step, _ := time.ParseDuration(resample)
+		frameMs = float64(step) / float64(time.Millisecond)
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(uploadKey, "bvh")))
+
+	if err := writeBVH(w, export, frameMs); err != nil {
+		log.Printf("failed to write bvh export: %v", err)
+	}
+}
+
+// exportTimeSeries writes samples for loading into a time series database,
+// as InfluxDB line protocol or a Timescale SQL script.
+func exportTimeSeries(w http.ResponseWriter, uploadKey, format string, metadata uploadMetadata, export *sampleExport) {
+	survey := export.survey
+	clock := wallClock(survey.earliest, survey.epochOffset, survey.hasEpoch, metadata.ReceivedAt)
+	uploadName := uploadNameFromKey(uploadKey)
+
+	write, extension := writeInfluxLines, "lp"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if format == "sql" {
+		write, extension = writeTimescaleSQL, "sql"
+		w.Header().Set("Content-Type", "application/sql")
+	}
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(uploadKey, extension)))
+
+	if err := write(w, uploadName, metadata.Labels, export.merged, clock); err != nil {
+		log.Printf("failed to write %s export: %v", format, err)
+	}
+}
@@ -0,0 +1,429 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func decodeExportLines(t *testing.T, body string) []trackerSample {
+	t.Helper()
+	var samples []trackerSample
+	scanner := bufio.NewScanner(strings.NewReader(body))
+	for scanner.Scan() {
+		var sample trackerSample
+		if err := json.Unmarshal(scanner.Bytes(), &sample); err != nil {
+			t.Fatalf("decode export line %q: %v", scanner.Text(), err)
+		}
+		samples = append(samples, sample)
+	}
+	return samples
+}
+
+func TestExportHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	entries := []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":30,"position":{"x":3,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":100,"position":{"x":10,"y":0,"z":0}}`,
+		`{"bpm":70}`,
+	}
+	simulateUpload(t, key, entries)
+
+	export := func(query string) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("export%s status = %d body=%s", query, rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	if raw := export(""); raw != strings.Join(entries, "\n")+"\n" {
+		t.Fatalf("raw export = %q", raw)
+	}
+
+	linear := decodeExportLines(t, export("?resample=50ms"))
+	if len(linear) != 3 {
+		t.Fatalf("linear resample length = %d, want 3", len(linear))
+	}
+	if linear[1].Timestamp != 50 || linear[1].Position.X != 5 {
+		t.Fatalf("linear resample = %+v", linear[1])
+	}
+
+	hold := decodeExportLines(t, export("?resample=50ms&method=hold"))
+	if hold[1].Position.X != 3 {
+		t.Fatalf("hold resample = %+v", hold[1])
+	}
+
+	// 100 ms at 1 ns would be 10^8 points
+	for _, query := range []string{"resample=fast", "resample=1ns", "smooth=savgol:1001,2", "smooth=savgol:9,8"} {
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export?"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		if rec.Code != 400 {
+			t.Fatalf("export?%s status = %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestTrajectoryHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"leftController","timestamp":10,"position":{"x":1,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":20,"position":{"x":2,"y":0,"z":0}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/trajectory?tracker=headset&resample=10ms", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	TrajectoryHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("trajectory status = %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var payload struct {
+		Trackers map[string][]trackerSample `json:"trackers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode trajectory response: %v", err)
+	}
+	if len(payload.Trackers) != 1 || len(payload.Trackers["headset"]) != 3 {
+		t.Fatalf("unexpected trajectory: %+v", payload.Trackers)
+	}
+	if payload.Trackers["headset"][1].Position.X != 1 {
+		t.Fatalf("interpolated position = %+v", payload.Trackers["headset"][1].Position)
+	}
+}
+
+func TestExportParquet(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","epoch":1700000000000,"timestamp":0,"position":{"x":0,"y":1.5,"z":0},"rotation":{"isQuaternion":true,"_x":0,"_y":0,"_z":0,"_w":1}}`,
+		`{"trackerKey":"leftController","timestamp":10,"position":{"x":-0.3,"y":1,"z":-0.2}}`,
+		`{"bpm":70}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export?format=parquet", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	ExportHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("parquet export status = %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	data := rec.Body.Bytes()
+	columns, rows, groups := readParquetFooter(t, data)
+	if rows != 2 || len(groups) != 1 {
+		t.Fatalf("parquet export has %d rows in %d row groups, want 2 in 1", rows, len(groups))
+	}
+	if len(columns) != len(exportParquetColumns) || len(groups[0]) != len(columns) {
+		t.Fatalf("parquet export has columns %v and %d chunks", columns, len(groups[0]))
+	}
+	// the chunks follow each other from the magic to the footer
+	offset := int64(len(parquetMagic))
+	chunks := map[string]parquetChunk{}
+	for i, chunk := range groups[0] {
+		if columns[i] != exportParquetColumns[i].Name || chunk.column != columns[i] || chunk.typ != int64(exportParquetColumns[i].Type) {
+			t.Fatalf("parquet column %d = %q, chunk %+v, want %+v", i, columns[i], chunk, exportParquetColumns[i])
+		}
+		if chunk.pageOffset != offset || chunk.numValues != 2 {
+			t.Fatalf("parquet chunk %+v, want 2 values at %d", chunk, offset)
+		}
+		offset += chunk.size
+		chunks[chunk.column] = chunk
+	}
+	if footerStart := int64(len(data)) - 8 - int64(binary.LittleEndian.Uint32(data[len(data)-8:])); offset != footerStart {
+		t.Fatalf("parquet chunks end at %d, footer starts at %d", offset, footerStart)
+	}
+
+	for _, c := range []struct {
+		column   string
+		optional bool
+		want     []any
+	}{
+		{"index", true, []any{int64(1), int64(2)}},
+		{"tracker", false, []any{"headset", "leftController"}},
+		{"timestamp", false, []any{0.0, 10.0}},
+		{"x", false, []any{0.0, -0.3}},
+		{"y", false, []any{1.5, 1.0}},
+		{"qw", true, []any{1.0, nil}},
+		{"labels", true, []any{nil, nil}},
+	} {
+		if got := readParquetColumn(t, data, chunks[c.column], c.optional); !slices.Equal(got, c.want) {
+			t.Errorf("parquet column %s = %v, want %v", c.column, got, c.want)
+		}
+	}
+}
+
+func TestExportTimeSeries(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"epoch":1700000000000,"position":{"x":0,"y":1.5,"z":0},"rotation":{"_x":0,"_y":0,"_z":0,"_w":1}}`,
+		`{"trackerKey":"left controller","timestamp":10,"position":{"x":1,"y":0,"z":0}}`,
+	})
+
+	export := func(format string) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export?format="+format, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("%s export status = %d: %s", format, rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	name := strings.ReplaceAll(uploadNameFromKey(key), " ", `\ `)
+	lines := strings.Split(strings.TrimSpace(export("influx")), "\n")
+	want := []string{
+		"vr_position,upload=" + name + ",tracker=headset x=0,y=1.5,z=0,qx=0,qy=0,qz=0,qw=1,index=1i 1700000000000000000",
+		"vr_position,upload=" + name + ",tracker=left\\ controller x=1,y=0,z=0,index=2i 1700000000010000000",
+	}
+	if len(lines) != 2 || lines[0] != want[0] || lines[1] != want[1] {
+		t.Fatalf("influx export =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+	}
+
+	sql := export("sql")
+	for _, fragment := range []string{
+		"CREATE TABLE IF NOT EXISTS vr_positions",
+		"create_hypertable('vr_positions'",
+		"('2023-11-14T22:13:20Z', '" + uploadNameFromKey(key) + "', 'headset', 1, 0, 1.5, 0, 0, 0, 0, 1),\n",
+		"('2023-11-14T22:13:20.01Z', '" + uploadNameFromKey(key) + "', 'left controller', 2, 1, 0, 0, NULL, NULL, NULL, NULL);\n",
+	} {
+		if !strings.Contains(sql, fragment) {
+			t.Fatalf("sql export missing %q:\n%s", fragment, sql)
+		}
+	}
+}
+
+func TestExportJSON(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	entries := []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"bpm":70}`,
+		`{"trackerKey":"headset","timestamp":100,"position":{"x":10,"y":0,"z":0}}`,
+	}
+	simulateUpload(t, key, entries)
+
+	export := func(query string) []json.RawMessage {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export?format=json"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		if rec.Code != 200 || rec.Header().Get("Content-Type") != "application/json" {
+			t.Fatalf("json export%s status = %d type=%s", query, rec.Code, rec.Header().Get("Content-Type"))
+		}
+		var records []json.RawMessage
+		if err := json.Unmarshal(rec.Body.Bytes(), &records); err != nil {
+			t.Fatalf("decode json export %q: %v", rec.Body.String(), err)
+		}
+		return records
+	}
+
+	raw := export("")
+	if len(raw) != 3 || string(raw[1]) != entries[1] {
+		t.Fatalf("raw json export = %s", raw)
+	}
+	if resampled := export("&resample=50ms"); len(resampled) != 3 {
+		t.Fatalf("resampled json export = %s", resampled)
+	}
+	if none := export("&tracker=headset&resample=1s&downsample=1hz"); len(none) != 1 {
+		t.Fatalf("downsampled json export = %s", none)
+	}
+}
+
+// countingResponseWriter discards a response, keeping its status, length
+// and ends.
+type countingResponseWriter struct {
+	header http.Header
+	status int
+	bytes  int64
+	first  byte
+	last   []byte
+}
+
+func (c *countingResponseWriter) Header() http.Header { return c.header }
+func (c *countingResponseWriter) WriteHeader(status int) {
+	if c.status == 0 {
+		c.status = status
+	}
+}
+func (c *countingResponseWriter) Write(p []byte) (int, error) {
+	if c.bytes == 0 && len(p) > 0 {
+		c.first = p[0]
+	}
+	c.bytes += int64(len(p))
+	c.last = append(c.last, p...)
+	c.last = c.last[max(len(c.last)-2, 0):]
+	return len(p), nil
+}
+
+// TestExportMemoryCeiling exports a large synthetic session of two trackers
+// in every format and with every transform, and checks that the heap stays
+// under a fixed ceiling however large the upload is. Set
+// HRDEMO_EXPORT_TEST_BYTES to export a larger one, e.g. 4000000000.
+func TestExportMemoryCeiling(t *testing.T) {
+	if testing.Short() {
+		t.Skip("writes a large upload")
+	}
+	// big enough that loading its samples would pass the ceiling, small
+	// enough to scan once per tracker for each export in a test run
+	size := int64(48 << 20)
+	if env := os.Getenv("HRDEMO_EXPORT_TEST_BYTES"); env != "" {
+		var err error
+		if size, err = strconv.ParseInt(env, 10, 64); err != nil {
+			t.Fatalf("invalid HRDEMO_EXPORT_TEST_BYTES %q", env)
+		}
+	}
+	const ceiling = 32 << 20
+
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	filePath := simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":1.6,"z":0}}`})
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatalf("open upload: %v", err)
+	}
+	writer := bufio.NewWriterSize(file, 1<<20)
+	records, payloadBytes := int64(1), int64(len(`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":1.6,"z":0}}`))
+	for written := int64(0); written < size; {
+		records++
+		tracker := "headset"
+		if records%2 == 0 {
+			tracker = "rightController"
+		}
+		payload := fmt.Sprintf(`{"trackerKey":%q,"timestamp":%d,"position":{"x":%d.5,"y":1.6,"z":-0.25},"rotation":{"isQuaternion":true,"_x":0,"_y":0,"_z":0,"_w":1}}`, tracker, records/2*10, records%100)
+		n, err := fmt.Fprintf(writer, "%d,%d,%s,,%s\n", records, time.Now().UnixMilli(), recordTypeTracker, payload)
+		if err != nil {
+			t.Fatalf("write upload: %v", err)
+		}
+		written += int64(n)
+		payloadBytes += int64(len(payload))
+	}
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("write upload: %v", err)
+	}
+	file.Close()
+
+	// export runs a request and returns its response with how much it grew
+	// the heap at most
+	export := func(handler http.HandlerFunc, path string) (*countingResponseWriter, int64) {
+		runtime.GC()
+		var baseline runtime.MemStats
+		runtime.ReadMemStats(&baseline)
+		var peak atomic.Uint64
+		done := make(chan struct{})
+		sampled := make(chan struct{})
+		go func() {
+			defer close(sampled)
+			var stats runtime.MemStats
+			for {
+				runtime.ReadMemStats(&stats)
+				if stats.HeapInuse > peak.Load() {
+					peak.Store(stats.HeapInuse)
+				}
+				select {
+				case <-done:
+					return
+				case <-time.After(5 * time.Millisecond):
+				}
+			}
+		}()
+
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetPathValue("key", key)
+		rec := &countingResponseWriter{header: http.Header{}}
+		handler(rec, req)
+		close(done)
+		<-sampled
+		return rec, int64(peak.Load()) - int64(baseline.HeapInuse)
+	}
+
+	for _, format := range []string{"ndjson", "json"} {
+		rec, grown := export(ExportHandler, "/api/uploads/"+key+"/export?format="+format)
+
+		// a newline per record, or the opening bracket, the commas and "]\n"
+		want := payloadBytes + records
+		if format == "json" {
+			want += 2
+		}
+		if rec.bytes != want {
+			t.Fatalf("%s export wrote %d bytes, want %d", format, rec.bytes, want)
+		}
+		if format == "json" && (rec.first != '[' || string(rec.last) != "]\n") {
+			t.Fatalf("json export starts with %q and ends with %q", rec.first, rec.last)
+		}
+		if grown > ceiling {
+			t.Fatalf("%s export of %d MB grew the heap by %d MB, ceiling is %d MB", format, size>>20, grown>>20, ceiling>>20)
+		}
+	}
+
+	// every other format and transform is streamed too
+	for _, query := range []string{
+		"downsample=4",
+		"downsample=10hz",
+		"format=json&downsample=10hz",
+		"downsample=10hz:minmax",
+		"downsample=4:minmax",
+		"format=parquet",
+		"format=bvh",
+		"format=influx",
+		"format=sql",
+		"resample=100ms",
+		"layout=frames&resample=100ms",
+		"smooth=ema:0.5",
+		"smooth=savgol:5,2",
+		"filter=outliers",
+		"filter=outliers:interpolate",
+		"simplify=0.01",
+		"up=z",
+		"units=cm",
+		"recenter=headset",
+		"tracker=headset&format=parquet",
+	} {
+		rec, grown := export(ExportHandler, "/api/uploads/"+key+"/export?"+query)
+		if rec.status != 0 && rec.status != http.StatusOK || rec.bytes == 0 {
+			t.Fatalf("export?%s: status %d, %d bytes", query, rec.status, rec.bytes)
+		}
+		if grown > ceiling {
+			t.Fatalf("export?%s of %d MB grew the heap by %d MB, ceiling is %d MB", query, size>>20, grown>>20, ceiling>>20)
+		}
+	}
+	for _, query := range []string{"", "resample=100ms"} {
+		rec, grown := export(TrajectoryHandler, "/api/uploads/"+key+"/trajectory?"+query)
+		if rec.status != 0 && rec.status != http.StatusOK || rec.bytes == 0 {
+			t.Fatalf("trajectory?%s: status %d, %d bytes", query, rec.status, rec.bytes)
+		}
+		if grown > ceiling {
+			t.Fatalf("trajectory?%s of %d MB grew the heap by %d MB, ceiling is %d MB", query, size>>20, grown>>20, ceiling>>20)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"expvar"
+	"os"
+	"sync"
+	"time"
+)
+
+// Active sessions append a batch every few seconds and are followed many
+// times a second, and each of those used to open and close the upload
+// file. The upload files in use stay open in a small LRU cache instead, and
+// are closed once idle. A cached handle is only reused while it is still
+// the file at its path: files replaced by an atomic rename, turned into a
+// cold storage stub or removed are reopened.
+//
+// Writers lock an entry, so appends to an upload don't interleave, and can
+// keep what they learned about the file in it. Readers use ReadAt, which
+// doesn't touch the shared offset, and don't lock.
+
+const (
+	maxOpenUploadFiles  = 256
+	openUploadFileIdle  = 2 * time.Minute
+	openUploadFileSweep = 30 * time.Second
+)
+
+// openUpload is a cached upload file handle.
+type openUpload struct {
+	mu   sync.Mutex // held by writers
+	path string
+	file *os.File
+
+	// size is the file size after the last write through this entry, -1
+	// if unknown. While the file still has that size, records and version
+	// describe it, and writers need not count its records again.
+	size    int64
+	records int
+	version int
+
+	refs     int // users, counted under uploadFilesMutex
+	lastUsed time.Time
+	element  *list.Element
+}
+
+var (
+	uploadFiles      = map[string]*openUpload{}
+	uploadFilesLRU   = list.New() // most recently used first
+	uploadFilesMutex sync.Mutex
+
+	uploadFileOpens = expvar.NewInt("upload_file_opens")
+	uploadFileReuse = expvar.NewInt("upload_file_reuses")
+)
+
+func init() {
+	registerJob("open_file_reaper", openUploadFileSweep, 0, func(context.Context) error {
+		closeIdleUploadFiles(time.Now().Add(-openUploadFileIdle))
+		return nil
+	})
+}
+
+// acquireUploadFile returns the cached handle of an upload file, opening
+// it if needed, creating it too if create is set. Call release when done.
+// Open errors are returned unwrapped so callers can test them with
+// os.IsNotExist.
+func acquireUploadFile(filePath string, create bool) (*openUpload, error) {
+	uploadFilesMutex.Lock()
+	if u, ok := uploadFiles[filePath]; ok {
+		u.refs++
+		uploadFilesLRU.MoveToFront(u.element)
+		uploadFilesMutex.Unlock()
+		if u.current() {
+			uploadFileReuse.Add(1)
+			return u, nil
+		}
+		u.release()
+		forgetUploadFile(u)
+	} else {
+		uploadFilesMutex.Unlock()
+	}
+
+	flags := os.O_RDWR
+	if create {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(filePath, flags, 0o644)
+	if err != nil {
+		return nil, err
+	}
+	uploadFileOpens.Add(1)
+
+	uploadFilesMutex.Lock()
+	defer uploadFilesMutex.Unlock()
+	if u, ok := uploadFiles[filePath]; ok {
+		// opened by someone else in between
+		file.Close()
+		u.refs++
+		uploadFilesLRU.MoveToFront(u.element)
+		return u, nil
+	}
+	u := &openUpload{path: filePath, file: file, size: -1, refs: 1}
+	u.element = uploadFilesLRU.PushFront(u)
+	uploadFiles[filePath] = u
+	evictUploadFilesLocked()
+	return u, nil
+}
+
+// current reports whether the handle is still the file at its path.
+func (u *openUpload) current() bool {
+	return fileStillLinked(u.path, u.file)
+}
+
+func (u *openUpload) release() {
+	uploadFilesMutex.Lock()
+	defer uploadFilesMutex.Unlock()
+	u.refs--
+	u.lastUsed = time.Now()
+	if u.refs == 0 && uploadFiles[u.path] != u {
+		// replaced while in use
+		u.file.Close()
+	}
+}
+
+// forgetUploadFile removes an entry from the cache, closing it once
+// unused.
+func forgetUploadFile(u *openUpload) {
+	uploadFilesMutex.Lock()
+	defer uploadFilesMutex.Unlock()
+	if uploadFiles[u.path] != u {
+		return
+	}
+	delete(uploadFiles, u.path)
+	uploadFilesLRU.Remove(u.element)
+	if u.refs == 0 {
+		u.file.Close()
+	}
+}
+
+// evictUploadFilesLocked closes the least recently used unused files while
+// there are too many open.
+func evictUploadFilesLocked() {
+	for element := uploadFilesLRU.Back(); element != nil && len(uploadFiles) > maxOpenUploadFiles; {
+		u := element.Value.(*openUpload)
+		element = element.Prev()
+		if u.refs == 0 {
+			delete(uploadFiles, u.path)
+			uploadFilesLRU.Remove(u.element)
+			u.file.Close()
+		}
+	}
+}
+
+// closeIdleUploadFiles closes the unused files last used before cutoff.
+func closeIdleUploadFiles(cutoff time.Time) {
+	uploadFilesMutex.Lock()
+	defer uploadFilesMutex.Unlock()
+	for element := uploadFilesLRU.Back(); element != nil; {
+		u := element.Value.(*openUpload)
+		element = element.Prev()
+		if u.refs == 0 && u.lastUsed.Before(cutoff) {
+			delete(uploadFiles, u.path)
+			uploadFilesLRU.Remove(u.element)
+			u.file.Close()
+		}
+	}
+}
@@ -0,0 +1,21 @@
+//go:build linux || darwin || freebsd
+
+package server
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileStillLinked reports whether file is still the file at path. Upload
+// files are only ever replaced by renaming another over them or removed,
+// both of which unlink the open file, so its link count tells without
+// looking up path.
+func fileStillLinked(path string, file *os.File) bool {
+	info, err := file.Stat()
+	if err != nil {
+		return false
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	return ok && stat.Nlink > 0
+}
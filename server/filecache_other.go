@@ -0,0 +1,15 @@
+//go:build !(linux || darwin || freebsd)
+
+package server
+
+import "os"
+
+// fileStillLinked reports whether file is still the file at path.
+func fileStillLinked(path string, file *os.File) bool {
+	pathInfo, err := os.Stat(path)
+	if err != nil {
+		return false
+	}
+	fileInfo, err := file.Stat()
+	return err == nil && os.SameFile(pathInfo, fileInfo)
+}
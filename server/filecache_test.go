@@ -0,0 +1,127 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestUploadFileCache(t *testing.T) {
+	dir := chdirTemp(t)
+	defer closeIdleUploadFiles(time.Now().Add(time.Hour))
+	path := filepath.Join(dir, "a.csv")
+	if err := os.WriteFile(path, []byte("first\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	reuses := uploadFileReuse.Value()
+	first, err := acquireUploadFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first.release()
+	second, err := acquireUploadFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	second.release()
+	if first != second || uploadFileReuse.Value() != reuses+1 {
+		t.Fatal("open upload file not reused")
+	}
+
+	// a file replaced by a rename is reopened
+	if err := writeFileAtomic(path, func(w *bufio.Writer) error {
+		_, err := w.WriteString("second\n")
+		return err
+	}); err != nil {
+		t.Fatal(err)
+	}
+	third, err := acquireUploadFile(path, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(io.NewSectionReader(third.file, 0, 100))
+	third.release()
+	if third == first || string(data) != "second\n" {
+		t.Fatalf("replaced file read as %q", data)
+	}
+
+	os.Remove(path)
+	if _, err := acquireUploadFile(path, false); !os.IsNotExist(err) {
+		t.Fatalf("acquire removed file: %v", err)
+	}
+
+	// unused files beyond the limit are closed, least recently used first
+	for i := range maxOpenUploadFiles + 10 {
+		u, err := acquireUploadFile(filepath.Join(dir, fmt.Sprintf("%d.csv", i)), true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		u.release()
+	}
+	if len(uploadFiles) != maxOpenUploadFiles {
+		t.Fatalf("%d files open", len(uploadFiles))
+	}
+	if _, ok := uploadFiles[filepath.Join(dir, "0.csv")]; ok {
+		t.Fatal("least recently used file kept open")
+	}
+	closeIdleUploadFiles(time.Now().Add(time.Second))
+	if len(uploadFiles) != 0 || uploadFilesLRU.Len() != 0 {
+		t.Fatalf("%d idle files left open", len(uploadFiles))
+	}
+}
+
+func TestSaveUploadCachedCount(t *testing.T) {
+	chdirTemp(t)
+	defer closeIdleUploadFiles(time.Now().Add(time.Hour))
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+	simulateUpload(t, key, []string{`{"bpm":71}`})
+
+	// a record appended behind the server's back is counted again
+	file, err := os.OpenFile(uploadFilePath(key), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprintln(file, `3,0,,,{"bpm":72}`)
+	file.Close()
+	simulateUpload(t, key, []string{`{"bpm":73}`})
+
+	_, _, lines := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, lines, []string{`{"bpm":70}`, `{"bpm":71}`, `{"bpm":72}`, `{"bpm":73}`})
+}
+
+// BenchmarkAppendBatch appends small batches to an upload of 100000
+// records, as a headset does during a long session.
+func BenchmarkAppendBatch(b *testing.B) {
+	dir := b.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	key, err := generateUploadKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	lines := make([]string, 100000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`{"trackerKey":"headset","timestamp":%d,"position":{"x":0,"y":1.6,"z":0}}`, i)
+	}
+	if _, err := saveUpload(key, "bench", recordColumns{ReceivedAt: time.Now()}, lines, nil); err != nil {
+		b.Fatal(err)
+	}
+
+	batch := lines[:10]
+	b.ResetTimer()
+	for range b.N {
+		if _, err := saveUpload(key, "bench", recordColumns{ReceivedAt: time.Now()}, batch, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Follow response formats. "raw" is the original "index,json" lines,
+// "ndjson" the record payloads alone, one per line, and "json" an array of
+// {"index":...,"record":...} objects.
+const (
+	followFormatRaw    = "raw"
+	followFormatNDJSON = "ndjson"
+	followFormatJSON   = "json"
+)
+
+// defaultFollowFormats is the format of each API version for clients that
+// ask for none. Version 1 and the legacy /api paths keep the raw lines that
+// deployed clients split themselves.
+var defaultFollowFormats = map[string]string{
+	"":  followFormatRaw,
+	"1": followFormatRaw,
+}
+
+// followMediaTypes maps the media types a client may accept to formats.
+var followMediaTypes = map[string]string{
+	"text/plain":           followFormatRaw,
+	"application/x-ndjson": followFormatNDJSON,
+	"application/json":     followFormatJSON,
+}
+
+// requestAPIVersion returns the API version a request was made under, ""
+// for the legacy unversioned paths.
+func requestAPIVersion(r *http.Request) string {
+	rest, ok := strings.CutPrefix(r.URL.Path, "/api/v")
+	if !ok {
+		return ""
+	}
+	version, _, _ := strings.Cut(rest, "/")
+	return version
+}
+
+// parseFollowFormat picks the follow format from the format parameter or,
+// without one, the Accept header. Clients accepting none of the formats
+// get the default of their API version.
+func parseFollowFormat(r *http.Request) (string, error) {
+	switch format := r.URL.Query().Get("format"); format {
+	case "":
+	case followFormatRaw, followFormatNDJSON, followFormatJSON:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid format parameter %q: must be raw, ndjson or json", format)
+	}
+
+	type acceptedType struct {
+		format  string
+		quality float64
+	}
+	var accepted []acceptedType
+	for _, part := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		format, ok := followMediaTypes[mediaType]
+		if !ok {
+			continue
+		}
+		quality := 1.0
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil {
+			quality = q
+		}
+		if quality > 0 {
+			accepted = append(accepted, acceptedType{format, quality})
+		}
+	}
+	sort.SliceStable(accepted, func(i, j int) bool { return accepted[i].quality > accepted[j].quality })
+	if len(accepted) > 0 {
+		return accepted[0].format, nil
+	}
+
+	if format, ok := defaultFollowFormats[requestAPIVersion(r)]; ok {
+		return format, nil
+	}
+	return followFormatRaw, nil
+}
+
+// writeFollowLines writes "index,json" record lines in a follow format.
+func writeFollowLines(w http.ResponseWriter, format string, lines []string) error {
+	var body bytes.Buffer
+	switch format {
+	case followFormatNDJSON:
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		for _, line := range lines {
+			_, payload, _ := strings.Cut(line, ",")
+			body.WriteString(payload)
+			body.WriteByte('\n')
+		}
+	case followFormatJSON:
+		type followRecord struct {
+			Index  int             `json:"index"`
+			Record json.RawMessage `json:"record"`
+		}
+		records := make([]followRecord, 0, len(lines))
+		for _, line := range lines {
+			index, payload, _ := strings.Cut(line, ",")
+			record := followRecord{Record: json.RawMessage(payload)}
+			record.Index, _ = strconv.Atoi(index)
+			if !json.Valid(record.Record) {
+				// not JSON, e.g. a legacy record; keep it as a string
+				record.Record, _ = json.Marshal(payload)
+			}
+			records = append(records, record)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(&body).Encode(records); err != nil {
+			return err
+		}
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		for _, line := range lines {
+			body.WriteString(line)
+			body.WriteByte('\n')
+		}
+	}
+	_, err := w.Write(body.Bytes())
+	return err
+}
@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestFollowFormats(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":71}`})
+
+	tests := []struct {
+		path, accept     string
+		code             int
+		contentType, out string
+	}{
+		{"/api/v1/follow?", "", 200, "text/plain", "1,{\"bpm\":70}\n2,{\"bpm\":71}\n"},
+		{"/api/follow?", "", 200, "text/plain", "1,{\"bpm\":70}\n2,{\"bpm\":71}\n"},
+		{"/api/v1/follow?format=ndjson&", "", 200, "application/x-ndjson", "{\"bpm\":70}\n{\"bpm\":71}\n"},
+		{"/api/v1/follow?format=json&", "", 200, "application/json", `[{"index":1,"record":{"bpm":70}},{"index":2,"record":{"bpm":71}}]` + "\n"},
+		{"/api/v1/follow?", "application/x-ndjson", 200, "application/x-ndjson", "{\"bpm\":70}\n{\"bpm\":71}\n"},
+		{"/api/v1/follow?", "text/plain;q=0.5, application/json", 200, "application/json", `[{"index":1,"record":{"bpm":70}},{"index":2,"record":{"bpm":71}}]` + "\n"},
+		{"/api/v1/follow?", "text/html, */*", 200, "text/plain", "1,{\"bpm\":70}\n2,{\"bpm\":71}\n"},
+		{"/api/v1/follow?format=raw&", "application/json", 200, "text/plain", "1,{\"bpm\":70}\n2,{\"bpm\":71}\n"},
+		{"/api/v1/follow?format=csv&", "", 400, "application/json", ""},
+	}
+	for _, test := range tests {
+		req := withUploadKey(httptest.NewRequest("GET", test.path, nil), key)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		FollowHandler(rec, req)
+		if rec.Code != test.code || rec.Header().Get("Content-Type") != test.contentType {
+			t.Errorf("%s with Accept %q: status %d, Content-Type %q", test.path, test.accept, rec.Code, rec.Header().Get("Content-Type"))
+			continue
+		}
+		if test.out != "" && rec.Body.String() != test.out {
+			t.Errorf("%s with Accept %q: body %q, want %q", test.path, test.accept, rec.Body, test.out)
+		}
+		if test.code == 200 && rec.Header().Get("X-Follow-Position") != "2" {
+			t.Errorf("%s: X-Follow-Position %q", test.path, rec.Header().Get("X-Follow-Position"))
+		}
+	}
+}
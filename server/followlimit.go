@@ -0,0 +1,144 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Viewers poll /follow as often as every 100ms, and each poll used to open
+// and scan the upload file. followStates remembers, per upload, the file
+// size and modification time it was last scanned at and the last record
+// found then, so polls that are up to date answer 204 from memory. Polls
+// more frequent than the follow rate limit are refused with 429.
+
+// followState is what a scan of an upload file found.
+type followState struct {
+	size    int64
+	modTime time.Time
+	// noneAfter is a record index the file has no records after
+	noneAfter int
+}
+
+var (
+	followStates      = map[string]followState{}
+	followStatesMutex sync.Mutex
+
+	followCacheHits    = expvar.NewInt("follow_cache_hits")
+	followRateLimited  = expvar.NewInt("follow_rate_limited")
+	followBuckets      = map[string]*followBucket{}
+	followBucketsMutex sync.Mutex
+)
+
+// followUpToDate reports whether the upload file, as info describes it,
+// was scanned before and had no records after position.
+func followUpToDate(uploadKey string, info os.FileInfo, position int) bool {
+	followStatesMutex.Lock()
+	state, ok := followStates[uploadKey]
+	followStatesMutex.Unlock()
+	if !ok || state.size != info.Size() || !state.modTime.Equal(info.ModTime()) || position < state.noneAfter {
+		return false
+	}
+	followCacheHits.Add(1)
+	return true
+}
+
+// rememberFollowScan records that the upload file, as info describes it
+// from before the scan, had no records after noneAfter. A file that
+// changed during the scan has a newer size or time, so it is scanned
+// again.
+func rememberFollowScan(uploadKey string, info os.FileInfo, noneAfter int) {
+	followStatesMutex.Lock()
+	defer followStatesMutex.Unlock()
+	followStates[uploadKey] = followState{size: info.Size(), modTime: info.ModTime(), noneAfter: noneAfter}
+}
+
+// followMinInterval is the sustained poll interval a client may follow an
+// upload at, and followBurst how many polls it may make faster than that,
+// e.g. to page through a backlog. A zero interval disables the limit. Set
+// by SetFollowRateLimit.
+var (
+	followMinInterval time.Duration
+	followBurst       = 10
+)
+
+// maxFollowBuckets is how many clients are tracked before the buckets of
+// idle ones are forgotten.
+const maxFollowBuckets = 10000
+
+// SetFollowRateLimit makes follow polls of one upload by one client faster
+// than minInterval fail with 429 once burst of them were made. A zero
+// minInterval disables the limit.
+func SetFollowRateLimit(minInterval time.Duration, burst int) error {
+	if minInterval < 0 {
+		return fmt.Errorf("invalid follow poll interval %s: must not be negative", minInterval)
+	}
+	if burst < 1 {
+		return fmt.Errorf("invalid follow burst %d: must be at least 1", burst)
+	}
+	followMinInterval, followBurst = minInterval, burst
+	followBucketsMutex.Lock()
+	followBuckets = map[string]*followBucket{}
+	followBucketsMutex.Unlock()
+	return nil
+}
+
+// followBucket is a token bucket: each poll takes a token, and tokens come
+// back one per followMinInterval, up to followBurst.
+type followBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// refill adds the tokens earned since the last poll.
+func (b *followBucket) refill(now time.Time) {
+	if !now.After(b.last) {
+		return
+	}
+	b.tokens = math.Min(float64(followBurst), b.tokens+float64(now.Sub(b.last))/float64(followMinInterval))
+	b.last = now
+}
+
+// allowFollow takes a token for a poll of uploadKey by client. If none is
+// left it returns false and how long until there is one.
+func allowFollow(uploadKey, client string, now time.Time) (bool, time.Duration) {
+	if followMinInterval == 0 {
+		return true, 0
+	}
+
+	followBucketsMutex.Lock()
+	defer followBucketsMutex.Unlock()
+	if len(followBuckets) >= maxFollowBuckets {
+		for id, bucket := range followBuckets {
+			if bucket.refill(now); bucket.tokens >= float64(followBurst) {
+				delete(followBuckets, id)
+			}
+		}
+	}
+
+	id := uploadKeyHash(uploadKey) + " " + client
+	bucket, ok := followBuckets[id]
+	if !ok {
+		bucket = &followBucket{tokens: float64(followBurst), last: now}
+		followBuckets[id] = bucket
+	}
+	bucket.refill(now)
+	if bucket.tokens < 1 {
+		followRateLimited.Add(1)
+		return false, time.Duration((1 - bucket.tokens) * float64(followMinInterval))
+	}
+	bucket.tokens--
+	return true, 0
+}
+
+// writeFollowRateLimited answers a poll refused by allowFollow.
+func writeFollowRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	// Retry-After is in whole seconds; round up so a retry isn't refused
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+	writeError(w, http.StatusTooManyRequests, errCodeRateLimited, fmt.Sprintf("follow polled too often: at most once every %s", followMinInterval))
+}
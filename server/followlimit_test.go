@@ -0,0 +1,72 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFollowCache(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":71}`})
+
+	follow := func(position string) (int, string) {
+		rec := httptest.NewRecorder()
+		FollowHandler(rec, withUploadKey(httptest.NewRequest("GET", "/api/follow?position="+position, nil), key))
+		return rec.Code, rec.Body.String()
+	}
+	if code, body := follow("0"); code != 200 || body != "1,{\"bpm\":70}\n2,{\"bpm\":71}\n" {
+		t.Fatalf("first follow: %d %q", code, body)
+	}
+	hits := followCacheHits.Value()
+	if code, _ := follow("2"); code != 204 || followCacheHits.Value() != hits+1 {
+		t.Fatalf("up to date follow: status %d, cache hits %d", code, followCacheHits.Value()-hits)
+	}
+	// earlier positions still get their records
+	if code, body := follow("1"); code != 200 || body != "2,{\"bpm\":71}\n" {
+		t.Fatalf("follow from 1: %d %q", code, body)
+	}
+
+	simulateUpload(t, key, []string{`{"bpm":72}`})
+	if code, body := follow("2"); code != 200 || body != "3,{\"bpm\":72}\n" {
+		t.Fatalf("follow after upload: %d %q", code, body)
+	}
+}
+
+func TestFollowRateLimit(t *testing.T) {
+	chdirTemp(t)
+	defer SetFollowRateLimit(0, 10)
+	if err := SetFollowRateLimit(time.Second, 2); err != nil {
+		t.Fatal(err)
+	}
+	key := newTestUploadKey(t)
+
+	now := time.Now()
+	for i, want := range []bool{true, true, false} {
+		if ok, _ := allowFollow(key, "10.0.0.1", now); ok != want {
+			t.Fatalf("poll %d allowed = %v", i+1, ok)
+		}
+	}
+	if ok, _ := allowFollow(key, "10.0.0.2", now); !ok {
+		t.Fatal("other client limited")
+	}
+	if ok, _ := allowFollow(newTestUploadKey(t), "10.0.0.1", now); !ok {
+		t.Fatal("other upload limited")
+	}
+	if ok, _ := allowFollow(key, "10.0.0.1", now.Add(time.Second)); !ok {
+		t.Fatal("poll after the interval limited")
+	}
+
+	rec := httptest.NewRecorder()
+	req := withUploadKey(httptest.NewRequest("GET", "/api/follow", nil), key)
+	req.RemoteAddr = "10.0.0.1:1234"
+	FollowHandler(rec, req)
+	if rec.Code != 429 || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("limited follow: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	if SetFollowRateLimit(-time.Second, 1) == nil || SetFollowRateLimit(time.Second, 0) == nil {
+		t.Fatal("invalid follow rate limit accepted")
+	}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// maxFollowKeys is how many uploads one multiplexed follow request can
+// watch, enough for a classroom of headsets.
+const maxFollowKeys = 64
+
+// multiFollowRecord is a record of one of the uploads a multiplexed follow
+// watches; upload is its position in the keys parameter.
+type multiFollowRecord struct {
+	upload  int
+	index   int
+	payload []byte
+	time    float64
+}
+
+// FollowMultiHandler is FollowHandler for several uploads at once, so that a
+// dashboard watching a room of headsets needs one polling loop instead of
+// one per headset. keys lists the uploads, by key or name, separated by
+// commas. The new records of all of them are returned as
+// upload_name,index,payload lines, interleaved by timestamp. Positions are
+// per upload, in the order of keys, as in "12,0,9", and are returned in
+// X-Follow-Position.
+func FollowMultiHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	defer observeFollow(time.Now())
+
+	refs := strings.Split(r.URL.Query().Get("keys"), ",")
+	if len(refs) == 1 && strings.TrimSpace(refs[0]) == "" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "missing keys parameter")
+		return
+	}
+	if len(refs) > maxFollowKeys {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("too many keys: at most %d can be followed at once", maxFollowKeys))
+		return
+	}
+	uploadKeys := make([]string, len(refs))
+	for i, ref := range refs {
+		uploadKey, status, code, err := resolveUploadRef(ref)
+		if err != nil {
+			writeError(w, status, code, fmt.Sprintf("keys[%d]: %v", i, err))
+			return
+		}
+		uploadKeys[i] = uploadKey
+	}
+
+	positions, err := parseMultiFollowPositions(r.URL.Query().Get("position"), len(uploadKeys))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	var records []multiFollowRecord
+	for i, uploadKey := range uploadKeys {
+		var last float64
+		err := scanUploadFileFrom(uploadFilePath(uploadKey), positions[i], func(index int, payload []byte) error {
+			if t, ok := payloadTime(payload); ok {
+				last = t
+			}
+			records = append(records, multiFollowRecord{upload: i, index: index, payload: payload, time: last})
+			positions[i] = max(positions[i], index)
+			return nil
+		})
+		if err != nil && !errors.Is(err, errUploadNotFound) {
+			log.Printf("failed to scan upload file: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+			return
+		}
+	}
+	slices.SortStableFunc(records, func(a, b multiFollowRecord) int {
+		return cmp.Compare(a.time, b.time)
+	})
+
+	w.Header().Set("X-Follow-Position", formatMultiFollowPositions(positions))
+	if len(records) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	log.Printf("follow multi read uploads=%d new_lines=%d", len(uploadKeys), len(records))
+
+	names := make([]string, len(uploadKeys))
+	for i, uploadKey := range uploadKeys {
+		names[i] = uploadNameFromKey(uploadKey)
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	writer := bufio.NewWriter(w)
+	for _, record := range records {
+		fmt.Fprintf(writer, "%s,%d,%s\n", names[record.upload], record.index, record.payload)
+	}
+	if err := writer.Flush(); err != nil {
+		log.Printf("failed to write follow multi response: %v", err)
+	}
+}
+
+// parseMultiFollowPositions parses the positions of a multiplexed follow,
+// one per upload separated by commas. Uploads left out at the end start
+// from 0.
+func parseMultiFollowPositions(raw string, uploads int) ([]int, error) {
+	positions := make([]int, uploads)
+	if raw == "" {
+		return positions, nil
+	}
+	parts := strings.Split(raw, ",")
+	if len(parts) > uploads {
+		return nil, errors.New("invalid position parameter: more positions than keys")
+	}
+	for i, part := range parts {
+		position, err := strconv.Atoi(part)
+		if err != nil || position < 0 {
+			return nil, errors.New("invalid position parameter: must be non-negative integers separated by commas, one per key")
+		}
+		positions[i] = position
+	}
+	return positions, nil
+}
+
+func formatMultiFollowPositions(positions []int) string {
+	parts := make([]string, len(positions))
+	for i, position := range positions {
+		parts[i] = strconv.Itoa(position)
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func followMulti(t *testing.T, query string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	FollowMultiHandler(rec, httptest.NewRequest("GET", "/api/follow/multi?"+query, nil))
+	return rec
+}
+
+func TestFollowMultiHandler(t *testing.T) {
+	chdirTemp(t)
+	first, second, idle := newTestUploadKey(t), newTestUploadKey(t), newTestUploadKey(t)
+	simulateUpload(t, first, []string{`{"timestamp":1,"trackerKey":"head"}`, `{"timestamp":3,"trackerKey":"head"}`})
+	simulateUpload(t, second, []string{`{"timestamp":2,"heartRate":70}`})
+	firstName, secondName := uploadNameFromKey(first), uploadNameFromKey(second)
+
+	// the second upload is given by name, the third hasn't uploaded yet
+	keys := "keys=" + first + "," + url.QueryEscape(secondName) + "," + idle
+	rec := followMulti(t, keys)
+	want := firstName + ",1,{\"timestamp\":1,\"trackerKey\":\"head\"}\n" +
+		secondName + ",1,{\"timestamp\":2,\"heartRate\":70}\n" +
+		firstName + ",2,{\"timestamp\":3,\"trackerKey\":\"head\"}\n"
+	if rec.Code != 200 || rec.Body.String() != want {
+		t.Fatalf("follow multi: status %d\n%s", rec.Code, rec.Body)
+	}
+	position := rec.Header().Get("X-Follow-Position")
+	if position != "2,1,0" {
+		t.Fatalf("position = %q", position)
+	}
+
+	rec = followMulti(t, keys+"&position="+position)
+	if rec.Code != 204 || rec.Header().Get("X-Follow-Position") != position {
+		t.Fatalf("follow multi without new records: status %d, position %q", rec.Code, rec.Header().Get("X-Follow-Position"))
+	}
+
+	simulateUpload(t, idle, []string{`{"timestamp":4,"heartRate":71}`})
+	rec = followMulti(t, keys+"&position="+position)
+	if rec.Body.String() != uploadNameFromKey(idle)+",1,{\"timestamp\":4,\"heartRate\":71}\n" || rec.Header().Get("X-Follow-Position") != "2,1,1" {
+		t.Fatalf("follow multi from %s: %q, position %q", position, rec.Body, rec.Header().Get("X-Follow-Position"))
+	}
+
+	for _, query := range []string{"", "keys=" + first + "&position=1,2", "keys=" + first + "&position=-1", "keys=" + first + ",nothex", "keys=" + strings.Repeat(first+",", maxFollowKeys) + first} {
+		if rec := followMulti(t, query); rec.Code != 400 {
+			t.Errorf("follow multi ?%.60s: status %d, want 400", query, rec.Code)
+		}
+	}
+}
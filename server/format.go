@@ -0,0 +1,173 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Upload file format versions. Both start with a JSON metadata line; v2
+// files say so in its format_version field, v1 files have none.
+//
+// v1 record lines are "index,json".
+//
+// v2 record lines are "index,received_ms,type,device_id,json": the server
+// receive time in Unix milliseconds, the record type (tracker, heart_rate,
+// prediction or other) and the id of the device that sent it, each empty if
+// unknown. The payload stays last so that it may contain commas.
+//
+// Readers handle both versions and hand out the payload only, so code that
+// works on records doesn't care which version it reads. Uploads keep the
+// version they were created with; MigrateUpload rewrites v1 uploads as v2.
+const (
+	formatV1 = 1
+	formatV2 = 2
+)
+
+// uploadFormatVersion is the version new uploads are written in. Set by
+// SetUploadFormatVersion.
+var uploadFormatVersion = formatV2
+
+// Record types of v2 record lines.
+const (
+	recordTypeTracker    = "tracker"
+	recordTypeHeartRate  = "heart_rate"
+	recordTypePrediction = "prediction"
+	recordTypeOther      = "other"
+	recordTypeEncrypted  = "encrypted"
+)
+
+// recordLine is a parsed record line. The v2 columns are zero for v1 lines.
+type recordLine struct {
+	Index      int
+	ReceivedAt int64 // Unix milliseconds
+	Type       string
+	DeviceID   string
+	Payload    []byte
+}
+
+// recordColumns are the v2 columns that a batch of records shares.
+type recordColumns struct {
+	ReceivedAt time.Time
+	DeviceID   string
+	Type       string // overrides the type recordType derives from the payload
+}
+
+// SetUploadFormatVersion sets the file format of new uploads, for tools that
+// only read v1 files.
+func SetUploadFormatVersion(version int) error {
+	if version != formatV1 && version != formatV2 {
+		return fmt.Errorf("invalid upload format version %d: must be 1 or 2", version)
+	}
+	uploadFormatVersion = version
+	return nil
+}
+
+// metadataFormatVersion returns the format version a metadata line declares.
+func metadataFormatVersion(metadataLine []byte) int {
+	var metadata struct {
+		FormatVersion int `json:"format_version"`
+	}
+	if json.Unmarshal(metadataLine, &metadata) != nil || metadata.FormatVersion == 0 {
+		return formatV1
+	}
+	return metadata.FormatVersion
+}
+
+// recordType classifies a payload for the type column of v2 record lines.
+func recordType(payload []byte) string {
+	var record struct {
+		TrackerKey         *string         `json:"trackerKey"`
+		BPM                json.RawMessage `json:"bpm"`
+		PredictedHeartRate json.RawMessage `json:"predicted_heart_rate"`
+	}
+	switch {
+	case json.Unmarshal(payload, &record) != nil:
+		return recordTypeOther
+	case record.TrackerKey != nil:
+		return recordTypeTracker
+	case record.BPM != nil:
+		return recordTypeHeartRate
+	case record.PredictedHeartRate != nil:
+		return recordTypePrediction
+	}
+	return recordTypeOther
+}
+
+// formatRecordLines encodes payloads as record lines of the given version,
+// numbered from startIndex, without trailing newlines.
+func formatRecordLines(version, startIndex int, columns recordColumns, payloads []string) []string {
+	var receivedAt string
+	if !columns.ReceivedAt.IsZero() {
+		receivedAt = strconv.FormatInt(columns.ReceivedAt.UnixMilli(), 10)
+	}
+
+	lines := make([]string, len(payloads))
+	for i, payload := range payloads {
+		index := strconv.Itoa(startIndex + i)
+		if version == formatV1 {
+			lines[i] = index + "," + payload
+			continue
+		}
+		typ := columns.Type
+		if typ == "" {
+			typ = recordType([]byte(payload))
+		}
+		lines[i] = index + "," + receivedAt + "," + typ + "," + columns.DeviceID + "," + payload
+	}
+	return lines
+}
+
+// parseRecordLine decodes a record line of the given version. The payload
+// aliases line.
+func parseRecordLine(line []byte, version int) (recordLine, error) {
+	fields := 2
+	if version >= formatV2 {
+		fields = 5
+	}
+	parts := bytes.SplitN(line, []byte(","), fields)
+	if len(parts) != fields {
+		return recordLine{}, fmt.Errorf("malformed record line %q", line)
+	}
+
+	var record recordLine
+	var err error
+	if record.Index, err = strconv.Atoi(string(parts[0])); err != nil {
+		return recordLine{}, fmt.Errorf("malformed record index %q: %w", parts[0], err)
+	}
+	record.Payload = parts[fields-1]
+	if version < formatV2 {
+		return record, nil
+	}
+
+	if len(parts[1]) > 0 {
+		if record.ReceivedAt, err = strconv.ParseInt(string(parts[1]), 10, 64); err != nil {
+			return recordLine{}, fmt.Errorf("malformed record receive time %q: %w", parts[1], err)
+		}
+	}
+	record.Type = string(parts[2])
+	record.DeviceID = string(parts[3])
+	return record, nil
+}
+
+// uploadFormat returns the file format version of a stored upload.
+func uploadFormat(filePath string) (int, error) {
+	metadata, err := readUploadMetadata(filePath)
+	if err != nil {
+		return 0, err
+	}
+	return max(metadata.FormatVersion, formatV1), nil
+}
+
+// columns returns the v2 columns of a parsed record line.
+func (r recordLine) columns() recordColumns {
+	var columns recordColumns
+	if r.ReceivedAt != 0 {
+		columns.ReceivedAt = time.UnixMilli(r.ReceivedAt).UTC()
+	}
+	columns.DeviceID = r.DeviceID
+	columns.Type = r.Type
+	return columns
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestParseRecordLine(t *testing.T) {
+	record, err := parseRecordLine([]byte(`3,{"a":1,"b":2}`), formatV1)
+	if err != nil || record.Index != 3 || string(record.Payload) != `{"a":1,"b":2}` {
+		t.Fatalf("v1 record = %+v, %v", record, err)
+	}
+
+	record, err = parseRecordLine([]byte(`4,1700000000123,tracker,quest-1,{"a":1,"b":2}`), formatV2)
+	if err != nil || record.Index != 4 || record.ReceivedAt != 1700000000123 || record.Type != recordTypeTracker ||
+		record.DeviceID != "quest-1" || string(record.Payload) != `{"a":1,"b":2}` {
+		t.Fatalf("v2 record = %+v, %v", record, err)
+	}
+
+	record, err = parseRecordLine([]byte(`5,,other,,[1,2]`), formatV2)
+	if err != nil || record.ReceivedAt != 0 || record.DeviceID != "" || string(record.Payload) != `[1,2]` {
+		t.Fatalf("v2 record without columns = %+v, %v", record, err)
+	}
+
+	for _, line := range []string{`x,{}`, `1,2,tracker`, `1,now,tracker,,{}`} {
+		if _, err := parseRecordLine([]byte(line), formatV2); err == nil {
+			t.Fatalf("parseRecordLine(%q) succeeded", line)
+		}
+	}
+}
+
+func TestUploadFormatV2(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	entries := []string{
+		`{"trackerKey":"headset","timestamp":1,"position":{"x":1,"y":2,"z":3}}`,
+		`{"bpm":70}`,
+		`{"predicted_heart_rate":71}`,
+	}
+
+	req := withUploadKey(httptest.NewRequest("POST", "/api/upload?device_id=Quest-1", strings.NewReader(strings.Join(entries, "\n"))), key)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	UploadHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("upload status = %d body=%s", rec.Code, rec.Body)
+	}
+
+	data, err := os.ReadFile(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if metadataFormatVersion([]byte(lines[0])) != formatV2 {
+		t.Fatalf("metadata line = %s", lines[0])
+	}
+	for i, want := range []string{recordTypeTracker, recordTypeHeartRate, recordTypePrediction} {
+		record, err := parseRecordLine([]byte(lines[i+1]), formatV2)
+		if err != nil || record.Type != want || record.DeviceID != "quest-1" || record.ReceivedAt == 0 {
+			t.Fatalf("record line %q = %+v, %v", lines[i+1], record, err)
+		}
+	}
+
+	tail, err := readTailRecords(uploadFilePath(key), 1)
+	if err != nil || len(tail) != 1 || tail[0].Index != 3 || string(tail[0].Record) != entries[2] {
+		t.Fatalf("tail = %+v, %v", tail, err)
+	}
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// layout=frames pivots the interleaved samples into frames: one row per
+// resampled timestamp with the position and rotation of every tracker in
+// columns of its own, headset_x, leftController_qw and so on. A tracker
+// without a sample at a frame, e.g. before it was first seen, has nulls.
+
+const framesLayout = "frames"
+
+// frameAxes are the columns of each tracker in a frame.
+var frameAxes = []string{"x", "y", "z", "qx", "qy", "qz", "qw"}
+
+type frame struct {
+	timestamp float64
+	epoch     float64
+	samples   []*trackerSample // per tracker, nil if it has none
+	labels    []string
+}
+
+// frameTrackers returns the trackers with samples in column order.
+func frameTrackers(samples map[string][]trackerSample) []string {
+	var trackers []string
+	for tracker, trackerSamples := range samples {
+		if len(trackerSamples) > 0 {
+			trackers = append(trackers, tracker)
+		}
+	}
+	return frameColumnOrder(trackers)
+}
+
+// frameColumnOrder puts trackers in column order: the headset and the hands
+// first, then the others by name.
+func frameColumnOrder(trackers []string) []string {
+	var ordered, others []string
+	for _, tracker := range append([]string{defaultTracker}, handTrackers...) {
+		if slices.Contains(trackers, tracker) {
+			ordered = append(ordered, tracker)
+		}
+	}
+	for _, tracker := range trackers {
+		if !slices.Contains(ordered, tracker) {
+			others = append(others, tracker)
+		}
+	}
+	slices.Sort(others)
+	return append(ordered, others...)
+}
+
+// pivotFrames joins the samples each passes on, interleaved by timestamp,
+// into frames of trackers and passes them to fn as they are complete.
+func pivotFrames(each func(func(trackerSample) error) error, trackers []string, fn func(frame) error) error {
+	columns := make(map[string]int, len(trackers))
+	for i, tracker := range trackers {
+		columns[tracker] = i
+	}
+
+	var f frame
+	started := false
+	emit := func() error {
+		for _, s := range f.samples {
+			if s == nil {
+				continue
+			}
+			if f.epoch == 0 {
+				f.epoch = s.Epoch
+			}
+			for _, label := range s.Labels {
+				if !slices.Contains(f.labels, label) {
+					f.labels = append(f.labels, label)
+				}
+			}
+		}
+		slices.Sort(f.labels)
+		return fn(f)
+	}
+
+	err := each(func(s trackerSample) error {
+		i, ok := columns[s.TrackerKey]
+		if !ok {
+			return nil
+		}
+		if started && (s.Timestamp != f.timestamp || f.samples[i] != nil) {
+			if err := emit(); err != nil {
+				return err
+			}
+			started = false
+		}
+		if !started {
+			f = frame{timestamp: s.Timestamp, samples: make([]*trackerSample, len(trackers))}
+			started = true
+		}
+		f.samples[i] = &s
+		return nil
+	})
+	if err != nil || !started {
+		return err
+	}
+	return emit()
+}
+
+// values returns the frame's columns of tracker i, in frameAxes order, with
+// nil for what it lacks.
+func (f frame) values(i int) []any {
+	s := f.samples[i]
+	values := make([]any, len(frameAxes))
+	if s == nil {
+		return values
+	}
+	values[0], values[1], values[2] = s.Position.X, s.Position.Y, s.Position.Z
+	if s.Rotation != nil {
+		values[3], values[4], values[5], values[6] = s.Rotation.X, s.Rotation.Y, s.Rotation.Z, s.Rotation.W
+	}
+	return values
+}
+
+// exportFrames writes the frames of an export as NDJSON or Parquet, with the
+// upload's labels added to every row.
+func exportFrames(w http.ResponseWriter, uploadKey, format string, uploadLabels map[string]string, export *sampleExport) {
+	trackers := frameColumnOrder(export.trackers)
+	frames := func(fn func(frame) error) error {
+		return pivotFrames(export.merged, trackers, fn)
+	}
+	if format == "parquet" {
+		exportFramesParquet(w, uploadKey, uploadLabels, trackers, frames)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(uploadKey, "ndjson")))
+
+	writer := bufio.NewWriter(w)
+	err := frames(func(f frame) error {
+		row := map[string]any{"timestamp": f.timestamp}
+		if f.epoch != 0 {
+			row["epoch"] = f.epoch
+		}
+		if len(f.labels) > 0 {
+			row["labels"] = f.labels
+		}
+		for i, tracker := range trackers {
+			for j, value := range f.values(i) {
+				row[tracker+"_"+frameAxes[j]] = value
+			}
+		}
+		payload, err := json.Marshal(row)
+		if err != nil {
+			return err
+		}
+		writer.Write(addUploadLabels(payload, uploadLabels))
+		return writer.WriteByte('\n')
+	})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		log.Printf("failed to write frames export: %v", err)
+	}
+}
+
+// exportFramesParquet writes the frames frames passes on as Parquet rows.
+// Like exportParquet, labels are joined with ";" and each upload label is a
+// column of its own.
+func exportFramesParquet(w http.ResponseWriter, uploadKey string, uploadLabels map[string]string, trackers []string, frames func(func(frame) error) error) {
+	w.Header().Set("Content-Type", "application/vnd.apache.parquet")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", exportFilename(uploadKey, "parquet")))
+
+	columns := []parquetColumn{
+		{Name: "timestamp", Type: parquetDouble},
+		{Name: "epoch", Type: parquetDouble, Optional: true},
+	}
+	for _, tracker := range trackers {
+		for _, axis := range frameAxes {
+			columns = append(columns, parquetColumn{Name: tracker + "_" + axis, Type: parquetDouble, Optional: true})
+		}
+	}
+	columns = append(columns, parquetColumn{Name: "labels", Type: parquetByteArray, Optional: true, UTF8: true})
+	labelNames := sortedLabelNames(uploadLabels)
+	labelValues := make([]any, len(labelNames))
+	for i, name := range labelNames {
+		columns = append(columns, parquetColumn{Name: name, Type: parquetByteArray, UTF8: true})
+		labelValues[i] = uploadLabels[name]
+	}
+
+	writer := bufio.NewWriter(w)
+	pw, err := newParquetWriter(writer, columns)
+	if err != nil {
+		log.Printf("failed to write parquet frames export: %v", err)
+		return
+	}
+	err = frames(func(f frame) error {
+		var epoch, labels any
+		if f.epoch != 0 {
+			epoch = f.epoch
+		}
+		if len(f.labels) > 0 {
+			labels = strings.Join(f.labels, ";")
+		}
+		row := []any{f.timestamp, epoch}
+		for i := range trackers {
+			row = append(row, f.values(i)...)
+		}
+		row = append(append(row, labels), labelValues...)
+		return pw.writeRow(row...)
+	})
+	if err != nil {
+		log.Printf("failed to write parquet frames export: %v", err)
+		return
+	}
+
+	err = pw.close([][2]string{{"upload_name", uploadNameFromKey(uploadKey)}})
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		log.Printf("failed to write parquet frames export: %v", err)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExportFrames(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":1.6,"z":0},"rotation":{"isQuaternion":true,"_x":0,"_y":0,"_z":0,"_w":1}}`,
+		`{"trackerKey":"rightController","timestamp":5,"position":{"x":0.3,"y":1,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":100,"position":{"x":1,"y":1.6,"z":0},"rotation":{"isQuaternion":true,"_x":0,"_y":0,"_z":0,"_w":1}}`,
+		`{"trackerKey":"leftController","timestamp":50,"position":{"x":-0.3,"y":1,"z":0}}`,
+		`{"trackerKey":"leftController","timestamp":100,"position":{"x":-0.3,"y":1.2,"z":0}}`,
+		`{"trackerKey":"rightController","timestamp":105,"position":{"x":0.3,"y":1,"z":0}}`,
+		`{"bpm":70}`,
+	})
+
+	export := func(query string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export?"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		return rec.Code, rec.Body.String()
+	}
+
+	status, body := export("layout=frames&resample=50ms")
+	if status != 200 {
+		t.Fatalf("frames export status = %d body=%s", status, body)
+	}
+	var frames []map[string]any
+	for _, line := range strings.Split(strings.TrimSpace(body), "\n") {
+		var frame map[string]any
+		if err := json.Unmarshal([]byte(line), &frame); err != nil {
+			t.Fatalf("decode frame %q: %v", line, err)
+		}
+		frames = append(frames, frame)
+	}
+	if len(frames) != 3 {
+		t.Fatalf("frames = %v", frames)
+	}
+	for i, want := range []float64{0, 50, 100} {
+		if frames[i]["timestamp"] != want {
+			t.Fatalf("frame %d at %v, want %v", i, frames[i]["timestamp"], want)
+		}
+	}
+	middle := frames[1]
+	if middle["headset_x"] != 0.5 || middle["headset_qw"] != float64(1) || middle["leftController_x"] != -0.3 || middle["rightController_x"] != 0.3 {
+		t.Fatalf("middle frame = %v", middle)
+	}
+	// the left hand is only seen from 50 ms on
+	if v, ok := frames[0]["leftController_y"]; !ok || v != nil {
+		t.Fatalf("first frame left hand = %v, %v", v, ok)
+	}
+	if v := frames[2]["leftController_y"]; v != 1.2 {
+		t.Fatalf("last frame left hand y = %v", v)
+	}
+	if _, ok := middle["leftController_qw"]; !ok {
+		t.Fatalf("frame without rotation columns: %v", middle)
+	}
+
+	status, body = export("layout=frames&resample=50ms&format=parquet")
+	if status != 200 {
+		t.Fatalf("parquet frames export status = %d", status)
+	}
+	for _, column := range []string{"timestamp", "headset_x", "leftController_qw", "rightController_z"} {
+		if !bytes.Contains([]byte(body), []byte(column)) {
+			t.Fatalf("parquet frames export is missing column %q", column)
+		}
+	}
+
+	for _, query := range []string{"layout=frames", "layout=columns&resample=50ms", "layout=frames&resample=50ms&format=bvh"} {
+		if status, _ := export(query); status != 400 {
+			t.Errorf("export?%s status = %d, want 400", query, status)
+		}
+	}
+}
+
+func TestFrameTrackers(t *testing.T) {
+	samples := map[string][]trackerSample{
+		"waist":           {{}},
+		"rightController": {{}},
+		"headset":         {{}},
+		"ankle":           {{}},
+		"leftController":  nil,
+	}
+	if got := frameTrackers(samples); !slices.Equal(got, []string{"headset", "rightController", "ankle", "waist"}) {
+		t.Fatalf("frameTrackers = %v", got)
+	}
+}
@@ -0,0 +1,325 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Kinds of problems found by fsck.
+const (
+	fsckMetadata  = "metadata"       // metadata line missing or not a JSON object
+	fsckMalformed = "malformed_line" // record line that doesn't parse
+	fsckIndex     = "index"          // record index not one more than the one before
+	fsckPayload   = "payload"        // payload that isn't valid JSON, or ciphertext if encrypted
+	fsckTornTail  = "torn_tail"      // last write cut short, e.g. by a crash
+	fsckChecksum  = "checksum"       // content doesn't match its .sum file
+)
+
+// fsckProblem is one problem of an upload file. Line counts from 1 in the
+// decompressed file, the metadata line being line 1; it is 0 for problems of
+// the whole file.
+type fsckProblem struct {
+	Line    int    `json:"line"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// fsckReport describes an upload with problems and what repair did about
+// them.
+type fsckReport struct {
+	UploadKey  string        `json:"upload_key"`
+	UploadName string        `json:"upload_name"`
+	FilePath   string        `json:"file_path"`
+	Records    int           `json:"records"`
+	Problems   []fsckProblem `json:"problems"`
+	Repaired   bool          `json:"repaired"`
+	BackupPath string        `json:"backup_path,omitempty"`
+	RepairSkip string        `json:"repair_skipped,omitempty"`
+}
+
+// fsckResult is the outcome of a check of all uploads. Reports only lists
+// uploads with problems.
+type fsckResult struct {
+	StartedAt  time.Time    `json:"started_at"`
+	FinishedAt time.Time    `json:"finished_at"`
+	Repair     bool         `json:"repair"`
+	Uploads    int          `json:"uploads"`
+	Reports    []fsckReport `json:"reports"`
+}
+
+var (
+	lastFsck      *fsckResult
+	lastFsckMutex sync.Mutex
+)
+
+// Fsck checks the given upload files, or all uploads if there are none: the
+// metadata line parses, record indices count up from 1, payloads are valid
+// JSON, the last write wasn't cut short and the content matches its
+// checksum. With repair, uploads with problems are rewritten without the torn
+// tail and the lines that don't parse, and renumbered, after copying the
+// original to a .bak file next to it. Problems are logged and the result is kept for the admin API. It
+// returns how many uploads still have problems.
+func Fsck(filePaths []string, repair bool) (int, error) {
+	result, err := runFsck(filePaths, repair)
+	if err != nil {
+		return 0, err
+	}
+	unresolved := 0
+	for _, report := range result.Reports {
+		if !report.Repaired {
+			unresolved++
+		}
+	}
+	return unresolved, nil
+}
+
+func runFsck(filePaths []string, repair bool) (fsckResult, error) {
+	result := fsckResult{StartedAt: time.Now().UTC(), Repair: repair, Reports: []fsckReport{}}
+	if len(filePaths) == 0 {
+		keys, err := listUploadKeys()
+		if err != nil {
+			return result, err
+		}
+		for _, uploadKey := range keys {
+			filePaths = append(filePaths, uploadFilePath(uploadKey))
+		}
+	}
+
+	for _, filePath := range filePaths {
+		report, err := checkUploadFile(filePath)
+		if err != nil {
+			return result, fmt.Errorf("%s: %w", filePath, err)
+		}
+		result.Uploads++
+		if len(report.Problems) == 0 {
+			continue
+		}
+		for _, problem := range report.Problems {
+			log.Printf("fsck problem file=%q line=%d kind=%s: %s", filePath, problem.Line, problem.Kind, problem.Message)
+		}
+		if repair {
+			if err := repairUploadFile(&report); err != nil {
+				return result, fmt.Errorf("repair %s: %w", filePath, err)
+			}
+			if report.Repaired {
+				log.Printf("fsck repaired file=%q records=%d backup=%q", filePath, report.Records, report.BackupPath)
+			} else {
+				log.Printf("fsck did not repair file=%q: %s", filePath, report.RepairSkip)
+			}
+		}
+		result.Reports = append(result.Reports, report)
+	}
+
+	result.FinishedAt = time.Now().UTC()
+	log.Printf("fsck checked %d uploads, %d with problems", result.Uploads, len(result.Reports))
+
+	lastFsckMutex.Lock()
+	lastFsck = &result
+	lastFsckMutex.Unlock()
+	return result, nil
+}
+
+// checkUploadFile lists the problems of an upload file.
+func checkUploadFile(filePath string) (fsckReport, error) {
+	report := fsckReport{FilePath: filePath}
+	_, err := scanUploadFileLenient(filePath, func(recordLine) error {
+		report.Records++
+		return nil
+	}, func(problem fsckProblem) {
+		report.Problems = append(report.Problems, problem)
+	})
+	if err != nil {
+		return report, err
+	}
+
+	// a checksum covering the file as it is must match it
+	stored, err := readChecksumFile(filePath)
+	if info, statErr := os.Stat(filePath); err == nil && statErr == nil && stored.StoredSize == info.Size() {
+		computed, err := computeUploadChecksum(filePath)
+		if err != nil && !isTruncatedZstd(err) {
+			return report, err
+		}
+		if err == nil && (computed.CRC32C != stored.CRC32C || computed.Size != stored.Size) {
+			report.Problems = append(report.Problems, fsckProblem{Kind: fsckChecksum, Message: fmt.Sprintf("content has checksum %s, %s recorded %s", computed, checksumPath(filePath), stored)})
+		}
+	}
+
+	if metadata, err := readUploadMetadata(filePath); err == nil {
+		report.UploadKey = metadata.UploadKey
+		report.UploadName = metadata.UploadName
+	}
+	return report, nil
+}
+
+// scanUploadFileLenient reads an upload like scanUploadFile, but instead of
+// failing on a bad line it reports it to problem and carries on. fn gets the
+// good records in order. The metadata line is returned if it is a JSON
+// object; without it no records are read.
+func scanUploadFileLenient(filePath string, fn func(recordLine) error, problem func(fsckProblem)) (map[string]any, error) {
+	file, err := openUploadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open upload file: %w", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, 64*1024)
+	line, err := reader.ReadString('\n')
+	var metadata map[string]any
+	if jsonErr := json.Unmarshal([]byte(line), &metadata); jsonErr != nil || metadata == nil {
+		problem(fsckProblem{Line: 1, Kind: fsckMetadata, Message: "metadata line is not a JSON object"})
+		return nil, nil
+	}
+	if err != nil {
+		return metadata, nil // metadata line only
+	}
+	version := metadataFormatVersion([]byte(line))
+	encrypted := metadata["encryption"] != nil
+
+	previous := 0
+	for lineNumber := 2; ; lineNumber++ {
+		line, err := reader.ReadString('\n')
+		if err != nil && !errors.Is(err, io.EOF) && !isTruncatedZstd(err) {
+			return metadata, fmt.Errorf("read upload file: %w", err)
+		}
+		if trimmed := strings.TrimSpace(line); trimmed != "" {
+			record, parseErr := parseRecordLine([]byte(trimmed), version)
+			switch {
+			case err != nil && !strings.HasSuffix(line, "\n") && (parseErr != nil || !validPayload(record.Payload, encrypted)):
+				problem(fsckProblem{Line: lineNumber, Kind: fsckTornTail, Message: fmt.Sprintf("last line %q is incomplete", trimmed)})
+			case parseErr != nil:
+				problem(fsckProblem{Line: lineNumber, Kind: fsckMalformed, Message: parseErr.Error()})
+			case !validPayload(record.Payload, encrypted):
+				problem(fsckProblem{Line: lineNumber, Kind: fsckPayload, Message: fmt.Sprintf("record %d is not valid JSON or ciphertext", record.Index)})
+			default:
+				if record.Index != previous+1 {
+					problem(fsckProblem{Line: lineNumber, Kind: fsckIndex, Message: fmt.Sprintf("record index %d follows %d", record.Index, previous)})
+				}
+				previous = record.Index
+				if err := fn(record); err != nil {
+					return metadata, err
+				}
+			}
+		}
+		if isTruncatedZstd(err) {
+			problem(fsckProblem{Line: lineNumber, Kind: fsckTornTail, Message: "compressed data ends mid-frame: " + err.Error()})
+		}
+		if err != nil {
+			return metadata, nil
+		}
+	}
+}
+
+// isTruncatedZstd reports whether a read error means the end of a
+// compressed upload, its last frame or the seek table, was cut short.
+func isTruncatedZstd(err error) bool {
+	return errors.Is(err, io.ErrUnexpectedEOF) || errors.Is(err, errZstdCorrupt)
+}
+
+// repairUploadFile backs up the upload of report and rewrites it with the
+// records that checkUploadFile found good, numbered from 1. Uploads that are
+// being recorded, or whose metadata is unreadable, are left alone.
+func repairUploadFile(report *fsckReport) error {
+	if report.UploadKey != "" && sessionActive(report.UploadKey) {
+		report.RepairSkip = "upload is being recorded"
+		return nil
+	}
+	metadata, err := scanUploadFileLenient(report.FilePath, func(recordLine) error { return nil }, func(fsckProblem) {})
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		report.RepairSkip = "metadata line is unreadable"
+		return nil
+	}
+
+	backupPath := report.FilePath + "." + time.Now().UTC().Format("20060102T150405Z") + ".bak"
+	if err := copyFile(report.FilePath, backupPath); err != nil {
+		return fmt.Errorf("back up upload: %w", err)
+	}
+
+	metadata["repaired_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return fmt.Errorf("encode metadata: %w", err)
+	}
+	err = rewriteUpload(report.FilePath, metadataJSON, func(yield func(recordLine) error) error {
+		_, err := scanUploadFileLenient(report.FilePath, yield, func(fsckProblem) {})
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// what is left of the tail may have changed
+	forgetDedupeWindow(report.UploadKey)
+	forgetTrackerClock(report.UploadKey)
+	report.Repaired = true
+	report.BackupPath = backupPath
+	return nil
+}
+
+// copyFile copies src to a new file dst.
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		os.Remove(dst)
+		return err
+	}
+	return out.Close()
+}
+
+// FsckHandler serves the admin view of upload integrity. GET returns the
+// result of the last check, run at startup or by an earlier POST; POST checks
+// all uploads now and, with repair=1, repairs those with problems that aren't
+// being recorded.
+func FsckHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		panic("only GET and POST allowed")
+	}
+
+	var result *fsckResult
+	if r.Method == http.MethodPost {
+		repair := r.URL.Query().Get("repair") == "1" || r.URL.Query().Get("repair") == "true"
+		checked, err := runFsck(nil, repair)
+		if err != nil {
+			log.Printf("failed to check uploads: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to check uploads")
+			return
+		}
+		result = &checked
+	} else {
+		lastFsckMutex.Lock()
+		result = lastFsck
+		lastFsckMutex.Unlock()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status": "ok",
+		"fsck":   result,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write fsck response: %v", err)
+	}
+}
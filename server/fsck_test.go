@@ -0,0 +1,171 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"slices"
+	"testing"
+)
+
+func fsckKinds(report fsckReport) []string {
+	var kinds []string
+	for _, problem := range report.Problems {
+		kinds = append(kinds, problem.Kind)
+	}
+	return kinds
+}
+
+// endTestSession makes an upload inactive, as repair skips active ones.
+func endTestSession(uploadKey string) {
+	activeSessionsMutex.Lock()
+	delete(activeSessions, uploadKey)
+	activeSessionsMutex.Unlock()
+}
+
+func TestFsckRepair(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	filePath := uploadFilePath(key)
+	simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":71}`})
+
+	file, err := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("5,,heart_rate,,{\"bpm\":72}\n")
+	file.WriteString("6,,other,,{not json}\n")
+	file.WriteString("oops\n")
+	file.WriteString("7,,heart_rate,,{\"bpm\"")
+	file.Close()
+
+	report, err := checkUploadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{fsckIndex, fsckPayload, fsckMalformed, fsckTornTail}
+	if !slices.Equal(fsckKinds(report), want) || report.Records != 3 || report.UploadKey != key {
+		t.Fatalf("report = %+v, want problems %v", report, want)
+	}
+
+	endTestSession(key)
+	unresolved, err := Fsck([]string{filePath}, false)
+	if err != nil || unresolved != 1 {
+		t.Fatalf("check: unresolved = %d, %v", unresolved, err)
+	}
+	if unresolved, err = Fsck([]string{filePath}, true); err != nil || unresolved != 0 {
+		t.Fatalf("repair: unresolved = %d, %v", unresolved, err)
+	}
+
+	_, metadata, records := readUploadFile(t, filePath)
+	if metadata["repaired_at"] == nil || metadata["upload_key"] != key {
+		t.Fatalf("repaired metadata = %v", metadata)
+	}
+	assertRecords(t, records, []string{`{"bpm":70}`, `{"bpm":71}`, `{"bpm":72}`})
+	if report, err = checkUploadFile(filePath); err != nil || len(report.Problems) != 0 {
+		t.Fatalf("after repair: %+v, %v", report.Problems, err)
+	}
+
+	lastFsckMutex.Lock()
+	backupPath := lastFsck.Reports[0].BackupPath
+	lastFsckMutex.Unlock()
+	if backup, err := os.ReadFile(backupPath); err != nil || len(backup) == 0 {
+		t.Fatalf("backup %q: %v", backupPath, err)
+	}
+
+	// appends carry on after the repaired records
+	simulateUpload(t, key, []string{`{"bpm":73}`})
+	_, _, records = readUploadFile(t, filePath)
+	assertRecords(t, records, []string{`{"bpm":70}`, `{"bpm":71}`, `{"bpm":72}`, `{"bpm":73}`})
+}
+
+func TestFsckCompressedTornTail(t *testing.T) {
+	chdirTemp(t)
+	compressStorage = true
+	t.Cleanup(func() { compressStorage = false })
+
+	key := newTestUploadKey(t)
+	filePath := uploadFilePath(key)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+	simulateUpload(t, key, []string{`{"bpm":71}`, `{"bpm":72}`})
+
+	info, err := os.Stat(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Truncate(filePath, info.Size()-10); err != nil {
+		t.Fatal(err)
+	}
+
+	endTestSession(key)
+	report, err := checkUploadFile(filePath)
+	if err != nil || !slices.Contains(fsckKinds(report), fsckTornTail) {
+		t.Fatalf("report = %+v, %v", report, err)
+	}
+	if unresolved, err := Fsck([]string{filePath}, true); err != nil || unresolved != 0 {
+		t.Fatalf("repair: unresolved = %d, %v", unresolved, err)
+	}
+	if report, err = checkUploadFile(filePath); err != nil || len(report.Problems) != 0 || report.Records == 0 {
+		t.Fatalf("after repair: %+v, %v", report, err)
+	}
+	if compressed, _ := isCompressedUpload(filePath); !compressed {
+		t.Fatal("repaired upload is no longer compressed")
+	}
+}
+
+func TestFsckHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+	file, err := os.OpenFile(uploadFilePath(key), os.O_APPEND|os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString("2,,heart_rate,,{\"bp")
+	file.Close()
+
+	rec := httptest.NewRecorder()
+	FsckHandler(rec, httptest.NewRequest("POST", "/api/admin/fsck?repair=1", nil))
+	var response struct {
+		Fsck fsckResult `json:"fsck"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || rec.Code != 200 {
+		t.Fatalf("status %d, body %s", rec.Code, rec.Body)
+	}
+	if response.Fsck.Uploads != 1 || len(response.Fsck.Reports) != 1 {
+		t.Fatalf("result = %+v", response.Fsck)
+	}
+	// the upload is still being recorded
+	if report := response.Fsck.Reports[0]; report.Repaired || report.RepairSkip == "" {
+		t.Fatalf("report = %+v", report)
+	}
+
+	rec = httptest.NewRecorder()
+	FsckHandler(rec, httptest.NewRequest("GET", "/api/admin/fsck", nil))
+	response.Fsck = fsckResult{}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || len(response.Fsck.Reports) != 1 {
+		t.Fatalf("last result: %s", rec.Body)
+	}
+}
+
+func TestFsckChecksum(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	filePath := uploadFilePath(key)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+
+	// same size, different content, e.g. a flipped bit on disk
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filePath, bytes.Replace(data, []byte(`"bpm":70`), []byte(`"bpm":71`), 1), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := checkUploadFile(filePath)
+	if err != nil || !slices.Equal(fsckKinds(report), []string{fsckChecksum}) {
+		t.Fatalf("report = %+v, %v", report, err)
+	}
+}
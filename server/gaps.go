@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+)
+
+// mergeTrackerSamples interleaves all trackers' samples by timestamp, keeping
+// stored order for equal timestamps.
+func mergeTrackerSamples(samples map[string][]trackerSample) []trackerSample {
+	var merged []trackerSample
+	for _, trackerSamples := range samples {
+		merged = append(merged, trackerSamples...)
+	}
+	sort.SliceStable(merged, func(i, j int) bool {
+		if merged[i].Timestamp != merged[j].Timestamp {
+			return merged[i].Timestamp < merged[j].Timestamp
+		}
+		return merged[i].Index < merged[j].Index
+	})
+	return merged
+}
+
+// GapsHandler reports timestamp gaps longer than gap_ms per tracker. Gaps in
+// a single tracker usually mean lost tracking, while gaps across all
+// trackers point at the client or network dropping out.
+func GapsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	gapThresholdMs, err := parseGapThreshold(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for gaps: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	samples, err = selectTracker(samples, r.URL.Query().Get("tracker"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, err.Error())
+		return
+	}
+
+	trackerGaps := make(map[string][]gapInterval, len(samples))
+	flagged := false
+	for tracker, trackerSamples := range samples {
+		gaps := findGaps(trackerSamples, gapThresholdMs)
+		if gaps == nil {
+			gaps = []gapInterval{}
+		}
+		trackerGaps[tracker] = gaps
+		flagged = flagged || len(gaps) > 0
+	}
+
+	sessionGaps := findGaps(mergeTrackerSamples(samples), gapThresholdMs)
+	if sessionGaps == nil {
+		sessionGaps = []gapInterval{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":           "ok",
+		"upload_name":      uploadNameFromKey(uploadKey),
+		"gap_threshold_ms": gapThresholdMs,
+		"flagged":          flagged,
+		"trackers":         trackerGaps,
+		"session":          sessionGaps,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write gaps response: %v", err)
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGapsHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"leftController","timestamp":100,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":200,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"leftController","timestamp":900,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1000,"position":{"x":0,"y":0,"z":0}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/gaps?gap_ms=500", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	GapsHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("gaps status = %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var payload struct {
+		Flagged  bool                     `json:"flagged"`
+		Trackers map[string][]gapInterval `json:"trackers"`
+		Session  []gapInterval            `json:"session"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode gaps response: %v", err)
+	}
+	if !payload.Flagged {
+		t.Fatalf("session with gaps not flagged")
+	}
+	headset := payload.Trackers["headset"]
+	if len(headset) != 1 || headset[0].Start != 200 || headset[0].End != 1000 || headset[0].StartIndex != 3 {
+		t.Fatalf("unexpected headset gaps: %+v", headset)
+	}
+	if len(payload.Trackers["leftController"]) != 1 {
+		t.Fatalf("unexpected leftController gaps: %+v", payload.Trackers["leftController"])
+	}
+	if len(payload.Session) != 1 || payload.Session[0].DurationMs != 700 {
+		t.Fatalf("unexpected session gaps: %+v", payload.Session)
+	}
+}
@@ -0,0 +1,184 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Metrics served to Grafana. Positional metrics are per tracker and named
+// "<tracker>.<metric>", e.g. "headset.speed".
+const (
+	grafanaPositionMagnitude = "position_magnitude"
+	grafanaSpeed             = "speed"
+	grafanaHeartRate         = "heart_rate"
+)
+
+var grafanaTrackers = []string{"headset", "leftController", "rightController"}
+
+// grafanaTarget is one query of a Grafana JSON datasource panel. The upload
+// is given either in the payload or as a "<upload_key>:" prefix of target.
+type grafanaTarget struct {
+	Target  string `json:"target"`
+	RefID   string `json:"refId"`
+	Payload struct {
+		UploadKey string `json:"upload_key"`
+	} `json:"payload"`
+}
+
+type grafanaSeries struct {
+	Target     string       `json:"target"`
+	Datapoints [][2]float64 `json:"datapoints"`
+}
+
+func grafanaMetrics() []string {
+	metrics := []string{grafanaHeartRate}
+	for _, tracker := range grafanaTrackers {
+		metrics = append(metrics, tracker+"."+grafanaPositionMagnitude, tracker+"."+grafanaSpeed)
+	}
+	return metrics
+}
+
+// grafanaDatapoints computes a metric for an upload as [value, unix ms]
+// pairs in time order.
+func grafanaDatapoints(uploadKey, metric string) ([][2]float64, error) {
+	if metric == grafanaHeartRate {
+		samples, err := readHeartRateSamples(uploadKey)
+		if err != nil {
+			return nil, err
+		}
+		points := make([][2]float64, 0, len(samples))
+		for _, s := range samples {
+			points = append(points, [2]float64{s.BPM, s.Epoch})
+		}
+		sort.Slice(points, func(i, j int) bool { return points[i][1] < points[j][1] })
+		return points, nil
+	}
+
+	tracker, name, ok := strings.Cut(metric, ".")
+	if !ok || (name != grafanaPositionMagnitude && name != grafanaSpeed) {
+		return nil, fmt.Errorf("unknown metric %q", metric)
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if err != nil {
+		return nil, err
+	}
+	trackerSamples := samples[tracker]
+
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if err != nil {
+		return nil, err
+	}
+	clock := sampleClock(trackerSamples, metadata.ReceivedAt)
+	millis := func(s trackerSample) float64 {
+		return float64(clock(s).UnixMicro()) / 1000
+	}
+
+	points := make([][2]float64, 0, len(trackerSamples))
+	if name == grafanaPositionMagnitude {
+		for _, s := range trackerSamples {
+			points = append(points, [2]float64{s.Position.length(), millis(s)})
+		}
+		return points, nil
+	}
+
+	_, kinematics := computeKinematics(trackerSamples)
+	for _, p := range kinematics {
+		points = append(points, [2]float64{p.Speed, millis(trackerSample{Timestamp: p.Timestamp})})
+	}
+	return points, nil
+}
+
+// GrafanaTestHandler answers the connection test of the Grafana JSON
+// datasource.
+func GrafanaTestHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// GrafanaSearchHandler lists the metrics that can be queried.
+func GrafanaSearchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(grafanaMetrics()); err != nil {
+		log.Printf("failed to write grafana search response: %v", err)
+	}
+}
+
+// GrafanaQueryHandler returns time series for the requested targets, limited
+// to the dashboard's time range and maxDataPoints.
+func GrafanaQueryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	var query struct {
+		Range struct {
+			From time.Time `json:"from"`
+			To   time.Time `json:"to"`
+		} `json:"range"`
+		Targets       []grafanaTarget `json:"targets"`
+		MaxDataPoints int             `json:"maxDataPoints"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid query JSON: %v", err))
+		return
+	}
+	from := float64(query.Range.From.UnixMilli())
+	to := float64(query.Range.To.UnixMilli())
+
+	series := make([]grafanaSeries, 0, len(query.Targets))
+	for _, target := range query.Targets {
+		metric := target.Target
+		rawKey := target.Payload.UploadKey
+		if prefix, rest, ok := strings.Cut(metric, ":"); ok {
+			rawKey, metric = prefix, rest
+		}
+		uploadKey, err := parseUploadKey(rawKey)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidUploadKey, fmt.Sprintf("target %q: %v", target.RefID, err))
+			return
+		}
+
+		points, err := grafanaDatapoints(uploadKey, metric)
+		if errors.Is(err, errUploadNotFound) {
+			writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
+		}
+
+		if !query.Range.From.IsZero() && !query.Range.To.IsZero() {
+			inRange := points[:0]
+			for _, p := range points {
+				if p[1] >= from && p[1] <= to {
+					inRange = append(inRange, p)
+				}
+			}
+			points = inRange
+		}
+
+		series = append(series, grafanaSeries{
+			Target:     uploadNameFromKey(uploadKey) + " " + metric,
+			Datapoints: downsamplePoints(points, query.MaxDataPoints),
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(series); err != nil {
+		log.Printf("failed to write grafana query response: %v", err)
+	}
+}
@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGrafanaQuery(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"epoch":1700000000000,"position":{"x":3,"y":4,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1000,"epoch":1700000001000,"position":{"x":3,"y":4,"z":2}}`,
+		`{"tsISO":"2023-11-14T22:13:20.5Z","bpm":72}`,
+	})
+
+	query := func(body string) (int, []grafanaSeries) {
+		t.Helper()
+		req := httptest.NewRequest("POST", "/api/grafana/query", strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		GrafanaQueryHandler(rec, req)
+		var series []grafanaSeries
+		json.Unmarshal(rec.Body.Bytes(), &series)
+		return rec.Code, series
+	}
+
+	code, series := query(`{
+		"range": {"from": "2023-11-14T22:00:00Z", "to": "2023-11-14T23:00:00Z"},
+		"targets": [
+			{"refId": "A", "target": "headset.position_magnitude", "payload": {"upload_key": "` + key + `"}},
+			{"refId": "B", "target": "` + key + `:headset.speed"},
+			{"refId": "C", "target": "heart_rate", "payload": {"upload_key": "` + key + `"}}
+		]
+	}`)
+	if code != 200 || len(series) != 3 {
+		t.Fatalf("query status = %d, series = %+v", code, series)
+	}
+	if got := series[0].Datapoints; len(got) != 2 || got[0] != [2]float64{5, 1700000000000} {
+		t.Fatalf("position magnitude = %v", got)
+	}
+	if got := series[1].Datapoints; len(got) != 1 || got[0] != [2]float64{2, 1700000001000} {
+		t.Fatalf("speed = %v", got)
+	}
+	if got := series[2].Datapoints; len(got) != 1 || got[0] != [2]float64{72, 1700000000500} {
+		t.Fatalf("heart rate = %v", got)
+	}
+
+	// points outside the dashboard range are dropped
+	_, series = query(`{
+		"range": {"from": "2023-11-14T22:13:20.5Z", "to": "2023-11-14T23:00:00Z"},
+		"targets": [{"target": "` + key + `:headset.position_magnitude"}]
+	}`)
+	if len(series) != 1 || len(series[0].Datapoints) != 1 {
+		t.Fatalf("range filtering failed: %+v", series)
+	}
+
+	if code, _ := query(`{"targets": [{"target": "` + key + `:headset.altitude"}]}`); code != 400 {
+		t.Fatalf("unknown metric status = %d, want 400", code)
+	}
+}
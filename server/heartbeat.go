@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// maxHeartbeatBodySize bounds the optional device status of a heartbeat.
+const maxHeartbeatBodySize = 4096
+
+// deviceStatus is what a headset reports about itself with a heartbeat.
+// Every field is optional.
+type deviceStatus struct {
+	Battery  *float64 `json:"battery,omitempty"` // percent
+	Charging *bool    `json:"charging,omitempty"`
+	FPS      *float64 `json:"fps,omitempty"`
+	Thermal  string   `json:"thermal,omitempty"` // e.g. nominal, fair, serious, critical
+}
+
+func (d deviceStatus) validate() error {
+	if d.Battery != nil && (*d.Battery < 0 || *d.Battery > 100 || math.IsNaN(*d.Battery)) {
+		return fmt.Errorf("invalid battery %v: must be a percentage", *d.Battery)
+	}
+	if d.FPS != nil && (*d.FPS < 0 || math.IsNaN(*d.FPS) || math.IsInf(*d.FPS, 0)) {
+		return fmt.Errorf("invalid fps %v: must be a non-negative number", *d.FPS)
+	}
+	if len(d.Thermal) > 32 {
+		return fmt.Errorf("invalid thermal: must be at most 32 characters")
+	}
+	return nil
+}
+
+// HeartbeatHandler lets a device report that its session is alive when it
+// has no tracker records to send, optionally with its battery, frame rate
+// and thermal state. The session is kept in the active-session registry.
+func HeartbeatHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	uploadKey, status, code, err := requestUploadKey(r)
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	if _, status, code, message := checkClientCert(r, uploadKey); status != 0 {
+		writeError(w, status, code, message)
+		return
+	}
+
+	defer r.Body.Close()
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxHeartbeatBodySize))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("error reading request body: %v", err))
+		return
+	}
+
+	var device *deviceStatus
+	if len(body) > 0 {
+		device = &deviceStatus{}
+		if err := json.Unmarshal(body, device); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid heartbeat JSON: %v", err))
+			return
+		}
+		if err := device.validate(); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+	}
+
+	receivedAt := time.Now().UTC()
+	touchSession(uploadKey, requestUserAgent(r), 0, receivedAt)
+	if device != nil {
+		setSessionDevice(uploadKey, *device, receivedAt)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"received_at": receivedAt.Format(time.RFC3339Nano),
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write heartbeat response: %v", err)
+	}
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postHeartbeat(t *testing.T, key, body string) int {
+	t.Helper()
+	req := withUploadKey(httptest.NewRequest("POST", "/api/heartbeat", strings.NewReader(body)), key)
+	req.Header.Set("User-Agent", "quest-browser")
+	rec := httptest.NewRecorder()
+	HeartbeatHandler(rec, req)
+	return rec.Code
+}
+
+func TestHeartbeatHandler(t *testing.T) {
+	chdirTemp(t)
+	activeSessionsMutex.Lock()
+	clear(activeSessions)
+	activeSessionsMutex.Unlock()
+
+	key := newTestUploadKey(t)
+	if code := postHeartbeat(t, key, ""); code != 200 {
+		t.Fatalf("empty heartbeat: status %d", code)
+	}
+	sessions := getActiveSessions(t)
+	if len(sessions) != 1 || sessions[0]["records"] != 0.0 || sessions[0]["user_agent"] != "quest-browser" || sessions[0]["device"] != nil {
+		t.Fatalf("sessions after empty heartbeat = %v", sessions)
+	}
+
+	if code := postHeartbeat(t, key, `{"battery":64.5,"charging":false,"fps":72,"thermal":"fair"}`); code != 200 {
+		t.Fatalf("heartbeat with device status: status %d", code)
+	}
+	device, _ := getActiveSessions(t)[0]["device"].(map[string]any)
+	if device["battery"] != 64.5 || device["charging"] != false || device["fps"] != 72.0 || device["thermal"] != "fair" {
+		t.Fatalf("device status = %v", device)
+	}
+
+	for _, body := range []string{`{"battery":140}`, `{"fps":-1}`, `not json`} {
+		if code := postHeartbeat(t, key, body); code != 400 {
+			t.Fatalf("heartbeat %s: status %d, want 400", body, code)
+		}
+	}
+	if code := postHeartbeat(t, "nope", ""); code != 400 {
+		t.Fatalf("heartbeat with invalid key: status %d", code)
+	}
+}
@@ -0,0 +1,173 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+)
+
+const (
+	defaultHeatmapCell = 0.1
+	maxHeatmapCells    = 1000
+	heatmapImageSize   = 512
+)
+
+type occupancyGrid struct {
+	Cell   float64 `json:"cell"`
+	MinX   float64 `json:"min_x"`
+	MinZ   float64 `json:"min_z"`
+	Cols   int     `json:"cols"`
+	Rows   int     `json:"rows"`
+	Max    int     `json:"max"`
+	Counts [][]int `json:"counts"`
+}
+
+// computeOccupancy bins the XZ (floor plane) positions of samples into square
+// cells of the given size. Row 0 holds the smallest Z.
+func computeOccupancy(samples []trackerSample, cell float64) (occupancyGrid, error) {
+	grid := occupancyGrid{Cell: cell, Counts: [][]int{}}
+	if len(samples) == 0 {
+		return grid, nil
+	}
+
+	minX, maxX := math.Inf(1), math.Inf(-1)
+	minZ, maxZ := math.Inf(1), math.Inf(-1)
+	for _, s := range samples {
+		minX, maxX = math.Min(minX, s.Position.X), math.Max(maxX, s.Position.X)
+		minZ, maxZ = math.Min(minZ, s.Position.Z), math.Max(maxZ, s.Position.Z)
+	}
+
+	grid.MinX = math.Floor(minX/cell) * cell
+	grid.MinZ = math.Floor(minZ/cell) * cell
+	// bounded as floats, which a tiny or NaN cell overflows as ints
+	cols, rows := (maxX-grid.MinX)/cell+1, (maxZ-grid.MinZ)/cell+1
+	if !(cols >= 1 && cols <= maxHeatmapCells && rows >= 1 && rows <= maxHeatmapCells) {
+		return occupancyGrid{}, fmt.Errorf("heatmap would be %.0fx%.0f cells, limit is %d per side: use a larger cell size", cols, rows, maxHeatmapCells)
+	}
+	grid.Cols, grid.Rows = int(cols), int(rows)
+
+	grid.Counts = make([][]int, grid.Rows)
+	for row := range grid.Counts {
+		grid.Counts[row] = make([]int, grid.Cols)
+	}
+	for _, s := range samples {
+		col := min(int((s.Position.X-grid.MinX)/cell), grid.Cols-1)
+		row := min(int((s.Position.Z-grid.MinZ)/cell), grid.Rows-1)
+		grid.Counts[row][col]++
+		grid.Max = max(grid.Max, grid.Counts[row][col])
+	}
+
+	return grid, nil
+}
+
+// heatColor maps v in [0, 1] onto a black-red-yellow-white ramp.
+func heatColor(v float64) color.RGBA {
+	channel := func(x float64) uint8 { return uint8(math.Round(255 * math.Max(0, math.Min(1, x)))) }
+	return color.RGBA{R: channel(3 * v), G: channel(3*v - 1), B: channel(3*v - 2), A: 255}
+}
+
+// render draws the grid with each cell as a square block, scaled so the
+// longer side is roughly heatmapImageSize pixels. Counts are log-scaled so
+// that briefly visited cells stay visible next to where the user stood.
+func (g occupancyGrid) render() image.Image {
+	px := max(1, heatmapImageSize/max(g.Cols, g.Rows, 1))
+	img := image.NewRGBA(image.Rect(0, 0, max(g.Cols, 1)*px, max(g.Rows, 1)*px))
+
+	for row, counts := range g.Counts {
+		for col, count := range counts {
+			v := 0.0
+			if g.Max > 0 {
+				v = math.Log1p(float64(count)) / math.Log1p(float64(g.Max))
+			}
+			c := heatColor(v)
+			// row 0 (smallest Z) at the top: seen from above, with the
+			// user's initial facing direction (-Z in WebXR) pointing up
+			y0 := row * px
+			for y := y0; y < y0+px; y++ {
+				for x := col * px; x < (col+1)*px; x++ {
+					img.SetRGBA(x, y, c)
+				}
+			}
+		}
+	}
+
+	return img
+}
+
+func HeatmapHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	cell, err := parsePositiveFloatParam(r, "cell", defaultHeatmapCell)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "png" {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("invalid format parameter %q: must be json or png", format))
+		return
+	}
+
+	tracker := r.URL.Query().Get("tracker")
+	if tracker == "" {
+		tracker = defaultTracker
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for heatmap: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	trackerSamples, ok := samples[tracker]
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, fmt.Sprintf("no samples for tracker %q", tracker))
+		return
+	}
+
+	grid, err := computeOccupancy(trackerSamples, cell)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	if format == "png" {
+		w.Header().Set("Content-Type", "image/png")
+		if err := png.Encode(w, grid.render()); err != nil {
+			log.Printf("failed to write heatmap image: %v", err)
+		}
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"tracker":     tracker,
+		"heatmap":     grid,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write heatmap response: %v", err)
+	}
+}
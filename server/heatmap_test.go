@@ -0,0 +1,80 @@
+package server
+
+import (
+	"encoding/json"
+	"image/png"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHeatmapHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0.05,"y":1.6,"z":0.05}}`,
+		`{"trackerKey":"headset","timestamp":10,"position":{"x":0.06,"y":1.6,"z":0.04}}`,
+		`{"trackerKey":"headset","timestamp":20,"position":{"x":0.25,"y":1.6,"z":0.15}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/heatmap?cell=0.1", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	HeatmapHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("heatmap status = %d body=%s", rec.Code, rec.Body.String())
+	}
+	var payload struct {
+		Heatmap occupancyGrid `json:"heatmap"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode heatmap response: %v", err)
+	}
+	grid := payload.Heatmap
+	if grid.Cols != 3 || grid.Rows != 2 {
+		t.Fatalf("grid size = %dx%d, want 3x2", grid.Cols, grid.Rows)
+	}
+	if grid.Counts[0][0] != 2 || grid.Counts[1][2] != 1 || grid.Max != 2 {
+		t.Fatalf("unexpected counts: %v", grid.Counts)
+	}
+
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/heatmap?cell=0.1&format=png", nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	HeatmapHandler(rec, req)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("heatmap png status = %d type=%s", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(rec.Body)
+	if err != nil {
+		t.Fatalf("decode png: %v", err)
+	}
+	if img.Bounds().Dx() != 3*170 {
+		t.Fatalf("png width = %d, want %d", img.Bounds().Dx(), 3*170)
+	}
+
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/heatmap?cell=0.0001", nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	HeatmapHandler(rec, req)
+	if rec.Code != 400 {
+		t.Fatalf("oversized heatmap status = %d, want 400", rec.Code)
+	}
+	for _, cell := range []string{"1e-300", "5e-324"} {
+		req = httptest.NewRequest("GET", "/api/uploads/"+key+"/heatmap?cell="+cell, nil)
+		req.SetPathValue("key", key)
+		rec = httptest.NewRecorder()
+		HeatmapHandler(rec, req)
+		if rec.Code != 400 {
+			t.Fatalf("heatmap with cell %s status = %d, want 400", cell, rec.Code)
+		}
+	}
+	samples := []trackerSample{{}, {}}
+	samples[1].Position.X = 1
+	for _, cell := range []float64{1e-300, math.NaN()} {
+		if _, err := computeOccupancy(samples, cell); err == nil {
+			t.Errorf("computeOccupancy with cell %v succeeded", cell)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"slices"
+	"strings"
+	"time"
+)
+
+// ID tokens are JWTs signed by the OIDC provider with one of the keys it
+// publishes as a JWK set. Only RS256 and ES256 are accepted, which every
+// provider offers.
+
+// jsonWebKey is a public key of a JWK set.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey decodes the key, returning nil for kinds that aren't used to
+// verify RS256 or ES256.
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	if k.Use != "" && k.Use != "sig" {
+		return nil, nil
+	}
+	decode := base64.RawURLEncoding.DecodeString
+	switch {
+	case k.Kty == "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, fmt.Errorf("invalid RSA modulus of key %q: %w", k.Kid, err)
+		}
+		e, err := decode(k.E)
+		if err != nil || len(e) > 4 {
+			return nil, fmt.Errorf("invalid RSA exponent of key %q", k.Kid)
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case k.Kty == "EC" && k.Crv == "P-256":
+		x, errX := decode(k.X)
+		y, errY := decode(k.Y)
+		if errX != nil || errY != nil {
+			return nil, fmt.Errorf("invalid EC point of key %q", k.Kid)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, fmt.Errorf("invalid EC point of key %q", k.Kid)
+		}
+		return key, nil
+	}
+	return nil, nil
+}
+
+// idTokenClaims are the claims of an ID token this server checks, and all
+// of them for role mapping.
+type idTokenClaims struct {
+	Issuer   string
+	Subject  string
+	Email    string
+	Nonce    string
+	Audience []string
+	Expires  time.Time
+	All      map[string]any
+}
+
+var errIDTokenInvalid = errors.New("invalid ID token")
+
+// parseIDToken verifies the signature of an ID token with the key it names
+// and returns its claims. keyByID returns nil for unknown key ids.
+func parseIDToken(token string, keyByID func(kid string) crypto.PublicKey) (idTokenClaims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return idTokenClaims{}, fmt.Errorf("%w: not a JWT", errIDTokenInvalid)
+	}
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := decodeJWTPart(parts[0], &header); err != nil {
+		return idTokenClaims{}, fmt.Errorf("%w: header: %v", errIDTokenInvalid, err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return idTokenClaims{}, fmt.Errorf("%w: signature: %v", errIDTokenInvalid, err)
+	}
+
+	key := keyByID(header.Kid)
+	if key == nil {
+		return idTokenClaims{}, fmt.Errorf("%w: unknown signing key %q", errIDTokenInvalid, header.Kid)
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if header.Alg != "RS256" || rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature) != nil {
+			return idTokenClaims{}, fmt.Errorf("%w: bad %s signature", errIDTokenInvalid, header.Alg)
+		}
+	case *ecdsa.PublicKey:
+		if header.Alg != "ES256" || len(signature) != 64 {
+			return idTokenClaims{}, fmt.Errorf("%w: bad %s signature", errIDTokenInvalid, header.Alg)
+		}
+		r, s := new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return idTokenClaims{}, fmt.Errorf("%w: bad %s signature", errIDTokenInvalid, header.Alg)
+		}
+	default:
+		return idTokenClaims{}, fmt.Errorf("%w: unsupported key type", errIDTokenInvalid)
+	}
+
+	var all map[string]any
+	if err := decodeJWTPart(parts[1], &all); err != nil {
+		return idTokenClaims{}, fmt.Errorf("%w: claims: %v", errIDTokenInvalid, err)
+	}
+	claims := idTokenClaims{All: all}
+	claims.Issuer, _ = all["iss"].(string)
+	claims.Subject, _ = all["sub"].(string)
+	claims.Email, _ = all["email"].(string)
+	claims.Nonce, _ = all["nonce"].(string)
+	switch aud := all["aud"].(type) {
+	case string:
+		claims.Audience = []string{aud}
+	case []any:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				claims.Audience = append(claims.Audience, s)
+			}
+		}
+	}
+	if exp, ok := all["exp"].(float64); ok {
+		claims.Expires = time.Unix(int64(exp), 0)
+	}
+	return claims, nil
+}
+
+// check validates the claims of an ID token issued to clientID for a login
+// that used nonce.
+func (c idTokenClaims) check(issuer, clientID, nonce string, now time.Time) error {
+	switch {
+	case c.Issuer != issuer:
+		return fmt.Errorf("%w: issued by %q, want %q", errIDTokenInvalid, c.Issuer, issuer)
+	case !slices.Contains(c.Audience, clientID):
+		return fmt.Errorf("%w: not issued to this client", errIDTokenInvalid)
+	case c.Expires.IsZero() || now.After(c.Expires.Add(time.Minute)):
+		return fmt.Errorf("%w: expired", errIDTokenInvalid)
+	case c.Nonce != nonce:
+		return fmt.Errorf("%w: nonce mismatch", errIDTokenInvalid)
+	case c.Subject == "":
+		return fmt.Errorf("%w: no subject", errIDTokenInvalid)
+	}
+	return nil
+}
+
+func decodeJWTPart(part string, v any) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
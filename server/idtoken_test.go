@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+	"time"
+)
+
+func TestParseIDToken(t *testing.T) {
+	provider := newFakeOIDCProvider(t)
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	now := time.Now()
+	token := provider.sign(t, map[string]any{"iss": "https://idp", "aud": []string{"hrdemo", "x"}, "sub": "alice", "nonce": "n", "exp": now.Add(time.Hour).Unix()})
+	claims, err := parseIDToken(token, func(kid string) crypto.PublicKey { return &provider.key.PublicKey })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := claims.check("https://idp", "hrdemo", "n", now); err != nil {
+		t.Fatal(err)
+	}
+	for name, err := range map[string]error{
+		"issuer":  claims.check("https://other", "hrdemo", "n", now),
+		"client":  claims.check("https://idp", "other", "n", now),
+		"nonce":   claims.check("https://idp", "hrdemo", "m", now),
+		"expired": claims.check("https://idp", "hrdemo", "n", now.Add(2*time.Hour)),
+	} {
+		if err == nil {
+			t.Errorf("%s check passed", name)
+		}
+	}
+
+	if _, err := parseIDToken(token, func(kid string) crypto.PublicKey { return &other.PublicKey }); err == nil {
+		t.Fatal("token verified with the wrong key")
+	}
+	if _, err := parseIDToken(token, func(kid string) crypto.PublicKey { return nil }); err == nil {
+		t.Fatal("token verified without a key")
+	}
+}
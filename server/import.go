@@ -0,0 +1,468 @@
+package server
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// maxImportBytes bounds the size of an import request body.
+const maxImportBytes = 1 << 30
+
+var errInvalidImport = errors.New("invalid import")
+
+type importResult struct {
+	UploadKey         string `json:"upload_key"`
+	UploadName        string `json:"upload_name"`
+	OriginalUploadKey string `json:"original_upload_key,omitempty"`
+	Records           int    `json:"records"`
+	Annotations       bool   `json:"annotations"`
+}
+
+// maxImportKeyClaims bounds how often importKey tries to claim a key.
+const maxImportKeyClaims = 5
+
+// importKey decides which key an imported session is stored under: its
+// original key, unless that is missing, malformed, already taken on this
+// server or known to its key store (handed out here, even if nothing was
+// uploaded with it yet, or revoked here, as erased uploads' keys are), or
+// forceNew is set, in which case a fresh key is minted. The key is claimed by creating its
+// upload file empty, so that concurrent imports of the same session never
+// get the same key; the import then moves its file over the empty one, or
+// removes it with releaseImportKey if it fails.
+func importKey(originalKey string, forceNew bool) (string, error) {
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return "", fmt.Errorf("create upload directory: %w", err)
+	}
+	for range maxImportKeyClaims {
+		uploadKey, err := parseUploadKey(originalKey)
+		if forceNew || err != nil || issuedUploadKey(uploadKey) {
+			if uploadKey, err = generateUploadKey(); err != nil {
+				return "", err
+			}
+		}
+		file, err := os.OpenFile(uploadFilePath(uploadKey), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+		if errors.Is(err, fs.ErrExist) {
+			forceNew = true
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("create import file: %w", err)
+		}
+		file.Close()
+		return uploadKey, nil
+	}
+	return "", errors.New("no free upload key to import into")
+}
+
+// issuedUploadKey reports whether the key store knows uploadKey: whoever it
+// was handed out to here may still upload with it, so an import must not
+// take it over.
+func issuedUploadKey(uploadKey string) bool {
+	_, ok := uploadKeys.lookup(uploadKey)
+	return ok
+}
+
+// releaseImportKey removes the empty upload file claiming a key for an
+// import that failed.
+func releaseImportKey(uploadKey string) {
+	filePath := uploadFilePath(uploadKey)
+	if info, err := os.Stat(filePath); err == nil && info.Size() == 0 {
+		os.Remove(filePath)
+	}
+}
+
+// writeFileAtomic writes data to a temporary file next to filePath and moves
+// it into place, so a failed import never leaves a partial upload behind.
+// Every call has its own temporary file, so concurrent imports of the same
+// session don't write into each other's.
+func writeFileAtomic(filePath string, fill func(w *bufio.Writer) error) error {
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return fmt.Errorf("create upload directory: %w", err)
+	}
+
+	file, err := os.CreateTemp(filepath.Dir(filePath), filepath.Base(filePath)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("create import file: %w", err)
+	}
+	tmpPath := file.Name()
+	if err := file.Chmod(0o644); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("create import file: %w", err)
+	}
+	writer := bufio.NewWriter(file)
+	err = fill(writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	return nil
+}
+
+// importStoredSession restores a session in the stored file format: a
+// metadata line followed by record lines of either format version. The records are kept
+// verbatim; only the key and name in the metadata are rewritten if a new key
+// was minted. If it fails after the session was stored, the result is
+// returned with the error.
+func importStoredSession(data io.Reader, annotations []byte, forceNew bool) (importResult, error) {
+	if len(annotations) > 0 && !json.Valid(annotations) {
+		return importResult{}, fmt.Errorf("%w: malformed annotations file", errInvalidImport)
+	}
+
+	scanner := bufio.NewScanner(data)
+	scanner.Buffer(make([]byte, 0, 1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		if err := scanner.Err(); err != nil {
+			return importResult{}, err
+		}
+		return importResult{}, fmt.Errorf("%w: empty session file", errInvalidImport)
+	}
+	var metadata map[string]any
+	if err := json.Unmarshal(scanner.Bytes(), &metadata); err != nil {
+		return importResult{}, fmt.Errorf("%w: first line is not a metadata object", errInvalidImport)
+	}
+	originalKey, _ := metadata["upload_key"].(string)
+
+	version := formatV1
+	if v, ok := metadata["format_version"].(float64); ok {
+		version = int(v)
+	}
+	if version != formatV1 && version != formatV2 {
+		return importResult{}, fmt.Errorf("%w: unsupported format version %v", errInvalidImport, metadata["format_version"])
+	}
+
+	uploadKey, err := importKey(originalKey, forceNew)
+	if err != nil {
+		return importResult{}, err
+	}
+	metadata["upload_key"] = uploadKey
+	metadata["upload_name"] = uploadNameFromKey(uploadKey)
+	metadata["imported_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+
+	result := importResult{UploadKey: uploadKey, UploadName: uploadNameFromKey(uploadKey)}
+	if uploadKey != strings.ToLower(originalKey) {
+		result.OriginalUploadKey = originalKey
+	}
+
+	encrypted := metadata["encryption"] != nil
+	err = writeFileAtomic(uploadFilePath(uploadKey), func(w *bufio.Writer) error {
+		metadataJSON, err := json.Marshal(metadata)
+		if err != nil {
+			return fmt.Errorf("encode metadata: %w", err)
+		}
+		w.Write(metadataJSON)
+		w.WriteByte('\n')
+
+		for scanner.Scan() {
+			line := bytes.TrimSpace(scanner.Bytes())
+			if len(line) == 0 {
+				continue
+			}
+			if record, err := parseRecordLine(line, version); err != nil || !validPayload(record.Payload, encrypted) {
+				return fmt.Errorf("%w: malformed record line %d", errInvalidImport, result.Records+2)
+			}
+			w.Write(line)
+			if err := w.WriteByte('\n'); err != nil {
+				return err
+			}
+			result.Records++
+		}
+		return scanner.Err()
+	})
+	if err != nil {
+		releaseImportKey(uploadKey)
+		return importResult{}, err
+	}
+
+	forgetQuotaUsage()
+	if _, err := registerUploadKey(uploadKey); err != nil {
+		return result, err
+	}
+	if err := rebuildRecordIndex(uploadFilePath(uploadKey)); err != nil {
+		return result, fmt.Errorf("build record index: %w", err)
+	}
+	refreshUploadChecksum(uploadFilePath(uploadKey))
+
+	if len(annotations) > 0 {
+		err := writeFileAtomic(annotationsFilePath(uploadKey), func(w *bufio.Writer) error {
+			_, err := w.Write(annotations)
+			return err
+		})
+		if err != nil {
+			return result, err
+		}
+		result.Annotations = true
+	}
+	return result, nil
+}
+
+// importNDJSON restores a session from an NDJSON export. Exports carry no key
+// or metadata, so a new key is always minted and records are renumbered.
+func importNDJSON(data io.Reader, userAgent string) (importResult, error) {
+	var lines []string
+	scanner := bufio.NewScanner(data)
+	scanner.Buffer(make([]byte, 0, 1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if !json.Valid([]byte(line)) {
+			return importResult{}, fmt.Errorf("%w: malformed NDJSON line %d", errInvalidImport, len(lines)+1)
+		}
+		lines = append(lines, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return importResult{}, err
+	}
+	if len(lines) == 0 {
+		return importResult{}, fmt.Errorf("%w: no records", errInvalidImport)
+	}
+
+	uploadKey, err := generateUploadKey()
+	if err != nil {
+		return importResult{}, err
+	}
+	if _, err := saveUpload(uploadKey, userAgent, recordColumns{ReceivedAt: time.Now().UTC()}, lines, nil); err != nil {
+		return importResult{}, err
+	}
+
+	forgetQuotaUsage()
+	if _, err := registerUploadKey(uploadKey); err != nil {
+		return importResult{}, err
+	}
+	return importResult{UploadKey: uploadKey, UploadName: uploadNameFromKey(uploadKey), Records: len(lines)}, nil
+}
+
+// importArchive restores every session of a zip produced by ArchiveHandler,
+// together with its annotations. If a session fails, the sessions imported
+// before it are returned with the error, as they stay imported.
+func importArchive(file *os.File, size int64, forceNew bool) ([]importResult, error) {
+	archive, err := zip.NewReader(file, size)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errInvalidImport, err)
+	}
+
+	entries := map[string]*zip.File{}
+	for _, entry := range archive.File {
+		entries[path.Base(entry.Name)] = entry
+	}
+
+	readEntry := func(entry *zip.File) ([]byte, error) {
+		rc, err := entry.Open()
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errInvalidImport, err)
+		}
+		defer rc.Close()
+		// entries are compressed, so the size of the body doesn't bound them
+		data, err := io.ReadAll(io.LimitReader(rc, maxImportBytes+1))
+		if err == nil && len(data) > maxImportBytes {
+			err = fmt.Errorf("%w: %s is larger than %d bytes", errInvalidImport, entry.Name, maxImportBytes)
+		}
+		return data, err
+	}
+
+	// check every session against the manifest before importing any, so a
+	// corrupted archive is refused as a whole
+	if manifestEntry, ok := entries["manifest.json"]; ok {
+		data, err := readEntry(manifestEntry)
+		if err != nil {
+			return nil, err
+		}
+		var manifest struct {
+			Uploads []archiveManifestEntry `json:"uploads"`
+		}
+		if err := json.Unmarshal(data, &manifest); err != nil {
+			return nil, fmt.Errorf("%w: malformed manifest.json: %v", errInvalidImport, err)
+		}
+		for _, upload := range manifest.Uploads {
+			entry, ok := entries[upload.File]
+			if !ok || upload.Checksum == "" {
+				continue
+			}
+			rc, err := entry.Open()
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v", errInvalidImport, err)
+			}
+			err = verifyChecksum(upload.Checksum, rc)
+			rc.Close()
+			if err != nil && !errors.Is(err, errChecksumMismatch) {
+				err = fmt.Errorf("%w: %v", errInvalidImport, err)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", entry.Name, err)
+			}
+		}
+	}
+
+	var results []importResult
+	for _, entry := range archive.File {
+		if !strings.HasSuffix(entry.Name, ".csv") {
+			continue
+		}
+
+		var annotations []byte
+		if sidecar, ok := entries[strings.TrimSuffix(path.Base(entry.Name), ".csv")+".annotations.json"]; ok {
+			if annotations, err = readEntry(sidecar); err != nil {
+				return results, err
+			}
+		}
+
+		rc, err := entry.Open()
+		if err != nil {
+			return results, fmt.Errorf("%w: %v", errInvalidImport, err)
+		}
+		result, err := importStoredSession(rc, annotations, forceNew)
+		rc.Close()
+		if result.UploadKey != "" {
+			results = append(results, result)
+		}
+		if err != nil {
+			return results, fmt.Errorf("%s: %w", entry.Name, err)
+		}
+	}
+
+	if len(results) == 0 {
+		return nil, fmt.Errorf("%w: archive contains no sessions", errInvalidImport)
+	}
+	return results, nil
+}
+
+// ImportHandler restores sessions exported from another server. The body is
+// a zip archive from /api/export/archive, a stored session file, or an NDJSON
+// export. Sessions keep their original key unless it is already in use here
+// or new_key=1 is given; the response maps original keys to the stored ones.
+// Sessions of an archive are checked against the checksums in its manifest,
+// and a body sent with an X-Upload-Checksum header, such as a session file
+// with the ETag its status had, against that. If an archive fails partway,
+// the error response also maps the sessions imported before the failure.
+func ImportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	forceNew := r.URL.Query().Get("new_key") == "1"
+
+	// buffer the body on disk, since zip archives need random access
+	tmp, err := os.CreateTemp("", "import-*")
+	if err != nil {
+		log.Printf("failed to create import buffer: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to buffer import")
+		return
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	size, err := io.Copy(tmp, http.MaxBytesReader(w, r.Body, maxImportBytes))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("failed to read import body: %v", err))
+		return
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		log.Printf("failed to rewind import buffer: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to buffer import")
+		return
+	}
+
+	if expected := r.Header.Get(checksumHeader); expected != "" {
+		if _, err := parseChecksum(expected); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("invalid %s header: %v", checksumHeader, err))
+			return
+		}
+		if err := verifyChecksum(expected, tmp); errors.Is(err, errChecksumMismatch) {
+			writeError(w, http.StatusBadRequest, errCodeChecksumMismatch, err.Error())
+			return
+		} else if err != nil {
+			log.Printf("failed to checksum import: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to buffer import")
+			return
+		}
+		tmp.Seek(0, io.SeekStart)
+	}
+
+	head := make([]byte, 4)
+	n, _ := io.ReadFull(tmp, head)
+	head = head[:n]
+	tmp.Seek(0, io.SeekStart)
+
+	var results []importResult
+	switch {
+	case bytes.Equal(head, []byte("PK\x03\x04")):
+		results, err = importArchive(tmp, size, forceNew)
+	default:
+		firstLine, _ := bufio.NewReader(io.LimitReader(tmp, 1<<20)).ReadBytes('\n')
+		tmp.Seek(0, io.SeekStart)
+		var metadata struct {
+			UploadKey *string `json:"upload_key"`
+		}
+		if json.Unmarshal(firstLine, &metadata) == nil && metadata.UploadKey != nil {
+			var result importResult
+			result, err = importStoredSession(tmp, nil, forceNew)
+			results = append(results, result)
+		} else {
+			var result importResult
+			result, err = importNDJSON(tmp, r.UserAgent())
+			results = append(results, result)
+		}
+	}
+
+	var imported []importResult
+	for _, result := range results {
+		if result.UploadKey != "" {
+			log.Printf("upload imported upload_name=%q records=%d", result.UploadName, result.Records)
+			imported = append(imported, result)
+		}
+	}
+	// sessions stored before a failure stay stored, so the error reports
+	// their keys too
+	var done map[string]any
+	if len(imported) > 0 {
+		done = map[string]any{"uploads": imported}
+	}
+	if errors.Is(err, errChecksumMismatch) {
+		writeErrorWith(w, http.StatusBadRequest, errCodeChecksumMismatch, err.Error(), done)
+		return
+	}
+	if errors.Is(err, errInvalidImport) {
+		writeErrorWith(w, http.StatusBadRequest, errCodeInvalidBody, err.Error(), done)
+		return
+	}
+	if err != nil {
+		log.Printf("failed to import upload: %v", err)
+		writeErrorWith(w, http.StatusInternalServerError, errCodeInternal, "failed to import upload", done)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":  "ok",
+		"uploads": results,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write import response: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func postImport(t *testing.T, query string, body []byte) (int, []importResult) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/import"+query, bytes.NewReader(body))
+	rec := httptest.NewRecorder()
+	ImportHandler(rec, req)
+	var payload struct {
+		Uploads []importResult `json:"uploads"`
+	}
+	json.Unmarshal(rec.Body.Bytes(), &payload)
+	return rec.Code, payload.Uploads
+}
+
+func TestImportArchive(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":100,"position":{"x":1,"y":0,"z":0}}`,
+	})
+	if code := postAnnotation(t, key, `{"label":"tutorial","start":0,"end":50}`); code != 201 {
+		t.Fatalf("post annotation status = %d", code)
+	}
+
+	req := httptest.NewRequest("POST", "/api/export/archive", strings.NewReader(`{"keys":["`+key+`"]}`))
+	rec := httptest.NewRecorder()
+	ArchiveHandler(rec, req)
+	archive := rec.Body.Bytes()
+
+	original, err := os.ReadFile(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// a fresh server keeps the original key
+	if err := os.RemoveAll(uploadDir); err != nil {
+		t.Fatal(err)
+	}
+	code, results := postImport(t, "", archive)
+	if code != 200 || len(results) != 1 {
+		t.Fatalf("import status = %d, results = %+v", code, results)
+	}
+	if results[0].UploadKey != key || results[0].OriginalUploadKey != "" || results[0].Records != 2 || !results[0].Annotations {
+		t.Fatalf("unexpected import result: %+v", results[0])
+	}
+	imported, err := os.ReadFile(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, originalRecords, _ := bytes.Cut(original, []byte("\n"))
+	_, importedRecords, _ := bytes.Cut(imported, []byte("\n"))
+	if !bytes.Equal(originalRecords, importedRecords) {
+		t.Fatalf("imported records differ:\n%s\nwant:\n%s", importedRecords, originalRecords)
+	}
+	if annotations, err := loadAnnotations(key); err != nil || len(annotations) != 1 {
+		t.Fatalf("annotations not restored: %v %+v", err, annotations)
+	}
+	if index, err := readRecordIndex(uploadFilePath(key)); err != nil || len(index) != 2 {
+		t.Fatalf("record index of the import = %+v, %v", index, err)
+	}
+	if leftovers, _ := filepath.Glob(filepath.Join(uploadDir, "*.tmp")); len(leftovers) > 0 {
+		t.Fatalf("import left %v behind", leftovers)
+	}
+
+	// importing again mints a new key since the original is taken
+	code, results = postImport(t, "", archive)
+	if code != 200 || len(results) != 1 || results[0].UploadKey == key || results[0].OriginalUploadKey != key {
+		t.Fatalf("re-import status = %d, results = %+v", code, results)
+	}
+	metadata, err := readUploadMetadata(uploadFilePath(results[0].UploadKey))
+	if err != nil || metadata.UploadKey != results[0].UploadKey || metadata.UploadName != results[0].UploadName {
+		t.Fatalf("metadata not rewritten for new key: %v %+v", err, metadata)
+	}
+
+	// an erased session doesn't come back under its key
+	erase(t, `{"upload_key":"`+key+`"}`)
+	code, results = postImport(t, "", archive)
+	if code != 200 || len(results) != 1 || results[0].UploadKey == key || results[0].OriginalUploadKey != key {
+		t.Fatalf("import of an erased session status = %d, results = %+v", code, results)
+	}
+	if _, err := os.Stat(uploadFilePath(key)); !os.IsNotExist(err) {
+		t.Fatalf("erased session restored under its key: %v", err)
+	}
+}
+
+func TestImportIssuedKey(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`})
+	stored, err := os.ReadFile(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Remove(uploadFilePath(key)); err != nil {
+		t.Fatal(err)
+	}
+
+	// handed out here but not uploaded with yet: the import mustn't take
+	// the session of whoever has the key
+	if _, err := registerUploadKey(key); err != nil {
+		t.Fatal(err)
+	}
+	code, results := postImport(t, "", stored)
+	if code != 200 || len(results) != 1 || results[0].UploadKey == key || results[0].OriginalUploadKey != key {
+		t.Fatalf("import of an issued key status = %d, results = %+v", code, results)
+	}
+	if _, err := os.Stat(uploadFilePath(key)); !os.IsNotExist(err) {
+		t.Fatalf("import stored under the issued key: %v", err)
+	}
+}
+
+func TestImportArchivePartial(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`})
+	stored, err := os.ReadFile(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, entry := range []struct {
+		name string
+		data []byte
+	}{{"a.csv", stored}, {"b.csv", []byte("not a session\n")}} {
+		w, err := zw.Create(entry.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(entry.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// a.csv is imported before b.csv fails, and stays imported
+	req := httptest.NewRequest("POST", "/api/import?new_key=1", bytes.NewReader(archive.Bytes()))
+	rec := httptest.NewRecorder()
+	ImportHandler(rec, req)
+	var response struct {
+		Error   apiError       `json:"error"`
+		Uploads []importResult `json:"uploads"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != 400 || response.Error.Code != errCodeInvalidBody || len(response.Uploads) != 1 || response.Uploads[0].OriginalUploadKey != key {
+		t.Fatalf("partial import status = %d: %s", rec.Code, rec.Body)
+	}
+	if _, _, records := readUploadFile(t, uploadFilePath(response.Uploads[0].UploadKey)); len(records) != 1 {
+		t.Fatalf("partially imported session has %d records", len(records))
+	}
+}
+
+func TestImportSessionFiles(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`})
+	stored, err := os.ReadFile(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	code, results := postImport(t, "?new_key=1", stored)
+	if code != 200 || len(results) != 1 || results[0].UploadKey == key || results[0].Records != 1 {
+		t.Fatalf("stored file import status = %d, results = %+v", code, results)
+	}
+
+	ndjson := []byte(`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}` + "\n" +
+		`{"trackerKey":"headset","timestamp":10,"position":{"x":1,"y":0,"z":0}}` + "\n")
+	code, results = postImport(t, "", ndjson)
+	if code != 200 || len(results) != 1 || results[0].Records != 2 {
+		t.Fatalf("ndjson import status = %d, results = %+v", code, results)
+	}
+	samples, err := readTrackerSamples(results[0].UploadKey)
+	if err != nil || len(samples["headset"]) != 2 {
+		t.Fatalf("ndjson import not readable: %v %+v", err, samples)
+	}
+
+	if code, _ := postImport(t, "", []byte("not json\n")); code != 400 {
+		t.Fatalf("malformed import status = %d, want 400", code)
+	}
+}
+
+func TestImportConcurrent(t *testing.T) {
+	chdirTemp(t)
+	procs := runtime.GOMAXPROCS(8)
+	t.Cleanup(func() { runtime.GOMAXPROCS(procs) })
+	key := newTestUploadKey(t)
+	// long enough for the imports to overlap
+	lines := make([]string, 5000)
+	for i := range lines {
+		lines[i] = fmt.Sprintf(`{"trackerKey":"headset","timestamp":%d,"position":{"x":0,"y":0,"z":0}}`, i*10)
+	}
+	simulateUpload(t, key, lines)
+	stored, err := os.ReadFile(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the session is restored on a server that doesn't have it yet
+	if err := os.Remove(uploadFilePath(key)); err != nil {
+		t.Fatal(err)
+	}
+
+	keys := make([]string, 10)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			code, results := postImport(t, "", stored)
+			if code != 200 || len(results) != 1 {
+				t.Errorf("import status = %d, results = %+v", code, results)
+				return
+			}
+			keys[i] = results[0].UploadKey
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, imported := range keys {
+		if seen[imported] {
+			t.Fatalf("imports share key %s: %q", imported, keys)
+		}
+		seen[imported] = true
+		if _, _, records := readUploadFile(t, uploadFilePath(imported)); len(records) != len(lines) {
+			t.Fatalf("import %s has %d records", imported, len(records))
+		}
+	}
+	if !seen[key] {
+		t.Fatalf("no import kept the original key: %q", keys)
+	}
+}
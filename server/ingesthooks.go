@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Record is an uploaded record as ingest hooks see it.
+type Record struct {
+	// Payload is the record's JSON, with timestamps already converted to
+	// seconds. It is what gets stored, so hooks enrich a record by changing
+	// it.
+	Payload json.RawMessage
+
+	// ReceivedAt and DeviceID describe the batch the record came in with.
+	// They are for information only: changes to them are ignored.
+	ReceivedAt time.Time
+	DeviceID   string
+}
+
+// IngestHook is called with every record of an uploaded batch before it is
+// stored and returns the record to store in its place. Returning
+// ErrDropRecord drops the record; any other error refuses the whole batch,
+// with the error message sent back to the client.
+type IngestHook func(ctx context.Context, uploadKey string, record Record) (Record, error)
+
+// ErrDropRecord is returned by an IngestHook to leave a record out.
+var ErrDropRecord = errors.New("drop record")
+
+// errRecordRejected wraps the error of a hook that refused a batch.
+var errRecordRejected = errors.New("record rejected")
+
+var (
+	ingestHooks      []IngestHook
+	ingestHooksMutex sync.Mutex
+)
+
+// RegisterIngestHook adds a hook that every ingested record passes through,
+// so that deployments can drop, enrich or copy records elsewhere without
+// changing the upload handlers. Hooks run in the order they were registered,
+// each on the record the previous one returned, after timestamps are
+// checked, duplicates dropped and the timestamp order enforced. Encrypted
+// batches don't pass through hooks, as their records can't be read.
+// Register hooks before the server starts.
+func RegisterIngestHook(hook IngestHook) {
+	ingestHooksMutex.Lock()
+	defer ingestHooksMutex.Unlock()
+	ingestHooks = append(ingestHooks, hook)
+}
+
+// runIngestHooks passes lines through the registered hooks and returns the
+// lines to store and how many were dropped.
+func runIngestHooks(ctx context.Context, uploadKey string, columns recordColumns, lines []string) ([]string, int, error) {
+	ingestHooksMutex.Lock()
+	hooks := ingestHooks
+	ingestHooksMutex.Unlock()
+	if len(hooks) == 0 {
+		return lines, 0, nil
+	}
+
+	kept := make([]string, 0, len(lines))
+	dropped := 0
+records:
+	for i, line := range lines {
+		record := Record{Payload: json.RawMessage(line), ReceivedAt: columns.ReceivedAt, DeviceID: columns.DeviceID}
+		for _, hook := range hooks {
+			var err error
+			record, err = hook(ctx, uploadKey, record)
+			if errors.Is(err, ErrDropRecord) {
+				dropped++
+				continue records
+			}
+			if err != nil {
+				return nil, 0, fmt.Errorf("%w: record %d: %v", errRecordRejected, i+1, err)
+			}
+		}
+		// stored records are one line each
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, record.Payload); err != nil {
+			return nil, 0, fmt.Errorf("ingest hook returned invalid JSON for record %d: %w", i+1, err)
+		}
+		kept = append(kept, compact.String())
+	}
+	return kept, dropped, nil
+}
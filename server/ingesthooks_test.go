@@ -0,0 +1,72 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// setTestIngestHooks replaces the ingest hooks for one test.
+func setTestIngestHooks(t *testing.T, hooks ...IngestHook) {
+	t.Helper()
+	saved := ingestHooks
+	ingestHooks = nil
+	for _, hook := range hooks {
+		RegisterIngestHook(hook)
+	}
+	t.Cleanup(func() { ingestHooks = saved })
+}
+
+func TestIngestHooks(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	var seenKey string
+	setTestIngestHooks(t,
+		func(_ context.Context, uploadKey string, record Record) (Record, error) {
+			seenKey = uploadKey
+			var fields map[string]any
+			json.Unmarshal(record.Payload, &fields)
+			if bpm, ok := fields["bpm"].(float64); ok && bpm <= 0 {
+				return record, ErrDropRecord
+			}
+			if fields["bpm"] == "reject" {
+				return record, errors.New("unreadable heart rate")
+			}
+			return record, nil
+		},
+		// enrichment, pretty-printed to check records stay on one line
+		func(_ context.Context, _ string, record Record) (Record, error) {
+			var fields map[string]any
+			json.Unmarshal(record.Payload, &fields)
+			fields["participant_id"] = "p-07"
+			record.Payload, _ = json.MarshalIndent(fields, "", "  ")
+			return record, nil
+		},
+	)
+
+	rec := httptest.NewRecorder()
+	UploadHandler(rec, withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader("{\"bpm\":70}\n{\"bpm\":0}\n{\"bpm\":72}")), key))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"hooks_dropped":1`) {
+		t.Fatalf("upload: status %d, body %s", rec.Code, rec.Body)
+	}
+	if seenKey != key {
+		t.Fatal("hook wasn't given the upload key")
+	}
+	_, _, lines := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, lines, []string{`{"bpm":70,"participant_id":"p-07"}`, `{"bpm":72,"participant_id":"p-07"}`})
+
+	rec = httptest.NewRecorder()
+	UploadHandler(rec, withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader("{\"bpm\":73}\n{\"bpm\":\"reject\"}")), key))
+	var response errorResponse
+	json.NewDecoder(rec.Body).Decode(&response)
+	if rec.Code != 422 || response.Error.Code != errCodeRecordRejected || !strings.Contains(response.Error.Message, "record 2: unreadable heart rate") {
+		t.Fatalf("rejected upload: status %d, error %+v", rec.Code, response.Error)
+	}
+	if _, _, lines := readUploadFile(t, uploadFilePath(key)); len(lines) != 2 {
+		t.Fatalf("rejected batch stored: %v", lines)
+	}
+}
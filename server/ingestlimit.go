@@ -0,0 +1,106 @@
+package server
+
+import (
+	"expvar"
+	"fmt"
+	"math/rand/v2"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// When many headsets reconnect at once, e.g. after a Wi-Fi outage, each
+// sends its backlog at the same time. Upload handlers are limited to
+// ingestSlots running at once, with up to cap(ingestQueue) more waiting
+// for a slot; the rest are refused with 503 and a Retry-After spread over a
+// few seconds, so the retries don't arrive together again.
+var (
+	ingestSlots chan struct{} // nil for no limit
+	ingestQueue chan struct{}
+
+	uploadsInFlight     = expvar.NewInt("uploads_in_flight")
+	uploadsQueued       = expvar.NewInt("uploads_queued")
+	uploadsRefusedBusy  = expvar.NewInt("uploads_refused_busy")
+	uploadsQueueTimeout = expvar.NewInt("uploads_queue_timeouts")
+)
+
+const (
+	// maxIngestQueueWait is how long an upload waits for a slot before it is
+	// refused after all.
+	maxIngestQueueWait = 10 * time.Second
+	// maxIngestRetryAfter is the longest Retry-After given to refused
+	// uploads, in seconds.
+	maxIngestRetryAfter = 5
+)
+
+// SetIngestConcurrency limits uploads to limit handled at once, with up to
+// queue more waiting for their turn. A zero limit disables it. It must be
+// called before the server starts handling requests.
+func SetIngestConcurrency(limit, queue int) error {
+	if limit < 0 {
+		return fmt.Errorf("invalid upload concurrency %d: must not be negative", limit)
+	}
+	if queue < 0 {
+		return fmt.Errorf("invalid upload queue length %d: must not be negative", queue)
+	}
+	if limit == 0 {
+		ingestSlots, ingestQueue = nil, nil
+		return nil
+	}
+	ingestSlots, ingestQueue = make(chan struct{}, limit), make(chan struct{}, queue)
+	return nil
+}
+
+// limitIngest runs handler once a slot is free, waiting in the queue if
+// there is room in it.
+func limitIngest(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slots, queue := ingestSlots, ingestQueue
+		if slots == nil {
+			handler(w, r)
+			return
+		}
+
+		select {
+		case slots <- struct{}{}:
+		default:
+			select {
+			case queue <- struct{}{}:
+			default:
+				uploadsRefusedBusy.Add(1)
+				refuseBusyUpload(w)
+				return
+			}
+			uploadsQueued.Add(1)
+			timer := time.NewTimer(maxIngestQueueWait)
+			select {
+			case slots <- struct{}{}:
+				timer.Stop()
+				<-queue
+				uploadsQueued.Add(-1)
+			case <-timer.C:
+				<-queue
+				uploadsQueued.Add(-1)
+				uploadsQueueTimeout.Add(1)
+				refuseBusyUpload(w)
+				return
+			case <-r.Context().Done():
+				// the client gave up
+				timer.Stop()
+				<-queue
+				uploadsQueued.Add(-1)
+				return
+			}
+		}
+		defer func() { <-slots }()
+
+		uploadsInFlight.Add(1)
+		defer uploadsInFlight.Add(-1)
+		handler(w, r)
+	}
+}
+
+func refuseBusyUpload(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", strconv.Itoa(1+rand.N(maxIngestRetryAfter)))
+	writeError(w, http.StatusServiceUnavailable, errCodeServerBusy, "too many uploads at once: retry later")
+}
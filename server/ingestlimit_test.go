@@ -0,0 +1,66 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLimitIngest(t *testing.T) {
+	defer SetIngestConcurrency(0, 0)
+	if err := SetIngestConcurrency(1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := limitIngest(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusNoContent)
+	})
+	upload := func() chan int {
+		code := make(chan int, 1)
+		go func() {
+			rec := httptest.NewRecorder()
+			handler(rec, httptest.NewRequest("POST", "/api/upload", nil))
+			code <- rec.Code
+		}()
+		return code
+	}
+
+	first := upload()
+	<-started
+	second := upload()
+	for uploadsQueued.Value() != 1 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// no slot and no room in the queue
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("POST", "/api/upload", nil))
+	retryAfter, err := strconv.Atoi(rec.Header().Get("Retry-After"))
+	if rec.Code != http.StatusServiceUnavailable || err != nil || retryAfter < 1 || retryAfter > maxIngestRetryAfter {
+		t.Fatalf("saturated upload: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	release <- struct{}{}
+	if code := <-first; code != http.StatusNoContent {
+		t.Fatalf("first upload: status %d", code)
+	}
+	// the queued upload gets the slot
+	<-started
+	release <- struct{}{}
+	if code := <-second; code != http.StatusNoContent {
+		t.Fatalf("queued upload: status %d", code)
+	}
+	if uploadsInFlight.Value() != 0 || uploadsQueued.Value() != 0 {
+		t.Fatalf("in flight %d, queued %d after uploads", uploadsInFlight.Value(), uploadsQueued.Value())
+	}
+
+	if SetIngestConcurrency(-1, 0) == nil || SetIngestConcurrency(1, -1) == nil {
+		t.Fatal("invalid ingest limits accepted")
+	}
+}
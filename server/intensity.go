@@ -0,0 +1,298 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+)
+
+const (
+	defaultIntensityWindowMs = 1000
+	maxIntensityWindows      = 100000
+)
+
+type intensityWindow struct {
+	Start        float64            `json:"start"`
+	EpochStart   float64            `json:"epoch_start,omitempty"`
+	Displacement map[string]float64 `json:"displacement"`
+}
+
+type hrCorrelationPoint struct {
+	EpochStart float64 `json:"epoch_start"`
+	Intensity  float64 `json:"intensity"`
+	BPM        float64 `json:"bpm"`
+}
+
+// epochOffset returns the difference between the client wall clock and the
+// scene timestamps, taken from the first sample that reports both.
+func epochOffset(samples []trackerSample) (float64, bool) {
+	for _, s := range samples {
+		if s.Epoch != 0 {
+			return s.Epoch - s.Timestamp, true
+		}
+	}
+	return 0, false
+}
+
+// windowedDisplacement sums the distance travelled by each tracker per
+// window of windowMs, keyed by window number relative to origin. Each step
+// between consecutive samples is attributed to the window of the later one.
+func windowedDisplacement(samples []trackerSample, origin, windowMs float64, clock func(trackerSample) float64) map[int]float64 {
+	windows := map[int]float64{}
+	for i := 1; i < len(samples); i++ {
+		n := int(math.Floor((clock(samples[i]) - origin) / windowMs))
+		windows[n] += samples[i].Position.sub(samples[i-1].Position).length()
+	}
+	return windows
+}
+
+// computeIntensity sums the displacement of each tracker per window of
+// windowMs. It fails if there would be more than maxIntensityWindows.
+func computeIntensity(samples map[string][]trackerSample, windowMs float64) ([]intensityWindow, error) {
+	merged := mergeTrackerSamples(samples)
+	if len(merged) == 0 {
+		return []intensityWindow{}, nil
+	}
+
+	origin := merged[0].Timestamp
+	count := math.Floor((merged[len(merged)-1].Timestamp-origin)/windowMs) + 1
+	if count > maxIntensityWindows {
+		return nil, fmt.Errorf("intensity would have %.0f windows, limit is %d: use a larger window_ms", count, maxIntensityWindows)
+	}
+	last := int(count) - 1
+	offset, hasEpoch := epochOffset(merged)
+
+	windows := make([]intensityWindow, last+1)
+	for n := range windows {
+		windows[n] = intensityWindow{
+			Start:        origin + float64(n)*windowMs,
+			Displacement: make(map[string]float64, len(samples)),
+		}
+		if hasEpoch {
+			windows[n].EpochStart = windows[n].Start + offset
+		}
+	}
+
+	for tracker, trackerSamples := range samples {
+		for n := range windows {
+			windows[n].Displacement[tracker] = 0
+		}
+		byTimestamp := func(s trackerSample) float64 { return s.Timestamp }
+		for n, displacement := range windowedDisplacement(trackerSamples, origin, windowMs, byTimestamp) {
+			windows[n].Displacement[tracker] = displacement
+		}
+	}
+
+	return windows, nil
+}
+
+// correlateHeartRate pairs per-window movement intensity with the mean heart
+// rate of the same wall-clock window and returns the paired series along
+// with their Pearson correlation coefficient.
+func correlateHeartRate(samples []trackerSample, heartRate []heartRateSample, windowMs float64) ([]hrCorrelationPoint, float64) {
+	points := []hrCorrelationPoint{}
+	byEpoch := func(s trackerSample) float64 { return s.Epoch }
+
+	var withEpoch []trackerSample
+	for _, s := range samples {
+		if s.Epoch != 0 {
+			withEpoch = append(withEpoch, s)
+		}
+	}
+	intensity := windowedDisplacement(withEpoch, 0, windowMs, byEpoch)
+
+	bpmSum := map[int]float64{}
+	bpmCount := map[int]int{}
+	for _, hr := range heartRate {
+		n := int(math.Floor(hr.Epoch / windowMs))
+		bpmSum[n] += hr.BPM
+		bpmCount[n]++
+	}
+
+	windows := make([]int, 0, len(intensity))
+	for n := range intensity {
+		if bpmCount[n] > 0 {
+			windows = append(windows, n)
+		}
+	}
+	sort.Ints(windows)
+
+	for _, n := range windows {
+		points = append(points, hrCorrelationPoint{
+			EpochStart: float64(n) * windowMs,
+			Intensity:  intensity[n],
+			BPM:        bpmSum[n] / float64(bpmCount[n]),
+		})
+	}
+
+	return points, pearson(points)
+}
+
+// pearson returns the correlation between intensity and bpm, or NaN if it is
+// undefined.
+func pearson(points []hrCorrelationPoint) float64 {
+	n := float64(len(points))
+	if n < 2 {
+		return math.NaN()
+	}
+
+	var meanX, meanY float64
+	for _, p := range points {
+		meanX += p.Intensity
+		meanY += p.BPM
+	}
+	meanX /= n
+	meanY /= n
+
+	var cov, varX, varY float64
+	for _, p := range points {
+		dx, dy := p.Intensity-meanX, p.BPM-meanY
+		cov += dx * dy
+		varX += dx * dx
+		varY += dy * dy
+	}
+	if varX == 0 || varY == 0 {
+		return math.NaN()
+	}
+
+	return cov / math.Sqrt(varX*varY)
+}
+
+func IntensityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	windowMs, err := parsePositiveFloatParam(r, "window_ms", defaultIntensityWindowMs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for intensity: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	samples, err = selectTracker(samples, r.URL.Query().Get("tracker"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, err.Error())
+		return
+	}
+
+	windows, err := computeIntensity(samples, windowMs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"window_ms":   windowMs,
+		"windows":     windows,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write intensity response: %v", err)
+	}
+}
+
+// HRCorrelationHandler correlates movement intensity of a tracker with heart
+// rate. Heart rate is usually streamed under its own upload key, given as
+// hr_key; without it the heart rate records are read from the same upload.
+func HRCorrelationHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	hrKey := uploadKey
+	if hrKeyStr := r.URL.Query().Get("hr_key"); hrKeyStr != "" {
+		hrKey, err = parseUploadKey(hrKeyStr)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidUploadKey, "hr_key: "+err.Error())
+			return
+		}
+	}
+
+	windowMs, err := parsePositiveFloatParam(r, "window_ms", defaultIntensityWindowMs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	tracker := r.URL.Query().Get("tracker")
+	if tracker == "" {
+		tracker = defaultTracker
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for hr correlation: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	samples, err = selectTracker(samples, tracker)
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, err.Error())
+		return
+	}
+
+	heartRate, err := readHeartRateSamples(hrKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, "heart rate "+err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read heart rate upload for hr correlation: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	points, correlation := correlateHeartRate(samples[tracker], heartRate, windowMs)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"tracker":     tracker,
+		"window_ms":   windowMs,
+		"windows":     points,
+		"correlation": nil,
+	}
+	if !math.IsNaN(correlation) {
+		response["correlation"] = correlation
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write hr correlation response: %v", err)
+	}
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestIntensityHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","epoch":1700000000000,"timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","epoch":1700000000500,"timestamp":500,"position":{"x":1,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","epoch":1700000001500,"timestamp":1500,"position":{"x":1,"y":0,"z":2}}`,
+		`{"trackerKey":"rightController","epoch":1700000001600,"timestamp":1600,"position":{"x":0,"y":0,"z":0}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/intensity?window_ms=1000", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	IntensityHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("intensity status = %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var payload struct {
+		Windows []intensityWindow `json:"windows"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode intensity response: %v", err)
+	}
+	if len(payload.Windows) != 2 {
+		t.Fatalf("windows = %d, want 2", len(payload.Windows))
+	}
+	if payload.Windows[0].Displacement["headset"] != 1 || payload.Windows[1].Displacement["headset"] != 2 {
+		t.Fatalf("unexpected displacement: %+v", payload.Windows)
+	}
+	if payload.Windows[1].EpochStart != 1700000001000 {
+		t.Fatalf("epoch start = %v, want 1700000001000", payload.Windows[1].EpochStart)
+	}
+	if _, ok := payload.Windows[0].Displacement["rightController"]; !ok {
+		t.Fatalf("missing rightController in first window")
+	}
+
+	// 1.6 s in windows of 1 ns would be 1.6e9 windows
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/intensity?window_ms=0.000001", nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	IntensityHandler(rec, req)
+	if rec.Code != 400 {
+		t.Fatalf("intensity with a tiny window status = %d, want 400", rec.Code)
+	}
+}
+
+func TestHRCorrelationHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	hrKey := newTestUploadKey(t)
+
+	// the faster the headset moves, the higher the heart rate
+	var movement, heartRate []string
+	x := 0.0
+	for second := 0; second < 5; second++ {
+		for i := 0; i < 10; i++ {
+			ms := second*1000 + i*100
+			x += float64(second+1) * 0.01
+			movement = append(movement, fmt.Sprintf(`{"trackerKey":"headset","epoch":%d,"timestamp":%d,"position":{"x":%g,"y":0,"z":0}}`, 1700000000000+ms, ms, x))
+		}
+		heartRate = append(heartRate, fmt.Sprintf(`{"tsISO":"2023-11-14T22:13:2%d.500Z","bpm":%d,"rr_s":0.8,"rr_ms":800}`, second, 70+second*5))
+	}
+	simulateUpload(t, key, movement)
+	simulateUpload(t, hrKey, heartRate)
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/hr-correlation?hr_key="+hrKey, nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	HRCorrelationHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("hr correlation status = %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var payload struct {
+		Windows     []hrCorrelationPoint `json:"windows"`
+		Correlation *float64             `json:"correlation"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode hr correlation response: %v", err)
+	}
+	if len(payload.Windows) != 5 {
+		t.Fatalf("windows = %d, want 5", len(payload.Windows))
+	}
+	if payload.Correlation == nil || math.Abs(*payload.Correlation-1) > 0.05 {
+		t.Fatalf("correlation = %v, want ~1", payload.Correlation)
+	}
+}
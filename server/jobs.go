@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"math/rand/v2"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// job is periodic background work, such as sweeps and recomputations, run by
+// the scheduler instead of a goroutine of its own so that it is timed,
+// counted and stopped with the server.
+type job struct {
+	name     string
+	interval time.Duration
+	jitter   time.Duration
+	run      func(ctx context.Context) error
+
+	metrics *expvar.Map
+}
+
+var (
+	jobs       []*job
+	jobsMutex  sync.Mutex
+	jobsCtx    context.Context // nil until StartJobs
+	stopJobs   context.CancelFunc
+	jobsActive sync.WaitGroup
+
+	// per-job runs, failures and timings, published on /debug/vars
+	jobMetrics = expvar.NewMap("jobs")
+)
+
+// registerJob schedules run every interval plus a random delay of up to
+// jitter, so that jobs of several servers, or several jobs with the same
+// interval, don't all run at once. A job never overlaps itself. run should
+// return soon after ctx is cancelled, which happens when the server shuts
+// down. Jobs registered before StartJobs wait for it.
+func registerJob(name string, interval, jitter time.Duration, run func(ctx context.Context) error) {
+	if interval <= 0 || jitter < 0 {
+		panic(fmt.Sprintf("invalid schedule for job %s", name))
+	}
+	j := &job{name: name, interval: interval, jitter: jitter, run: run, metrics: new(expvar.Map).Init()}
+	jobMetrics.Set(name, j.metrics)
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	for _, existing := range jobs {
+		if existing.name == name {
+			panic("job " + name + " registered twice")
+		}
+	}
+	jobs = append(jobs, j)
+	if jobsCtx != nil {
+		startJob(jobsCtx, j)
+	}
+}
+
+// StartJobs starts running the registered background jobs.
+func StartJobs() {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+	if jobsCtx != nil {
+		return
+	}
+	jobsCtx, stopJobs = context.WithCancel(context.Background())
+	for _, j := range jobs {
+		startJob(jobsCtx, j)
+	}
+}
+
+// StopJobs cancels the background jobs and waits until those running have
+// returned, or until ctx is done.
+func StopJobs(ctx context.Context) error {
+	jobsMutex.Lock()
+	if jobsCtx == nil {
+		jobsMutex.Unlock()
+		return nil
+	}
+	stopJobs()
+	jobsCtx = nil
+	jobsMutex.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		jobsActive.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("background jobs still running: %w", ctx.Err())
+	}
+}
+
+func startJob(ctx context.Context, j *job) {
+	jobsActive.Add(1)
+	go func() {
+		defer jobsActive.Done()
+		for {
+			delay := j.interval
+			if j.jitter > 0 {
+				delay += rand.N(j.jitter)
+			}
+			timer := time.NewTimer(delay)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			j.runOnce(ctx)
+		}
+	}()
+}
+
+// runOnce runs the job and records the outcome. A panic counts as a failure
+// rather than taking the server down.
+func (j *job) runOnce(ctx context.Context) {
+	start := time.Now()
+	err := func() (err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				err = fmt.Errorf("panic: %v\n%s", p, debug.Stack())
+			}
+		}()
+		return j.run(ctx)
+	}()
+	duration := time.Since(start)
+
+	j.metrics.Add("runs", 1)
+	j.metrics.Add("duration_ns_total", int64(duration))
+	last := new(expvar.String)
+	last.Set(start.UTC().Format(time.RFC3339Nano))
+	j.metrics.Set("last_run", last)
+	switch {
+	case err == nil:
+		j.metrics.Set("last_success", last)
+	case errors.Is(err, context.Canceled) && ctx.Err() != nil:
+		// stopped by shutdown
+	default:
+		j.metrics.Add("failures", 1)
+		log.Printf("job %s failed after %s: %v", j.name, duration.Round(time.Millisecond), err)
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"slices"
+	"testing"
+	"time"
+)
+
+// registerTestJob registers a job for one test and removes it afterwards.
+func registerTestJob(t *testing.T, name string, interval time.Duration, run func(ctx context.Context) error) *job {
+	t.Helper()
+	registerJob(name, interval, interval/2, run)
+	jobsMutex.Lock()
+	j := jobs[len(jobs)-1]
+	jobsMutex.Unlock()
+	t.Cleanup(func() {
+		jobsMutex.Lock()
+		jobs = slices.DeleteFunc(jobs, func(other *job) bool { return other == j })
+		jobsMutex.Unlock()
+	})
+	return j
+}
+
+func jobCounter(j *job, name string) int64 {
+	if v, ok := j.metrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func TestJobs(t *testing.T) {
+	runs := make(chan struct{}, 100)
+	ok := registerTestJob(t, "test_ok", time.Millisecond, func(context.Context) error {
+		runs <- struct{}{}
+		return nil
+	})
+	failing := registerTestJob(t, "test_failing", time.Millisecond, func(context.Context) error {
+		return errors.New("broken")
+	})
+	panicking := registerTestJob(t, "test_panicking", time.Millisecond, func(context.Context) error {
+		panic("boom")
+	})
+
+	StartJobs()
+	t.Cleanup(func() { StopJobs(context.Background()) })
+	for range 3 {
+		select {
+		case <-runs:
+		case <-time.After(5 * time.Second):
+			t.Fatal("job didn't run")
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for jobCounter(failing, "failures") == 0 || jobCounter(panicking, "failures") == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("failures not counted: %v, %v", failing.metrics, panicking.metrics)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if jobCounter(ok, "runs") < 3 || jobCounter(ok, "failures") != 0 || ok.metrics.Get("last_success") == nil {
+		t.Fatalf("ok job metrics = %v", ok.metrics)
+	}
+}
+
+func TestStopJobsWaitsForRunningJobs(t *testing.T) {
+	started, finished := make(chan struct{}), make(chan struct{})
+	registerTestJob(t, "test_slow", time.Millisecond, func(ctx context.Context) error {
+		select {
+		case started <- struct{}{}:
+		default:
+			return nil
+		}
+		<-ctx.Done()
+		time.Sleep(10 * time.Millisecond)
+		close(finished)
+		return ctx.Err()
+	})
+
+	StartJobs()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("job didn't run")
+	}
+	if err := StopJobs(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-finished:
+	default:
+		t.Fatal("StopJobs returned before the running job finished")
+	}
+}
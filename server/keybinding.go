@@ -0,0 +1,63 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+)
+
+// With key binding on, the first upload of a key records the fingerprint of
+// its client in the metadata line, and later uploads from another client
+// are refused, so that a key leaked from a live study can't be used to add
+// junk to it. The fingerprint is that of the client certificate if there is
+// one, else a hash of the client IP and User-Agent; keys used from a
+// headset whose address changes then stop working, and need replacing.
+// Two first uploads racing from different clients may both be accepted.
+
+// bindUploadKeys turns key binding on. Set by SetUploadKeyBinding.
+var bindUploadKeys bool
+
+var uploadsRejectedFingerprint = expvar.NewInt("uploads_rejected_fingerprint")
+
+// SetUploadKeyBinding makes upload keys bound to the client of their first
+// upload.
+func SetUploadKeyBinding(enabled bool) {
+	bindUploadKeys = enabled
+}
+
+// clientFingerprint identifies the client of r: "cert:" and the SHA-256
+// of its client certificate, or "ip-ua:" and a hash of its IP and
+// User-Agent.
+func clientFingerprint(r *http.Request) string {
+	if identity := requestClientIdentity(r); identity != nil {
+		return "cert:" + identity.Fingerprint
+	}
+	sum := sha256.Sum256([]byte(clientIP(r) + "\n" + r.Header.Get("User-Agent")))
+	return "ip-ua:" + hex.EncodeToString(sum[:16])
+}
+
+// checkKeyBinding refuses uploads to a bound key from another client. It
+// returns the metadata to record for a new upload, or a non-zero error
+// status with its code and message if the request must be rejected.
+func checkKeyBinding(r *http.Request, uploadKey string) (metadata map[string]any, status int, code, message string) {
+	if !bindUploadKeys {
+		return nil, 0, "", ""
+	}
+
+	fingerprint := clientFingerprint(r)
+	existing, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if err != nil && !errors.Is(err, errUploadNotFound) {
+		log.Printf("failed to read upload metadata for key binding check: %v", err)
+		return nil, http.StatusInternalServerError, errCodeInternal, "failed to read upload file"
+	}
+	if err == nil && existing.ClientFingerprint != "" && existing.ClientFingerprint != fingerprint {
+		uploadsRejectedFingerprint.Add(1)
+		log.Printf("upload from another client refused key_hash=%s upload_name=%q", uploadKeyHash(uploadKey), uploadNameFromKey(uploadKey))
+		return nil, http.StatusForbidden, errCodeClientFingerprintMismatch, "upload_key is bound to a different client"
+	}
+
+	return map[string]any{"client_fingerprint": fingerprint}, 0, "", ""
+}
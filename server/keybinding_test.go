@@ -0,0 +1,54 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadKeyBinding(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	SetUploadKeyBinding(true)
+	t.Cleanup(func() { SetUploadKeyBinding(false) })
+
+	upload := func(remoteAddr, userAgent string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader(`{"bpm":70}`+"\n")), key)
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("User-Agent", userAgent)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+		return rec
+	}
+
+	if rec := upload("10.0.0.5:4000", "headset/1.0"); rec.Code != 200 {
+		t.Fatalf("first upload status = %d: %s", rec.Code, rec.Body.String())
+	}
+	metadata, err := readUploadMetadata(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(metadata.ClientFingerprint, "ip-ua:") {
+		t.Fatalf("client fingerprint = %q", metadata.ClientFingerprint)
+	}
+
+	// the port changes with every connection
+	if rec := upload("10.0.0.5:4001", "headset/1.0"); rec.Code != 200 {
+		t.Fatalf("upload from the same client status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	for _, client := range [][2]string{{"10.0.0.6:4000", "headset/1.0"}, {"10.0.0.5:4000", "curl/8.0"}} {
+		rec := upload(client[0], client[1])
+		if rec.Code != 403 || !strings.Contains(rec.Body.String(), errCodeClientFingerprintMismatch) {
+			t.Errorf("upload from %v status = %d: %s", client, rec.Code, rec.Body.String())
+		}
+	}
+
+	SetUploadKeyBinding(false)
+	if rec := upload("10.0.0.6:4000", "curl/8.0"); rec.Code != 200 {
+		t.Fatalf("upload with binding off status = %d: %s", rec.Code, rec.Body.String())
+	}
+}
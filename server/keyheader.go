@@ -0,0 +1,74 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+// Query strings end up in access logs, proxy logs and browser history, so
+// clients send their upload key to /api/upload, /api/follow, /api/heartbeat
+// and /api/pairing in an "Authorization: Bearer <key>" or "X-Upload-Key"
+// header. The upload_key parameter is only accepted when enabled with
+// SetUploadKeyQuery, for clients that can't set headers yet.
+
+// uploadKeyQueryAllowed makes the upload_key parameter work. Set by
+// SetUploadKeyQuery.
+var uploadKeyQueryAllowed bool
+
+var errUploadKeyInQuery = errors.New("upload_key in the query string is disabled: send the key in an Authorization: Bearer or X-Upload-Key header")
+
+// SetUploadKeyQuery makes the server accept upload keys given as upload_key
+// query parameter, as well as in headers.
+func SetUploadKeyQuery(allowed bool) {
+	uploadKeyQueryAllowed = allowed
+}
+
+// headerUploadKey returns the upload key in the headers of r, unparsed.
+func headerUploadKey(r *http.Request) string {
+	if key := r.Header.Get("X-Upload-Key"); key != "" {
+		return key
+	}
+	if token, ok := bearerToken(r); ok {
+		return token
+	}
+	return ""
+}
+
+// bearerToken returns the token of an "Authorization: Bearer" header; the
+// scheme is case-insensitive (RFC 9110, section 11.1).
+func bearerToken(r *http.Request) (string, bool) {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return "", false
+	}
+	return token, true
+}
+
+// presentedUploadKey returns the upload key a request carries, unparsed,
+// wherever it is, for logs and traces to identify the upload by.
+func presentedUploadKey(r *http.Request) string {
+	if key := headerUploadKey(r); key != "" {
+		return key
+	}
+	return r.URL.Query().Get("upload_key")
+}
+
+// requestUploadKey returns the upload key of a request, from its headers
+// or, if allowed, its upload_key parameter. On failure it also returns the
+// status and error code to respond with.
+func requestUploadKey(r *http.Request) (string, int, string, error) {
+	raw := headerUploadKey(r)
+	if raw == "" && r.URL.Query().Has("upload_key") {
+		if !uploadKeyQueryAllowed {
+			return "", http.StatusBadRequest, errCodeUploadKeyInQuery, errUploadKeyInQuery
+		}
+		raw = r.URL.Query().Get("upload_key")
+	}
+
+	uploadKey, err := parseUploadKey(raw)
+	if err != nil {
+		return "", http.StatusBadRequest, errCodeInvalidUploadKey, err
+	}
+	return uploadKey, 0, "", nil
+}
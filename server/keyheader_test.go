@@ -0,0 +1,61 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUploadKeyHeaders(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	upload := func(target string, header ...string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("POST", target, strings.NewReader(`{"bpm":70}`))
+		for i := 0; i < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+		return rec
+	}
+
+	if rec := upload("/api/upload", "X-Upload-Key", key); rec.Code != 200 {
+		t.Fatalf("X-Upload-Key upload status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := upload("/api/upload", "Authorization", "Bearer "+key); rec.Code != 200 {
+		t.Fatalf("bearer upload status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if rec := upload("/api/upload"); rec.Code != 400 || !strings.Contains(rec.Body.String(), errCodeInvalidUploadKey) {
+		t.Fatalf("upload without key status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	rec := upload("/api/upload?upload_key=" + key)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), errCodeUploadKeyInQuery) {
+		t.Fatalf("query key upload status = %d: %s", rec.Code, rec.Body.String())
+	}
+	SetUploadKeyQuery(true)
+	t.Cleanup(func() { SetUploadKeyQuery(false) })
+	if rec := upload("/api/upload?upload_key=" + key); rec.Code != 200 {
+		t.Fatalf("query key upload with compat status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// logs identify the upload by hash, wherever its key was sent
+	req := httptest.NewRequest("GET", "/api/follow", nil)
+	req.Header.Set("Authorization", "Bearer "+key)
+	if path, hash := redactRequestPath(req); path != "/api/follow" || hash != uploadKeyHash(key) {
+		t.Fatalf("redactRequestPath = %q, %q", path, hash)
+	}
+	// keys in the path are redacted even when a header names one too
+	other := newTestUploadKey(t)
+	req = httptest.NewRequest("GET", "/api/uploads/"+other+"/summary", nil)
+	req.Header.Set("X-Upload-Key", key)
+	if path, hash := redactRequestPath(req); path != "/api/uploads/{"+uploadKeyHash(other)+"}/summary" || hash != uploadKeyHash(key) {
+		t.Fatalf("redactRequestPath with a header = %q, %q", path, hash)
+	}
+	req = httptest.NewRequest("GET", "/api/uploads/"+other+"/summary", nil)
+	if path, hash := redactRequestPath(req); path != "/api/uploads/{"+uploadKeyHash(other)+"}/summary" || hash != uploadKeyHash(other) {
+		t.Fatalf("redactRequestPath = %q, %q", path, hash)
+	}
+}
@@ -0,0 +1,365 @@
+package server
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The server remembers the upload keys it handed out, with when they were
+// created, expire and were revoked. Keys it knows nothing of, such as ones
+// handed out by other servers, are accepted, so only revoked and expired
+// keys are refused. The store lives in memory, and the expiry and
+// revocation of keys are also appended to uploadKeyStateFile in the upload
+// directory, by key hash, so that they still hold after a restart.
+
+// uploadKeyStateFile is the file in the upload directory that the state of
+// upload keys is appended to, one uploadKeyState per line; later lines
+// override earlier ones of the same key.
+const uploadKeyStateFile = "upload-keys.jsonl"
+
+// uploadKeyState is a line of uploadKeyStateFile. The full SHA-256 of the
+// key stands in for it, so the file holds no keys and a short hash can't
+// make one key revoke another.
+type uploadKeyState struct {
+	KeyHash string    `json:"key_hash"`
+	Created time.Time `json:"created"`
+	Expires time.Time `json:"expires,omitzero"`
+	Revoked time.Time `json:"revoked,omitzero"`
+}
+
+func newUploadKeyState(hash string, info uploadKeyInfo) uploadKeyState {
+	return uploadKeyState{KeyHash: hash, Created: info.Created, Expires: info.Expires, Revoked: info.Revoked}
+}
+
+func uploadKeyStateHash(uploadKey string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(uploadKey)))
+	return hex.EncodeToString(sum[:])
+}
+
+// uploadKeyInfo is what the server knows of an upload key.
+type uploadKeyInfo struct {
+	Created time.Time
+	Expires time.Time // zero if the key doesn't expire
+	Revoked time.Time // zero unless revoked
+	Labels  map[string]string
+}
+
+var (
+	errUploadKeyRevoked = errors.New("upload key was revoked")
+	errUploadKeyExpired = errors.New("upload key expired: generate another one and try again")
+)
+
+// uploadKeyStore indexes upload keys for constant-time lookup. Uploads
+// only read it, so they share its lock. Keys from before a restart are in
+// stored, by hash, until they are handed out or revoked again.
+type uploadKeyStore struct {
+	mu     sync.RWMutex
+	keys   map[string]*uploadKeyInfo
+	stored map[string]uploadKeyInfo
+
+	// signingIDs maps the signing ids of the keys handed out and of the
+	// stored uploads to their keys.
+	signingIDs map[string]string
+	// files holds the file names of stored uploads named after another
+	// word list than the current one.
+	files map[string]string
+}
+
+func newUploadKeyStore() *uploadKeyStore {
+	return &uploadKeyStore{keys: map[string]*uploadKeyInfo{}, signingIDs: map[string]string{}, files: map[string]string{}}
+}
+
+var uploadKeys = newUploadKeyStore()
+
+// LoadUploadKeyState reads the expiry and revocation of the upload keys
+// handed out before the server started from the upload directory, and
+// rewrites the file with the last line of every key. It also indexes the
+// signing ids of the stored uploads. It must be called after SetUploadDir
+// and before the server starts handling requests.
+func LoadUploadKeyState() error {
+	stored, err := listUploadKeys()
+	if err != nil {
+		return err
+	}
+	uploadKeys.mu.Lock()
+	for _, uploadKey := range stored {
+		uploadKeys.signingIDs[uploadSigningID(uploadKey)] = uploadKey
+	}
+	uploadKeys.mu.Unlock()
+
+	path := filepath.Join(uploadDir, uploadKeyStateFile)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("open upload key state: %w", err)
+	}
+	defer file.Close()
+
+	states := map[string]uploadKeyInfo{}
+	var order []string
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		var state uploadKeyState
+		if err := json.Unmarshal(scanner.Bytes(), &state); err != nil || state.KeyHash == "" {
+			// most likely a line cut short by a crash
+			log.Printf("skipping malformed upload key state line %d", line)
+			continue
+		}
+		if _, ok := states[state.KeyHash]; !ok {
+			order = append(order, state.KeyHash)
+		}
+		states[state.KeyHash] = uploadKeyInfo{Created: state.Created, Expires: state.Expires, Revoked: state.Revoked}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read upload key state: %w", err)
+	}
+
+	// the rewrite also drops a line cut short, which the next line appended
+	// would otherwise be glued to
+	var compacted []byte
+	for _, hash := range order {
+		info := states[hash]
+		line, err := json.Marshal(newUploadKeyState(hash, info))
+		if err != nil {
+			return fmt.Errorf("encode upload key state: %w", err)
+		}
+		compacted = append(append(compacted, line...), '\n')
+	}
+	if err := os.WriteFile(path+".tmp", compacted, 0o600); err != nil {
+		return fmt.Errorf("write upload key state: %w", err)
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		return fmt.Errorf("replace upload key state: %w", err)
+	}
+
+	uploadKeys.mu.Lock()
+	defer uploadKeys.mu.Unlock()
+	uploadKeys.stored = states
+	return nil
+}
+
+// persist appends the state of a key to uploadKeyStateFile. s.mu must be
+// held, which keeps the lines of one key in order.
+func (s *uploadKeyStore) persist(uploadKey string, info uploadKeyInfo) error {
+	line, err := json.Marshal(newUploadKeyState(uploadKeyStateHash(uploadKey), info))
+	if err != nil {
+		return fmt.Errorf("encode upload key state: %w", err)
+	}
+	if err := os.MkdirAll(uploadDir, 0o755); err != nil {
+		return fmt.Errorf("create upload directory: %w", err)
+	}
+	file, err := os.OpenFile(filepath.Join(uploadDir, uploadKeyStateFile), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o600)
+	if err != nil {
+		return fmt.Errorf("open upload key state: %w", err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return fmt.Errorf("write upload key state: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("sync upload key state: %w", err)
+	}
+	return file.Close()
+}
+
+// known returns the entry of a key, taking it over from stored if it is
+// from before a restart. s.mu must be held for writing.
+func (s *uploadKeyStore) known(uploadKey string) (*uploadKeyInfo, bool) {
+	if info, ok := s.keys[uploadKey]; ok {
+		return info, true
+	}
+	hash := uploadKeyStateHash(uploadKey)
+	stored, ok := s.stored[hash]
+	if !ok {
+		return nil, false
+	}
+	info := &stored
+	s.keys[uploadKey] = info
+	delete(s.stored, hash)
+	return info, true
+}
+
+// uploadKeyTTL is how long new upload keys accept uploads; 0 for ever. Set
+// by SetUploadKeyTTL.
+var uploadKeyTTL time.Duration
+
+// SetUploadKeyTTL makes upload keys handed out from now on stop accepting
+// uploads ttl after they were created, 0 to keep them valid.
+func SetUploadKeyTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("invalid upload key TTL %s: must not be negative", ttl)
+	}
+	uploadKeyTTL = ttl
+	return nil
+}
+
+// add records a new upload key, created now. A key added again keeps its
+// original metadata.
+func (s *uploadKeyStore) add(uploadKey string) (uploadKeyInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.signingIDs[uploadSigningID(uploadKey)] = uploadKey
+	if info, ok := s.known(uploadKey); ok {
+		return *info, nil
+	}
+	info := &uploadKeyInfo{Created: time.Now().UTC()}
+	if uploadKeyTTL > 0 {
+		info.Expires = info.Created.Add(uploadKeyTTL)
+	}
+	s.keys[uploadKey] = info
+	if info.Expires.IsZero() {
+		// nothing a restart would forget
+		return *info, nil
+	}
+	return *info, s.persist(uploadKey, *info)
+}
+
+// setLabels sets the labels new uploads with a key get.
+func (s *uploadKeyStore) setLabels(uploadKey string, labels map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if info, ok := s.keys[uploadKey]; ok {
+		info.Labels = labels
+	}
+}
+
+func (s *uploadKeyStore) lookup(uploadKey string) (uploadKeyInfo, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if info, ok := s.keys[uploadKey]; ok {
+		return *info, true
+	}
+	info, ok := s.stored[uploadKeyStateHash(uploadKey)]
+	return info, ok
+}
+
+// check returns errUploadKeyRevoked or errUploadKeyExpired for keys that
+// may no longer upload, nil for others, including unknown ones.
+func (s *uploadKeyStore) check(uploadKey string, now time.Time) error {
+	info, ok := s.lookup(uploadKey)
+	switch {
+	case !ok:
+		return nil
+	case !info.Revoked.IsZero():
+		return errUploadKeyRevoked
+	case !info.Expires.IsZero() && now.After(info.Expires):
+		return errUploadKeyExpired
+	}
+	return nil
+}
+
+// revoke marks a key revoked, adding it if unknown, and returns its
+// metadata. The key is revoked even if that can't be persisted.
+func (s *uploadKeyStore) revoke(uploadKey string, now time.Time) (uploadKeyInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	info, ok := s.known(uploadKey)
+	if !ok {
+		info = &uploadKeyInfo{}
+		s.keys[uploadKey] = info
+	}
+	if !info.Revoked.IsZero() {
+		return *info, nil
+	}
+	info.Revoked = now.UTC()
+	return *info, s.persist(uploadKey, *info)
+}
+
+// resolveSigningID returns the key a signing id was derived from.
+func (s *uploadKeyStore) resolveSigningID(id string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	uploadKey, ok := s.signingIDs[id]
+	return uploadKey, ok
+}
+
+// forgetSigningID stops the signing id of a key from resolving.
+func (s *uploadKeyStore) forgetSigningID(uploadKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.signingIDs, uploadSigningID(uploadKey))
+}
+
+// setStoredFile records the file name of an upload not stored under its
+// current name.
+func (s *uploadKeyStore) setStoredFile(uploadKey, name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.files[uploadKey] = name
+}
+
+// storedFile returns the file name recorded by setStoredFile.
+func (s *uploadKeyStore) storedFile(uploadKey string) (string, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	name, ok := s.files[uploadKey]
+	return name, ok
+}
+
+// forgetStoredFile drops the file name recorded by setStoredFile, once the
+// file is gone.
+func (s *uploadKeyStore) forgetStoredFile(uploadKey string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.files, uploadKey)
+}
+
+// each calls fn with every key in the store.
+func (s *uploadKeyStore) each(fn func(uploadKey string, info uploadKeyInfo)) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for uploadKey, info := range s.keys {
+		fn(uploadKey, *info)
+	}
+}
+
+func registerUploadKey(uploadKey string) (uploadKeyInfo, error) {
+	return uploadKeys.add(uploadKey)
+}
+
+// RevokeUploadKeyHandler stops an upload key from uploading, e.g. one
+// leaked from a shared headset. Its stored records stay readable.
+func RevokeUploadKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	uploadKey, err := parseUploadKey(r.PathValue("key"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidUploadKey, err.Error())
+		return
+	}
+
+	info, err := uploadKeys.revoke(uploadKey, time.Now())
+	if err != nil {
+		log.Printf("failed to persist upload key revocation: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to store the revocation; the key is revoked until the server restarts")
+		return
+	}
+	log.Printf("revoked upload key upload_name=%q key_hash=%s", uploadNameFromKey(uploadKey), uploadKeyHash(uploadKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"key_hash":    uploadKeyHash(uploadKey),
+		"revoked_at":  info.Revoked.Format(time.RFC3339Nano),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write revoke response: %v", err)
+	}
+}
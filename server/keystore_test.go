@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func uploadWithKey(t *testing.T, key string) (int, string) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	UploadHandler(rec, withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader(`{"bpm":70}`)), key))
+	var response struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	json.NewDecoder(rec.Body).Decode(&response)
+	return rec.Code, response.Error.Code
+}
+
+func TestUploadKeyStore(t *testing.T) {
+	chdirTemp(t)
+	defer SetUploadKeyTTL(0)
+
+	// keys handed out before a restart are unknown and still upload
+	unknown := newTestUploadKey(t)
+	if code, _ := uploadWithKey(t, unknown); code != 200 {
+		t.Fatalf("upload with unknown key: status %d", code)
+	}
+
+	if err := SetUploadKeyTTL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	NewUploadKeyHandler(rec, httptest.NewRequest("POST", "/api/new-upload-key", nil))
+	var created struct {
+		UploadKey string `json:"upload_key"`
+		ExpiresAt string `json:"expires_at"`
+	}
+	json.NewDecoder(rec.Body).Decode(&created)
+	info, ok := uploadKeys.lookup(created.UploadKey)
+	if !ok || created.ExpiresAt != info.Expires.Format(time.RFC3339Nano) || info.Expires.Sub(info.Created) != time.Hour {
+		t.Fatalf("new key %+v stored as %+v", created, info)
+	}
+	if code, _ := uploadWithKey(t, created.UploadKey); code != 200 {
+		t.Fatalf("upload with new key: status %d", code)
+	}
+	if err := uploadKeys.check(created.UploadKey, info.Expires.Add(time.Second)); err != errUploadKeyExpired {
+		t.Fatalf("check after expiry = %v", err)
+	}
+
+	req := httptest.NewRequest("POST", "/api/admin/keys/"+created.UploadKey+"/revoke", nil)
+	req.SetPathValue("key", created.UploadKey)
+	rec = httptest.NewRecorder()
+	RevokeUploadKeyHandler(rec, req)
+	if rec.Code != 200 || strings.Contains(rec.Body.String(), created.UploadKey) {
+		t.Fatalf("revoke: status %d, %s", rec.Code, rec.Body)
+	}
+	if code, errCode := uploadWithKey(t, created.UploadKey); code != 403 || errCode != errCodeUploadKeyRevoked {
+		t.Fatalf("upload with revoked key: status %d, code %q", code, errCode)
+	}
+	// records uploaded before stay readable
+	rec = httptest.NewRecorder()
+	FollowHandler(rec, withUploadKey(httptest.NewRequest("GET", "/api/follow", nil), created.UploadKey))
+	if rec.Code != 200 {
+		t.Fatalf("follow revoked key: status %d", rec.Code)
+	}
+
+	if SetUploadKeyTTL(-time.Hour) == nil {
+		t.Fatal("negative TTL accepted")
+	}
+}
+
+func TestUploadKeyStateSurvivesRestart(t *testing.T) {
+	chdirTemp(t)
+	defer SetUploadKeyTTL(0)
+	defer func(keys *uploadKeyStore) { uploadKeys = keys }(uploadKeys)
+
+	revoked, unlimited := newTestUploadKey(t), newTestUploadKey(t)
+	registerUploadKey(unlimited)
+	if _, err := uploadKeys.revoke(revoked, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetUploadKeyTTL(time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	expiring := newTestUploadKey(t)
+	info, err := registerUploadKey(expiring)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	state, err := os.ReadFile(filepath.Join(uploadDir, uploadKeyStateFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{revoked, unlimited, expiring} {
+		if strings.Contains(string(state), key) {
+			t.Fatalf("key state holds a key: %s", state)
+		}
+	}
+	if lines := strings.Count(string(state), "\n"); lines != 2 {
+		t.Fatalf("key state has %d lines, want 2: %s", lines, state)
+	}
+	// a line cut short by a crash is skipped
+	os.WriteFile(filepath.Join(uploadDir, uploadKeyStateFile), append(state, `{"key_hash":"ab`...), 0o600)
+
+	// a restart
+	uploadKeys = newUploadKeyStore()
+	if err := LoadUploadKeyState(); err != nil {
+		t.Fatal(err)
+	}
+	if code, errCode := uploadWithKey(t, revoked); code != 403 || errCode != errCodeUploadKeyRevoked {
+		t.Fatalf("upload with revoked key after restart: status %d, code %q", code, errCode)
+	}
+	if err := uploadKeys.check(expiring, info.Expires.Add(time.Second)); err != errUploadKeyExpired {
+		t.Fatalf("check of expired key after restart = %v", err)
+	}
+	if code, _ := uploadWithKey(t, unlimited); code != 200 {
+		t.Fatalf("upload with unlimited key after restart: status %d", code)
+	}
+
+	// handing out a key again keeps its expiry, revoking it later persists
+	again, err := registerUploadKey(expiring)
+	if err != nil || !again.Expires.Equal(info.Expires) {
+		t.Fatalf("key handed out again = %+v, %v, want expiry %s", again, err, info.Expires)
+	}
+	if _, err := uploadKeys.revoke(expiring, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	uploadKeys = newUploadKeyStore()
+	if err := LoadUploadKeyState(); err != nil {
+		t.Fatal(err)
+	}
+	if err := uploadKeys.check(expiring, time.Now()); err != errUploadKeyRevoked {
+		t.Fatalf("check of key revoked after restart = %v", err)
+	}
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+)
+
+const defaultTracker = "headset"
+
+type kinematicsPoint struct {
+	Index        int     `json:"index"`
+	Timestamp    float64 `json:"timestamp"`
+	Velocity     vec3    `json:"velocity"`
+	Speed        float64 `json:"speed"`
+	Acceleration float64 `json:"acceleration"`
+}
+
+type kinematicsSummary struct {
+	Samples         int     `json:"samples"`
+	DurationMs      float64 `json:"duration_ms"`
+	TotalDistance   float64 `json:"total_distance"`
+	MaxSpeed        float64 `json:"max_speed"`
+	MeanSpeed       float64 `json:"mean_speed"`
+	MaxAcceleration float64 `json:"max_acceleration"`
+}
+
+// computeKinematics derives velocity (units/s) and acceleration (units/s²)
+// from consecutive samples. Pairs with a non-increasing timestamp are
+// skipped since they carry no rate information.
+func computeKinematics(samples []trackerSample) (kinematicsSummary, []kinematicsPoint) {
+	summary := kinematicsSummary{Samples: len(samples)}
+	if len(samples) == 0 {
+		return summary, nil
+	}
+
+	summary.DurationMs = samples[len(samples)-1].Timestamp - samples[0].Timestamp
+
+	points := make([]kinematicsPoint, 0, len(samples))
+	var speedSum float64
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1], samples[i]
+		dt := (cur.Timestamp - prev.Timestamp) / 1000
+		if dt <= 0 {
+			continue
+		}
+
+		displacement := cur.Position.sub(prev.Position)
+		summary.TotalDistance += displacement.length()
+
+		velocity := displacement.scale(1 / dt)
+		point := kinematicsPoint{
+			Index:     cur.Index,
+			Timestamp: cur.Timestamp,
+			Velocity:  velocity,
+			Speed:     velocity.length(),
+		}
+		if len(points) > 0 {
+			last := points[len(points)-1]
+			adt := (cur.Timestamp - last.Timestamp) / 1000
+			point.Acceleration = velocity.sub(last.Velocity).scale(1 / adt).length()
+		}
+
+		summary.MaxSpeed = max(summary.MaxSpeed, point.Speed)
+		summary.MaxAcceleration = max(summary.MaxAcceleration, point.Acceleration)
+		speedSum += point.Speed
+		points = append(points, point)
+	}
+
+	if len(points) > 0 {
+		summary.MeanSpeed = speedSum / float64(len(points))
+	}
+
+	return summary, points
+}
+
+// downsamplePoints keeps at most n evenly spaced points, always including the
+// last one.
+func downsamplePoints[T any](points []T, n int) []T {
+	if n <= 0 || len(points) <= n {
+		return points
+	}
+	if n == 1 {
+		return points[len(points)-1:]
+	}
+
+	out := make([]T, 0, n)
+	step := float64(len(points)-1) / float64(n-1)
+	for i := 0; i < n; i++ {
+		out = append(out, points[int(float64(i)*step+0.5)])
+	}
+
+	return out
+}
+
+func KinematicsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	tracker := r.URL.Query().Get("tracker")
+	if tracker == "" {
+		tracker = defaultTracker
+	}
+
+	// points=N includes a series of at most N points in the response
+	seriesPoints := 0
+	if pointsStr := r.URL.Query().Get("points"); pointsStr != "" {
+		seriesPoints, err = strconv.Atoi(pointsStr)
+		if err != nil || seriesPoints < 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid points parameter: must be a non-negative integer")
+			return
+		}
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for kinematics: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	trackerSamples, ok := samples[tracker]
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, fmt.Sprintf("no samples for tracker %q", tracker))
+		return
+	}
+
+	summary, points := computeKinematics(trackerSamples)
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"tracker":     tracker,
+		"summary":     summary,
+	}
+	if seriesPoints > 0 {
+		response["series"] = downsamplePoints(points, seriesPoints)
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write kinematics response: %v", err)
+	}
+}
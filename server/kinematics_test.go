@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestKinematicsHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	// headset moves 1 unit per second along x, then 3 units in the next second
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"left","timestamp":0,"position":{"x":5,"y":5,"z":5}}`,
+		`{"trackerKey":"headset","timestamp":1000,"position":{"x":1,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":2000,"position":{"x":4,"y":0,"z":0}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/kinematics?tracker=headset&points=10", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	KinematicsHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("kinematics status = %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var payload struct {
+		Summary kinematicsSummary `json:"summary"`
+		Series  []kinematicsPoint `json:"series"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode kinematics response: %v", err)
+	}
+	if payload.Summary.Samples != 3 {
+		t.Fatalf("samples = %d, want 3", payload.Summary.Samples)
+	}
+	if math.Abs(payload.Summary.TotalDistance-4) > 1e-9 {
+		t.Fatalf("total distance = %v, want 4", payload.Summary.TotalDistance)
+	}
+	if math.Abs(payload.Summary.MaxSpeed-3) > 1e-9 {
+		t.Fatalf("max speed = %v, want 3", payload.Summary.MaxSpeed)
+	}
+	if math.Abs(payload.Summary.MeanSpeed-2) > 1e-9 {
+		t.Fatalf("mean speed = %v, want 2", payload.Summary.MeanSpeed)
+	}
+	if len(payload.Series) != 2 {
+		t.Fatalf("series length = %d, want 2", len(payload.Series))
+	}
+	if math.Abs(payload.Series[1].Acceleration-2) > 1e-9 {
+		t.Fatalf("acceleration = %v, want 2", payload.Series[1].Acceleration)
+	}
+
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/kinematics?tracker=missing", nil)
+	req.SetPathValue("key", key)
+	rec = httptest.NewRecorder()
+	KinematicsHandler(rec, req)
+	if rec.Code != 404 {
+		t.Fatalf("missing tracker status = %d, want 404", rec.Code)
+	}
+}
@@ -0,0 +1,134 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"unicode"
+)
+
+// Datasets merged from several venues need to say where each upload came
+// from. Upload labels, such as venue=lab-2 or rig_id=7, are set for the
+// whole server with SetUploadLabels and per upload key when the key is
+// generated; the key's labels win. They are stored in the metadata of new
+// uploads, and exports carry them as extra columns, Influx tags or, in
+// NDJSON, an upload_labels object.
+
+const (
+	maxUploadLabels          = 16
+	maxUploadLabelNameLength = 32
+	maxUploadLabelLength     = 128
+)
+
+// reservedLabelNames are the columns exports have already.
+var reservedLabelNames = map[string]bool{
+	"index": true, "tracker": true, "timestamp": true, "epoch": true,
+	"x": true, "y": true, "z": true, "qx": true, "qy": true, "qz": true, "qw": true,
+	"labels": true, "upload": true, "time": true, "record_index": true,
+	"upload_labels": true,
+}
+
+// serverUploadLabels are added to every new upload. Set by SetUploadLabels.
+var serverUploadLabels map[string]string
+
+// parseUploadLabel parses a label given as name=value. Names are lower-case
+// letters, digits and underscores, starting with a letter, so they can be
+// column names.
+func parseUploadLabel(raw string) (name, value string, err error) {
+	name, value, ok := strings.Cut(raw, "=")
+	if !ok {
+		return "", "", fmt.Errorf("invalid label %q: expected name=value", raw)
+	}
+	if name == "" || len(name) > maxUploadLabelNameLength {
+		return "", "", fmt.Errorf("invalid label name %q: must be 1 to %d characters", name, maxUploadLabelNameLength)
+	}
+	for i, r := range name {
+		if (r < 'a' || r > 'z') && (i == 0 || (r < '0' || r > '9') && r != '_') {
+			return "", "", fmt.Errorf("invalid label name %q: only lower-case letters, digits and underscores are allowed, starting with a letter", name)
+		}
+	}
+	if reservedLabelNames[name] {
+		return "", "", fmt.Errorf("invalid label name %q: exports have a column of that name", name)
+	}
+	if value == "" || len(value) > maxUploadLabelLength {
+		return "", "", fmt.Errorf("invalid value of label %q: must be 1 to %d characters", name, maxUploadLabelLength)
+	}
+	if strings.ContainsFunc(value, unicode.IsControl) {
+		return "", "", fmt.Errorf("invalid value of label %q: must not contain control characters", name)
+	}
+	return name, value, nil
+}
+
+// parseUploadLabels parses labels given as name=value, each name once.
+func parseUploadLabels(raw []string) (map[string]string, error) {
+	if len(raw) > maxUploadLabels {
+		return nil, fmt.Errorf("too many labels: at most %d are allowed", maxUploadLabels)
+	}
+	labels := map[string]string{}
+	for _, label := range raw {
+		name, value, err := parseUploadLabel(label)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("invalid labels: %q is given more than once", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// SetUploadLabels sets labels, each given as name=value, that are stored
+// with every new upload, e.g. the venue the server runs at.
+func SetUploadLabels(labels []string) error {
+	parsed, err := parseUploadLabels(labels)
+	if err != nil {
+		return err
+	}
+	serverUploadLabels = parsed
+	return nil
+}
+
+// uploadLabels returns the labels a new upload with uploadKey gets: the
+// server's, overridden by the key's.
+func uploadLabels(uploadKey string) map[string]string {
+	labels := maps.Clone(serverUploadLabels)
+	if info, ok := uploadKeys.lookup(uploadKey); ok && len(info.Labels) > 0 {
+		if labels == nil {
+			labels = map[string]string{}
+		}
+		maps.Copy(labels, info.Labels)
+	}
+	return labels
+}
+
+// sortedLabelNames returns the names of labels in the order exports list
+// them in.
+func sortedLabelNames(labels map[string]string) []string {
+	return slices.Sorted(maps.Keys(labels))
+}
+
+// addUploadLabels adds an upload_labels object to a JSON object payload.
+// Other payloads are returned as-is.
+func addUploadLabels(payload []byte, labels map[string]string) []byte {
+	if len(labels) == 0 {
+		return payload
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return payload
+	}
+	encoded, err := json.Marshal(labels)
+	if err != nil {
+		return payload
+	}
+	fields["upload_labels"] = encoded
+
+	labeled, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return labeled
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestParseUploadLabels(t *testing.T) {
+	labels, err := parseUploadLabels([]string{"venue=Lab 2", "rig_id=7"})
+	if err != nil {
+		t.Fatalf("parseUploadLabels: %v", err)
+	}
+	if labels["venue"] != "Lab 2" || labels["rig_id"] != "7" {
+		t.Fatalf("labels = %v", labels)
+	}
+
+	for _, raw := range []string{"venue", "Venue=x", "7rig=x", "rig-id=x", "x=1", "venue=", "venue=a\nb"} {
+		if _, err := parseUploadLabels([]string{raw}); err == nil {
+			t.Errorf("parseUploadLabels(%q) succeeded", raw)
+		}
+	}
+	if _, err := parseUploadLabels([]string{"venue=a", "venue=b"}); err == nil {
+		t.Error("parseUploadLabels accepted a label twice")
+	}
+}
+
+func TestUploadLabelsInExports(t *testing.T) {
+	chdirTemp(t)
+	if err := SetUploadLabels([]string{"venue=lab-1", "experiment_id=e9"}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetUploadLabels(nil) })
+
+	rec := httptest.NewRecorder()
+	NewUploadKeyHandler(rec, httptest.NewRequest("POST", "/api/new-upload-key?label=venue=lab-2&label=rig_id=7", nil))
+	if rec.Code != 200 {
+		t.Fatalf("new upload key status = %d: %s", rec.Code, rec.Body.String())
+	}
+	var created struct {
+		UploadKey string            `json:"upload_key"`
+		Labels    map[string]string `json:"labels"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.Labels["rig_id"] != "7" {
+		t.Fatalf("new upload key labels = %v", created.Labels)
+	}
+	key := created.UploadKey
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"epoch":1700000000000,"position":{"x":0,"y":1.5,"z":0}}`,
+	})
+
+	metadata, err := readUploadMetadata(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"venue": "lab-2", "rig_id": "7", "experiment_id": "e9"}
+	if len(metadata.Labels) != len(want) || metadata.Labels["venue"] != "lab-2" || metadata.Labels["experiment_id"] != "e9" {
+		t.Fatalf("metadata labels = %v, want %v", metadata.Labels, want)
+	}
+
+	export := func(query string) string {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("export%s status = %d: %s", query, rec.Code, rec.Body.String())
+		}
+		return rec.Body.String()
+	}
+
+	for _, query := range []string{"", "?resample=10ms"} {
+		var line struct {
+			UploadLabels map[string]string `json:"upload_labels"`
+		}
+		if err := json.Unmarshal([]byte(export(query)), &line); err != nil {
+			t.Fatal(err)
+		}
+		if line.UploadLabels["rig_id"] != "7" {
+			t.Errorf("export%s upload_labels = %v", query, line.UploadLabels)
+		}
+	}
+
+	name := strings.ReplaceAll(uploadNameFromKey(key), " ", `\ `)
+	influx := export("?format=influx")
+	if prefix := "vr_position,upload=" + name + ",tracker=headset,experiment_id=e9,rig_id=7,venue=lab-2 x=0"; !strings.HasPrefix(influx, prefix) {
+		t.Errorf("influx export = %q, want prefix %q", influx, prefix)
+	}
+
+	sql := export("?format=sql")
+	for _, fragment := range []string{
+		"ALTER TABLE vr_positions ADD COLUMN IF NOT EXISTS rig_id TEXT;",
+		"qw, experiment_id, rig_id, venue) VALUES",
+		", NULL, 'e9', '7', 'lab-2')",
+	} {
+		if !strings.Contains(sql, fragment) {
+			t.Errorf("sql export is missing %q:\n%s", fragment, sql)
+		}
+	}
+
+	if parquet := export("?format=parquet"); !strings.Contains(parquet, "rig_id") || !strings.Contains(parquet, "lab-2") {
+		t.Error("parquet export is missing the label columns")
+	}
+}
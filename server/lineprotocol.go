@@ -0,0 +1,162 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	influxMeasurement = "vr_position"
+	timescaleTable    = "vr_positions"
+	timescaleBatch    = 1000
+)
+
+// sampleClock maps scene timestamps to wall-clock time. It uses the client's
+// epoch field when the upload has one; otherwise the first sample is anchored
+// at the time the upload was first received, which is accurate to within one
+// upload interval.
+func sampleClock(samples []trackerSample, receivedAt string) func(trackerSample) time.Time {
+	offset, ok := epochOffset(samples)
+	var first float64
+	if len(samples) > 0 {
+		first = samples[0].Timestamp
+	}
+	return wallClock(first, offset, ok, receivedAt)
+}
+
+// wallClock is sampleClock for the samples of an upload whose first
+// timestamp is first and whose epochs, if hasEpoch, are offset from it.
+func wallClock(first, offset float64, hasEpoch bool, receivedAt string) func(trackerSample) time.Time {
+	if hasEpoch {
+		return func(s trackerSample) time.Time {
+			return time.UnixMicro(int64(math.Round((s.Timestamp + offset) * 1000)))
+		}
+	}
+
+	anchor, err := time.Parse(time.RFC3339Nano, receivedAt)
+	if err != nil {
+		anchor = time.Unix(0, 0)
+	}
+	return func(s trackerSample) time.Time {
+		return anchor.Add(time.Duration((s.Timestamp - first) * float64(time.Millisecond)))
+	}
+}
+
+var influxTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// writeInfluxLines writes the samples each passes on as InfluxDB line
+// protocol with nanosecond timestamps, tagged by upload name, tracker and
+// the upload's labels.
+func writeInfluxLines(w io.Writer, uploadName string, labels map[string]string, each func(func(trackerSample) error) error, clock func(trackerSample) time.Time) error {
+	writer := bufio.NewWriter(w)
+	upload := influxTagEscaper.Replace(uploadName)
+	var labelTags strings.Builder
+	for _, name := range sortedLabelNames(labels) {
+		fmt.Fprintf(&labelTags, ",%s=%s", name, influxTagEscaper.Replace(labels[name]))
+	}
+	err := each(func(s trackerSample) error {
+		fmt.Fprintf(writer, "%s,upload=%s,tracker=%s%s x=%s,y=%s,z=%s",
+			influxMeasurement, upload, influxTagEscaper.Replace(s.TrackerKey), labelTags.String(),
+			formatFloat(s.Position.X), formatFloat(s.Position.Y), formatFloat(s.Position.Z))
+		if s.Rotation != nil {
+			fmt.Fprintf(writer, ",qx=%s,qy=%s,qz=%s,qw=%s",
+				formatFloat(s.Rotation.X), formatFloat(s.Rotation.Y), formatFloat(s.Rotation.Z), formatFloat(s.Rotation.W))
+		}
+		if s.Index != 0 {
+			fmt.Fprintf(writer, ",index=%di", s.Index)
+		}
+		_, err := fmt.Fprintf(writer, " %d\n", clock(s).UnixNano())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+func sqlString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+func sqlNullableFloat(f float64, valid bool) string {
+	if !valid {
+		return "NULL"
+	}
+	return formatFloat(f)
+}
+
+// writeTimescaleSQL writes the samples each passes on as a SQL script that
+// creates a Timescale hypertable if needed and inserts the rows in batches.
+// The upload's labels are TEXT columns, added to the table if missing, so
+// that uploads with different labels load into one table.
+func writeTimescaleSQL(w io.Writer, uploadName string, labels map[string]string, each func(func(trackerSample) error) error, clock func(trackerSample) time.Time) error {
+	writer := bufio.NewWriter(w)
+	fmt.Fprintf(writer, `CREATE TABLE IF NOT EXISTS %[1]s (
+	time TIMESTAMPTZ NOT NULL,
+	upload TEXT NOT NULL,
+	tracker TEXT NOT NULL,
+	record_index INTEGER,
+	x DOUBLE PRECISION,
+	y DOUBLE PRECISION,
+	z DOUBLE PRECISION,
+	qx DOUBLE PRECISION,
+	qy DOUBLE PRECISION,
+	qz DOUBLE PRECISION,
+	qw DOUBLE PRECISION
+);
+SELECT create_hypertable('%[1]s', 'time', if_not_exists => TRUE);
+`, timescaleTable)
+
+	labelNames := sortedLabelNames(labels)
+	var labelColumns, labelValues strings.Builder
+	for _, name := range labelNames {
+		fmt.Fprintf(writer, "ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s TEXT;\n", timescaleTable, name)
+		labelColumns.WriteString(", " + name)
+		labelValues.WriteString(", " + sqlString(labels[name]))
+	}
+
+	upload := sqlString(uploadName)
+	rows := 0
+	err := each(func(s trackerSample) error {
+		if rows%timescaleBatch == 0 {
+			if rows > 0 {
+				writer.WriteString(";\n")
+			}
+			fmt.Fprintf(writer, "INSERT INTO %s (time, upload, tracker, record_index, x, y, z, qx, qy, qz, qw%s) VALUES\n", timescaleTable, labelColumns.String())
+		} else {
+			writer.WriteString(",\n")
+		}
+		rows++
+
+		var q quat
+		if s.Rotation != nil {
+			q = *s.Rotation
+		}
+		index := "NULL"
+		if s.Index != 0 {
+			index = strconv.Itoa(s.Index)
+		}
+		_, err := fmt.Fprintf(writer, "(%s, %s, %s, %s, %s, %s, %s, %s, %s, %s, %s%s)",
+			sqlString(clock(s).UTC().Format(time.RFC3339Nano)), upload, sqlString(s.TrackerKey), index,
+			formatFloat(s.Position.X), formatFloat(s.Position.Y), formatFloat(s.Position.Z),
+			sqlNullableFloat(q.X, s.Rotation != nil), sqlNullableFloat(q.Y, s.Rotation != nil),
+			sqlNullableFloat(q.Z, s.Rotation != nil), sqlNullableFloat(q.W, s.Rotation != nil), labelValues.String())
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if rows > 0 {
+		writer.WriteString(";\n")
+	}
+	return writer.Flush()
+}
@@ -0,0 +1,242 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sessions are linked to the pseudonymous id of their participant, and get
+// other labels such as the study or condition, after they were recorded.
+// The linked labels live next to the upload in a .labels.json file, since
+// the metadata line is only written once, and override the labels stored
+// with the upload. The participant id is the label "participant". Exports,
+// the upload list and erasure all see the combined labels.
+
+// participantLabel is the label that holds the participant id.
+const participantLabel = "participant"
+
+const maxParticipantIDLength = 64
+
+var linkageMutex sync.Mutex
+
+// linkedLabels is the content of a .labels.json file. An empty value hides
+// a label stored with the upload.
+type linkedLabels struct {
+	Labels    map[string]string `json:"labels"`
+	UpdatedAt string            `json:"updated_at"`
+}
+
+func linkedLabelsPath(uploadKey string) string {
+	return strings.TrimSuffix(uploadFilePath(uploadKey), ".csv") + ".labels.json"
+}
+
+func loadLinkedLabels(uploadKey string) (linkedLabels, error) {
+	data, err := os.ReadFile(linkedLabelsPath(uploadKey))
+	if os.IsNotExist(err) {
+		return linkedLabels{Labels: map[string]string{}}, nil
+	}
+	if err != nil {
+		return linkedLabels{}, fmt.Errorf("read linked labels: %w", err)
+	}
+	var linked linkedLabels
+	if err := json.Unmarshal(data, &linked); err != nil {
+		return linkedLabels{}, fmt.Errorf("decode linked labels: %w", err)
+	}
+	if linked.Labels == nil {
+		linked.Labels = map[string]string{}
+	}
+	return linked, nil
+}
+
+// sessionLabels returns the labels of an upload: those stored with it,
+// overridden by the linked ones. Failures to read the linked labels are
+// logged and leave the stored labels.
+func sessionLabels(uploadKey string, stored map[string]string) map[string]string {
+	linkageMutex.Lock()
+	linked, err := loadLinkedLabels(uploadKey)
+	linkageMutex.Unlock()
+	if err != nil {
+		log.Printf("failed to load linked labels key_hash=%s: %v", uploadKeyHash(uploadKey), err)
+		return stored
+	}
+	return combineLabels(stored, linked.Labels)
+}
+
+func combineLabels(stored, linked map[string]string) map[string]string {
+	if len(linked) == 0 {
+		return stored
+	}
+	labels := maps.Clone(stored)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	for name, value := range linked {
+		if value == "" {
+			delete(labels, name)
+		} else {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// parseParticipantID accepts ids that are safe to show and put in file
+// names: letters, digits, dots, hyphens and underscores.
+func parseParticipantID(raw string) (string, error) {
+	id := strings.TrimSpace(raw)
+	if id == "" || len(id) > maxParticipantIDLength {
+		return "", fmt.Errorf("invalid participant id: must be 1 to %d characters", maxParticipantIDLength)
+	}
+	for _, r := range id {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') && (r < '0' || r > '9') && r != '.' && r != '-' && r != '_' {
+			return "", fmt.Errorf("invalid participant id %q: only letters, digits, dots, hyphens and underscores are allowed", raw)
+		}
+	}
+	return id, nil
+}
+
+// labelsPatch is the body of PATCH /uploads/{key}/labels, a JSON merge
+// patch: null removes a label, or the participant.
+type labelsPatch struct {
+	Participant json.RawMessage            `json:"participant"`
+	Labels      map[string]json.RawMessage `json:"labels"`
+}
+
+// apply validates the patch and applies it to linked.
+func (p labelsPatch) apply(linked map[string]string) error {
+	set := func(name string, raw json.RawMessage) error {
+		if string(raw) == "null" {
+			linked[name] = ""
+			return nil
+		}
+		var value string
+		if err := json.Unmarshal(raw, &value); err != nil {
+			return fmt.Errorf("invalid value of label %q: must be a string or null", name)
+		}
+		if name == participantLabel {
+			id, err := parseParticipantID(value)
+			if err != nil {
+				return err
+			}
+			value = id
+		}
+		if _, _, err := parseUploadLabel(name + "=" + value); err != nil {
+			return err
+		}
+		linked[name] = value
+		return nil
+	}
+
+	for _, name := range slices.Sorted(maps.Keys(p.Labels)) {
+		if err := set(name, p.Labels[name]); err != nil {
+			return err
+		}
+	}
+	if p.Participant != nil {
+		if _, ok := p.Labels[participantLabel]; ok {
+			return errors.New("give the participant either as participant or as label, not both")
+		}
+		if err := set(participantLabel, p.Participant); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UploadLabelsHandler returns the labels of an upload (GET) or changes them
+// with a JSON merge patch such as {"participant": "P017", "labels":
+// {"study": "A", "venue": null}} (PATCH).
+func UploadLabelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPatch {
+		panic("only GET and PATCH allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read metadata for labels: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	linkageMutex.Lock()
+	defer linkageMutex.Unlock()
+	linked, err := loadLinkedLabels(uploadKey)
+	if err != nil {
+		log.Printf("failed to load linked labels: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read labels")
+		return
+	}
+
+	if r.Method == http.MethodPatch {
+		var patch labelsPatch
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 64*1024)).Decode(&patch); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid labels JSON: %v", err))
+			return
+		}
+		if err := patch.apply(linked.Labels); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		if combined := combineLabels(metadata.Labels, linked.Labels); len(combined) > maxUploadLabels {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("too many labels: at most %d are allowed", maxUploadLabels))
+			return
+		}
+		linked.UpdatedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		if err := storeLinkedLabels(uploadKey, linked); err != nil {
+			log.Printf("failed to store linked labels: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to store labels")
+			return
+		}
+		log.Printf("labels changed upload_name=%q key_hash=%s", uploadNameFromKey(uploadKey), uploadKeyHash(uploadKey))
+	}
+
+	labels := combineLabels(metadata.Labels, linked.Labels)
+	if labels == nil {
+		labels = map[string]string{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"participant": labels[participantLabel],
+		"labels":      labels,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write labels response: %v", err)
+	}
+}
+
+func storeLinkedLabels(uploadKey string, linked linkedLabels) error {
+	data, err := json.MarshalIndent(linked, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode linked labels: %w", err)
+	}
+	// write to a temporary file first so a crash never leaves a torn file
+	filePath := linkedLabelsPath(uploadKey)
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("write linked labels: %w", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("replace linked labels: %w", err)
+	}
+	return nil
+}
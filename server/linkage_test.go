@@ -0,0 +1,77 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func patchLabels(t *testing.T, uploadKey, body string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("PATCH", "/api/uploads/"+uploadKey+"/labels", strings.NewReader(body))
+	req.SetPathValue("key", uploadKey)
+	rec := httptest.NewRecorder()
+	UploadLabelsHandler(rec, req)
+	var response map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatalf("labels response %q: %v", rec.Body, err)
+	}
+	return rec.Code, response
+}
+
+func TestUploadLabelsPatch(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	registerUploadKey(key)
+	uploadKeys.setLabels(key, map[string]string{"venue": "lab-1", "rig_id": "7"})
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+
+	status, response := patchLabels(t, key, `{"participant":"P017","labels":{"study":"A","venue":null}}`)
+	if status != 200 {
+		t.Fatalf("patch status = %d: %v", status, response)
+	}
+	labels := response["labels"].(map[string]any)
+	if response["participant"] != "P017" || labels["study"] != "A" || labels["rig_id"] != "7" || labels["venue"] != nil {
+		t.Fatalf("labels after patch = %v", response)
+	}
+
+	// labels not in the patch stay, null undoes a participant
+	status, response = patchLabels(t, key, `{"participant":null,"labels":{"venue":"lab-2"}}`)
+	labels = response["labels"].(map[string]any)
+	if status != 200 || response["participant"] != "" || labels["study"] != "A" || labels["venue"] != "lab-2" {
+		t.Fatalf("labels after second patch = %d %v", status, response)
+	}
+
+	for _, body := range []string{
+		`{"participant":"P 017"}`,
+		`{"labels":{"Study":"A"}}`,
+		`{"labels":{"study":7}}`,
+		`{"participant":"P1","labels":{"participant":"P2"}}`,
+	} {
+		if status, _ := patchLabels(t, key, body); status != 400 {
+			t.Errorf("patch %s: status = %d, want 400", body, status)
+		}
+	}
+
+	if status, _ := patchLabels(t, newTestUploadKey(t), `{"participant":"P017"}`); status != 404 {
+		t.Errorf("patch of a missing upload: status = %d, want 404", status)
+	}
+}
+
+func TestLinkedLabelsInExport(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+	if status, response := patchLabels(t, key, `{"participant":"P017"}`); status != 200 {
+		t.Fatalf("patch status = %d: %v", status, response)
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	ExportHandler(rec, req)
+	if !strings.Contains(rec.Body.String(), `"upload_labels":{"participant":"P017"}`) {
+		t.Fatalf("export = %d %s", rec.Code, rec.Body)
+	}
+}
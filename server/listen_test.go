@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestListenUnix(t *testing.T) {
+	// socket paths are limited to ~100 bytes, so avoid t.TempDir's long names
+	dir, err := os.MkdirTemp("", "sock")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "hrdemo.sock")
+
+	listener, err := ListenUnix(path, 0o660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0o660 {
+		t.Fatalf("socket mode = %v (%v), want 0660", info.Mode().Perm(), err)
+	}
+
+	if _, err := ListenUnix(path, 0o660); err == nil {
+		t.Fatal("expected an error for a socket in use")
+	}
+
+	// simulate a crash that leaves the socket file behind
+	listener.(*net.UnixListener).SetUnlinkOnClose(false)
+	listener.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("stale socket missing: %v", err)
+	}
+
+	listener, err = ListenUnix(path, 0o600)
+	if err != nil {
+		t.Fatalf("stale socket not cleaned up: %v", err)
+	}
+	listener.Close()
+
+	regular := filepath.Join(dir, "regular")
+	os.WriteFile(regular, nil, 0o644)
+	if _, err := ListenUnix(regular, 0o660); err == nil {
+		t.Fatal("expected an error for a path that is not a socket")
+	}
+}
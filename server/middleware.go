@@ -0,0 +1,111 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const requestIDHeader = "X-Request-Id"
+
+// Client-supplied request ids are reused only if they are short and safe to
+// log verbatim.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+func newRequestID() string {
+	buf := make([]byte, 8)
+	rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// uploadKeyHash identifies an upload key in logs without revealing it.
+func uploadKeyHash(uploadKey string) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(uploadKey)))
+	return hex.EncodeToString(sum[:6])
+}
+
+// redactRequestPath returns the request path with any upload key replaced by
+// its hash, and the hash of the key the request names: the one in its
+// X-Upload-Key header, else the first in its path ("-" if there is none).
+// Paths are redacted even with the header, which needn't hold the same key.
+func redactRequestPath(r *http.Request) (string, string) {
+	hash := "-"
+	if key := presentedUploadKey(r); key != "" {
+		hash = uploadKeyHash(key)
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+	for i := 1; i < len(segments); i++ {
+		if segments[i-1] == "uploads" && len(segments[i]) == uploadKeyHexLength {
+			segmentHash := uploadKeyHash(segments[i])
+			segments[i] = "{" + segmentHash + "}"
+			if hash == "-" {
+				hash = segmentHash
+			}
+		}
+	}
+	return strings.Join(segments, "/"), hash
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (w *loggingResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *loggingResponseWriter) Write(p []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(p)
+	w.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer, which the
+// streaming handlers need for flushing.
+func (w *loggingResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// RequestLogger assigns every request an id, taken from the X-Request-Id
+// header if the client sent a usable one, echoes it in the response (and in
+// error bodies), and writes one access log line per request.
+func RequestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newRequestID()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		defer func() {
+			status := lw.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			path, keyHash := redactRequestPath(r)
+			log.Printf(
+				"request id=%s method=%s path=%q status=%d bytes=%d duration=%s key_hash=%s client=%s",
+				requestID, r.Method, path, status, lw.bytes, time.Since(start).Round(time.Microsecond), keyHash, loggedClientIP(r),
+			)
+		}()
+
+		next.ServeHTTP(lw, r)
+	})
+}
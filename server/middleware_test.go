@@ -0,0 +1,57 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRequestLogger(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux)
+	handler := RequestLogger(mux)
+
+	req := httptest.NewRequest("GET", "/api/v1/uploads/"+key+"/summary", nil)
+	req.Header.Set("X-Request-Id", "headset-42")
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+
+	if got := rec.Header().Get("X-Request-Id"); got != "headset-42" {
+		t.Fatalf("X-Request-Id = %q, want the client's id", got)
+	}
+	var response errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || response.Error.RequestID != "headset-42" {
+		t.Fatalf("error body lacks request id: %s", rec.Body.String())
+	}
+
+	line := logs.String()
+	for _, want := range []string{"id=headset-42", "method=GET", "status=404", "key_hash=" + uploadKeyHash(key)} {
+		if !strings.Contains(line, want) {
+			t.Fatalf("access log %q missing %q", line, want)
+		}
+	}
+	if strings.Contains(line, key) {
+		t.Fatalf("access log leaks the upload key: %q", line)
+	}
+
+	// unusable ids are replaced
+	req = httptest.NewRequest("GET", "/api/v1/uploads/"+key+"/summary", nil)
+	req.Header.Set("X-Request-Id", "bad id\n")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-Id"); got == "" || got == "bad id\n" {
+		t.Fatalf("X-Request-Id = %q, want a generated id", got)
+	}
+}
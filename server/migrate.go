@@ -0,0 +1,181 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// rewriteBatchRecords is how many records at most go into each zstd frame
+// when a compressed upload is rewritten.
+const rewriteBatchRecords = 1000
+
+// MigrateUpload rewrites a v1 upload as v2 and reports whether it did; v2
+// uploads are left alone. With dryRun it only reports whether it would. v1
+// files don't know when or from which device a record arrived, so those
+// columns stay empty. The metadata gets a migrated_at time.
+//
+// Uploads must not be written to while they are migrated, so run it with the
+// server stopped.
+func MigrateUpload(filePath string, dryRun bool) (bool, error) {
+	metadata, err := readUploadMetadataMap(filePath)
+	if err != nil {
+		return false, err
+	}
+	if version, _ := metadata["format_version"].(float64); version >= formatV2 {
+		return false, nil
+	}
+	if _, err := os.Stat(coldInfoPath(filePath)); err == nil {
+		// left as it is rather than brought back from cold storage
+		return false, nil
+	}
+	if dryRun {
+		return true, nil
+	}
+	metadata["format_version"] = formatV2
+	metadata["migrated_at"] = time.Now().UTC().Format(time.RFC3339Nano)
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return false, fmt.Errorf("encode metadata: %w", err)
+	}
+
+	err = rewriteUpload(filePath, metadataJSON, func(yield func(recordLine) error) error {
+		return scanUploadFile(filePath, func(index int, payload []byte) error {
+			return yield(recordLine{Index: index, Payload: payload})
+		})
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// rewriteUpload replaces an upload with metadataJSON and the records that
+// each yields, renumbered from 1 and written in the format version
+// metadataJSON declares, then rebuilds its record index. Compressed uploads
+// stay compressed.
+func rewriteUpload(filePath string, metadataJSON []byte, each func(yield func(recordLine) error) error) error {
+	version := metadataFormatVersion(metadataJSON)
+	compressed, err := isCompressedUpload(filePath)
+	if err != nil {
+		return err
+	}
+	if compressed {
+		err = rewriteCompressedUpload(filePath, metadataJSON, each)
+	} else {
+		err = writeFileAtomic(filePath, func(w *bufio.Writer) error {
+			w.Write(metadataJSON)
+			w.WriteByte('\n')
+			index := 0
+			return each(func(record recordLine) error {
+				index++
+				return writeRecordLines(w, formatRecordLines(version, index, record.columns(), []string{string(record.Payload)}))
+			})
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	if err := rebuildRecordIndex(filePath); err != nil {
+		return fmt.Errorf("rebuild record index: %w", err)
+	}
+	refreshUploadChecksum(filePath)
+	forgetQuotaUsage()
+	return nil
+}
+
+// rewriteCompressedUpload writes a new compressed file with its own frame
+// index next to the upload, then moves both into place. Records that arrived
+// together stay in one member.
+func rewriteCompressedUpload(filePath string, metadataJSON []byte, each func(yield func(recordLine) error) error) error {
+	tmpPath := filepath.Join(filepath.Dir(filePath), ".rewrite-"+filepath.Base(filePath))
+	os.Remove(tmpPath)
+	os.Remove(frameIndexPath(tmpPath))
+
+	var batch []string
+	var columns recordColumns
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		err := appendCompressedBatch(tmpPath, metadataJSON, columns, batch)
+		batch = batch[:0]
+		return err
+	}
+	err := each(func(record recordLine) error {
+		if record.columns() != columns || len(batch) == rewriteBatchRecords {
+			if err := flush(); err != nil {
+				return err
+			}
+			columns = record.columns()
+		}
+		batch = append(batch, string(record.Payload))
+		return nil
+	})
+	if err == nil {
+		err = flush()
+	}
+	if err == nil {
+		err = os.Rename(frameIndexPath(tmpPath), frameIndexPath(filePath))
+	}
+	if err == nil {
+		err = os.Rename(tmpPath, filePath)
+	}
+	os.Remove(checksumPath(tmpPath))
+	if err != nil {
+		os.Remove(tmpPath)
+		os.Remove(frameIndexPath(tmpPath))
+		return fmt.Errorf("rewrite compressed upload: %w", err)
+	}
+	return nil
+}
+
+// MigrateUploads migrates every v1 upload in the upload directory and returns
+// the paths of those it migrated. With dryRun it only lists them.
+func MigrateUploads(dryRun bool) ([]string, error) {
+	keys, err := listUploadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	var migrated []string
+	for _, uploadKey := range keys {
+		filePath := uploadFilePath(uploadKey)
+		ok, err := MigrateUpload(filePath, dryRun)
+		if err != nil {
+			return migrated, fmt.Errorf("%s: %w", filePath, err)
+		}
+		if ok {
+			migrated = append(migrated, filePath)
+		}
+	}
+	return migrated, nil
+}
+
+// readUploadMetadataMap reads the metadata line of an upload keeping every
+// field, including those uploadMetadata doesn't know.
+func readUploadMetadataMap(filePath string) (map[string]any, error) {
+	file, err := openUploadFile(filePath)
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open upload file: %w", err)
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReaderSize(file, 4096).ReadString('\n')
+	if err != nil && line == "" {
+		return nil, fmt.Errorf("read metadata line: %w", err)
+	}
+	var metadata map[string]any
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &metadata); err != nil {
+		return nil, fmt.Errorf("decode metadata line: %w", err)
+	}
+	return metadata, nil
+}
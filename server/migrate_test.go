@@ -0,0 +1,68 @@
+package server
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMigrateUploads(t *testing.T) {
+	chdirTemp(t)
+	if err := SetUploadFormatVersion(formatV1); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { uploadFormatVersion = formatV2 })
+
+	plain := newTestUploadKey(t)
+	compressed := newTestUploadKey(t)
+	entries := []string{`{"trackerKey":"head","timestamp":1}`, `{"bpm":70}`}
+	simulateUpload(t, plain, entries)
+	compressStorage = true
+	simulateUpload(t, compressed, entries)
+	compressStorage = false
+	uploadFormatVersion = formatV2
+
+	// v1 uploads stay v1 when appended to
+	simulateUpload(t, plain, []string{`{"bpm":71}`})
+	raw, _, _ := readUploadFile(t, uploadFilePath(plain))
+	if metadataFormatVersion([]byte(raw)) != formatV1 {
+		t.Fatalf("appended v1 upload metadata = %s", raw)
+	}
+
+	pending, err := MigrateUploads(true)
+	if err != nil || len(pending) != 2 {
+		t.Fatalf("dry run = %q, %v", pending, err)
+	}
+	if version, _ := uploadFormat(uploadFilePath(plain)); version != formatV1 {
+		t.Fatalf("dry run migrated the upload")
+	}
+
+	migrated, err := MigrateUploads(false)
+	if err != nil || len(migrated) != 2 {
+		t.Fatalf("migrated = %q, %v", migrated, err)
+	}
+
+	_, metadata, records := readUploadFile(t, uploadFilePath(plain))
+	if metadata["format_version"] != float64(formatV2) || metadata["migrated_at"] == nil || metadata["upload_key"] != plain {
+		t.Fatalf("migrated metadata = %v", metadata)
+	}
+	assertRecords(t, records, append(entries, `{"bpm":71}`))
+
+	// both keep working as v2 uploads
+	simulateUpload(t, compressed, []string{`{"bpm":72}`})
+	var payloads []string
+	err = scanUploadFile(uploadFilePath(compressed), func(index int, payload []byte) error {
+		payloads = append(payloads, string(payload))
+		return nil
+	})
+	if err != nil || strings.Join(payloads, "\n") != strings.Join(append(entries, `{"bpm":72}`), "\n") {
+		t.Fatalf("compressed records = %q, %v", payloads, err)
+	}
+	tail, err := readTailRecords(uploadFilePath(compressed), 1)
+	if err != nil || len(tail) != 1 || tail[0].Index != 3 {
+		t.Fatalf("compressed tail = %+v, %v", tail, err)
+	}
+
+	if migrated, err := MigrateUploads(false); err != nil || len(migrated) != 0 {
+		t.Fatalf("second migration = %q, %v", migrated, err)
+	}
+}
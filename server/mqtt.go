@@ -0,0 +1,329 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	mqttConnect    = 1
+	mqttConnack    = 2
+	mqttPublish    = 3
+	mqttPuback     = 4
+	mqttSubscribe  = 8
+	mqttSuback     = 9
+	mqttPingreq    = 12
+	mqttPingresp   = 13
+	mqttKeepalive  = 30 * time.Second
+	mqttMaxBackoff = time.Minute
+
+	// mqttKeyPlaceholder marks the topic level that carries the upload key.
+	mqttKeyPlaceholder = "{key}"
+)
+
+// mqttIngest subscribes to an MQTT broker and stores every message as a batch
+// of NDJSON records for the upload key found in its topic.
+type mqttIngest struct {
+	addr     string
+	username string
+	password string
+	filter   string
+	keyLevel int
+}
+
+// StartMQTTIngest connects to broker (tcp://[user:pass@]host:1883) and
+// subscribes to topicPattern, in which the level holding the upload key is
+// written as {key}, e.g. "sensors/{key}/records". Messages go through the same
+// key checks, validation and storage as /api/upload; they can't be signed,
+// carry a client certificate or be bound to a client, so all are refused
+// while the server requires one of these. The connection is retried in the background for as long as
+// the server runs.
+func StartMQTTIngest(broker, topicPattern string) error {
+	ingest, err := newMQTTIngest(broker, topicPattern)
+	if err != nil {
+		return err
+	}
+	go ingest.run()
+	return nil
+}
+
+func newMQTTIngest(broker, topicPattern string) (*mqttIngest, error) {
+	u, err := url.Parse(broker)
+	if err != nil || (u.Scheme != "tcp" && u.Scheme != "mqtt") || u.Host == "" {
+		return nil, fmt.Errorf("invalid mqtt broker %q: expected tcp://host:port", broker)
+	}
+
+	ingest := &mqttIngest{addr: u.Host, keyLevel: -1}
+	if u.Port() == "" {
+		ingest.addr = net.JoinHostPort(u.Hostname(), "1883")
+	}
+	if u.User != nil {
+		ingest.username = u.User.Username()
+		ingest.password, _ = u.User.Password()
+	}
+
+	levels := strings.Split(topicPattern, "/")
+	for i, level := range levels {
+		if level == mqttKeyPlaceholder {
+			if ingest.keyLevel >= 0 {
+				return nil, errors.New("invalid mqtt topic: {key} must appear once")
+			}
+			ingest.keyLevel = i
+			levels[i] = "+"
+		}
+	}
+	if ingest.keyLevel < 0 {
+		return nil, errors.New("invalid mqtt topic: must contain a {key} level")
+	}
+	ingest.filter = strings.Join(levels, "/")
+
+	return ingest, nil
+}
+
+func (m *mqttIngest) run() {
+	backoff := time.Second
+	for {
+		start := time.Now()
+		err := m.session()
+		if time.Since(start) > mqttMaxBackoff {
+			backoff = time.Second
+		}
+		log.Printf("mqtt connection to %s lost, retrying in %s: %v", m.addr, backoff, err)
+		time.Sleep(backoff)
+		backoff = min(backoff*2, mqttMaxBackoff)
+	}
+}
+
+// session runs one broker connection until it fails.
+func (m *mqttIngest) session() error {
+	conn, err := net.DialTimeout("tcp", m.addr, 10*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	if err := m.handshake(conn, reader); err != nil {
+		return err
+	}
+	log.Printf("mqtt ingest subscribed to %q on %s", m.filter, m.addr)
+
+	// ping at the keepalive interval; a failed write ends the read loop below
+	// by closing the connection
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		ticker := time.NewTicker(mqttKeepalive / 2)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := writeMQTTPacket(conn, mqttPingreq<<4, nil); err != nil {
+					conn.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepalive * 2))
+		header, body, err := readMQTTPacket(reader)
+		if err != nil {
+			return err
+		}
+		switch header >> 4 {
+		case mqttPublish:
+			if err := m.handlePublish(conn, header, body); err != nil {
+				return err
+			}
+		case mqttPingresp:
+		default:
+			return fmt.Errorf("unexpected mqtt packet type %d", header>>4)
+		}
+	}
+}
+
+func (m *mqttIngest) handshake(conn net.Conn, reader *bufio.Reader) error {
+	var connect bytes.Buffer
+	writeMQTTString(&connect, "MQTT")
+	connect.WriteByte(4) // protocol level 3.1.1
+	flags := byte(0x02)  // clean session
+	if m.username != "" {
+		flags |= 0x80
+	}
+	if m.password != "" {
+		flags |= 0x40
+	}
+	connect.WriteByte(flags)
+	binary.Write(&connect, binary.BigEndian, uint16(mqttKeepalive/time.Second))
+	writeMQTTString(&connect, fmt.Sprintf("hr-demo-app-%d", time.Now().UnixNano()%1e9))
+	if m.username != "" {
+		writeMQTTString(&connect, m.username)
+	}
+	if m.password != "" {
+		writeMQTTString(&connect, m.password)
+	}
+	if err := writeMQTTPacket(conn, mqttConnect<<4, connect.Bytes()); err != nil {
+		return err
+	}
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	header, body, err := readMQTTPacket(reader)
+	if err != nil {
+		return err
+	}
+	if header>>4 != mqttConnack || len(body) != 2 || body[1] != 0 {
+		return fmt.Errorf("mqtt connect refused: % x", body)
+	}
+
+	var subscribe bytes.Buffer
+	binary.Write(&subscribe, binary.BigEndian, uint16(1))
+	writeMQTTString(&subscribe, m.filter)
+	subscribe.WriteByte(1) // QoS 1, so messages are acked only once stored
+	if err := writeMQTTPacket(conn, mqttSubscribe<<4|0x02, subscribe.Bytes()); err != nil {
+		return err
+	}
+
+	header, body, err = readMQTTPacket(reader)
+	if err != nil {
+		return err
+	}
+	if header>>4 != mqttSuback || len(body) != 3 || body[2] == 0x80 {
+		return fmt.Errorf("mqtt subscribe to %q refused", m.filter)
+	}
+	return nil
+}
+
+// handlePublish stores one message. Invalid messages are logged and acked
+// anyway, since redelivering them would never succeed.
+func (m *mqttIngest) handlePublish(conn net.Conn, header byte, body []byte) error {
+	topic, rest, err := readMQTTString(body)
+	if err != nil {
+		return err
+	}
+
+	qos := (header >> 1) & 0x03
+	var packetID []byte
+	if qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("malformed mqtt publish packet")
+		}
+		packetID, rest = rest[:2], rest[2:]
+	}
+
+	if err := m.ingest(topic, rest); err != nil {
+		log.Printf("mqtt message on %q rejected: %v", topic, err)
+	}
+
+	if qos > 0 {
+		return writeMQTTPacket(conn, mqttPuback<<4, packetID)
+	}
+	return nil
+}
+
+func (m *mqttIngest) ingest(topic string, payload []byte) error {
+	levels := strings.Split(topic, "/")
+	if m.keyLevel >= len(levels) {
+		return errors.New("topic has no upload key level")
+	}
+	uploadKey, err := parseUploadKey(levels[m.keyLevel])
+	if err != nil {
+		return err
+	}
+
+	extraMetadata, status, _, message := authorizeUpload(nil, uploadKey)
+	if status != 0 {
+		return errors.New(message)
+	}
+
+	lines, err := readRecordLines(bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+
+	receivedAt := time.Now().UTC()
+	if _, err := ingestRecords(context.Background(), uploadKey, "mqtt", receivedAt, lines, extraMetadata, ingestOptions{}); err != nil {
+		return fmt.Errorf("failed to store upload: %w", err)
+	}
+
+	log.Printf("upload received via mqtt upload_name=%q records=%d", uploadNameFromKey(uploadKey), len(lines))
+	return nil
+}
+
+func writeMQTTString(buf *bytes.Buffer, s string) {
+	binary.Write(buf, binary.BigEndian, uint16(len(s)))
+	buf.WriteString(s)
+}
+
+func readMQTTString(data []byte) (string, []byte, error) {
+	if len(data) < 2 {
+		return "", nil, errors.New("malformed mqtt string")
+	}
+	n := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+n {
+		return "", nil, errors.New("malformed mqtt string")
+	}
+	return string(data[2 : 2+n]), data[2+n:], nil
+}
+
+func writeMQTTPacket(w io.Writer, header byte, body []byte) error {
+	packet := []byte{header}
+	for n := len(body); ; {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if n == 0 {
+			break
+		}
+	}
+	_, err := w.Write(append(packet, body...))
+	return err
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length, multiplier := 0, 1
+	for i := 0; ; i++ {
+		if i == 4 {
+			return 0, nil, errors.New("malformed mqtt remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length += int(b&0x7f) * multiplier
+		multiplier *= 128
+		if b&0x80 == 0 {
+			break
+		}
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io/fs"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMQTTIngest(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	ingest, err := newMQTTIngest("tcp://"+listener.Addr().String(), "sensors/{key}/records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ingest.filter != "sensors/+/records" {
+		t.Fatalf("subscription filter = %q", ingest.filter)
+	}
+	go ingest.session()
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+
+	if header, _, err := readMQTTPacket(reader); err != nil || header>>4 != mqttConnect {
+		t.Fatalf("expected CONNECT, got %x (%v)", header, err)
+	}
+	writeMQTTPacket(conn, mqttConnack<<4, []byte{0, 0})
+
+	header, body, err := readMQTTPacket(reader)
+	if err != nil || header>>4 != mqttSubscribe {
+		t.Fatalf("expected SUBSCRIBE, got %x (%v)", header, err)
+	}
+	writeMQTTPacket(conn, mqttSuback<<4, append(body[:2:2], 1))
+
+	var publish bytes.Buffer
+	writeMQTTString(&publish, "sensors/"+key+"/records")
+	binary.Write(&publish, binary.BigEndian, uint16(7))
+	publish.WriteString(`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":0,"z":0}}` + "\n" +
+		`{"trackerKey":"headset","timestamp":10,"position":{"x":1,"y":0,"z":0}}`)
+	writeMQTTPacket(conn, mqttPublish<<4|0x02, publish.Bytes())
+
+	// the ack is only sent once the records are stored
+	header, body, err = readMQTTPacket(reader)
+	if err != nil || header>>4 != mqttPuback || binary.BigEndian.Uint16(body) != 7 {
+		t.Fatalf("expected PUBACK 7, got %x % x (%v)", header, body, err)
+	}
+
+	samples, err := readTrackerSamples(key)
+	if err != nil || len(samples["headset"]) != 2 {
+		t.Fatalf("mqtt records not stored: %v %+v", err, samples)
+	}
+	metadata, err := readUploadMetadata(uploadFilePath(key))
+	if err != nil || metadata.UserAgent != "mqtt" {
+		t.Fatalf("unexpected metadata: %v %+v", err, metadata)
+	}
+
+	if _, err := newMQTTIngest("tcp://localhost", "sensors/records"); err == nil {
+		t.Fatal("expected error for topic without {key}")
+	}
+}
+
+func TestMQTTIngestKeyChecks(t *testing.T) {
+	chdirTemp(t)
+	ingest, err := newMQTTIngest("tcp://localhost", "sensors/{key}/records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := []byte(`{"trackerKey":"headset","timestamp":0}`)
+
+	revoked := newTestUploadKey(t)
+	if _, err := uploadKeys.revoke(revoked, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if err := ingest.ingest("sensors/"+revoked+"/records", record); err == nil || !strings.Contains(err.Error(), "revoked") {
+		t.Fatalf("revoked key: %v", err)
+	}
+	if _, err := os.Stat(uploadFilePath(revoked)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("upload of revoked key stored: %v", err)
+	}
+
+	// messages can't be signed
+	SetSignedUploads(true)
+	t.Cleanup(func() { SetSignedUploads(false) })
+	key := newTestUploadKey(t)
+	if err := ingest.ingest("sensors/"+key+"/records", record); err == nil {
+		t.Fatal("unsigned message stored while uploads must be signed")
+	}
+	if _, err := os.Stat(uploadFilePath(key)); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("unsigned upload stored: %v", err)
+	}
+}
@@ -0,0 +1,503 @@
+package server
+
+import (
+	"bufio"
+	"cmp"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A multi-device session groups the uploads of several devices worn by one
+// participant, e.g. two headsets and a chest strap. Each device keeps
+// uploading with its own upload key; binding the key to the session under a
+// device id makes its records part of the session's merged follow and
+// export, tagged with that device id.
+//
+// The session id grants read access to every bound device, like an upload
+// key does for one upload, so it is as long and as random.
+
+const (
+	sessionIDHexLength = 64
+	maxDeviceIDLength  = 64
+)
+
+type multiDeviceSession struct {
+	SessionID string        `json:"session_id"`
+	CreatedAt string        `json:"created_at"`
+	Devices   []boundDevice `json:"devices"`
+}
+
+type boundDevice struct {
+	DeviceID  string `json:"device_id"`
+	UploadKey string `json:"upload_key"`
+	BoundAt   string `json:"bound_at"`
+
+	// Clock is the device's estimated offset to server time, if any; see
+	// clocksync.go.
+	Clock *clockOffset `json:"clock,omitempty"`
+}
+
+// deviceRecord is a stored record of one device of a multi-device session.
+type deviceRecord struct {
+	deviceID string
+	index    int
+	payload  []byte
+	time     float64
+}
+
+var multiDeviceSessionsMutex sync.Mutex
+
+var (
+	errSessionNotFound    = errors.New("session not found")
+	errDeviceAlreadyBound = errors.New("device_id is already bound to another upload key")
+	errDeviceNotFound     = errors.New("device_id is not bound to this session")
+)
+
+func multiDeviceSessionPath(sessionID string) string {
+	return filepath.Join(uploadDir, "sessions", sessionID+".json")
+}
+
+func parseSessionID(raw string) (string, error) {
+	sessionID := strings.ToLower(strings.TrimSpace(raw))
+	if len(sessionID) != sessionIDHexLength {
+		return "", fmt.Errorf("invalid session id length: expected %d-character hex string", sessionIDHexLength)
+	}
+	if _, err := hex.DecodeString(sessionID); err != nil {
+		return "", errors.New("invalid session id format: must be hexadecimal")
+	}
+	return sessionID, nil
+}
+
+// parseDeviceID accepts lower-case letters, digits, hyphens and underscores,
+// so that device ids can be used in follow positions and file names.
+func parseDeviceID(raw string) (string, error) {
+	deviceID := strings.ToLower(strings.TrimSpace(raw))
+	if deviceID == "" {
+		return "", errors.New("missing device_id")
+	}
+	if len(deviceID) > maxDeviceIDLength {
+		return "", fmt.Errorf("invalid device_id: must be at most %d characters", maxDeviceIDLength)
+	}
+	for _, r := range deviceID {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return "", fmt.Errorf("invalid device_id %q: only letters, digits, hyphens and underscores are allowed", raw)
+		}
+	}
+	return deviceID, nil
+}
+
+func loadMultiDeviceSession(sessionID string) (multiDeviceSession, error) {
+	data, err := os.ReadFile(multiDeviceSessionPath(sessionID))
+	if os.IsNotExist(err) {
+		return multiDeviceSession{}, errSessionNotFound
+	}
+	if err != nil {
+		return multiDeviceSession{}, fmt.Errorf("read session: %w", err)
+	}
+
+	var session multiDeviceSession
+	if err := json.Unmarshal(data, &session); err != nil {
+		return multiDeviceSession{}, fmt.Errorf("decode session: %w", err)
+	}
+	return session, nil
+}
+
+func storeMultiDeviceSession(session multiDeviceSession) error {
+	data, err := json.MarshalIndent(session, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode session: %w", err)
+	}
+
+	filePath := multiDeviceSessionPath(session.SessionID)
+	if err := os.MkdirAll(filepath.Dir(filePath), 0o755); err != nil {
+		return fmt.Errorf("create session directory: %w", err)
+	}
+
+	// write to a temporary file first so a crash never leaves a torn file
+	tmpPath := filePath + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0o644); err != nil {
+		return fmt.Errorf("write session: %w", err)
+	}
+	if err := os.Rename(tmpPath, filePath); err != nil {
+		return fmt.Errorf("replace session: %w", err)
+	}
+	return nil
+}
+
+// bindDevice adds uploadKey to a session as deviceID. Binding the same
+// device to the same key again is a no-op.
+func bindDevice(sessionID, deviceID, uploadKey string, now time.Time) (multiDeviceSession, error) {
+	multiDeviceSessionsMutex.Lock()
+	defer multiDeviceSessionsMutex.Unlock()
+
+	session, err := loadMultiDeviceSession(sessionID)
+	if err != nil {
+		return multiDeviceSession{}, err
+	}
+	for _, device := range session.Devices {
+		if device.DeviceID != deviceID {
+			continue
+		}
+		if device.UploadKey != uploadKey {
+			return multiDeviceSession{}, errDeviceAlreadyBound
+		}
+		return session, nil
+	}
+
+	session.Devices = append(session.Devices, boundDevice{
+		DeviceID:  deviceID,
+		UploadKey: uploadKey,
+		BoundAt:   now.UTC().Format(time.RFC3339Nano),
+	})
+	if err := storeMultiDeviceSession(session); err != nil {
+		return multiDeviceSession{}, err
+	}
+	return session, nil
+}
+
+// setDeviceClock stores the clock offset of a bound device.
+func setDeviceClock(sessionID, deviceID string, offset clockOffset) error {
+	multiDeviceSessionsMutex.Lock()
+	defer multiDeviceSessionsMutex.Unlock()
+
+	session, err := loadMultiDeviceSession(sessionID)
+	if err != nil {
+		return err
+	}
+	for i := range session.Devices {
+		if session.Devices[i].DeviceID == deviceID {
+			session.Devices[i].Clock = &offset
+			return storeMultiDeviceSession(session)
+		}
+	}
+	return errDeviceNotFound
+}
+
+// sessionDevices returns what can be shown about the devices of a session:
+// everything but their upload keys.
+func sessionDevices(session multiDeviceSession) []map[string]any {
+	devices := make([]map[string]any, 0, len(session.Devices))
+	for _, device := range session.Devices {
+		devices = append(devices, map[string]any{
+			"device_id":   device.DeviceID,
+			"upload_name": uploadNameFromKey(device.UploadKey),
+			"bound_at":    device.BoundAt,
+			"clock":       device.Clock,
+		})
+	}
+	return devices
+}
+
+// readDeviceRecords returns the records of every device of a session stored
+// after its position in positions, interleaved by timestamp. Records without
+// a timestamp keep their place after the previous record of their device;
+// records with equal timestamps come in device binding order. With
+// alignClocks, the times of devices with an estimated clock offset are
+// shifted to server time first.
+func readDeviceRecords(session multiDeviceSession, positions map[string]int, alignClocks bool) ([]deviceRecord, error) {
+	var records []deviceRecord
+	for _, device := range session.Devices {
+		var last, offset float64
+		if alignClocks && device.Clock != nil {
+			offset = device.Clock.OffsetSeconds
+		}
+		err := scanUploadFileFrom(uploadFilePath(device.UploadKey), positions[device.DeviceID], func(index int, payload []byte) error {
+			if t, ok := payloadTime(payload); ok {
+				last = t
+			}
+			records = append(records, deviceRecord{
+				deviceID: device.DeviceID,
+				index:    index,
+				payload:  payload,
+				time:     last + offset,
+			})
+			return nil
+		})
+		if err != nil && !errors.Is(err, errUploadNotFound) {
+			return nil, fmt.Errorf("read device %s: %w", device.DeviceID, err)
+		}
+	}
+
+	slices.SortStableFunc(records, func(a, b deviceRecord) int {
+		return cmp.Compare(a.time, b.time)
+	})
+	return records, nil
+}
+
+// parseDevicePositions parses a merged follow position such as
+// "left=12,right=9,strap=40". Devices that are left out start from 0.
+func parseDevicePositions(raw string) (map[string]int, error) {
+	positions := map[string]int{}
+	if raw == "" {
+		return positions, nil
+	}
+	for _, part := range strings.Split(raw, ",") {
+		deviceID, value, ok := strings.Cut(part, "=")
+		position, err := strconv.Atoi(value)
+		if !ok || err != nil || position < 0 {
+			return nil, errors.New("invalid position parameter: must be device_id=position pairs separated by commas")
+		}
+		positions[deviceID] = position
+	}
+	return positions, nil
+}
+
+func formatDevicePositions(session multiDeviceSession, positions map[string]int) string {
+	parts := make([]string, 0, len(session.Devices))
+	for _, device := range session.Devices {
+		parts = append(parts, device.DeviceID+"="+strconv.Itoa(positions[device.DeviceID]))
+	}
+	return strings.Join(parts, ",")
+}
+
+// tagPayload adds a "device_id" field to a stored JSON payload, and an
+// "aligned_time" field if alignedTime isn't empty. Payloads that aren't JSON
+// objects are returned as-is.
+func tagPayload(payload []byte, deviceID, alignedTime string) []byte {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil || fields == nil {
+		return payload
+	}
+	fields["device_id"], _ = json.Marshal(deviceID)
+	if alignedTime != "" {
+		fields["aligned_time"] = json.RawMessage(alignedTime)
+	}
+
+	tagged, err := json.Marshal(fields)
+	if err != nil {
+		return payload
+	}
+	return tagged
+}
+
+// alignClocksParam reports whether a merge should apply the devices' clock
+// offsets.
+func alignClocksParam(r *http.Request) bool {
+	value := r.URL.Query().Get("align_clocks")
+	return value == "1" || value == "true"
+}
+
+// multiDeviceSessionFromPath loads the session named by the {id} path value,
+// writing an error response if that fails.
+func multiDeviceSessionFromPath(w http.ResponseWriter, r *http.Request) (multiDeviceSession, bool) {
+	sessionID, err := parseSessionID(r.PathValue("id"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return multiDeviceSession{}, false
+	}
+
+	multiDeviceSessionsMutex.Lock()
+	session, err := loadMultiDeviceSession(sessionID)
+	multiDeviceSessionsMutex.Unlock()
+	if errors.Is(err, errSessionNotFound) {
+		writeError(w, http.StatusNotFound, errCodeSessionNotFound, err.Error())
+		return multiDeviceSession{}, false
+	}
+	if err != nil {
+		log.Printf("failed to load session: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read session")
+		return multiDeviceSession{}, false
+	}
+	return session, true
+}
+
+// NewMultiDeviceSessionHandler creates an empty multi-device session.
+func NewMultiDeviceSessionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	buf := make([]byte, sessionIDHexLength/2)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("failed to generate session id: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to generate session id")
+		return
+	}
+	session := multiDeviceSession{
+		SessionID: hex.EncodeToString(buf),
+		CreatedAt: time.Now().UTC().Format(time.RFC3339Nano),
+		Devices:   []boundDevice{},
+	}
+
+	multiDeviceSessionsMutex.Lock()
+	err := storeMultiDeviceSession(session)
+	multiDeviceSessionsMutex.Unlock()
+	if err != nil {
+		log.Printf("failed to store session: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to store session")
+		return
+	}
+
+	log.Printf("multi-device session created session_id=%q", session.SessionID)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	response := map[string]any{
+		"status":     "ok",
+		"session_id": session.SessionID,
+		"created_at": session.CreatedAt,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write session response: %v", err)
+	}
+}
+
+// SessionDevicesHandler lists the devices of a session (GET) or binds a
+// device's upload key to it, given as {"device_id": ..., "upload_key": ...}
+// (POST).
+func SessionDevicesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		panic("only GET and POST allowed")
+	}
+
+	session, ok := multiDeviceSessionFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		var request struct {
+			DeviceID  string `json:"device_id"`
+			UploadKey string `json:"upload_key"`
+		}
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096)).Decode(&request); err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid device JSON: %v", err))
+			return
+		}
+		deviceID, err := parseDeviceID(request.DeviceID)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidBody, err.Error())
+			return
+		}
+		uploadKey, err := parseUploadKey(request.UploadKey)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidUploadKey, err.Error())
+			return
+		}
+		if _, status, code, message := checkClientCert(r, uploadKey); status != 0 {
+			writeError(w, status, code, message)
+			return
+		}
+
+		session, err = bindDevice(session.SessionID, deviceID, uploadKey, time.Now())
+		if errors.Is(err, errDeviceAlreadyBound) {
+			writeError(w, http.StatusConflict, errCodeDeviceAlreadyBound, err.Error())
+			return
+		}
+		if err != nil {
+			log.Printf("failed to bind device: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to store session")
+			return
+		}
+
+		log.Printf("device bound session_id=%q device_id=%q upload_name=%q", session.SessionID, deviceID, uploadNameFromKey(uploadKey))
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":     "ok",
+		"session_id": session.SessionID,
+		"devices":    sessionDevices(session),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write session devices response: %v", err)
+	}
+}
+
+// SessionFollowHandler is the merged counterpart of FollowHandler: it returns
+// the new records of every device of a session as device_id,index,payload
+// lines, interleaved by timestamp, or by server time with align_clocks=1.
+// Positions are per device, as in "left=12,right=9", and are returned in
+// X-Follow-Position.
+func SessionFollowHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	session, ok := multiDeviceSessionFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	positions, err := parseDevicePositions(r.URL.Query().Get("position"))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	records, err := readDeviceRecords(session, positions, alignClocksParam(r))
+	if err != nil {
+		log.Printf("failed to read session records: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	for _, record := range records {
+		positions[record.deviceID] = max(positions[record.deviceID], record.index)
+	}
+	w.Header().Set("X-Follow-Position", formatDevicePositions(session, positions))
+	if len(records) == 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	writer := bufio.NewWriter(w)
+	for _, record := range records {
+		fmt.Fprintf(writer, "%s,%d,%s\n", record.deviceID, record.index, record.payload)
+	}
+	if err := writer.Flush(); err != nil {
+		log.Printf("failed to write session follow response: %v", err)
+	}
+}
+
+// SessionExportHandler downloads the records of every device of a session
+// as NDJSON, interleaved by timestamp, with a device_id field added to each.
+// With align_clocks=1 records are ordered by server time instead, which is
+// added to each as aligned_time.
+func SessionExportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	session, ok := multiDeviceSessionFromPath(w, r)
+	if !ok {
+		return
+	}
+
+	alignClocks := alignClocksParam(r)
+	records, err := readDeviceRecords(session, nil, alignClocks)
+	if err != nil {
+		log.Printf("failed to read session records: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", "session-"+session.CreatedAt[:len("2006-01-02")]+".ndjson"))
+
+	writer := bufio.NewWriter(w)
+	for _, record := range records {
+		var alignedTime string
+		if alignClocks {
+			alignedTime = strconv.FormatFloat(record.time, 'f', -1, 64)
+		}
+		writer.Write(tagPayload(record.payload, record.deviceID, alignedTime))
+		writer.WriteByte('\n')
+	}
+	if err := writer.Flush(); err != nil {
+		log.Printf("failed to write session export: %v", err)
+	}
+}
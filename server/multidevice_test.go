@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func sessionRequest(t *testing.T, handler http.HandlerFunc, method, sessionID, path, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(method, "/api/sessions/"+sessionID+path, strings.NewReader(body))
+	req.SetPathValue("id", sessionID)
+	rec := httptest.NewRecorder()
+	handler(rec, req)
+	return rec
+}
+
+func TestMultiDeviceSession(t *testing.T) {
+	chdirTemp(t)
+
+	rec := httptest.NewRecorder()
+	NewMultiDeviceSessionHandler(rec, httptest.NewRequest("POST", "/api/sessions/new", nil))
+	var created struct {
+		SessionID string `json:"session_id"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != 201 {
+		t.Fatalf("new session: status %d, %v", rec.Code, err)
+	}
+	id := created.SessionID
+
+	left, strap := newTestUploadKey(t), newTestUploadKey(t)
+	simulateUpload(t, left, []string{`{"timestamp":1,"trackerKey":"head"}`, `{"timestamp":3,"trackerKey":"head"}`})
+	simulateUpload(t, strap, []string{`{"timestamp":2,"heartRate":70}`, `{"heartRate":71}`, `{"timestamp":4,"heartRate":72}`})
+
+	for _, binding := range [][2]string{{"Left", left}, {"strap", strap}} {
+		rec := sessionRequest(t, SessionDevicesHandler, "POST", id, "/devices", `{"device_id":"`+binding[0]+`","upload_key":"`+binding[1]+`"}`)
+		if rec.Code != 200 {
+			t.Fatalf("bind %s: status %d %s", binding[0], rec.Code, rec.Body.String())
+		}
+	}
+	if rec := sessionRequest(t, SessionDevicesHandler, "POST", id, "/devices", `{"device_id":"left","upload_key":"`+strap+`"}`); rec.Code != 409 {
+		t.Fatalf("rebind left to another key: status %d", rec.Code)
+	}
+	if rec := sessionRequest(t, SessionDevicesHandler, "POST", id, "/devices", `{"device_id":"left,right","upload_key":"`+left+`"}`); rec.Code != 400 {
+		t.Fatalf("invalid device id: status %d", rec.Code)
+	}
+
+	rec = sessionRequest(t, SessionDevicesHandler, "GET", id, "/devices", "")
+	if rec.Code != 200 || strings.Contains(rec.Body.String(), left) || !strings.Contains(rec.Body.String(), `"device_id":"strap"`) {
+		t.Fatalf("devices: status %d %s", rec.Code, rec.Body.String())
+	}
+
+	rec = sessionRequest(t, SessionFollowHandler, "GET", id, "/follow", "")
+	merged := "left,1,{\"timestamp\":1,\"trackerKey\":\"head\"}\n" +
+		"strap,1,{\"timestamp\":2,\"heartRate\":70}\n" +
+		"strap,2,{\"heartRate\":71}\n" +
+		"left,2,{\"timestamp\":3,\"trackerKey\":\"head\"}\n" +
+		"strap,3,{\"timestamp\":4,\"heartRate\":72}\n"
+	if rec.Code != 200 || rec.Body.String() != merged {
+		t.Fatalf("follow: status %d\n%s", rec.Code, rec.Body.String())
+	}
+	position := rec.Header().Get("X-Follow-Position")
+	if position != "left=2,strap=3" {
+		t.Fatalf("position = %q", position)
+	}
+
+	simulateUpload(t, strap, []string{`{"timestamp":5,"heartRate":73}`})
+	req := httptest.NewRequest("GET", "/api/sessions/"+id+"/follow?position="+position, nil)
+	req.SetPathValue("id", id)
+	rec = httptest.NewRecorder()
+	SessionFollowHandler(rec, req)
+	if rec.Body.String() != "strap,4,{\"timestamp\":5,\"heartRate\":73}\n" || rec.Header().Get("X-Follow-Position") != "left=2,strap=4" {
+		t.Fatalf("follow from %s: %q, position %q", position, rec.Body.String(), rec.Header().Get("X-Follow-Position"))
+	}
+
+	rec = sessionRequest(t, SessionExportHandler, "GET", id, "/export", "")
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if rec.Code != 200 || len(lines) != 6 || lines[0] != `{"device_id":"left","timestamp":1,"trackerKey":"head"}` {
+		t.Fatalf("export: status %d\n%s", rec.Code, rec.Body.String())
+	}
+
+	if rec := sessionRequest(t, SessionFollowHandler, "GET", strings.Repeat("ab", 32), "/follow", ""); rec.Code != 404 {
+		t.Fatalf("unknown session: status %d", rec.Code)
+	}
+}
@@ -0,0 +1,226 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// maxUploadKeyDraws bounds how often a key is re-drawn to get an upload name
+// no other upload uses, before a numeric suffix is added instead.
+const maxUploadKeyDraws = 20
+
+var errAmbiguousUploadName = errors.New("upload_name matches several uploads: use the upload key")
+
+// uploadNameSuffixes holds the numeric suffix of upload names that had to be
+// told apart from an existing upload with the same words, by upload key. The
+// suffix is part of the file name, which is how RestoreUploadNameSuffixes
+// finds it again after a restart.
+var (
+	uploadNameSuffixes      = map[string]int{}
+	uploadNameSuffixesMutex sync.Mutex
+)
+
+func uploadNameSuffix(uploadKey string) int {
+	uploadNameSuffixesMutex.Lock()
+	defer uploadNameSuffixesMutex.Unlock()
+	return uploadNameSuffixes[uploadKey]
+}
+
+// normalizeUploadName lower-cases a name typed by a user and accepts
+// hyphens, underscores and plus signs between the words.
+func normalizeUploadName(raw string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(raw), func(r rune) bool {
+		return r == ' ' || r == '-' || r == '_' || r == '+'
+	}), " ")
+}
+
+// liveUploadKeys returns the keys handed out by this server and those of
+// active sessions.
+func liveUploadKeys() map[string]bool {
+	keys := map[string]bool{}
+
+	uploadKeys.each(func(uploadKey string, _ uploadKeyInfo) {
+		keys[uploadKey] = true
+	})
+
+	activeSessionsMutex.Lock()
+	for uploadKey := range activeSessions {
+		keys[uploadKey] = true
+	}
+	activeSessionsMutex.Unlock()
+
+	return keys
+}
+
+// takenUploadNames returns the names of live sessions and stored uploads.
+func takenUploadNames() (map[string]bool, error) {
+	keys := liveUploadKeys()
+	stored, err := listUploadKeys()
+	if err != nil {
+		return nil, err
+	}
+	for _, uploadKey := range stored {
+		keys[uploadKey] = true
+	}
+
+	names := map[string]bool{}
+	for uploadKey := range keys {
+		names[uploadNameFromKey(uploadKey)] = true
+	}
+	return names, nil
+}
+
+// newUploadKeyMutex is held by newUniqueUploadKey from reading the taken
+// names to registering the new key, so that keys created at the same time
+// don't get the same name or suffix.
+var newUploadKeyMutex sync.Mutex
+
+// newUniqueUploadKey generates and registers an upload key whose name no
+// live session or stored upload uses. Keys are re-drawn a few times; if the
+// name is still taken, as happens with short word lists, the smallest free
+// numeric suffix is added to it.
+func newUniqueUploadKey() (string, uploadKeyInfo, error) {
+	newUploadKeyMutex.Lock()
+	defer newUploadKeyMutex.Unlock()
+
+	taken, err := takenUploadNames()
+	if err != nil {
+		return "", uploadKeyInfo{}, err
+	}
+
+	var uploadKey string
+	for draw := 0; draw < maxUploadKeyDraws; draw++ {
+		if uploadKey, err = generateUploadKey(); err != nil {
+			return "", uploadKeyInfo{}, err
+		}
+		if !taken[uploadNameFromKey(uploadKey)] {
+			info, err := registerUploadKey(uploadKey)
+			return uploadKey, info, err
+		}
+	}
+
+	name := uploadNameFromKey(uploadKey)
+	suffix := 2
+	for taken[name+" "+strconv.Itoa(suffix)] {
+		suffix++
+	}
+	uploadNameSuffixesMutex.Lock()
+	uploadNameSuffixes[uploadKey] = suffix
+	uploadNameSuffixesMutex.Unlock()
+
+	info, err := registerUploadKey(uploadKey)
+	return uploadKey, info, err
+}
+
+// RestoreUploadNameSuffixes reads the numeric suffixes of upload names back
+// from the file names of stored uploads, so that suffixed names survive a
+// restart, and records in the key store the files named after another word
+// list, which uploadFilePath finds there. It must be called after the word
+// list is configured.
+func RestoreUploadNameSuffixes() error {
+	entries, err := os.ReadDir(uploadDir)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("read upload directory: %w", err)
+	}
+
+	restored := map[string]int{}
+	stored := map[string]string{}
+	for _, entry := range entries {
+		base, ok := strings.CutSuffix(entry.Name(), ".csv")
+		underscore := strings.LastIndexByte(base, '_')
+		if entry.IsDir() || !ok || underscore < 0 {
+			continue
+		}
+		uploadKey, err := parseUploadKey(base[underscore+1:])
+		if err != nil || base[underscore+1:] != uploadKey {
+			continue
+		}
+		stored[uploadKey] = entry.Name()
+		suffix, ok := strings.CutPrefix(base[:underscore], uploadNameFromKey(uploadKey)+" ")
+		if !ok {
+			continue
+		}
+		if n, err := strconv.Atoi(suffix); err == nil && n > 1 {
+			restored[uploadKey] = n
+		}
+	}
+
+	uploadNameSuffixesMutex.Lock()
+	maps.Copy(uploadNameSuffixes, restored)
+	uploadNameSuffixesMutex.Unlock()
+
+	for uploadKey, name := range stored {
+		if name != uploadFileName(uploadKey) {
+			uploadKeys.setStoredFile(uploadKey, name)
+		}
+	}
+	return nil
+}
+
+// resolveUploadName returns the key of the upload called name, looking at
+// live sessions and stored uploads.
+func resolveUploadName(name string) (string, error) {
+	name = normalizeUploadName(name)
+
+	candidates := liveUploadKeys()
+	stored, err := listUploadKeys()
+	if err != nil {
+		return "", err
+	}
+	for _, uploadKey := range stored {
+		candidates[uploadKey] = true
+	}
+
+	var match string
+	for uploadKey := range candidates {
+		if uploadNameFromKey(uploadKey) != name {
+			continue
+		}
+		if match != "" {
+			return "", errAmbiguousUploadName
+		}
+		match = uploadKey
+	}
+	if match == "" {
+		return "", errUploadNotFound
+	}
+	return match, nil
+}
+
+// resolveUploadRef accepts either an upload key or an upload name, as used
+// in /uploads/{key}/... paths. On failure it also returns the status and
+// error code to respond with.
+func resolveUploadRef(raw string) (string, int, string, error) {
+	uploadKey, err := parseUploadKey(raw)
+	if err != nil && strings.ContainsAny(strings.TrimSpace(raw), " -_+") {
+		return resolveUploadNameStatus(raw)
+	}
+	if err != nil {
+		return "", http.StatusBadRequest, errCodeInvalidUploadKey, err
+	}
+	return uploadKey, 0, "", nil
+}
+
+func resolveUploadNameStatus(name string) (string, int, string, error) {
+	uploadKey, err := resolveUploadName(name)
+	switch {
+	case errors.Is(err, errUploadNotFound):
+		return "", http.StatusNotFound, errCodeUploadNotFound, err
+	case errors.Is(err, errAmbiguousUploadName):
+		return "", http.StatusConflict, errCodeAmbiguousUploadName, err
+	case err != nil:
+		log.Printf("failed to resolve upload name: %v", err)
+		return "", http.StatusInternalServerError, errCodeInternal, errors.New("failed to resolve upload_name")
+	}
+	return uploadKey, 0, "", nil
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestResolveUploadName(t *testing.T) {
+	chdirTemp(t)
+	activeSessionsMutex.Lock()
+	clear(activeSessions)
+	activeSessionsMutex.Unlock()
+
+	key := newTestUploadKey(t)
+	name := uploadNameFromKey(key)
+	simulateUpload(t, key, []string{`{"heartRate":70}`})
+
+	follow := func(query string) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		FollowHandler(rec, httptest.NewRequest("GET", "/api/follow?"+query, nil))
+		return rec
+	}
+
+	rec := follow("upload_name=" + url.QueryEscape(name))
+	if rec.Code != 200 || strings.TrimSpace(rec.Body.String()) != `1,{"heartRate":70}` {
+		t.Fatalf("follow by name: status %d body %q", rec.Code, rec.Body.String())
+	}
+	if rec := follow("upload_name=" + strings.ToUpper(strings.ReplaceAll(name, " ", "-"))); rec.Code != 200 {
+		t.Fatalf("follow by hyphenated name: status %d", rec.Code)
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/x/status", nil)
+	req.SetPathValue("key", name)
+	statusRec := httptest.NewRecorder()
+	StatusHandler(statusRec, req)
+	if statusRec.Code != 200 {
+		t.Fatalf("status by name: %d %s", statusRec.Code, statusRec.Body.String())
+	}
+
+	if taken, err := takenUploadNames(); err != nil || !taken[name] {
+		t.Fatalf("name of an active session not taken (err %v)", err)
+	}
+
+	// a second upload with the same name (same first bytes of the key)
+	twin := key[:4*uploadNameWordCount] + strings.Repeat("0", uploadKeyHexLength-4*uploadNameWordCount)
+	simulateUpload(t, twin, []string{`{"heartRate":80}`})
+	if rec := follow("upload_name=" + url.QueryEscape(name)); rec.Code != 409 {
+		t.Fatalf("follow by ambiguous name: status %d", rec.Code)
+	}
+
+	if rec := follow("upload_name=no+such+upload+here"); rec.Code != 404 {
+		t.Fatalf("follow by unknown name: status %d", rec.Code)
+	}
+}
+
+func TestUploadNameSuffix(t *testing.T) {
+	chdirTemp(t)
+	builtinWords := uploadNameWords
+	t.Cleanup(func() {
+		uploadNameWords = builtinWords
+		uploadNameSuffixesMutex.Lock()
+		clear(uploadNameSuffixes)
+		uploadNameSuffixesMutex.Unlock()
+	})
+	// a single word means every key gets the same name
+	uploadNameWords = []string{"same"}
+
+	newKey := func() (string, string) {
+		rec := httptest.NewRecorder()
+		NewUploadKeyHandler(rec, httptest.NewRequest("POST", "/api/new-upload-key", nil))
+		var response struct {
+			Name      string `json:"name"`
+			UploadKey string `json:"upload_key"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatal(err)
+		}
+		return response.Name, response.UploadKey
+	}
+
+	stored := newTestUploadKey(t)
+	simulateUpload(t, stored, []string{`{"heartRate":70}`})
+	if name := uploadNameFromKey(stored); name != strings.Repeat("same ", uploadNameWordCount-1)+"same" {
+		t.Fatalf("name = %q", name)
+	}
+
+	name2, key2 := newKey()
+	name3, key3 := newKey()
+	if !strings.HasSuffix(name2, "same 2") || !strings.HasSuffix(name3, "same 3") {
+		t.Fatalf("names = %q, %q", name2, name3)
+	}
+	simulateUpload(t, key2, []string{`{"heartRate":71}`})
+	if !strings.HasPrefix(filepath.Base(uploadFilePath(key2)), name2+"_") {
+		t.Fatalf("file of suffixed upload: %s", uploadFilePath(key2))
+	}
+	if got, err := resolveUploadName(strings.ReplaceAll(name3, " ", "-")); err != nil || got != key3 {
+		t.Fatalf("resolve %q = %q, %v", name3, got, err)
+	}
+
+	// after a restart the suffix comes back from the file name
+	uploadNameSuffixesMutex.Lock()
+	clear(uploadNameSuffixes)
+	uploadNameSuffixesMutex.Unlock()
+	if err := RestoreUploadNameSuffixes(); err != nil {
+		t.Fatal(err)
+	}
+	if got := uploadNameFromKey(key2); got != name2 {
+		t.Fatalf("restored name = %q, want %q", got, name2)
+	}
+}
+
+func TestUploadNameConcurrent(t *testing.T) {
+	chdirTemp(t)
+	builtinWords := uploadNameWords
+	t.Cleanup(func() {
+		uploadNameWords = builtinWords
+		uploadNameSuffixesMutex.Lock()
+		clear(uploadNameSuffixes)
+		uploadNameSuffixesMutex.Unlock()
+	})
+	uploadNameWords = []string{"same"}
+	// let the requests overlap even on a single CPU
+	procs := runtime.GOMAXPROCS(8)
+	t.Cleanup(func() { runtime.GOMAXPROCS(procs) })
+
+	names := make([]string, 50)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range names {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			rec := httptest.NewRecorder()
+			NewUploadKeyHandler(rec, httptest.NewRequest("POST", "/api/new-upload-key", nil))
+			var response struct {
+				Name string `json:"name"`
+			}
+			if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+				t.Error(err)
+			}
+			names[i] = response.Name
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			t.Fatalf("name %q handed out twice: %q", name, names)
+		}
+		seen[name] = true
+	}
+}
@@ -0,0 +1,472 @@
+package server
+
+import (
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// With OIDC enabled, people sign in to the dashboard and the API at an
+// OpenID Connect provider (authorization code flow with PKCE). The callback
+// verifies the ID token, maps its claims to a role and keeps the identity
+// in a signed session cookie, so the server stores no sessions. Devices
+// keep using upload keys; see access.go for what each role may do.
+
+const (
+	sessionCookieName  = "hrdemo_session"
+	loginCookieName    = "hrdemo_login"
+	sessionLifetime    = 12 * time.Hour
+	loginLifetime      = 10 * time.Minute
+	oidcTimeout        = 10 * time.Second
+	jwksRefetchMinimum = time.Minute
+)
+
+// OIDCConfig configures sign-in with an OpenID Connect provider.
+type OIDCConfig struct {
+	Issuer       string // e.g. https://accounts.example.org
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string // this server's /api/v1/auth/callback as the provider knows it
+
+	// RoleClaim names the ID token claim (a string or a list of strings)
+	// whose values Roles maps to roles, e.g. groups.
+	RoleClaim string
+	Roles     map[string]string
+	// DefaultRole is the role of users whose claims Roles maps to none.
+	// Empty refuses them sign-in.
+	DefaultRole string
+
+	// SessionSecret signs session cookies. Empty uses a random secret, which
+	// signs everyone out when the server restarts.
+	SessionSecret string
+}
+
+type oidcProvider struct {
+	config        OIDCConfig
+	authEndpoint  string
+	tokenEndpoint string
+	jwksURI       string
+	sessionKey    []byte
+	client        *http.Client
+	// secureCookies marks cookies Secure if the redirect URL is https, as
+	// the request itself may have reached a TLS-terminating proxy first.
+	secureCookies bool
+
+	mu         sync.Mutex
+	keys       map[string]crypto.PublicKey
+	keysLoaded time.Time
+}
+
+// oidc is the configured provider; nil disables OIDC. Set by EnableOIDC.
+var oidc *oidcProvider
+
+// EnableOIDC fetches the discovery document and signing keys of the
+// provider and enforces roles on every endpoint.
+func EnableOIDC(config OIDCConfig) error {
+	config.Issuer = strings.TrimSuffix(config.Issuer, "/")
+	if u, err := url.Parse(config.Issuer); err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid OIDC issuer %q: must be an http or https URL", config.Issuer)
+	}
+	if config.ClientID == "" {
+		return errors.New("OIDC needs a client id")
+	}
+	redirectURL, err := url.Parse(config.RedirectURL)
+	if err != nil || !redirectURL.IsAbs() {
+		return fmt.Errorf("invalid OIDC redirect URL %q: must be absolute, e.g. https://example.org/api/v1/auth/callback", config.RedirectURL)
+	}
+	for value, role := range config.Roles {
+		if !validRole(role) {
+			return fmt.Errorf("invalid role %q for %q: must be one of %s", role, value, strings.Join(roles, ", "))
+		}
+	}
+	if config.DefaultRole != "" && !validRole(config.DefaultRole) {
+		return fmt.Errorf("invalid default role %q: must be one of %s", config.DefaultRole, strings.Join(roles, ", "))
+	}
+
+	p := &oidcProvider{
+		config:        config,
+		client:        &http.Client{Timeout: oidcTimeout},
+		secureCookies: redirectURL.Scheme == "https",
+	}
+	if config.SessionSecret != "" {
+		p.sessionKey = []byte(config.SessionSecret)
+	} else {
+		p.sessionKey = make([]byte, 32)
+		rand.Read(p.sessionKey)
+	}
+
+	var discovery struct {
+		Issuer                string `json:"issuer"`
+		AuthorizationEndpoint string `json:"authorization_endpoint"`
+		TokenEndpoint         string `json:"token_endpoint"`
+		JWKSURI               string `json:"jwks_uri"`
+	}
+	if err := p.getJSON(config.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+		return fmt.Errorf("failed to fetch OIDC discovery document: %w", err)
+	}
+	if strings.TrimSuffix(discovery.Issuer, "/") != config.Issuer {
+		return fmt.Errorf("OIDC discovery document is for issuer %q, not %q", discovery.Issuer, config.Issuer)
+	}
+	if discovery.AuthorizationEndpoint == "" || discovery.TokenEndpoint == "" || discovery.JWKSURI == "" {
+		return errors.New("OIDC discovery document lacks authorization, token or JWKS endpoint")
+	}
+	// ID tokens carry the issuer exactly as the provider spells it
+	p.config.Issuer = discovery.Issuer
+	p.authEndpoint = discovery.AuthorizationEndpoint
+	p.tokenEndpoint = discovery.TokenEndpoint
+	p.jwksURI = discovery.JWKSURI
+	if err := p.loadKeys(); err != nil {
+		return err
+	}
+
+	oidc = p
+	return nil
+}
+
+func (p *oidcProvider) getJSON(rawURL string, v any) error {
+	resp, err := p.client.Get(rawURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", rawURL, resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(v)
+}
+
+// loadKeys fetches the provider's JWK set.
+func (p *oidcProvider) loadKeys() error {
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := p.getJSON(p.jwksURI, &set); err != nil {
+		return fmt.Errorf("failed to fetch OIDC signing keys: %w", err)
+	}
+	keys := make(map[string]crypto.PublicKey)
+	for _, k := range set.Keys {
+		key, err := k.publicKey()
+		if err != nil {
+			return err
+		}
+		if key != nil {
+			keys[k.Kid] = key
+		}
+	}
+	p.mu.Lock()
+	p.keys, p.keysLoaded = keys, time.Now()
+	p.mu.Unlock()
+	return nil
+}
+
+// key returns the signing key kid, fetching the JWK set again for unknown
+// ids as providers rotate keys, but at most once a minute.
+func (p *oidcProvider) key(kid string) crypto.PublicKey {
+	p.mu.Lock()
+	key, stale := p.keys[kid], time.Since(p.keysLoaded) > jwksRefetchMinimum
+	p.mu.Unlock()
+	if key != nil || !stale {
+		return key
+	}
+	if err := p.loadKeys(); err != nil {
+		log.Printf("oidc: %v", err)
+		return nil
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.keys[kid]
+}
+
+// role maps the claims of an ID token to a role, the most privileged one if
+// several values match. Users whose claims map to no role get DefaultRole,
+// and "" if there is none.
+func (p *oidcProvider) role(claims map[string]any) string {
+	var values []string
+	switch v := claims[p.config.RoleClaim].(type) {
+	case string:
+		values = []string{v}
+	case []any:
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+	}
+	role := ""
+	for _, value := range values {
+		if mapped, ok := p.config.Roles[value]; ok && roleAtLeast(mapped, role) {
+			role = mapped
+		}
+	}
+	if role == "" {
+		return p.config.DefaultRole
+	}
+	return role
+}
+
+// identity is a signed-in user, as stored in the session cookie.
+type identity struct {
+	Subject string    `json:"sub"`
+	Email   string    `json:"email,omitempty"`
+	Role    string    `json:"role"`
+	Expires time.Time `json:"exp"`
+}
+
+// loginState is what the login cookie remembers between the redirect to
+// the provider and the callback.
+type loginState struct {
+	State    string    `json:"state"`
+	Nonce    string    `json:"nonce"`
+	Verifier string    `json:"verifier"`
+	Next     string    `json:"next"`
+	Expires  time.Time `json:"exp"`
+}
+
+// seal encodes v and signs it for a cookie value.
+func (p *oidcProvider) seal(v any) string {
+	data, _ := json.Marshal(v)
+	payload := base64.RawURLEncoding.EncodeToString(data)
+	mac := hmac.New(sha256.New, p.sessionKey)
+	mac.Write([]byte(payload))
+	return payload + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// unseal verifies a cookie value made by seal and decodes it into v.
+func (p *oidcProvider) unseal(value string, v any) bool {
+	payload, signature, ok := strings.Cut(value, ".")
+	if !ok {
+		return false
+	}
+	sum, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, p.sessionKey)
+	mac.Write([]byte(payload))
+	if !hmac.Equal(sum, mac.Sum(nil)) {
+		return false
+	}
+	return decodeJWTPart(payload, v) == nil
+}
+
+func randomToken() string {
+	buf := make([]byte, 24)
+	rand.Read(buf)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+// sessionIdentity returns the signed-in user of r, if any.
+func sessionIdentity(r *http.Request) (identity, bool) {
+	if oidc == nil {
+		return identity{}, false
+	}
+	cookie, err := r.Cookie(sessionCookieName)
+	if err != nil {
+		return identity{}, false
+	}
+	var id identity
+	if !oidc.unseal(cookie.Value, &id) || time.Now().After(id.Expires) {
+		return identity{}, false
+	}
+	return id, true
+}
+
+// localRedirect returns next if it is a path on this server, else "/", so
+// that the login flow can't be used to redirect elsewhere.
+func localRedirect(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.Contains(next, `\`) {
+		return "/"
+	}
+	return next
+}
+
+// LoginHandler sends the browser to the provider to sign in, coming back to
+// the path in the next parameter.
+func LoginHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		writeError(w, http.StatusNotFound, errCodeOIDCDisabled, "sign-in is not configured; start the server with -oidc-issuer")
+		return
+	}
+	login := loginState{
+		State:    randomToken(),
+		Nonce:    randomToken(),
+		Verifier: randomToken() + randomToken(),
+		Next:     localRedirect(r.URL.Query().Get("next")),
+		Expires:  time.Now().Add(loginLifetime),
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     loginCookieName,
+		Value:    oidc.seal(login),
+		Path:     "/",
+		MaxAge:   int(loginLifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   oidc.secureCookies,
+		// the provider redirects back with a top-level GET
+		SameSite: http.SameSiteLaxMode,
+	})
+
+	challenge := sha256.Sum256([]byte(login.Verifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {oidc.config.ClientID},
+		"redirect_uri":          {oidc.config.RedirectURL},
+		"scope":                 {"openid email profile"},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+	separator := "?"
+	if strings.Contains(oidc.authEndpoint, "?") {
+		separator = "&"
+	}
+	http.Redirect(w, r, oidc.authEndpoint+separator+query.Encode(), http.StatusFound)
+}
+
+// CallbackHandler completes a sign-in: it exchanges the authorization code
+// for an ID token, verifies it and sets the session cookie. Users without a
+// role are refused.
+func CallbackHandler(w http.ResponseWriter, r *http.Request) {
+	if oidc == nil {
+		writeError(w, http.StatusNotFound, errCodeOIDCDisabled, "sign-in is not configured; start the server with -oidc-issuer")
+		return
+	}
+	query := r.URL.Query()
+	if e := query.Get("error"); e != "" {
+		writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "sign-in failed: "+e)
+		return
+	}
+	var login loginState
+	cookie, err := r.Cookie(loginCookieName)
+	if err != nil || !oidc.unseal(cookie.Value, &login) || time.Now().After(login.Expires) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "sign-in expired or was started in another browser; sign in again")
+		return
+	}
+	if query.Get("state") != login.State {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "state does not match the sign-in")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{Name: loginCookieName, Path: "/", MaxAge: -1})
+
+	rawIDToken, err := oidc.exchange(query.Get("code"), login.Verifier)
+	if err != nil {
+		log.Printf("oidc: code exchange failed: %v", err)
+		writeError(w, http.StatusBadGateway, errCodeUnauthorized, "sign-in failed: the identity provider did not issue a token")
+		return
+	}
+	claims, err := parseIDToken(rawIDToken, oidc.key)
+	if err == nil {
+		err = claims.check(oidc.config.Issuer, oidc.config.ClientID, login.Nonce, time.Now())
+	}
+	if err != nil {
+		log.Printf("oidc: %v", err)
+		writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "sign-in failed: "+err.Error())
+		return
+	}
+
+	id := identity{
+		Subject: claims.Subject,
+		Email:   claims.Email,
+		Role:    oidc.role(claims.All),
+		Expires: time.Now().Add(sessionLifetime),
+	}
+	if id.Role == "" {
+		log.Printf("oidc: refused sign-in of sub=%q: no role for its %s", id.Subject, oidc.config.RoleClaim)
+		writeError(w, http.StatusForbidden, errCodeForbidden, "sign-in refused: your account has no role on this server")
+		return
+	}
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    oidc.seal(id),
+		Path:     "/",
+		Expires:  id.Expires,
+		HttpOnly: true,
+		Secure:   oidc.secureCookies,
+		SameSite: http.SameSiteLaxMode,
+	})
+	log.Printf("oidc: signed in sub=%q role=%s", id.Subject, id.Role)
+	http.Redirect(w, r, login.Next, http.StatusFound)
+}
+
+// exchange redeems an authorization code at the token endpoint and returns
+// the ID token.
+func (p *oidcProvider) exchange(code, verifier string) (string, error) {
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {p.config.RedirectURL},
+		"client_id":     {p.config.ClientID},
+		"code_verifier": {verifier},
+	}
+	req, err := http.NewRequest("POST", p.tokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientID), url.QueryEscape(p.config.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		IDToken string `json:"id_token"`
+		Error   string `json:"error"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&token); err != nil {
+		return "", fmt.Errorf("token endpoint: %s: %w", resp.Status, err)
+	}
+	if resp.StatusCode != http.StatusOK || token.IDToken == "" {
+		return "", fmt.Errorf("token endpoint: %s %s", resp.Status, token.Error)
+	}
+	return token.IDToken, nil
+}
+
+// LogoutHandler clears the session cookie.
+func LogoutHandler(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// WhoAmIHandler returns the signed-in user, for the dashboard to show.
+func WhoAmIHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := sessionIdentity(r)
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errCodeUnauthorized, "not signed in")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(id)
+}
+
+// RequireLoginForPages sends browsers that aren't signed in to the login
+// when they open one of pages (paths such as /viewer.html) while OIDC is
+// enabled. Other paths are served as they are.
+func RequireLoginForPages(handler http.Handler, pages []string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if oidc != nil && slices.Contains(pages, r.URL.Path) {
+			if _, ok := sessionIdentity(r); !ok {
+				next := url.QueryEscape(r.URL.RequestURI())
+				http.Redirect(w, r, "/api/v"+apiVersion+"/auth/login?next="+next, http.StatusFound)
+				return
+			}
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeOIDCProvider is an OpenID provider that signs in everyone who asks,
+// with the claims in next.
+type fakeOIDCProvider struct {
+	*httptest.Server
+	key      *ecdsa.PrivateKey
+	next     map[string]any
+	nonces   map[string]string // code -> nonce
+	verifier map[string]string // code -> PKCE challenge
+}
+
+func newFakeOIDCProvider(t *testing.T) *fakeOIDCProvider {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &fakeOIDCProvider{key: key, nonces: map[string]string{}, verifier: map[string]string{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 p.URL,
+			"authorization_endpoint": p.URL + "/authorize",
+			"token_endpoint":         p.URL + "/token",
+			"jwks_uri":               p.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("GET /jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := base64.RawURLEncoding.EncodeToString
+		json.NewEncoder(w).Encode(map[string]any{"keys": []map[string]string{{
+			"kty": "EC", "kid": "k1", "use": "sig", "crv": "P-256",
+			"x": encode(key.X.FillBytes(make([]byte, 32))),
+			"y": encode(key.Y.FillBytes(make([]byte, 32))),
+		}}})
+	})
+	mux.HandleFunc("GET /authorize", func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		code := randomToken()
+		p.nonces[code] = q.Get("nonce")
+		p.verifier[code] = q.Get("code_challenge")
+		http.Redirect(w, r, q.Get("redirect_uri")+"?code="+code+"&state="+q.Get("state"), http.StatusFound)
+	})
+	mux.HandleFunc("POST /token", func(w http.ResponseWriter, r *http.Request) {
+		code := r.FormValue("code")
+		challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+		if p.verifier[code] != base64.RawURLEncoding.EncodeToString(challenge[:]) {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+			return
+		}
+		claims := map[string]any{"iss": p.URL, "aud": "hrdemo", "nonce": p.nonces[code], "exp": time.Now().Add(time.Hour).Unix()}
+		for k, v := range p.next {
+			claims[k] = v
+		}
+		json.NewEncoder(w).Encode(map[string]string{"id_token": p.sign(t, claims)})
+	})
+	p.Server = httptest.NewServer(mux)
+	t.Cleanup(p.Close)
+	return p
+}
+
+func (p *fakeOIDCProvider) sign(t *testing.T, claims map[string]any) string {
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "kid": "k1"})
+	payload, _ := json.Marshal(claims)
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, p.key, digest[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// signIn runs the login flow against handler and returns the session
+// cookie.
+func signIn(t *testing.T, handler http.Handler, next string) *http.Cookie {
+	t.Helper()
+	rec := completeSignIn(t, handler, next)
+	if rec.Code != http.StatusFound || rec.Header().Get("Location") != next {
+		t.Fatalf("callback status = %d, Location = %q: %s", rec.Code, rec.Header().Get("Location"), rec.Body)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	t.Fatal("callback set no session cookie")
+	return nil
+}
+
+// completeSignIn runs the login flow against handler and returns the
+// response of the callback.
+func completeSignIn(t *testing.T, handler http.Handler, next string) *httptest.ResponseRecorder {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/auth/login?next="+url.QueryEscape(next), nil))
+	if rec.Code != http.StatusFound {
+		t.Fatalf("login status = %d: %s", rec.Code, rec.Body)
+	}
+	loginCookie := rec.Result().Cookies()[0]
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := client.Get(rec.Header().Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	callback, _ := url.Parse(resp.Header.Get("Location"))
+
+	req := httptest.NewRequest("GET", "/api/v1/auth/callback?"+callback.RawQuery, nil)
+	req.AddCookie(loginCookie)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestOIDCLogin(t *testing.T) {
+	chdirTemp(t)
+	provider := newFakeOIDCProvider(t)
+	err := EnableOIDC(OIDCConfig{
+		Issuer:      provider.URL,
+		ClientID:    "hrdemo",
+		RedirectURL: "https://hrdemo.example/api/v1/auth/callback",
+		RoleClaim:   "groups",
+		Roles:       map[string]string{"hr-admins": roleAdmin, "staff": roleViewer},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { oidc = nil })
+
+	mux := http.NewServeMux()
+	RegisterRoutes(mux)
+	mux.Handle("/", RequireLoginForPages(http.NotFoundHandler(), []string{"/viewer.html"}))
+
+	request := func(method, path string, cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if cookie != nil {
+			req.AddCookie(cookie)
+		}
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := request("GET", "/viewer.html", nil); rec.Code != http.StatusFound || !strings.HasPrefix(rec.Header().Get("Location"), "/api/v1/auth/login?next=") {
+		t.Fatalf("dashboard without session: status = %d, Location = %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if rec := request("GET", "/api/v1/sessions/active", nil); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("list without session: status = %d", rec.Code)
+	}
+	if rec := request("POST", "/api/v1/upload", nil); rec.Code == http.StatusUnauthorized {
+		t.Fatal("upload endpoint requires sign-in")
+	}
+
+	provider.next = map[string]any{"sub": "alice", "groups": []string{"staff"}}
+	viewer := signIn(t, mux, "/viewer.html")
+	if !viewer.Secure {
+		// the request came over plain HTTP, as it does behind a proxy
+		t.Fatal("session cookie isn't Secure with an https redirect URL")
+	}
+	if rec := request("GET", "/viewer.html", viewer); rec.Code != http.StatusNotFound {
+		t.Fatalf("dashboard with session: status = %d", rec.Code)
+	}
+	if rec := request("GET", "/api/v1/sessions/active", viewer); rec.Code != http.StatusOK {
+		t.Fatalf("list with session: status = %d: %s", rec.Code, rec.Body)
+	}
+	if rec := request("GET", "/api/v1/admin/quotas", viewer); rec.Code != http.StatusForbidden {
+		t.Fatalf("admin API as viewer: status = %d", rec.Code)
+	}
+
+	provider.next = map[string]any{"sub": "bob", "groups": []string{"staff", "hr-admins"}}
+	admin := signIn(t, mux, "/")
+	rec := request("GET", "/api/v1/auth/me", admin)
+	var id identity
+	if err := json.Unmarshal(rec.Body.Bytes(), &id); err != nil || id.Subject != "bob" || id.Role != roleAdmin {
+		t.Fatalf("me = %s (%v)", rec.Body, err)
+	}
+	if rec := request("GET", "/api/v1/admin/quotas", admin); rec.Code != http.StatusOK {
+		t.Fatalf("admin API as admin: status = %d: %s", rec.Code, rec.Body)
+	}
+
+	// claims mapping to no role are refused, unless there is a default
+	provider.next = map[string]any{"sub": "carol", "groups": []string{"guests"}}
+	rec = completeSignIn(t, mux, "/")
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("sign-in without a role: status = %d: %s", rec.Code, rec.Body)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			t.Fatal("sign-in without a role set a session cookie")
+		}
+	}
+	oidc.config.DefaultRole = roleViewer
+	guest := signIn(t, mux, "/")
+	if rec := request("GET", "/api/v1/sessions/active", guest); rec.Code != http.StatusOK {
+		t.Fatalf("list with the default role: status = %d: %s", rec.Code, rec.Body)
+	}
+
+	tampered := *viewer
+	tampered.Value = strings.Replace(tampered.Value, ".", "x.", 1)
+	if rec := request("GET", "/api/v1/sessions/active", &tampered); rec.Code != http.StatusUnauthorized {
+		t.Fatalf("tampered session: status = %d", rec.Code)
+	}
+}
@@ -0,0 +1,236 @@
+package server
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Timestamp order modes. Derivatives such as velocities assume each
+// tracker's samples are stored in time order; with "reject" a batch whose
+// timestamps go backwards, within itself or behind the stored records of the
+// same tracker, is refused, and with "reorder" the batch is sorted per
+// tracker and records still behind the stored ones are dropped. "off" stores
+// records as sent.
+const (
+	timestampOrderOff     = "off"
+	timestampOrderReject  = "reject"
+	timestampOrderReorder = "reorder"
+)
+
+// orderSeedRecords is how many stored records are read to find the last
+// timestamp of each tracker when an upload is first checked.
+const orderSeedRecords = 1000
+
+// maxReportedViolations bounds the violations listed in a response.
+const maxReportedViolations = 20
+
+// timestampOrder is the mode of uploads that don't request one. Set by
+// SetTimestampOrder.
+var timestampOrder = timestampOrderOff
+
+var errTimestampOutOfOrder = errors.New("timestamps go backwards")
+
+// orderViolation is a record whose timestamp is before that of an earlier
+// record of the same tracker. Record counts from 1 within the batch.
+type orderViolation struct {
+	Record     int     `json:"record"`
+	TrackerKey string  `json:"tracker_key"`
+	Timestamp  float64 `json:"timestamp"`
+	Previous   float64 `json:"previous"`
+}
+
+// trackerClock holds the last stored timestamp of each tracker of an upload.
+type trackerClock struct {
+	mu   sync.Mutex
+	last map[string]float64
+}
+
+var (
+	trackerClocks      = map[string]*trackerClock{}
+	trackerClocksMutex sync.Mutex
+)
+
+// SetTimestampOrder sets the order mode of uploads that don't request one:
+// off, reject or reorder.
+func SetTimestampOrder(mode string) error {
+	mode, err := parseTimestampOrder(mode)
+	if err != nil {
+		return err
+	}
+	timestampOrder = mode
+	return nil
+}
+
+func parseTimestampOrder(raw string) (string, error) {
+	switch raw {
+	case timestampOrderOff, timestampOrderReject, timestampOrderReorder:
+		return raw, nil
+	}
+	return "", fmt.Errorf("invalid timestamp order %q: must be off, reject or reorder", raw)
+}
+
+// recordTrackerTime returns the tracker key and numeric timestamp of a
+// record. Records without a tracker key, such as heart rate samples, have
+// the empty one.
+func recordTrackerTime(payload []byte) (string, float64, bool) {
+	var record struct {
+		TrackerKey string   `json:"trackerKey"`
+		Timestamp  *float64 `json:"timestamp"`
+	}
+	if err := json.Unmarshal(payload, &record); err != nil || record.Timestamp == nil {
+		return "", 0, false
+	}
+	return record.TrackerKey, *record.Timestamp, true
+}
+
+// uploadTrackerClock returns the tracker clock of an upload, seeding a new
+// one from its last stored records.
+func uploadTrackerClock(uploadKey string) (*trackerClock, error) {
+	trackerClocksMutex.Lock()
+	defer trackerClocksMutex.Unlock()
+
+	if clock, ok := trackerClocks[uploadKey]; ok {
+		return clock, nil
+	}
+
+	clock := &trackerClock{last: map[string]float64{}}
+	tail, err := readTailRecords(uploadFilePath(uploadKey), orderSeedRecords)
+	if err != nil && !errors.Is(err, errUploadNotFound) {
+		return nil, err
+	}
+	for _, record := range tail {
+		if tracker, t, ok := recordTrackerTime(record.Record); ok {
+			clock.last[tracker] = max(clock.last[tracker], t)
+		}
+	}
+	trackerClocks[uploadKey] = clock
+	return clock, nil
+}
+
+// forgetTrackerClock drops the clock of an upload that stopped uploading.
+func forgetTrackerClock(uploadKey string) {
+	trackerClocksMutex.Lock()
+	delete(trackerClocks, uploadKey)
+	trackerClocksMutex.Unlock()
+}
+
+// enforceTimestampOrder applies mode to a batch. It returns the records to
+// store, how many of them were moved, the violations found and the last
+// timestamp of each tracker in the batch: with reject the violations fail the
+// batch with errTimestampOutOfOrder, with reorder they are the records that
+// were dropped. The upload's clock isn't moved, so that a batch refused later
+// on doesn't block its own retry; pass the timestamps to commitTrackerClock
+// once the records are stored.
+func enforceTimestampOrder(uploadKey string, lines []string, mode string) ([]string, int, []orderViolation, map[string]float64, error) {
+	if mode == timestampOrderOff {
+		return lines, 0, nil, nil, nil
+	}
+	clock, err := uploadTrackerClock(uploadKey)
+	if err != nil {
+		return nil, 0, nil, nil, err
+	}
+
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	type sample struct {
+		record  int
+		line    string
+		tracker string
+		time    float64
+		timed   bool
+	}
+	samples := make([]sample, len(lines))
+	for i, line := range lines {
+		samples[i].record = i + 1
+		samples[i].line = line
+		samples[i].tracker, samples[i].time, samples[i].timed = recordTrackerTime([]byte(line))
+	}
+
+	moved := 0
+	if mode == timestampOrderReorder {
+		// sort each tracker's records among the places they already take
+		slots := map[string][]int{}
+		for i, s := range samples {
+			if s.timed {
+				slots[s.tracker] = append(slots[s.tracker], i)
+			}
+		}
+		for _, indices := range slots {
+			sorted := make([]sample, len(indices))
+			for j, i := range indices {
+				sorted[j] = samples[i]
+			}
+			slices.SortStableFunc(sorted, func(a, b sample) int {
+				return cmp.Compare(a.time, b.time)
+			})
+			for j, i := range indices {
+				if samples[i].record != sorted[j].record {
+					moved++
+				}
+				samples[i] = sorted[j]
+			}
+		}
+	}
+
+	last := map[string]float64{}
+	var violations []orderViolation
+	kept := make([]string, 0, len(lines))
+	for _, s := range samples {
+		if s.timed {
+			previous, ok := last[s.tracker]
+			if !ok {
+				previous, ok = clock.last[s.tracker]
+			}
+			if ok && s.time < previous {
+				violations = append(violations, orderViolation{Record: s.record, TrackerKey: s.tracker, Timestamp: s.time, Previous: previous})
+				continue
+			}
+			last[s.tracker] = s.time
+		}
+		kept = append(kept, s.line)
+	}
+
+	if mode == timestampOrderReject && len(violations) > 0 {
+		return nil, 0, violations, nil, fmt.Errorf("%w: %s", errTimestampOutOfOrder, describeViolations(violations))
+	}
+	return kept, moved, violations, last, nil
+}
+
+// commitTrackerClock moves the clock of an upload to the last timestamps of
+// a stored batch. A clock never goes back, in case batches checked at the
+// same time are stored in another order.
+func commitTrackerClock(uploadKey string, last map[string]float64) error {
+	if len(last) == 0 {
+		return nil
+	}
+	clock, err := uploadTrackerClock(uploadKey)
+	if err != nil {
+		return err
+	}
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	for tracker, t := range last {
+		if previous, ok := clock.last[tracker]; !ok || t > previous {
+			clock.last[tracker] = t
+		}
+	}
+	return nil
+}
+
+// describeViolations summarizes violations for an error message.
+func describeViolations(violations []orderViolation) string {
+	parts := make([]string, 0, min(len(violations), 3))
+	for _, v := range violations[:min(len(violations), 3)] {
+		parts = append(parts, fmt.Sprintf("record %d (tracker %q) at %v after %v", v.Record, v.TrackerKey, v.Timestamp, v.Previous))
+	}
+	if len(violations) > 3 {
+		parts = append(parts, fmt.Sprintf("and %d more", len(violations)-3))
+	}
+	return strings.Join(parts, ", ")
+}
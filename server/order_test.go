@@ -0,0 +1,81 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestTimestampOrder(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	upload := func(mode string, entries ...string) (int, map[string]any) {
+		t.Helper()
+		req := withUploadKey(httptest.NewRequest("POST", "/api/upload?timestamp_order="+mode, strings.NewReader(strings.Join(entries, "\n"))), key)
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+		var response map[string]any
+		json.NewDecoder(rec.Body).Decode(&response)
+		return rec.Code, response
+	}
+
+	head := func(ts string) string { return `{"trackerKey":"head","timestamp":` + ts + `}` }
+	hand := func(ts string) string { return `{"trackerKey":"hand","timestamp":` + ts + `}` }
+
+	if code, response := upload("reject", head("1"), hand("5"), head("2")); code != 200 {
+		t.Fatalf("in order: status %d %v", code, response)
+	}
+	// hand goes back within the batch, head behind the stored record
+	code, response := upload("reject", hand("6"), hand("5.5"), head("1.5"))
+	message, _ := response["error"].(map[string]any)["message"].(string)
+	if code != 409 || !strings.Contains(message, `record 2 (tracker "hand") at 5.5 after 6`) || !strings.Contains(message, `record 3 (tracker "head") at 1.5 after 2`) {
+		t.Fatalf("reject: status %d %v", code, response)
+	}
+
+	code, response = upload("reorder", head("4"), `{"heartRate":70}`, head("3"), hand("7"), head("1.5"))
+	if code != 200 || response["reordered"] != 2.0 || response["out_of_order_dropped"] != 1.0 {
+		t.Fatalf("reorder: status %d %v", code, response)
+	}
+	violations := response["order_violations"].([]any)
+	if v := violations[0].(map[string]any); v["record"] != 5.0 || v["timestamp"] != 1.5 || v["previous"] != 2.0 {
+		t.Fatalf("violations = %v", violations)
+	}
+
+	// off stores anything
+	if code, _ := upload("off", head("0.5")); code != 200 {
+		t.Fatalf("off: status %d", code)
+	}
+	if code, _ := upload("sideways", head("9")); code != 400 {
+		t.Fatalf("invalid mode: status %d", code)
+	}
+
+	_, _, records := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, records, []string{head("1"), hand("5"), head("2"), `{"heartRate":70}`, head("3"), hand("7"), head("4"), head("0.5")})
+}
+
+func TestTimestampOrderRefusedBatch(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	setTestQuotas(t, quotaUsage{Records: 1}, quotaUsage{})
+
+	batch := []string{`{"trackerKey":"head","timestamp":1}`, `{"trackerKey":"head","timestamp":2}`}
+	upload := func() int {
+		t.Helper()
+		req := withUploadKey(httptest.NewRequest("POST", "/api/upload?timestamp_order=reject", strings.NewReader(strings.Join(batch, "\n"))), key)
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+		return rec.Code
+	}
+	if code := upload(); code != 413 {
+		t.Fatalf("batch over the quota: status %d", code)
+	}
+	// the refused batch didn't move the clock past its own retry
+	setTestQuotas(t, quotaUsage{}, quotaUsage{})
+	if code := upload(); code != 200 {
+		t.Fatalf("retry: status %d", code)
+	}
+	_, _, records := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, records, batch)
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// When a Quest loses tracking it reports positions that jump far away for a
+// frame or a few, which ruin any velocity computed downstream. Such glitches
+// are found by the speed it would take to get to a sample from the last
+// good one. A jump the tracker doesn't come back from, within maxGlitchMs
+// or maxGlitchSamples, is taken to be real, e.g. a recentered play space,
+// rather than tracking loss.
+
+const (
+	defaultOutlierSpeed = 20 // m/s, faster than any hand or head moves
+	maxGlitchMs         = 500
+	maxGlitchSamples    = 1000
+
+	outliersDrop        = "drop"
+	outliersInterpolate = "interpolate"
+)
+
+// glitchStage drops the glitches at maxSpeed, in m/s, or with interpolate
+// moves each onto the line between the good samples around it, or to the
+// last good sample at the end. Samples are in timestamp order, in
+// milliseconds. Samples that may be glitches are held back until the
+// tracker either comes back or stays.
+type glitchStage struct {
+	next        sampleStage
+	maxSpeed    float64
+	interpolate bool
+
+	good    trackerSample   // the last good sample
+	run     []trackerSample // the glitches since
+	started bool
+}
+
+func (g *glitchStage) push(s trackerSample) error {
+	if !g.started {
+		g.good, g.started = s, true
+		return g.next.push(s)
+	}
+
+	prev := g.good
+	if len(g.run) > 0 {
+		prev = g.run[len(g.run)-1]
+	}
+	dt := (s.Timestamp - g.good.Timestamp) / 1000
+	distance := s.Position.sub(g.good.Position).length()
+	// a jump the tracker stays at, rather than comes back from, isn't a
+	// glitch
+	stayed := len(g.run) > 0 &&
+		(s.Timestamp-g.run[0].Timestamp >= maxGlitchMs || len(g.run) >= maxGlitchSamples ||
+			distance <= g.maxSpeed*dt && s.Position.sub(prev.Position).length() < distance)
+	if !stayed && distance > g.maxSpeed*dt {
+		g.run = append(g.run, s)
+		return nil
+	}
+
+	if err := g.emitRun(&s, !stayed); err != nil {
+		return err
+	}
+	g.good = s
+	return g.next.push(s)
+}
+
+func (g *glitchStage) flush() error {
+	if err := g.emitRun(nil, true); err != nil {
+		return err
+	}
+	return g.next.flush()
+}
+
+// emitRun puts out the held back samples, fixed if they are glitches, and
+// forgets them. next is the good sample after them, if there is one.
+func (g *glitchStage) emitRun(next *trackerSample, glitches bool) error {
+	defer func() { g.run = g.run[:0] }()
+	for _, s := range g.run {
+		if glitches && !g.interpolate {
+			continue
+		}
+		if glitches {
+			a := g.good
+			s.Position, s.Rotation = a.Position, a.Rotation
+			if next != nil {
+				b := *next
+				f := 0.0
+				if span := b.Timestamp - a.Timestamp; span > 0 {
+					f = (s.Timestamp - a.Timestamp) / span
+				}
+				d := b.Position.sub(a.Position).scale(f)
+				s.Position = vec3{a.Position.X + d.X, a.Position.Y + d.Y, a.Position.Z + d.Z}
+				if a.Rotation != nil && b.Rotation != nil {
+					rotation := a.Rotation.nlerp(*b.Rotation, f)
+					s.Rotation = &rotation
+				}
+			}
+		}
+		if err := g.next.push(s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parseOutlierFilter parses filter=outliers, filter=outliers:drop or
+// filter=outliers:interpolate, with the speed above which a jump is a
+// glitch taken from outlier_speed, in m/s.
+func parseOutlierFilter(spec, speed string) (trackerTransform, error) {
+	name, method, _ := strings.Cut(spec, ":")
+	if name != "outliers" {
+		return nil, fmt.Errorf("invalid filter parameter %q: must be outliers", spec)
+	}
+	var interpolate bool
+	switch method {
+	case "", outliersDrop:
+	case outliersInterpolate:
+		interpolate = true
+	default:
+		return nil, fmt.Errorf("invalid filter parameter %q: outliers are handled by drop or interpolate", spec)
+	}
+
+	maxSpeed := float64(defaultOutlierSpeed)
+	if speed != "" {
+		var err error
+		maxSpeed, err = strconv.ParseFloat(speed, 64)
+		if err != nil || maxSpeed <= 0 {
+			return nil, fmt.Errorf("invalid outlier_speed parameter %q: must be a positive speed in m/s", speed)
+		}
+	}
+
+	return func(_ samplePipeline, next sampleStage) (sampleStage, error) {
+		return &glitchStage{next: next, maxSpeed: maxSpeed, interpolate: interpolate}, nil
+	}, nil
+}
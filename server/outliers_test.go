@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func walkWithGlitch() []trackerSample {
+	// walking along x at 1 m/s, with tracking lost at 30 ms
+	var samples []trackerSample
+	for i := range 7 {
+		t := float64(i * 10)
+		samples = append(samples, trackerSample{Index: i + 1, TrackerKey: "headset", Timestamp: t, Position: vec3{X: t / 1000}})
+	}
+	samples[3].Position = vec3{X: 5, Y: -3}
+	return samples
+}
+
+func filterGlitches(samples []trackerSample, interpolate bool) []trackerSample {
+	return collectSamples(samples, func(next sampleStage) sampleStage {
+		return &glitchStage{next: next, maxSpeed: defaultOutlierSpeed, interpolate: interpolate}
+	})
+}
+
+func TestGlitchStage(t *testing.T) {
+	samples := walkWithGlitch()
+	dropped := filterGlitches(samples, false)
+	if len(dropped) != 6 || dropped[3].Index != 5 {
+		t.Fatalf("dropped = %+v", dropped)
+	}
+	fixed := filterGlitches(samples, true)
+	if len(fixed) != 7 || fixed[3].Position != (vec3{X: 0.03}) || samples[3].Position.X != 5 {
+		t.Fatalf("interpolated = %+v", fixed[3])
+	}
+
+	// a jump the tracker stays at is a move, not a glitch
+	var moved []trackerSample
+	for i := range 100 {
+		x := 0.0
+		if i >= 10 {
+			x = 3
+		}
+		moved = append(moved, trackerSample{Timestamp: float64(i * 10), Position: vec3{X: x}})
+	}
+	for _, interpolate := range []bool{false, true} {
+		got := filterGlitches(moved, interpolate)
+		if !slices.EqualFunc(got, moved, func(a, b trackerSample) bool { return a.Timestamp == b.Timestamp && a.Position == b.Position }) {
+			t.Fatalf("recentered session filtered with interpolate=%v: %+v", interpolate, got)
+		}
+	}
+}
+
+func TestTrajectoryOutlierFilter(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	var lines []string
+	for _, sample := range walkWithGlitch() {
+		line, _ := json.Marshal(map[string]any{"trackerKey": sample.TrackerKey, "timestamp": sample.Timestamp, "position": sample.Position})
+		lines = append(lines, string(line))
+	}
+	simulateUpload(t, key, lines)
+
+	for query, want := range map[string]int{"": 7, "?filter=outliers": 6, "?filter=outliers:interpolate": 7, "?filter=outliers&outlier_speed=1000": 7} {
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/trajectory"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		TrajectoryHandler(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("trajectory%s status = %d: %s", query, rec.Code, rec.Body)
+		}
+		if got := strings.Count(rec.Body.String(), `"trackerKey"`); got != want {
+			t.Errorf("trajectory%s has %d samples, want %d: %s", query, got, want, rec.Body)
+		}
+		if query == "?filter=outliers:interpolate" && strings.Contains(rec.Body.String(), `"x":5`) {
+			t.Errorf("interpolated trajectory still has the glitch: %s", rec.Body)
+		}
+	}
+
+	for _, query := range []string{"?filter=spikes", "?filter=outliers:smooth", "?filter=outliers&outlier_speed=0"} {
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/export"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ExportHandler(rec, req)
+		if rec.Code != 400 {
+			t.Errorf("export%s status = %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+)
+
+// The packed upload format (Content-Type application/x-hrdemo-packed) is a
+// little-endian frame for bandwidth-constrained clients:
+//
+//	magic     [4]byte  "HRDP"
+//	version   uint8    1
+//	trackers  uint8    number of tracker names that follow
+//	  length  uint8    \ repeated: the tracker key, indexed by
+//	  name    []byte   / position from 0
+//	samples, repeated until the end of the body, 21 bytes each:
+//	  tracker   uint8    index into the tracker names
+//	  timestamp int64    scene time in microseconds
+//	  x, y, z   float32  position
+//
+// Each sample is stored as the canonical JSON record
+// {"trackerKey":...,"timestamp":<ms>,"position":{"x":...,"y":...,"z":...}}.
+const (
+	packedMagic      = "HRDP"
+	packedVersion    = 1
+	packedSampleSize = 1 + 8 + 3*4
+)
+
+func readPackedRecords(body io.Reader) ([]string, error) {
+	reader := bufio.NewReader(body)
+
+	header := make([]byte, len(packedMagic)+2)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, errors.New("invalid packed body: truncated header")
+	}
+	if string(header[:len(packedMagic)]) != packedMagic {
+		return nil, errors.New("invalid packed body: bad magic")
+	}
+	if header[4] != packedVersion {
+		return nil, fmt.Errorf("invalid packed body: unsupported version %d", header[4])
+	}
+
+	// tracker names are kept JSON-encoded, ready to be copied into records
+	trackers := make([][]byte, header[5])
+	for i := range trackers {
+		length, err := reader.ReadByte()
+		if err != nil {
+			return nil, errors.New("invalid packed body: truncated tracker table")
+		}
+		name := make([]byte, length)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return nil, errors.New("invalid packed body: truncated tracker table")
+		}
+		trackers[i], _ = json.Marshal(string(name))
+	}
+
+	lines := make([]string, 0, 200)
+	sample := make([]byte, packedSampleSize)
+	for {
+		n, err := io.ReadFull(reader, sample)
+		if err == io.EOF {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid packed body: truncated sample %d (%d of %d bytes)", len(lines)+1, n, packedSampleSize)
+		}
+
+		tracker := int(sample[0])
+		if tracker >= len(trackers) {
+			return nil, fmt.Errorf("invalid packed body: sample %d has unknown tracker %d", len(lines)+1, tracker)
+		}
+		timestampUs := int64(binary.LittleEndian.Uint64(sample[1:9]))
+		var position [3]float32
+		for i := range position {
+			position[i] = math.Float32frombits(binary.LittleEndian.Uint32(sample[9+4*i:]))
+			if math.IsNaN(float64(position[i])) || math.IsInf(float64(position[i]), 0) {
+				return nil, fmt.Errorf("invalid packed body: sample %d has a non-finite position", len(lines)+1)
+			}
+		}
+
+		line := make([]byte, 0, 128)
+		line = append(line, `{"trackerKey":`...)
+		line = append(line, trackers[tracker]...)
+		line = append(line, `,"timestamp":`...)
+		line = strconv.AppendFloat(line, float64(timestampUs)/1000, 'f', -1, 64)
+		line = append(line, `,"position":{"x":`...)
+		line = strconv.AppendFloat(line, float64(position[0]), 'g', -1, 32)
+		line = append(line, `,"y":`...)
+		line = strconv.AppendFloat(line, float64(position[1]), 'g', -1, 32)
+		line = append(line, `,"z":`...)
+		line = strconv.AppendFloat(line, float64(position[2]), 'g', -1, 32)
+		line = append(line, "}}"...)
+		lines = append(lines, string(line))
+	}
+}
@@ -0,0 +1,80 @@
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"testing"
+)
+
+func encodePacked(trackers []string, samples []struct {
+	tracker     uint8
+	timestampUs int64
+	x, y, z     float32
+}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(packedMagic)
+	buf.WriteByte(packedVersion)
+	buf.WriteByte(byte(len(trackers)))
+	for _, name := range trackers {
+		buf.WriteByte(byte(len(name)))
+		buf.WriteString(name)
+	}
+	for _, s := range samples {
+		buf.WriteByte(s.tracker)
+		binary.Write(&buf, binary.LittleEndian, s.timestampUs)
+		binary.Write(&buf, binary.LittleEndian, [3]float32{s.x, s.y, s.z})
+	}
+	return buf.Bytes()
+}
+
+func TestUploadPacked(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	body := encodePacked([]string{"headset", "rightController"}, []struct {
+		tracker     uint8
+		timestampUs int64
+		x, y, z     float32
+	}{
+		{0, 0, 0.1, 1.6, -0.25},
+		{1, 16667, 0.3, 1.2, -0.3},
+	})
+	if got, want := len(body), 6+8+16+2*packedSampleSize; got != want {
+		t.Fatalf("encoded size = %d, want %d", got, want)
+	}
+
+	if code := postUpload(t, key, "application/x-hrdemo-packed", string(body)); code != 200 {
+		t.Fatalf("packed upload status = %d", code)
+	}
+	_, _, records := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, records, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0.1,"y":1.6,"z":-0.25}}`,
+		`{"trackerKey":"rightController","timestamp":16.667,"position":{"x":0.3,"y":1.2,"z":-0.3}}`,
+	})
+
+	samples, err := readTrackerSamples(key)
+	if err != nil || len(samples["headset"]) != 1 || len(samples["rightController"]) != 1 {
+		t.Fatalf("packed records not readable: %v %+v", err, samples)
+	}
+
+	bad := map[string][]byte{
+		"truncated sample": body[:len(body)-3],
+		"bad magic":        append([]byte("XXXX"), body[4:]...),
+		"unknown tracker": encodePacked([]string{"headset"}, []struct {
+			tracker     uint8
+			timestampUs int64
+			x, y, z     float32
+		}{{3, 0, 0, 0, 0}}),
+		"non-finite": encodePacked([]string{"headset"}, []struct {
+			tracker     uint8
+			timestampUs int64
+			x, y, z     float32
+		}{{0, 0, float32(math.NaN()), 0, 0}}),
+	}
+	for name, body := range bad {
+		if code := postUpload(t, key, "application/x-hrdemo-packed", string(body)); code != 400 {
+			t.Fatalf("%s: status = %d, want 400", name, code)
+		}
+	}
+}
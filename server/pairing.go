@@ -0,0 +1,233 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	pairingCodeLength = 6
+	pairingCodeTTL    = 5 * time.Minute
+	qrModuleScale     = 8
+)
+
+// pairingCodeAlphabet leaves out characters that are easily confused when
+// read off a headset display (0/O, 1/I/L).
+const pairingCodeAlphabet = "ABCDEFGHJKMNPQRSTUVWXYZ23456789"
+
+// A pairing code is a short-lived, single-use stand-in for an upload key
+// that a viewer claims to get a follow token. Follow tokens only allow
+// reading an upload, unlike the upload key, and last until the server
+// restarts.
+type pairing struct {
+	uploadKey string
+	expires   time.Time
+}
+
+var (
+	pairings      = map[string]pairing{}
+	followTokens  = map[string]string{}
+	pairingsMutex sync.Mutex
+)
+
+var errPairingNotFound = errors.New("pairing code not found or expired")
+
+func generatePairingCode() (string, error) {
+	buf := make([]byte, pairingCodeLength)
+	if _, err := rand.Read(buf); err != nil {
+		return "", fmt.Errorf("generate pairing code: %w", err)
+	}
+	// the modulo bias of 256 % 31 is irrelevant for a 5 minute code
+	code := make([]byte, pairingCodeLength)
+	for i, b := range buf {
+		code[i] = pairingCodeAlphabet[int(b)%len(pairingCodeAlphabet)]
+	}
+	return string(code), nil
+}
+
+func normalizePairingCode(raw string) string {
+	return strings.ToUpper(strings.TrimSpace(raw))
+}
+
+// lookupPairing returns the upload key a pairing code stands for, dropping
+// expired codes along the way.
+func lookupPairing(code string, now time.Time) (string, bool) {
+	pairingsMutex.Lock()
+	defer pairingsMutex.Unlock()
+
+	for c, p := range pairings {
+		if now.After(p.expires) {
+			delete(pairings, c)
+		}
+	}
+	p, ok := pairings[code]
+	return p.uploadKey, ok
+}
+
+// followTokenUploadKey returns the upload key a follow token grants read
+// access to.
+func followTokenUploadKey(token string) (string, bool) {
+	pairingsMutex.Lock()
+	defer pairingsMutex.Unlock()
+
+	uploadKey, ok := followTokens[strings.ToLower(strings.TrimSpace(token))]
+	return uploadKey, ok
+}
+
+// NewPairingHandler creates a pairing code for the upload key of the
+// requesting device, to be shown as text or QR code.
+func NewPairingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	uploadKey, status, errCode, err := requestUploadKey(r)
+	if err != nil {
+		writeError(w, status, errCode, err.Error())
+		return
+	}
+
+	if _, status, code, message := checkClientCert(r, uploadKey); status != 0 {
+		writeError(w, status, code, message)
+		return
+	}
+
+	expires := time.Now().Add(pairingCodeTTL).UTC()
+	var code string
+	for {
+		if code, err = generatePairingCode(); err != nil {
+			log.Printf("failed to generate pairing code: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to generate pairing code")
+			return
+		}
+		if _, taken := lookupPairing(code, time.Now()); !taken {
+			break
+		}
+	}
+
+	pairingsMutex.Lock()
+	pairings[code] = pairing{uploadKey: uploadKey, expires: expires}
+	pairingsMutex.Unlock()
+
+	log.Printf("pairing code created upload_name=%q", uploadNameFromKey(uploadKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"code":        code,
+		"upload_name": uploadNameFromKey(uploadKey),
+		"expires_at":  expires.Format(time.RFC3339Nano),
+		"qr_url":      "/api/v" + apiVersion + "/pair/" + code + "/qr.png",
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write pairing response: %v", err)
+	}
+}
+
+// ClaimPairingHandler exchanges a pairing code, given as {"code": ...}, for a
+// follow token. Each code can be claimed once.
+func ClaimPairingHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	var request struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1024)).Decode(&request); err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidBody, fmt.Sprintf("invalid claim JSON: %v", err))
+		return
+	}
+	code := normalizePairingCode(request.Code)
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		log.Printf("failed to generate follow token: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to generate follow token")
+		return
+	}
+	token := hex.EncodeToString(buf)
+
+	uploadKey, ok := lookupPairing(code, time.Now())
+	if ok {
+		pairingsMutex.Lock()
+		// another claim may have won in the meantime
+		if _, ok = pairings[code]; ok {
+			delete(pairings, code)
+			followTokens[token] = uploadKey
+		}
+		pairingsMutex.Unlock()
+	}
+	if !ok {
+		writeError(w, http.StatusNotFound, errCodePairingNotFound, errPairingNotFound.Error())
+		return
+	}
+
+	log.Printf("pairing code claimed upload_name=%q", uploadNameFromKey(uploadKey))
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":       "ok",
+		"upload_name":  uploadNameFromKey(uploadKey),
+		"follow_token": token,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write claim response: %v", err)
+	}
+}
+
+// PairingQRHandler serves a pairing code as a QR code PNG for a companion
+// app to scan.
+func PairingQRHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	code := normalizePairingCode(r.PathValue("code"))
+	if _, ok := lookupPairing(code, time.Now()); !ok {
+		writeError(w, http.StatusNotFound, errCodePairingNotFound, errPairingNotFound.Error())
+		return
+	}
+
+	qr, err := encodeQR([]byte(code))
+	if err != nil {
+		log.Printf("failed to encode pairing QR code: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to encode QR code")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := png.Encode(w, qr.image(qrModuleScale)); err != nil {
+		log.Printf("failed to write pairing QR code: %v", err)
+	}
+}
+
+// followUploadKey returns the upload a follow request is for: the one its
+// follow_token grants access to, the one called upload_name, or else the
+// one its upload key names. On failure it also returns the status and error code to
+// respond with.
+func followUploadKey(r *http.Request) (string, int, string, error) {
+	if token := r.URL.Query().Get("follow_token"); token != "" {
+		uploadKey, ok := followTokenUploadKey(token)
+		if !ok {
+			return "", http.StatusForbidden, errCodeInvalidFollowToken, errors.New("unknown follow_token: pair again to get a new one")
+		}
+		return uploadKey, 0, "", nil
+	}
+	if name := r.URL.Query().Get("upload_name"); name != "" {
+		return resolveUploadNameStatus(name)
+	}
+	return requestUploadKey(r)
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"image/png"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func claimPairing(t *testing.T, code string) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ClaimPairingHandler(rec, httptest.NewRequest("POST", "/api/pair/claim", strings.NewReader(`{"code":"`+code+`"}`)))
+	var response map[string]any
+	json.NewDecoder(rec.Body).Decode(&response)
+	return rec.Code, response
+}
+
+func TestPairing(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"heartRate":70}`})
+
+	rec := httptest.NewRecorder()
+	NewPairingHandler(rec, withUploadKey(httptest.NewRequest("POST", "/api/pair/new", nil), key))
+	var created struct {
+		Code  string `json:"code"`
+		QRURL string `json:"qr_url"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil || rec.Code != 200 {
+		t.Fatalf("new pairing: status %d, %v", rec.Code, err)
+	}
+	if len(created.Code) != pairingCodeLength || created.QRURL != "/api/v1/pair/"+created.Code+"/qr.png" {
+		t.Fatalf("new pairing = %+v", created)
+	}
+
+	req := httptest.NewRequest("GET", created.QRURL, nil)
+	req.SetPathValue("code", strings.ToLower(created.Code))
+	rec = httptest.NewRecorder()
+	PairingQRHandler(rec, req)
+	if rec.Code != 200 || rec.Header().Get("Content-Type") != "image/png" {
+		t.Fatalf("qr: status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+	img, err := png.Decode(bytes.NewReader(rec.Body.Bytes()))
+	if err != nil {
+		t.Fatalf("qr is not a png: %v", err)
+	}
+	if side := img.Bounds().Dx(); side != (21+8)*qrModuleScale {
+		t.Fatalf("qr width = %d", side)
+	}
+
+	code, claimed := claimPairing(t, strings.ToLower(created.Code))
+	token, _ := claimed["follow_token"].(string)
+	if code != 200 || token == "" || claimed["upload_name"] != uploadNameFromKey(key) {
+		t.Fatalf("claim: status %d %v", code, claimed)
+	}
+	if code, _ := claimPairing(t, created.Code); code != 404 {
+		t.Fatalf("second claim: status %d, want 404", code)
+	}
+
+	rec = httptest.NewRecorder()
+	FollowHandler(rec, httptest.NewRequest("GET", "/api/follow?follow_token="+token, nil))
+	if rec.Code != 200 || strings.TrimSpace(rec.Body.String()) != `1,{"heartRate":70}` {
+		t.Fatalf("follow with token: status %d body %q", rec.Code, rec.Body.String())
+	}
+	rec = httptest.NewRecorder()
+	FollowHandler(rec, httptest.NewRequest("GET", "/api/follow?follow_token=00ff", nil))
+	if rec.Code != 403 {
+		t.Fatalf("follow with unknown token: status %d", rec.Code)
+	}
+
+	// expired codes can't be claimed
+	pairingsMutex.Lock()
+	pairings["ABCDEF"] = pairing{uploadKey: key, expires: time.Now().Add(-time.Second)}
+	pairingsMutex.Unlock()
+	if code, _ := claimPairing(t, "ABCDEF"); code != 404 {
+		t.Fatalf("claim of expired code: status %d", code)
+	}
+}
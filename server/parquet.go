@@ -0,0 +1,363 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A minimal Parquet writer: flat schemas, PLAIN encoding, no compression and
+// one data page per column chunk. That is all the export needs, and it
+// keeps the server free of a full Parquet implementation.
+// See https://github.com/apache/parquet-format for the format.
+
+const parquetMagic = "PAR1"
+
+// Parquet physical types.
+const (
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+)
+
+// Parquet enum values used in the metadata.
+const (
+	parquetRequired     = 0
+	parquetOptional     = 1
+	parquetConvertedUTF = 0
+	parquetPlain        = 0
+	parquetRLE          = 3
+	parquetDataPage     = 0
+	parquetUncompressed = 0
+)
+
+// defaultParquetRowGroupSize bounds how many rows are buffered in memory
+// before a row group is written.
+const defaultParquetRowGroupSize = 64 * 1024
+
+type parquetColumn struct {
+	Name     string
+	Type     int32
+	Optional bool
+	UTF8     bool
+}
+
+type parquetColumnBuffer struct {
+	values    []byte
+	defLevels []bool
+	nulls     int
+}
+
+type parquetChunkMeta struct {
+	offset    int64
+	size      int64
+	numValues int64
+}
+
+type parquetRowGroupMeta struct {
+	rows   int64
+	size   int64
+	chunks []parquetChunkMeta
+}
+
+type parquetWriter struct {
+	w            io.Writer
+	offset       int64
+	columns      []parquetColumn
+	buffers      []parquetColumnBuffer
+	rows         int64
+	rowGroupSize int64
+	rowGroups    []parquetRowGroupMeta
+	totalRows    int64
+}
+
+func newParquetWriter(w io.Writer, columns []parquetColumn) (*parquetWriter, error) {
+	p := &parquetWriter{
+		w:            w,
+		columns:      columns,
+		buffers:      make([]parquetColumnBuffer, len(columns)),
+		rowGroupSize: defaultParquetRowGroupSize,
+	}
+	if err := p.write([]byte(parquetMagic)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func (p *parquetWriter) write(data []byte) error {
+	n, err := p.w.Write(data)
+	p.offset += int64(n)
+	return err
+}
+
+// writeRow appends a row. Values must be int64, float64 or string matching
+// the column types, or nil for a null in an optional column.
+func (p *parquetWriter) writeRow(values ...any) error {
+	if len(values) != len(p.columns) {
+		return fmt.Errorf("parquet row has %d values, want %d", len(values), len(p.columns))
+	}
+
+	for i, value := range values {
+		column, buf := p.columns[i], &p.buffers[i]
+		if value == nil {
+			if !column.Optional {
+				return fmt.Errorf("parquet column %s is required", column.Name)
+			}
+			buf.defLevels = append(buf.defLevels, false)
+			buf.nulls++
+			continue
+		}
+		if column.Optional {
+			buf.defLevels = append(buf.defLevels, true)
+		}
+
+		switch v := value.(type) {
+		case int64:
+			buf.values = binary.LittleEndian.AppendUint64(buf.values, uint64(v))
+		case float64:
+			buf.values = binary.LittleEndian.AppendUint64(buf.values, math.Float64bits(v))
+		case string:
+			buf.values = binary.LittleEndian.AppendUint32(buf.values, uint32(len(v)))
+			buf.values = append(buf.values, v...)
+		default:
+			return fmt.Errorf("unsupported parquet value %T for column %s", value, column.Name)
+		}
+	}
+
+	p.rows++
+	if p.rows >= p.rowGroupSize {
+		return p.flushRowGroup()
+	}
+	return nil
+}
+
+func (p *parquetWriter) flushRowGroup() error {
+	if p.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroupMeta{rows: p.rows}
+	for i, column := range p.columns {
+		buf := &p.buffers[i]
+
+		var page []byte
+		if column.Optional {
+			levels := encodeParquetLevels(buf.defLevels)
+			page = binary.LittleEndian.AppendUint32(page, uint32(len(levels)))
+			page = append(page, levels...)
+		}
+		page = append(page, buf.values...)
+
+		header := &thriftEncoder{}
+		header.beginStruct()
+		header.i32Field(1, parquetDataPage)
+		header.i32Field(2, int32(len(page)))
+		header.i32Field(3, int32(len(page)))
+		header.structField(5)
+		header.i32Field(1, int32(p.rows))
+		header.i32Field(2, parquetPlain)
+		header.i32Field(3, parquetRLE)
+		header.i32Field(4, parquetRLE)
+		header.endStruct()
+		header.endStruct()
+
+		chunk := parquetChunkMeta{offset: p.offset, numValues: p.rows}
+		if err := p.write(header.buf); err != nil {
+			return err
+		}
+		if err := p.write(page); err != nil {
+			return err
+		}
+		chunk.size = p.offset - chunk.offset
+		group.size += chunk.size
+		group.chunks = append(group.chunks, chunk)
+
+		*buf = parquetColumnBuffer{values: buf.values[:0], defLevels: buf.defLevels[:0]}
+	}
+
+	p.rowGroups = append(p.rowGroups, group)
+	p.totalRows += p.rows
+	p.rows = 0
+	return nil
+}
+
+// encodeParquetLevels encodes definition levels (bit width 1) with the
+// RLE/bit-packing hybrid, using RLE runs only.
+func encodeParquetLevels(levels []bool) []byte {
+	var out []byte
+	for i := 0; i < len(levels); {
+		j := i
+		for j < len(levels) && levels[j] == levels[i] {
+			j++
+		}
+		out = binary.AppendUvarint(out, uint64(j-i)<<1)
+		if levels[i] {
+			out = append(out, 1)
+		} else {
+			out = append(out, 0)
+		}
+		i = j
+	}
+	return out
+}
+
+// close writes any buffered rows and the file footer. keyValues are stored
+// as key/value metadata of the file.
+func (p *parquetWriter) close(keyValues [][2]string) error {
+	if err := p.flushRowGroup(); err != nil {
+		return err
+	}
+
+	meta := &thriftEncoder{}
+	meta.beginStruct()
+	meta.i32Field(1, 1)
+
+	meta.listField(2, thriftStruct, len(p.columns)+1)
+	meta.beginStruct()
+	meta.stringField(4, "schema")
+	meta.i32Field(5, int32(len(p.columns)))
+	meta.endStruct()
+	for _, column := range p.columns {
+		meta.beginStruct()
+		meta.i32Field(1, column.Type)
+		repetition := int32(parquetRequired)
+		if column.Optional {
+			repetition = parquetOptional
+		}
+		meta.i32Field(3, repetition)
+		meta.stringField(4, column.Name)
+		if column.UTF8 {
+			meta.i32Field(6, parquetConvertedUTF)
+		}
+		meta.endStruct()
+	}
+
+	meta.i64Field(3, p.totalRows)
+
+	meta.listField(4, thriftStruct, len(p.rowGroups))
+	for _, group := range p.rowGroups {
+		meta.beginStruct()
+		meta.listField(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			column := p.columns[i]
+			meta.beginStruct()
+			meta.i64Field(2, chunk.offset)
+			meta.structField(3)
+			meta.i32Field(1, column.Type)
+			meta.listField(2, thriftI32, 2)
+			meta.zigzag(parquetPlain)
+			meta.zigzag(parquetRLE)
+			meta.listField(3, thriftBinary, 1)
+			meta.binary(column.Name)
+			meta.i32Field(4, parquetUncompressed)
+			meta.i64Field(5, chunk.numValues)
+			meta.i64Field(6, chunk.size)
+			meta.i64Field(7, chunk.size)
+			meta.i64Field(9, chunk.offset)
+			meta.endStruct()
+			meta.endStruct()
+		}
+		meta.i64Field(2, group.size)
+		meta.i64Field(3, group.rows)
+		meta.endStruct()
+	}
+
+	if len(keyValues) > 0 {
+		meta.listField(5, thriftStruct, len(keyValues))
+		for _, kv := range keyValues {
+			meta.beginStruct()
+			meta.stringField(1, kv[0])
+			meta.stringField(2, kv[1])
+			meta.endStruct()
+		}
+	}
+	meta.stringField(6, "HR-Demo-App")
+	meta.endStruct()
+
+	if err := p.write(meta.buf); err != nil {
+		return err
+	}
+	if err := p.write(binary.LittleEndian.AppendUint32(nil, uint32(len(meta.buf)))); err != nil {
+		return err
+	}
+	return p.write([]byte(parquetMagic))
+}
+
+// Thrift compact protocol types.
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// thriftEncoder writes the subset of the Thrift compact protocol needed for
+// Parquet metadata.
+type thriftEncoder struct {
+	buf    []byte
+	lastID []int16
+}
+
+func (e *thriftEncoder) beginStruct() {
+	e.lastID = append(e.lastID, 0)
+}
+
+func (e *thriftEncoder) endStruct() {
+	e.buf = append(e.buf, 0)
+	e.lastID = e.lastID[:len(e.lastID)-1]
+}
+
+func (e *thriftEncoder) field(id int16, typ byte) {
+	last := &e.lastID[len(e.lastID)-1]
+	if delta := id - *last; delta > 0 && delta <= 15 {
+		e.buf = append(e.buf, byte(delta)<<4|typ)
+	} else {
+		e.buf = append(e.buf, typ)
+		e.zigzag(int64(id))
+	}
+	*last = id
+}
+
+func (e *thriftEncoder) zigzag(v int64) {
+	e.buf = binary.AppendUvarint(e.buf, uint64((v<<1)^(v>>63)))
+}
+
+func (e *thriftEncoder) binary(s string) {
+	e.buf = binary.AppendUvarint(e.buf, uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *thriftEncoder) i32Field(id int16, v int32) {
+	e.field(id, thriftI32)
+	e.zigzag(int64(v))
+}
+
+func (e *thriftEncoder) i64Field(id int16, v int64) {
+	e.field(id, thriftI64)
+	e.zigzag(v)
+}
+
+func (e *thriftEncoder) stringField(id int16, s string) {
+	e.field(id, thriftBinary)
+	e.binary(s)
+}
+
+// structField starts a nested struct field; close it with endStruct.
+func (e *thriftEncoder) structField(id int16) {
+	e.field(id, thriftStruct)
+	e.beginStruct()
+}
+
+// listField starts a list field. Its elements follow directly: struct
+// elements as beginStruct/endStruct pairs, scalars via zigzag or binary.
+func (e *thriftEncoder) listField(id int16, elemType byte, size int) {
+	e.field(id, thriftList)
+	if size < 15 {
+		e.buf = append(e.buf, byte(size)<<4|elemType)
+		return
+	}
+	e.buf = append(e.buf, 0xf0|elemType)
+	e.buf = binary.AppendUvarint(e.buf, uint64(size))
+}
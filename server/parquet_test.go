@@ -0,0 +1,220 @@
+package server
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+)
+
+// thriftDecoder reads the Thrift compact protocol into generic values:
+// structs become maps by field id, lists slices, integers int64 and
+// binaries strings. It is the reading side of thriftEncoder, for tests.
+type thriftDecoder struct {
+	buf []byte
+	pos int
+}
+
+func (d *thriftDecoder) byte() byte {
+	if d.pos >= len(d.buf) {
+		panic("thrift: unexpected end of data")
+	}
+	d.pos++
+	return d.buf[d.pos-1]
+}
+
+func (d *thriftDecoder) uvarint() uint64 {
+	v, n := binary.Uvarint(d.buf[d.pos:])
+	if n <= 0 {
+		panic("thrift: malformed varint")
+	}
+	d.pos += n
+	return v
+}
+
+func (d *thriftDecoder) zigzag() int64 {
+	v := d.uvarint()
+	return int64(v>>1) ^ -int64(v&1)
+}
+
+func (d *thriftDecoder) structValue() map[int16]any {
+	fields := map[int16]any{}
+	var last int16
+	for {
+		header := d.byte()
+		if header == 0 {
+			return fields
+		}
+		id := last + int16(header>>4)
+		if header>>4 == 0 {
+			id = int16(d.zigzag())
+		}
+		switch typ := header & 0x0f; typ {
+		case 1, 2:
+			// booleans are in the type of struct fields
+			fields[id] = typ == 1
+		default:
+			fields[id] = d.value(typ)
+		}
+		last = id
+	}
+}
+
+func (d *thriftDecoder) value(typ byte) any {
+	switch typ {
+	case 1, 2:
+		return d.byte() == 1
+	case 3:
+		return int64(int8(d.byte()))
+	case 4, 5, 6:
+		return d.zigzag()
+	case 7:
+		d.pos += 8
+		return math.Float64frombits(binary.LittleEndian.Uint64(d.buf[d.pos-8:]))
+	case thriftBinary:
+		n := int(d.uvarint())
+		d.pos += n
+		return string(d.buf[d.pos-n : d.pos])
+	case thriftList, 10:
+		header := d.byte()
+		size := int(header >> 4)
+		if size == 15 {
+			size = int(d.uvarint())
+		}
+		list := make([]any, size)
+		for i := range list {
+			list[i] = d.value(header & 0x0f)
+		}
+		return list
+	case thriftStruct:
+		return d.structValue()
+	}
+	panic(fmt.Sprintf("thrift: unsupported type %d", typ))
+}
+
+// decodeThrift decodes the Thrift struct at the start of data and returns
+// it with its encoded length.
+func decodeThrift(t *testing.T, data []byte) (fields map[int16]any, n int) {
+	t.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			t.Fatalf("decode thrift: %v", r)
+		}
+	}()
+	d := &thriftDecoder{buf: data}
+	return d.structValue(), d.pos
+}
+
+// parquetChunk is what a test needs of a column chunk of a Parquet file.
+type parquetChunk struct {
+	column     string
+	typ        int64
+	numValues  int64
+	pageOffset int64
+	size       int64
+}
+
+// readParquetFooter decodes the FileMetaData of a Parquet file and returns
+// its schema column names, row count and the chunks of its row groups.
+func readParquetFooter(t *testing.T, data []byte) (columns []string, rows int64, groups [][]parquetChunk) {
+	t.Helper()
+	if len(data) < 12 || string(data[:4]) != parquetMagic || string(data[len(data)-4:]) != parquetMagic {
+		t.Fatalf("parquet file is not framed by %q", parquetMagic)
+	}
+	footerLength := int(binary.LittleEndian.Uint32(data[len(data)-8:]))
+	if footerLength <= 0 || footerLength > len(data)-12 {
+		t.Fatalf("invalid parquet footer length %d", footerLength)
+	}
+	footer := data[len(data)-8-footerLength : len(data)-8]
+	meta, n := decodeThrift(t, footer)
+	if n != footerLength {
+		t.Fatalf("parquet footer is %d bytes, FileMetaData %d", footerLength, n)
+	}
+
+	schema := meta[2].([]any)
+	if root := schema[0].(map[int16]any); root[5] != int64(len(schema)-1) {
+		t.Fatalf("schema root has %v children, want %d", root[5], len(schema)-1)
+	}
+	for _, element := range schema[1:] {
+		columns = append(columns, element.(map[int16]any)[4].(string))
+	}
+	rows = meta[3].(int64)
+
+	for _, group := range meta[4].([]any) {
+		var chunks []parquetChunk
+		for _, chunk := range group.(map[int16]any)[1].([]any) {
+			columnMeta := chunk.(map[int16]any)[3].(map[int16]any)
+			chunks = append(chunks, parquetChunk{
+				column:     columnMeta[3].([]any)[0].(string),
+				typ:        columnMeta[1].(int64),
+				numValues:  columnMeta[5].(int64),
+				pageOffset: columnMeta[9].(int64),
+				size:       columnMeta[6].(int64),
+			})
+		}
+		groups = append(groups, chunks)
+	}
+	return columns, rows, groups
+}
+
+// readParquetColumn decodes the PLAIN data page of a chunk into its values,
+// nil for nulls. optional says whether the page has definition levels.
+func readParquetColumn(t *testing.T, data []byte, chunk parquetChunk, optional bool) []any {
+	t.Helper()
+	header, n := decodeThrift(t, data[chunk.pageOffset:])
+	if header[1] != int64(parquetDataPage) {
+		t.Fatalf("column %s page type = %v", chunk.column, header[1])
+	}
+	pageSize := int(header[3].(int64))
+	if int64(n+pageSize) != chunk.size {
+		t.Fatalf("column %s chunk is %d bytes, header and page %d", chunk.column, chunk.size, n+pageSize)
+	}
+	page := data[int(chunk.pageOffset)+n : int(chunk.pageOffset)+n+pageSize]
+	numValues := int(header[5].(map[int16]any)[1].(int64))
+
+	defined := make([]bool, numValues)
+	for i := range defined {
+		defined[i] = true
+	}
+	if optional {
+		levelsLength := int(binary.LittleEndian.Uint32(page))
+		levels := page[4 : 4+levelsLength]
+		page = page[4+levelsLength:]
+		defined = defined[:0]
+		for len(levels) > 0 {
+			run, n := binary.Uvarint(levels)
+			if n <= 0 || run&1 != 0 {
+				t.Fatalf("column %s: unexpected definition levels", chunk.column)
+			}
+			for range run >> 1 {
+				defined = append(defined, levels[n] == 1)
+			}
+			levels = levels[n+1:]
+		}
+	}
+
+	values := make([]any, len(defined))
+	for i, isDefined := range defined {
+		if !isDefined {
+			continue
+		}
+		switch chunk.typ {
+		case parquetDouble:
+			values[i] = math.Float64frombits(binary.LittleEndian.Uint64(page))
+			page = page[8:]
+		case parquetInt64:
+			values[i] = int64(binary.LittleEndian.Uint64(page))
+			page = page[8:]
+		case parquetByteArray:
+			length := int(binary.LittleEndian.Uint32(page))
+			values[i] = string(page[4 : 4+length])
+			page = page[4+length:]
+		default:
+			t.Fatalf("column %s has unsupported type %d", chunk.column, chunk.typ)
+		}
+	}
+	if len(page) != 0 {
+		t.Fatalf("column %s: %d bytes left after %d values", chunk.column, len(page), len(values))
+	}
+	return values
+}
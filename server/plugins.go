@@ -0,0 +1,257 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Analysis plugins are WebAssembly modules that compute custom metrics for
+// an upload. A plugin is a WASI command: it reads the upload's records as
+// NDJSON on stdin and writes a single JSON object of metrics to stdout.
+// Plugins are run by an external WASI runtime, wasmtime by default, which
+// keeps them away from the network and the file system; memory and fuel
+// limits can be given as runtime options, e.g.
+// "wasmtime run -W max-memory-size=268435456". The server adds a time limit
+// and caps what a plugin may write.
+
+const (
+	pluginTimeout        = time.Minute
+	maxPluginOutputBytes = 1024 * 1024
+	maxPluginStderrBytes = 4096
+	maxConcurrentPlugins = 4
+)
+
+var pluginNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+var (
+	pluginDir     string   // empty if plugins are disabled
+	pluginRuntime []string // command and options, followed by the module path
+
+	pluginSlots = make(chan struct{}, maxConcurrentPlugins)
+)
+
+// SetAnalysisPlugins enables the analysis plugins in dir, the files named
+// <plugin>.wasm, run with the WASI runtime command line runtime. It fails
+// if the runtime's command can't be found.
+func SetAnalysisPlugins(dir, runtime string) error {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return fmt.Errorf("analysis plugin directory: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("analysis plugin directory %s is not a directory", dir)
+	}
+	command := strings.Fields(runtime)
+	if len(command) == 0 {
+		return errors.New("missing WASI runtime command")
+	}
+	// the runtime is a separate program, so a missing one is reported now
+	// rather than on the first analysis
+	if _, err := exec.LookPath(command[0]); err != nil {
+		return fmt.Errorf("WASI runtime %q not found: install wasmtime (https://wasmtime.dev) or give another runtime with -wasm-runtime: %w", command[0], err)
+	}
+	pluginDir, pluginRuntime = dir, command
+	return nil
+}
+
+// listAnalysisPlugins returns the names of the installed plugins.
+func listAnalysisPlugins() ([]string, error) {
+	matches, err := filepath.Glob(filepath.Join(pluginDir, "*.wasm"))
+	if err != nil {
+		return nil, err
+	}
+	names := []string{}
+	for _, match := range matches {
+		if name := strings.TrimSuffix(filepath.Base(match), ".wasm"); pluginNamePattern.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// runAnalysisPlugin streams the records of an upload through a plugin and
+// returns the metrics it wrote.
+func runAnalysisPlugin(ctx context.Context, plugin, filePath string) (json.RawMessage, error) {
+	select {
+	case pluginSlots <- struct{}{}:
+		defer func() { <-pluginSlots }()
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, pluginTimeout)
+	defer cancel()
+	args := append(pluginRuntime[1:len(pluginRuntime):len(pluginRuntime)], filepath.Join(pluginDir, plugin+".wasm"))
+	cmd := exec.CommandContext(ctx, pluginRuntime[0], args...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	var stdout, stderr limitedBuffer
+	stdout.limit, stderr.limit = maxPluginOutputBytes, maxPluginStderrBytes
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("start plugin: %w", err)
+	}
+
+	// a plugin may stop reading early, which ends the feed with a broken pipe
+	feedErr := make(chan error, 1)
+	go func() {
+		writer := bufio.NewWriter(stdin)
+		err := scanUploadFile(filePath, func(_ int, payload []byte) error {
+			if _, err := writer.Write(payload); err != nil {
+				return err
+			}
+			return writer.WriteByte('\n')
+		})
+		if err == nil {
+			err = writer.Flush()
+		}
+		stdin.Close()
+		feedErr <- err
+	}()
+
+	waitErr := cmd.Wait()
+	if err := <-feedErr; errors.Is(err, errUploadNotFound) {
+		return nil, err
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		return nil, fmt.Errorf("plugin %s timed out after %s", plugin, pluginTimeout)
+	}
+	if waitErr != nil {
+		log.Printf("analysis plugin %s failed: %v: %s", plugin, waitErr, bytes.TrimSpace(stderr.Bytes()))
+		return nil, fmt.Errorf("plugin %s failed: %v", plugin, waitErr)
+	}
+	if stdout.overflow {
+		return nil, fmt.Errorf("plugin %s wrote more than %d bytes", plugin, maxPluginOutputBytes)
+	}
+
+	metrics := bytes.TrimSpace(stdout.Bytes())
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(metrics, &object); err != nil || object == nil {
+		return nil, fmt.Errorf("plugin %s didn't write a JSON object", plugin)
+	}
+	return metrics, nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so that a plugin can't exhaust memory through its output.
+type limitedBuffer struct {
+	bytes.Buffer
+	limit    int
+	overflow bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.Len(); len(p) > room {
+		b.overflow = true
+		b.Buffer.Write(p[:max(room, 0)])
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// AnalyzeHandler runs an analysis plugin, named by the plugin parameter, on
+// an upload and returns the metrics it computed.
+func AnalyzeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	if pluginDir == "" {
+		writeError(w, http.StatusNotFound, errCodePluginNotFound, "analysis plugins are disabled; start the server with -analysis-plugins")
+		return
+	}
+	plugin := r.URL.Query().Get("plugin")
+	if !pluginNamePattern.MatchString(plugin) {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid plugin parameter: must be the name of an installed plugin")
+		return
+	}
+	if _, err := os.Stat(filepath.Join(pluginDir, plugin+".wasm")); err != nil {
+		writeError(w, http.StatusNotFound, errCodePluginNotFound, fmt.Sprintf("no analysis plugin named %q", plugin))
+		return
+	}
+
+	filePath := uploadFilePath(uploadKey)
+	metadata, err := readUploadMetadata(filePath)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for analysis: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+	if metadata.Encryption != nil {
+		writeError(w, http.StatusConflict, errCodeEncryptionMismatch, "encrypted uploads can't be analyzed on the server")
+		return
+	}
+
+	metrics, err := runAnalysisPlugin(r.Context(), plugin, filePath)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusBadGateway, errCodePluginFailed, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"plugin":      plugin,
+		"metrics":     metrics,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write analysis response: %v", err)
+	}
+}
+
+// AnalysisPluginsHandler lists the installed analysis plugins.
+func AnalysisPluginsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	plugins := []string{}
+	if pluginDir != "" {
+		var err error
+		if plugins, err = listAnalysisPlugins(); err != nil {
+			log.Printf("failed to list analysis plugins: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to list analysis plugins")
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":  "ok",
+		"plugins": plugins,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write plugins response: %v", err)
+	}
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPluginRuntimeHelper stands in for a WASI runtime when run by the
+// plugin tests: it "runs" the module named by its last argument.
+func TestPluginRuntimeHelper(t *testing.T) {
+	if os.Getenv("HRDEMO_PLUGIN_HELPER") != "1" {
+		t.Skip("only run as a fake plugin runtime")
+	}
+	module := filepath.Base(os.Args[len(os.Args)-1])
+	switch module {
+	case "count.wasm":
+		records, bpm := 0, 0.0
+		scanner := bufio.NewScanner(os.Stdin)
+		for scanner.Scan() {
+			var record struct{ BPM float64 }
+			json.Unmarshal(scanner.Bytes(), &record)
+			records++
+			bpm += record.BPM
+		}
+		fmt.Printf(`{"records":%d,"mean_bpm":%g}`, records, bpm/float64(records))
+	case "crash.wasm":
+		fmt.Fprint(os.Stderr, "unreachable executed")
+		os.Exit(1)
+	case "chatty.wasm":
+		fmt.Print(strings.Repeat("x", maxPluginOutputBytes+1))
+	default:
+		fmt.Print(`"not an object"`)
+	}
+	os.Exit(0)
+}
+
+func analyze(t *testing.T, key, plugin string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/uploads/"+key+"/analyze?plugin="+plugin, nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	AnalyzeHandler(rec, req)
+	var response map[string]any
+	json.NewDecoder(rec.Body).Decode(&response)
+	return rec.Code, response
+}
+
+func TestAnalyzeHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":80}`})
+
+	if code, _ := analyze(t, key, "count"); code != 404 {
+		t.Fatalf("analyze without plugins: status %d", code)
+	}
+
+	os.Mkdir("plugins", 0o755)
+	for _, name := range []string{"count", "crash", "chatty", "scalar"} {
+		os.WriteFile(filepath.Join("plugins", name+".wasm"), []byte("\x00asm"), 0o644)
+	}
+	t.Setenv("HRDEMO_PLUGIN_HELPER", "1")
+	if err := SetAnalysisPlugins("plugins", os.Args[0]+" -test.run=^TestPluginRuntimeHelper$ --"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { pluginDir, pluginRuntime = "", nil })
+	if err := SetAnalysisPlugins("plugins", "hrdemo-no-such-runtime run"); err == nil || !strings.Contains(err.Error(), "-wasm-runtime") {
+		t.Fatalf("missing runtime accepted: %v", err)
+	}
+
+	rec := httptest.NewRecorder()
+	AnalysisPluginsHandler(rec, httptest.NewRequest("GET", "/api/analysis-plugins", nil))
+	if !strings.Contains(rec.Body.String(), `"plugins":["chatty","count","crash","scalar"]`) {
+		t.Fatalf("plugins = %s", rec.Body)
+	}
+
+	code, response := analyze(t, key, "count")
+	metrics, _ := response["metrics"].(map[string]any)
+	if code != 200 || metrics["records"] != float64(2) || metrics["mean_bpm"] != float64(75) {
+		t.Fatalf("analyze: status %d, %v", code, response)
+	}
+
+	for plugin, want := range map[string]int{"crash": 502, "chatty": 502, "scalar": 502, "missing": 404, "../count": 400} {
+		if code, response := analyze(t, key, plugin); code != want {
+			t.Errorf("analyze with %s: status %d, want %d: %v", plugin, code, want, response)
+		}
+	}
+	if code, _ := analyze(t, newTestUploadKey(t), "count"); code != 404 {
+		t.Errorf("analyze missing upload: status %d", code)
+	}
+}
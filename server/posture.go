@@ -0,0 +1,245 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+)
+
+// Posture is read from heights above the floor, Y in the clients' local-floor
+// space. The standing height of a participant is estimated as a high
+// percentile of their headset height, so that a session spent mostly
+// crouching still finds it; below crouchRatio of it they count as crouching.
+// Times are weighted by the time to the next sample, with gaps longer than
+// the gap threshold left out.
+
+const (
+	defaultPostureBin         = 0.05 // m
+	defaultCrouchRatio        = 0.8
+	standingHeightPercentile  = 0.9
+	maxPostureHistogramLength = 1000
+)
+
+// handTrackers are the tracker keys of the hands, as the VR clients send
+// them.
+var handTrackers = []string{"leftController", "rightController"}
+
+type heightHistogram struct {
+	Bin     float64   `json:"bin"`
+	Start   float64   `json:"start"`
+	Seconds []float64 `json:"seconds"`
+}
+
+type headsetPosture struct {
+	Samples          int             `json:"samples"`
+	Seconds          float64         `json:"seconds"`
+	Height           *distribution   `json:"height"`
+	Histogram        heightHistogram `json:"histogram"`
+	StandingHeight   float64         `json:"standing_height"`
+	CrouchHeight     float64         `json:"crouch_height"`
+	StandingSeconds  float64         `json:"standing_seconds"`
+	CrouchingSeconds float64         `json:"crouching_seconds"`
+	CrouchingShare   float64         `json:"crouching_share"`
+}
+
+type handPosture struct {
+	Samples        int           `json:"samples"`
+	RelativeHeight *distribution `json:"relative_height"`
+	AboveHeadShare float64       `json:"above_head_share"`
+}
+
+type sessionPosture struct {
+	Headset headsetPosture         `json:"headset"`
+	Hands   map[string]handPosture `json:"hands"`
+}
+
+// sampleWeights returns how long, in seconds, each sample stands for: the
+// time to the next sample, or nothing across a gap and for the last one.
+func sampleWeights(samples []trackerSample, gapThresholdMs float64) []float64 {
+	weights := make([]float64, len(samples))
+	for i := 0; i+1 < len(samples); i++ {
+		if dt := samples[i+1].Timestamp - samples[i].Timestamp; dt > 0 && dt <= gapThresholdMs {
+			weights[i] = dt / 1000
+		}
+	}
+	return weights
+}
+
+// headPositionAt returns where the headset was at t, interpolating between
+// the samples around it. head is in timestamp order; from is a hint where
+// to start looking, which is advanced for callers going forward in time.
+func headPositionAt(head []trackerSample, t float64, from *int) vec3 {
+	i := *from
+	for i+1 < len(head) && head[i+1].Timestamp <= t {
+		i++
+	}
+	*from = i
+	cur := head[i]
+	if i+1 == len(head) || t <= cur.Timestamp {
+		return cur.Position
+	}
+	next := head[i+1]
+	d := next.Position.sub(cur.Position).scale((t - cur.Timestamp) / (next.Timestamp - cur.Timestamp))
+	return vec3{cur.Position.X + d.X, cur.Position.Y + d.Y, cur.Position.Z + d.Z}
+}
+
+type postureOptions struct {
+	bin            float64
+	crouchRatio    float64
+	standingHeight float64 // 0 to estimate it
+	gapThresholdMs float64
+}
+
+func computePosture(samples map[string][]trackerSample, options postureOptions) (sessionPosture, error) {
+	head := samples[defaultTracker]
+	if len(head) == 0 {
+		return sessionPosture{}, fmt.Errorf("no samples for tracker %q", defaultTracker)
+	}
+
+	heights := make([]float64, len(head))
+	for i, s := range head {
+		heights[i] = s.Position.Y
+	}
+	sorted := slices.Sorted(slices.Values(heights))
+	posture := sessionPosture{
+		Headset: headsetPosture{
+			Samples:        len(head),
+			Height:         describeDistribution(heights),
+			StandingHeight: sorted[int(standingHeightPercentile*float64(len(sorted)-1))],
+		},
+		Hands: map[string]handPosture{},
+	}
+	h := &posture.Headset
+	if options.standingHeight > 0 {
+		h.StandingHeight = options.standingHeight
+	}
+	h.CrouchHeight = h.StandingHeight * options.crouchRatio
+	bin := options.bin
+
+	// heights on a bin edge go into the bin above, rounding aside
+	binOf := func(height float64, start float64) int { return int(math.Floor((height-start)/bin + 1e-9)) }
+	start := math.Floor(sorted[0]/bin+1e-9) * bin
+	// bounded as a float, which a tiny or NaN bin overflows as an int
+	span := math.Floor((sorted[len(sorted)-1]-start)/bin+1e-9) + 1
+	if !(span >= 1 && span <= maxPostureHistogramLength) {
+		return sessionPosture{}, fmt.Errorf("height histogram would have %.0f bins, limit is %d: use a larger bin", span, maxPostureHistogramLength)
+	}
+	bins := int(span)
+	h.Histogram = heightHistogram{Bin: bin, Start: start, Seconds: make([]float64, bins)}
+	for i, weight := range sampleWeights(head, options.gapThresholdMs) {
+		h.Seconds += weight
+		h.Histogram.Seconds[min(binOf(heights[i], start), bins-1)] += weight
+		if heights[i] < h.CrouchHeight {
+			h.CrouchingSeconds += weight
+		} else {
+			h.StandingSeconds += weight
+		}
+	}
+	if h.Seconds > 0 {
+		h.CrouchingShare = h.CrouchingSeconds / h.Seconds
+	}
+
+	for _, tracker := range handTrackers {
+		hand := samples[tracker]
+		if len(hand) == 0 {
+			continue
+		}
+		relative := make([]float64, len(hand))
+		var seconds, above float64
+		from := 0
+		weights := sampleWeights(hand, options.gapThresholdMs)
+		for i, s := range hand {
+			relative[i] = s.Position.Y - headPositionAt(head, s.Timestamp, &from).Y
+			seconds += weights[i]
+			if relative[i] > 0 {
+				above += weights[i]
+			}
+		}
+		hp := handPosture{Samples: len(hand), RelativeHeight: describeDistribution(relative)}
+		if seconds > 0 {
+			hp.AboveHeadShare = above / seconds
+		}
+		posture.Hands[tracker] = hp
+	}
+	return posture, nil
+}
+
+// PostureHandler reports how high the headset was over the session, how
+// long the participant stood and crouched, and how high the hands were
+// relative to the head. bin sets the histogram bin in metres, crouch_ratio
+// the share of the standing height below which they crouched, and
+// standing_height overrides the estimated standing height.
+func PostureHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	bin, err := parsePositiveFloatParam(r, "bin", defaultPostureBin)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	crouchRatio, err := parsePositiveFloatParam(r, "crouch_ratio", defaultCrouchRatio)
+	if err == nil && crouchRatio >= 1 {
+		err = errors.New("invalid crouch_ratio parameter: must be below 1")
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	standingHeight, err := parsePositiveFloatParam(r, "standing_height", 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	gapThresholdMs, err := parseGapThreshold(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for posture: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+	if len(samples[defaultTracker]) == 0 {
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, fmt.Sprintf("no samples for tracker %q", defaultTracker))
+		return
+	}
+	posture, err := computePosture(samples, postureOptions{
+		bin:            bin,
+		crouchRatio:    crouchRatio,
+		standingHeight: standingHeight,
+		gapThresholdMs: gapThresholdMs,
+	})
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"posture":     posture,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write posture response: %v", err)
+	}
+}
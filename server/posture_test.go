@@ -0,0 +1,72 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestPosture(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	// 8 s standing at 1.7 m, then 2 s crouching at 1.0 m, one sample per
+	// 100 ms; the right hand is raised above the head for the first second
+	var lines []string
+	for i := range 101 {
+		ts := float64(i * 100)
+		y := 1.7
+		if i >= 80 {
+			y = 1.0
+		}
+		handY := y - 0.6
+		if i < 10 {
+			handY = y + 0.2
+		}
+		lines = append(lines,
+			fmt.Sprintf(`{"trackerKey":"headset","timestamp":%v,"position":{"x":0,"y":%v,"z":0}}`, ts, y),
+			fmt.Sprintf(`{"trackerKey":"rightController","timestamp":%v,"position":{"x":0.3,"y":%v,"z":0}}`, ts+50, handY),
+		)
+	}
+	simulateUpload(t, key, lines)
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/posture", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	PostureHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("posture status = %d: %s", rec.Code, rec.Body)
+	}
+	var response struct {
+		Posture sessionPosture `json:"posture"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	h := response.Posture.Headset
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-6 }
+	if h.StandingHeight != 1.7 || !near(h.CrouchHeight, 1.36) || !near(h.StandingSeconds, 8) || !near(h.CrouchingSeconds, 2) || !near(h.CrouchingShare, 0.2) {
+		t.Fatalf("headset posture = %+v", h)
+	}
+	if len(h.Histogram.Seconds) != 15 || !near(h.Histogram.Seconds[0], 2) || !near(h.Histogram.Seconds[14], 8) {
+		t.Fatalf("height histogram = %+v", h.Histogram)
+	}
+	right, ok := response.Posture.Hands["rightController"]
+	if !ok || !near(right.RelativeHeight.Median, -0.6) || !near(right.AboveHeadShare, 0.1) {
+		t.Fatalf("right hand posture = %+v", right)
+	}
+	if _, ok := response.Posture.Hands["leftController"]; ok {
+		t.Fatal("posture of a hand without samples")
+	}
+
+	for _, query := range []string{"?bin=0", "?crouch_ratio=1.2", "?bin=0.0001", "?bin=1e-300", "?bin=5e-324", "?bin=NaN"} {
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/posture"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		PostureHandler(rec, req)
+		if rec.Code != 400 {
+			t.Errorf("posture%s status = %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// User agent policies, set by SetUserAgentPolicy.
+const (
+	userAgentKeep = "keep"
+	userAgentHash = "hash"
+	userAgentOmit = "omit"
+)
+
+var (
+	userAgentPolicy = userAgentKeep
+
+	// dropClientIPs keeps client addresses out of upload metadata and the
+	// access log. Set by DropClientIPs.
+	dropClientIPs bool
+)
+
+// SetUserAgentPolicy sets what is kept of the User-Agent of uploads and
+// heartbeats, in upload metadata, sessions and logs: keep stores it as sent,
+// hash a SHA-256 prefix that still tells clients apart, and omit nothing.
+// User agents are few enough that a hash can be reversed by hashing
+// candidates, so use omit where even that is too much.
+func SetUserAgentPolicy(policy string) error {
+	switch policy {
+	case userAgentKeep, userAgentHash, userAgentOmit:
+		userAgentPolicy = policy
+		return nil
+	}
+	return fmt.Errorf("invalid user agent policy %q: must be keep, hash or omit", policy)
+}
+
+// DropClientIPs stops storing the client address in the metadata of new
+// uploads and logging it per request. Rate limits and proxy handling still
+// see it.
+func DropClientIPs() {
+	dropClientIPs = true
+}
+
+// requestUserAgent is the User-Agent of r as the user agent policy allows it
+// to be stored.
+func requestUserAgent(r *http.Request) string {
+	userAgent := r.Header.Get("User-Agent")
+	switch {
+	case userAgent == "" || userAgentPolicy == userAgentKeep:
+		return userAgent
+	case userAgentPolicy == userAgentHash:
+		sum := sha256.Sum256([]byte(userAgent))
+		return "sha256:" + hex.EncodeToString(sum[:8])
+	}
+	return ""
+}
+
+// loggedClientIP is the client address of r for the access log.
+func loggedClientIP(r *http.Request) string {
+	if dropClientIPs {
+		return "-"
+	}
+	return clientIP(r)
+}
+
+var uploadKeyPattern = regexp.MustCompile(fmt.Sprintf(`(?i)[0-9a-f]{%d}`, uploadKeyHexLength))
+
+// redactUploadKeys replaces the upload keys in s, e.g. in a file path, with
+// their hash.
+func redactUploadKeys(s string) string {
+	return uploadKeyPattern.ReplaceAllStringFunc(s, func(key string) string {
+		return "{" + uploadKeyHash(key) + "}"
+	})
+}
+
+// RedactUploadKeys returns a writer that replaces upload keys in what is
+// written to w with their hash, as in "{3f2a9c01be47}". It is meant for the
+// log output, so that keys that end up in a log line, e.g. in the file path
+// of an error, are not leaked; log lines name uploads by key_hash anyway.
+func RedactUploadKeys(w io.Writer) io.Writer {
+	return redactingWriter{w}
+}
+
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.w, redactUploadKeys(string(p))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
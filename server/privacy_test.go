@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func uploadWithUserAgent(t *testing.T, key, userAgent string) {
+	t.Helper()
+	req := withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader(`{"bpm":70}`)), key)
+	req.Header.Set("User-Agent", userAgent)
+	rec := httptest.NewRecorder()
+	UploadHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("upload status = %d body=%s", rec.Code, rec.Body)
+	}
+}
+
+func TestUploadLogsOmitKeys(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	uploadWithUserAgent(t, key, "Quest")
+	req := withUploadKey(httptest.NewRequest("GET", "/api/follow", nil), key)
+	FollowHandler(httptest.NewRecorder(), req)
+
+	if strings.Contains(strings.ToLower(logs.String()), key) {
+		t.Fatalf("logs contain the upload key:\n%s", logs.String())
+	}
+	if !strings.Contains(logs.String(), "key_hash="+uploadKeyHash(key)) {
+		t.Fatalf("logs lack the key hash:\n%s", logs.String())
+	}
+}
+
+func TestRedactUploadKeys(t *testing.T) {
+	key := strings.Repeat("ab", uploadKeyHexLength/2)
+	var out bytes.Buffer
+	w := RedactUploadKeys(&out)
+	line := "open uploads/calm-otter_" + strings.ToUpper(key) + ".csv: no such file\n"
+	if n, err := w.Write([]byte(line)); err != nil || n != len(line) {
+		t.Fatalf("Write = %d, %v", n, err)
+	}
+	if want := "open uploads/calm-otter_{" + uploadKeyHash(key) + "}.csv: no such file\n"; out.String() != want {
+		t.Fatalf("redacted %q, want %q", out.String(), want)
+	}
+}
+
+func TestUserAgentPolicy(t *testing.T) {
+	chdirTemp(t)
+	t.Cleanup(func() { userAgentPolicy = userAgentKeep })
+	if err := SetUserAgentPolicy("scramble"); err == nil {
+		t.Fatal("SetUserAgentPolicy accepted an unknown policy")
+	}
+
+	for policy, check := range map[string]func(string) bool{
+		userAgentKeep: func(stored string) bool { return stored == "OculusBrowser/30.0" },
+		userAgentHash: func(stored string) bool {
+			return strings.HasPrefix(stored, "sha256:") && len(stored) == len("sha256:")+16
+		},
+		userAgentOmit: func(stored string) bool { return stored == "" },
+	} {
+		if err := SetUserAgentPolicy(policy); err != nil {
+			t.Fatal(err)
+		}
+		key := newTestUploadKey(t)
+		uploadWithUserAgent(t, key, "OculusBrowser/30.0")
+		metadata, err := readUploadMetadata(uploadFilePath(key))
+		if err != nil || !check(metadata.UserAgent) {
+			t.Fatalf("%s: stored user agent %q, %v", policy, metadata.UserAgent, err)
+		}
+		activeSessionsMutex.Lock()
+		session := activeSessions[key]
+		activeSessionsMutex.Unlock()
+		if session == nil || !check(session.UserAgent) {
+			t.Fatalf("%s: session %+v", policy, session)
+		}
+	}
+}
+
+func TestDropClientIPs(t *testing.T) {
+	chdirTemp(t)
+	t.Cleanup(func() { dropClientIPs = false })
+
+	key := newTestUploadKey(t)
+	uploadWithUserAgent(t, key, "Quest")
+	if metadata, _ := readUploadMetadata(uploadFilePath(key)); metadata.ClientIP == "" {
+		t.Fatal("client IP not stored by default")
+	}
+
+	DropClientIPs()
+	key = newTestUploadKey(t)
+	uploadWithUserAgent(t, key, "Quest")
+	if metadata, _ := readUploadMetadata(uploadFilePath(key)); metadata.ClientIP != "" {
+		t.Fatalf("client IP stored: %q", metadata.ClientIP)
+	}
+	if got := loggedClientIP(httptest.NewRequest("GET", "/", nil)); got != "-" {
+		t.Fatalf("logged client IP = %q", got)
+	}
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// trustedProxies are the networks whose X-Forwarded-For and X-Real-IP
+// headers are believed. Set by SetTrustedProxies.
+var trustedProxies []netip.Prefix
+
+// SetTrustedProxies configures the reverse proxies allowed to report the
+// client address, as a comma-separated list of IPs or CIDR ranges.
+func SetTrustedProxies(list string) error {
+	var prefixes []netip.Prefix
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			addr, err := netip.ParseAddr(entry)
+			if err != nil {
+				return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+			}
+			prefixes = append(prefixes, netip.PrefixFrom(addr.Unmap(), addr.Unmap().BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(entry)
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	trustedProxies = prefixes
+	return nil
+}
+
+func isTrustedProxy(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	for _, prefix := range trustedProxies {
+		if prefix.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientIP returns the address of the client that made r. Forwarding headers
+// are only used when the connection comes from a trusted proxy (or over the
+// unix socket, which only a local proxy can reach). X-Forwarded-For is read
+// right to left, skipping trusted proxies, so a client can't spoof its
+// address by sending the header itself.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	peer, err := netip.ParseAddr(host)
+	viaUnixSocket := err != nil
+	if !viaUnixSocket && !isTrustedProxy(peer) {
+		return peer.Unmap().String()
+	}
+
+	if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+		hops := strings.Split(strings.Join(forwarded, ","), ",")
+		var leftmost string
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop, err := netip.ParseAddr(strings.TrimSpace(hops[i]))
+			if err != nil {
+				break
+			}
+			leftmost = hop.Unmap().String()
+			if !isTrustedProxy(hop) {
+				return leftmost
+			}
+		}
+		if leftmost != "" {
+			return leftmost
+		}
+	}
+
+	if realIP, err := netip.ParseAddr(strings.TrimSpace(r.Header.Get("X-Real-IP"))); err == nil {
+		return realIP.Unmap().String()
+	}
+
+	if viaUnixSocket {
+		return "unix"
+	}
+	return peer.Unmap().String()
+}
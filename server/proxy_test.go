@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientIP(t *testing.T) {
+	if err := SetTrustedProxies("10.0.0.0/8, 192.168.1.1"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { trustedProxies = nil })
+
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		realIP    string
+		want      string
+	}{
+		{"direct client", "203.0.113.5:1234", "", "", "203.0.113.5"},
+		{"untrusted peer spoofing", "203.0.113.5:1234", "1.2.3.4", "5.6.7.8", "203.0.113.5"},
+		{"trusted proxy", "10.1.2.3:443", "198.51.100.7", "", "198.51.100.7"},
+		{"proxy chain", "192.168.1.1:443", "1.2.3.4, 198.51.100.7, 10.9.9.9", "", "198.51.100.7"},
+		{"all hops trusted", "10.1.2.3:443", "10.0.0.1, 10.0.0.2", "", "10.0.0.1"},
+		{"real ip header", "10.1.2.3:443", "", "198.51.100.8", "198.51.100.8"},
+		{"unix socket", "@", "198.51.100.9", "", "198.51.100.9"},
+		{"ipv4 mapped peer", "[::ffff:203.0.113.5]:1234", "", "", "203.0.113.5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/", nil)
+			req.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				req.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			if tt.realIP != "" {
+				req.Header.Set("X-Real-IP", tt.realIP)
+			}
+			if got := clientIP(req); got != tt.want {
+				t.Fatalf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	if err := SetTrustedProxies("not-an-ip"); err == nil {
+		t.Fatal("expected an error for an invalid proxy")
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// publishQueueSize is the number of batches buffered for the publisher before
+// new ones are dropped, so a slow broker never holds up uploads.
+const publishQueueSize = 1024
+
+// publishedBatch is the message sent to the broker for every ingested upload
+// request. The upload key is left out since it grants write access.
+type publishedBatch struct {
+	UploadName string            `json:"upload_name"`
+	ReceivedAt string            `json:"received_at"`
+	Records    []json.RawMessage `json:"records"`
+}
+
+type batchSink interface {
+	send(message []byte) error
+}
+
+var publishQueue chan publishedBatch
+
+// StartPublisher forwards every ingested batch to the given target, one of
+//
+//	nats://host:4222/subject
+//	kafka+http://rest-proxy:8082/topic (or kafka+https://)
+//
+// Kafka is reached through a Confluent-compatible REST proxy.
+func StartPublisher(target string) error {
+	sink, err := parsePublishTarget(target)
+	if err != nil {
+		return err
+	}
+
+	publishQueue = make(chan publishedBatch, publishQueueSize)
+	go func() {
+		for batch := range publishQueue {
+			message, err := json.Marshal(batch)
+			if err == nil {
+				err = sink.send(message)
+			}
+			if err != nil {
+				log.Printf("failed to publish batch upload_name=%q records=%d: %v", batch.UploadName, len(batch.Records), err)
+			}
+		}
+	}()
+
+	return nil
+}
+
+func parsePublishTarget(target string) (batchSink, error) {
+	u, err := url.Parse(target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid publish target: %w", err)
+	}
+	topic := strings.Trim(u.Path, "/")
+	if u.Host == "" || topic == "" {
+		return nil, errors.New("invalid publish target: expected scheme://host:port/subject")
+	}
+
+	switch u.Scheme {
+	case "nats":
+		host := u.Host
+		if u.Port() == "" {
+			host = net.JoinHostPort(u.Hostname(), "4222")
+		}
+		return &natsSink{addr: host, subject: topic}, nil
+	case "kafka+http", "kafka+https":
+		base := strings.TrimPrefix(u.Scheme, "kafka+") + "://" + u.Host
+		return &kafkaRESTSink{url: base + "/topics/" + url.PathEscape(topic), client: &http.Client{Timeout: 10 * time.Second}}, nil
+	default:
+		return nil, fmt.Errorf("invalid publish target scheme %q: must be nats, kafka+http or kafka+https", u.Scheme)
+	}
+}
+
+// publishBatch queues an ingested batch for the publisher, if one is running.
+func publishBatch(uploadKey string, receivedAt time.Time, lines []string) {
+	if publishQueue == nil || len(lines) == 0 {
+		return
+	}
+
+	batch := publishedBatch{
+		UploadName: uploadNameFromKey(uploadKey),
+		ReceivedAt: receivedAt.Format(time.RFC3339Nano),
+		Records:    make([]json.RawMessage, len(lines)),
+	}
+	for i, line := range lines {
+		if json.Valid([]byte(line)) {
+			batch.Records[i] = json.RawMessage(line)
+		} else {
+			// ciphertext of an encrypted upload
+			batch.Records[i], _ = json.Marshal(line)
+		}
+	}
+
+	select {
+	case publishQueue <- batch:
+	default:
+		log.Printf("publish queue full, dropping batch upload_name=%q records=%d", batch.UploadName, len(lines))
+	}
+}
+
+// natsSink speaks the NATS text protocol over a single connection, which is
+// re-established on the next send after a failure.
+type natsSink struct {
+	addr    string
+	subject string
+
+	mu   sync.Mutex
+	conn net.Conn
+}
+
+func (s *natsSink) connect() error {
+	conn, err := net.DialTimeout("tcp", s.addr, 5*time.Second)
+	if err != nil {
+		return fmt.Errorf("connect to nats: %w", err)
+	}
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	info, err := reader.ReadString('\n')
+	conn.SetReadDeadline(time.Time{})
+	if err != nil || !strings.HasPrefix(info, "INFO ") {
+		conn.Close()
+		return fmt.Errorf("nats handshake failed: %q %v", info, err)
+	}
+	if _, err := conn.Write([]byte(`CONNECT {"verbose":false,"pedantic":false,"name":"hr-demo-app"}` + "\r\n")); err != nil {
+		conn.Close()
+		return fmt.Errorf("nats handshake failed: %w", err)
+	}
+
+	s.conn = conn
+	go s.readLoop(conn, reader)
+	return nil
+}
+
+// readLoop answers server pings and drops the connection when it fails.
+func (s *natsSink) readLoop(conn net.Conn, reader *bufio.Reader) {
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			s.mu.Lock()
+			if s.conn == conn {
+				s.conn = nil
+			}
+			s.mu.Unlock()
+			conn.Close()
+			return
+		}
+		switch {
+		case strings.HasPrefix(line, "PING"):
+			s.mu.Lock()
+			conn.Write([]byte("PONG\r\n"))
+			s.mu.Unlock()
+		case strings.HasPrefix(line, "-ERR"):
+			log.Printf("nats error: %s", strings.TrimSpace(line))
+		}
+	}
+}
+
+func (s *natsSink) send(message []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conn == nil {
+		if err := s.connect(); err != nil {
+			return err
+		}
+	}
+
+	var frame bytes.Buffer
+	fmt.Fprintf(&frame, "PUB %s %d\r\n", s.subject, len(message))
+	frame.Write(message)
+	frame.WriteString("\r\n")
+
+	s.conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if _, err := s.conn.Write(frame.Bytes()); err != nil {
+		s.conn.Close()
+		s.conn = nil
+		return fmt.Errorf("publish to nats: %w", err)
+	}
+	return nil
+}
+
+// kafkaRESTSink produces to a Kafka topic through the REST proxy API.
+type kafkaRESTSink struct {
+	url    string
+	client *http.Client
+}
+
+func (s *kafkaRESTSink) send(message []byte) error {
+	body, err := json.Marshal(map[string]any{
+		"records": []map[string]json.RawMessage{{"value": message}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := s.client.Post(s.url, "application/vnd.kafka.json.v2+json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("produce to kafka: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("produce to kafka: unexpected status %s", resp.Status)
+	}
+	return nil
+}
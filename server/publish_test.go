@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNATSSink(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {}\r\n"))
+		reader := bufio.NewReader(conn)
+		for {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return
+			}
+			if strings.HasPrefix(line, "PUB ") {
+				payload, _ := reader.ReadString('\n')
+				received <- line + payload
+				return
+			}
+		}
+	}()
+
+	sink, err := parsePublishTarget("nats://" + listener.Addr().String() + "/vr.records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.send([]byte(`{"a":1}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+	if got, want := <-received, "PUB vr.records 7\r\n{\"a\":1}\r\n"; got != want {
+		t.Fatalf("nats frame = %q, want %q", got, want)
+	}
+}
+
+func TestKafkaRESTSink(t *testing.T) {
+	var body []byte
+	var path string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		body, _ = io.ReadAll(r.Body)
+	}))
+	defer proxy.Close()
+
+	sink, err := parsePublishTarget(strings.Replace(proxy.URL, "http://", "kafka+http://", 1) + "/vr-records")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.send([]byte(`{"a":1}`)); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	var produced struct {
+		Records []struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"records"`
+	}
+	if err := json.Unmarshal(body, &produced); err != nil {
+		t.Fatalf("decode produce request: %v", err)
+	}
+	if path != "/topics/vr-records" || len(produced.Records) != 1 || string(produced.Records[0].Value) != `{"a":1}` {
+		t.Fatalf("unexpected produce request %s: %s", path, body)
+	}
+
+	if _, err := parsePublishTarget("amqp://localhost/x"); err == nil {
+		t.Fatal("expected error for unsupported scheme")
+	}
+}
@@ -0,0 +1,385 @@
+package server
+
+import (
+	"errors"
+	"image"
+	"image/color"
+)
+
+// A minimal QR code encoder: byte mode, error correction level M, versions 1
+// to 6 (up to 106 bytes), which is plenty for pairing codes and short URLs.
+
+// qrVersions describes each supported version at level M: the number of
+// blocks, data codewords per block, error correction codewords per block
+// and the position of the alignment pattern (0 if there is none).
+var qrVersions = []struct {
+	blocks, dataPerBlock, ecPerBlock, alignment int
+}{
+	1: {1, 16, 10, 0},
+	2: {1, 28, 16, 18},
+	3: {1, 44, 26, 22},
+	4: {2, 32, 18, 26},
+	5: {2, 43, 24, 30},
+	6: {4, 27, 16, 34},
+}
+
+var errQRTooLong = errors.New("data too long for a QR code")
+
+// qrCode is a square grid of modules; true is dark.
+type qrCode struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+// encodeQR returns the QR code for data.
+func encodeQR(data []byte) (*qrCode, error) {
+	version := 0
+	for v := 1; v < len(qrVersions); v++ {
+		// mode indicator, 8-bit length, data
+		if 4+8+8*len(data) <= 8*qrVersions[v].blocks*qrVersions[v].dataPerBlock {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+	spec := qrVersions[version]
+	capacity := spec.blocks * spec.dataPerBlock
+
+	var bits qrBitBuffer
+	bits.append(0b0100, 4) // byte mode
+	bits.append(len(data), 8)
+	for _, b := range data {
+		bits.append(int(b), 8)
+	}
+	bits.append(0, min(4, 8*capacity-len(bits)))
+	bits.append(0, (8-len(bits)%8)%8)
+	codewords := bits.bytes()
+	for pad := byte(0xec); len(codewords) < capacity; pad ^= 0xec ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	// split into blocks, add error correction and interleave
+	generator := reedSolomonGenerator(spec.ecPerBlock)
+	dataBlocks := make([][]byte, spec.blocks)
+	ecBlocks := make([][]byte, spec.blocks)
+	for i := range dataBlocks {
+		dataBlocks[i] = codewords[i*spec.dataPerBlock : (i+1)*spec.dataPerBlock]
+		ecBlocks[i] = reedSolomonRemainder(dataBlocks[i], generator)
+	}
+	var interleaved []byte
+	for i := 0; i < spec.dataPerBlock; i++ {
+		for _, block := range dataBlocks {
+			interleaved = append(interleaved, block[i])
+		}
+	}
+	for i := 0; i < spec.ecPerBlock; i++ {
+		for _, block := range ecBlocks {
+			interleaved = append(interleaved, block[i])
+		}
+	}
+
+	size := 17 + 4*version
+	qr := &qrCode{size: size, modules: make([][]bool, size), isFunction: make([][]bool, size)}
+	for y := range qr.modules {
+		qr.modules[y] = make([]bool, size)
+		qr.isFunction[y] = make([]bool, size)
+	}
+	qr.drawFunctionPatterns(spec.alignment)
+	qr.drawCodewords(interleaved)
+
+	// keep the mask with the lowest penalty
+	bestMask, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		qr.applyMask(mask)
+		qr.drawFormatBits(mask)
+		if penalty := qr.penalty(); bestPenalty < 0 || penalty < bestPenalty {
+			bestMask, bestPenalty = mask, penalty
+		}
+		qr.applyMask(mask) // undo
+	}
+	qr.applyMask(bestMask)
+	qr.drawFormatBits(bestMask)
+	return qr, nil
+}
+
+func (qr *qrCode) setFunction(x, y int, dark bool) {
+	qr.modules[y][x] = dark
+	qr.isFunction[y][x] = true
+}
+
+func (qr *qrCode) drawFunctionPatterns(alignment int) {
+	for i := 0; i < qr.size; i++ {
+		qr.setFunction(6, i, i%2 == 0)
+		qr.setFunction(i, 6, i%2 == 0)
+	}
+
+	for _, corner := range [][2]int{{3, 3}, {qr.size - 4, 3}, {3, qr.size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := corner[0]+dx, corner[1]+dy
+				if x < 0 || x >= qr.size || y < 0 || y >= qr.size {
+					continue
+				}
+				dist := max(absInt(dx), absInt(dy))
+				qr.setFunction(x, y, dist != 2 && dist != 4)
+			}
+		}
+	}
+
+	if alignment != 0 {
+		for dy := -2; dy <= 2; dy++ {
+			for dx := -2; dx <= 2; dx++ {
+				qr.setFunction(alignment+dx, alignment+dy, max(absInt(dx), absInt(dy)) != 1)
+			}
+		}
+	}
+
+	// reserve the format areas until the mask is known
+	qr.drawFormatBits(0)
+}
+
+// drawFormatBits draws both copies of the format information for level M
+// and mask, and the dark module.
+func (qr *qrCode) drawFormatBits(mask int) {
+	data := 0b00<<3 | mask // level M
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = rem<<1 ^ (rem>>9)*0x537
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 != 0 }
+
+	for i := 0; i <= 5; i++ {
+		qr.setFunction(8, i, bit(i))
+	}
+	qr.setFunction(8, 7, bit(6))
+	qr.setFunction(8, 8, bit(7))
+	qr.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		qr.setFunction(14-i, 8, bit(i))
+	}
+
+	for i := 0; i < 8; i++ {
+		qr.setFunction(qr.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		qr.setFunction(8, qr.size-15+i, bit(i))
+	}
+	qr.setFunction(8, qr.size-8, true)
+}
+
+// drawCodewords fills the non-function modules in the zigzag order of the
+// standard, starting at the bottom right.
+func (qr *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5 // skip the vertical timing pattern
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert // upward
+				}
+				if !qr.isFunction[y][x] && i < len(data)*8 {
+					qr.modules[y][x] = data[i>>3]>>(7-i&7)&1 != 0
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask inverts the data modules selected by mask; applying it twice
+// undoes it.
+func (qr *qrCode) applyMask(mask int) {
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			if invert && !qr.isFunction[y][x] {
+				qr.modules[y][x] = !qr.modules[y][x]
+			}
+		}
+	}
+}
+
+// penalty scores how hard the code is to scan, following the four rules of
+// the standard: runs, 2x2 blocks, finder-like patterns and dark balance.
+func (qr *qrCode) penalty() int {
+	penalty := 0
+	at := func(x, y int, vertical bool) bool {
+		if vertical {
+			return qr.modules[x][y]
+		}
+		return qr.modules[y][x]
+	}
+
+	for _, vertical := range []bool{false, true} {
+		for y := 0; y < qr.size; y++ {
+			run := 1
+			for x := 1; x <= qr.size; x++ {
+				if x < qr.size && at(x, y, vertical) == at(x-1, y, vertical) {
+					run++
+					continue
+				}
+				if run >= 5 {
+					penalty += run - 2
+				}
+				run = 1
+			}
+
+			// dark-light-dark-dark-dark-light-dark with four light modules
+			// on one side
+			for x := 0; x+7 <= qr.size; x++ {
+				pattern := [7]bool{true, false, true, true, true, false, true}
+				match := true
+				for i, dark := range pattern {
+					if at(x+i, y, vertical) != dark {
+						match = false
+						break
+					}
+				}
+				if !match {
+					continue
+				}
+				lightBefore, lightAfter := true, true
+				for i := 1; i <= 4; i++ {
+					if x-i >= 0 && at(x-i, y, vertical) {
+						lightBefore = false
+					}
+					if x+6+i < qr.size && at(x+6+i, y, vertical) {
+						lightAfter = false
+					}
+				}
+				if lightBefore || lightAfter {
+					penalty += 40
+				}
+			}
+		}
+	}
+
+	dark := 0
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if qr.modules[y][x] {
+				dark++
+			}
+			if x+1 < qr.size && y+1 < qr.size {
+				c := qr.modules[y][x]
+				if qr.modules[y][x+1] == c && qr.modules[y+1][x] == c && qr.modules[y+1][x+1] == c {
+					penalty += 3
+				}
+			}
+		}
+	}
+	total := qr.size * qr.size
+	penalty += absInt(dark*20-total*10) / total * 10
+
+	return penalty
+}
+
+// image renders the code with scale pixels per module and the four module
+// quiet zone scanners need.
+func (qr *qrCode) image(scale int) *image.Gray {
+	const quietZone = 4
+	side := (qr.size + 2*quietZone) * scale
+	img := image.NewGray(image.Rect(0, 0, side, side))
+	for i := range img.Pix {
+		img.Pix[i] = 0xff
+	}
+	for y := 0; y < qr.size; y++ {
+		for x := 0; x < qr.size; x++ {
+			if !qr.modules[y][x] {
+				continue
+			}
+			for py := 0; py < scale; py++ {
+				for px := 0; px < scale; px++ {
+					img.SetGray((x+quietZone)*scale+px, (y+quietZone)*scale+py, color.Gray{})
+				}
+			}
+		}
+	}
+	return img
+}
+
+type qrBitBuffer []bool
+
+func (b *qrBitBuffer) append(value, length int) {
+	for i := length - 1; i >= 0; i-- {
+		*b = append(*b, value>>i&1 != 0)
+	}
+}
+
+func (b qrBitBuffer) bytes() []byte {
+	out := make([]byte, len(b)/8)
+	for i, bit := range b {
+		if bit {
+			out[i/8] |= 0x80 >> (i % 8)
+		}
+	}
+	return out
+}
+
+// reedSolomonGenerator returns the generator polynomial of the given degree
+// over GF(256), highest coefficient first and the leading 1 omitted.
+func reedSolomonGenerator(degree int) []byte {
+	generator := make([]byte, degree)
+	generator[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range generator {
+			generator[j] = gfMultiply(generator[j], root)
+			if j+1 < len(generator) {
+				generator[j] ^= generator[j+1]
+			}
+		}
+		root = gfMultiply(root, 0x02)
+	}
+	return generator
+}
+
+func reedSolomonRemainder(data, generator []byte) []byte {
+	remainder := make([]byte, len(generator))
+	for _, b := range data {
+		factor := b ^ remainder[0]
+		copy(remainder, remainder[1:])
+		remainder[len(remainder)-1] = 0
+		for i := range remainder {
+			remainder[i] ^= gfMultiply(generator[i], factor)
+		}
+	}
+	return remainder
+}
+
+// gfMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func gfMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = z<<1 ^ (z>>7)*0x11d
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
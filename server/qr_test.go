@@ -0,0 +1,135 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReedSolomon(t *testing.T) {
+	// the version 1-M example of ISO/IEC 18004 ("01234567")
+	data := []byte{32, 91, 11, 120, 209, 114, 220, 77, 67, 64, 236, 17, 236, 17, 236, 17}
+	want := []byte{196, 35, 39, 119, 235, 215, 231, 226, 93, 23}
+	if got := reedSolomonRemainder(data, reedSolomonGenerator(10)); !bytes.Equal(got, want) {
+		t.Fatalf("error correction = %v, want %v", got, want)
+	}
+}
+
+// readQR decodes a code produced by encodeQR, undoing each step of the
+// encoder, and checks the error correction of every block.
+func readQR(t *testing.T, qr *qrCode) []byte {
+	t.Helper()
+	version := (qr.size - 17) / 4
+	spec := qrVersions[version]
+
+	format := 0
+	for i := 14; i >= 9; i-- {
+		format = format<<1 | b2i(qr.modules[8][14-i])
+	}
+	format = format<<1 | b2i(qr.modules[8][7])
+	format = format<<1 | b2i(qr.modules[8][8])
+	format = format<<1 | b2i(qr.modules[7][8])
+	for i := 5; i >= 0; i-- {
+		format = format<<1 | b2i(qr.modules[i][8])
+	}
+	format ^= 0x5412
+	if format>>13 != 0b00 {
+		t.Fatalf("error correction level bits = %b, want M", format>>13)
+	}
+	mask := format >> 10 & 7
+
+	// format information of level M from the table in the standard
+	formatBits := []int{0x5412, 0x5125, 0x5e7c, 0x5b4b, 0x45f9, 0x40ce, 0x4f97, 0x4aa0}
+	if format^0x5412 != formatBits[mask] {
+		t.Fatalf("format bits = %015b, want %015b", format^0x5412, formatBits[mask])
+	}
+
+	qr.applyMask(mask)
+	defer qr.applyMask(mask)
+	var bits qrBitBuffer
+	for right := qr.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < qr.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x, y := right-j, vert
+				if (right+1)&2 == 0 {
+					y = qr.size - 1 - vert
+				}
+				if !qr.isFunction[y][x] {
+					bits = append(bits, qr.modules[y][x])
+				}
+			}
+		}
+	}
+	codewords := bits[:8*spec.blocks*(spec.dataPerBlock+spec.ecPerBlock)].bytes()
+
+	var data []byte
+	generator := reedSolomonGenerator(spec.ecPerBlock)
+	for b := 0; b < spec.blocks; b++ {
+		var block, ec []byte
+		for i := 0; i < spec.dataPerBlock; i++ {
+			block = append(block, codewords[i*spec.blocks+b])
+		}
+		for i := 0; i < spec.ecPerBlock; i++ {
+			ec = append(ec, codewords[spec.blocks*spec.dataPerBlock+i*spec.blocks+b])
+		}
+		if want := reedSolomonRemainder(block, generator); !bytes.Equal(ec, want) {
+			t.Fatalf("block %d error correction = %v, want %v", b, ec, want)
+		}
+		data = append(data, block...)
+	}
+
+	if data[0]>>4 != 0b0100 {
+		t.Fatalf("mode = %04b, want byte mode", data[0]>>4)
+	}
+	length := int(data[0]&0xf)<<4 | int(data[1]>>4)
+	message := make([]byte, length)
+	for i := range message {
+		message[i] = data[1+i]<<4 | data[2+i]>>4
+	}
+	return message
+}
+
+func b2i(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func TestEncodeQR(t *testing.T) {
+	for _, tc := range []struct {
+		message string
+		size    int
+	}{
+		{"K7P2QX", 21},
+		{"https://hr-demo.example.org/viewer.html?pair=K7P2QX", 33},
+		{string(bytes.Repeat([]byte("x"), 100)), 41},
+	} {
+		qr, err := encodeQR([]byte(tc.message))
+		if err != nil {
+			t.Fatalf("encode %q: %v", tc.message, err)
+		}
+		if qr.size != tc.size {
+			t.Fatalf("encode %q: size %d, want %d", tc.message, qr.size, tc.size)
+		}
+		if got := string(readQR(t, qr)); got != tc.message {
+			t.Fatalf("decoded %q, want %q", got, tc.message)
+		}
+
+		// finder patterns in three corners, dark module next to the bottom one
+		for _, corner := range [][2]int{{0, 0}, {qr.size - 7, 0}, {0, qr.size - 7}} {
+			if !qr.modules[corner[1]][corner[0]] || qr.modules[corner[1]+1][corner[0]+1] || !qr.modules[corner[1]+3][corner[0]+3] {
+				t.Fatalf("encode %q: no finder pattern at %v", tc.message, corner)
+			}
+		}
+		if !qr.modules[qr.size-8][8] {
+			t.Fatalf("encode %q: dark module missing", tc.message)
+		}
+	}
+
+	if _, err := encodeQR(bytes.Repeat([]byte("x"), 107)); err != errQRTooLong {
+		t.Fatalf("encode 107 bytes: err = %v, want errQRTooLong", err)
+	}
+}
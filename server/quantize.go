@@ -0,0 +1,89 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// positionQuantization is the step, in meters, that positions of new uploads
+// are rounded to before they are stored. Zero keeps the values as sent. Set
+// by SetPositionQuantization.
+var positionQuantization float64
+
+// quantizationInfo records in the upload metadata how stored values were
+// rounded, so analysts know their precision.
+type quantizationInfo struct {
+	PositionStep float64 `json:"position_step"`
+}
+
+// SetPositionQuantization makes new uploads store positions rounded to step
+// meters, e.g. 0.0001 for 0.1mm. Uploads keep the precision they were created
+// with, so records appended later are rounded the same way.
+func SetPositionQuantization(step float64) error {
+	if step < 0 || math.IsNaN(step) || math.IsInf(step, 0) {
+		return fmt.Errorf("invalid position quantization %v: must be a non-negative number of meters", step)
+	}
+	positionQuantization = step
+	return nil
+}
+
+// uploadQuantization returns the position step to store records of an upload
+// with: the one in its metadata if it exists, else the configured one.
+func uploadQuantization(uploadKey string) (*quantizationInfo, error) {
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if errors.Is(err, errUploadNotFound) {
+		if positionQuantization == 0 {
+			return nil, nil
+		}
+		return &quantizationInfo{PositionStep: positionQuantization}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return metadata.Quantization, nil
+}
+
+// quantizeRecordLines rounds the position of each record to step. Records
+// without a position, or that aren't objects, are kept as they are.
+func quantizeRecordLines(lines []string, step float64) []string {
+	// print with just enough decimals for the step, so rounded values don't
+	// pick up float noise again, e.g. 0.1235 rather than 0.12350000000000001
+	decimals := max(0, int(math.Ceil(-math.Log10(step)-1e-9)))
+
+	quantized := make([]string, len(lines))
+	for i, line := range lines {
+		quantized[i] = line
+
+		var record map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &record); err != nil || record["position"] == nil {
+			continue
+		}
+		var position map[string]json.RawMessage
+		if err := json.Unmarshal(record["position"], &position); err != nil {
+			continue
+		}
+		for axis, raw := range position {
+			v, err := strconv.ParseFloat(string(raw), 64)
+			if err != nil {
+				continue
+			}
+			rounded, _ := strconv.ParseFloat(strconv.FormatFloat(math.Round(v/step)*step, 'f', decimals, 64), 64)
+			if rounded == 0 {
+				rounded = 0 // no "-0" for small negative values
+			}
+			position[axis], _ = json.Marshal(rounded)
+		}
+
+		var err error
+		if record["position"], err = json.Marshal(position); err != nil {
+			continue
+		}
+		if encoded, err := json.Marshal(record); err == nil {
+			quantized[i] = string(encoded)
+		}
+	}
+	return quantized
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestUploadQuantization(t *testing.T) {
+	chdirTemp(t)
+	if err := SetPositionQuantization(0.0001); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { SetPositionQuantization(0) })
+
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1.123456789,"position":{"x":0.123456789012345,"y":1.60004999,"z":-0.00001}}`,
+		`{"heartRate":72}`,
+	})
+
+	meta, _, records := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, records, []string{
+		`{"position":{"x":0.1235,"y":1.6,"z":0},"timestamp":1.123456789,"trackerKey":"headset"}`,
+		`{"heartRate":72}`,
+	})
+
+	var metadata uploadMetadata
+	if err := json.Unmarshal([]byte(meta), &metadata); err != nil {
+		t.Fatal(err)
+	}
+	if metadata.Quantization == nil || metadata.Quantization.PositionStep != 0.0001 {
+		t.Fatalf("metadata quantization = %+v, want position_step 0.0001", metadata.Quantization)
+	}
+
+	// the upload keeps its precision when the setting changes
+	SetPositionQuantization(0)
+	simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":2,"position":{"x":0.33333333,"y":0,"z":0}}`})
+	_, _, records = readUploadFile(t, uploadFilePath(key))
+	if !strings.Contains(records[2], `"x":0.3333`) || strings.Contains(records[2], "0.33333") {
+		t.Fatalf("appended record not quantized: %s", records[2])
+	}
+
+	other := newTestUploadKey(t)
+	simulateUpload(t, other, []string{`{"trackerKey":"headset","timestamp":2,"position":{"x":0.33333333,"y":0,"z":0}}`})
+	meta, _, records = readUploadFile(t, uploadFilePath(other))
+	assertRecords(t, records, []string{`{"trackerKey":"headset","timestamp":2,"position":{"x":0.33333333,"y":0,"z":0}}`})
+	if strings.Contains(meta, "quantization") {
+		t.Fatalf("unquantized upload has quantization metadata: %s", meta)
+	}
+
+	if err := SetPositionQuantization(-1); err == nil {
+		t.Fatal("negative quantization accepted")
+	}
+}
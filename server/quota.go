@@ -0,0 +1,339 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// maxTenantLength is the longest tenant name accepted.
+const maxTenantLength = 64
+
+// quotaUsage is an amount of stored records, in records and bytes. Bytes
+// count the record payloads as uploaded plus a newline each, which is what an
+// export of the upload takes, not the size of the file. In limits, zero
+// means unlimited.
+type quotaUsage struct {
+	Records int64 `json:"records"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// Quota limits, set by SetUploadQuota and SetTenantQuota.
+var (
+	uploadQuota quotaUsage
+	tenantQuota quotaUsage
+)
+
+// uploadUsage is the usage of one upload key.
+type uploadUsage struct {
+	Tenant string
+	quotaUsage
+}
+
+// Usage is counted in memory, from a scan of all uploads on first need, and
+// updated with every stored batch. Rewriting or importing uploads drops it so
+// that it is counted again.
+var (
+	uploadUsages  map[string]*uploadUsage // by upload key, nil until counted
+	tenantUsages  map[string]*quotaUsage
+	usageCount    int // how many times usage was counted
+	quotaUsageMux sync.Mutex
+)
+
+// quotaError is why a batch was refused. tooLarge means the batch alone
+// exceeds the limit, so retrying it can never succeed.
+type quotaError struct {
+	scope    string // "upload" or "tenant"
+	resource string // "records" or "bytes"
+	limit    int64
+	tooLarge bool
+}
+
+func (e *quotaError) Error() string {
+	if e.tooLarge {
+		return fmt.Sprintf("batch exceeds the %s quota of %d %s on its own", e.scope, e.limit, e.resource)
+	}
+	return fmt.Sprintf("%s quota of %d %s exceeded", e.scope, e.limit, e.resource)
+}
+
+// SetUploadQuota limits how many records and bytes of records each upload
+// key may store. Zero leaves a limit off.
+func SetUploadQuota(records, bytes int64) error {
+	if records < 0 || bytes < 0 {
+		return errors.New("invalid upload quota: must not be negative")
+	}
+	uploadQuota = quotaUsage{Records: records, Bytes: bytes}
+	return nil
+}
+
+// SetTenantQuota limits how many records and bytes of records the uploads of
+// each tenant may store together. Uploads without a tenant only have the
+// upload quota. Zero leaves a limit off.
+func SetTenantQuota(records, bytes int64) error {
+	if records < 0 || bytes < 0 {
+		return errors.New("invalid tenant quota: must not be negative")
+	}
+	tenantQuota = quotaUsage{Records: records, Bytes: bytes}
+	return nil
+}
+
+func quotasEnabled() bool {
+	return uploadQuota != (quotaUsage{}) || tenantQuota != (quotaUsage{})
+}
+
+// parseTenant accepts lower-case letters, digits, hyphens and underscores,
+// like device ids.
+func parseTenant(raw string) (string, error) {
+	tenant := strings.ToLower(strings.TrimSpace(raw))
+	if tenant == "" || len(tenant) > maxTenantLength {
+		return "", fmt.Errorf("invalid tenant: must be 1 to %d characters", maxTenantLength)
+	}
+	for _, r := range tenant {
+		if (r < 'a' || r > 'z') && (r < '0' || r > '9') && r != '-' && r != '_' {
+			return "", fmt.Errorf("invalid tenant %q: only letters, digits, hyphens and underscores are allowed", raw)
+		}
+	}
+	return tenant, nil
+}
+
+var errTenantMismatch = errors.New("tenant mismatch")
+
+// uploadTenant returns the tenant of an upload: the one in its metadata if
+// it exists, else requested. An upload can't move to another tenant.
+func uploadTenant(uploadKey, requested string) (string, error) {
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if errors.Is(err, errUploadNotFound) {
+		return requested, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if requested != "" && requested != metadata.Tenant {
+		return "", fmt.Errorf("%w: upload belongs to tenant %q", errTenantMismatch, metadata.Tenant)
+	}
+	return metadata.Tenant, nil
+}
+
+// recordBytes is how many bytes lines count against a quota.
+func recordBytes(lines []string) int64 {
+	var n int64
+	for _, line := range lines {
+		n += int64(len(line)) + 1
+	}
+	return n
+}
+
+// countQuotaUsageLocked counts the usage of all uploads if it isn't known.
+func countQuotaUsageLocked() error {
+	if uploadUsages != nil {
+		return nil
+	}
+	keys, err := listUploadKeys()
+	if err != nil {
+		return err
+	}
+	usages := make(map[string]*uploadUsage, len(keys))
+	tenants := map[string]*quotaUsage{}
+	for _, uploadKey := range keys {
+		filePath := uploadFilePath(uploadKey)
+		metadata, err := readUploadMetadata(filePath)
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+		usage := &uploadUsage{Tenant: metadata.Tenant}
+		if cold, err := readColdInfo(filePath); err == nil {
+			// counted when it went cold, so it needn't come back for this
+			usage.Records, usage.Bytes = int64(cold.Records), cold.RecordBytes
+		} else if err = scanUploadFile(filePath, func(_ int, payload []byte) error {
+			usage.Records++
+			usage.Bytes += int64(len(payload)) + 1
+			return nil
+		}); err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+		usages[uploadKey] = usage
+		if usage.Tenant != "" {
+			tenants[usage.Tenant] = addUsage(tenants[usage.Tenant], usage.quotaUsage)
+		}
+	}
+	uploadUsages, tenantUsages = usages, tenants
+	usageCount++
+	return nil
+}
+
+func addUsage(total *quotaUsage, usage quotaUsage) *quotaUsage {
+	if total == nil {
+		total = &quotaUsage{}
+	}
+	total.Records += usage.Records
+	total.Bytes += usage.Bytes
+	return total
+}
+
+// checkQuota returns a *quotaError if adding batch to usage exceeds limit.
+func checkQuota(scope string, usage, batch, limit quotaUsage) error {
+	for _, q := range []struct {
+		resource            string
+		used, adding, limit int64
+	}{
+		{"records", usage.Records, batch.Records, limit.Records},
+		{"bytes", usage.Bytes, batch.Bytes, limit.Bytes},
+	} {
+		if q.limit > 0 && q.used+q.adding > q.limit {
+			return &quotaError{scope: scope, resource: q.resource, limit: q.limit, tooLarge: q.adding > q.limit}
+		}
+	}
+	return nil
+}
+
+// reserveQuota counts lines against the quotas of an upload, or returns a
+// *quotaError if they don't fit. If the lines aren't stored after all,
+// release must be called to give the reservation back.
+func reserveQuota(uploadKey, tenant string, lines []string) (release func(), err error) {
+	quotaUsageMux.Lock()
+	defer quotaUsageMux.Unlock()
+	if uploadUsages == nil && !quotasEnabled() {
+		// usage is counted once it is asked for
+		return func() {}, nil
+	}
+	if err := countQuotaUsageLocked(); err != nil {
+		return nil, fmt.Errorf("count quota usage: %w", err)
+	}
+
+	usage := uploadUsages[uploadKey]
+	if usage == nil {
+		usage = &uploadUsage{Tenant: tenant}
+	}
+	batch := quotaUsage{Records: int64(len(lines)), Bytes: recordBytes(lines)}
+	if err := checkQuota("upload", usage.quotaUsage, batch, uploadQuota); err != nil {
+		return nil, err
+	}
+	if tenant != "" {
+		var used quotaUsage
+		if total := tenantUsages[tenant]; total != nil {
+			used = *total
+		}
+		if err := checkQuota("tenant", used, batch, tenantQuota); err != nil {
+			return nil, err
+		}
+	}
+
+	uploadUsages[uploadKey] = usage
+	addUsage(&usage.quotaUsage, batch)
+	if tenant != "" {
+		tenantUsages[tenant] = addUsage(tenantUsages[tenant], batch)
+	}
+	count := usageCount
+	return func() {
+		quotaUsageMux.Lock()
+		defer quotaUsageMux.Unlock()
+		if uploadUsages == nil || usageCount != count {
+			return // counted again since, without the batch
+		}
+		addUsage(&usage.quotaUsage, quotaUsage{Records: -batch.Records, Bytes: -batch.Bytes})
+		if tenant != "" {
+			addUsage(tenantUsages[tenant], quotaUsage{Records: -batch.Records, Bytes: -batch.Bytes})
+		}
+	}, nil
+}
+
+// forgetQuotaUsage drops the usage counts after uploads were changed other
+// than by appending, so that they are counted again when needed.
+func forgetQuotaUsage() {
+	quotaUsageMux.Lock()
+	uploadUsages, tenantUsages = nil, nil
+	quotaUsageMux.Unlock()
+}
+
+// quotaStatus describes the usage and limits of an upload for the status
+// endpoint.
+type quotaStatus struct {
+	Usage       quotaUsage  `json:"usage"`
+	Limit       quotaUsage  `json:"limit"`
+	Tenant      string      `json:"tenant,omitempty"`
+	TenantUsage *quotaUsage `json:"tenant_usage,omitempty"`
+	TenantLimit *quotaUsage `json:"tenant_limit,omitempty"`
+}
+
+func uploadQuotaStatus(uploadKey string) (quotaStatus, error) {
+	quotaUsageMux.Lock()
+	defer quotaUsageMux.Unlock()
+	if err := countQuotaUsageLocked(); err != nil {
+		return quotaStatus{}, err
+	}
+	status := quotaStatus{Limit: uploadQuota}
+	if usage := uploadUsages[uploadKey]; usage != nil {
+		status.Usage = usage.quotaUsage
+		status.Tenant = usage.Tenant
+	}
+	if status.Tenant != "" {
+		tenantUsage, tenantLimit := *tenantUsages[status.Tenant], tenantQuota
+		status.TenantUsage, status.TenantLimit = &tenantUsage, &tenantLimit
+	}
+	return status, nil
+}
+
+// QuotasHandler serves the admin view of quota usage: the limits, and the
+// usage of every tenant and upload, heaviest first.
+func QuotasHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	type tenantEntry struct {
+		Tenant  string `json:"tenant"`
+		Uploads int    `json:"uploads"`
+		quotaUsage
+	}
+	type uploadEntry struct {
+		UploadName string `json:"upload_name"`
+		KeyHash    string `json:"key_hash"`
+		Tenant     string `json:"tenant,omitempty"`
+		quotaUsage
+	}
+
+	quotaUsageMux.Lock()
+	err := countQuotaUsageLocked()
+	tenants := []tenantEntry{}
+	uploads := []uploadEntry{}
+	if err == nil {
+		uploadCounts := map[string]int{}
+		for uploadKey, usage := range uploadUsages {
+			uploads = append(uploads, uploadEntry{UploadName: uploadNameFromKey(uploadKey), KeyHash: uploadKeyHash(uploadKey), Tenant: usage.Tenant, quotaUsage: usage.quotaUsage})
+			uploadCounts[usage.Tenant]++
+		}
+		for tenant, usage := range tenantUsages {
+			tenants = append(tenants, tenantEntry{Tenant: tenant, Uploads: uploadCounts[tenant], quotaUsage: *usage})
+		}
+	}
+	quotaUsageMux.Unlock()
+	if err != nil {
+		log.Printf("failed to count quota usage: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to count quota usage")
+		return
+	}
+
+	sort.Slice(tenants, func(i, j int) bool {
+		return tenants[i].Bytes > tenants[j].Bytes || tenants[i].Bytes == tenants[j].Bytes && tenants[i].Tenant < tenants[j].Tenant
+	})
+	sort.Slice(uploads, func(i, j int) bool {
+		return uploads[i].Bytes > uploads[j].Bytes || uploads[i].Bytes == uploads[j].Bytes && uploads[i].KeyHash < uploads[j].KeyHash
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":       "ok",
+		"upload_limit": uploadQuota,
+		"tenant_limit": tenantQuota,
+		"tenants":      tenants,
+		"uploads":      uploads,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write quotas response: %v", err)
+	}
+}
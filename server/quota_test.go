@@ -0,0 +1,131 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// setTestQuotas sets the quota limits for a test and drops usage counted in
+// other tests' upload directories.
+func setTestQuotas(t *testing.T, upload, tenant quotaUsage) {
+	t.Helper()
+	forgetQuotaUsage()
+	if err := SetUploadQuota(upload.Records, upload.Bytes); err != nil {
+		t.Fatal(err)
+	}
+	if err := SetTenantQuota(tenant.Records, tenant.Bytes); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		uploadQuota, tenantQuota = quotaUsage{}, quotaUsage{}
+		forgetQuotaUsage()
+	})
+}
+
+func postTenantUpload(t *testing.T, key, tenant string, entries []string) (int, errorResponse) {
+	t.Helper()
+	query := ""
+	if tenant != "" {
+		query = "?tenant=" + url.QueryEscape(tenant)
+	}
+	req := withUploadKey(httptest.NewRequest("POST", "/api/upload"+query, strings.NewReader(strings.Join(entries, "\n"))), key)
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	rec := httptest.NewRecorder()
+	UploadHandler(rec, req)
+	var response errorResponse
+	json.Unmarshal(rec.Body.Bytes(), &response)
+	return rec.Code, response
+}
+
+func TestUploadQuota(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":71}`})
+	// usage already stored counts when the quota is set
+	setTestQuotas(t, quotaUsage{Records: 3, Bytes: 100}, quotaUsage{})
+
+	if code, response := postTenantUpload(t, key, "", []string{`{"bpm":72}`, `{"bpm":73}`}); code != 429 || response.Error.Code != errCodeQuotaExceeded {
+		t.Fatalf("upload over the record quota: status %d, %+v", code, response)
+	}
+	if code, _ := postTenantUpload(t, key, "", []string{`{"bpm":72}`}); code != 200 {
+		t.Fatalf("upload within the quota: status %d", code)
+	}
+
+	other := newTestUploadKey(t)
+	big := `{"note":"` + strings.Repeat("x", 100) + `"}`
+	if code, response := postTenantUpload(t, other, "", []string{big}); code != 413 || response.Error.Code != errCodeBatchOverQuota {
+		t.Fatalf("batch over the byte quota: status %d, %+v", code, response)
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/status", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	StatusHandler(rec, req)
+	var status struct {
+		Quota quotaStatus `json:"quota"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+		t.Fatal(err)
+	}
+	if want := (quotaUsage{Records: 3, Bytes: 33}); status.Quota.Usage != want || status.Quota.Limit != uploadQuota {
+		t.Fatalf("status quota = %+v, want usage %+v", status.Quota, want)
+	}
+}
+
+func TestTenantQuota(t *testing.T) {
+	chdirTemp(t)
+	setTestQuotas(t, quotaUsage{}, quotaUsage{Records: 3})
+	first, second := newTestUploadKey(t), newTestUploadKey(t)
+
+	if code, _ := postTenantUpload(t, first, "Clinic-A", []string{`{"bpm":70}`, `{"bpm":71}`}); code != 200 {
+		t.Fatalf("first upload: status %d", code)
+	}
+	// later batches stay in the tenant without naming it
+	if code, _ := postTenantUpload(t, first, "", []string{`{"bpm":72}`}); code != 200 {
+		t.Fatalf("second batch: status %d", code)
+	}
+	if metadata, err := readUploadMetadata(uploadFilePath(first)); err != nil || metadata.Tenant != "clinic-a" {
+		t.Fatalf("metadata = %+v, %v", metadata, err)
+	}
+	if code, response := postTenantUpload(t, second, "clinic-a", []string{`{"bpm":70}`}); code != 429 || response.Error.Code != errCodeQuotaExceeded {
+		t.Fatalf("upload over the tenant quota: status %d, %+v", code, response)
+	}
+	if code, _ := postTenantUpload(t, second, "clinic-b", []string{`{"bpm":70}`}); code != 200 {
+		t.Fatalf("upload for another tenant: status %d", code)
+	}
+	if code, response := postTenantUpload(t, second, "clinic-a", []string{`{"bpm":71}`}); code != 409 || response.Error.Code != errCodeTenantMismatch {
+		t.Fatalf("moving an upload to another tenant: status %d, %+v", code, response)
+	}
+	if code, _ := postTenantUpload(t, second, "not a tenant", []string{`{"bpm":71}`}); code != 400 {
+		t.Fatalf("invalid tenant: status %d", code)
+	}
+
+	rec := httptest.NewRecorder()
+	QuotasHandler(rec, httptest.NewRequest("GET", "/api/admin/quotas", nil))
+	var response struct {
+		Tenants []struct {
+			Tenant  string `json:"tenant"`
+			Uploads int    `json:"uploads"`
+			Records int64  `json:"records"`
+		} `json:"tenants"`
+		Uploads []struct {
+			KeyHash string `json:"key_hash"`
+			Records int64  `json:"records"`
+		} `json:"uploads"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Tenants) != 2 || response.Tenants[0].Tenant != "clinic-a" || response.Tenants[0].Records != 3 || response.Tenants[0].Uploads != 1 {
+		t.Fatalf("tenants = %+v", response.Tenants)
+	}
+	if len(response.Uploads) != 2 || response.Uploads[0].KeyHash != uploadKeyHash(first) {
+		t.Fatalf("uploads = %+v", response.Uploads)
+	}
+	if strings.Contains(rec.Body.String(), first) {
+		t.Fatal("admin response contains an upload key")
+	}
+}
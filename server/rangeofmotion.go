@@ -0,0 +1,160 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"slices"
+)
+
+// Range of motion is what rehab sessions are judged by: how much space each
+// tracker covered, how far the hands reached from the head, and how the
+// left side compares to the right. Reach is measured from where the headset
+// was at the time of each hand sample, so walking around doesn't count as
+// reaching.
+
+const reachPercentile = 0.95
+
+type trackerRange struct {
+	Samples     int         `json:"samples"`
+	BoundingBox boundingBox `json:"bounding_box"`
+	Extent      vec3        `json:"extent"`
+	Volume      float64     `json:"volume"`
+}
+
+// reachEnvelope describes where a hand was relative to the headset. The
+// relative box is in the clients' axes, -Z forward and Y up, unrotated.
+type reachEnvelope struct {
+	RelativeBox boundingBox `json:"relative_box"`
+	Volume      float64     `json:"volume"`
+	MaxReach    float64     `json:"max_reach"`
+	P95Reach    float64     `json:"p95_reach"`
+	MeanReach   float64     `json:"mean_reach"`
+}
+
+// asymmetry compares the left hand to the right as a symmetry index,
+// (left-right)/((left+right)/2): 0 is symmetric, positive favours the left.
+type asymmetry struct {
+	Volume   float64 `json:"volume"`
+	P95Reach float64 `json:"p95_reach"`
+	Distance float64 `json:"distance"`
+}
+
+type rangeOfMotion struct {
+	Trackers  map[string]trackerRange  `json:"trackers"`
+	Reach     map[string]reachEnvelope `json:"reach"`
+	Asymmetry *asymmetry               `json:"asymmetry,omitempty"`
+}
+
+func boundingBoxOf(positions []vec3) boundingBox {
+	box := boundingBox{Min: positions[0], Max: positions[0]}
+	for _, p := range positions[1:] {
+		box.Min = vec3{math.Min(box.Min.X, p.X), math.Min(box.Min.Y, p.Y), math.Min(box.Min.Z, p.Z)}
+		box.Max = vec3{math.Max(box.Max.X, p.X), math.Max(box.Max.Y, p.Y), math.Max(box.Max.Z, p.Z)}
+	}
+	return box
+}
+
+func (b boundingBox) volume() float64 {
+	e := b.Max.sub(b.Min)
+	return e.X * e.Y * e.Z
+}
+
+// symmetryIndex returns (left-right)/((left+right)/2), or 0 if both are 0.
+func symmetryIndex(left, right float64) float64 {
+	if left+right == 0 {
+		return 0
+	}
+	return (left - right) / ((left + right) / 2)
+}
+
+func computeRangeOfMotion(samples map[string][]trackerSample) rangeOfMotion {
+	rom := rangeOfMotion{Trackers: map[string]trackerRange{}, Reach: map[string]reachEnvelope{}}
+	for tracker, trackerSamples := range samples {
+		if len(trackerSamples) == 0 {
+			continue
+		}
+		positions := make([]vec3, len(trackerSamples))
+		for i, s := range trackerSamples {
+			positions[i] = s.Position
+		}
+		box := boundingBoxOf(positions)
+		rom.Trackers[tracker] = trackerRange{Samples: len(positions), BoundingBox: box, Extent: box.Max.sub(box.Min), Volume: box.volume()}
+	}
+
+	head := samples[defaultTracker]
+	distances := map[string]float64{}
+	for _, tracker := range handTrackers {
+		hand := samples[tracker]
+		if len(hand) == 0 || len(head) == 0 {
+			continue
+		}
+		relative := make([]vec3, len(hand))
+		reaches := make([]float64, len(hand))
+		from := 0
+		for i, s := range hand {
+			relative[i] = s.Position.sub(headPositionAt(head, s.Timestamp, &from))
+			reaches[i] = relative[i].length()
+			if i > 0 {
+				distances[tracker] += s.Position.sub(hand[i-1].Position).length()
+			}
+		}
+		box := boundingBoxOf(relative)
+		reach := describeDistribution(reaches)
+		rom.Reach[tracker] = reachEnvelope{
+			RelativeBox: box,
+			Volume:      box.volume(),
+			MaxReach:    reach.Max,
+			P95Reach:    sortedQuantile(slices.Sorted(slices.Values(reaches)), reachPercentile),
+			MeanReach:   reach.Mean,
+		}
+	}
+
+	left, hasLeft := rom.Reach[handTrackers[0]]
+	right, hasRight := rom.Reach[handTrackers[1]]
+	if hasLeft && hasRight {
+		rom.Asymmetry = &asymmetry{
+			Volume:   symmetryIndex(left.Volume, right.Volume),
+			P95Reach: symmetryIndex(left.P95Reach, right.P95Reach),
+			Distance: symmetryIndex(distances[handTrackers[0]], distances[handTrackers[1]]),
+		}
+	}
+	return rom
+}
+
+// RangeOfMotionHandler reports the range of motion of every tracker, the
+// reach of the hands relative to the headset and how symmetric they are.
+func RangeOfMotionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for range of motion: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":          "ok",
+		"upload_name":     uploadNameFromKey(uploadKey),
+		"range_of_motion": computeRangeOfMotion(samples),
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write range of motion response: %v", err)
+	}
+}
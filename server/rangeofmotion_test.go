@@ -0,0 +1,54 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRangeOfMotion(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	// walking 2 m along x; the left hand swings 0.6 m sideways from the
+	// head, the right one only 0.3 m
+	var lines []string
+	for i := range 21 {
+		ts, x := float64(i*100), float64(i)*0.1
+		swing := float64(i % 2)
+		lines = append(lines,
+			fmt.Sprintf(`{"trackerKey":"headset","timestamp":%v,"position":{"x":%v,"y":1.7,"z":0}}`, ts, x),
+			fmt.Sprintf(`{"trackerKey":"leftController","timestamp":%v,"position":{"x":%v,"y":1.2,"z":-0.2}}`, ts, x-0.2-0.4*swing),
+			fmt.Sprintf(`{"trackerKey":"rightController","timestamp":%v,"position":{"x":%v,"y":1.2,"z":-0.2}}`, ts, x+0.2+0.1*swing),
+		)
+	}
+	simulateUpload(t, key, lines)
+
+	summary, err := computeSessionSummary(key, defaultGapThresholdMs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rom := summary.RangeOfMotion
+	near := func(got, want float64) bool { return math.Abs(got-want) < 1e-9 }
+	if head := rom.Trackers["headset"]; !near(head.Extent.X, 2) || head.Volume != 0 {
+		t.Fatalf("headset range = %+v", head)
+	}
+	left, right := rom.Reach["leftController"], rom.Reach["rightController"]
+	if !near(left.RelativeBox.Min.X, -0.6) || !near(left.RelativeBox.Max.X, -0.2) || !near(left.RelativeBox.Max.Y, -0.5) {
+		t.Fatalf("left reach = %+v", left)
+	}
+	if !near(left.MaxReach, math.Sqrt(0.36+0.25+0.04)) || !near(right.MaxReach, math.Sqrt(0.09+0.25+0.04)) {
+		t.Fatalf("max reach left = %v, right = %v", left.MaxReach, right.MaxReach)
+	}
+	if rom.Asymmetry == nil || rom.Asymmetry.P95Reach <= 0 || rom.Asymmetry.Distance <= 0 {
+		t.Fatalf("asymmetry = %+v", rom.Asymmetry)
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/range-of-motion", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	RangeOfMotionHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("range of motion status = %d: %s", rec.Code, rec.Body)
+	}
+}
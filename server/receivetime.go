@@ -0,0 +1,99 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"strconv"
+	"time"
+)
+
+// recordReceiveTime makes new uploads store the server's receive time in
+// every record. Set by EnableRecordReceiveTime.
+var recordReceiveTime bool
+
+// EnableRecordReceiveTime adds a server_received_at field, in Unix
+// milliseconds like the stored timestamps, to every record of new uploads. Compared with
+// the record's own timestamp it shows the latency between capture and
+// ingest, and its drift over a session shows how far the device clock
+// drifts. Records that aren't JSON objects are stored as sent.
+//
+// Since it changes what records look like, the upload metadata says whether
+// an upload has the field, and uploads keep the setting they were created
+// with.
+func EnableRecordReceiveTime() {
+	recordReceiveTime = true
+}
+
+// uploadRecordReceiveTime reports whether records of an upload get their
+// receive time: as in its metadata if it exists, else as configured.
+func uploadRecordReceiveTime(uploadKey string) (bool, error) {
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if errors.Is(err, errUploadNotFound) {
+		return recordReceiveTime, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return metadata.RecordReceiveTime, nil
+}
+
+// stampReceiveTime adds receivedAt to every record that is a JSON object,
+// after its other fields, which keep their order. A server_received_at the
+// client sent is overwritten.
+func stampReceiveTime(lines []string, receivedAt time.Time) []string {
+	receivedAtMs := strconv.FormatInt(receivedAt.UnixMilli(), 10)
+
+	stamped := make([]string, len(lines))
+	for i, line := range lines {
+		stamped[i] = line
+		start, end, closing, fields := objectFieldSpan([]byte(line), "server_received_at")
+		switch {
+		case start >= 0:
+			stamped[i] = line[:start] + receivedAtMs + line[end:]
+		case closing < 0:
+			// not a JSON object
+		case fields > 0:
+			stamped[i] = line[:closing] + `,"server_received_at":` + receivedAtMs + line[closing:]
+		default:
+			stamped[i] = line[:closing] + `"server_received_at":` + receivedAtMs + line[closing:]
+		}
+	}
+	return stamped
+}
+
+// objectFieldSpan finds the value of the top-level field name of a JSON
+// object record, start -1 if there is none, the offset of the object's
+// closing brace, -1 if the record isn't a JSON object, and how many fields
+// it has.
+func objectFieldSpan(record []byte, name string) (start, end, closing, fields int) {
+	start, end = -1, -1
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return -1, -1, -1, 0
+	}
+	for ; decoder.More(); fields++ {
+		key, err := decoder.Token()
+		if err != nil {
+			return -1, -1, -1, 0
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return -1, -1, -1, 0
+		}
+		if key == name {
+			// a raw value holds the bytes as they are in the record
+			end = int(decoder.InputOffset())
+			start = end - len(value)
+		}
+	}
+	if _, err := decoder.Token(); err != nil {
+		return -1, -1, -1, 0
+	}
+	closing = int(decoder.InputOffset()) - 1
+	if _, err := decoder.Token(); err != io.EOF {
+		return -1, -1, -1, 0
+	}
+	return start, end, closing, fields
+}
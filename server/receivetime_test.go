@@ -0,0 +1,57 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordReceiveTime(t *testing.T) {
+	chdirTemp(t)
+	plain := newTestUploadKey(t)
+	simulateUpload(t, plain, []string{`{"heartRate":70}`})
+
+	EnableRecordReceiveTime()
+	t.Cleanup(func() { recordReceiveTime = false })
+
+	stamped := newTestUploadKey(t)
+	before := time.Now()
+	simulateUpload(t, stamped, []string{`{"timestamp":1,"heartRate":70}`, `[1,2]`})
+	// uploads keep the format they were created with
+	simulateUpload(t, plain, []string{`{"heartRate":71}`})
+
+	_, metadata, records := readUploadFile(t, uploadFilePath(stamped))
+	if metadata["record_receive_time"] != true || len(records) != 2 || records[1] != "2,[1,2]" {
+		t.Fatalf("metadata %v, records %q", metadata, records)
+	}
+	// the field goes after the client's, in milliseconds like timestamps
+	_, payload, _ := strings.Cut(records[0], ",")
+	prefix := `{"timestamp":1,"heartRate":70,"server_received_at":`
+	if !strings.HasPrefix(payload, prefix) || !strings.HasSuffix(payload, "}") {
+		t.Fatalf("stamped record = %s", payload)
+	}
+	receivedMs, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(payload, prefix), "}"), 10, 64)
+	if d := receivedMs - before.UnixMilli(); err != nil || d < 0 || d > 5000 {
+		t.Fatalf("server_received_at = %s, uploaded at %v", payload, before)
+	}
+
+	received := time.UnixMilli(1700000000123)
+	for record, want := range map[string]string{
+		`{}`:                             `{"server_received_at":1700000000123}`,
+		` { "b" : 1 , "a" : [ 2 ] } `:    ` { "b" : 1 , "a" : [ 2 ] ,"server_received_at":1700000000123} `,
+		`{"server_received_at":1,"z":2}`: `{"server_received_at":1700000000123,"z":2}`,
+		`{"a":1}x`:                       `{"a":1}x`,
+		`"text"`:                         `"text"`,
+	} {
+		if got := stampReceiveTime([]string{record}, received)[0]; got != want {
+			t.Errorf("stampReceiveTime(%s) = %s, want %s", record, got, want)
+		}
+	}
+
+	_, metadata, records = readUploadFile(t, uploadFilePath(plain))
+	if _, ok := metadata["record_receive_time"]; ok {
+		t.Fatalf("plain upload metadata = %v", metadata)
+	}
+	assertRecords(t, records, []string{`{"heartRate":70}`, `{"heartRate":71}`})
+}
@@ -0,0 +1,286 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"strings"
+)
+
+// A record index sits next to each upload file and lets readers start at a
+// given record or capture time without scanning the whole upload. Entry i
+// describes record i+1: where reading has to start to reach it, and its
+// capture time as returned by payloadTime (NaN if it has none). Entries are
+// 16 bytes, little-endian.
+//
+// For plain uploads the offset is the start of the record's line. For
+// compressed uploads it is the start of the zstd frame holding the record,
+// which is then decompressed from there. Offset 0 means the record can only
+// be reached by reading from the start of the upload.
+type recordIndexEntry struct {
+	Offset int64
+	Time   float64
+}
+
+const recordIndexEntrySize = 16
+
+func recordIndexPath(filePath string) string {
+	return strings.TrimSuffix(filePath, ".csv") + ".idx"
+}
+
+func readRecordIndex(filePath string) ([]recordIndexEntry, error) {
+	data, err := os.ReadFile(recordIndexPath(filePath))
+	if err != nil {
+		return nil, err
+	}
+	if len(data)%recordIndexEntrySize != 0 {
+		return nil, errors.New("truncated record index")
+	}
+
+	entries := make([]recordIndexEntry, len(data)/recordIndexEntrySize)
+	for i := range entries {
+		entry := data[i*recordIndexEntrySize:]
+		entries[i] = recordIndexEntry{
+			Offset: int64(binary.LittleEndian.Uint64(entry)),
+			Time:   math.Float64frombits(binary.LittleEndian.Uint64(entry[8:])),
+		}
+	}
+	return entries, nil
+}
+
+// readRecordIndexEntry returns entry i of the record index of an upload,
+// and how many entries the index has, reading only that one entry. The
+// index of a long session is megabytes, too much to read on every follow.
+// An i past the end returns a zero entry.
+func readRecordIndexEntry(filePath string, i int) (recordIndexEntry, int, error) {
+	file, err := os.Open(recordIndexPath(filePath))
+	if err != nil {
+		return recordIndexEntry{}, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return recordIndexEntry{}, 0, err
+	}
+	if info.Size()%recordIndexEntrySize != 0 {
+		return recordIndexEntry{}, 0, errors.New("truncated record index")
+	}
+
+	count := int(info.Size() / recordIndexEntrySize)
+	if i < 0 || i >= count {
+		return recordIndexEntry{}, count, nil
+	}
+	var entry [recordIndexEntrySize]byte
+	if _, err := file.ReadAt(entry[:], int64(i)*recordIndexEntrySize); err != nil {
+		return recordIndexEntry{}, 0, err
+	}
+	return recordIndexEntry{
+		Offset: int64(binary.LittleEndian.Uint64(entry[:])),
+		Time:   math.Float64frombits(binary.LittleEndian.Uint64(entry[8:])),
+	}, count, nil
+}
+
+func encodeRecordIndex(entries []recordIndexEntry) []byte {
+	data := make([]byte, len(entries)*recordIndexEntrySize)
+	for i, e := range entries {
+		binary.LittleEndian.PutUint64(data[i*recordIndexEntrySize:], uint64(e.Offset))
+		binary.LittleEndian.PutUint64(data[i*recordIndexEntrySize+8:], math.Float64bits(e.Time))
+	}
+	return data
+}
+
+// recordTime returns the capture time stored in the index for a payload.
+func recordTime(payload string) float64 {
+	if t, ok := payloadTime([]byte(payload)); ok {
+		return t
+	}
+	return math.NaN()
+}
+
+// appendRecordIndex adds the entries of a batch that followed
+// existingRecords records. If the index doesn't match the upload (it is
+// missing, or an earlier append was interrupted) it is rebuilt instead.
+// Index failures are only logged: the upload itself is already stored.
+func appendRecordIndex(filePath string, existingRecords int, entries []recordIndexEntry) {
+	indexPath := recordIndexPath(filePath)
+	info, err := os.Stat(indexPath)
+	if err != nil || info.Size() != int64(existingRecords)*recordIndexEntrySize {
+		if err := rebuildRecordIndex(filePath); err != nil {
+			log.Printf("failed to rebuild record index for %s: %v", filePath, err)
+		}
+		return
+	}
+
+	file, err := os.OpenFile(indexPath, os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		log.Printf("failed to open record index for %s: %v", filePath, err)
+		return
+	}
+	defer file.Close()
+	if _, err := file.Write(encodeRecordIndex(entries)); err != nil {
+		log.Printf("failed to write record index for %s: %v", filePath, err)
+	}
+}
+
+// rebuildRecordIndex writes the record index of an upload from scratch.
+// Records of compressed uploads get the start of their frame from the seek
+// table, or offset 0 if it can't be read.
+func rebuildRecordIndex(filePath string) error {
+	file, err := openUploadFile(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	compressed, err := isCompressedUpload(filePath)
+	if err != nil {
+		return err
+	}
+
+	var frames []compressedFrame
+	if compressed {
+		if frames, err = compressedFrames(filePath); err != nil {
+			log.Printf("indexing %s without frame offsets: %v", filePath, err)
+		}
+	}
+
+	var entries []recordIndexEntry
+	reader := bufio.NewReader(file)
+	var offset int64
+	version := formatV1
+	for lineNumber := 0; ; lineNumber++ {
+		line, err := reader.ReadString('\n')
+		start := offset
+		offset += int64(len(line))
+		if lineNumber == 0 {
+			version = metadataFormatVersion([]byte(line))
+		} else if trimmed := strings.TrimSpace(line); trimmed != "" {
+			var payload string
+			if record, err := parseRecordLine([]byte(trimmed), version); err == nil {
+				payload = string(record.Payload)
+			}
+			if compressed {
+				for len(frames) > 1 && frames[1].PlainOffset <= start {
+					frames = frames[1:]
+				}
+				start = 0
+				if len(frames) > 0 {
+					start = frames[0].Offset
+				}
+			}
+			entries = append(entries, recordIndexEntry{Offset: start, Time: recordTime(payload)})
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("read upload file: %w", err)
+		}
+	}
+
+	return writeFileAtomic(recordIndexPath(filePath), func(w *bufio.Writer) error {
+		_, err := w.Write(encodeRecordIndex(entries))
+		return err
+	})
+}
+
+// scanUploadFileFrom is scanUploadFile for the records after index after.
+// The record index is used to skip ahead; without a usable one the whole
+// upload is scanned.
+func scanUploadFileFrom(filePath string, after int, fn func(index int, payload []byte) error) error {
+	if after <= 0 {
+		return scanUploadFile(filePath, fn)
+	}
+
+	skip := func(index int, payload []byte) error {
+		if index <= after {
+			return nil
+		}
+		return fn(index, payload)
+	}
+
+	if err := ensureHot(filePath); err != nil {
+		return err
+	}
+	// a position past the index, e.g. from a client ahead of a lagging
+	// index, starts at the last record indexed rather than the beginning
+	entry, count, err := readRecordIndexEntry(filePath, after-1)
+	start := after
+	if err == nil && after > count && count > 0 {
+		start = count
+		entry, _, err = readRecordIndexEntry(filePath, start-1)
+	}
+	if err != nil || start > count || entry.Offset <= 0 {
+		return scanUploadFile(filePath, skip)
+	}
+
+	version, err := uploadFormat(filePath)
+	if err != nil {
+		return err
+	}
+
+	upload, err := acquireUploadFile(filePath, false)
+	if os.IsNotExist(err) {
+		return errUploadNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("open upload file: %w", err)
+	}
+	defer upload.release()
+
+	// start at the last record already seen, or the last indexed one, which
+	// must be there
+	var reader io.Reader = bufio.NewReader(io.NewSectionReader(upload.file, entry.Offset, math.MaxInt64-entry.Offset))
+	if magic, _ := reader.(*bufio.Reader).Peek(len(zstdMagic)); bytes.Equal(magic, zstdMagic) {
+		reader = newZstdReader(reader)
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 0, 1024), 16*1024*1024)
+	first := true
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		record, err := parseRecordLine([]byte(line), version)
+		if first && (err != nil || record.Index > start) {
+			// the index doesn't match the file
+			log.Printf("ignoring stale record index for %s", filePath)
+			return scanUploadFile(filePath, skip)
+		}
+		first = false
+		if err != nil {
+			return err
+		}
+		if err := skip(record.Index, record.Payload); err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan upload file: %w", err)
+	}
+	return nil
+}
+
+// firstRecordAtTime returns the number of records before the first one
+// captured at or after t according to the index, for use as the after
+// argument of scanUploadFileFrom. Records without a time are skipped over.
+func firstRecordAtTime(filePath string, t float64) int {
+	entries, err := readRecordIndex(filePath)
+	if err != nil {
+		return 0
+	}
+	for i, e := range entries {
+		if e.Time >= t {
+			return i
+		}
+	}
+	return len(entries)
+}
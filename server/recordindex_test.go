@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestRecordIndex(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	filePath := uploadFilePath(key)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1000,"position":{"x":0,"y":0,"z":0}}`,
+		`{"heartRate":70}`,
+	})
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1100,"position":{"x":1,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1300,"position":{"x":2,"y":0,"z":0}}`,
+	})
+
+	entries, err := readRecordIndex(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 4 || entries[0].Time != 1000 || !math.IsNaN(entries[1].Time) || entries[3].Time != 1300 {
+		t.Fatalf("index entries = %+v", entries)
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, e := range entries {
+		if want := string(rune('1'+i)) + ","; !strings.HasPrefix(string(data[e.Offset:]), want) {
+			t.Fatalf("entry %d points at %q", i+1, data[e.Offset:e.Offset+10])
+		}
+	}
+
+	var indexes []int
+	collect := func(index int, _ []byte) error {
+		indexes = append(indexes, index)
+		return nil
+	}
+	if err := scanUploadFileFrom(filePath, 2, collect); err != nil || len(indexes) != 2 || indexes[0] != 3 {
+		t.Fatalf("scan from 2 = %v, %v", indexes, err)
+	}
+	if after := firstRecordAtTime(filePath, 1100); after != 2 {
+		t.Fatalf("firstRecordAtTime(1100) = %d, want 2", after)
+	}
+
+	// a stale index is ignored when reading and rebuilt on the next append
+	stale := encodeRecordIndex([]recordIndexEntry{{Offset: entries[3].Offset}, {Offset: entries[3].Offset}})
+	if err := os.WriteFile(recordIndexPath(filePath), stale, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	indexes = nil
+	if err := scanUploadFileFrom(filePath, 1, collect); err != nil || len(indexes) != 3 || indexes[0] != 2 {
+		t.Fatalf("scan with stale index = %v, %v", indexes, err)
+	}
+	simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":1400,"position":{"x":3,"y":0,"z":0}}`})
+	rebuilt, err := readRecordIndex(filePath)
+	if err != nil || len(rebuilt) != 5 || rebuilt[2] != entries[2] || rebuilt[4].Time != 1400 {
+		t.Fatalf("rebuilt index = %+v, %v", rebuilt, err)
+	}
+
+	if entry, count, err := readRecordIndexEntry(filePath, 4); err != nil || count != 5 || entry != rebuilt[4] {
+		t.Fatalf("readRecordIndexEntry(4) = %+v, %d, %v", entry, count, err)
+	}
+	if entry, count, err := readRecordIndexEntry(filePath, 5); err != nil || count != 5 || entry != (recordIndexEntry{}) {
+		t.Fatalf("readRecordIndexEntry past the end = %+v, %d, %v", entry, count, err)
+	}
+
+	// a position past a lagging index starts at its last record
+	lagging := encodeRecordIndex(rebuilt[:3])
+	if err := os.WriteFile(recordIndexPath(filePath), lagging, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	indexes = nil
+	if err := scanUploadFileFrom(filePath, 4, collect); err != nil || len(indexes) != 1 || indexes[0] != 5 {
+		t.Fatalf("scan past lagging index = %v, %v", indexes, err)
+	}
+	if err := os.WriteFile(recordIndexPath(filePath), encodeRecordIndex(rebuilt), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	followRec := httptest.NewRecorder()
+	FollowHandler(followRec, withUploadKey(httptest.NewRequest("GET", "/api/follow?position=4", nil), key))
+	if body := strings.TrimSpace(followRec.Body.String()); followRec.Header().Get("X-Follow-Position") != "5" || !strings.HasPrefix(body, "5,") {
+		t.Fatalf("follow from index: position %s body %q", followRec.Header().Get("X-Follow-Position"), body)
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/replay?speed=1000&start_ms=1250", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	ReplayHandler(rec, req)
+	if body := rec.Body.String(); !strings.HasPrefix(body, "id: 4\n") || strings.Count(body, "id: ") != 2 {
+		t.Fatalf("replay from start_ms: %q", body)
+	}
+}
+
+// BenchmarkFollowLongSession follows the end of an upload of over 100MB, as
+// a viewer keeping up with a long session does.
+func BenchmarkFollowLongSession(b *testing.B) {
+	dir := b.TempDir()
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		b.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	key, err := generateUploadKey()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	const batches, batchSize = 60, 10000
+	var batch strings.Builder
+	for i := range batches {
+		batch.Reset()
+		for j := range batchSize {
+			t := float64(i*batchSize+j) / 90
+			fmt.Fprintf(&batch, `{"trackerKey":"headset","timestamp":%f,"position":{"x":%f,"y":1.6,"z":%f},"rotation":{"x":0,"y":0.7071,"z":0,"w":0.7071}}`+"\n", t, math.Sin(t), math.Cos(t))
+		}
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader(batch.String())), key))
+		if rec.Code != 200 {
+			b.Fatalf("upload status %d: %s", rec.Code, rec.Body)
+		}
+	}
+	if info, err := os.Stat(uploadFilePath(key)); err != nil || info.Size() < 100_000_000 {
+		b.Fatalf("upload file is %v bytes, %v", info.Size(), err)
+	}
+
+	position := fmt.Sprint(batches*batchSize - 1)
+	b.ResetTimer()
+	for range b.N {
+		// one record behind, so the follow cache can't answer
+		rec := httptest.NewRecorder()
+		FollowHandler(rec, withUploadKey(httptest.NewRequest("GET", "/api/follow?position="+position, nil), key))
+		if rec.Code != 200 {
+			b.Fatalf("follow status %d", rec.Code)
+		}
+	}
+}
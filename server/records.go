@@ -0,0 +1,382 @@
+package server
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var errUploadNotFound = errors.New("upload not found")
+
+type vec3 struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+}
+
+func (v vec3) sub(o vec3) vec3 {
+	return vec3{v.X - o.X, v.Y - o.Y, v.Z - o.Z}
+}
+
+func (v vec3) scale(f float64) vec3 {
+	return vec3{v.X * f, v.Y * f, v.Z * f}
+}
+
+func (v vec3) length() float64 {
+	return math.Sqrt(v.X*v.X + v.Y*v.Y + v.Z*v.Z)
+}
+
+// quat is a rotation quaternion. The VR clients serialize THREE.Quaternion
+// objects, which have underscore-prefixed fields, so both spellings are
+// accepted.
+type quat struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	Z float64 `json:"z"`
+	W float64 `json:"w"`
+}
+
+func (q *quat) UnmarshalJSON(data []byte) error {
+	var fields struct {
+		X, Y, Z, W *float64
+		UX         *float64 `json:"_x"`
+		UY         *float64 `json:"_y"`
+		UZ         *float64 `json:"_z"`
+		UW         *float64 `json:"_w"`
+	}
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	pick := func(plain, underscored *float64) float64 {
+		if plain != nil {
+			return *plain
+		}
+		if underscored != nil {
+			return *underscored
+		}
+		return 0
+	}
+	*q = quat{
+		X: pick(fields.X, fields.UX),
+		Y: pick(fields.Y, fields.UY),
+		Z: pick(fields.Z, fields.UZ),
+		W: pick(fields.W, fields.UW),
+	}
+	return nil
+}
+
+// mul returns the Hamilton product q*o.
+func (q quat) mul(o quat) quat {
+	return quat{
+		X: q.W*o.X + q.X*o.W + q.Y*o.Z - q.Z*o.Y,
+		Y: q.W*o.Y - q.X*o.Z + q.Y*o.W + q.Z*o.X,
+		Z: q.W*o.Z + q.X*o.Y - q.Y*o.X + q.Z*o.W,
+		W: q.W*o.W - q.X*o.X - q.Y*o.Y - q.Z*o.Z,
+	}
+}
+
+// nlerp interpolates between q and o by f along the shorter arc and
+// normalizes the result, which is close enough to slerp for the small
+// rotations between consecutive samples.
+func (q quat) nlerp(o quat, f float64) quat {
+	if q.X*o.X+q.Y*o.Y+q.Z*o.Z+q.W*o.W < 0 {
+		o = quat{-o.X, -o.Y, -o.Z, -o.W}
+	}
+	r := quat{
+		X: q.X + f*(o.X-q.X),
+		Y: q.Y + f*(o.Y-q.Y),
+		Z: q.Z + f*(o.Z-q.Z),
+		W: q.W + f*(o.W-q.W),
+	}
+	n := math.Sqrt(r.X*r.X + r.Y*r.Y + r.Z*r.Z + r.W*r.W)
+	if n == 0 {
+		return q
+	}
+	return quat{r.X / n, r.Y / n, r.Z / n, r.W / n}
+}
+
+// trackerSample is a single positional record as sent by the VR clients
+// (posvel.html, posrot.html, ...). Timestamps are in milliseconds; Epoch is
+// the client's wall clock in Unix milliseconds, or zero if it was not sent.
+type trackerSample struct {
+	Index      int      `json:"index,omitempty"`
+	TrackerKey string   `json:"trackerKey"`
+	Timestamp  float64  `json:"timestamp"`
+	Epoch      float64  `json:"epoch,omitempty"`
+	Position   vec3     `json:"position"`
+	Rotation   *quat    `json:"rotation,omitempty"`
+	Labels     []string `json:"labels,omitempty"`
+}
+
+// parseUploadKey normalizes a client-supplied upload key and checks that it
+// has the expected length and encoding.
+func parseUploadKey(raw string) (string, error) {
+	uploadKey := strings.ToLower(strings.TrimSpace(raw))
+	if uploadKey == "" {
+		return "", errors.New("missing upload_key")
+	}
+
+	if len(uploadKey) != uploadKeyHexLength {
+		return "", fmt.Errorf("invalid upload_key length: expected %d-character hex string", uploadKeyHexLength)
+	}
+
+	if _, err := hex.DecodeString(uploadKey); err != nil {
+		return "", errors.New("invalid upload_key format: must be hexadecimal")
+	}
+
+	return uploadKey, nil
+}
+
+// uploadFilePath returns where an upload is stored. Files are named after
+// the upload name and key; a file stored under a name from another word list
+// is looked up in the key store, which RestoreUploadNameSuffixes tells.
+func uploadFilePath(uploadKey string) string {
+	if name, ok := uploadKeys.storedFile(uploadKey); ok {
+		return filepath.Join(uploadDir, name)
+	}
+	return filepath.Join(uploadDir, uploadFileName(uploadKey))
+}
+
+// uploadFileName is the name new uploads are stored under.
+func uploadFileName(uploadKey string) string {
+	return fmt.Sprintf("%s_%s.csv", uploadNameFromKey(uploadKey), uploadKey)
+}
+
+// scanUploadFile calls fn for every non-empty record line of a stored upload,
+// skipping the metadata line. index is the stored record index and payload
+// is the JSON part of the line, in either file format version.
+func scanUploadFile(filePath string, fn func(index int, payload []byte) error) error {
+	if err := ensureHot(filePath); err != nil {
+		return err
+	}
+	file, err := openUploadFile(filePath)
+	if os.IsNotExist(err) {
+		return errUploadNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("open upload file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 0, 1024), 16*1024*1024)
+
+	if !scanner.Scan() {
+		// empty file or metadata line only
+		return scanner.Err()
+	}
+	version := metadataFormatVersion(scanner.Bytes())
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		record, err := parseRecordLine([]byte(line), version)
+		if err != nil {
+			return err
+		}
+		if err := fn(record.Index, record.Payload); err != nil {
+			return err
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("scan upload file: %w", err)
+	}
+
+	return nil
+}
+
+// readTrackerSamples loads every positional record of an upload, grouped by
+// tracker key. Records without a tracker key or position (heart rate
+// entries, model output, ...) are skipped.
+func readTrackerSamples(uploadKey string) (map[string][]trackerSample, error) {
+	samples := map[string][]trackerSample{}
+	err := scanUploadFile(uploadFilePath(uploadKey), func(index int, payload []byte) error {
+		if sample, ok := parseTrackerSample(index, payload); ok {
+			samples[sample.TrackerKey] = append(samples[sample.TrackerKey], sample)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+// parseTrackerSample reads a stored record as a tracker sample, reporting
+// false if it isn't one.
+func parseTrackerSample(index int, payload []byte) (trackerSample, bool) {
+	var record struct {
+		TrackerKey string   `json:"trackerKey"`
+		Timestamp  *float64 `json:"timestamp"`
+		Epoch      float64  `json:"epoch"`
+		Position   *vec3    `json:"position"`
+		Rotation   *quat    `json:"rotation"`
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		// Stored lines were validated on ingest; a non-object payload is
+		// simply not a tracker sample.
+		return trackerSample{}, false
+	}
+	if record.TrackerKey == "" || record.Timestamp == nil || record.Position == nil {
+		return trackerSample{}, false
+	}
+	return trackerSample{
+		Index:      index,
+		TrackerKey: record.TrackerKey,
+		Timestamp:  *record.Timestamp,
+		Epoch:      record.Epoch,
+		Position:   *record.Position,
+		Rotation:   record.Rotation,
+	}, true
+}
+
+var errTrackerNotFound = errors.New("no samples for tracker")
+
+// selectTracker narrows samples down to a single tracker if one is given.
+func selectTracker(samples map[string][]trackerSample, tracker string) (map[string][]trackerSample, error) {
+	if tracker == "" {
+		return samples, nil
+	}
+	trackerSamples, ok := samples[tracker]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errTrackerNotFound, tracker)
+	}
+	return map[string][]trackerSample{tracker: trackerSamples}, nil
+}
+
+// heartRateSample is a heart rate reading, either measured
+// (web-bluetooth-polar-send.html) or predicted (model_upload.py). Epoch is
+// in Unix milliseconds.
+type heartRateSample struct {
+	Index int
+	Epoch float64
+	BPM   float64
+}
+
+// readHeartRateSamples loads every heart rate record of an upload. Records
+// that carry no usable wall-clock time are skipped.
+func readHeartRateSamples(uploadKey string) ([]heartRateSample, error) {
+	var samples []heartRateSample
+	err := scanUploadFile(uploadFilePath(uploadKey), func(index int, payload []byte) error {
+		var record struct {
+			BPM                *float64 `json:"bpm"`
+			PredictedHeartRate *float64 `json:"predicted_heart_rate"`
+			Epoch              float64  `json:"epoch"`
+			TsISO              string   `json:"tsISO"`
+		}
+		if err := json.Unmarshal(payload, &record); err != nil {
+			return nil
+		}
+
+		bpm := record.BPM
+		if bpm == nil {
+			bpm = record.PredictedHeartRate
+		}
+		if bpm == nil {
+			return nil
+		}
+
+		epoch := record.Epoch
+		if epoch == 0 && record.TsISO != "" {
+			ts, err := time.Parse(time.RFC3339Nano, record.TsISO)
+			if err != nil {
+				return nil
+			}
+			epoch = float64(ts.UnixMilli())
+		}
+		if epoch == 0 {
+			return nil
+		}
+
+		samples = append(samples, heartRateSample{Index: index, Epoch: epoch, BPM: *bpm})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return samples, nil
+}
+
+// uploadMetadata is the JSON metadata line at the top of each upload file.
+type uploadMetadata struct {
+	UploadKey         string            `json:"upload_key"`
+	UploadName        string            `json:"upload_name"`
+	UserAgent         string            `json:"user_agent"`
+	ReceivedAt        string            `json:"received_at"`
+	ServerVersion     string            `json:"server_version,omitempty"`
+	ClientCert        *clientIdentity   `json:"client_cert,omitempty"`
+	ClientFingerprint string            `json:"client_fingerprint,omitempty"`
+	ClientIP          string            `json:"client_ip,omitempty"`
+	Quantization      *quantizationInfo `json:"quantization,omitempty"`
+	TimestampUnit     string            `json:"timestamp_unit,omitempty"`
+	RecordReceiveTime bool              `json:"record_receive_time,omitempty"`
+	FormatVersion     int               `json:"format_version,omitempty"`
+	Encryption        *encryptionInfo   `json:"encryption,omitempty"`
+	Tenant            string            `json:"tenant,omitempty"`
+	Labels            map[string]string `json:"labels,omitempty"`
+}
+
+func readUploadMetadata(filePath string) (uploadMetadata, error) {
+	file, err := openUploadFile(filePath)
+	if os.IsNotExist(err) {
+		return uploadMetadata{}, errUploadNotFound
+	}
+	if err != nil {
+		return uploadMetadata{}, fmt.Errorf("open upload file: %w", err)
+	}
+	defer file.Close()
+
+	line, err := bufio.NewReaderSize(file, 4096).ReadBytes('\n')
+	if err != nil && len(line) == 0 {
+		return uploadMetadata{}, fmt.Errorf("read metadata line: %w", err)
+	}
+
+	var metadata uploadMetadata
+	if err := json.Unmarshal(line, &metadata); err != nil {
+		return uploadMetadata{}, fmt.Errorf("decode metadata line: %w", err)
+	}
+	return metadata, nil
+}
+
+// listUploadKeys returns the keys of all stored uploads, derived from the
+// file names in the upload directory.
+func listUploadKeys() ([]string, error) {
+	entries, err := os.ReadDir(uploadDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read upload directory: %w", err)
+	}
+
+	var keys []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, ".csv") {
+			continue
+		}
+		underscore := strings.LastIndexByte(name, '_')
+		if underscore < 0 {
+			continue
+		}
+		// files named after another word list count too
+		uploadKey, err := parseUploadKey(strings.TrimSuffix(name[underscore+1:], ".csv"))
+		if err != nil || name[underscore+1:] != uploadKey+".csv" {
+			continue
+		}
+		keys = append(keys, uploadKey)
+	}
+	return keys, nil
+}
@@ -0,0 +1,274 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	starlarkjson "go.starlark.net/lib/json"
+	starlarkmath "go.starlark.net/lib/math"
+	"go.starlark.net/starlark"
+	"go.starlark.net/syntax"
+)
+
+// A record script transforms and filters records at ingest and adds computed
+// fields to raw exports, so that a study can be tweaked without rebuilding
+// the server. Scripts are Starlark (https://github.com/bazelbuild/starlark),
+// a small dialect of Python without I/O, while loops or recursion, and each
+// record gets a step and a time limit, so a script can't stall the server.
+// For example:
+//
+//	def ingest(record):
+//	    bpm = record.get("bpm")
+//	    if bpm != None and (bpm <= 0 or bpm > 250):
+//	        return None  # implausible, dropped
+//	    record["study"] = "pilot-2"
+//	    record.pop("debug", None)
+//	    return record
+//
+//	def export(record):
+//	    if "bpm" in record:
+//	        record["hr_zone"] = math.floor(record["bpm"] / 20)
+//	    return record
+//
+// Both functions are optional and get a record decoded from JSON as a dict.
+// ingest returns the record to store, or None to drop it; export returns the
+// record to export, or None to export it as stored. The math module is
+// predeclared. Records that aren't JSON objects are left alone.
+
+const (
+	// maxScriptSteps bounds the Starlark steps taken per record.
+	maxScriptSteps = 100000
+	// maxScriptRecordBytes bounds a record changed by a script.
+	maxScriptRecordBytes = 1024 * 1024
+)
+
+// maxScriptTime bounds the time taken per record, including builtins such
+// as sorted that take a single step however much they do.
+var maxScriptTime = 100 * time.Millisecond
+
+var (
+	errScriptTooExpensive = errors.New("script exceeded its step limit")
+	errScriptTooSlow      = errors.New("script exceeded its time limit")
+)
+
+type recordScript struct {
+	source string
+	ingest starlark.Callable // nil if the script has no ingest function
+	export starlark.Callable // nil if the script has no export function
+
+	fieldsMutex sync.Mutex
+	fields      []string // top-level fields ingest added to records
+}
+
+// ingestScript and exportScript hold the loaded record script if it has
+// an ingest or export function.
+var ingestScript, exportScript *recordScript
+
+// SetRecordScript loads the Starlark record script at path: its ingest
+// function is registered as an ingest hook, its export function applies to
+// raw NDJSON exports.
+func SetRecordScript(path string) error {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read record script: %w", err)
+	}
+	script, err := loadRecordScript(path, source)
+	if err != nil {
+		return err
+	}
+	if script.ingest != nil {
+		RegisterIngestHook(script.ingestHook)
+		ingestScript = script
+	}
+	if script.export != nil {
+		exportScript = script
+	}
+	return nil
+}
+
+// loadRecordScript runs the top level of a record script and picks up its
+// functions.
+func loadRecordScript(filename string, source []byte) (*recordScript, error) {
+	thread, stop := newScriptThread()
+	defer stop()
+	globals, err := starlark.ExecFileOptions(&syntax.FileOptions{}, thread, filename, source, starlark.StringDict{"math": starlarkmath.Module})
+	if err != nil {
+		return nil, scriptError(thread, err)
+	}
+
+	script := &recordScript{source: string(source)}
+	for name, fn := range map[string]*starlark.Callable{"ingest": &script.ingest, "export": &script.export} {
+		value, ok := globals[name]
+		if !ok {
+			continue
+		}
+		function, ok := value.(*starlark.Function)
+		if !ok || function.NumParams() != 1 {
+			return nil, fmt.Errorf("%s: %s must be a function of one record", filename, name)
+		}
+		*fn = function
+	}
+	if script.ingest == nil && script.export == nil {
+		return nil, fmt.Errorf("%s: record script defines neither ingest nor export", filename)
+	}
+	return script, nil
+}
+
+// newScriptThread returns a thread with the per-record limits; stop has to
+// be called once it is done.
+func newScriptThread() (thread *starlark.Thread, stop func()) {
+	thread = &starlark.Thread{
+		Name:  "record script",
+		Print: func(_ *starlark.Thread, msg string) { log.Printf("record script: %s", msg) },
+	}
+	thread.SetMaxExecutionSteps(maxScriptSteps)
+	var expired atomic.Bool
+	timer := time.AfterFunc(maxScriptTime, func() {
+		expired.Store(true)
+		thread.Cancel(errScriptTooSlow.Error())
+	})
+	thread.SetLocal("expired", &expired)
+	return thread, func() { timer.Stop() }
+}
+
+// scriptError describes the failure of a script on thread, with the
+// position in the script it happened at.
+func scriptError(thread *starlark.Thread, err error) error {
+	if expired, _ := thread.Local("expired").(*atomic.Bool); expired != nil && expired.Load() {
+		return errScriptTooSlow
+	}
+	if thread.ExecutionSteps() >= maxScriptSteps {
+		return errScriptTooExpensive
+	}
+	var evalErr *starlark.EvalError
+	if !errors.As(err, &evalErr) {
+		return err
+	}
+	for i := len(evalErr.CallStack) - 1; i >= 0; i-- {
+		if frame := evalErr.CallStack[i]; frame.Pos.Filename() != "<builtin>" {
+			return fmt.Errorf("%s: %s", frame.Pos, evalErr.Msg)
+		}
+	}
+	return errors.New(evalErr.Msg)
+}
+
+// ingestHook runs the ingest function as an IngestHook.
+func (s *recordScript) ingestHook(_ context.Context, _ string, record Record) (Record, error) {
+	payload, drop, err := s.run(s.ingest, record.Payload)
+	if err != nil {
+		return record, err
+	}
+	if drop {
+		return record, ErrDropRecord
+	}
+	record.Payload = payload
+	return record, nil
+}
+
+// ingestScriptFields returns the top-level fields the ingest function added
+// to records so far, which uploads note in their metadata so that
+// anonymizing can strip them.
+func ingestScriptFields() []string {
+	if ingestScript == nil {
+		return nil
+	}
+	ingestScript.fieldsMutex.Lock()
+	defer ingestScript.fieldsMutex.Unlock()
+	return slices.Clone(ingestScript.fields)
+}
+
+// applyExportScript runs the export function on a payload. If the script
+// fails on it, the payload is exported unchanged.
+func applyExportScript(payload []byte) []byte {
+	if exportScript == nil {
+		return payload
+	}
+	changed, drop, err := exportScript.run(exportScript.export, payload)
+	if err != nil {
+		log.Printf("record script failed on export: %v", err)
+		return payload
+	}
+	if drop {
+		return payload
+	}
+	return changed
+}
+
+// run calls fn on a payload and returns the payload to keep and whether fn
+// returned None.
+func (s *recordScript) run(fn starlark.Callable, payload []byte) ([]byte, bool, error) {
+	thread, stop := newScriptThread()
+	defer stop()
+
+	decoded, err := starlark.Call(thread, starlarkjson.Module.Members["decode"], starlark.Tuple{starlark.String(payload)}, nil)
+	if err != nil {
+		return payload, false, nil
+	}
+	record, ok := decoded.(*starlark.Dict)
+	if !ok {
+		return payload, false, nil
+	}
+	original, err := encodeScriptRecord(thread, record)
+	if err != nil {
+		return nil, false, err
+	}
+	fields := map[string]bool{}
+	for _, key := range record.Keys() {
+		fields[string(key.(starlark.String))] = true
+	}
+
+	result, err := starlark.Call(thread, fn, starlark.Tuple{record}, nil)
+	if err != nil {
+		return nil, false, scriptError(thread, err)
+	}
+	if result == starlark.None {
+		return nil, true, nil
+	}
+	changed, ok := result.(*starlark.Dict)
+	if !ok {
+		return nil, false, fmt.Errorf("%s returned %s, want a dict or None", fn.Name(), result.Type())
+	}
+	encoded, err := encodeScriptRecord(thread, changed)
+	if err != nil {
+		return nil, false, fmt.Errorf("%s returned a record that isn't JSON: %w", fn.Name(), err)
+	}
+	if encoded == original {
+		return payload, false, nil
+	}
+	if len(encoded) > maxScriptRecordBytes {
+		return nil, false, fmt.Errorf("scripted record is larger than %d bytes", maxScriptRecordBytes)
+	}
+
+	if fn == s.ingest {
+		for _, key := range changed.Keys() {
+			if field, ok := key.(starlark.String); ok && !fields[string(field)] {
+				s.noteField(string(field))
+			}
+		}
+	}
+	return []byte(encoded), false, nil
+}
+
+func encodeScriptRecord(thread *starlark.Thread, record *starlark.Dict) (string, error) {
+	encoded, err := starlark.Call(thread, starlarkjson.Module.Members["encode"], starlark.Tuple{record}, nil)
+	if err != nil {
+		return "", scriptError(thread, err)
+	}
+	return string(encoded.(starlark.String)), nil
+}
+
+// noteField adds a field to those the ingest function added.
+func (s *recordScript) noteField(field string) {
+	s.fieldsMutex.Lock()
+	defer s.fieldsMutex.Unlock()
+	if !slices.Contains(s.fields, field) {
+		s.fields = append(s.fields, field)
+	}
+}
@@ -0,0 +1,161 @@
+package server
+
+import (
+	"errors"
+	"os"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecordScriptIngest(t *testing.T) {
+	script, err := loadRecordScript("study.star", []byte(`
+def ingest(record):
+    bpm = record.get("bpm")
+    if bpm != None and (bpm <= 0 or bpm > 250):
+        return None  # implausible
+    record["study"] = "pilot-#2"
+    if "position" in record:
+        record["position"]["y"] = math.round(record["position"]["y"] * 1000) / 10
+    if "trackers" in record:
+        record["tag"] = record["trackerKey"].upper() + "-" + str(len(record["trackers"]))
+    record.pop("debug", None)
+    return record
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if script.export != nil {
+		t.Fatal("script without export has an export function")
+	}
+
+	tests := []struct {
+		payload, want string
+		drop          bool
+	}{
+		{`{"bpm":70,"debug":true}`, `{"bpm":70,"study":"pilot-#2"}`, false},
+		{`{"bpm":0}`, "", true},
+		{`{"bpm":300}`, "", true},
+		{`{"trackerKey":"head","position":{"x":1,"y":0.12345},"trackers":[1,2]}`, `{"position":{"x":1,"y":12.3},"study":"pilot-#2","tag":"HEAD-2","trackerKey":"head","trackers":[1,2]}`, false},
+		{`[1,2]`, `[1,2]`, false},
+	}
+	for _, test := range tests {
+		got, drop, err := script.run(script.ingest, []byte(test.payload))
+		if err != nil || drop != test.drop || !drop && string(got) != test.want {
+			t.Errorf("run(%s) = %s, %v, %v; want %s, %v", test.payload, got, drop, err, test.want, test.drop)
+		}
+	}
+	if fields := script.fields; !slices.Equal(fields, []string{"study", "tag"}) {
+		t.Errorf("added fields = %q", fields)
+	}
+
+	// the position of the failure is reported
+	if _, _, err := script.run(script.ingest, []byte(`{"bpm":"fast"}`)); err == nil || !strings.Contains(err.Error(), "study.star:4:") {
+		t.Errorf("comparing a string with a number: %v", err)
+	}
+}
+
+func TestRecordScriptErrors(t *testing.T) {
+	for _, source := range []string{
+		"x = 1",
+		"def ingest(record):\n    return record +",
+		"def ingest(record, upload):\n    return record",
+		"ingest = 1",
+		"def ingest(record):\n    return exec(record)",
+		"def ingest(record):\n    while True:\n        pass",
+		"load(\"os.star\", \"system\")\ndef ingest(record):\n    return record",
+		"fail(\"broken\")",
+	} {
+		if _, err := loadRecordScript("study.star", []byte(source)); err == nil {
+			t.Errorf("loadRecordScript(%q) succeeded", source)
+		}
+	}
+
+	script, err := loadRecordScript("study.star", []byte("def ingest(record):\n    return [record]\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := script.run(script.ingest, []byte(`{}`)); err == nil || !strings.Contains(err.Error(), "want a dict") {
+		t.Fatalf("returning a list: %v", err)
+	}
+
+	// a script can't take unbounded work
+	script, err = loadRecordScript("study.star", []byte(`
+def ingest(record):
+    n = 0
+    for i in range(1000000):
+        n += i
+    record["n"] = n
+    return record
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := script.run(script.ingest, []byte(`{}`)); !errors.Is(err, errScriptTooExpensive) {
+		t.Fatalf("long loop: %v", err)
+	}
+
+	// nor unbounded time, e.g. in builtins that take a single step
+	script, err = loadRecordScript("study.star", []byte(`
+def ingest(record):
+    s = "ab" * 500000
+    n = 0
+    for i in range(100):
+        n += len(s.replace("a", "c"))
+    record["n"] = n
+    return record
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	maxScriptTime = time.Millisecond
+	t.Cleanup(func() { maxScriptTime = 100 * time.Millisecond })
+	if _, _, err := script.run(script.ingest, []byte(`{}`)); !errors.Is(err, errScriptTooSlow) {
+		t.Fatalf("slow builtins: %v", err)
+	}
+}
+
+func TestSetRecordScript(t *testing.T) {
+	chdirTemp(t)
+	setTestIngestHooks(t)
+	t.Cleanup(func() { ingestScript, exportScript = nil, nil })
+
+	err := os.WriteFile("study.star", []byte(`
+def ingest(record):
+    if record.get("bpm") == 0:
+        return None
+    record["participant"] = "p-07"
+    return record
+
+def export(record):
+    if "bpm" in record:
+        record["zone"] = math.floor(record["bpm"] / 20)
+    return record
+`), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+	etag, err := exportETag(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := SetRecordScript("study.star"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, _ := exportETag(key); changed == etag {
+		t.Fatal("export ETag doesn't change with the record script")
+	}
+
+	simulateUpload(t, key, []string{`{"bpm":0}`, `{"bpm":90}`})
+	_, _, lines := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, lines, []string{`{"bpm":70}`, `{"bpm":90,"participant":"p-07"}`})
+
+	want := `{"bpm":70,"zone":3}` + "\n" + `{"bpm":90,"participant":"p-07","zone":4}` + "\n"
+	if raw := exportRawUpload(t, key); raw != want {
+		t.Fatalf("export = %q, want %q", raw, want)
+	}
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// In relay mode every stored batch is also sent to one or more upstream
+// servers, e.g. from an edge collector at a venue to a central archive.
+// Batches are queued on disk first, one directory per upstream, so they
+// survive outages and restarts, and are sent in order by one worker per
+// upstream that retries with backoff. Batches an upstream refuses for good
+// are moved aside to a failed directory. Upstreams store batches under the
+// same upload key, so uploads keep their names.
+
+const (
+	relayTimeout    = 30 * time.Second
+	relayMaxBackoff = 5 * time.Minute
+)
+
+// relayMinBackoff is the first delay before a batch is sent again.
+var relayMinBackoff = time.Second
+
+// relayedBatch is a queued batch, as stored in the queue directory. It holds
+// the upload key, which the upstream needs to store the batch.
+type relayedBatch struct {
+	UploadKey string   `json:"upload_key"`
+	DeviceID  string   `json:"device_id,omitempty"`
+	Tenant    string   `json:"tenant,omitempty"`
+	KeyID     string   `json:"key_id,omitempty"`
+	Lines     []string `json:"lines"`
+}
+
+type relayUpstream struct {
+	url      string // upload endpoint
+	queueDir string
+	wake     chan struct{}
+}
+
+var (
+	relayUpstreams []*relayUpstream
+	relaySequence  atomic.Int64
+
+	relayBatchesSent     = expvar.NewInt("relay_batches_sent")
+	relayBatchesRetried  = expvar.NewInt("relay_batches_retried")
+	relayBatchesRejected = expvar.NewInt("relay_batches_rejected")
+)
+
+// StartRelay forwards every stored batch to the servers at upstreams, given
+// by their base URL (e.g. https://archive.example.org), queueing batches in
+// queueDir until they are accepted. Batches queued by an earlier run are
+// sent too.
+func StartRelay(upstreams []string, queueDir string) error {
+	if len(upstreams) == 0 {
+		return errors.New("no relay upstreams")
+	}
+	var started []*relayUpstream
+	for i, upstream := range upstreams {
+		u, err := url.Parse(strings.TrimSuffix(upstream, "/"))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("invalid relay upstream %q: must be an http or https URL", upstream)
+		}
+		relay := &relayUpstream{
+			url: u.String() + "/api/v" + apiVersion + "/upload",
+			// upstreams are told apart by position, so keep the list stable
+			// while batches are queued
+			queueDir: filepath.Join(queueDir, strconv.Itoa(i)),
+			wake:     make(chan struct{}, 1),
+		}
+		if err := os.MkdirAll(filepath.Join(relay.queueDir, "failed"), 0o755); err != nil {
+			return fmt.Errorf("create relay queue: %w", err)
+		}
+		started = append(started, relay)
+	}
+
+	relayUpstreams = started
+	for _, relay := range started {
+		go relay.run()
+	}
+	return nil
+}
+
+// relayBatch queues a stored batch for every upstream.
+func relayBatch(uploadKey string, columns recordColumns, tenant, keyID string, lines []string) {
+	if len(relayUpstreams) == 0 || len(lines) == 0 {
+		return
+	}
+	data, err := json.Marshal(relayedBatch{UploadKey: uploadKey, DeviceID: columns.DeviceID, Tenant: tenant, KeyID: keyID, Lines: lines})
+	if err != nil {
+		log.Printf("failed to encode relayed batch: %v", err)
+		return
+	}
+	// names sort in the order batches were stored
+	name := fmt.Sprintf("%020d-%010d.json", time.Now().UnixNano(), relaySequence.Add(1))
+	for _, relay := range relayUpstreams {
+		path := filepath.Join(relay.queueDir, name)
+		if err := os.WriteFile(path+".tmp", data, 0o600); err != nil {
+			log.Printf("failed to queue batch for %s: %v", relay.url, err)
+			continue
+		}
+		if err := os.Rename(path+".tmp", path); err != nil {
+			log.Printf("failed to queue batch for %s: %v", relay.url, err)
+			continue
+		}
+		select {
+		case relay.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// queued returns the names of the queued batches, oldest first.
+func (r *relayUpstream) queued() ([]string, error) {
+	entries, err := os.ReadDir(r.queueDir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, entry := range entries {
+		if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+			names = append(names, entry.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// run sends queued batches until the queue is empty, then waits for more.
+func (r *relayUpstream) run() {
+	client := &http.Client{Timeout: relayTimeout}
+	backoff := relayMinBackoff
+	for {
+		names, err := r.queued()
+		if err != nil {
+			log.Printf("failed to read relay queue %s: %v", r.queueDir, err)
+		}
+		if len(names) == 0 {
+			<-r.wake
+			continue
+		}
+
+		for _, name := range names {
+			path := filepath.Join(r.queueDir, name)
+			retry, err := r.send(client, path)
+			if err == nil {
+				os.Remove(path)
+				relayBatchesSent.Add(1)
+				backoff = relayMinBackoff
+				continue
+			}
+			if !retry {
+				log.Printf("relay upstream %s refused batch %s, moved to failed: %v", r.url, name, err)
+				os.Rename(path, filepath.Join(r.queueDir, "failed", name))
+				relayBatchesRejected.Add(1)
+				continue
+			}
+
+			// later batches wait, so that they arrive in order
+			log.Printf("failed to relay batch to %s, retrying in %s: %v", r.url, backoff, err)
+			relayBatchesRetried.Add(1)
+			time.Sleep(backoff)
+			backoff = min(backoff*2, relayMaxBackoff)
+			break
+		}
+	}
+}
+
+// send posts a queued batch and reports whether a failure is worth retrying.
+func (r *relayUpstream) send(client *http.Client, path string) (retry bool, err error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return false, err
+	}
+	var batch relayedBatch
+	if err := json.Unmarshal(data, &batch); err != nil {
+		return false, fmt.Errorf("decode queued batch: %w", err)
+	}
+
+	query := url.Values{"timestamp_unit": {"s"}}
+	if batch.DeviceID != "" {
+		query.Set("device_id", batch.DeviceID)
+	}
+	if batch.Tenant != "" {
+		query.Set("tenant", batch.Tenant)
+	}
+	contentType := "application/x-ndjson"
+	if batch.KeyID != "" {
+		query.Set("key_id", batch.KeyID)
+		contentType = encryptedUploadType
+	}
+	body := strings.Join(batch.Lines, "\n") + "\n"
+
+	req, err := http.NewRequest(http.MethodPost, r.url+"?"+query.Encode(), strings.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Upload-Key", batch.UploadKey)
+	req.Header.Set("User-Agent", "hr-demo-app-relay/"+VersionString())
+	resp, err := client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	defer resp.Body.Close()
+	message, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	switch {
+	case resp.StatusCode/100 == 2:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode >= 500:
+		return true, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	default:
+		return false, fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(message))
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRelay(t *testing.T) {
+	chdirTemp(t)
+	relayMinBackoff = time.Millisecond
+	t.Cleanup(func() { relayUpstreams, relayMinBackoff = nil, time.Second })
+
+	type received struct{ uploadKey, contentType, body string }
+	var mu sync.Mutex
+	var batches []received
+	failures := 1
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		if r.URL.Path != "/api/v1/upload" {
+			http.NotFound(w, r)
+			return
+		}
+		if strings.Contains(string(body), "refuse") {
+			http.Error(w, "bad batch", http.StatusBadRequest)
+			return
+		}
+		if failures > 0 {
+			failures--
+			http.Error(w, "down for maintenance", http.StatusServiceUnavailable)
+			return
+		}
+		batches = append(batches, received{r.Header.Get("X-Upload-Key"), r.Header.Get("Content-Type"), string(body)})
+	}))
+	defer upstream.Close()
+
+	if err := StartRelay([]string{upstream.URL + "/"}, "relay-queue"); err != nil {
+		t.Fatal(err)
+	}
+
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`, `{"bpm":71}`})
+	simulateUpload(t, key, []string{`{"bpm":"refuse"}`})
+	simulateUpload(t, key, []string{`{"bpm":72}`})
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		mu.Lock()
+		n := len(batches)
+		mu.Unlock()
+		if n == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("relayed %d batches, want 2", n)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// the first batch was retried and still arrived before the later one
+	mu.Lock()
+	defer mu.Unlock()
+	if batches[0].body != "{\"bpm\":70}\n{\"bpm\":71}\n" || batches[1].body != "{\"bpm\":72}\n" {
+		t.Fatalf("relayed batches = %+v", batches)
+	}
+	if batches[0].uploadKey != key || batches[0].contentType != "application/x-ndjson" {
+		t.Fatalf("relayed request = %+v", batches[0])
+	}
+
+	failed, _ := filepath.Glob(filepath.Join("relay-queue", "0", "failed", "*.json"))
+	queued, _ := filepath.Glob(filepath.Join("relay-queue", "0", "*.json"))
+	if len(failed) != 1 || len(queued) != 0 {
+		t.Fatalf("queue: %d failed, %d left", len(failed), len(queued))
+	}
+	if data, _ := os.ReadFile(failed[0]); !strings.Contains(string(data), "refuse") {
+		t.Fatalf("failed batch = %s", data)
+	}
+}
+
+func TestStartRelayRejectsInvalidUpstreams(t *testing.T) {
+	chdirTemp(t)
+	for _, upstreams := range [][]string{nil, {"ftp://archive"}, {"https://"}} {
+		if err := StartRelay(upstreams, "relay-queue"); err == nil {
+			t.Errorf("StartRelay(%q) succeeded", upstreams)
+		}
+	}
+}
@@ -0,0 +1,183 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+var (
+	errReplayCancelled = errors.New("replay cancelled")
+	errReplayIdle      = errors.New("replay idle timeout")
+)
+
+// payloadTime returns the capture time of a stored payload in milliseconds:
+// the scene timestamp of tracker records, or the wall-clock epoch of
+// records that only carry one.
+func payloadTime(payload []byte) (float64, bool) {
+	var record struct {
+		Timestamp json.RawMessage `json:"timestamp"`
+		Epoch     *float64        `json:"epoch"`
+		EpochMs   *float64        `json:"epoch_ms"`
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return 0, false
+	}
+
+	var timestamp float64
+	if json.Unmarshal(record.Timestamp, &timestamp) == nil {
+		return timestamp, true
+	}
+	if record.Epoch != nil {
+		return *record.Epoch, true
+	}
+	if record.EpochMs != nil {
+		return *record.EpochMs, true
+	}
+	return 0, false
+}
+
+// ReplayHandler streams a stored session as server-sent events, pacing
+// records by their original capture times divided by speed. Each event's
+// id is the record index, so a reconnecting EventSource resumes where it
+// left off via Last-Event-ID. start_ms starts the replay part way through,
+// and downsample= sends fewer records over the same time.
+func ReplayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	speed, err := parsePositiveFloatParam(r, "speed", 1)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	// max_gap_ms caps pauses in the original recording, e.g. breaks
+	maxGapMs, err := parsePositiveFloatParam(r, "max_gap_ms", math.Inf(1))
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	downsample, err := parseDownsample(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	resumeAfter := 0
+	if lastEventID := r.Header.Get("Last-Event-ID"); lastEventID != "" {
+		resumeAfter, err = strconv.Atoi(lastEventID)
+		if err != nil || resumeAfter < 0 {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid Last-Event-ID header: must be a record index")
+			return
+		}
+	}
+
+	// start_ms skips to the first record captured at or after that time
+	startMs := math.Inf(-1)
+	if startStr := r.URL.Query().Get("start_ms"); startStr != "" {
+		startMs, err = strconv.ParseFloat(startStr, 64)
+		if err != nil || math.IsNaN(startMs) || math.IsInf(startMs, 0) {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid start_ms parameter: must be a number")
+			return
+		}
+	}
+
+	filePath := uploadFilePath(uploadKey)
+	if _, err := os.Stat(filePath); os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, errUploadNotFound.Error())
+		return
+	}
+
+	after := resumeAfter
+	if !math.IsInf(startMs, -1) {
+		after = max(after, firstRecordAtTime(filePath, startMs))
+	}
+
+	stream := newEventStream(w)
+	defer stream.stop()
+
+	log.Printf("replay started upload_name=%q speed=%v resume_after=%d", uploadNameFromKey(uploadKey), speed, resumeAfter)
+
+	ctx := r.Context()
+	var lastTime float64
+	haveLastTime := false
+	sent := 0
+	send := func(index int, payload []byte) error {
+		t, ok := payloadTime(payload)
+		if !math.IsInf(startMs, -1) && sent == 0 && (!ok || t < startMs) {
+			// without a record index the start is found by scanning
+			return nil
+		}
+
+		if ok {
+			if haveLastTime && t > lastTime {
+				delay := time.Duration(math.Min(t-lastTime, maxGapMs) / speed * float64(time.Millisecond))
+				timer := time.NewTimer(delay)
+				defer timer.Stop()
+			wait:
+				for {
+					// long pauses send keepalives so the connection survives them
+					select {
+					case <-ctx.Done():
+						return errReplayCancelled
+					case <-stream.idle():
+						return errReplayIdle
+					case <-stream.keepalive():
+						if err := stream.ping(); err != nil {
+							return err
+						}
+					case <-timer.C:
+						break wait
+					}
+				}
+			}
+			lastTime, haveLastTime = t, true
+		}
+
+		if err := stream.send("id: %d\ndata: %s\n\n", index, payload); err != nil {
+			return err
+		}
+		sent++
+		return nil
+	}
+	flush := func() error { return nil }
+	if downsample != nil {
+		send, flush = downsample.scan(send)
+	}
+	err = scanUploadFileFrom(filePath, after, send)
+	if err == nil {
+		err = flush()
+	}
+	if errors.Is(err, errReplayCancelled) {
+		log.Printf("replay cancelled upload_name=%q sent=%d", uploadNameFromKey(uploadKey), sent)
+		return
+	}
+	if errors.Is(err, errReplayIdle) {
+		// the client reconnects with Last-Event-ID and resumes after the pause
+		log.Printf("replay idle timeout upload_name=%q sent=%d", uploadNameFromKey(uploadKey), sent)
+		return
+	}
+	if err != nil {
+		log.Printf("replay failed upload_name=%q sent=%d: %v", uploadNameFromKey(uploadKey), sent, err)
+		return
+	}
+
+	if err := stream.send("event: end\ndata: {}\n\n"); err != nil {
+		log.Printf("failed to flush replay end: %v", err)
+	}
+	log.Printf("replay finished upload_name=%q sent=%d", uploadNameFromKey(uploadKey), sent)
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReplayHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1000,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1100,"position":{"x":1,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1300,"position":{"x":2,"y":0,"z":0}}`,
+	})
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/replay?speed=2", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	ReplayHandler(rec, req)
+	elapsed := time.Since(start)
+
+	// 300ms of recording at double speed
+	if elapsed < 140*time.Millisecond {
+		t.Fatalf("replay took %v, want at least 150ms", elapsed)
+	}
+	if rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("content type = %q", rec.Header().Get("Content-Type"))
+	}
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "id: 1\ndata: {\"trackerKey\":\"headset\",\"timestamp\":1000") {
+		t.Fatalf("unexpected replay start: %q", body)
+	}
+	if strings.Count(body, "id: ") != 3 || !strings.HasSuffix(body, "event: end\ndata: {}\n\n") {
+		t.Fatalf("unexpected replay body: %q", body)
+	}
+
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/replay?speed=100", nil)
+	req.SetPathValue("key", key)
+	req.Header.Set("Last-Event-ID", "2")
+	rec = httptest.NewRecorder()
+	ReplayHandler(rec, req)
+	if body := rec.Body.String(); !strings.HasPrefix(body, "id: 3\n") || strings.Count(body, "id: ") != 1 {
+		t.Fatalf("resumed replay body: %q", body)
+	}
+}
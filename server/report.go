@@ -0,0 +1,319 @@
+package server
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The session report is one HTML file with everything inline, charts as SVG
+// and the heatmap as a data URL, so that it can be archived next to a
+// participant's other records and opened anywhere without the server.
+
+const (
+	reportChartWidth  = 720
+	reportChartHeight = 180
+	reportChartPoints = 600
+	maxReportGaps     = 200
+)
+
+// reportColors are the line colours of the trackers the VR clients send;
+// others are grey.
+var reportColors = map[string]string{
+	defaultTracker:  "#1f77b4",
+	handTrackers[0]: "#2ca02c",
+	handTrackers[1]: "#d62728",
+}
+
+type reportSeries struct {
+	Label  string
+	Color  string
+	Points string // SVG polyline points
+}
+
+type reportChart struct {
+	Title         string
+	Unit          string
+	Width, Height int
+	Min, Max      float64
+	Seconds       float64
+	Series        []reportSeries
+}
+
+type reportGap struct {
+	Tracker string
+	gapInterval
+}
+
+type reportData struct {
+	Summary      sessionSummary
+	Participant  string
+	Labels       map[string]string
+	Annotations  []annotation
+	Trackers     []string
+	Charts       []reportChart
+	Heatmap      template.URL
+	HeatmapError string
+	Gaps         []reportGap
+	MoreGaps     int
+	GeneratedAt  string
+}
+
+type chartPoint struct{ t, v float64 }
+
+// newReportChart draws series of points over the session from start, in
+// ms, lasting durationMs. Each series is thinned out to reportChartPoints.
+func newReportChart(title, unit string, start, durationMs float64, trackers []string, points map[string][]chartPoint) reportChart {
+	chart := reportChart{Title: title, Unit: unit, Width: reportChartWidth, Height: reportChartHeight, Seconds: durationMs / 1000, Min: math.Inf(1), Max: math.Inf(-1)}
+	for _, tracker := range trackers {
+		for _, p := range points[tracker] {
+			chart.Min, chart.Max = math.Min(chart.Min, p.v), math.Max(chart.Max, p.v)
+		}
+	}
+	if math.IsInf(chart.Min, 1) {
+		chart.Min, chart.Max = 0, 0
+	}
+	span := chart.Max - chart.Min
+	if span == 0 {
+		span = 1
+	}
+	for _, tracker := range trackers {
+		if len(points[tracker]) == 0 {
+			continue
+		}
+		var b []byte
+		for i, p := range downsamplePoints(points[tracker], reportChartPoints) {
+			if i > 0 {
+				b = append(b, ' ')
+			}
+			x := 0.0
+			if durationMs > 0 {
+				x = (p.t - start) / durationMs * reportChartWidth
+			}
+			y := reportChartHeight - (p.v-chart.Min)/span*reportChartHeight
+			b = strconv.AppendFloat(b, x, 'f', 1, 64)
+			b = append(b, ',')
+			b = strconv.AppendFloat(b, y, 'f', 1, 64)
+		}
+		color, ok := reportColors[tracker]
+		if !ok {
+			color = "#7f7f7f"
+		}
+		chart.Series = append(chart.Series, reportSeries{Label: tracker, Color: color, Points: string(b)})
+	}
+	return chart
+}
+
+func buildReport(uploadKey string, samples map[string][]trackerSample, summary sessionSummary, cell float64) reportData {
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if err != nil {
+		log.Printf("failed to read metadata for report: %v", err)
+	}
+	labels := sessionLabels(uploadKey, metadata.Labels)
+	report := reportData{
+		Summary:     summary,
+		Participant: labels[participantLabel],
+		Labels:      labels,
+		Annotations: readSessionAnnotations(uploadKey),
+		Trackers:    frameTrackers(samples),
+		GeneratedAt: time.Now().UTC().Format(time.RFC3339),
+	}
+	delete(report.Labels, participantLabel)
+
+	heights := map[string][]chartPoint{}
+	for _, s := range samples[defaultTracker] {
+		heights[defaultTracker] = append(heights[defaultTracker], chartPoint{s.Timestamp, s.Position.Y})
+	}
+	speeds := map[string][]chartPoint{}
+	for _, tracker := range report.Trackers {
+		_, points := computeKinematics(samples[tracker])
+		for _, p := range points {
+			speeds[tracker] = append(speeds[tracker], chartPoint{p.Timestamp, p.Speed})
+		}
+	}
+	report.Charts = []reportChart{
+		newReportChart("Headset height", "m", summary.Start, summary.DurationMs, []string{defaultTracker}, heights),
+		newReportChart("Speed", "m/s", summary.Start, summary.DurationMs, report.Trackers, speeds),
+	}
+
+	if head := samples[defaultTracker]; len(head) > 0 {
+		grid, err := computeOccupancy(head, cell)
+		var image bytes.Buffer
+		if err == nil {
+			err = png.Encode(&image, grid.render())
+		}
+		if err != nil {
+			report.HeatmapError = err.Error()
+		} else {
+			report.Heatmap = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(image.Bytes()))
+		}
+	}
+
+	for _, tracker := range report.Trackers {
+		for _, gap := range findGaps(samples[tracker], summary.GapThresholdMs) {
+			if len(report.Gaps) == maxReportGaps {
+				report.MoreGaps++
+				continue
+			}
+			report.Gaps = append(report.Gaps, reportGap{Tracker: tracker, gapInterval: gap})
+		}
+	}
+	return report
+}
+
+var reportTemplate = template.Must(template.New("report").Funcs(template.FuncMap{
+	"fixed": func(digits int, v float64) string { return strconv.FormatFloat(v, 'f', digits, 64) },
+	"seconds": func(ms float64) string {
+		return (time.Duration(ms) * time.Millisecond).Round(100 * time.Millisecond).String()
+	},
+	"percent":  func(v float64) string { return strconv.FormatFloat(100*v, 'f', 0, 64) + "%" },
+	"subtract": func(a, b float64) float64 { return a - b },
+}).Parse(reportHTML))
+
+// ReportHandler renders a self-contained HTML report of an upload: its
+// summary, charts of the headset height and the speed of every tracker, a
+// heatmap of where the headset was and the gaps in tracking. gap_ms sets
+// the gap threshold and cell the heatmap cell, as for their endpoints.
+func ReportHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	gapThresholdMs, err := parseGapThreshold(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+	cell, err := parsePositiveFloatParam(r, "cell", defaultHeatmapCell)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	summary, err := cachedSessionSummary(uploadKey, gapThresholdMs)
+	var samples map[string][]trackerSample
+	if err == nil {
+		samples, err = readTrackerSamples(uploadKey)
+	}
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for report: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	// rendered before anything is sent, so that a template error is still
+	// a proper error response
+	var page bytes.Buffer
+	if err := reportTemplate.Execute(&page, buildReport(uploadKey, samples, summary, cell)); err != nil {
+		log.Printf("failed to render report: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to render report")
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("inline; filename=%q", exportFilename(uploadKey, "html")))
+	if _, err := page.WriteTo(w); err != nil {
+		log.Printf("failed to write report: %v", err)
+	}
+}
+
+var reportHTML = strings.TrimSpace(`
+<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>Session report: {{.Summary.UploadName}}</title>
+<style>
+body { font-family: system-ui, sans-serif; margin: 2em auto; max-width: 760px; color: #222; }
+h1 { font-size: 1.5em; }
+h2 { font-size: 1.15em; margin-top: 2em; border-bottom: 1px solid #ccc; }
+table { border-collapse: collapse; }
+th, td { padding: 0.2em 0.8em 0.2em 0; text-align: left; }
+td.n { text-align: right; font-variant-numeric: tabular-nums; }
+svg { border: 1px solid #ddd; overflow: visible; }
+svg text { font-size: 11px; fill: #555; }
+.legend span { margin-right: 1em; }
+.note { color: #777; }
+</style>
+</head>
+<body>
+<h1>Session report: {{.Summary.UploadName}}</h1>
+<p class="note">Generated {{.GeneratedAt}}</p>
+
+<h2>Summary</h2>
+<table>
+{{with .Participant}}<tr><th>Participant</th><td>{{.}}</td></tr>{{end}}
+{{range $name, $value := .Labels}}<tr><th>{{$name}}</th><td>{{$value}}</td></tr>{{end}}
+<tr><th>Records</th><td class="n">{{.Summary.Records}}</td></tr>
+<tr><th>Duration</th><td class="n">{{seconds .Summary.DurationMs}}</td></tr>
+<tr><th>Head travel</th><td class="n">{{fixed 2 .Summary.HeadTravel}} m</td></tr>
+{{with .Summary.RangeOfMotion.Asymmetry}}<tr><th>Reach asymmetry</th><td class="n">{{percent .P95Reach}} <span class="note">(positive favours the left)</span></td></tr>{{end}}
+</table>
+
+<h2>Trackers</h2>
+<table>
+<tr><th>Tracker</th><th>Samples</th><th>Rate</th><th>Distance</th><th>Gaps</th><th>Longest gap</th><th>95% reach</th></tr>
+{{range .Trackers}}{{$t := index $.Summary.Trackers .}}
+<tr><td>{{.}}</td><td class="n">{{$t.Samples}}</td><td class="n">{{fixed 1 $t.SampleRateHz}} Hz</td><td class="n">{{fixed 2 $t.Distance}} m</td><td class="n">{{$t.Gaps}}</td><td class="n">{{seconds $t.LongestGapMs}}</td><td class="n">{{$reach := index $.Summary.RangeOfMotion.Reach .}}{{if $reach.P95Reach}}{{fixed 2 $reach.P95Reach}} m{{end}}</td></tr>
+{{end}}
+</table>
+
+{{range .Charts}}
+<h2>{{.Title}}</h2>
+{{if .Series}}
+<svg xmlns="http://www.w3.org/2000/svg" width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}">
+{{range .Series}}<polyline fill="none" stroke="{{.Color}}" stroke-width="1" points="{{.Points}}"/>
+{{end}}<text x="-4" y="10" text-anchor="end">{{fixed 2 .Max}}</text>
+<text x="-4" y="{{.Height}}" text-anchor="end">{{fixed 2 .Min}}</text>
+<text x="{{.Width}}" y="{{.Height}}" dy="14" text-anchor="end">{{fixed 0 .Seconds}} s</text>
+</svg>
+<p class="legend">{{range .Series}}<span style="color: {{.Color}}">&#9632; {{.Label}}</span>{{end}} in {{.Unit}}</p>
+{{else}}<p class="note">No samples.</p>{{end}}
+{{end}}
+
+<h2>Heatmap</h2>
+{{if .Heatmap}}<img src="{{.Heatmap}}" alt="Where the headset was, seen from above" style="max-width: 100%; image-rendering: pixelated">
+{{else if .HeatmapError}}<p class="note">{{.HeatmapError}}</p>
+{{else}}<p class="note">No headset samples.</p>{{end}}
+
+<h2>Gaps</h2>
+<p class="note">Gaps in tracking longer than {{seconds .Summary.GapThresholdMs}}.</p>
+{{if .Gaps}}
+<table>
+<tr><th>Tracker</th><th>From</th><th>To</th><th>Length</th></tr>
+{{range .Gaps}}<tr><td>{{.Tracker}}</td><td class="n">{{seconds (subtract .Start $.Summary.Start)}}</td><td class="n">{{seconds (subtract .End $.Summary.Start)}}</td><td class="n">{{seconds .DurationMs}}</td></tr>
+{{end}}
+</table>
+{{if .MoreGaps}}<p class="note">and {{.MoreGaps}} more.</p>{{end}}
+{{else}}<p>None.</p>{{end}}
+
+{{if .Annotations}}
+<h2>Annotations</h2>
+<table>
+<tr><th>Label</th><th>From</th><th>To</th><th>Note</th></tr>
+{{range .Annotations}}<tr><td>{{.Label}}</td><td class="n">{{seconds (subtract .Start $.Summary.Start)}}</td><td class="n">{{seconds (subtract .End $.Summary.Start)}}</td><td>{{.Note}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`)
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReportHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	var lines []string
+	for i := range 50 {
+		ts := i * 20
+		if i >= 25 {
+			ts += 2000 // a two second gap
+		}
+		lines = append(lines,
+			fmt.Sprintf(`{"trackerKey":"headset","timestamp":%d,"position":{"x":%g,"y":1.6,"z":0}}`, ts, float64(i)/50),
+			fmt.Sprintf(`{"trackerKey":"leftController","timestamp":%d,"position":{"x":-0.3,"y":1.2,"z":-0.4}}`, ts),
+			fmt.Sprintf(`{"trackerKey":"rightController","timestamp":%d,"position":{"x":0.3,"y":1.2,"z":-0.3}}`, ts),
+		)
+	}
+	simulateUpload(t, key, lines)
+	if status, _ := patchLabels(t, key, `{"participant":"P017","labels":{"study":"<script>alert(1)</script>"}}`); status != 200 {
+		t.Fatalf("patch labels status = %d", status)
+	}
+	if code := postAnnotation(t, key, `{"label":"task 1","start":100,"end":400}`); code != 201 {
+		t.Fatalf("post annotation status = %d", code)
+	}
+
+	report := func(query string) (int, string) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/report.html"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		ReportHandler(rec, req)
+		if rec.Code == 200 && rec.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("report content type = %s", rec.Header().Get("Content-Type"))
+		}
+		return rec.Code, rec.Body.String()
+	}
+
+	status, page := report("")
+	if status != 200 {
+		t.Fatalf("report status = %d body=%s", status, page)
+	}
+	for _, want := range []string{
+		"<!DOCTYPE html>",
+		uploadNameFromKey(key),
+		"P017",
+		"&lt;script&gt;",
+		"<polyline",
+		`stroke="#d62728"`,
+		"data:image/png;base64,",
+		`<tr><td>headset</td><td class="n">500ms</td><td class="n">2.5s</td><td class="n">2s</td></tr>`,
+		"task 1",
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("report is missing %q", want)
+		}
+	}
+	if strings.Contains(page, "<script>") || strings.Contains(page, key) {
+		t.Errorf("report leaks a label or the upload key")
+	}
+	// the report is self-contained
+	for _, external := range []string{"<script", "<link", "src=\"http", "href=\"http"} {
+		if strings.Contains(page, external) {
+			t.Errorf("report refers to %q", external)
+		}
+	}
+
+	if _, page := report("?gap_ms=5000"); !strings.Contains(page, "<p>None.</p>") {
+		t.Errorf("gaps shorter than gap_ms listed")
+	}
+	for _, query := range []string{"?cell=0.0001", "?cell=1e-300"} {
+		if _, page := report(query); !strings.Contains(page, "use a larger cell size") {
+			t.Errorf("report%s without a note on the heatmap cell", query)
+		}
+	}
+	for _, query := range []string{"?gap_ms=0", "?cell=x"} {
+		if status, _ := report(query); status != 400 {
+			t.Errorf("report%s status = %d, want 400", query, status)
+		}
+	}
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+newTestUploadKey(t)+"/report.html", nil)
+	req.SetPathValue("key", req.URL.Path[len("/api/uploads/"):len(req.URL.Path)-len("/report.html")])
+	rec := httptest.NewRecorder()
+	ReportHandler(rec, req)
+	if rec.Code != 404 {
+		t.Fatalf("report of a missing upload status = %d, want 404", rec.Code)
+	}
+}
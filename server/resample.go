@@ -0,0 +1,127 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+const (
+	resampleLinear = "linear"
+	resampleHold   = "hold"
+
+	// maxResamplePoints bounds the points a resampled series may have, so
+	// that a tiny interval can't keep an export going for ever
+	maxResamplePoints = 1_000_000
+)
+
+// resampleStage interpolates the samples of a tracker onto the grid
+// origin + n*step, covering their time span. With resampleHold, each grid
+// point takes the position of the latest sample at or before it. A grid
+// point is put out once the sample after it is in, or at the end.
+type resampleStage struct {
+	next         sampleStage
+	origin, step float64
+	method       string
+
+	n       float64 // of the next grid point
+	cur     trackerSample
+	started bool
+}
+
+func (r *resampleStage) push(s trackerSample) error {
+	if !r.started {
+		r.started = true
+		r.n = math.Ceil((s.Timestamp - r.origin) / r.step)
+	} else if err := r.emit(&s); err != nil {
+		return err
+	}
+	r.cur = s
+	return nil
+}
+
+func (r *resampleStage) flush() error {
+	if r.started {
+		if err := r.emit(nil); err != nil {
+			return err
+		}
+	}
+	return r.next.flush()
+}
+
+// emit puts out the grid points between the current sample and next, or
+// up to the current sample if there is no next one.
+func (r *resampleStage) emit(next *trackerSample) error {
+	cur := r.cur
+	for t := r.origin + r.n*r.step; next != nil && t < next.Timestamp || next == nil && t <= cur.Timestamp; t = r.origin + r.n*r.step {
+		r.n++
+		sample := trackerSample{
+			TrackerKey: cur.TrackerKey,
+			Timestamp:  t,
+			Position:   cur.Position,
+			Rotation:   cur.Rotation,
+		}
+		if cur.Epoch != 0 {
+			sample.Epoch = cur.Epoch + (t - cur.Timestamp)
+		}
+
+		if r.method == resampleLinear && next != nil {
+			if span := next.Timestamp - cur.Timestamp; span > 0 {
+				f := (t - cur.Timestamp) / span
+				d := next.Position.sub(cur.Position).scale(f)
+				sample.Position = vec3{cur.Position.X + d.X, cur.Position.Y + d.Y, cur.Position.Z + d.Z}
+				if cur.Rotation != nil && next.Rotation != nil {
+					rotation := cur.Rotation.nlerp(*next.Rotation, f)
+					sample.Rotation = &rotation
+				}
+			}
+		}
+
+		if err := r.next.push(sample); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resampleTracker is resampleStage on samples.
+func resampleTracker(samples []trackerSample, origin, step float64, method string) []trackerSample {
+	return collectSamples(samples, func(next sampleStage) sampleStage {
+		return &resampleStage{next: next, origin: origin, step: step, method: method}
+	})
+}
+
+// checkResamplePoints returns an error if resampling a tracker spanning span
+// every stepMs would give more than maxResamplePoints points.
+func checkResamplePoints(span trackerSpan, stepMs float64, interval string) error {
+	if points := (span.last - span.first) / stepMs; points > maxResamplePoints {
+		return fmt.Errorf("invalid resample parameter %q: would give %.0f points per tracker, limit is %d: use a larger interval", interval, points, maxResamplePoints)
+	}
+	return nil
+}
+
+// parseResample parses resample=50ms&method=linear|hold. All trackers share
+// one grid anchored at the earliest first sample of a tracker, so resampled
+// series line up across trackers.
+func parseResample(interval, method string) (trackerTransform, error) {
+	step, err := time.ParseDuration(interval)
+	if err != nil || step <= 0 {
+		return nil, fmt.Errorf("invalid resample parameter %q: must be a positive duration such as 50ms", interval)
+	}
+
+	switch method {
+	case "":
+		method = resampleLinear
+	case resampleLinear, resampleHold:
+	default:
+		return nil, fmt.Errorf("invalid method parameter %q: must be %s or %s", method, resampleLinear, resampleHold)
+	}
+
+	stepMs := float64(step) / float64(time.Millisecond)
+	return func(p samplePipeline, next sampleStage) (sampleStage, error) {
+		if err := checkResamplePoints(p.export.survey.trackers[p.tracker], stepMs, interval); err != nil {
+			return nil, err
+		}
+		return &resampleStage{next: next, origin: p.export.survey.origin, step: stepMs, method: method}, nil
+	}, nil
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+)
+
+// apiVersion is the current API version, served under /api/v1. The
+// unversioned /api paths remain as deprecated aliases for deployed clients.
+const apiVersion = "1"
+
+// apiRoute is an API endpoint, as ServeMux pattern relative to the API
+// prefix, and the role it needs by default.
+type apiRoute struct {
+	pattern string
+	role    string
+	handler http.HandlerFunc
+}
+
+// apiRoutes are the API endpoints.
+var apiRoutes = []apiRoute{
+	{"GET /version", roleDevice, VersionHandler},
+	{"GET /time", roleDevice, TimeHandler},
+	{"POST /new-upload-key", roleDevice, NewUploadKeyHandler},
+	{"POST /upload", roleDevice, limitIngest(traceUploads(UploadHandler))},
+	{"POST /heartbeat", roleDevice, HeartbeatHandler},
+	{"GET /follow", roleViewer, FollowHandler},
+	{"GET /follow/multi", roleViewer, FollowMultiHandler},
+	{"GET /uploads", roleViewer, UploadsHandler},
+	{"GET /uploads/{key}/labels", roleViewer, UploadLabelsHandler},
+	{"PATCH /uploads/{key}/labels", roleResearcher, UploadLabelsHandler},
+	{"GET /uploads/{key}/kinematics", roleViewer, KinematicsHandler},
+	{"GET /uploads/{key}/summary", roleViewer, SummaryHandler},
+	{"GET /uploads/{key}/posture", roleViewer, PostureHandler},
+	{"GET /uploads/{key}/range-of-motion", roleViewer, RangeOfMotionHandler},
+	{"GET /uploads/{key}/report.html", roleViewer, ReportHandler},
+	{"GET /uploads/{key}/gaps", roleViewer, GapsHandler},
+	{"GET /uploads/{key}/stability", roleViewer, StabilityHandler},
+	{"GET /uploads/{key}/intensity", roleViewer, IntensityHandler},
+	{"GET /uploads/{key}/hr-correlation", roleViewer, HRCorrelationHandler},
+	{"GET /uploads/{key}/export", roleResearcher, ExportHandler},
+	{"GET /uploads/{key}/trajectory", roleResearcher, TrajectoryHandler},
+	{"GET /uploads/{key}/heatmap", roleViewer, HeatmapHandler},
+	{"GET /uploads/{key}/replay", roleResearcher, ReplayHandler},
+	{"GET /uploads/{key}/tail", roleResearcher, TailHandler},
+	{"GET /uploads/{key}/status", roleViewer, StatusHandler},
+	{"POST /uploads/{key}/analyze", roleResearcher, AnalyzeHandler},
+	{"POST /uploads/{key}/validate", roleResearcher, ValidateHandler},
+	{"GET /uploads/{key}/annotations", roleViewer, AnnotationsHandler},
+	{"POST /uploads/{key}/annotations", roleResearcher, AnnotationsHandler},
+	{"POST /pair/new", roleDevice, NewPairingHandler},
+	{"POST /pair/claim", roleDevice, ClaimPairingHandler},
+	{"GET /pair/{code}/qr.png", roleDevice, PairingQRHandler},
+	{"GET /sessions/active", roleViewer, ActiveSessionsHandler},
+	{"POST /sessions/new", roleDevice, NewMultiDeviceSessionHandler},
+	{"GET /sessions/{id}/devices", roleViewer, SessionDevicesHandler},
+	{"POST /sessions/{id}/devices", roleDevice, SessionDevicesHandler},
+	{"POST /sessions/{id}/devices/{device}/clock", roleDevice, DeviceClockHandler},
+	{"GET /sessions/{id}/follow", roleViewer, SessionFollowHandler},
+	{"GET /sessions/{id}/export", roleResearcher, SessionExportHandler},
+	{"GET /compare", roleViewer, CompareHandler},
+	{"GET /analysis-plugins", roleViewer, AnalysisPluginsHandler},
+	{"POST /analysis/aggregate", roleResearcher, AggregateHandler},
+	{"POST /export/archive", roleResearcher, ArchiveHandler},
+	{"POST /import", roleAdmin, ImportHandler},
+	{"GET /admin/fsck", roleAdmin, FsckHandler},
+	{"POST /admin/fsck", roleAdmin, FsckHandler},
+	{"GET /admin/quotas", roleAdmin, QuotasHandler},
+	{"GET /admin/storage", roleAdmin, StorageHandler},
+	{"GET /admin/events", roleAdmin, AdminEventsHandler},
+	{"POST /admin/keys/{key}/revoke", roleAdmin, RevokeUploadKeyHandler},
+	{"POST /admin/erase", roleAdmin, EraseHandler},
+	{"GET /auth/login", roleDevice, LoginHandler},
+	{"GET /auth/callback", roleDevice, CallbackHandler},
+	{"POST /auth/logout", roleDevice, LogoutHandler},
+	{"GET /auth/me", roleDevice, WhoAmIHandler},
+	{"GET /grafana/{$}", roleViewer, GrafanaTestHandler},
+	{"POST /grafana/search", roleViewer, GrafanaSearchHandler},
+	{"POST /grafana/query", roleViewer, GrafanaQueryHandler},
+}
+
+// RegisterRoutes adds every API endpoint to mux, both under /api/v1 and
+// under the legacy /api prefix, each checking the role of its requests.
+func RegisterRoutes(mux *http.ServeMux) {
+	for _, route := range apiRoutes {
+		method, path, _ := strings.Cut(route.pattern, " ")
+		handler := authorize(route.pattern, route.role, route.handler)
+		mux.Handle(method+" /api/v"+apiVersion+path, versioned(handler))
+		mux.Handle(method+" /api"+path, deprecatedAlias(handler))
+	}
+}
+
+// versioned tags responses with the API version that served them. A client
+// asking for a different version through the API-Version header gets a 400
+// rather than a response in a schema it doesn't expect.
+func versioned(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requested := r.Header.Get("API-Version"); requested != "" && requested != apiVersion {
+			writeError(w, http.StatusBadRequest, errCodeUnsupportedVersion, "unsupported API-Version: this server implements version "+apiVersion)
+			return
+		}
+		w.Header().Set("API-Version", apiVersion)
+		handler.ServeHTTP(w, r)
+	})
+}
+
+// deprecatedAlias serves a legacy unversioned path, pointing clients at its
+// versioned successor (RFC 8594 style Deprecation and Link headers).
+func deprecatedAlias(handler http.Handler) http.Handler {
+	handler = versioned(handler)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		successor := "/api/v" + apiVersion + strings.TrimPrefix(r.URL.Path, "/api")
+		w.Header().Set("Deprecation", "true")
+		w.Header().Set("Link", "<"+successor+`>; rel="successor-version"`)
+		handler.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRegisterRoutes(t *testing.T) {
+	chdirTemp(t)
+	mux := http.NewServeMux()
+	RegisterRoutes(mux)
+
+	req := httptest.NewRequest("POST", "/api/v1/new-upload-key", nil)
+	rec := httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != 200 || rec.Header().Get("API-Version") != "1" || rec.Header().Get("Deprecation") != "" {
+		t.Fatalf("v1 route: status = %d, headers = %v", rec.Code, rec.Header())
+	}
+
+	key := newTestUploadKey(t)
+	req = httptest.NewRequest("GET", "/api/uploads/"+key+"/summary", nil)
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != 404 || rec.Header().Get("Deprecation") != "true" {
+		t.Fatalf("legacy route: status = %d, headers = %v", rec.Code, rec.Header())
+	}
+	if want := `</api/v1/uploads/` + key + `/summary>; rel="successor-version"`; rec.Header().Get("Link") != want {
+		t.Fatalf("Link = %q, want %q", rec.Header().Get("Link"), want)
+	}
+
+	req = httptest.NewRequest("POST", "/api/v1/new-upload-key", nil)
+	req.Header.Set("API-Version", "2")
+	rec = httptest.NewRecorder()
+	mux.ServeHTTP(rec, req)
+	if rec.Code != 400 {
+		t.Fatalf("unsupported version status = %d, want 400", rec.Code)
+	}
+}
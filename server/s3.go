@@ -0,0 +1,185 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// s3Store keeps objects in an S3 bucket, or a bucket of an S3-compatible
+// service such as MinIO, addressed path-style and signed with AWS
+// Signature Version 4. Credentials come from the usual AWS_ACCESS_KEY_ID,
+// AWS_SECRET_ACCESS_KEY and AWS_SESSION_TOKEN environment variables.
+type s3Store struct {
+	endpoint string // scheme://host, without a trailing slash
+	region   string
+	bucket   string
+	prefix   string // key prefix, empty or ending in "/"
+
+	accessKey, secretKey, sessionToken string
+
+	client *http.Client
+}
+
+// newS3Store parses s3://bucket/prefix?region=eu-central-1&endpoint=https://minio:9000.
+// The region defaults to AWS_REGION, the endpoint to AWS's for the region.
+func newS3Store(u *url.URL) (*s3Store, error) {
+	store := &s3Store{
+		bucket:       u.Host,
+		region:       u.Query().Get("region"),
+		endpoint:     strings.TrimSuffix(u.Query().Get("endpoint"), "/"),
+		accessKey:    os.Getenv("AWS_ACCESS_KEY_ID"),
+		secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		client:       &http.Client{Timeout: 5 * time.Minute},
+	}
+	if prefix := strings.Trim(u.Path, "/"); prefix != "" {
+		store.prefix = prefix + "/"
+	}
+	if store.region == "" {
+		store.region = os.Getenv("AWS_REGION")
+	}
+	switch {
+	case store.bucket == "":
+		return nil, errors.New("invalid s3 target: missing bucket")
+	case store.region == "":
+		return nil, errors.New("invalid s3 target: missing region, pass ?region= or set AWS_REGION")
+	case store.accessKey == "" || store.secretKey == "":
+		return nil, errors.New("s3 target needs AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY")
+	}
+	if store.endpoint == "" {
+		store.endpoint = "https://s3." + store.region + ".amazonaws.com"
+	}
+	if e, err := url.Parse(store.endpoint); err != nil || (e.Scheme != "http" && e.Scheme != "https") || e.Host == "" {
+		return nil, fmt.Errorf("invalid s3 endpoint %q", store.endpoint)
+	}
+	return store, nil
+}
+
+func (s *s3Store) objectURL(name string) string {
+	return s.endpoint + "/" + s.bucket + "/" + s3EscapePath(s.prefix+name)
+}
+
+func (s *s3Store) put(name string, body io.Reader, size int64) error {
+	req, err := http.NewRequest(http.MethodPut, s.objectURL(name), body)
+	if err != nil {
+		return err
+	}
+	req.ContentLength = size
+	req.Header.Set("Content-Type", "application/gzip")
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *s3Store) get(name string) (io.ReadCloser, error) {
+	req, err := http.NewRequest(http.MethodGet, s.objectURL(name), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *s3Store) remove(name string) error {
+	req, err := http.NewRequest(http.MethodDelete, s.objectURL(name), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// do signs and sends req, turning non-2xx responses into errors.
+func (s *s3Store) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now().UTC())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode/100 != 2 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", req.Method, req.URL.Path, resp.Status, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// sign adds a Signature Version 4 Authorization header to req. The payload
+// is left unsigned, which S3 allows, so that uploads can be streamed.
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalHeaders := "host:" + req.URL.Host + "\n" +
+		"x-amz-content-sha256:" + payloadHash + "\n" +
+		"x-amz-date:" + amzDate + "\n"
+	if s.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.sessionToken)
+		signedHeaders += ";x-amz-security-token"
+		canonicalHeaders += "x-amz-security-token:" + s.sessionToken + "\n"
+	}
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders,
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + s.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// s3EscapePath escapes an object key as SigV4 expects: every byte except
+// unreserved characters and '/' is percent-encoded.
+func s3EscapePath(key string) string {
+	var b strings.Builder
+	for i := 0; i < len(key); i++ {
+		c := key[i]
+		if 'a' <= c && c <= 'z' || 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
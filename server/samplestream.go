@@ -0,0 +1,299 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"iter"
+	"math"
+	"slices"
+)
+
+// Exports and trajectories stream the samples of an upload instead of
+// loading them. Each tracker's samples go through a pipeline of stages as
+// the upload is scanned: the transforms, downsample= and the annotation
+// labels, each holding only the few samples it needs at a time. Formats that
+// interleave the trackers by timestamp scan the upload once per tracker and
+// merge what the pipelines put out, so memory grows with the number of
+// trackers, not with the length of the session. A first scan, the survey,
+// learns what some transforms and formats need before the samples
+// themselves, such as where a tracker's samples begin.
+
+// maxExportTrackers bounds the trackers an export or trajectory streams,
+// as each is scanned for on its own.
+const maxExportTrackers = 64
+
+var errTooManyTrackers = fmt.Errorf("upload has more than %d trackers to export this way: export one tracker at a time with tracker=, or as ndjson or json without transforms", maxExportTrackers)
+
+// errStopScan ends a scan early without an error to report.
+var errStopScan = errors.New("scan stopped")
+
+// sampleStage is a step of a tracker's pipeline. push gets the samples in
+// order and flush follows the last one; both pass what the stage makes of
+// them on to the next stage.
+type sampleStage interface {
+	push(s trackerSample) error
+	flush() error
+}
+
+// sampleSink ends a pipeline.
+type sampleSink func(trackerSample) error
+
+func (f sampleSink) push(s trackerSample) error { return f(s) }
+func (f sampleSink) flush() error               { return nil }
+
+// mapStage passes every sample on as fn changes it.
+type mapStage struct {
+	next sampleStage
+	fn   func(trackerSample) trackerSample
+}
+
+func (m mapStage) push(s trackerSample) error { return m.next.push(m.fn(s)) }
+func (m mapStage) flush() error               { return m.next.flush() }
+
+// collectSamples runs samples through the stage start returns and gives
+// back what comes out of it.
+func collectSamples(samples []trackerSample, start func(next sampleStage) sampleStage) []trackerSample {
+	var out []trackerSample
+	stage := start(sampleSink(func(s trackerSample) error {
+		out = append(out, s)
+		return nil
+	}))
+	for _, s := range samples {
+		stage.push(s)
+	}
+	stage.flush()
+	return out
+}
+
+// trackerTransform starts a transform on the samples of the tracker of p,
+// passing what it makes of them to next. Errors are about the parameters
+// not suiting the upload, e.g. a resample interval giving too many points.
+type trackerTransform func(p samplePipeline, next sampleStage) (sampleStage, error)
+
+// samplePipeline is where in an export a transform is started.
+type samplePipeline struct {
+	export  *sampleExport
+	tracker string
+	stage   int // of the transform, in export.transforms
+}
+
+// first returns the first sample of tracker that comes out of the
+// transforms before p's, and false if none does.
+func (p samplePipeline) first(tracker string) (trackerSample, bool, error) {
+	if _, ok := p.export.survey.trackers[tracker]; !ok {
+		return trackerSample{}, false, nil
+	}
+	var first trackerSample
+	found := false
+	stage, err := p.export.pipeline(tracker, p.stage, sampleSink(func(s trackerSample) error {
+		first, found = s, true
+		return errStopScan
+	}))
+	if err != nil {
+		return trackerSample{}, false, err
+	}
+	if err := p.export.run(tracker, stage); err != nil && err != errStopScan {
+		return trackerSample{}, false, err
+	}
+	return first, found, nil
+}
+
+// trackerSpan is what the survey learns about one tracker.
+type trackerSpan struct {
+	first, last float64 // timestamps of its first and last stored sample
+}
+
+// sampleSurvey is what a first scan learns about the samples of an upload.
+type sampleSurvey struct {
+	trackers map[string]trackerSpan
+	origin   float64 // the earliest first timestamp of a tracker
+	earliest float64 // the earliest timestamp of any sample
+
+	// epochOffset maps timestamps to Unix milliseconds, as the earliest
+	// sample with an epoch has it
+	epochOffset float64
+	hasEpoch    bool
+}
+
+// surveySamples scans the samples of an upload, of tracker only if one is
+// given.
+func surveySamples(filePath, tracker string) (sampleSurvey, error) {
+	survey := sampleSurvey{trackers: map[string]trackerSpan{}, origin: math.Inf(1), earliest: math.Inf(1)}
+	epochAt := math.Inf(1)
+	err := scanUploadFile(filePath, func(index int, payload []byte) error {
+		s, ok := parseTrackerSample(index, payload)
+		if !ok || (tracker != "" && s.TrackerKey != tracker) {
+			return nil
+		}
+		span, ok := survey.trackers[s.TrackerKey]
+		if !ok {
+			if len(survey.trackers) == maxExportTrackers {
+				return errTooManyTrackers
+			}
+			span.first = s.Timestamp
+			survey.origin = math.Min(survey.origin, s.Timestamp)
+		}
+		span.last = s.Timestamp
+		survey.trackers[s.TrackerKey] = span
+		survey.earliest = math.Min(survey.earliest, s.Timestamp)
+		if s.Epoch != 0 && s.Timestamp < epochAt {
+			survey.epochOffset, survey.hasEpoch, epochAt = s.Epoch-s.Timestamp, true, s.Timestamp
+		}
+		return nil
+	})
+	if err != nil {
+		return sampleSurvey{}, err
+	}
+	if tracker != "" && len(survey.trackers) == 0 {
+		return sampleSurvey{}, fmt.Errorf("%w %q", errTrackerNotFound, tracker)
+	}
+	return survey, nil
+}
+
+// sampleExport streams the positional samples of an upload through the
+// transforms, downsample= and the annotation labels.
+type sampleExport struct {
+	filePath    string
+	survey      sampleSurvey
+	trackers    []string // by name
+	transforms  []trackerTransform
+	downsample  *downsample
+	annotations []annotation
+}
+
+// newSampleExport surveys the samples of an upload, of tracker only if one
+// is given, for exporting them. downsample may be nil.
+func newSampleExport(uploadKey, tracker string, transforms []trackerTransform, downsample *downsample) (*sampleExport, error) {
+	filePath := uploadFilePath(uploadKey)
+	survey, err := surveySamples(filePath, tracker)
+	if err != nil {
+		return nil, err
+	}
+	e := &sampleExport{
+		filePath:    filePath,
+		survey:      survey,
+		transforms:  transforms,
+		downsample:  downsample,
+		annotations: readSessionAnnotations(uploadKey),
+	}
+	for tracker := range survey.trackers {
+		e.trackers = append(e.trackers, tracker)
+	}
+	slices.Sort(e.trackers)
+	return e, nil
+}
+
+// check starts the transforms on every tracker, so that parameters that
+// don't suit the upload are reported before the export begins.
+func (e *sampleExport) check() error {
+	discard := sampleSink(func(trackerSample) error { return nil })
+	for _, tracker := range e.trackers {
+		if _, err := e.pipeline(tracker, len(e.transforms), discard); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pipeline starts the first stages transforms on the samples of tracker,
+// passing what comes out of them to next.
+func (e *sampleExport) pipeline(tracker string, stages int, next sampleStage) (sampleStage, error) {
+	stage := next
+	for i := stages - 1; i >= 0; i-- {
+		var err error
+		if stage, err = e.transforms[i](samplePipeline{e, tracker, i}, stage); err != nil {
+			return nil, err
+		}
+	}
+	return stage, nil
+}
+
+// run scans the upload for the samples of tracker and pushes them to stage.
+func (e *sampleExport) run(tracker string, stage sampleStage) error {
+	err := scanUploadFile(e.filePath, func(index int, payload []byte) error {
+		if s, ok := parseTrackerSample(index, payload); ok && s.TrackerKey == tracker {
+			return stage.push(s)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return stage.flush()
+}
+
+// each passes the exported samples of tracker to fn, in order.
+func (e *sampleExport) each(tracker string, fn func(trackerSample) error) error {
+	var last sampleStage = sampleSink(fn)
+	if len(e.annotations) > 0 {
+		last = labelStage(e.annotations, last)
+	}
+	if e.downsample != nil {
+		last = e.downsample.stage(tracker, last)
+	}
+	stage, err := e.pipeline(tracker, len(e.transforms), last)
+	if err != nil {
+		return err
+	}
+	return e.run(tracker, stage)
+}
+
+// samples is each as an iterator.
+func (e *sampleExport) samples(tracker string) iter.Seq2[trackerSample, error] {
+	return func(yield func(trackerSample, error) bool) {
+		err := e.each(tracker, func(s trackerSample) error {
+			if !yield(s, nil) {
+				return errStopScan
+			}
+			return nil
+		})
+		if err != nil && err != errStopScan {
+			yield(trackerSample{}, err)
+		}
+	}
+}
+
+// merged passes the exported samples of every tracker to fn, interleaved
+// by timestamp, then by record index and tracker. Each tracker's samples
+// keep their order.
+func (e *sampleExport) merged(fn func(trackerSample) error) error {
+	type cursor struct {
+		next   func() (trackerSample, error, bool)
+		sample trackerSample
+		ok     bool
+	}
+	cursors := make([]cursor, len(e.trackers))
+	advance := func(c *cursor) error {
+		var err error
+		c.sample, err, c.ok = c.next()
+		return err
+	}
+	for i, tracker := range e.trackers {
+		next, stop := iter.Pull2(e.samples(tracker))
+		defer stop()
+		cursors[i].next = next
+		if err := advance(&cursors[i]); err != nil {
+			return err
+		}
+	}
+
+	for {
+		var first *cursor
+		for i := range cursors {
+			c := &cursors[i]
+			if c.ok && (first == nil || c.sample.Timestamp < first.sample.Timestamp ||
+				c.sample.Timestamp == first.sample.Timestamp && c.sample.Index < first.sample.Index) {
+				first = c
+			}
+		}
+		if first == nil {
+			return nil
+		}
+		if err := fn(first.sample); err != nil {
+			return err
+		}
+		if err := advance(first); err != nil {
+			return err
+		}
+	}
+}
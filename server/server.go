@@ -2,31 +2,45 @@ package server
 
 import (
 	"bufio"
+	"bytes"
+	"cmp"
+	"context"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"maps"
 	"net/http"
 	"os"
-	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 )
 
-var uploadKeys = []string{}
-var uploadKeysMutex sync.Mutex
-
 const (
-	uploadDir             = "uploads"
 	uploadKeyHexLength    = 128
 	uploadKeyPrefixLength = 16
-	uploadNameWordCount   = 4
 )
 
+// uploadDir is the directory uploads and their side files are stored in.
+// Set by SetUploadDir.
+var uploadDir = "uploads"
+
+// SetUploadDir sets the directory uploads are stored in, "uploads" in the
+// working directory by default. It must be called before the server starts
+// handling requests.
+func SetUploadDir(dir string) {
+	uploadDir = dir
+}
+
+// uploadNameWordCount is the number of words in upload names, and
+// uploadNameWords the words they are made of. Both can be configured with
+// SetUploadNameWordCount and LoadUploadNameWords.
+var uploadNameWordCount = 4
+
 var uploadNameWords = []string{
 	"correct",
 	"battery",
@@ -106,31 +120,75 @@ func uploadNameFromKey(uploadKey string) string {
 		index := value % len(uploadNameWords)
 		words[i] = uploadNameWords[index]
 	}
+	if suffix := uploadNameSuffix(normalized); suffix > 0 {
+		words = append(words, strconv.Itoa(suffix))
+	}
 
 	return strings.Join(words, " ")
 }
 
-func saveUpload(uploadKey, userAgent string, receivedAt time.Time, lines []string) (filePath string, err error) {
-	uploadName := uploadNameFromKey(uploadKey)
+// recordBatch is lines received together, with their columns.
+type recordBatch struct {
+	Columns recordColumns
+	Lines   []string
+}
+
+// saveUpload appends lines to an upload, creating the file with its metadata
+// line first if needed. extraMetadata is added to that metadata line and is
+// ignored for existing uploads. Records are written in the format version of
+// the upload; columns are only stored by v2 uploads, and columns.ReceivedAt
+// is also the received_at of a new upload.
+func saveUpload(uploadKey, userAgent string, columns recordColumns, lines []string, extraMetadata map[string]any) (filePath string, err error) {
+	return saveUploadBatches(uploadKey, userAgent, []recordBatch{{columns, lines}}, extraMetadata)
+}
 
+// saveUploadBatches is saveUpload for several batches in one write. The
+// first batch's receive time is the received_at of a new upload.
+func saveUploadBatches(uploadKey, userAgent string, batches []recordBatch, extraMetadata map[string]any) (filePath string, err error) {
 	if err = os.MkdirAll(uploadDir, 0o755); err != nil {
 		return "", fmt.Errorf("create upload directory: %w", err)
 	}
 
-	filename := fmt.Sprintf("%s_%s.csv", uploadName, uploadKey)
-	filePath = filepath.Join(uploadDir, filename)
+	filePath = uploadFilePath(uploadKey)
+	receivedAt := batches[0].Columns.ReceivedAt
+	if err := ensureHot(filePath); err != nil {
+		return "", err
+	}
+
+	compressed, err := isCompressedUpload(filePath)
+	if err != nil {
+		return "", err
+	}
+	if compressed {
+		metadataJSON, err := newUploadMetadataLine(uploadKey, userAgent, receivedAt, extraMetadata)
+		if err != nil {
+			return "", err
+		}
+		for _, batch := range batches {
+			if err := appendCompressedBatch(filePath, metadataJSON, batch.Columns, batch.Lines); err != nil {
+				return "", err
+			}
+		}
+		return filePath, nil
+	}
 
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0o644)
+	upload, err := acquireUploadFile(filePath, true)
 	if err != nil {
 		return "", fmt.Errorf("open upload file: %w", err)
 	}
+	upload.mu.Lock()
+	file := upload.file
 
 	cleanupOnErr := false
 	defer func() {
-		if cerr := file.Close(); err == nil && cerr != nil {
-			err = cerr
+		if err != nil {
+			// what the entry knew may no longer hold
+			upload.size = -1
 		}
+		upload.mu.Unlock()
+		upload.release()
 		if err != nil && cleanupOnErr {
+			forgetUploadFile(upload)
 			if removeErr := os.Remove(filePath); removeErr != nil {
 				log.Printf("failed to remove incomplete upload file %s: %v", filePath, removeErr)
 			}
@@ -152,11 +210,15 @@ func saveUpload(uploadKey, userAgent string, receivedAt time.Time, lines []strin
 	}
 
 	existingRecords := 0
-	if !isNew {
+	version := uploadFormatVersion
+	if !isNew && upload.size == info.Size() {
+		// nothing was written since the last batch, which counted them
+		existingRecords, version = upload.records, upload.version
+	} else if !isNew {
 		scanner := bufio.NewScanner(file)
 		scanner.Buffer(make([]byte, 0, 1024), 16*1024*1024)
 		if scanner.Scan() {
-			// skip metadata line
+			version = metadataFormatVersion(scanner.Bytes())
 		}
 		for scanner.Scan() {
 			line := strings.TrimSpace(scanner.Text())
@@ -182,18 +244,15 @@ func saveUpload(uploadKey, userAgent string, receivedAt time.Time, lines []strin
 		return "", fmt.Errorf("seek upload file to end: %w", err)
 	}
 
-	writer := bufio.NewWriter(file)
+	// the checksum is extended by what is appended
+	var appended bytes.Buffer
+	writer := bufio.NewWriter(io.MultiWriter(file, &appended))
+	recordsOffset := info.Size()
 
 	if isNew {
-		metadata := map[string]any{
-			"upload_key":  uploadKey,
-			"upload_name": uploadName,
-			"user_agent":  userAgent,
-			"received_at": receivedAt.Format(time.RFC3339Nano),
-		}
-		metadataJSON, err := json.Marshal(metadata)
+		metadataJSON, err := newUploadMetadataLine(uploadKey, userAgent, receivedAt, extraMetadata)
 		if err != nil {
-			return "", fmt.Errorf("encode metadata: %w", err)
+			return "", err
 		}
 		if _, err = writer.Write(metadataJSON); err != nil {
 			return "", fmt.Errorf("write metadata: %w", err)
@@ -201,34 +260,267 @@ func saveUpload(uploadKey, userAgent string, receivedAt time.Time, lines []strin
 		if err = writer.WriteByte('\n'); err != nil {
 			return "", fmt.Errorf("write metadata newline: %w", err)
 		}
+		recordsOffset += int64(len(metadataJSON)) + 1
 	} else if needsTrailingNewline {
 		if err = writer.WriteByte('\n'); err != nil {
 			return "", fmt.Errorf("write separator newline: %w", err)
 		}
+		recordsOffset++
+	}
+
+	var records, lines []string
+	for _, batch := range batches {
+		records = append(records, formatRecordLines(version, existingRecords+len(records)+1, batch.Columns, batch.Lines)...)
+		lines = append(lines, batch.Lines...)
+	}
+	if err = writeRecordLines(writer, records); err != nil {
+		return "", err
+	}
+
+	if err = writer.Flush(); err != nil {
+		return "", fmt.Errorf("flush upload data: %w", err)
 	}
 
-	startIndex := existingRecords + 1
+	cleanupOnErr = false
+	upload.size = info.Size() + int64(appended.Len())
+	upload.records, upload.version = existingRecords+len(lines), version
+
+	index := make([]recordIndexEntry, len(lines))
 	for i, line := range lines {
-		if _, err = writer.WriteString(strconv.Itoa(startIndex + i)); err != nil {
-			return "", fmt.Errorf("write record %d index: %w", startIndex+i, err)
+		index[i] = recordIndexEntry{Offset: recordsOffset, Time: recordTime(line)}
+		recordsOffset += int64(len(records[i])) + 1
+	}
+	appendRecordIndex(filePath, existingRecords, index)
+	extendUploadChecksum(filePath, info.Size(), appended.Bytes())
+
+	return filePath, nil
+}
+
+// newUploadMetadataLine encodes the metadata line that starts a new upload.
+func newUploadMetadataLine(uploadKey, userAgent string, receivedAt time.Time, extraMetadata map[string]any) ([]byte, error) {
+	metadata := map[string]any{
+		"upload_key":     uploadKey,
+		"upload_name":    uploadNameFromKey(uploadKey),
+		"user_agent":     userAgent,
+		"received_at":    receivedAt.Format(time.RFC3339Nano),
+		"server_version": VersionString(),
+	}
+	if uploadFormatVersion != formatV1 {
+		metadata["format_version"] = uploadFormatVersion
+	}
+	for k, v := range extraMetadata {
+		metadata[k] = v
+	}
+	metadataJSON, err := json.Marshal(metadata)
+	if err != nil {
+		return nil, fmt.Errorf("encode metadata: %w", err)
+	}
+	return metadataJSON, nil
+}
+
+// writeRecordLines writes record lines made by formatRecordLines.
+func writeRecordLines(writer *bufio.Writer, records []string) error {
+	for i, record := range records {
+		if _, err := writer.WriteString(record); err != nil {
+			return fmt.Errorf("write record %d: %w", i+1, err)
 		}
-		if err = writer.WriteByte(','); err != nil {
-			return "", fmt.Errorf("write record %d separator: %w", startIndex+i, err)
+		if err := writer.WriteByte('\n'); err != nil {
+			return fmt.Errorf("write record newline %d: %w", i+1, err)
 		}
-		if _, err = writer.WriteString(line); err != nil {
-			return "", fmt.Errorf("write record %d payload: %w", startIndex+i, err)
+	}
+	return nil
+}
+
+// readRecordLines reads newline-delimited JSON records, skipping blank lines.
+// Errors describe the offending line and are meant for the client.
+func readRecordLines(body io.Reader) ([]string, error) {
+	scanner := bufio.NewScanner(body)
+
+	buf := make([]byte, 0, 1024*1024)
+	scanner.Buffer(buf, 16*1024*1024)
+
+	lines := make([]string, 0, 200) // approx. 10 per second, and save every 10 seconds (and add some buffer for uncertainty)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
 		}
-		if err = writer.WriteByte('\n'); err != nil {
-			return "", fmt.Errorf("write record newline %d: %w", startIndex+i, err)
+
+		var payload json.RawMessage
+		if err := json.Unmarshal([]byte(line), &payload); err != nil {
+			return nil, fmt.Errorf("invalid JSON on line %d: %v", len(lines)+1, err)
 		}
+
+		lines = append(lines, line)
 	}
 
-	if err = writer.Flush(); err != nil {
-		return "", fmt.Errorf("flush upload data: %w", err)
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading request body: %v", err)
 	}
 
-	cleanupOnErr = false
-	return filePath, nil
+	return lines, nil
+}
+
+// ingestOptions are the per-request settings of an ingest. Empty fields
+// use the upload's or the server's setting.
+type ingestOptions struct {
+	TimestampUnit  string
+	TimestampOrder string
+	DeviceID       string
+	KeyID          string // set for end-to-end encrypted batches
+	Tenant         string
+}
+
+// ingestResult describes what an ingest did besides storing records.
+type ingestResult struct {
+	FilePath          string
+	DuplicatesDropped int
+	Reordered         int
+	OrderViolations   []orderViolation
+	HooksDropped      int
+	Buffered          bool // acknowledged before being written, in write-behind mode
+}
+
+// ingestRecords appends validated record lines to an upload and forwards
+// them to the publisher. It is shared by every ingest path. Timestamps are
+// checked and stored in milliseconds, records repeating a recent one are
+// dropped if a dedupe window is set, the timestamp order is enforced if
+// requested, positions are quantized if the upload is stored with reduced
+// precision, and the receive time is added if the upload stores it.
+// Encrypted batches are stored as sent. Batches that don't fit the quotas
+// are refused with a *quotaError, and all batches with an
+// errInsufficientStorage error while disk space is short. errInvalidTimestamp,
+// errTimestampOutOfOrder, errEncryptionMismatch and errTenantMismatch errors
+// are the client's fault too, as are errRecordRejected errors of the ingest
+// hooks, which run after the order is enforced.
+func ingestRecords(ctx context.Context, uploadKey, userAgent string, receivedAt time.Time, lines []string, extraMetadata map[string]any, options ingestOptions) (ingestResult, error) {
+	var result ingestResult
+	extraMetadata = maps.Clone(extraMetadata)
+	if extraMetadata == nil {
+		extraMetadata = map[string]any{}
+	}
+
+	if err := checkUploadEncryption(uploadKey, options.KeyID); err != nil {
+		return result, err
+	}
+	tenant, err := uploadTenant(uploadKey, options.Tenant)
+	if err != nil {
+		return result, err
+	}
+	if tenant != "" {
+		extraMetadata["tenant"] = tenant
+	}
+	if labels := uploadLabels(uploadKey); len(labels) > 0 {
+		extraMetadata["labels"] = labels
+	}
+	columns := recordColumns{ReceivedAt: receivedAt, DeviceID: options.DeviceID}
+	if options.KeyID != "" {
+		extraMetadata["encryption"] = encryptionInfo{KeyID: options.KeyID}
+		columns.Type = recordTypeEncrypted
+		return storeRecords(uploadKey, userAgent, tenant, columns, lines, extraMetadata, result)
+	}
+
+	unit, err := uploadTimestampUnit(uploadKey, options.TimestampUnit)
+	if err != nil {
+		return result, err
+	}
+	if lines, unit, err = normalizeTimestamps(lines, unit, receivedAt); err != nil {
+		return result, err
+	}
+	extraMetadata["timestamp_unit"] = unit
+
+	var rememberRecords func()
+	if lines, result.DuplicatesDropped, rememberRecords, err = dropDuplicateRecords(uploadKey, lines); err != nil {
+		return result, err
+	}
+
+	order := cmp.Or(options.TimestampOrder, timestampOrder)
+	var trackerTimes map[string]float64
+	if lines, result.Reordered, result.OrderViolations, trackerTimes, err = enforceTimestampOrder(uploadKey, lines, order); err != nil {
+		return result, err
+	}
+
+	if lines, result.HooksDropped, err = runIngestHooks(ctx, uploadKey, columns, lines); err != nil {
+		return result, err
+	}
+	if fields := ingestScriptFields(); len(fields) > 0 {
+		extraMetadata["script_fields"] = fields
+	}
+
+	if len(lines) == 0 && result.DuplicatesDropped+len(result.OrderViolations)+result.HooksDropped > 0 {
+		// nothing left to store, e.g. a retry of records stored already
+		touchSession(uploadKey, userAgent, 0, receivedAt)
+		result.FilePath = uploadFilePath(uploadKey)
+		return result, nil
+	}
+
+	quantization, err := uploadQuantization(uploadKey)
+	if err != nil {
+		return result, err
+	}
+	if quantization != nil {
+		lines = quantizeRecordLines(lines, quantization.PositionStep)
+		extraMetadata["quantization"] = quantization
+	}
+
+	stampReceived, err := uploadRecordReceiveTime(uploadKey)
+	if err != nil {
+		return result, err
+	}
+	if stampReceived {
+		lines = stampReceiveTime(lines, receivedAt)
+		extraMetadata["record_receive_time"] = true
+	}
+
+	if result, err = storeRecords(uploadKey, userAgent, tenant, columns, lines, extraMetadata, result); err != nil {
+		return result, err
+	}
+	rememberRecords()
+	if err := commitTrackerClock(uploadKey, trackerTimes); err != nil {
+		// stored already; the clock is seeded from the file again
+		log.Printf("failed to update timestamp order of upload key_hash=%s: %v", uploadKeyHash(uploadKey), err)
+		forgetTrackerClock(uploadKey)
+	}
+	return result, nil
+}
+
+// storeRecords is the last step of ingestRecords: it checks there is disk
+// space for the prepared lines, counts them against the quotas, saves them
+// and forwards them to the publisher and the relay upstreams.
+func storeRecords(uploadKey, userAgent, tenant string, columns recordColumns, lines []string, extraMetadata map[string]any, result ingestResult) (ingestResult, error) {
+	if err := checkDiskSpace(recordBytes(lines)); err != nil {
+		return result, err
+	}
+	release, err := reserveQuota(uploadKey, tenant, lines)
+	if err != nil {
+		return result, err
+	}
+
+	uploadName := uploadNameFromKey(uploadKey)
+	for i, line := range lines {
+		log.Printf("upload record key_hash=%s upload_name=%q line=%d data=%s", uploadKeyHash(uploadKey), uploadName, i+1, line)
+	}
+
+	if writeBehindInterval > 0 {
+		// acknowledged now, written with the next flush
+		result.Buffered = true
+		if result.FilePath, err = bufferRecords(uploadKey, userAgent, columns, lines, extraMetadata, release); err != nil {
+			return result, err
+		}
+	} else if result.FilePath, err = saveUpload(uploadKey, userAgent, columns, lines, extraMetadata); err != nil {
+		release()
+		return result, err
+	}
+
+	ingestedRecords.Add(int64(len(lines)))
+	touchSession(uploadKey, userAgent, len(lines), columns.ReceivedAt)
+	publishBatch(uploadKey, columns.ReceivedAt, lines)
+	var keyID string
+	if encryption, ok := extraMetadata["encryption"].(encryptionInfo); ok {
+		keyID = encryption.KeyID
+	}
+	relayBatch(uploadKey, columns, tenant, keyID, lines)
+	return result, nil
 }
 
 func NewUploadKeyHandler(w http.ResponseWriter, r *http.Request) {
@@ -236,27 +528,43 @@ func NewUploadKeyHandler(w http.ResponseWriter, r *http.Request) {
 		panic("only POST allowed")
 	}
 
-	uploadKey, err := generateUploadKey()
+	labels, err := parseUploadLabels(r.URL.Query()["label"])
 	if err != nil {
-		log.Printf("failed to generate upload key: %v", err)
-		http.Error(w, "failed to generate upload key", http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
 		return
 	}
 
-	func() {
-		uploadKeysMutex.Lock()
-		defer uploadKeysMutex.Unlock()
-		uploadKeys = append(uploadKeys, uploadKey)
-	}()
+	uploadKey, keyInfo, err := newUniqueUploadKey()
+	if err != nil {
+		log.Printf("failed to generate upload key: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to generate upload key")
+		return
+	}
+	if len(labels) > 0 {
+		uploadKeys.setLabels(uploadKey, labels)
+		keyInfo.Labels = labels
+	}
 
 	uploadName := uploadNameFromKey(uploadKey)
-	log.Printf("generated upload key upload_name=%q upload_key=%q", uploadName, uploadKey)
+	log.Printf("generated upload key upload_name=%q key_hash=%s", uploadName, uploadKeyHash(uploadKey))
+	publishAdminEvent(adminEventKeyCreated, uploadKey, nil)
 
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]any{
-		"status":     "ok",
-		"name":       uploadName,
-		"upload_key": uploadKey,
+		"status":            "ok",
+		"name":              uploadName,
+		"upload_key":        uploadKey,
+		"name_entropy_bits": uploadNameEntropyBits(),
+	}
+	if !keyInfo.Expires.IsZero() {
+		response["expires_at"] = keyInfo.Expires.Format(time.RFC3339Nano)
+	}
+	if len(keyInfo.Labels) > 0 {
+		response["labels"] = keyInfo.Labels
+	}
+	if signedUploadsRequired {
+		response["signing_id"] = uploadSigningID(uploadKey)
+		response["signing_secret"] = uploadSigningSecret(uploadKey)
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -264,98 +572,198 @@ func NewUploadKeyHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// rejectUpload sends an error response to an upload and publishes the
+// rejection as an admin event.
+func rejectUpload(w http.ResponseWriter, uploadKey string, status int, code, message string) {
+	writeError(w, status, code, message)
+	publishAdminEvent(adminEventUploadRejected, uploadKey, map[string]any{"status": status, "code": code, "message": message})
+}
+
+// authorizeUpload runs the checks of an upload key that every ingest path
+// makes before storing records: revoked and expired keys are refused, and
+// the key must match the client certificate and client it is bound to. It
+// returns the metadata those checks store with the upload. A nil r stands for
+// records that didn't come over HTTP, such as MQTT messages; these are
+// refused while uploads must be signed, bound or come with a client
+// certificate, since none of that can be verified for them. The signature of
+// an HTTP upload is verified when its key is read, by uploadRequestKey.
+func authorizeUpload(r *http.Request, uploadKey string) (metadata map[string]any, status int, code, message string) {
+	switch err := uploadKeys.check(uploadKey, time.Now()); {
+	case errors.Is(err, errUploadKeyRevoked):
+		return nil, http.StatusForbidden, errCodeUploadKeyRevoked, err.Error()
+	case errors.Is(err, errUploadKeyExpired):
+		return nil, http.StatusForbidden, errCodeUploadKeyExpired, err.Error()
+	}
+
+	if r == nil {
+		switch {
+		case signedUploadsRequired:
+			return nil, http.StatusUnauthorized, errCodeSignatureRequired, errSignatureRequired.Error()
+		case clientCertRequired:
+			return nil, http.StatusUnauthorized, errCodeClientCertRequired, "a client certificate is required to upload"
+		case bindUploadKeys:
+			return nil, http.StatusForbidden, errCodeClientFingerprintMismatch, "upload keys are bound to the client of their first upload"
+		}
+		return map[string]any{}, 0, "", ""
+	}
+
+	metadata, status, code, message = checkClientCert(r, uploadKey)
+	if status != 0 {
+		return nil, status, code, message
+	}
+	binding, status, code, message := checkKeyBinding(r, uploadKey)
+	if status != 0 {
+		return nil, status, code, message
+	}
+	if metadata == nil {
+		metadata = map[string]any{}
+	}
+	maps.Copy(metadata, binding)
+	return metadata, 0, "", ""
+}
+
 func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		panic("only POST allowed")
 	}
 
-	uploadKey := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("upload_key")))
-	if uploadKey == "" {
-		http.Error(w, "missing upload_key query parameter", http.StatusBadRequest)
+	uploadKey, status, code, err := uploadRequestKey(w, r)
+	if err != nil {
+		rejectUpload(w, "", status, code, err.Error())
 		return
 	}
 
-	if len(uploadKey) != uploadKeyHexLength {
-		http.Error(w, fmt.Sprintf("invalid upload_key length: expected %d-character hex string", uploadKeyHexLength), http.StatusBadRequest)
+	extraMetadata, status, code, message := authorizeUpload(r, uploadKey)
+	if status != 0 {
+		rejectUpload(w, uploadKey, status, code, message)
 		return
 	}
-
-	if _, err := hex.DecodeString(uploadKey); err != nil {
-		http.Error(w, "invalid upload_key format: must be hexadecimal", http.StatusBadRequest)
-		return
+	if !dropClientIPs {
+		extraMetadata["client_ip"] = clientIP(r)
 	}
 
-	// validUploadKey := func() bool {
-	// 	uploadKeysMutex.Lock()
-	// 	defer uploadKeysMutex.Unlock()
-	// 	return slices.Contains(uploadKeys, uploadKey)
-	// }()
-	// if !validUploadKey {
-	// 	http.Error(w, "invalid upload_key value: generate another one and try again", http.StatusBadRequest)
-	// 	return
-	// }
-
 	uploadName := uploadNameFromKey(uploadKey)
 
-	userAgent := r.Header.Get("User-Agent")
+	userAgent := requestUserAgent(r)
 	receivedAt := time.Now().UTC()
 
-	scanner := bufio.NewScanner(r.Body)
 	defer r.Body.Close()
 
-	buf := make([]byte, 0, 1024*1024)
-	scanner.Buffer(buf, 16*1024*1024)
-
-	records := 0
-	lines := make([]string, 0, 200) // approx. 10 per second, and save every 10 seconds (and add some buffer for uncertainty)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	var options ingestOptions
+	if raw := r.URL.Query().Get("timestamp_unit"); raw != "" {
+		if options.TimestampUnit, err = parseTimestampUnit(raw); err != nil {
+			rejectUpload(w, uploadKey, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
 		}
-
-		lineNumber := records + 1
-
-		var payload json.RawMessage
-		if err := json.Unmarshal([]byte(line), &payload); err != nil {
-			http.Error(w, fmt.Sprintf("invalid JSON on line %d: %v", lineNumber, err), http.StatusBadRequest)
+	}
+	if raw := r.URL.Query().Get("timestamp_order"); raw != "" {
+		if options.TimestampOrder, err = parseTimestampOrder(raw); err != nil {
+			rejectUpload(w, uploadKey, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
+		}
+	}
+	if raw := r.URL.Query().Get("device_id"); raw != "" {
+		if options.DeviceID, err = parseDeviceID(raw); err != nil {
+			rejectUpload(w, uploadKey, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
 			return
 		}
+	}
 
-		lines = append(lines, line)
-		records++
-		log.Printf("upload record upload_key=%q upload_name=%q line=%d data=%s", uploadKey, uploadName, lineNumber, line)
+	if raw := r.URL.Query().Get("tenant"); raw != "" {
+		if options.Tenant, err = parseTenant(raw); err != nil {
+			rejectUpload(w, uploadKey, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
+		}
+	}
+	if options.KeyID, err = parseUploadKeyID(r); err != nil {
+		rejectUpload(w, uploadKey, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
 	}
 
-	if err := scanner.Err(); err != nil {
-		http.Error(w, fmt.Sprintf("error reading request body: %v", err), http.StatusBadRequest)
+	lines, status, code, err := readUploadBody(r)
+	if err != nil {
+		rejectUpload(w, uploadKey, status, code, err.Error())
 		return
 	}
+	records := len(lines)
 
-	filePath, err := saveUpload(uploadKey, userAgent, receivedAt, lines)
+	result, err := ingestRecords(r.Context(), uploadKey, userAgent, receivedAt, lines, extraMetadata, options)
+	if errors.Is(err, errInvalidTimestamp) {
+		rejectUpload(w, uploadKey, http.StatusBadRequest, errCodeInvalidTimestamp, err.Error())
+		return
+	}
+	if errors.Is(err, errTimestampOutOfOrder) {
+		rejectUpload(w, uploadKey, http.StatusConflict, errCodeTimestampOutOfOrder, err.Error())
+		return
+	}
+	if errors.Is(err, errEncryptionMismatch) {
+		rejectUpload(w, uploadKey, http.StatusConflict, errCodeEncryptionMismatch, err.Error())
+		return
+	}
+	if errors.Is(err, errTenantMismatch) {
+		rejectUpload(w, uploadKey, http.StatusConflict, errCodeTenantMismatch, err.Error())
+		return
+	}
+	if errors.Is(err, errRecordRejected) {
+		rejectUpload(w, uploadKey, http.StatusUnprocessableEntity, errCodeRecordRejected, err.Error())
+		return
+	}
+	if errors.Is(err, errInsufficientStorage) {
+		rejectUpload(w, uploadKey, http.StatusInsufficientStorage, errCodeInsufficientStorage, err.Error())
+		return
+	}
+	if errors.Is(err, errBufferedRecordsLost) {
+		log.Printf("refused upload after losing buffered records: %v", err)
+		rejectUpload(w, uploadKey, http.StatusInternalServerError, errCodeBufferedRecordsLost, err.Error()+"; this batch was not stored either, send it again")
+		return
+	}
+	var quotaErr *quotaError
+	if errors.As(err, &quotaErr) {
+		if quotaErr.tooLarge {
+			rejectUpload(w, uploadKey, http.StatusRequestEntityTooLarge, errCodeBatchOverQuota, err.Error())
+		} else {
+			rejectUpload(w, uploadKey, http.StatusTooManyRequests, errCodeQuotaExceeded, err.Error())
+		}
+		return
+	}
 	if err != nil {
 		log.Printf("failed to store upload: %v", err)
-		http.Error(w, "failed to store upload", http.StatusInternalServerError)
+		rejectUpload(w, uploadKey, http.StatusInternalServerError, errCodeInternal, "failed to store upload")
 		return
 	}
 
 	log.Printf(
-		"upload received upload_key=%q upload_name=%q user_agent=%q received_at=%s records=%d saved_to=%s",
-		uploadKey,
+		"upload received key_hash=%s upload_name=%q user_agent=%q received_at=%s records=%d duplicates_dropped=%d saved_to=%s",
+		uploadKeyHash(uploadKey),
 		uploadName,
 		userAgent,
 		receivedAt.Format(time.RFC3339Nano),
 		records,
-		filePath,
+		result.DuplicatesDropped,
+		redactUploadKeys(result.FilePath),
 	)
 
 	w.Header().Set("Content-Type", "application/json")
 	response := map[string]any{
-		"status":      "ok",
-		"records":     records,
-		"received_at": receivedAt.Format(time.RFC3339Nano),
-		"file_path":   filePath,
-		"upload_name": uploadName,
+		"status":             "ok",
+		"records":            records,
+		"duplicates_dropped": result.DuplicatesDropped,
+		"received_at":        receivedAt.Format(time.RFC3339Nano),
+		"file_path":          result.FilePath,
+		"upload_name":        uploadName,
+	}
+	if result.Reordered > 0 {
+		response["reordered"] = result.Reordered
+	}
+	if result.HooksDropped > 0 {
+		response["hooks_dropped"] = result.HooksDropped
+	}
+	if result.Buffered {
+		response["buffered"] = true
+	}
+	if len(result.OrderViolations) > 0 {
+		response["order_violations"] = result.OrderViolations[:min(len(result.OrderViolations), maxReportedViolations)]
+		response["out_of_order_dropped"] = len(result.OrderViolations)
 	}
 
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -363,37 +771,30 @@ func UploadHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// maxFollowLimit bounds the limit parameter of follow requests.
+const maxFollowLimit = 100000
+
+// errFollowPageFull stops a follow scan once limit new lines are collected.
+var errFollowPageFull = errors.New("follow page full")
+
 func FollowHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodGet {
 		panic("only GET allowed")
 	}
 
-	uploadKey := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("upload_key")))
-	if uploadKey == "" {
-		http.Error(w, "missing upload_key query parameter", http.StatusBadRequest)
-		return
-	}
+	defer observeFollow(time.Now())
 
-	if len(uploadKey) != uploadKeyHexLength {
-		http.Error(w, fmt.Sprintf("invalid upload_key length: expected %d-character hex string", uploadKeyHexLength), http.StatusBadRequest)
+	uploadKey, status, code, err := followUploadKey(r)
+	if err != nil {
+		writeError(w, status, code, err.Error())
 		return
 	}
 
-	if _, err := hex.DecodeString(uploadKey); err != nil {
-		http.Error(w, "invalid upload_key format: must be hexadecimal", http.StatusBadRequest)
+	if ok, retryAfter := allowFollow(uploadKey, clientIP(r), time.Now()); !ok {
+		writeFollowRateLimited(w, retryAfter)
 		return
 	}
 
-	// validUploadKey := func() bool {
-	// 	uploadKeysMutex.Lock()
-	// 	defer uploadKeysMutex.Unlock()
-	// 	return slices.Contains(uploadKeys, uploadKey)
-	// }()
-	// if !validUploadKey {
-	// 	http.Error(w, "invalid upload_key value: generate another one and try again", http.StatusBadRequest)
-	// 	return
-	// }
-
 	// Get position from query parameter (defaults to 0)
 	positionStr := r.URL.Query().Get("position")
 	lastPosition := 0
@@ -401,61 +802,103 @@ func FollowHandler(w http.ResponseWriter, r *http.Request) {
 		var err error
 		lastPosition, err = strconv.Atoi(positionStr)
 		if err != nil || lastPosition < 0 {
-			http.Error(w, "invalid position parameter: must be a non-negative integer", http.StatusBadRequest)
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, "invalid position parameter: must be a non-negative integer")
 			return
 		}
 	}
 
-	uploadName := uploadNameFromKey(uploadKey)
-	filename := fmt.Sprintf("%s_%s.csv", uploadName, uploadKey)
-	filePath := filepath.Join(uploadDir, filename)
+	// limit pages through a long backlog, so that catching up on a long
+	// session doesn't take one huge response
+	limit := 0
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit <= 0 || limit > maxFollowLimit {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("invalid limit parameter: must be between 1 and %d", maxFollowLimit))
+			return
+		}
+	}
 
-	// Check if file exists
-	if _, err := os.Stat(filePath); os.IsNotExist(err) {
-		// File doesn't exist yet, return 204 No Content with current position
-		w.Header().Set("X-Follow-Position", strconv.Itoa(lastPosition))
-		w.WriteHeader(http.StatusNoContent)
+	transform, err := parseCoordinateTransform(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	downsample, err := parseDownsample(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
 		return
 	}
 
-	// Read the file and get new lines
-	file, err := os.Open(filePath)
+	format, err := parseFollowFormat(r)
 	if err != nil {
-		log.Printf("failed to open upload file for follow: %v", err)
-		http.Error(w, "failed to read upload file", http.StatusInternalServerError)
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
 		return
 	}
-	defer file.Close()
+	w.Header().Set("Vary", "Accept")
 
-	scanner := bufio.NewScanner(file)
-	scanner.Buffer(make([]byte, 0, 1024), 16*1024*1024)
+	uploadName := uploadNameFromKey(uploadKey)
+	filePath := uploadFilePath(uploadKey)
 
-	// Skip metadata line
-	if !scanner.Scan() {
+	// Check if file exists
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		// File doesn't exist yet, return 204 No Content with current position
+		w.Header().Set("X-Follow-Position", strconv.Itoa(lastPosition))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if err == nil && followUpToDate(uploadKey, info, lastPosition) {
+		// nothing was written since a scan found no records after here
 		w.Header().Set("X-Follow-Position", strconv.Itoa(lastPosition))
 		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
-	// Read all lines and collect ones after lastPosition
-	currentLine := 0
+	// Collect the lines after lastPosition, using the record index to skip
+	// the ones already sent. A recentering transform needs to see them all.
+	after := lastPosition
+	if transform != nil {
+		after = 0
+	}
+	// With downsampling, limit counts the records read rather than sent.
+	currentLine := lastPosition
 	var newLines []string
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+	keep := func(index int, payload []byte) error {
+		newLines = append(newLines, strconv.Itoa(index)+","+string(payload))
+		return nil
+	}
+	flush := func() error { return nil }
+	if downsample != nil {
+		keep, flush = downsample.scan(keep)
+	}
+	read := 0
+	err = scanUploadFileFrom(filePath, after, func(index int, payload []byte) error {
+		if transform != nil {
+			transform.observe(strconv.Itoa(index) + "," + string(payload))
 		}
-		currentLine++
-		if currentLine > lastPosition {
-			newLines = append(newLines, line)
+		if index > lastPosition {
+			if limit > 0 && read == limit {
+				return errFollowPageFull
+			}
+			read++
+			currentLine = index
+			return keep(index, payload)
 		}
+		return nil
+	})
+	more := errors.Is(err, errFollowPageFull)
+	if more || err == nil {
+		err = flush()
 	}
-
-	if err := scanner.Err(); err != nil {
+	if err != nil {
 		log.Printf("failed to scan upload file: %v", err)
-		http.Error(w, "failed to read upload file", http.StatusInternalServerError)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
 		return
 	}
+	if info != nil && !more {
+		rememberFollowScan(uploadKey, info, currentLine)
+	}
 
 	// No new lines, return 204 No Content with current position
 	if len(newLines) == 0 {
@@ -464,12 +907,20 @@ func FollowHandler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("follow read upload_key=%q upload_name=%q last_position=%d new_lines=%d current_position=%d", uploadKey, uploadName, lastPosition, len(newLines), currentLine)
+	log.Printf("follow read key_hash=%s upload_name=%q last_position=%d new_lines=%d current_position=%d", uploadKeyHash(uploadKey), uploadName, lastPosition, len(newLines), currentLine)
 
 	// Return new lines with updated position in header
 	w.Header().Set("X-Follow-Position", strconv.Itoa(currentLine))
-	w.Header().Set("Content-Type", "text/plain")
-	for _, line := range newLines {
-		fmt.Fprintf(w, "%s\n", line)
+	if more {
+		// the client should ask again right away for the next page
+		w.Header().Set("X-Follow-More", "true")
+	}
+	if transform != nil {
+		for i, line := range newLines {
+			newLines[i] = transform.rewriteLine(line)
+		}
+	}
+	if err := writeFollowLines(w, format, newLines); err != nil {
+		log.Printf("failed to write follow response: %v", err)
 	}
 }
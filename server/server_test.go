@@ -5,8 +5,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"io"
+	"net/http"
 	"net/http/httptest"
-	"net/url"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -78,10 +78,16 @@ func TestUploadFlow(t *testing.T) {
 	assertRecords(t, lines2, combined)
 }
 
+// withUploadKey sends the upload key of req in a header, as clients do.
+func withUploadKey(req *http.Request, key string) *http.Request {
+	req.Header.Set("X-Upload-Key", key)
+	return req
+}
+
 func simulateUpload(t *testing.T, key string, entries []string) string {
 	t.Helper()
 	body := bytes.NewBufferString(strings.Join(entries, "\n"))
-	req := httptest.NewRequest("POST", "/api/upload?upload_key="+url.QueryEscape(key), body)
+	req := withUploadKey(httptest.NewRequest("POST", "/api/upload", body), key)
 	req.Header.Set("Content-Type", "application/x-ndjson")
 	req.Header.Set("User-Agent", "test-agent")
 
@@ -129,7 +135,23 @@ func readUploadFile(t *testing.T, path string) (string, map[string]any, []string
 	if err := scanner.Err(); err != nil {
 		t.Fatalf("scanner error: %v", err)
 	}
-	return metaLine, metadata, records
+	return metaLine, metadata, payloadRecordLines(t, metaLine, records)
+}
+
+// payloadRecordLines rewrites record lines of any format version as
+// "index,payload", the form assertRecords expects.
+func payloadRecordLines(t *testing.T, metaLine string, lines []string) []string {
+	t.Helper()
+	version := metadataFormatVersion([]byte(metaLine))
+	records := make([]string, len(lines))
+	for i, line := range lines {
+		record, err := parseRecordLine([]byte(line), version)
+		if err != nil {
+			t.Fatalf("record line: %v", err)
+		}
+		records[i] = strconv.Itoa(record.Index) + "," + string(record.Payload)
+	}
+	return records
 }
 
 func assertRecords(t *testing.T, lines []string, expected []string) {
@@ -183,7 +205,7 @@ func TestFollowHandler(t *testing.T) {
 	}
 
 	// Test 1: Follow on non-existent file should return 204 with position 0
-	followReq := httptest.NewRequest("GET", "/api/follow?upload_key="+keyPayload.UploadKey, nil)
+	followReq := withUploadKey(httptest.NewRequest("GET", "/api/follow", nil), keyPayload.UploadKey)
 	followRec := httptest.NewRecorder()
 	FollowHandler(followRec, followReq)
 	if followRec.Code != 204 {
@@ -202,7 +224,7 @@ func TestFollowHandler(t *testing.T) {
 	simulateUpload(t, keyPayload.UploadKey, firstEntries)
 
 	// Test 2: First follow should return all lines and position 2
-	followReq = httptest.NewRequest("GET", "/api/follow?upload_key="+keyPayload.UploadKey, nil)
+	followReq = withUploadKey(httptest.NewRequest("GET", "/api/follow", nil), keyPayload.UploadKey)
 	followRec = httptest.NewRecorder()
 	FollowHandler(followRec, followReq)
 	if followRec.Code != 200 {
@@ -232,7 +254,7 @@ func TestFollowHandler(t *testing.T) {
 	}
 
 	// Test 3: Second follow with position 2 and no new data should return 204
-	followReq = httptest.NewRequest("GET", "/api/follow?upload_key="+keyPayload.UploadKey+"&position="+position, nil)
+	followReq = withUploadKey(httptest.NewRequest("GET", "/api/follow?position="+position, nil), keyPayload.UploadKey)
 	followRec = httptest.NewRecorder()
 	FollowHandler(followRec, followReq)
 	if followRec.Code != 204 {
@@ -251,7 +273,7 @@ func TestFollowHandler(t *testing.T) {
 	simulateUpload(t, keyPayload.UploadKey, secondEntries)
 
 	// Test 4: Third follow with position 2 should return only new lines (3 and 4)
-	followReq = httptest.NewRequest("GET", "/api/follow?upload_key="+keyPayload.UploadKey+"&position="+position, nil)
+	followReq = withUploadKey(httptest.NewRequest("GET", "/api/follow?position="+position, nil), keyPayload.UploadKey)
 	followRec = httptest.NewRecorder()
 	FollowHandler(followRec, followReq)
 	if followRec.Code != 200 {
@@ -276,7 +298,7 @@ func TestFollowHandler(t *testing.T) {
 	}
 
 	// Test 5: Fourth follow with position 4 should return 204 again
-	followReq = httptest.NewRequest("GET", "/api/follow?upload_key="+keyPayload.UploadKey+"&position="+position, nil)
+	followReq = withUploadKey(httptest.NewRequest("GET", "/api/follow?position="+position, nil), keyPayload.UploadKey)
 	followRec = httptest.NewRecorder()
 	FollowHandler(followRec, followReq)
 	if followRec.Code != 204 {
@@ -287,3 +309,62 @@ func TestFollowHandler(t *testing.T) {
 		t.Fatalf("final follow with no new data: want position 4, got %s", newPosition)
 	}
 }
+
+func TestFollowLimit(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"n":1}`, `{"n":2}`, `{"n":3}`, `{"n":4}`, `{"n":5}`})
+
+	// pages of two, with the position advancing per page
+	position := "0"
+	var pages []string
+	for {
+		rec := httptest.NewRecorder()
+		FollowHandler(rec, withUploadKey(httptest.NewRequest("GET", "/api/follow?limit=2&position="+position, nil), key))
+		if rec.Code != 200 {
+			t.Fatalf("follow at %s: status %d", position, rec.Code)
+		}
+		pages = append(pages, rec.Body.String())
+		position = rec.Header().Get("X-Follow-Position")
+		if rec.Header().Get("X-Follow-More") != "true" {
+			break
+		}
+	}
+	want := []string{"1,{\"n\":1}\n2,{\"n\":2}\n", "3,{\"n\":3}\n4,{\"n\":4}\n", "5,{\"n\":5}\n"}
+	if strings.Join(pages, "|") != strings.Join(want, "|") || position != "5" {
+		t.Fatalf("pages = %q ending at %s", pages, position)
+	}
+
+	for _, limit := range []string{"0", "-1", "x", "100001"} {
+		rec := httptest.NewRecorder()
+		FollowHandler(rec, withUploadKey(httptest.NewRequest("GET", "/api/follow?limit="+limit, nil), key))
+		if rec.Code != 400 {
+			t.Errorf("follow with limit %s: status %d", limit, rec.Code)
+		}
+	}
+}
+
+// chdirTemp switches into a fresh temporary directory for the duration of
+// the test, so uploads are written under it.
+func chdirTemp(t *testing.T) string {
+	t.Helper()
+	tempDir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatalf("getwd: %v", err)
+	}
+	if err := os.Chdir(tempDir); err != nil {
+		t.Fatalf("chdir temp: %v", err)
+	}
+	t.Cleanup(func() { _ = os.Chdir(wd) })
+	return tempDir
+}
+
+func newTestUploadKey(t *testing.T) string {
+	t.Helper()
+	key, err := generateUploadKey()
+	if err != nil {
+		t.Fatalf("generate upload key: %v", err)
+	}
+	return key
+}
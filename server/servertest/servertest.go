@@ -0,0 +1,148 @@
+// Package servertest runs the server's API on a local port for integration
+// tests, storing uploads in a temporary directory.
+//
+// The server is configured through package-level settings, which every
+// Server shares. Tests using New must not run in parallel with each other
+// or with tests that change those settings.
+package servertest
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/VR-state-analysis/HR-Demo-App/server"
+)
+
+// Server is a running API server.
+type Server struct {
+	*httptest.Server
+
+	// UploadDir is where the server stores uploads.
+	UploadDir string
+}
+
+// New starts a server with every API endpoint, storing uploads under a
+// temporary directory of t. The server is closed and the upload directory
+// set back to the default when the test ends.
+func New(t testing.TB) *Server {
+	t.Helper()
+	dir := filepath.Join(t.TempDir(), "uploads")
+	server.SetUploadDir(dir)
+
+	mux := http.NewServeMux()
+	server.RegisterRoutes(mux)
+	s := &Server{Server: httptest.NewServer(server.RequestLogger(mux)), UploadDir: dir}
+	t.Cleanup(func() {
+		s.Close()
+		server.SetUploadDir("uploads")
+	})
+	return s
+}
+
+// API returns the URL of an API endpoint, given relative to /api/v1, e.g.
+// "/follow?position=0".
+func (s *Server) API(path string) string {
+	return s.URL + "/api/v1" + path
+}
+
+// Do sends a request to an API endpoint and decodes its JSON response into
+// response, which may be nil. It fails the test unless the server answers
+// with status want.
+func (s *Server) Do(t testing.TB, method, path, contentType string, body io.Reader, want int, response any) {
+	t.Helper()
+	req, err := http.NewRequest(method, s.API(path), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	s.do(t, req, want, response)
+}
+
+// do sends a request and checks and decodes its response like Do.
+func (s *Server) do(t testing.TB, req *http.Request, want int, response any) {
+	t.Helper()
+	method, path := req.Method, req.URL.Path
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("%s %s: %v", method, path, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("%s %s: read response: %v", method, path, err)
+	}
+	if resp.StatusCode != want {
+		t.Fatalf("%s %s: status %d, want %d: %s", method, path, resp.StatusCode, want, data)
+	}
+	if response != nil {
+		if err := json.Unmarshal(data, response); err != nil {
+			t.Fatalf("%s %s: decode response: %v: %s", method, path, err, data)
+		}
+	}
+}
+
+// NewUploadKey creates an upload key and returns it with the upload's name.
+func (s *Server) NewUploadKey(t testing.TB) (key, name string) {
+	t.Helper()
+	var response struct {
+		UploadKey string `json:"upload_key"`
+		Name      string `json:"name"`
+	}
+	s.Do(t, http.MethodPost, "/new-upload-key", "", nil, http.StatusOK, &response)
+	return response.UploadKey, response.Name
+}
+
+// Upload stores records, given as JSON lines, under an upload key and
+// returns how many were stored.
+func (s *Server) Upload(t testing.TB, key string, records ...string) int {
+	t.Helper()
+	var response struct {
+		Records int `json:"records"`
+	}
+	body := strings.NewReader(strings.Join(records, "\n") + "\n")
+	req, err := http.NewRequest(http.MethodPost, s.API("/upload"), body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("X-Upload-Key", key)
+	s.do(t, req, http.StatusOK, &response)
+	return response.Records
+}
+
+// Follow returns the record lines ("index,json") stored under an upload
+// key after position, and the position to follow on from.
+func (s *Server) Follow(t testing.TB, key string, position int) ([]string, int) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, s.API(fmt.Sprintf("/follow?position=%d", position)), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("X-Upload-Key", key)
+	resp, err := s.Client().Do(req)
+	if err != nil {
+		t.Fatalf("follow: %v", err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil, position
+	case http.StatusOK:
+	default:
+		t.Fatalf("follow: status %d: %s", resp.StatusCode, data)
+	}
+	var next int
+	if _, err := fmt.Sscan(resp.Header.Get("X-Follow-Position"), &next); err != nil {
+		t.Fatalf("follow: bad X-Follow-Position %q", resp.Header.Get("X-Follow-Position"))
+	}
+	return strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"), next
+}
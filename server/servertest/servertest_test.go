@@ -0,0 +1,48 @@
+package servertest_test
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/VR-state-analysis/HR-Demo-App/server/servertest"
+)
+
+func TestServer(t *testing.T) {
+	wd, _ := os.Getwd()
+	s := servertest.New(t)
+
+	key, name := s.NewUploadKey(t)
+	if key == "" || name == "" {
+		t.Fatalf("new upload key = %q, %q", key, name)
+	}
+	if n := s.Upload(t, key, `{"bpm":70}`, `{"bpm":71}`); n != 2 {
+		t.Fatalf("stored %d records, want 2", n)
+	}
+
+	lines, position := s.Follow(t, key, 0)
+	if len(lines) != 2 || lines[1] != `2,{"bpm":71}` || position != 2 {
+		t.Fatalf("follow = %q, %d", lines, position)
+	}
+	if lines, next := s.Follow(t, key, position); lines != nil || next != position {
+		t.Fatalf("follow at the end = %q, %d", lines, next)
+	}
+
+	var status struct{ Records int }
+	s.Do(t, http.MethodGet, "/uploads/"+key+"/status", "", nil, http.StatusOK, &status)
+	if status.Records != 2 {
+		t.Fatalf("status records = %d", status.Records)
+	}
+
+	// uploads go to the temporary directory, not the working directory
+	if matches, _ := filepath.Glob(filepath.Join(s.UploadDir, "*_"+key+".csv")); len(matches) != 1 {
+		t.Fatalf("upload files in %s: %v", s.UploadDir, matches)
+	}
+	if now, _ := os.Getwd(); now != wd {
+		t.Fatalf("working directory changed to %s", now)
+	}
+	if _, err := os.Stat("uploads"); !os.IsNotExist(err) {
+		t.Fatalf("uploads created in the working directory: %v", err)
+	}
+}
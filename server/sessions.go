@@ -0,0 +1,150 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sessionIdleTimeout is how long a session may go without uploads before it
+// is considered ended and dropped from the active-session registry.
+const sessionIdleTimeout = 2 * time.Minute
+
+// activeSession is a session that uploaded recently. The upload key is kept
+// out of the JSON since it grants write access; key_hash matches the request
+// logs.
+type activeSession struct {
+	uploadKey        string
+	UploadName       string    `json:"upload_name"`
+	KeyHash          string    `json:"key_hash"`
+	UserAgent        string    `json:"user_agent"`
+	StartedAt        time.Time `json:"started_at"`
+	LastSeen         time.Time `json:"last_seen"`
+	Records          int       `json:"records"`
+	RecordsPerSecond float64   `json:"records_per_second"`
+
+	// last status reported by a heartbeat, if any
+	Device           *deviceStatus `json:"device,omitempty"`
+	DeviceReportedAt time.Time     `json:"device_reported_at,omitzero"`
+}
+
+var (
+	activeSessions      = map[string]*activeSession{}
+	activeSessionsMutex sync.Mutex
+)
+
+// sessions that went quiet are ended in the background
+func init() {
+	registerJob("session_reaper", sessionIdleTimeout/4, 0, func(context.Context) error {
+		reapIdleSessions(time.Now())
+		return nil
+	})
+}
+
+// touchSession records that an upload received records, or a heartbeat with
+// none, at now, registering it as active if it wasn't.
+func touchSession(uploadKey, userAgent string, records int, now time.Time) {
+	activeSessionsMutex.Lock()
+	defer activeSessionsMutex.Unlock()
+
+	session, ok := activeSessions[uploadKey]
+	if !ok {
+		session = &activeSession{
+			uploadKey:  uploadKey,
+			UploadName: uploadNameFromKey(uploadKey),
+			KeyHash:    uploadKeyHash(uploadKey),
+			StartedAt:  now,
+		}
+		activeSessions[uploadKey] = session
+		log.Printf("session started upload_name=%q key_hash=%s user_agent=%q", session.UploadName, session.KeyHash, userAgent)
+		publishAdminEvent(adminEventSessionStarted, uploadKey, map[string]any{"user_agent": userAgent})
+	}
+	if userAgent != "" {
+		session.UserAgent = userAgent
+	}
+	session.LastSeen = now
+	session.Records += records
+	if elapsed := now.Sub(session.StartedAt).Seconds(); elapsed > 0 {
+		session.RecordsPerSecond = float64(session.Records) / elapsed
+	}
+}
+
+// setSessionDevice stores the device status reported for an active session.
+func setSessionDevice(uploadKey string, device deviceStatus, now time.Time) {
+	activeSessionsMutex.Lock()
+	defer activeSessionsMutex.Unlock()
+
+	if session, ok := activeSessions[uploadKey]; ok {
+		session.Device = &device
+		session.DeviceReportedAt = now
+	}
+}
+
+// sessionActive reports whether an upload received records recently.
+func sessionActive(uploadKey string) bool {
+	activeSessionsMutex.Lock()
+	defer activeSessionsMutex.Unlock()
+	session, ok := activeSessions[uploadKey]
+	return ok && time.Since(session.LastSeen) <= sessionIdleTimeout
+}
+
+// reapIdleSessions drops the sessions that have been quiet for longer than
+// sessionIdleTimeout at now and reports them as ended.
+func reapIdleSessions(now time.Time) {
+	activeSessionsMutex.Lock()
+	var ended []activeSession
+	for key, session := range activeSessions {
+		if now.Sub(session.LastSeen) > sessionIdleTimeout {
+			ended = append(ended, *session)
+			delete(activeSessions, key)
+		}
+	}
+	activeSessionsMutex.Unlock()
+
+	for _, session := range ended {
+		sessionEnded(session)
+	}
+}
+
+// sessionEnded is called for every session that went quiet.
+func sessionEnded(session activeSession) {
+	forgetDedupeWindow(session.uploadKey)
+	forgetTrackerClock(session.uploadKey)
+	log.Printf("session ended upload_name=%q key_hash=%s records=%d duration=%s", session.UploadName, session.KeyHash, session.Records, session.LastSeen.Sub(session.StartedAt))
+	publishAdminEvent(adminEventSessionEnded, session.uploadKey, map[string]any{"records": session.Records, "duration_seconds": session.LastSeen.Sub(session.StartedAt).Seconds()})
+}
+
+// ActiveSessionsHandler lists the sessions that uploaded recently, most
+// recently seen first.
+func ActiveSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	activeSessionsMutex.Lock()
+	sessions := make([]activeSession, 0, len(activeSessions))
+	for _, session := range activeSessions {
+		if time.Since(session.LastSeen) <= sessionIdleTimeout {
+			sessions = append(sessions, *session)
+		}
+	}
+	activeSessionsMutex.Unlock()
+
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastSeen.After(sessions[j].LastSeen)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":   "ok",
+		"sessions": sessions,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write active sessions response: %v", err)
+	}
+}
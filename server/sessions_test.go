@@ -0,0 +1,69 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func getActiveSessions(t *testing.T) []map[string]any {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	ActiveSessionsHandler(rec, httptest.NewRequest("GET", "/api/sessions/active", nil))
+	var response struct {
+		Sessions []map[string]any `json:"sessions"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatalf("decode active sessions: %v", err)
+	}
+	return response.Sessions
+}
+
+func TestActiveSessions(t *testing.T) {
+	chdirTemp(t)
+	resetActiveSessions := func() {
+		activeSessionsMutex.Lock()
+		clear(activeSessions)
+		activeSessionsMutex.Unlock()
+	}
+	resetActiveSessions()
+	t.Cleanup(resetActiveSessions)
+
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"heartRate":70}`, `{"heartRate":71}`})
+	simulateUpload(t, key, []string{`{"heartRate":72}`})
+
+	sessions := getActiveSessions(t)
+	if len(sessions) != 1 {
+		t.Fatalf("active sessions = %v", sessions)
+	}
+	session := sessions[0]
+	if session["upload_name"] != uploadNameFromKey(key) || session["key_hash"] != uploadKeyHash(key) ||
+		session["records"] != 3.0 || session["user_agent"] != "test-agent" {
+		t.Fatalf("active session = %v", session)
+	}
+	if _, ok := session["upload_key"]; ok {
+		t.Fatal("active session exposes the upload key")
+	}
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	reapIdleSessions(time.Now())
+	if len(getActiveSessions(t)) != 1 {
+		t.Fatal("recent session reaped")
+	}
+	reapIdleSessions(time.Now().Add(sessionIdleTimeout + time.Second))
+	if sessions := getActiveSessions(t); len(sessions) != 0 {
+		t.Fatalf("idle session still active: %v", sessions)
+	}
+	if !strings.Contains(logs.String(), "session ended upload_name=") || !strings.Contains(logs.String(), "records=3") {
+		t.Fatalf("no session ended event logged: %q", logs.String())
+	}
+}
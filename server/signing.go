@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Signed uploads keep the upload key off the wire. With the key, a client
+// is given a signing id and secret, both derived from the key; it sends
+// the id in X-Upload-Id, the Unix time in X-Timestamp and in X-Signature
+// the hex HMAC-SHA256, keyed with the secret, of the timestamp, a newline
+// and the body. The server refuses requests whose timestamp is more than
+// signatureMaxSkew away, whose signature doesn't match, or that repeat a
+// signature it has accepted before.
+
+const (
+	// signatureMaxSkew is how far the timestamp of a signed upload may be
+	// from the server's clock.
+	signatureMaxSkew = 5 * time.Minute
+	// maxSignedUploadBytes is the largest body of a signed upload, which is
+	// read into memory to verify it.
+	maxSignedUploadBytes = 64 << 20
+)
+
+var (
+	errSignatureRequired = errors.New("uploads must be signed: send X-Upload-Id, X-Timestamp and X-Signature instead of the upload key")
+	errSignatureInvalid  = errors.New("invalid upload signature")
+	errSignatureStale    = errors.New("upload signature timestamp is too far from the server time: check the client clock")
+	errSignatureReplayed = errors.New("upload signature was used before")
+)
+
+// signedUploadsRequired makes uploads with a plain upload_key fail. Set by
+// SetSignedUploads.
+var signedUploadsRequired bool
+
+var (
+	// seenSignatures holds the accepted signatures until they expire, and
+	// seenSignatureQueue the same in the order they were accepted, which,
+	// since they all last as long, is the order they expire in.
+	seenSignatures      = map[string]time.Time{}
+	seenSignatureQueue  []string
+	seenSignaturesMutex sync.Mutex
+
+	uploadsRejectedSignature = expvar.NewInt("uploads_rejected_signature")
+)
+
+// SetSignedUploads makes new upload keys come with a signing secret and
+// requires uploads to be signed with it.
+func SetSignedUploads(required bool) {
+	signedUploadsRequired = required
+}
+
+// uploadSigningID is the public id signed uploads name their upload by.
+func uploadSigningID(uploadKey string) string {
+	sum := sha256.Sum256([]byte("upload signing id\n" + uploadKey))
+	return hex.EncodeToString(sum[:16])
+}
+
+// uploadSigningSecret is the HMAC key signed uploads are signed with.
+func uploadSigningSecret(uploadKey string) string {
+	mac := hmac.New(sha256.New, []byte(uploadKey))
+	mac.Write([]byte("upload signing secret"))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// resolveSigningID returns the upload key a signing id was derived from,
+// which the key store knows for the keys it handed out and the stored
+// uploads.
+func resolveSigningID(id string) (string, error) {
+	if uploadKey, ok := uploadKeys.resolveSigningID(id); ok {
+		return uploadKey, nil
+	}
+	return "", errUploadNotFound
+}
+
+// uploadSignature signs a body sent at timestamp.
+func uploadSignature(secret, timestamp string, body []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp + "\n"))
+	mac.Write(body)
+	return mac.Sum(nil)
+}
+
+// verifySignedUpload checks the signature of an upload and returns its key.
+// It reads the body and replaces it with a copy for the handler.
+func verifySignedUpload(w http.ResponseWriter, r *http.Request, now time.Time) (string, error) {
+	timestamp := r.Header.Get("X-Timestamp")
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return "", fmt.Errorf("%w: X-Timestamp must be Unix seconds", errSignatureInvalid)
+	}
+	if skew := now.Sub(time.Unix(seconds, 0)); skew > signatureMaxSkew || skew < -signatureMaxSkew {
+		return "", errSignatureStale
+	}
+	signature, err := hex.DecodeString(r.Header.Get("X-Signature"))
+	if err != nil || len(signature) != sha256.Size {
+		return "", fmt.Errorf("%w: X-Signature must be a hex HMAC-SHA256", errSignatureInvalid)
+	}
+
+	uploadKey, err := resolveSigningID(r.Header.Get("X-Upload-Id"))
+	if errors.Is(err, errUploadNotFound) {
+		return "", fmt.Errorf("%w: unknown X-Upload-Id", errSignatureInvalid)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxSignedUploadBytes))
+	if err != nil {
+		return "", fmt.Errorf("%w: failed to read body: %v", errSignatureInvalid, err)
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	if !hmac.Equal(signature, uploadSignature(uploadSigningSecret(uploadKey), timestamp, body)) {
+		return "", errSignatureInvalid
+	}
+	if !rememberSignature(hex.EncodeToString(signature), now) {
+		return "", errSignatureReplayed
+	}
+	return uploadKey, nil
+}
+
+// rememberSignature records an accepted signature, returning false if it
+// was accepted before. Signatures are forgotten once their timestamp would
+// be refused anyway.
+func rememberSignature(signature string, now time.Time) bool {
+	seenSignaturesMutex.Lock()
+	defer seenSignaturesMutex.Unlock()
+	for len(seenSignatureQueue) > 0 && now.After(seenSignatures[seenSignatureQueue[0]]) {
+		delete(seenSignatures, seenSignatureQueue[0])
+		seenSignatureQueue = seenSignatureQueue[1:]
+	}
+	if _, ok := seenSignatures[signature]; ok {
+		return false
+	}
+	seenSignatures[signature] = now.Add(2 * signatureMaxSkew)
+	seenSignatureQueue = append(seenSignatureQueue, signature)
+	return true
+}
+
+// uploadRequestKey returns the upload key of an upload request, from its
+// signature or as requestUploadKey finds it. On failure it also returns the
+// status and error code to respond with.
+func uploadRequestKey(w http.ResponseWriter, r *http.Request) (string, int, string, error) {
+	if r.Header.Get("X-Signature") == "" {
+		if signedUploadsRequired {
+			uploadsRejectedSignature.Add(1)
+			return "", http.StatusUnauthorized, errCodeSignatureRequired, errSignatureRequired
+		}
+		return requestUploadKey(r)
+	}
+
+	uploadKey, err := verifySignedUpload(w, r, time.Now())
+	switch {
+	case errors.Is(err, errSignatureStale):
+		uploadsRejectedSignature.Add(1)
+		return "", http.StatusUnauthorized, errCodeSignatureExpired, err
+	case errors.Is(err, errSignatureInvalid), errors.Is(err, errSignatureReplayed):
+		uploadsRejectedSignature.Add(1)
+		return "", http.StatusUnauthorized, errCodeSignatureInvalid, err
+	case err != nil:
+		log.Printf("failed to verify upload signature: %v", err)
+		return "", http.StatusInternalServerError, errCodeInternal, errors.New("failed to verify upload signature")
+	}
+	return uploadKey, 0, "", nil
+}
@@ -0,0 +1,111 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignedUploads(t *testing.T) {
+	chdirTemp(t)
+	SetSignedUploads(true)
+	t.Cleanup(func() { SetSignedUploads(false) })
+
+	rec := httptest.NewRecorder()
+	NewUploadKeyHandler(rec, httptest.NewRequest("POST", "/api/new-upload-key", nil))
+	var created struct {
+		UploadKey     string `json:"upload_key"`
+		SigningID     string `json:"signing_id"`
+		SigningSecret string `json:"signing_secret"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&created); err != nil {
+		t.Fatal(err)
+	}
+	if created.SigningID == "" || created.SigningSecret == "" {
+		t.Fatalf("new upload key response has no signing id or secret: %+v", created)
+	}
+
+	upload := func(id string, timestamp int64, body, signedBody string) *httptest.ResponseRecorder {
+		t.Helper()
+		ts := strconv.FormatInt(timestamp, 10)
+		req := httptest.NewRequest("POST", "/api/upload", strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("X-Upload-Id", id)
+		req.Header.Set("X-Timestamp", ts)
+		req.Header.Set("X-Signature", hex.EncodeToString(uploadSignature(created.SigningSecret, ts, []byte(signedBody))))
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+		return rec
+	}
+
+	now := time.Now().Unix()
+	body := `{"bpm":70}` + "\n"
+	if rec := upload(created.SigningID, now, body, body); rec.Code != 200 {
+		t.Fatalf("signed upload status = %d: %s", rec.Code, rec.Body.String())
+	}
+	if _, _, lines := readUploadFile(t, uploadFilePath(created.UploadKey)); len(lines) != 1 {
+		t.Fatalf("stored %d records, want 1", len(lines))
+	}
+
+	for _, tc := range []struct {
+		name       string
+		id         string
+		timestamp  int64
+		signedBody string
+		code       string
+	}{
+		{"replayed", created.SigningID, now, body, errCodeSignatureInvalid},
+		{"tampered", created.SigningID, now + 1, `{"bpm":180}` + "\n", errCodeSignatureInvalid},
+		{"unknown id", strings.Repeat("0", 32), now + 2, body, errCodeSignatureInvalid},
+		{"stale", created.SigningID, now - 600, body, errCodeSignatureExpired},
+	} {
+		rec := upload(tc.id, tc.timestamp, body, tc.signedBody)
+		if rec.Code != 401 || !strings.Contains(rec.Body.String(), tc.code) {
+			t.Errorf("%s upload status = %d: %s", tc.name, rec.Code, rec.Body.String())
+		}
+	}
+
+	req := withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader(body)), created.UploadKey)
+	rec = httptest.NewRecorder()
+	UploadHandler(rec, req)
+	if rec.Code != 401 || !strings.Contains(rec.Body.String(), errCodeSignatureRequired) {
+		t.Fatalf("unsigned upload status = %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// keys from before a restart are found among the stored uploads
+	uploadKeys = newUploadKeyStore()
+	if err := LoadUploadKeyState(); err != nil {
+		t.Fatal(err)
+	}
+	if rec := upload(created.SigningID, now+3, body, body); rec.Code != 200 {
+		t.Fatalf("signed upload after restart status = %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRememberSignatureExpiry(t *testing.T) {
+	seenSignaturesMutex.Lock()
+	saved, savedQueue := seenSignatures, seenSignatureQueue
+	seenSignatures, seenSignatureQueue = map[string]time.Time{}, nil
+	seenSignaturesMutex.Unlock()
+	t.Cleanup(func() { seenSignatures, seenSignatureQueue = saved, savedQueue })
+
+	start := time.Unix(1700000000, 0)
+	for i := range 100 {
+		if !rememberSignature(strconv.Itoa(i), start.Add(time.Duration(i)*time.Second)) {
+			t.Fatalf("signature %d refused", i)
+		}
+	}
+	if rememberSignature("5", start.Add(2*signatureMaxSkew)) {
+		t.Fatal("signature accepted twice before it expired")
+	}
+	// the first half expired, and went without looking at the rest; "5" is
+	// accepted again
+	later := start.Add(2*signatureMaxSkew + 50*time.Second)
+	if !rememberSignature("5", later) || len(seenSignatures) != 51 || len(seenSignatureQueue) != 51 {
+		t.Fatalf("after expiry %d signatures are kept, %d queued", len(seenSignatures), len(seenSignatureQueue))
+	}
+}
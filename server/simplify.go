@@ -0,0 +1,109 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+)
+
+// Drawing a session only needs the samples that change the shape of its
+// path. simplify= runs Ramer-Douglas-Peucker on each tracker in 3D: samples
+// closer than the tolerance, in metres, to the line between the samples
+// kept around them are dropped, so the simplified path never strays further
+// than that from the recorded one. A long path is simplified a chunk of
+// simplifyChunk samples at a time, each beginning where the last ended, so
+// it may keep a few more samples than simplifying it at once would.
+
+const simplifyChunk = 10000
+
+// segmentDistance returns the distance from p to the segment from a to b.
+func segmentDistance(p, a, b vec3) float64 {
+	ab, ap := b.sub(a), p.sub(a)
+	lengthSquared := ab.X*ab.X + ab.Y*ab.Y + ab.Z*ab.Z
+	if lengthSquared == 0 {
+		return ap.length()
+	}
+	t := (ap.X*ab.X + ap.Y*ab.Y + ap.Z*ab.Z) / lengthSquared
+	t = math.Max(0, math.Min(1, t))
+	return ap.sub(ab.scale(t)).length()
+}
+
+// simplifyPath returns the samples Ramer-Douglas-Peucker keeps at tolerance,
+// always the first and last.
+func simplifyPath(samples []trackerSample, tolerance float64) []trackerSample {
+	if len(samples) < 3 {
+		return samples
+	}
+	keep := make([]bool, len(samples))
+	keep[0], keep[len(samples)-1] = true, true
+
+	// an explicit stack, as a long session would recurse deeply
+	type span struct{ from, to int }
+	stack := []span{{0, len(samples) - 1}}
+	for len(stack) > 0 {
+		s := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		farthest, distance := -1, tolerance
+		for i := s.from + 1; i < s.to; i++ {
+			if d := segmentDistance(samples[i].Position, samples[s.from].Position, samples[s.to].Position); d > distance {
+				farthest, distance = i, d
+			}
+		}
+		if farthest < 0 {
+			continue
+		}
+		keep[farthest] = true
+		stack = append(stack, span{s.from, farthest}, span{farthest, s.to})
+	}
+
+	simplified := make([]trackerSample, 0, len(samples))
+	for i, sample := range samples {
+		if keep[i] {
+			simplified = append(simplified, sample)
+		}
+	}
+	return simplified
+}
+
+// simplifyStage simplifies a tracker's path in chunks.
+type simplifyStage struct {
+	next      sampleStage
+	tolerance float64
+	chunk     []trackerSample
+}
+
+func (st *simplifyStage) push(s trackerSample) error {
+	st.chunk = append(st.chunk, s)
+	if len(st.chunk) < simplifyChunk {
+		return nil
+	}
+	// the last sample is kept, and begins the next chunk
+	simplified := simplifyPath(st.chunk, st.tolerance)
+	for _, s := range simplified[:len(simplified)-1] {
+		if err := st.next.push(s); err != nil {
+			return err
+		}
+	}
+	st.chunk = append(st.chunk[:0], st.chunk[len(st.chunk)-1])
+	return nil
+}
+
+func (st *simplifyStage) flush() error {
+	for _, s := range simplifyPath(st.chunk, st.tolerance) {
+		if err := st.next.push(s); err != nil {
+			return err
+		}
+	}
+	return st.next.flush()
+}
+
+// parseSimplify parses the simplify tolerance, in metres.
+func parseSimplify(spec string) (trackerTransform, error) {
+	tolerance, err := strconv.ParseFloat(spec, 64)
+	if err != nil || tolerance <= 0 || math.IsInf(tolerance, 0) {
+		return nil, fmt.Errorf("invalid simplify parameter %q: must be a positive tolerance in metres", spec)
+	}
+	return func(_ samplePipeline, next sampleStage) (sampleStage, error) {
+		return &simplifyStage{next: next, tolerance: tolerance}, nil
+	}, nil
+}
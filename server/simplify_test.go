@@ -0,0 +1,91 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSimplifyPath(t *testing.T) {
+	// a straight walk along x, a corner, then up along y, with a little
+	// jitter in z
+	var samples []trackerSample
+	for i := range 200 {
+		p := vec3{X: math.Min(float64(i), 100) / 100, Y: math.Max(float64(i)-100, 0) / 100, Z: 0.002 * float64(i%2)}
+		samples = append(samples, trackerSample{Index: i + 1, Timestamp: float64(i * 10), Position: p})
+	}
+
+	simplified := simplifyPath(samples, 0.01)
+	if len(simplified) != 3 {
+		t.Fatalf("simplified to %d samples: %+v", len(simplified), simplified)
+	}
+	if simplified[0].Index != 1 || simplified[1].Position.X != 1 || simplified[1].Position.Y != 0 || simplified[2].Index != 200 {
+		t.Fatalf("simplified = %+v", simplified)
+	}
+
+	// every dropped sample stays within the tolerance of the kept path
+	for _, tolerance := range []float64{0.001, 0.01, 0.1} {
+		simplified := simplifyPath(samples, tolerance)
+		k := 0
+		for _, s := range samples {
+			for k+1 < len(simplified)-1 && simplified[k+1].Timestamp <= s.Timestamp {
+				k++
+			}
+			if d := segmentDistance(s.Position, simplified[k].Position, simplified[k+1].Position); d > tolerance {
+				t.Fatalf("tolerance %g: sample %d is %g away", tolerance, s.Index, d)
+			}
+		}
+	}
+
+	if short := simplifyPath(samples[:2], 1); len(short) != 2 {
+		t.Fatalf("two samples simplified to %d", len(short))
+	}
+}
+
+func TestTrajectorySimplify(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	var lines []string
+	for i := range 50 {
+		lines = append(lines,
+			fmt.Sprintf(`{"trackerKey":"headset","timestamp":%d,"position":{"x":%g,"y":1.6,"z":0}}`, i*10, float64(i)/100),
+			fmt.Sprintf(`{"trackerKey":"leftController","timestamp":%d,"position":{"x":%g,"y":1,"z":%g}}`, i*10+5, float64(i%2)/10, float64(i)/100),
+		)
+	}
+	simulateUpload(t, key, lines)
+
+	trajectory := func(query string) (int, map[string][]trackerSample) {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/trajectory?"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		TrajectoryHandler(rec, req)
+		var payload struct {
+			Trackers map[string][]trackerSample `json:"trackers"`
+		}
+		if rec.Code == 200 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+				t.Fatalf("decode trajectory response: %v", err)
+			}
+		}
+		return rec.Code, payload.Trackers
+	}
+
+	status, trackers := trajectory("simplify=0.01")
+	if status != 200 {
+		t.Fatalf("trajectory status = %d", status)
+	}
+	// the straight headset path needs its ends, the zig-zagging controller
+	// every sample
+	if len(trackers["headset"]) != 2 || len(trackers["leftController"]) != 50 {
+		t.Fatalf("simplified to %d headset and %d controller samples", len(trackers["headset"]), len(trackers["leftController"]))
+	}
+
+	for _, spec := range []string{"0", "-1", "close", "Inf"} {
+		if status, _ := trajectory("simplify=" + spec); status != 400 {
+			t.Errorf("simplify=%s status = %d, want 400", spec, status)
+		}
+	}
+}
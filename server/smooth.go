@@ -0,0 +1,233 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// maxSavgolWindow and maxSavgolOrder bound the Savitzky-Golay filter: the
+// coefficients are solved for per window position, and high orders make
+// that ill-conditioned without smoothing any better.
+const (
+	maxSavgolWindow = 101
+	maxSavgolOrder  = 6
+)
+
+// emaStage applies an exponential moving average with factor alpha in
+// (0, 1]; higher values follow the raw signal more closely.
+type emaStage struct {
+	next    sampleStage
+	alpha   float64
+	prev    vec3
+	started bool
+}
+
+func (e *emaStage) push(s trackerSample) error {
+	if e.started {
+		s.Position = vec3{
+			e.prev.X + e.alpha*(s.Position.X-e.prev.X),
+			e.prev.Y + e.alpha*(s.Position.Y-e.prev.Y),
+			e.prev.Z + e.alpha*(s.Position.Z-e.prev.Z),
+		}
+	}
+	e.prev, e.started = s.Position, true
+	return e.next.push(s)
+}
+
+func (e *emaStage) flush() error { return e.next.flush() }
+
+// savgolCoefficients returns the weights that evaluate a least-squares
+// polynomial of the given order, fitted over window points, at offset
+// position within the window (0 is the first point).
+func savgolCoefficients(window, order, position int) []float64 {
+	terms := order + 1
+	half := window / 2
+
+	// normal equations (AᵀA) of the Vandermonde matrix A[i][j] = (i-half)^j,
+	// centered on the window for better conditioning
+	ata := make([][]float64, terms)
+	for j := range ata {
+		ata[j] = make([]float64, terms)
+		for k := range ata[j] {
+			for i := 0; i < window; i++ {
+				ata[j][k] += pow(float64(i-half), j+k)
+			}
+		}
+	}
+
+	// solve (AᵀA) b = e(position), then weight i = Σ_j A[i][j] b[j]
+	b := make([]float64, terms)
+	for j := range b {
+		b[j] = pow(float64(position-half), j)
+	}
+	solveLinear(ata, b)
+
+	coefficients := make([]float64, window)
+	for i := range coefficients {
+		for j := 0; j < terms; j++ {
+			coefficients[i] += pow(float64(i-half), j) * b[j]
+		}
+	}
+	return coefficients
+}
+
+func pow(x float64, n int) float64 {
+	result := 1.0
+	for ; n > 0; n-- {
+		result *= x
+	}
+	return result
+}
+
+// solveLinear solves m·x = b in place using Gaussian elimination with
+// partial pivoting; the solution is left in b.
+func solveLinear(m [][]float64, b []float64) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for row := col + 1; row < n; row++ {
+			if abs(m[row][col]) > abs(m[pivot][col]) {
+				pivot = row
+			}
+		}
+		m[col], m[pivot] = m[pivot], m[col]
+		b[col], b[pivot] = b[pivot], b[col]
+
+		for row := col + 1; row < n; row++ {
+			f := m[row][col] / m[col][col]
+			for k := col; k < n; k++ {
+				m[row][k] -= f * m[col][k]
+			}
+			b[row] -= f * b[col]
+		}
+	}
+
+	for row := n - 1; row >= 0; row-- {
+		for k := row + 1; k < n; k++ {
+			b[row] -= m[row][k] * b[k]
+		}
+		b[row] /= m[row][row]
+	}
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// savgolStage applies a Savitzky-Golay filter. The filter assumes evenly
+// spaced samples, so it is best combined with resample. Points closer than
+// half a window to either end are evaluated off-center on the first or last
+// full window instead of being left unfiltered; series shorter than a
+// window are left alone. It holds back a window of samples.
+type savgolStage struct {
+	next          sampleStage
+	window, order int
+	center        []float64
+	edges         map[int][]float64
+	samples       []trackerSample // the last window of them
+	filled        bool
+}
+
+func newSavgolStage(window, order int, next sampleStage) *savgolStage {
+	return &savgolStage{
+		next:    next,
+		window:  window,
+		order:   order,
+		center:  savgolCoefficients(window, order, window/2),
+		edges:   map[int][]float64{},
+		samples: make([]trackerSample, 0, window),
+	}
+}
+
+func (g *savgolStage) push(s trackerSample) error {
+	if len(g.samples) == g.window {
+		copy(g.samples, g.samples[1:])
+		g.samples = g.samples[:g.window-1]
+	}
+	g.samples = append(g.samples, s)
+	if len(g.samples) < g.window {
+		return nil
+	}
+	half := g.window / 2
+	if !g.filled {
+		g.filled = true
+		for position := 0; position < half; position++ {
+			if err := g.emit(position); err != nil {
+				return err
+			}
+		}
+	}
+	return g.emit(half)
+}
+
+func (g *savgolStage) flush() error {
+	if !g.filled {
+		for _, s := range g.samples {
+			if err := g.next.push(s); err != nil {
+				return err
+			}
+		}
+		return g.next.flush()
+	}
+	for position := g.window/2 + 1; position < g.window; position++ {
+		if err := g.emit(position); err != nil {
+			return err
+		}
+	}
+	return g.next.flush()
+}
+
+// emit puts out the sample at position in the window, filtered.
+func (g *savgolStage) emit(position int) error {
+	coefficients := g.center
+	if position != g.window/2 {
+		if g.edges[position] == nil {
+			g.edges[position] = savgolCoefficients(g.window, g.order, position)
+		}
+		coefficients = g.edges[position]
+	}
+	var p vec3
+	for k, c := range coefficients {
+		q := g.samples[k].Position
+		p = vec3{p.X + c*q.X, p.Y + c*q.Y, p.Z + c*q.Z}
+	}
+	sample := g.samples[position]
+	sample.Position = p
+	return g.next.push(sample)
+}
+
+// parseSmooth parses smooth=ema:<alpha> or smooth=savgol:<window>,<order>.
+func parseSmooth(spec string) (trackerTransform, error) {
+	method, args, _ := strings.Cut(spec, ":")
+
+	var start func(next sampleStage) sampleStage
+	switch method {
+	case "ema":
+		alpha, err := strconv.ParseFloat(args, 64)
+		if err != nil || alpha <= 0 || alpha > 1 {
+			return nil, fmt.Errorf("invalid smooth parameter %q: ema factor must be in (0, 1]", spec)
+		}
+		start = func(next sampleStage) sampleStage { return &emaStage{next: next, alpha: alpha} }
+	case "savgol":
+		windowStr, orderStr, _ := strings.Cut(args, ",")
+		window, err1 := strconv.Atoi(windowStr)
+		order, err2 := strconv.Atoi(orderStr)
+		if err1 != nil || err2 != nil || window < 3 || window%2 == 0 || order < 0 || order >= window {
+			return nil, fmt.Errorf("invalid smooth parameter %q: savgol needs an odd window >= 3 and an order below it", spec)
+		}
+		if window > maxSavgolWindow || order > maxSavgolOrder {
+			return nil, fmt.Errorf("invalid smooth parameter %q: savgol window is limited to %d and order to %d", spec, maxSavgolWindow, maxSavgolOrder)
+		}
+		start = func(next sampleStage) sampleStage { return newSavgolStage(window, order, next) }
+	default:
+		return nil, fmt.Errorf("invalid smooth parameter %q: must be ema:<alpha> or savgol:<window>,<order>", spec)
+	}
+
+	return func(_ samplePipeline, next sampleStage) (sampleStage, error) {
+		return start(next), nil
+	}, nil
+}
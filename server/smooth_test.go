@@ -0,0 +1,67 @@
+package server
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSavgolPreservesPolynomials(t *testing.T) {
+	// a quadratic filter must reproduce a quadratic signal exactly, including
+	// at the edges
+	var samples []trackerSample
+	for i := 0; i < 20; i++ {
+		x := float64(i)
+		samples = append(samples, trackerSample{Timestamp: x * 10, Position: vec3{x * x, 2*x + 1, 0}})
+	}
+
+	smoothed := collectSamples(samples, func(next sampleStage) sampleStage { return newSavgolStage(7, 2, next) })
+	if len(smoothed) != len(samples) {
+		t.Fatalf("smoothed %d samples, want %d", len(smoothed), len(samples))
+	}
+	for i, s := range smoothed {
+		if s.Position.sub(samples[i].Position).length() > 1e-6 {
+			t.Fatalf("sample %d = %+v, want %+v", i, s.Position, samples[i].Position)
+		}
+	}
+}
+
+func TestSmoothTransforms(t *testing.T) {
+	samples := []trackerSample{
+		{Timestamp: 0, Position: vec3{0, 0, 0}},
+		{Timestamp: 10, Position: vec3{1, 0, 0}},
+		{Timestamp: 20, Position: vec3{0, 0, 0}},
+		{Timestamp: 30, Position: vec3{1, 0, 0}},
+		{Timestamp: 40, Position: vec3{0, 0, 0}},
+	}
+	smooth := func(transform trackerTransform) []trackerSample {
+		return collectSamples(samples, func(next sampleStage) sampleStage {
+			stage, err := transform(samplePipeline{export: &sampleExport{}}, next)
+			if err != nil {
+				t.Fatalf("start transform: %v", err)
+			}
+			return stage
+		})
+	}
+
+	ema, err := parseSmooth("ema:0.5")
+	if err != nil {
+		t.Fatalf("parse ema: %v", err)
+	}
+	if got := smooth(ema)[1].Position.X; got != 0.5 {
+		t.Fatalf("ema second sample = %v, want 0.5", got)
+	}
+
+	savgol, err := parseSmooth("savgol:3,1")
+	if err != nil {
+		t.Fatalf("parse savgol: %v", err)
+	}
+	if got := smooth(savgol)[2].Position.X; math.Abs(got-2.0/3) > 1e-9 {
+		t.Fatalf("savgol middle sample = %v, want 2/3", got)
+	}
+
+	for _, spec := range []string{"ema:0", "ema:2", "savgol:4,2", "savgol:5,5", "savgol:103,2", "savgol:21,7", "savgol:999999999,2", "median:3"} {
+		if _, err := parseSmooth(spec); err == nil {
+			t.Fatalf("parseSmooth(%q) succeeded, want error", spec)
+		}
+	}
+}
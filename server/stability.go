@@ -0,0 +1,198 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+const (
+	defaultStabilityWindowMs = 1000
+	minStabilitySamples      = 3
+	maxStabilityWindows      = 100000
+)
+
+type stabilityWindow struct {
+	Start     float64 `json:"start"`
+	End       float64 `json:"end"`
+	Samples   int     `json:"samples"`
+	JitterRMS float64 `json:"jitter_rms"`
+}
+
+type trackerStability struct {
+	MeanJitterRMS float64           `json:"mean_jitter_rms"`
+	MaxJitterRMS  float64           `json:"max_jitter_rms"`
+	Windows       []stabilityWindow `json:"windows"`
+}
+
+// detrendedRMS fits a straight line over time to each axis and returns the
+// RMS of the 3D residuals, i.e. the high-frequency part of the motion that
+// remains once deliberate movement is removed.
+func detrendedRMS(samples []trackerSample) float64 {
+	n := float64(len(samples))
+	var meanT float64
+	var meanP vec3
+	for _, s := range samples {
+		meanT += s.Timestamp
+		meanP = vec3{meanP.X + s.Position.X, meanP.Y + s.Position.Y, meanP.Z + s.Position.Z}
+	}
+	meanT /= n
+	meanP = meanP.scale(1 / n)
+
+	var varT float64
+	var covTP vec3
+	for _, s := range samples {
+		dt := s.Timestamp - meanT
+		dp := s.Position.sub(meanP)
+		varT += dt * dt
+		covTP = vec3{covTP.X + dt*dp.X, covTP.Y + dt*dp.Y, covTP.Z + dt*dp.Z}
+	}
+
+	var slope vec3
+	if varT > 0 {
+		slope = covTP.scale(1 / varT)
+	}
+
+	var sumSq float64
+	for _, s := range samples {
+		trend := vec3{
+			meanP.X + slope.X*(s.Timestamp-meanT),
+			meanP.Y + slope.Y*(s.Timestamp-meanT),
+			meanP.Z + slope.Z*(s.Timestamp-meanT),
+		}
+		residual := s.Position.sub(trend).length()
+		sumSq += residual * residual
+	}
+
+	return math.Sqrt(sumSq / n)
+}
+
+// computeStability slides a window of windowMs over samples in steps of
+// stepMs. Windows with fewer than minStabilitySamples samples are skipped.
+// It fails if there would be more than maxStabilityWindows steps.
+func computeStability(samples []trackerSample, windowMs, stepMs float64) (trackerStability, error) {
+	result := trackerStability{Windows: []stabilityWindow{}}
+	if len(samples) == 0 {
+		return result, nil
+	}
+
+	origin := samples[0].Timestamp
+	steps := math.Floor((samples[len(samples)-1].Timestamp-origin)/stepMs) + 1
+	if steps > maxStabilityWindows {
+		return trackerStability{}, fmt.Errorf("stability would have %.0f windows, limit is %d: use a larger step_ms", steps, maxStabilityWindows)
+	}
+	first := 0
+	var sum float64
+	// an integer step count, as start += stepMs stops moving once stepMs is
+	// below the float spacing of the timestamps
+	for i := range int(steps) {
+		start := origin + float64(i)*stepMs
+		end := start + windowMs
+		for first < len(samples) && samples[first].Timestamp < start {
+			first++
+		}
+		last := first
+		for last < len(samples) && samples[last].Timestamp < end {
+			last++
+		}
+		if last-first < minStabilitySamples {
+			continue
+		}
+
+		window := stabilityWindow{
+			Start:     start,
+			End:       end,
+			Samples:   last - first,
+			JitterRMS: detrendedRMS(samples[first:last]),
+		}
+		result.Windows = append(result.Windows, window)
+		result.MaxJitterRMS = max(result.MaxJitterRMS, window.JitterRMS)
+		sum += window.JitterRMS
+	}
+
+	if len(result.Windows) > 0 {
+		result.MeanJitterRMS = sum / float64(len(result.Windows))
+	}
+
+	return result, nil
+}
+
+func parsePositiveFloatParam(r *http.Request, name string, defaultValue float64) (float64, error) {
+	valueStr := r.URL.Query().Get(name)
+	if valueStr == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.ParseFloat(valueStr, 64)
+	if err != nil || math.IsNaN(value) || value <= 0 || math.IsInf(value, 0) {
+		return 0, fmt.Errorf("invalid %s parameter: must be a positive number", name)
+	}
+	return value, nil
+}
+
+func StabilityHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	windowMs, err := parsePositiveFloatParam(r, "window_ms", defaultStabilityWindowMs)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	// windows overlap by half unless a step is given
+	stepMs, err := parsePositiveFloatParam(r, "step_ms", windowMs/2)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	samples, err := readTrackerSamples(uploadKey)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for stability: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	samples, err = selectTracker(samples, r.URL.Query().Get("tracker"))
+	if err != nil {
+		writeError(w, http.StatusNotFound, errCodeTrackerNotFound, err.Error())
+		return
+	}
+
+	trackers := make(map[string]trackerStability, len(samples))
+	for tracker, trackerSamples := range samples {
+		trackers[tracker], err = computeStability(trackerSamples, windowMs, stepMs)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"window_ms":   windowMs,
+		"step_ms":     stepMs,
+		"trackers":    trackers,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write stability response: %v", err)
+	}
+}
@@ -0,0 +1,93 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestDetrendedRMSIgnoresLinearMotion(t *testing.T) {
+	var samples []trackerSample
+	for i := 0; i < 10; i++ {
+		ts := float64(i * 10)
+		samples = append(samples, trackerSample{Timestamp: ts, Position: vec3{ts * 0.01, 1.6, -ts * 0.02}})
+	}
+	if rms := detrendedRMS(samples); rms > 1e-9 {
+		t.Fatalf("rms of linear motion = %v, want 0", rms)
+	}
+}
+
+func TestStabilityHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	// headset alternates +-0.01 around a fixed point at 100Hz
+	var entries []string
+	for i := 0; i < 200; i++ {
+		offset := 0.01
+		if i%2 == 1 {
+			offset = -0.01
+		}
+		entries = append(entries, fmt.Sprintf(`{"trackerKey":"headset","timestamp":%d,"position":{"x":%g,"y":1.6,"z":0}}`, i*10, offset))
+	}
+	simulateUpload(t, key, entries)
+
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/stability?tracker=headset&window_ms=500&step_ms=500", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	StabilityHandler(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("stability status = %d body=%s", rec.Code, rec.Body.String())
+	}
+
+	var payload struct {
+		Trackers map[string]trackerStability `json:"trackers"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode stability response: %v", err)
+	}
+	headset := payload.Trackers["headset"]
+	if len(headset.Windows) != 4 {
+		t.Fatalf("windows = %d, want 4", len(headset.Windows))
+	}
+	if math.Abs(headset.MeanJitterRMS-0.01) > 1e-3 {
+		t.Fatalf("mean jitter = %v, want ~0.01", headset.MeanJitterRMS)
+	}
+}
+
+func TestStabilityWindowLimit(t *testing.T) {
+	// Unix ms timestamps, where a tiny step is below the float spacing
+	samples := []trackerSample{{Timestamp: 1.7e12}, {Timestamp: 1.7e12 + 1000}}
+	if _, err := computeStability(samples, 500, 1e-8); err == nil {
+		t.Fatalf("computeStability with a tiny step succeeded")
+	}
+	stability, err := computeStability(samples, 500, 250)
+	if err != nil || len(stability.Windows) != 0 {
+		t.Fatalf("computeStability = %+v, %v", stability, err)
+	}
+
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1700000000000,"position":{"x":0,"y":1.6,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1700000600000,"position":{"x":0,"y":1.6,"z":0}}`,
+	})
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/stability?step_ms=0.00000001", nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	StabilityHandler(rec, req)
+	if rec.Code != 400 {
+		t.Fatalf("stability with a tiny step status = %d, want 400", rec.Code)
+	}
+	for _, query := range []string{"window_ms=NaN", "step_ms=nan", "window_ms=-1", "window_ms=+Inf"} {
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/stability?"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		StabilityHandler(rec, req)
+		if rec.Code != 400 {
+			t.Errorf("stability with %s status = %d, want 400", query, rec.Code)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// The dashboard pages are served from the directory the server runs in,
+// which by default also holds the uploads and other state of the server.
+// Only the viewer assets are served from it: files at its top level with
+// one of staticExtensions, never a subdirectory or a dotfile.
+var staticExtensions = map[string]bool{
+	".html": true,
+	".js":   true,
+	".css":  true,
+	".png":  true,
+	".gif":  true,
+	".jpg":  true,
+	".svg":  true,
+	".ico":  true,
+}
+
+// StaticFiles serves the viewer assets in dir, and its index.html at /.
+// Everything else is not found.
+func StaticFiles(dir string) http.Handler {
+	fileServer := http.FileServer(http.Dir(dir))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		name := path.Clean("/" + r.URL.Path)
+		if name == "/" {
+			// without an index.html the file server would list dir
+			if _, err := os.Stat(filepath.Join(dir, "index.html")); err != nil {
+				http.NotFound(w, r)
+				return
+			}
+		} else if strings.Count(name, "/") != 1 || strings.HasPrefix(name, "/.") || !staticExtensions[path.Ext(name)] {
+			http.NotFound(w, r)
+			return
+		}
+		fileServer.ServeHTTP(w, r)
+	})
+}
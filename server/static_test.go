@@ -0,0 +1,55 @@
+package server
+
+import (
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStaticFiles(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"index.html", "viewer.html", "app.js", ".secret.html", "go.mod", "uploads/a.csv", "uploads/b.html", "relay-queue/1.json", "autocert-cache/acme_account+key"} {
+		if err := os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0o755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(name), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	handler := StaticFiles(dir)
+
+	get := func(target string) (int, string) {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return rec.Code, rec.Body.String()
+	}
+
+	for target, want := range map[string]string{"/": "index.html", "/viewer.html": "viewer.html", "/app.js": "app.js"} {
+		if code, body := get(target); code != 200 || body != want {
+			t.Errorf("GET %s = %d %q, want %q", target, code, body, want)
+		}
+	}
+	for _, target := range []string{
+		"/uploads/a.csv",
+		"/uploads/b.html",
+		"/uploads/",
+		"/uploads/../uploads/a.csv",
+		"/relay-queue/1.json",
+		"/autocert-cache/acme_account+key",
+		"/.secret.html",
+		"/go.mod",
+	} {
+		if code, _ := get(target); code != 404 {
+			t.Errorf("GET %s = %d, want 404", target, code)
+		}
+	}
+
+	if err := os.Remove(filepath.Join(dir, "index.html")); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := get("/"); code != 404 {
+		t.Errorf("GET / without an index = %d %q, want 404", code, body)
+	}
+}
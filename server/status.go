@@ -0,0 +1,125 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// defaultLiveSeconds is how recently an upload must have received records
+// to count as live.
+const defaultLiveSeconds = 30
+
+// StatusHandler reports how far an upload has got and whether it is still
+// being recorded, without reading more than its last record. The upload can
+// be given by key or by name.
+func StatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	liveSeconds, err := parsePositiveFloatParam(r, "live_seconds", defaultLiveSeconds)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	filePath := uploadFilePath(uploadKey)
+	info, err := os.Stat(filePath)
+	if os.IsNotExist(err) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, errUploadNotFound.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to stat upload for status: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	// cold uploads answer from their .cold file rather than coming back
+	cold, coldErr := readColdInfo(filePath)
+	if coldErr != nil && !os.IsNotExist(coldErr) {
+		log.Printf("failed to read cold storage info for status: %v", coldErr)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	var last []tailRecord
+	if coldErr != nil {
+		last, err = readTailRecords(filePath, 1)
+	}
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload for status: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	checksum, err := uploadFileChecksum(filePath)
+	if err != nil {
+		log.Printf("failed to checksum upload for status: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	// usage is only counted if there are quotas to count it against
+	var quota *quotaStatus
+	if quotasEnabled() {
+		status, err := uploadQuotaStatus(uploadKey)
+		if err != nil {
+			log.Printf("failed to count quota usage for status: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to count quota usage")
+			return
+		}
+		quota = &status
+	}
+
+	// the file is only written by uploads, so its modification time is when
+	// the last batch arrived
+	lastUploadAt := info.ModTime().UTC()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("ETag", strconv.Quote(checksum.String()))
+	response := map[string]any{
+		"status":                "ok",
+		"upload_name":           uploadNameFromKey(uploadKey),
+		"records":               0,
+		"last_record_timestamp": nil,
+		"last_upload_at":        lastUploadAt.Format(time.RFC3339Nano),
+		"live":                  time.Since(lastUploadAt).Seconds() <= liveSeconds,
+		"live_seconds":          liveSeconds,
+		"checksum":              checksum.String(),
+	}
+	if coldErr == nil {
+		response["records"] = cold.Records
+		response["last_record_timestamp"] = cold.LastRecordTimestamp
+		response["cold_storage"] = map[string]any{"archived_at": cold.ArchivedAt.Format(time.RFC3339Nano)}
+	}
+	if len(last) > 0 {
+		response["records"] = last[0].Index
+		if t, ok := payloadTime(last[0].Record); ok {
+			response["last_record_timestamp"] = t
+		}
+	}
+
+	if quota != nil {
+		response["quota"] = quota
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write status response: %v", err)
+	}
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+)
+
+func getStatus(t *testing.T, key, query string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/status"+query, nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	StatusHandler(rec, req)
+
+	var response map[string]any
+	if rec.Code == 200 {
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatalf("decode status response: %v", err)
+		}
+	}
+	return rec.Code, response
+}
+
+func TestStatusHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	if code, _ := getStatus(t, key, ""); code != 404 {
+		t.Fatalf("status of missing upload: %d", code)
+	}
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1000,"position":{"x":0,"y":0,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1100,"position":{"x":1,"y":0,"z":0}}`,
+	})
+
+	code, status := getStatus(t, key, "")
+	if code != 200 || status["records"] != 2.0 || status["last_record_timestamp"] != 1100.0 || status["live"] != true {
+		t.Fatalf("status: %d %v", code, status)
+	}
+
+	// an upload that hasn't received anything for a minute is stale
+	old := time.Now().Add(-time.Minute)
+	if err := os.Chtimes(uploadFilePath(key), old, old); err != nil {
+		t.Fatal(err)
+	}
+	code, status = getStatus(t, key, "")
+	if code != 200 || status["live"] != false {
+		t.Fatalf("stale status: %d %v", code, status)
+	}
+	code, status = getStatus(t, key, "?live_seconds=120")
+	if code != 200 || status["live"] != true {
+		t.Fatalf("status with live_seconds=120: %d %v", code, status)
+	}
+
+	if code, _ := getStatus(t, key, "?live_seconds=-1"); code != 400 {
+		t.Fatalf("invalid live_seconds: %d", code)
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// uploadStorage is the disk usage of one upload: its CSV file and the files
+// next to it that share its name, such as the checksum, record index, frame
+// index, annotations and fsck backups.
+type uploadStorage struct {
+	UploadName string    `json:"upload_name"`
+	KeyHash    string    `json:"key_hash"`
+	DataBytes  int64     `json:"data_bytes"`
+	TotalBytes int64     `json:"total_bytes"`
+	Files      int       `json:"files"`
+	ReceivedAt time.Time `json:"received_at,omitzero"`
+}
+
+// storageStats is what StorageHandler reports.
+type storageStats struct {
+	UploadDir     string          `json:"upload_dir"`
+	TotalBytes    int64           `json:"total_bytes"`
+	Files         int             `json:"files"`
+	Uploads       []uploadStorage `json:"uploads"`
+	OldestSession *uploadStorage  `json:"oldest_session"`
+	FreeBytes     *int64          `json:"free_bytes"`
+}
+
+// collectStorageStats measures everything under the upload directory.
+// Uploads are sorted by total size, largest first.
+func collectStorageStats() (storageStats, error) {
+	stats := storageStats{UploadDir: uploadDir, Uploads: []uploadStorage{}}
+
+	sizes := map[string]int64{} // by file name, for files directly in uploadDir
+	err := filepath.WalkDir(uploadDir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == uploadDir {
+				return fs.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		stats.TotalBytes += info.Size()
+		stats.Files++
+		if filepath.Dir(path) == filepath.Clean(uploadDir) {
+			sizes[entry.Name()] = info.Size()
+		}
+		return nil
+	})
+	if err != nil {
+		return stats, err
+	}
+
+	keys, err := listUploadKeys()
+	if err != nil {
+		return stats, err
+	}
+	for _, uploadKey := range keys {
+		filePath := uploadFilePath(uploadKey)
+		upload := uploadStorage{UploadName: uploadNameFromKey(uploadKey), KeyHash: uploadKeyHash(uploadKey), DataBytes: sizes[filepath.Base(filePath)]}
+		prefix := strings.TrimSuffix(filepath.Base(filePath), ".csv") + "."
+		for name, size := range sizes {
+			if strings.HasPrefix(name, prefix) {
+				upload.TotalBytes += size
+				upload.Files++
+			}
+		}
+		if metadata, err := readUploadMetadata(filePath); err == nil {
+			upload.ReceivedAt, _ = time.Parse(time.RFC3339Nano, metadata.ReceivedAt)
+		}
+		stats.Uploads = append(stats.Uploads, upload)
+	}
+
+	sort.Slice(stats.Uploads, func(i, j int) bool {
+		a, b := stats.Uploads[i], stats.Uploads[j]
+		return a.TotalBytes > b.TotalBytes || a.TotalBytes == b.TotalBytes && a.KeyHash < b.KeyHash
+	})
+	for i, upload := range stats.Uploads {
+		if !upload.ReceivedAt.IsZero() && (stats.OldestSession == nil || upload.ReceivedAt.Before(stats.OldestSession.ReceivedAt)) {
+			stats.OldestSession = &stats.Uploads[i]
+		}
+	}
+
+	if free, err := freeDiskSpace(diskSpaceDir()); err == nil {
+		stats.FreeBytes = &free
+	}
+	return stats, nil
+}
+
+// StorageHandler serves the admin view of disk usage: the size of the upload
+// directory and of every upload, the oldest session and the free space left
+// on the volume (null where that can't be determined).
+func StorageHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	stats, err := collectStorageStats()
+	if err != nil {
+		log.Printf("failed to collect storage stats: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to collect storage stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":  "ok",
+		"storage": stats,
+	}
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write storage response: %v", err)
+	}
+}
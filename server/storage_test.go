@@ -0,0 +1,63 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestStorageHandler(t *testing.T) {
+	chdirTemp(t)
+
+	rec := httptest.NewRecorder()
+	StorageHandler(rec, httptest.NewRequest("GET", "/api/admin/storage", nil))
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"total_bytes":0`) {
+		t.Fatalf("empty storage: status %d, body %s", rec.Code, rec.Body)
+	}
+
+	small, large := newTestUploadKey(t), newTestUploadKey(t)
+	simulateUpload(t, small, []string{`{"bpm":70}`})
+	simulateUpload(t, large, []string{`{"bpm":70}`, `{"bpm":71}`, `{"bpm":72}`})
+	if code := postAnnotation(t, large, `{"label":"warmup","start":0,"end":5}`); code != 201 {
+		t.Fatalf("post annotation status = %d", code)
+	}
+
+	rec = httptest.NewRecorder()
+	StorageHandler(rec, httptest.NewRequest("GET", "/api/admin/storage", nil))
+	var response struct {
+		Storage storageStats `json:"storage"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	stats := response.Storage
+
+	var total int64
+	entries, _ := os.ReadDir(uploadDir)
+	for _, entry := range entries {
+		info, _ := entry.Info()
+		total += info.Size()
+	}
+	if stats.TotalBytes != total || stats.Files != len(entries) {
+		t.Fatalf("totals = %d bytes in %d files, want %d in %d", stats.TotalBytes, stats.Files, total, len(entries))
+	}
+
+	if len(stats.Uploads) != 2 || stats.Uploads[0].KeyHash != uploadKeyHash(large) {
+		t.Fatalf("uploads = %+v", stats.Uploads)
+	}
+	info, err := os.Stat(uploadFilePath(large))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if upload := stats.Uploads[0]; upload.DataBytes != info.Size() || upload.TotalBytes <= upload.DataBytes || upload.Files < 3 {
+		t.Fatalf("large upload = %+v, csv is %d bytes", upload, info.Size())
+	}
+	if stats.OldestSession == nil || stats.OldestSession.KeyHash != uploadKeyHash(small) {
+		t.Fatalf("oldest session = %+v", stats.OldestSession)
+	}
+	if strings.Contains(rec.Body.String(), small) {
+		t.Fatal("storage response contains an upload key")
+	}
+}
@@ -0,0 +1,241 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const defaultGapThresholdMs = 500
+
+type boundingBox struct {
+	Min vec3 `json:"min"`
+	Max vec3 `json:"max"`
+}
+
+type gapInterval struct {
+	StartIndex int     `json:"start_index"`
+	EndIndex   int     `json:"end_index"`
+	Start      float64 `json:"start"`
+	End        float64 `json:"end"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type trackerSummary struct {
+	Samples      int         `json:"samples"`
+	DurationMs   float64     `json:"duration_ms"`
+	SampleRateHz float64     `json:"sample_rate_hz"`
+	Gaps         int         `json:"gaps"`
+	LongestGapMs float64     `json:"longest_gap_ms"`
+	BoundingBox  boundingBox `json:"bounding_box"`
+	Distance     float64     `json:"distance"`
+}
+
+type sessionSummary struct {
+	UploadName     string                    `json:"upload_name"`
+	Records        int                       `json:"records"`
+	Start          float64                   `json:"start"`
+	End            float64                   `json:"end"`
+	DurationMs     float64                   `json:"duration_ms"`
+	GapThresholdMs float64                   `json:"gap_threshold_ms"`
+	HeadTravel     float64                   `json:"head_travel_distance"`
+	Trackers       map[string]trackerSummary `json:"trackers"`
+	RangeOfMotion  rangeOfMotion             `json:"range_of_motion"`
+	ComputedAt     string                    `json:"computed_at"`
+}
+
+type summaryCacheEntry struct {
+	size           int64
+	modTime        time.Time
+	gapThresholdMs float64
+	summary        sessionSummary
+}
+
+// Summaries are cached per upload and reused for as long as the file is
+// unchanged, so a closed session is only ever scanned once.
+var summaryCache = map[string]summaryCacheEntry{}
+var summaryCacheMutex sync.Mutex
+
+// findGaps returns the intervals between consecutive samples that are longer
+// than thresholdMs.
+func findGaps(samples []trackerSample, thresholdMs float64) []gapInterval {
+	var gaps []gapInterval
+	for i := 1; i < len(samples); i++ {
+		prev, cur := samples[i-1], samples[i]
+		if delta := cur.Timestamp - prev.Timestamp; delta > thresholdMs {
+			gaps = append(gaps, gapInterval{
+				StartIndex: prev.Index,
+				EndIndex:   cur.Index,
+				Start:      prev.Timestamp,
+				End:        cur.Timestamp,
+				DurationMs: delta,
+			})
+		}
+	}
+	return gaps
+}
+
+func summarizeTracker(samples []trackerSample, gapThresholdMs float64) trackerSummary {
+	summary := trackerSummary{Samples: len(samples)}
+	if len(samples) == 0 {
+		return summary
+	}
+
+	first, last := samples[0], samples[len(samples)-1]
+	summary.DurationMs = last.Timestamp - first.Timestamp
+	if summary.DurationMs > 0 {
+		summary.SampleRateHz = float64(len(samples)-1) / (summary.DurationMs / 1000)
+	}
+
+	for _, gap := range findGaps(samples, gapThresholdMs) {
+		summary.Gaps++
+		summary.LongestGapMs = max(summary.LongestGapMs, gap.DurationMs)
+	}
+
+	box := boundingBox{Min: first.Position, Max: first.Position}
+	for i, sample := range samples {
+		p := sample.Position
+		box.Min = vec3{math.Min(box.Min.X, p.X), math.Min(box.Min.Y, p.Y), math.Min(box.Min.Z, p.Z)}
+		box.Max = vec3{math.Max(box.Max.X, p.X), math.Max(box.Max.Y, p.Y), math.Max(box.Max.Z, p.Z)}
+		if i > 0 {
+			summary.Distance += p.sub(samples[i-1].Position).length()
+		}
+	}
+	summary.BoundingBox = box
+
+	return summary
+}
+
+func computeSessionSummary(uploadKey string, gapThresholdMs float64) (sessionSummary, error) {
+	samples, err := readTrackerSamples(uploadKey)
+	if err != nil {
+		return sessionSummary{}, err
+	}
+
+	summary := sessionSummary{
+		UploadName:     uploadNameFromKey(uploadKey),
+		GapThresholdMs: gapThresholdMs,
+		Trackers:       make(map[string]trackerSummary, len(samples)),
+		Start:          math.Inf(1),
+		End:            math.Inf(-1),
+		ComputedAt:     time.Now().UTC().Format(time.RFC3339Nano),
+	}
+
+	trackers := make([]string, 0, len(samples))
+	for tracker := range samples {
+		trackers = append(trackers, tracker)
+	}
+	sort.Strings(trackers)
+
+	for _, tracker := range trackers {
+		trackerSamples := samples[tracker]
+		ts := summarizeTracker(trackerSamples, gapThresholdMs)
+		summary.Trackers[tracker] = ts
+		summary.Records += ts.Samples
+		summary.Start = math.Min(summary.Start, trackerSamples[0].Timestamp)
+		summary.End = math.Max(summary.End, trackerSamples[len(trackerSamples)-1].Timestamp)
+	}
+
+	if summary.Records == 0 {
+		summary.Start, summary.End = 0, 0
+	}
+	summary.DurationMs = summary.End - summary.Start
+	summary.HeadTravel = summary.Trackers[defaultTracker].Distance
+	summary.RangeOfMotion = computeRangeOfMotion(samples)
+
+	return summary, nil
+}
+
+// cachedSessionSummary returns the summary for uploadKey, recomputing it
+// only if the upload file changed since it was last computed.
+func cachedSessionSummary(uploadKey string, gapThresholdMs float64) (sessionSummary, error) {
+	info, err := os.Stat(uploadFilePath(uploadKey))
+	if os.IsNotExist(err) {
+		return sessionSummary{}, errUploadNotFound
+	}
+	if err != nil {
+		return sessionSummary{}, err
+	}
+
+	summaryCacheMutex.Lock()
+	entry, ok := summaryCache[uploadKey]
+	summaryCacheMutex.Unlock()
+	if ok && entry.size == info.Size() && entry.modTime.Equal(info.ModTime()) && entry.gapThresholdMs == gapThresholdMs {
+		return entry.summary, nil
+	}
+
+	summary, err := computeSessionSummary(uploadKey, gapThresholdMs)
+	if err != nil {
+		return sessionSummary{}, err
+	}
+
+	summaryCacheMutex.Lock()
+	defer summaryCacheMutex.Unlock()
+	summaryCache[uploadKey] = summaryCacheEntry{
+		size:           info.Size(),
+		modTime:        info.ModTime(),
+		gapThresholdMs: gapThresholdMs,
+		summary:        summary,
+	}
+
+	return summary, nil
+}
+
+// parseGapThreshold reads the gap_ms query parameter.
+func parseGapThreshold(r *http.Request) (float64, error) {
+	gapStr := r.URL.Query().Get("gap_ms")
+	if gapStr == "" {
+		return defaultGapThresholdMs, nil
+	}
+	gapMs, err := strconv.ParseFloat(gapStr, 64)
+	if err != nil || gapMs <= 0 || math.IsInf(gapMs, 0) {
+		return 0, errors.New("invalid gap_ms parameter: must be a positive number")
+	}
+	return gapMs, nil
+}
+
+func SummaryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	gapThresholdMs, err := parseGapThreshold(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	summary, err := cachedSessionSummary(uploadKey, gapThresholdMs)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to compute session summary: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":  "ok",
+		"summary": summary,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write summary response: %v", err)
+	}
+}
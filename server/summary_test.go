@@ -0,0 +1,69 @@
+package server
+
+import (
+	"encoding/json"
+	"math"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSummaryHandler(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":0,"position":{"x":0,"y":1,"z":0}}`,
+		`{"trackerKey":"leftController","timestamp":50,"position":{"x":-1,"y":1,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":100,"position":{"x":1,"y":1.5,"z":0}}`,
+		`{"trackerKey":"headset","timestamp":1100,"position":{"x":1,"y":1.5,"z":2}}`,
+		`{"bpm":72,"rr_ms":830}`,
+	})
+
+	getSummary := func(query string) sessionSummary {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/api/uploads/"+key+"/summary"+query, nil)
+		req.SetPathValue("key", key)
+		rec := httptest.NewRecorder()
+		SummaryHandler(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("summary status = %d body=%s", rec.Code, rec.Body.String())
+		}
+		var payload struct {
+			Summary sessionSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+			t.Fatalf("decode summary response: %v", err)
+		}
+		return payload.Summary
+	}
+
+	summary := getSummary("?gap_ms=500")
+	if summary.Records != 4 {
+		t.Fatalf("records = %d, want 4", summary.Records)
+	}
+	if summary.DurationMs != 1100 {
+		t.Fatalf("duration = %v, want 1100", summary.DurationMs)
+	}
+	headset := summary.Trackers["headset"]
+	if headset.Samples != 3 || headset.Gaps != 1 || headset.LongestGapMs != 1000 {
+		t.Fatalf("unexpected headset summary: %+v", headset)
+	}
+	if headset.BoundingBox.Max != (vec3{1, 1.5, 2}) {
+		t.Fatalf("bounding box max = %+v", headset.BoundingBox.Max)
+	}
+	if math.Abs(summary.HeadTravel-(math.Sqrt(1.25)+2)) > 1e-9 {
+		t.Fatalf("head travel = %v", summary.HeadTravel)
+	}
+
+	// an unchanged file is served from the cache
+	if cached := getSummary("?gap_ms=500"); cached.ComputedAt != summary.ComputedAt {
+		t.Fatalf("summary was recomputed for an unchanged file")
+	}
+
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"headset","timestamp":1200,"position":{"x":1,"y":1.5,"z":2}}`,
+	})
+	if updated := getSummary("?gap_ms=500"); updated.Records != 5 {
+		t.Fatalf("records after append = %d, want 5", updated.Records)
+	}
+}
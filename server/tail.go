@@ -0,0 +1,166 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+)
+
+const (
+	defaultTailRecords = 100
+	maxTailRecords     = 10000
+	tailChunkSize      = 64 * 1024
+)
+
+type tailRecord struct {
+	Index  int             `json:"index"`
+	Record json.RawMessage `json:"record"`
+}
+
+// readTailRecords returns the last n records of an upload in stored order.
+// Plain uploads are read backwards from the end of the file; compressed ones
+// are decompressed from the member the record index points at.
+func readTailRecords(filePath string, n int) ([]tailRecord, error) {
+	if err := ensureHot(filePath); err != nil {
+		return nil, err
+	}
+	compressed, err := isCompressedUpload(filePath)
+	if err != nil {
+		return nil, err
+	}
+	if compressed {
+		return readTailRecordsCompressed(filePath, n)
+	}
+
+	version, err := uploadFormat(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil, errUploadNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("open upload file: %w", err)
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("stat upload file: %w", err)
+	}
+
+	// read chunks from the end until they hold n complete record lines, or
+	// the start of the file is reached
+	var tail []byte
+	end := info.Size()
+	for end > 0 && bytes.Count(bytes.TrimSpace(tail), []byte("\n")) < n {
+		start := max(0, end-tailChunkSize)
+		chunk := make([]byte, end-start, int(end-start)+len(tail))
+		if _, err := file.ReadAt(chunk, start); err != nil && err != io.EOF {
+			return nil, fmt.Errorf("read upload file: %w", err)
+		}
+		tail = append(chunk, tail...)
+		end = start
+	}
+
+	lines := bytes.Split(tail, []byte("\n"))
+	if end > 0 {
+		lines = lines[1:] // partial line before the chunks
+	} else if len(lines) > 0 {
+		lines = lines[1:] // metadata line
+	}
+
+	var records []tailRecord
+	for _, line := range lines {
+		line = bytes.TrimSpace(line)
+		if len(line) == 0 {
+			continue
+		}
+		record, err := parseRecordLine(line, version)
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, tailRecord{Index: record.Index, Record: record.Payload})
+	}
+	return records[max(0, len(records)-n):], nil
+}
+
+func readTailRecordsCompressed(filePath string, n int) ([]tailRecord, error) {
+	after := 0
+	if _, count, err := readRecordIndexEntry(filePath, -1); err == nil {
+		after = max(0, count-n)
+	}
+
+	records := make([]tailRecord, 0, n)
+	err := scanUploadFileFrom(filePath, after, func(index int, payload []byte) error {
+		if len(records) == n {
+			records = append(records[:0], records[1:]...)
+		}
+		records = append(records, tailRecord{Index: index, Record: payload})
+		return nil
+	})
+	return records, err
+}
+
+// TailHandler returns the last n records of an upload, e.g. for showing
+// the current position of a session without reading all of it. position is
+// the index of the last record, to continue with follow from.
+func TailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+
+	n := defaultTailRecords
+	if nStr := r.URL.Query().Get("n"); nStr != "" {
+		n, err = strconv.Atoi(nStr)
+		if err != nil || n <= 0 || n > maxTailRecords {
+			writeError(w, http.StatusBadRequest, errCodeInvalidParameter, fmt.Sprintf("invalid n parameter: must be between 1 and %d", maxTailRecords))
+			return
+		}
+	}
+
+	records, err := readTailRecords(uploadFilePath(uploadKey), n)
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to read upload tail: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+
+	position := 0
+	if len(records) > 0 {
+		position = records[len(records)-1].Index
+	}
+	if records == nil {
+		records = []tailRecord{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"position":    position,
+		"records":     records,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write tail response: %v", err)
+	}
+}
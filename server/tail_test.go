@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+)
+
+func getTail(t *testing.T, key, query string) (int, tailResponse) {
+	t.Helper()
+	req := httptest.NewRequest("GET", "/api/uploads/"+key+"/tail"+query, nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	TailHandler(rec, req)
+
+	var response tailResponse
+	if rec.Code == 200 {
+		if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+			t.Fatalf("decode tail response: %v", err)
+		}
+	}
+	return rec.Code, response
+}
+
+type tailResponse struct {
+	Position int          `json:"position"`
+	Records  []tailRecord `json:"records"`
+}
+
+func TestTailHandler(t *testing.T) {
+	for _, compressed := range []bool{false, true} {
+		t.Run(fmt.Sprintf("compressed=%v", compressed), func(t *testing.T) {
+			chdirTemp(t)
+			compressStorage = compressed
+			t.Cleanup(func() { compressStorage = false })
+
+			key := newTestUploadKey(t)
+			if code, _ := getTail(t, key, ""); code != 404 {
+				t.Fatalf("tail of missing upload: status %d", code)
+			}
+
+			// enough records to need several chunks from the end of the file
+			for batch := 0; batch < 10; batch++ {
+				entries := make([]string, 200)
+				for i := range entries {
+					entries[i] = fmt.Sprintf(`{"trackerKey":"headset","timestamp":%d,"position":{"x":%d,"y":0,"z":0}}`, batch*200+i, i)
+				}
+				simulateUpload(t, key, entries)
+			}
+
+			code, response := getTail(t, key, "?n=3")
+			if code != 200 || response.Position != 2000 || len(response.Records) != 3 || response.Records[0].Index != 1998 {
+				t.Fatalf("tail n=3: status %d %+v", code, response)
+			}
+			if got := string(response.Records[2].Record); got != `{"trackerKey":"headset","timestamp":1999,"position":{"x":199,"y":0,"z":0}}` {
+				t.Fatalf("last record = %s", got)
+			}
+
+			code, response = getTail(t, key, "?n=10000")
+			if code != 200 || len(response.Records) != 2000 || response.Records[0].Index != 1 {
+				t.Fatalf("tail of whole upload: status %d, %d records", code, len(response.Records))
+			}
+
+			if code, _ := getTail(t, key, "?n=0"); code != 400 {
+				t.Fatalf("tail n=0: status %d", code)
+			}
+		})
+	}
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Record timestamps are stored in milliseconds, the unit every reader of
+// the records works in. Clients send them in seconds, milliseconds or
+// microseconds depending on their SDK; the unit is taken from the upload
+// request, the server configuration or, with "auto", the magnitude of the
+// first timestamp of the upload. Converted records keep the value as sent in
+// timestamp_original.
+//
+// Magnitude only tells units apart for Unix times: a relative scene time of
+// 12000 could be 12 seconds in milliseconds or 12000 seconds. Relative times
+// are taken to be milliseconds, as the WebXR clients send them; clients with
+// relative times in seconds have to say so.
+
+const (
+	timestampUnitAuto = "auto"
+
+	// Timestamps larger than maxRelativeTimestamp seconds (about three years)
+	// are Unix times and must lie between minEpochTimestamp (2000-01-01) and
+	// maxTimestampSkew after the server clock.
+	maxRelativeTimestamp = 1e8
+	minEpochTimestamp    = 946684800
+	maxTimestampSkew     = 24 * time.Hour
+)
+
+// timestampUnitsPerSecond lists the supported units.
+var timestampUnitsPerSecond = map[string]float64{
+	"s":  1,
+	"ms": 1e3,
+	"us": 1e6,
+}
+
+// timestampUnit is the unit of uploads that don't give one. Set by
+// SetTimestampUnit.
+var timestampUnit = timestampUnitAuto
+
+var errInvalidTimestamp = errors.New("invalid timestamp")
+
+// SetTimestampUnit sets the unit assumed for timestamps of uploads that don't
+// give one: s, ms, us or auto.
+func SetTimestampUnit(unit string) error {
+	unit, err := parseTimestampUnit(unit)
+	if err != nil {
+		return err
+	}
+	timestampUnit = unit
+	return nil
+}
+
+func parseTimestampUnit(raw string) (string, error) {
+	if _, ok := timestampUnitsPerSecond[raw]; ok || raw == timestampUnitAuto {
+		return raw, nil
+	}
+	return "", fmt.Errorf("invalid timestamp unit %q: must be s, ms, us or auto", raw)
+}
+
+// detectTimestampUnit guesses the unit of a timestamp from its magnitude,
+// assuming Unix times are recent: 1e11 seconds is in the year 5138, while
+// 1e11 milliseconds and 1e14 microseconds are in 1973. Anything below Unix
+// times in seconds is a relative time in milliseconds.
+func detectTimestampUnit(v float64) string {
+	switch v = math.Abs(v); {
+	case v >= 1e14:
+		return "us"
+	case v >= 1e11:
+		return "ms"
+	case v > maxRelativeTimestamp:
+		return "s"
+	default:
+		return "ms"
+	}
+}
+
+// uploadTimestampUnit returns the unit of an upload's timestamps: the one in
+// its metadata if it exists, else requested, else the configured one.
+func uploadTimestampUnit(uploadKey, requested string) (string, error) {
+	metadata, err := readUploadMetadata(uploadFilePath(uploadKey))
+	if err != nil && !errors.Is(err, errUploadNotFound) {
+		return "", err
+	}
+	switch {
+	case metadata.TimestampUnit != "":
+		return metadata.TimestampUnit, nil
+	case requested != "":
+		return requested, nil
+	default:
+		return timestampUnit, nil
+	}
+}
+
+// checkTimestamp rejects timestamps, in seconds, that can't be right.
+func checkTimestamp(seconds float64, receivedAt time.Time) error {
+	switch {
+	case seconds < 0:
+		return errors.New("must not be negative")
+	case seconds <= maxRelativeTimestamp:
+		return nil
+	case seconds < minEpochTimestamp:
+		return errors.New("is before the year 2000")
+	case seconds > unixSeconds(receivedAt.Add(maxTimestampSkew)):
+		return fmt.Errorf("is more than %v ahead of the server clock", maxTimestampSkew)
+	}
+	return nil
+}
+
+// normalizeTimestamps checks the numeric timestamp of every record and
+// converts it to milliseconds. With unit "auto" the unit is detected from
+// the first timestamp; the unit used is returned, still "auto" if no record
+// has a timestamp. Records whose timestamp isn't numeric are kept as they
+// are, and converted ones only have their timestamp field rewritten.
+func normalizeTimestamps(lines []string, unit string, receivedAt time.Time) ([]string, string, error) {
+	normalized := make([]string, len(lines))
+	for i, line := range lines {
+		normalized[i] = line
+
+		start, end, hasOriginal := timestampSpan([]byte(line))
+		if start < 0 {
+			continue
+		}
+		raw := line[start:end]
+		value, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			continue
+		}
+
+		if unit == timestampUnitAuto {
+			unit = detectTimestampUnit(value)
+		}
+		seconds := value / timestampUnitsPerSecond[unit]
+		if err := checkTimestamp(seconds, receivedAt); err != nil {
+			return nil, "", fmt.Errorf("%w: record %d: timestamp %s (%s) %v", errInvalidTimestamp, i+1, raw, unit, err)
+		}
+		if unit == "ms" {
+			continue
+		}
+
+		patched := strconv.FormatFloat(seconds*1000, 'f', -1, 64)
+		if !hasOriginal {
+			patched += `,"timestamp_original":` + raw
+		}
+		normalized[i] = line[:start] + patched + line[end:]
+	}
+	return normalized, unit, nil
+}
+
+// timestampSpan finds the value of the top-level timestamp field of a JSON
+// object record, returning -1 if there is none, and whether the record
+// already has a timestamp_original field.
+func timestampSpan(record []byte) (start, end int, hasOriginal bool) {
+	start, end = -1, -1
+	decoder := json.NewDecoder(bytes.NewReader(record))
+	if token, err := decoder.Token(); err != nil || token != json.Delim('{') {
+		return -1, -1, false
+	}
+	for decoder.More() {
+		key, err := decoder.Token()
+		if err != nil {
+			return -1, -1, false
+		}
+		var value json.RawMessage
+		if err := decoder.Decode(&value); err != nil {
+			return -1, -1, false
+		}
+		switch key {
+		case "timestamp":
+			// a raw value holds the bytes as they are in the record
+			end = int(decoder.InputOffset())
+			start = end - len(value)
+		case "timestamp_original":
+			hasOriginal = true
+		}
+	}
+	if _, err := decoder.Token(); err != nil && err != io.EOF {
+		return -1, -1, false
+	}
+	return start, end, hasOriginal
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNormalizeTimestamps(t *testing.T) {
+	receivedAt := time.Unix(1700000000, 0)
+
+	lines, unit, err := normalizeTimestamps([]string{`{"heartRate":70}`, `{"timestamp":1699999999.123,"heartRate":71}`}, timestampUnitAuto, receivedAt)
+	if err != nil || unit != "s" {
+		t.Fatalf("unit %q, err %v", unit, err)
+	}
+	// only the timestamp is rewritten, the other fields keep their order
+	if lines[0] != `{"heartRate":70}` || lines[1] != `{"timestamp":1699999999123,"timestamp_original":1699999999.123,"heartRate":71}` {
+		t.Fatalf("lines = %q", lines)
+	}
+
+	lines, unit, _ = normalizeTimestamps([]string{`{"z":1, "timestamp" : 1699999999123456 ,"a":2}`}, timestampUnitAuto, receivedAt)
+	if unit != "us" || lines[0] != `{"z":1, "timestamp" : 1699999999123.456,"timestamp_original":1699999999123456 ,"a":2}` {
+		t.Fatalf("microseconds: %q %q", lines, unit)
+	}
+
+	// milliseconds are only checked, relative times too
+	for _, line := range []string{`{"timestamp":12.25}`, `{"timestamp":1699999999123,"heartRate":70}`} {
+		lines, unit, err := normalizeTimestamps([]string{line}, timestampUnitAuto, receivedAt)
+		if err != nil || unit != "ms" || lines[0] != line {
+			t.Fatalf("%s: %q %q %v", line, lines, unit, err)
+		}
+	}
+	if lines, _, _ := normalizeTimestamps([]string{`{"timestamp":12}`}, "s", receivedAt); lines[0] != `{"timestamp":12000,"timestamp_original":12}` {
+		t.Fatalf("relative seconds = %q", lines)
+	}
+	// a nested timestamp or one already converted isn't touched again
+	line := `{"timestamp":1500,"timestamp_original":1.5,"pose":{"timestamp":2}}`
+	if lines, _, _ := normalizeTimestamps([]string{line}, "s", receivedAt); lines[0] != `{"timestamp":1500000,"timestamp_original":1.5,"pose":{"timestamp":2}}` {
+		t.Fatalf("nested timestamp = %q", lines)
+	}
+
+	for _, c := range []struct{ unit, line string }{
+		{timestampUnitAuto, `{"timestamp":-1}`},
+		{"s", `{"timestamp":600000000}`},         // 1989
+		{"s", `{"timestamp":1800000000}`},        // 2027
+		{"us", `{"timestamp":1800000000000000}`}, // 2027
+	} {
+		if _, _, err := normalizeTimestamps([]string{`{"timestamp":1}`, c.line}, c.unit, receivedAt); !errors.Is(err, errInvalidTimestamp) || !strings.Contains(err.Error(), "record 2") {
+			t.Fatalf("%s: err %v", c.line, err)
+		}
+	}
+}
+
+func TestUploadTimestampUnit(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	upload := func(query, body string) *httptest.ResponseRecorder {
+		req := withUploadKey(httptest.NewRequest("POST", "/api/upload?"+query, strings.NewReader(body)), key)
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+		return rec
+	}
+
+	if rec := upload("&timestamp_unit=minutes", `{"timestamp":1}`); rec.Code != 400 {
+		t.Fatalf("invalid unit: status %d", rec.Code)
+	}
+	if rec := upload("&timestamp_unit=s", `{"timestamp":1.5}`); rec.Code != 200 {
+		t.Fatalf("upload: status %d %s", rec.Code, rec.Body.String())
+	}
+	// later batches keep the unit of the upload
+	if rec := upload("", `{"timestamp":2.5}`); rec.Code != 200 {
+		t.Fatalf("upload: status %d %s", rec.Code, rec.Body.String())
+	}
+	rec := upload("", `{"timestamp":`+strings.Repeat("9", 16)+`}`)
+	if rec.Code != 400 || !strings.Contains(rec.Body.String(), `"code":"invalid_timestamp"`) {
+		t.Fatalf("far future: status %d %s", rec.Code, rec.Body.String())
+	}
+
+	_, metadata, records := readUploadFile(t, uploadFilePath(key))
+	if metadata["timestamp_unit"] != "s" {
+		t.Fatalf("metadata = %v", metadata)
+	}
+	assertRecords(t, records, []string{`{"timestamp":1500,"timestamp_original":1.5}`, `{"timestamp":2500,"timestamp_original":2.5}`})
+}
+
+// Unix times in milliseconds or seconds end up as the same session: 90 Hz
+// for two seconds, the headset walking at 1.5 m/s.
+func TestUploadUnixTimestamps(t *testing.T) {
+	chdirTemp(t)
+	start := time.Now().Add(-time.Minute).UnixMilli()
+
+	for _, unit := range []string{"ms", "s"} {
+		key := newTestUploadKey(t)
+		var body strings.Builder
+		for i := range 181 {
+			ms := float64(start) + float64(i)*1000/90
+			ts := strconv.FormatFloat(ms, 'f', 3, 64)
+			if unit == "s" {
+				ts = strconv.FormatFloat(ms/1000, 'f', 6, 64)
+			}
+			fmt.Fprintf(&body, `{"trackerKey":"headset","timestamp":%s,"position":{"x":%g,"y":1.6,"z":0}}`+"\n", ts, float64(i)*1.5/90)
+		}
+		req := withUploadKey(httptest.NewRequest("POST", "/api/upload?timestamp_unit="+unit, strings.NewReader(body.String())), key)
+		rec := httptest.NewRecorder()
+		UploadHandler(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("%s upload: status %d %s", unit, rec.Code, rec.Body.String())
+		}
+
+		req = httptest.NewRequest("GET", "/api/uploads/"+key+"/summary", nil)
+		req.SetPathValue("key", key)
+		rec = httptest.NewRecorder()
+		SummaryHandler(rec, req)
+		var summary struct {
+			Summary sessionSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &summary); err != nil {
+			t.Fatalf("%s: decode summary: %v", unit, err)
+		}
+		headset := summary.Summary.Trackers["headset"]
+		if math.Abs(headset.DurationMs-2000) > 0.01 || math.Abs(headset.SampleRateHz-90) > 0.01 {
+			t.Fatalf("%s: headset summary = %+v", unit, headset)
+		}
+
+		req = httptest.NewRequest("GET", "/api/uploads/"+key+"/kinematics?tracker=headset", nil)
+		req.SetPathValue("key", key)
+		rec = httptest.NewRecorder()
+		KinematicsHandler(rec, req)
+		var kinematics struct {
+			Summary kinematicsSummary `json:"summary"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &kinematics); err != nil {
+			t.Fatalf("%s: decode kinematics: %v", unit, err)
+		}
+		if math.Abs(kinematics.Summary.MaxSpeed-1.5) > 0.01 {
+			t.Fatalf("%s: max speed = %v, want 1.5", unit, kinematics.Summary.MaxSpeed)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// uploadBodyParsers maps the media types accepted by /api/upload to the
+// parser for that body format. Every parser returns one compact JSON record
+// per element, ready to be stored as a line, except for encrypted bodies,
+// whose lines are stored as they are.
+var uploadBodyParsers = map[string]func(io.Reader) ([]string, error){
+	"application/x-ndjson": readRecordLinesOrArray,
+	"application/ndjson":   readRecordLinesOrArray,
+	"application/jsonl":    readRecordLinesOrArray,
+	// fetch() without an explicit header sends strings as text/plain
+	"text/plain":                  readRecordLinesOrArray,
+	"application/json":            readRecordArray,
+	"application/x-hrdemo-packed": readPackedRecords,
+	encryptedUploadType:           readCiphertextLines,
+}
+
+func acceptedUploadTypes() string {
+	types := make([]string, 0, len(uploadBodyParsers))
+	for mediaType := range uploadBodyParsers {
+		types = append(types, mediaType)
+	}
+	sort.Strings(types)
+	return strings.Join(types, ", ")
+}
+
+// readUploadBody parses the request body according to its Content-Type. A
+// missing Content-Type is read as NDJSON, which is what clients sent before
+// the header was checked.
+func readUploadBody(r *http.Request) ([]string, int, string, error) {
+	parse := readRecordLinesOrArray
+	if contentType := r.Header.Get("Content-Type"); contentType != "" {
+		mediaType, _, err := mime.ParseMediaType(contentType)
+		if err != nil {
+			return nil, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, fmt.Errorf("invalid Content-Type %q", contentType)
+		}
+		var ok bool
+		parse, ok = uploadBodyParsers[mediaType]
+		if !ok {
+			return nil, http.StatusUnsupportedMediaType, errCodeUnsupportedMediaType, fmt.Errorf("unsupported Content-Type %q: must be one of %s", mediaType, acceptedUploadTypes())
+		}
+	}
+
+	lines, err := parse(r.Body)
+	if err != nil {
+		return nil, http.StatusBadRequest, errCodeInvalidBody, err
+	}
+	return lines, 0, "", nil
+}
+
+// readRecordLinesOrArray reads NDJSON, or a JSON array if the body starts
+// with '[': some client libraries re-serialize the batch as an array while
+// keeping the NDJSON Content-Type.
+func readRecordLinesOrArray(body io.Reader) ([]string, error) {
+	reader := bufio.NewReader(body)
+	for {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			return []string{}, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("error reading request body: %v", err)
+		}
+		if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+			continue
+		}
+		reader.UnreadByte()
+		if b == '[' {
+			return readRecordArray(reader)
+		}
+		return readRecordLines(reader)
+	}
+}
+
+// readRecordArray reads a JSON array of records, decoding one element at a
+// time so that large batches are never held twice in memory.
+func readRecordArray(body io.Reader) ([]string, error) {
+	decoder := json.NewDecoder(body)
+	if token, err := decoder.Token(); err != nil || token != json.Delim('[') {
+		return nil, errors.New("invalid JSON array body: expected '['")
+	}
+
+	lines := make([]string, 0, 200)
+	for decoder.More() {
+		var record json.RawMessage
+		if err := decoder.Decode(&record); err != nil {
+			return nil, fmt.Errorf("invalid JSON in element %d: %v", len(lines)+1, err)
+		}
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, record); err != nil {
+			return nil, fmt.Errorf("invalid JSON in element %d: %v", len(lines)+1, err)
+		}
+		lines = append(lines, compact.String())
+	}
+
+	if token, err := decoder.Token(); err != nil || token != json.Delim(']') {
+		return nil, errors.New("invalid JSON array body: expected ']'")
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return nil, errors.New("invalid JSON array body: unexpected data after ']'")
+	}
+	return lines, nil
+}
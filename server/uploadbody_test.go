@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func postUpload(t *testing.T, key, contentType, body string) int {
+	t.Helper()
+	req := withUploadKey(httptest.NewRequest("POST", "/api/upload", strings.NewReader(body)), key)
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	rec := httptest.NewRecorder()
+	UploadHandler(rec, req)
+	return rec.Code
+}
+
+func TestUploadContentTypes(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        int
+	}{
+		{"application/x-ndjson", `{"bpm":1}` + "\n" + `{"bpm":2}`, 200},
+		{"application/x-ndjson; charset=utf-8", `{"bpm":3}`, 200},
+		{"", `{"bpm":4}`, 200},
+		{"text/plain;charset=UTF-8", `{"bpm":5}`, 200},
+		{"application/json", "[\n  {\"bpm\": 6},\n  {\"bpm\": 7}\n]", 200},
+		{"application/json", `{"bpm":8}`, 400},
+		{"application/xml", `<bpm>9</bpm>`, 415},
+		{"not a media type;;", `{"bpm":10}`, 415},
+	}
+	for _, tt := range tests {
+		if got := postUpload(t, key, tt.contentType, tt.body); got != tt.want {
+			t.Fatalf("Content-Type %q: status = %d, want %d", tt.contentType, got, tt.want)
+		}
+	}
+
+	_, _, records := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, records, []string{
+		`{"bpm":1}`, `{"bpm":2}`, `{"bpm":3}`, `{"bpm":4}`, `{"bpm":5}`, `{"bpm":6}`, `{"bpm":7}`,
+	})
+}
+
+func TestUploadJSONArrayBody(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+
+	tests := []struct {
+		contentType string
+		body        string
+		want        int
+	}{
+		// re-serialized batches keep the NDJSON type
+		{"application/x-ndjson", "  \n[{\"bpm\":1},\n {\"bpm\":2}]", 200},
+		{"", `[{"bpm":3}]`, 200},
+		{"application/json", `[]`, 200},
+		{"application/json", `[{"bpm":4}] {"bpm":5}`, 400},
+		{"application/json", `[{"bpm":4},`, 400},
+		{"application/x-ndjson", `[{"bpm":4}`, 400},
+	}
+	for _, tt := range tests {
+		if got := postUpload(t, key, tt.contentType, tt.body); got != tt.want {
+			t.Fatalf("Content-Type %q, body %q: status = %d, want %d", tt.contentType, tt.body, got, tt.want)
+		}
+	}
+
+	_, _, records := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, records, []string{`{"bpm":1}`, `{"bpm":2}`, `{"bpm":3}`})
+}
@@ -0,0 +1,166 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The upload index holds what GET /uploads filters on for every stored
+// upload, so listing doesn't read all the uploads each time. It is built at
+// startup and brought up to date on every listing: uploads whose file or
+// linked labels changed since are read again, from where the index left
+// off if the upload only grew. Cold uploads are indexed from their .cold
+// file rather than rehydrated.
+
+// uploadIndexEntry is what the index knows of one upload.
+type uploadIndexEntry struct {
+	uploadKey  string
+	receivedAt time.Time
+	records    int
+	lastIndex  int
+	trackers   []string
+	labels     map[string]string
+
+	// what the entry was read from, to notice changes
+	size      int64
+	modTime   time.Time
+	labelsMod time.Time
+	cold      bool
+}
+
+var (
+	uploadIndexMutex sync.Mutex
+	uploadIndex      = map[string]*uploadIndexEntry{}
+)
+
+// BuildUploadIndex reads every stored upload into the index that GET
+// /uploads searches. Without it the index is built on the first listing.
+func BuildUploadIndex() error {
+	start := time.Now()
+	entries, err := indexedUploads()
+	if err != nil {
+		return err
+	}
+	log.Printf("indexed %d uploads in %s", len(entries), time.Since(start).Round(time.Millisecond))
+	return nil
+}
+
+// indexedUploads brings the index up to date and returns a copy of its
+// entries.
+func indexedUploads() ([]uploadIndexEntry, error) {
+	keys, err := listUploadKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	uploadIndexMutex.Lock()
+	defer uploadIndexMutex.Unlock()
+	stored := map[string]bool{}
+	entries := make([]uploadIndexEntry, 0, len(keys))
+	for _, uploadKey := range keys {
+		stored[uploadKey] = true
+		entry, err := refreshIndexEntry(uploadKey, uploadIndex[uploadKey])
+		if err != nil {
+			log.Printf("failed to index upload key_hash=%s: %v", uploadKeyHash(uploadKey), err)
+			delete(uploadIndex, uploadKey)
+			continue
+		}
+		uploadIndex[uploadKey] = entry
+		entries = append(entries, *entry)
+	}
+	for uploadKey := range uploadIndex {
+		if !stored[uploadKey] {
+			delete(uploadIndex, uploadKey)
+		}
+	}
+	return entries, nil
+}
+
+// refreshIndexEntry returns entry, or a new entry if the upload changed
+// since entry was read or entry is nil.
+func refreshIndexEntry(uploadKey string, entry *uploadIndexEntry) (*uploadIndexEntry, error) {
+	filePath := uploadFilePath(uploadKey)
+	stat, err := os.Stat(filePath)
+	if err != nil {
+		return nil, err
+	}
+	var labelsMod time.Time
+	if labelsStat, err := os.Stat(linkedLabelsPath(uploadKey)); err == nil {
+		labelsMod = labelsStat.ModTime()
+	}
+	info, err := readColdInfo(filePath)
+	cold := err == nil
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if entry != nil && entry.size == stat.Size() && entry.modTime.Equal(stat.ModTime()) && entry.cold == cold {
+		if !entry.labelsMod.Equal(labelsMod) {
+			updated := *entry
+			updated.labelsMod = labelsMod
+			updated.labels = indexedLabels(uploadKey, filePath)
+			return &updated, nil
+		}
+		return entry, nil
+	}
+
+	updated := &uploadIndexEntry{uploadKey: uploadKey, size: stat.Size(), modTime: stat.ModTime(), labelsMod: labelsMod, cold: cold}
+	metadata, err := readUploadMetadata(filePath)
+	if err != nil {
+		return nil, err
+	}
+	updated.receivedAt, _ = time.Parse(time.RFC3339Nano, metadata.ReceivedAt)
+	updated.labels = sessionLabels(uploadKey, metadata.Labels)
+
+	if cold {
+		updated.records, updated.lastIndex = info.Records, info.Records
+		updated.trackers = info.Trackers
+		return updated, nil
+	}
+
+	// an upload that only grew is read on from the last record indexed
+	after := 0
+	if entry != nil && !entry.cold && stat.Size() > entry.size {
+		after = entry.lastIndex
+		updated.records, updated.lastIndex = entry.records, entry.lastIndex
+		updated.trackers = slices.Clone(entry.trackers)
+	}
+	err = scanUploadFileFrom(filePath, after, func(index int, payload []byte) error {
+		updated.records++
+		updated.lastIndex = max(updated.lastIndex, index)
+		if tracker := payloadTrackerKey(payload); tracker != "" && !slices.Contains(updated.trackers, tracker) {
+			updated.trackers = append(updated.trackers, tracker)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("scan upload: %w", err)
+	}
+	slices.Sort(updated.trackers)
+	return updated, nil
+}
+
+func indexedLabels(uploadKey, filePath string) map[string]string {
+	metadata, err := readUploadMetadata(filePath)
+	if err != nil {
+		log.Printf("failed to read metadata for upload index key_hash=%s: %v", uploadKeyHash(uploadKey), err)
+	}
+	return sessionLabels(uploadKey, metadata.Labels)
+}
+
+// payloadTrackerKey returns the trackerKey of a record, or "" if it has
+// none.
+func payloadTrackerKey(payload []byte) string {
+	var record struct {
+		TrackerKey string `json:"trackerKey"`
+	}
+	if err := json.Unmarshal(payload, &record); err != nil {
+		return ""
+	}
+	return record.TrackerKey
+}
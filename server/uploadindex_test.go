@@ -0,0 +1,67 @@
+package server
+
+import (
+	"os"
+	"slices"
+	"testing"
+	"time"
+)
+
+func indexEntry(t *testing.T, uploadKey string) uploadIndexEntry {
+	t.Helper()
+	entries, err := indexedUploads()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		if entry.uploadKey == uploadKey {
+			return entry
+		}
+	}
+	t.Fatalf("upload %s is not indexed", uploadNameFromKey(uploadKey))
+	return uploadIndexEntry{}
+}
+
+func TestUploadIndex(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	filePath := simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":1,"position":{"x":0,"y":1.7,"z":0}}`})
+	if err := BuildUploadIndex(); err != nil {
+		t.Fatal(err)
+	}
+	if entry := indexEntry(t, key); entry.records != 1 || !slices.Equal(entry.trackers, []string{"headset"}) {
+		t.Fatalf("indexed records = %d, trackers = %v", entry.records, entry.trackers)
+	}
+
+	// the index reads on from where it left off
+	simulateUpload(t, key, []string{`{"trackerKey":"left","timestamp":2,"position":{"x":0,"y":1,"z":0}}`, `{"bpm":70}`})
+	if entry := indexEntry(t, key); entry.records != 3 || !slices.Equal(entry.trackers, []string{"headset", "left"}) {
+		t.Fatalf("indexed records after append = %d, trackers = %v", entry.records, entry.trackers)
+	}
+
+	if status, response := patchLabels(t, key, `{"participant":"P017"}`); status != 200 {
+		t.Fatalf("patch status = %d: %v", status, response)
+	}
+	if entry := indexEntry(t, key); entry.labels[participantLabel] != "P017" {
+		t.Fatalf("indexed labels = %v", entry.labels)
+	}
+
+	// cold uploads are indexed from their .cold file
+	setTestColdStorage(t, t.TempDir())
+	endTestSession(key)
+	if err := freezeUpload(key, time.Now().Add(48*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	if entry := indexEntry(t, key); !entry.cold || entry.records != 3 || !slices.Equal(entry.trackers, []string{"headset", "left"}) {
+		t.Fatalf("indexed cold upload = %+v", entry)
+	}
+	if _, err := os.Stat(coldInfoPath(filePath)); err != nil {
+		t.Fatalf("listing rehydrated the upload: %v", err)
+	}
+
+	os.Remove(filePath)
+	entries, err := indexedUploads()
+	if err != nil || len(entries) != 0 {
+		t.Fatalf("entries after removing the upload = %v, %v", entries, err)
+	}
+}
@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// uploadListEntry describes one stored upload in GET /uploads. Uploads are
+// listed by name and key hash only; the key itself is a credential. The
+// name stands in for the key in /uploads/{key}/... paths and erasures.
+type uploadListEntry struct {
+	UploadName  string            `json:"upload_name"`
+	KeyHash     string            `json:"key_hash"`
+	ReceivedAt  string            `json:"received_at,omitempty"`
+	Records     int               `json:"records"`
+	Trackers    []string          `json:"trackers"`
+	Participant string            `json:"participant,omitempty"`
+	Labels      map[string]string `json:"labels"`
+}
+
+// uploadFilter is what GET /uploads narrows the list down by. Every part
+// that is set has to match.
+type uploadFilter struct {
+	labels     map[string]string // name=value labels
+	anyLabels  []string          // labels given by value or name only
+	from, to   time.Time         // received at, to exclusive
+	minRecords int
+	maxRecords int // 0 for no limit
+	trackers   []string
+}
+
+// parseUploadFilter reads the filter of GET /uploads:
+//
+//	label=name=value  an upload label; repeatable
+//	label=studyA      a label with that value, or of that name
+//	participant=P017  the linked participant
+//	from=2024-06-01   received on or after, a date or RFC 3339 time
+//	to=2024-06-30     received on or before; a date includes the whole day
+//	min_records=1000  at least that many records
+//	max_records=5000  at most that many records
+//	tracker=headset   has samples of the tracker; repeatable
+func parseUploadFilter(query url.Values) (uploadFilter, error) {
+	filter := uploadFilter{labels: map[string]string{}}
+	for _, raw := range query["label"] {
+		if !strings.Contains(raw, "=") {
+			if raw == "" {
+				return uploadFilter{}, errors.New("invalid label: must not be empty")
+			}
+			filter.anyLabels = append(filter.anyLabels, raw)
+			continue
+		}
+		name, value, err := parseUploadLabel(raw)
+		if err != nil {
+			return uploadFilter{}, err
+		}
+		if existing, ok := filter.labels[name]; ok && existing != value {
+			return uploadFilter{}, fmt.Errorf("invalid labels: %q is given more than once", name)
+		}
+		filter.labels[name] = value
+	}
+	if raw := query.Get("participant"); raw != "" {
+		id, err := parseParticipantID(raw)
+		if err != nil {
+			return uploadFilter{}, err
+		}
+		filter.labels[participantLabel] = id
+	}
+
+	var err error
+	if raw := query.Get("from"); raw != "" {
+		if filter.from, _, err = parseFilterTime(raw); err != nil {
+			return uploadFilter{}, fmt.Errorf("invalid from parameter %q: %w", raw, err)
+		}
+	}
+	if raw := query.Get("to"); raw != "" {
+		var date bool
+		if filter.to, date, err = parseFilterTime(raw); err != nil {
+			return uploadFilter{}, fmt.Errorf("invalid to parameter %q: %w", raw, err)
+		}
+		if date {
+			filter.to = filter.to.AddDate(0, 0, 1)
+		} else {
+			filter.to = filter.to.Add(time.Nanosecond)
+		}
+	}
+
+	for name, limit := range map[string]*int{"min_records": &filter.minRecords, "max_records": &filter.maxRecords} {
+		raw := query.Get(name)
+		if raw == "" {
+			continue
+		}
+		n, err := strconv.Atoi(raw)
+		if err != nil || n < 0 {
+			return uploadFilter{}, fmt.Errorf("invalid %s parameter %q: must be a non-negative integer", name, raw)
+		}
+		*limit = n
+	}
+	filter.trackers = query["tracker"]
+	return filter, nil
+}
+
+// parseFilterTime parses a date, in UTC, or an RFC 3339 time, reporting
+// whether it was a date.
+func parseFilterTime(raw string) (time.Time, bool, error) {
+	if t, err := time.Parse(time.DateOnly, raw); err == nil {
+		return t, true, nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, raw)
+	if err != nil {
+		return time.Time{}, false, errors.New("must be a date such as 2024-06-01 or an RFC 3339 time")
+	}
+	return t, false, nil
+}
+
+func (f uploadFilter) matches(entry uploadIndexEntry) bool {
+	if !f.from.IsZero() && entry.receivedAt.Before(f.from) {
+		return false
+	}
+	if !f.to.IsZero() && !entry.receivedAt.Before(f.to) {
+		return false
+	}
+	if entry.records < f.minRecords || f.maxRecords > 0 && entry.records > f.maxRecords {
+		return false
+	}
+	for _, tracker := range f.trackers {
+		if !slices.Contains(entry.trackers, tracker) {
+			return false
+		}
+	}
+	if !hasLabels(entry.labels, f.labels) {
+		return false
+	}
+	for _, label := range f.anyLabels {
+		if _, ok := entry.labels[label]; !ok && !slices.Contains(slices.Collect(maps.Values(entry.labels)), label) {
+			return false
+		}
+	}
+	return true
+}
+
+// UploadsHandler lists the stored uploads, newest first, narrowed down by
+// the filter parseUploadFilter reads, counting the labels linked
+// afterwards.
+func UploadsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	filter, err := parseUploadFilter(r.URL.Query())
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	entries, err := indexedUploads()
+	if err != nil {
+		log.Printf("failed to list uploads: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to list uploads")
+		return
+	}
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].receivedAt.After(entries[j].receivedAt)
+	})
+
+	uploads := []uploadListEntry{}
+	for _, entry := range entries {
+		if !filter.matches(entry) {
+			continue
+		}
+		upload := uploadListEntry{
+			UploadName:  uploadNameFromKey(entry.uploadKey),
+			KeyHash:     uploadKeyHash(entry.uploadKey),
+			Records:     entry.records,
+			Trackers:    entry.trackers,
+			Participant: entry.labels[participantLabel],
+			Labels:      entry.labels,
+		}
+		if !entry.receivedAt.IsZero() {
+			upload.ReceivedAt = entry.receivedAt.UTC().Format(time.RFC3339Nano)
+		}
+		if upload.Trackers == nil {
+			upload.Trackers = []string{}
+		}
+		if upload.Labels == nil {
+			upload.Labels = map[string]string{}
+		}
+		uploads = append(uploads, upload)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]any{"status": "ok", "uploads": uploads}); err != nil {
+		log.Printf("failed to write upload list: %v", err)
+	}
+}
+
+// hasLabels reports whether labels has every label in want.
+func hasLabels(labels, want map[string]string) bool {
+	for name, value := range want {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUploadsList(t *testing.T) {
+	chdirTemp(t)
+	first, second := newTestUploadKey(t), newTestUploadKey(t)
+	simulateUpload(t, first, []string{`{"bpm":70}`})
+	simulateUpload(t, second, []string{
+		`{"trackerKey":"headset","timestamp":1,"position":{"x":0,"y":1.7,"z":0}}`,
+		`{"trackerKey":"left","timestamp":1,"position":{"x":0,"y":1,"z":0}}`,
+	})
+	patchLabels(t, first, `{"participant":"P017","labels":{"study":"a"}}`)
+	patchLabels(t, second, `{"labels":{"study":"a"}}`)
+
+	for query, want := range map[string][]string{
+		"":                               {first, second},
+		"?label=study=a":                 {first, second},
+		"?participant=P017":              {first},
+		"?label=study=a&participant=P1":  {},
+		"?label=study=b":                 {},
+		"?label=P017":                    {first},
+		"?label=study":                   {first, second},
+		"?tracker=headset":               {second},
+		"?tracker=headset&tracker=right": {},
+		"?min_records=2":                 {second},
+		"?max_records=1":                 {first},
+		"?from=2000-01-01":               {first, second},
+		"?from=2999-01-01":               {},
+		"?to=2000-01-01":                 {},
+		"?to=" + time.Now().UTC().Format(time.DateOnly): {first, second},
+	} {
+		rec := httptest.NewRecorder()
+		UploadsHandler(rec, httptest.NewRequest("GET", "/api/uploads"+query, nil))
+		var response struct {
+			Uploads []uploadListEntry `json:"uploads"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("%s: %v: %s", query, err, rec.Body)
+		}
+		got := map[string]bool{}
+		for _, upload := range response.Uploads {
+			got[upload.KeyHash] = true
+		}
+		if len(got) != len(want) {
+			t.Errorf("uploads%s = %+v, want %d", query, response.Uploads, len(want))
+		}
+		for _, key := range want {
+			if !got[uploadKeyHash(key)] {
+				t.Errorf("uploads%s misses %s", query, uploadNameFromKey(key))
+			}
+		}
+	}
+
+	for _, query := range []string{"?label=Study=a", "?from=June", "?min_records=-1"} {
+		rec := httptest.NewRecorder()
+		UploadsHandler(rec, httptest.NewRequest("GET", "/api/uploads"+query, nil))
+		if rec.Code != 400 {
+			t.Errorf("uploads%s: status = %d, want 400", query, rec.Code)
+		}
+	}
+}
+
+func TestUploadsListNamesAddressUploads(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"trackerKey":"headset","timestamp":1,"position":{"x":0,"y":1.7,"z":0}}`})
+
+	rec := httptest.NewRecorder()
+	UploadsHandler(rec, httptest.NewRequest("GET", "/api/uploads", nil))
+	var response struct {
+		Uploads []uploadListEntry `json:"uploads"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil || len(response.Uploads) != 1 {
+		t.Fatalf("uploads = %s (%v)", rec.Body, err)
+	}
+	name := response.Uploads[0].UploadName
+
+	// what the list gives is enough to export, replay and erase the upload
+	mux := http.NewServeMux()
+	RegisterRoutes(mux)
+	for _, path := range []string{"/export", "/trajectory", "/replay?speed=100", "/tail"} {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", "/api/v1/uploads/"+url.PathEscape(name)+path, nil))
+		if rec.Code != 200 || !strings.Contains(rec.Body.String(), `"headset"`) {
+			t.Errorf("GET %s by name: status = %d: %s", path, rec.Code, rec.Body)
+		}
+	}
+	erase(t, `{"upload_key":"`+name+`"}`)
+	if _, err := os.Stat(uploadFilePath(key)); !os.IsNotExist(err) {
+		t.Fatalf("upload erased by name still stored: %v", err)
+	}
+}
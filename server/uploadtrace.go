@@ -0,0 +1,140 @@
+package server
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Upload tracing records upload requests exactly as clients sent them, to
+// reproduce client-side encoding bugs: each request's headers, raw body and
+// the status it got are appended to a trace file per upload key, which
+// "hrdemo replay" can send to another server. Traces hold the upload keys
+// and the records, so the trace directory is only readable by the server's
+// user.
+
+// maxTracedBodyBytes is how much of a request body a trace keeps; larger
+// bodies are still handled in full but traced truncated.
+const maxTracedBodyBytes = 32 * 1024 * 1024
+
+// untracedHeaders carry credentials, which traces leave out.
+var untracedHeaders = []string{"Authorization", "Cookie", "Proxy-Authorization"}
+
+var (
+	traceDir   string // empty if tracing is disabled
+	traceMutex sync.Mutex
+)
+
+// uploadTraceEntry is one traced request, a line of a trace file.
+type uploadTraceEntry struct {
+	Time          time.Time   `json:"time"`
+	Method        string      `json:"method"`
+	Path          string      `json:"path"`
+	Query         string      `json:"query"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body"`
+	BodyTruncated bool        `json:"body_truncated,omitempty"`
+	Status        int         `json:"status"`
+}
+
+// SetUploadTraceDir enables upload tracing, appending the requests for each
+// upload key to <dir>/<key hash>.ndjson.
+func SetUploadTraceDir(dir string) error {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return fmt.Errorf("create trace directory: %w", err)
+	}
+	traceDir = dir
+	return nil
+}
+
+// uploadTracePath returns the trace file for the upload key a request names.
+func uploadTracePath(r *http.Request) string {
+	name := "invalid-key"
+	if uploadKey, err := parseUploadKey(presentedUploadKey(r)); err == nil {
+		name = uploadKeyHash(uploadKey)
+	} else if id := r.Header.Get("X-Upload-Id"); id != "" {
+		if _, err := hex.DecodeString(id); err == nil && len(id) <= 64 {
+			name = "signed-" + id
+		}
+	}
+	return filepath.Join(traceDir, name+".ndjson")
+}
+
+// traceUploads records the requests handled by handler while tracing is
+// enabled.
+func traceUploads(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if traceDir == "" {
+			handler(w, r)
+			return
+		}
+
+		entry := uploadTraceEntry{
+			Time:   time.Now().UTC(),
+			Method: r.Method,
+			Path:   r.URL.Path,
+			Query:  r.URL.RawQuery,
+			Header: r.Header.Clone(),
+		}
+		for _, name := range untracedHeaders {
+			entry.Header.Del(name)
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, maxTracedBodyBytes+1))
+		if len(body) > maxTracedBodyBytes {
+			entry.BodyTruncated = true
+		}
+		entry.Body = body[:min(len(body), maxTracedBodyBytes)]
+		// the handler reads the body as sent, including a read error
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), errorReader{err}, r.Body), r.Body}
+
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		handler(lw, r)
+		entry.Status = lw.status
+		if entry.Status == 0 {
+			entry.Status = http.StatusOK
+		}
+
+		if err := appendUploadTrace(uploadTracePath(r), entry); err != nil {
+			log.Printf("failed to write upload trace: %v", err)
+		}
+	}
+}
+
+// errorReader fails reads with err, or ends the stream if err is nil.
+type errorReader struct{ err error }
+
+func (r errorReader) Read([]byte) (int, error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	return 0, io.EOF
+}
+
+func appendUploadTrace(path string, entry uploadTraceEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	traceMutex.Lock()
+	defer traceMutex.Unlock()
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(append(data, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
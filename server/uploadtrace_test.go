@@ -0,0 +1,67 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTraceUploads(t *testing.T) {
+	chdirTemp(t)
+	if err := SetUploadTraceDir("traces"); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { traceDir = "" })
+
+	key := newTestUploadKey(t)
+	upload := func(body string) int {
+		req := withUploadKey(httptest.NewRequest("POST", "/api/v1/upload", strings.NewReader(body)), key)
+		req.Header.Set("Content-Type", "application/x-ndjson")
+		req.Header.Set("Authorization", "Bearer secret")
+		rec := httptest.NewRecorder()
+		traceUploads(UploadHandler)(rec, req)
+		return rec.Code
+	}
+	if code := upload("{\"bpm\":70}\r\n{\"bpm\":71}\r\n"); code != 200 {
+		t.Fatalf("upload: status %d", code)
+	}
+	if code := upload("{\"bpm\":"); code != 400 {
+		t.Fatalf("broken upload: status %d", code)
+	}
+	// the traced handler still sees the whole body
+	_, _, lines := readUploadFile(t, uploadFilePath(key))
+	assertRecords(t, lines, []string{`{"bpm":70}`, `{"bpm":71}`})
+
+	file, err := os.Open(filepath.Join("traces", uploadKeyHash(key)+".ndjson"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []uploadTraceEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry uploadTraceEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) != 2 {
+		t.Fatalf("traced %d requests, want 2", len(entries))
+	}
+	first := entries[0]
+	if string(first.Body) != "{\"bpm\":70}\r\n{\"bpm\":71}\r\n" || first.Status != 200 || first.Path != "/api/v1/upload" || first.Header.Get("X-Upload-Key") != key {
+		t.Fatalf("first trace entry = %+v", first)
+	}
+	if first.Header.Get("Content-Type") != "application/x-ndjson" || first.Header.Get("Authorization") != "" {
+		t.Fatalf("traced headers = %v", first.Header)
+	}
+	if entries[1].Status != 400 || string(entries[1].Body) != "{\"bpm\":" {
+		t.Fatalf("second trace entry = %+v", entries[1])
+	}
+}
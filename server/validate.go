@@ -0,0 +1,228 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+)
+
+// Validation checks a stored upload the way ingest would check it now, for
+// uploads stored before a check existed or under laxer settings: the file
+// itself (as fsck does), the fields of every record, the timestamp order of
+// each tracker and gaps in the recording.
+
+// validationProblem is a record that fails a schema check.
+type validationProblem struct {
+	Record  int    `json:"record"`
+	Kind    string `json:"kind"`
+	Message string `json:"message"`
+}
+
+// Kinds of validation problems.
+const (
+	problemNotObject         = "not_object"
+	problemInvalidField      = "invalid_field"
+	problemIncompleteTracker = "incomplete_tracker_record"
+)
+
+// maxQuaternionNormError is how far a rotation's norm may be from 1.
+const maxQuaternionNormError = 0.05
+
+// validateRecord returns the schema problems of a record payload.
+func validateRecord(index int, payload []byte) []validationProblem {
+	var record map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &record); err != nil || record == nil {
+		return []validationProblem{{index, problemNotObject, "record is not a JSON object"}}
+	}
+
+	var problems []validationProblem
+	invalid := func(format string, args ...any) {
+		problems = append(problems, validationProblem{index, problemInvalidField, fmt.Sprintf(format, args...)})
+	}
+	for _, name := range []string{"timestamp", "epoch", "bpm"} {
+		raw, ok := record[name]
+		if !ok {
+			continue
+		}
+		var value float64
+		if err := json.Unmarshal(raw, &value); err != nil || string(raw) == "null" {
+			invalid("%s is %s, not a number", name, raw)
+		} else if value < 0 || name == "bpm" && value == 0 {
+			invalid("%s is %s, must be positive", name, raw)
+		}
+	}
+
+	tracker, isTracker := record["trackerKey"]
+	if isTracker {
+		var key string
+		if err := json.Unmarshal(tracker, &key); err != nil || key == "" {
+			invalid("trackerKey is %s, not a non-empty string", tracker)
+		}
+		if record["timestamp"] == nil || record["position"] == nil {
+			problems = append(problems, validationProblem{index, problemIncompleteTracker, "tracker record without timestamp or position"})
+		}
+	}
+	if raw, ok := record["position"]; ok {
+		if _, ok := numericComponents(raw, "x", "y", "z"); !ok {
+			invalid("position is %s, not an object with numeric x, y and z", raw)
+		}
+	}
+	if raw, ok := record["rotation"]; ok {
+		components, ok := numericComponents(raw, "x", "y", "z", "w")
+		if !ok {
+			invalid("rotation is %s, not an object with numeric x, y, z and w", raw)
+		} else if norm := math.Sqrt(components[0]*components[0] + components[1]*components[1] + components[2]*components[2] + components[3]*components[3]); math.Abs(norm-1) > maxQuaternionNormError {
+			invalid("rotation has norm %.3f, not a unit quaternion", norm)
+		}
+	}
+	return problems
+}
+
+// numericComponents reads the named numeric fields of a JSON object.
+func numericComponents(raw json.RawMessage, names ...string) ([]float64, bool) {
+	var object map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &object); err != nil {
+		return nil, false
+	}
+	components := make([]float64, len(names))
+	for i, name := range names {
+		if err := json.Unmarshal(object[name], &components[i]); err != nil {
+			return nil, false
+		}
+	}
+	return components, true
+}
+
+// ValidateHandler checks a stored upload and reports what it found: file
+// problems, records failing the schema, timestamps going backwards per
+// tracker and gaps longer than gap_ms. valid is false if anything but gaps
+// was found. Encrypted uploads only get the file checks.
+func ValidateHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		panic("only POST allowed")
+	}
+
+	uploadKey, status, code, err := resolveUploadRef(r.PathValue("key"))
+	if err != nil {
+		writeError(w, status, code, err.Error())
+		return
+	}
+	gapThresholdMs, err := parseGapThreshold(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, errCodeInvalidParameter, err.Error())
+		return
+	}
+
+	filePath := uploadFilePath(uploadKey)
+	err = ensureHot(filePath)
+	var metadata uploadMetadata
+	if err == nil {
+		metadata, err = readUploadMetadata(filePath)
+	}
+	var fileReport fsckReport
+	if err == nil {
+		fileReport, err = checkUploadFile(filePath)
+	}
+	if errors.Is(err, errUploadNotFound) {
+		writeError(w, http.StatusNotFound, errCodeUploadNotFound, err.Error())
+		return
+	}
+	if err != nil {
+		log.Printf("failed to check upload for validation: %v", err)
+		writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+		return
+	}
+	fileProblems := fileReport.Problems
+	if fileProblems == nil {
+		fileProblems = []fsckProblem{}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"upload_name": uploadNameFromKey(uploadKey),
+		"records":     fileReport.Records,
+		"file": map[string]any{
+			"problem_count": len(fileProblems),
+			"problems":      fileProblems[:min(len(fileProblems), maxReportedViolations)],
+		},
+	}
+	valid := len(fileProblems) == 0
+
+	if metadata.Encryption != nil {
+		response["encrypted"] = true
+	} else {
+		schemaProblems := []validationProblem{}
+		schemaProblemCount := 0
+		violations := []orderViolation{}
+		violationCount := 0
+		last := map[string]float64{}
+		samples := map[string][]trackerSample{}
+		// bad lines were reported by the file check already
+		_, err := scanUploadFileLenient(filePath, func(record recordLine) error {
+			problems := validateRecord(record.Index, record.Payload)
+			schemaProblemCount += len(problems)
+			schemaProblems = append(schemaProblems, problems[:min(len(problems), maxReportedViolations-len(schemaProblems))]...)
+
+			if tracker, timestamp, ok := recordTrackerTime(record.Payload); ok {
+				if previous, seen := last[tracker]; seen && timestamp < previous {
+					violationCount++
+					if len(violations) < maxReportedViolations {
+						violations = append(violations, orderViolation{Record: record.Index, TrackerKey: tracker, Timestamp: timestamp, Previous: previous})
+					}
+				} else {
+					last[tracker] = timestamp
+				}
+			}
+			if sample, ok := parseTrackerSample(record.Index, record.Payload); ok {
+				samples[sample.TrackerKey] = append(samples[sample.TrackerKey], sample)
+			}
+			return nil
+		}, func(fsckProblem) {})
+		if err != nil {
+			log.Printf("failed to read upload for validation: %v", err)
+			writeError(w, http.StatusInternalServerError, errCodeInternal, "failed to read upload file")
+			return
+		}
+
+		trackerGaps := make(map[string][]gapInterval, len(samples))
+		flagged := false
+		for tracker, trackerSamples := range samples {
+			gaps := findGaps(trackerSamples, gapThresholdMs)
+			if gaps == nil {
+				gaps = []gapInterval{}
+			}
+			trackerGaps[tracker] = gaps
+			flagged = flagged || len(gaps) > 0
+		}
+		sessionGaps := findGaps(mergeTrackerSamples(samples), gapThresholdMs)
+		if sessionGaps == nil {
+			sessionGaps = []gapInterval{}
+		}
+
+		response["schema"] = map[string]any{
+			"problem_count": schemaProblemCount,
+			"problems":      schemaProblems,
+		}
+		// records are given by their stored index here
+		response["order"] = map[string]any{
+			"violation_count": violationCount,
+			"violations":      violations,
+		}
+		response["gaps"] = map[string]any{
+			"gap_threshold_ms": gapThresholdMs,
+			"flagged":          flagged,
+			"trackers":         trackerGaps,
+			"session":          sessionGaps,
+		}
+		valid = valid && schemaProblemCount == 0 && violationCount == 0
+	}
+	response["valid"] = valid
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write validation response: %v", err)
+	}
+}
@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func validateUpload(t *testing.T, key, query string) (int, map[string]any) {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/api/uploads/"+key+"/validate"+query, nil)
+	req.SetPathValue("key", key)
+	rec := httptest.NewRecorder()
+	ValidateHandler(rec, req)
+	var response map[string]any
+	json.NewDecoder(rec.Body).Decode(&response)
+	return rec.Code, response
+}
+
+func TestValidateRecord(t *testing.T) {
+	tests := []struct {
+		payload string
+		kinds   []string
+	}{
+		{`{"trackerKey":"head","timestamp":1,"position":{"x":0,"y":1.6,"z":0},"rotation":{"x":0,"y":0,"z":0,"w":1}}`, nil},
+		{`{"bpm":72,"epoch":1760000000000}`, nil},
+		{`[1,2]`, []string{problemNotObject}},
+		{`{"bpm":"fast"}`, []string{problemInvalidField}},
+		{`{"bpm":0}`, []string{problemInvalidField}},
+		{`{"trackerKey":"head","timestamp":-1,"position":{"x":0,"y":"1","z":0}}`, []string{problemInvalidField, problemInvalidField}},
+		{`{"trackerKey":"head","timestamp":1}`, []string{problemIncompleteTracker}},
+		{`{"trackerKey":"head","timestamp":1,"position":{"x":0,"y":0,"z":0},"rotation":{"x":0,"y":0,"z":0,"w":2}}`, []string{problemInvalidField}},
+	}
+	for _, test := range tests {
+		problems := validateRecord(1, []byte(test.payload))
+		var kinds []string
+		for _, problem := range problems {
+			kinds = append(kinds, problem.Kind)
+		}
+		if len(kinds) != len(test.kinds) || len(kinds) > 0 && kinds[0] != test.kinds[0] {
+			t.Errorf("validateRecord(%s) = %v, want kinds %v", test.payload, problems, test.kinds)
+		}
+	}
+}
+
+func TestValidateHandler(t *testing.T) {
+	chdirTemp(t)
+
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"head","timestamp":1,"position":{"x":0,"y":1.6,"z":0}}`,
+		`{"trackerKey":"head","timestamp":1.01,"position":{"x":0,"y":1.6,"z":0}}`,
+		`{"trackerKey":"head","timestamp":1.5,"position":{"x":0,"y":1.6,"z":0}}`,
+	})
+	code, response := validateUpload(t, key, "?gap_ms=0.2")
+	gaps, _ := response["gaps"].(map[string]any)
+	if code != 200 || response["valid"] != true || response["records"] != float64(3) || gaps["flagged"] != true {
+		t.Fatalf("validate clean upload: status %d, %v", code, response)
+	}
+
+	// records stored before checks were made, and a torn last line
+	simulateUpload(t, key, []string{
+		`{"trackerKey":"head","timestamp":1.2,"position":{"x":0,"y":1.6,"z":0}}`,
+		`{"bpm":"fast"}`,
+	})
+	file, err := os.OpenFile(uploadFilePath(key), os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.WriteString(`6,{"bpm":`)
+	file.Close()
+
+	code, response = validateUpload(t, key, "")
+	if code != 200 || response["valid"] != false {
+		t.Fatalf("validate broken upload: status %d, %v", code, response)
+	}
+	fileReport := response["file"].(map[string]any)
+	schema := response["schema"].(map[string]any)
+	order := response["order"].(map[string]any)
+	if fileReport["problem_count"] == float64(0) || schema["problem_count"] != float64(1) || order["violation_count"] != float64(1) {
+		t.Fatalf("validate broken upload: %v", response)
+	}
+	violation := order["violations"].([]any)[0].(map[string]any)
+	if violation["record"] != float64(4) || violation["previous"] != 1.5 {
+		t.Fatalf("order violation = %v", violation)
+	}
+
+	if code, _ := validateUpload(t, newTestUploadKey(t), ""); code != 404 {
+		t.Fatalf("validate missing upload: status %d", code)
+	}
+	if code, _ := validateUpload(t, key, "?gap_ms=-1"); code != 400 {
+		t.Fatalf("validate with bad gap_ms: status %d", code)
+	}
+}
@@ -0,0 +1,103 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"sync"
+)
+
+// Build information, set at link time, e.g.
+//
+//	go build -ldflags "-X github.com/VR-state-analysis/HR-Demo-App/server.Commit=$(git rev-parse HEAD)"
+//
+// Anything left empty is filled in from the build info embedded by the Go
+// toolchain, where available.
+var (
+	Version   string
+	Commit    string
+	BuildDate string
+)
+
+type buildInfo struct {
+	Version   string `json:"version"`
+	Commit    string `json:"commit"`
+	BuildDate string `json:"build_date"`
+	Modified  bool   `json:"modified,omitempty"`
+	GoVersion string `json:"go_version"`
+}
+
+var currentBuildInfo = sync.OnceValue(func() buildInfo {
+	info := buildInfo{
+		Version:   Version,
+		Commit:    Commit,
+		BuildDate: BuildDate,
+		GoVersion: runtime.Version(),
+	}
+
+	if embedded, ok := debug.ReadBuildInfo(); ok {
+		if info.Version == "" && embedded.Main.Version != "(devel)" {
+			info.Version = embedded.Main.Version
+		}
+		for _, setting := range embedded.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if info.Commit == "" {
+					info.Commit = setting.Value
+				}
+			case "vcs.time":
+				if info.BuildDate == "" {
+					info.BuildDate = setting.Value
+				}
+			case "vcs.modified":
+				info.Modified = setting.Value == "true"
+			}
+		}
+	}
+
+	if info.Version == "" {
+		info.Version = "dev"
+	}
+	return info
+})
+
+// VersionString describes the running build in one line, for logs and upload
+// metadata.
+func VersionString() string {
+	info := currentBuildInfo()
+	s := info.Version
+	if info.Commit != "" {
+		commit := info.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		s += " (" + commit
+		if info.Modified {
+			s += "+dirty"
+		}
+		s += ")"
+	}
+	if info.BuildDate != "" {
+		s += " built " + info.BuildDate
+	}
+	return s
+}
+
+func VersionHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		panic("only GET allowed")
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	response := map[string]any{
+		"status":      "ok",
+		"build":       currentBuildInfo(),
+		"api_version": apiVersion,
+	}
+
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Printf("failed to write version response: %v", err)
+	}
+}
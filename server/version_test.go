@@ -0,0 +1,36 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionHandler(t *testing.T) {
+	rec := httptest.NewRecorder()
+	VersionHandler(rec, httptest.NewRequest("GET", "/api/version", nil))
+
+	var payload struct {
+		Build buildInfo `json:"build"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &payload); err != nil {
+		t.Fatalf("decode version response: %v", err)
+	}
+	if payload.Build.Version == "" || payload.Build.GoVersion == "" {
+		t.Fatalf("incomplete build info: %+v", payload.Build)
+	}
+}
+
+func TestUploadMetadataRecordsServerVersion(t *testing.T) {
+	chdirTemp(t)
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+
+	metadata, err := readUploadMetadata(uploadFilePath(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if metadata.ServerVersion != VersionString() {
+		t.Fatalf("server_version = %q, want %q", metadata.ServerVersion, VersionString())
+	}
+}
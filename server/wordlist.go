@@ -0,0 +1,77 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"math"
+	"os"
+	"strings"
+	"unicode"
+)
+
+const (
+	minUploadNameWords     = 16
+	maxUploadNameWords     = 1 << 16 // each word is picked by two key bytes
+	maxUploadNameWordCount = 8
+)
+
+// LoadUploadNameWords replaces the built-in word list used for upload names
+// with the words in path, one per line. Blank lines and lines starting with
+// # are ignored. Words are lower-cased and may only contain letters and
+// hyphens, in any script, since names end up in file names.
+//
+// Names of existing uploads change with the list, but their files are still
+// found by key.
+func LoadUploadNameWords(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var words []string
+	seen := map[string]bool{}
+	scanner := bufio.NewScanner(file)
+	for line := 1; scanner.Scan(); line++ {
+		word := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if word == "" || strings.HasPrefix(word, "#") {
+			continue
+		}
+		for _, r := range word {
+			if !unicode.IsLetter(r) && r != '-' {
+				return fmt.Errorf("%s:%d: invalid word %q: only letters and hyphens are allowed", path, line, word)
+			}
+		}
+		if seen[word] {
+			return fmt.Errorf("%s:%d: duplicate word %q", path, line, word)
+		}
+		seen[word] = true
+		words = append(words, word)
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("read %s: %w", path, err)
+	}
+
+	if len(words) < minUploadNameWords || len(words) > maxUploadNameWords {
+		return fmt.Errorf("%s: word list has %d words, need between %d and %d", path, len(words), minUploadNameWords, maxUploadNameWords)
+	}
+	uploadNameWords = words
+	return nil
+}
+
+// SetUploadNameWordCount sets how many words upload names have.
+func SetUploadNameWordCount(n int) error {
+	if n < 1 || n > maxUploadNameWordCount {
+		return fmt.Errorf("invalid upload name word count %d: must be between 1 and %d", n, maxUploadNameWordCount)
+	}
+	uploadNameWordCount = n
+	return nil
+}
+
+// uploadNameEntropyBits is roughly how many bits of randomness an upload
+// name carries, i.e. how hard it is to guess one. It is far less than the
+// key itself: names identify sessions to people, they don't protect them.
+func uploadNameEntropyBits() float64 {
+	bits := float64(uploadNameWordCount) * math.Log2(float64(len(uploadNameWords)))
+	return math.Round(bits*10) / 10
+}
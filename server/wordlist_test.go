@@ -0,0 +1,82 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestUploadNameWordlist(t *testing.T) {
+	dir := chdirTemp(t)
+	builtinWords, builtinCount := uploadNameWords, uploadNameWordCount
+	t.Cleanup(func() {
+		uploadNameWords, uploadNameWordCount = builtinWords, builtinCount
+		clear(uploadKeys.files)
+	})
+
+	key := newTestUploadKey(t)
+	simulateUpload(t, key, []string{`{"heartRate":70}`})
+	oldPath := uploadFilePath(key)
+
+	german := "# Wörter für Sitzungsnamen\nApfel\nbirne\nkirsche\n\ndattel\nerdbeere\nfeige\ngranatapfel\nheidelbeere\ningwer\njohannisbeere\nkiwi\nlimette\nmango\nnektarine\nolive\npflaume\nquitte\nrübe\n"
+	path := filepath.Join(dir, "words.txt")
+	if err := os.WriteFile(path, []byte(german), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := LoadUploadNameWords(path); err != nil {
+		t.Fatalf("load wordlist: %v", err)
+	}
+	if err := SetUploadNameWordCount(3); err != nil {
+		t.Fatal(err)
+	}
+	if len(uploadNameWords) != 18 || uploadNameWords[0] != "apfel" || uploadNameWords[17] != "rübe" {
+		t.Fatalf("words = %v", uploadNameWords)
+	}
+
+	name := uploadNameFromKey(newTestUploadKey(t))
+	if words := strings.Fields(name); len(words) != 3 {
+		t.Fatalf("name %q has %d words", name, len(words))
+	}
+
+	// uploads stored under the old name are still found after a restart
+	if err := RestoreUploadNameSuffixes(); err != nil {
+		t.Fatal(err)
+	}
+	if got := uploadFilePath(key); got != oldPath {
+		t.Fatalf("path of existing upload = %q, want %q", got, oldPath)
+	}
+	simulateUpload(t, key, []string{`{"heartRate":71}`})
+	_, _, records := readUploadFile(t, oldPath)
+	assertRecords(t, records, []string{`{"heartRate":70}`, `{"heartRate":71}`})
+
+	rec := httptest.NewRecorder()
+	NewUploadKeyHandler(rec, httptest.NewRequest("POST", "/api/new-upload-key", nil))
+	var response struct {
+		NameEntropyBits float64 `json:"name_entropy_bits"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&response); err != nil {
+		t.Fatal(err)
+	}
+	if response.NameEntropyBits != 12.5 { // 3 * log2(18)
+		t.Fatalf("name_entropy_bits = %v", response.NameEntropyBits)
+	}
+
+	for content, problem := range map[string]string{
+		"alpha\nbeta\n":              "too few words",
+		strings.Repeat("same\n", 20): "duplicates",
+		"apfel_birne\n":              "an underscore",
+	} {
+		if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := LoadUploadNameWords(path); err == nil {
+			t.Fatalf("wordlist with %s accepted", problem)
+		}
+	}
+	if err := SetUploadNameWordCount(0); err == nil {
+		t.Fatal("word count 0 accepted")
+	}
+}
@@ -0,0 +1,201 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// In write-behind mode, batches are acknowledged once they are in memory
+// and written to their upload every writeBehindInterval, or as soon as an
+// upload has writeBehindRecords records waiting. Many headsets sending a
+// few records several times a second then cause one write per interval
+// each, instead of one per request. The price is durability: records
+// acknowledged but not yet written are lost if the server crashes, and
+// readers such as follow see them only once written. Batches that fail to
+// be written stay buffered and are retried with the next flushes; only
+// after maxWriteBehindAttempts failures in a row are they dropped, and the
+// next batch of their upload is refused with errBufferedRecordsLost, so
+// that the client learns of it.
+var (
+	writeBehindInterval time.Duration // 0 writes every batch at once
+	writeBehindRecords  = 1000
+
+	writeBehindBuffers      = map[string]*writeBehindBuffer{}
+	writeBehindBuffersMutex sync.Mutex
+	// writeBehindLost holds, by upload key, the error of the batches dropped
+	// since the upload's last batch. Guarded by writeBehindBuffersMutex.
+	writeBehindLost = map[string]error{}
+
+	writeBehindJob sync.Once
+
+	writeBehindFlushes     = expvar.NewInt("write_behind_flushes")
+	writeBehindLostRecords = expvar.NewInt("write_behind_lost_records")
+)
+
+// maxWriteBehindAttempts is how often a flush may fail in a row before the
+// batches waiting are dropped.
+const maxWriteBehindAttempts = 5
+
+var errBufferedRecordsLost = errors.New("records acknowledged earlier were lost")
+
+// SetWriteBehind makes ingest buffer batches in memory and write them every
+// interval, or once an upload has maxRecords records waiting. A zero
+// interval writes every batch before acknowledging it, as by default. It
+// must be called before the server starts handling requests.
+func SetWriteBehind(interval time.Duration, maxRecords int) error {
+	if interval < 0 {
+		return fmt.Errorf("invalid write-behind interval %s: must not be negative", interval)
+	}
+	if maxRecords < 1 {
+		return fmt.Errorf("invalid write-behind record count %d: must be at least 1", maxRecords)
+	}
+	writeBehindInterval, writeBehindRecords = interval, maxRecords
+	if interval > 0 {
+		log.Printf("write-behind enabled: records are acknowledged before they are written, and up to %s of them are lost if the server crashes", interval)
+		writeBehindJob.Do(func() {
+			registerJob("write_behind_flush", interval, 0, func(context.Context) error {
+				return FlushWriteBehind()
+			})
+		})
+	}
+	return nil
+}
+
+// writeBehindBuffer holds the batches of an upload waiting to be written.
+// Its mutex is held while they are written, so that the batches of an
+// upload are written in order.
+type writeBehindBuffer struct {
+	mu            sync.Mutex
+	uploadKey     string
+	userAgent     string
+	extraMetadata map[string]any // of the first batch, for a new upload
+	batches       []recordBatch
+	records       int
+	releases      []func() // quota reservations of the batches
+	failures      int      // flushes failed in a row
+	closed        bool     // removed from writeBehindBuffers
+}
+
+// bufferRecords queues a batch for writing and returns the upload's file
+// path. It writes the queue of the upload right away once it is long
+// enough. If batches of the upload were dropped since its last batch, this
+// one is refused with errBufferedRecordsLost instead, and its quota given
+// back.
+func bufferRecords(uploadKey, userAgent string, columns recordColumns, lines []string, extraMetadata map[string]any, release func()) (string, error) {
+	for {
+		writeBehindBuffersMutex.Lock()
+		if lost, ok := writeBehindLost[uploadKey]; ok {
+			delete(writeBehindLost, uploadKey)
+			writeBehindBuffersMutex.Unlock()
+			release()
+			return "", lost
+		}
+		buffer, ok := writeBehindBuffers[uploadKey]
+		if !ok {
+			buffer = &writeBehindBuffer{uploadKey: uploadKey}
+			writeBehindBuffers[uploadKey] = buffer
+		}
+		writeBehindBuffersMutex.Unlock()
+
+		buffer.mu.Lock()
+		if buffer.closed {
+			// flushed and removed in between; queue in its successor
+			buffer.mu.Unlock()
+			continue
+		}
+		if len(buffer.batches) == 0 {
+			buffer.userAgent, buffer.extraMetadata = userAgent, extraMetadata
+		}
+		buffer.batches = append(buffer.batches, recordBatch{columns, lines})
+		buffer.records += len(lines)
+		buffer.releases = append(buffer.releases, release)
+
+		var err error
+		if buffer.records >= writeBehindRecords {
+			if err = buffer.flushLocked(); errors.Is(err, errBufferedRecordsLost) {
+				// this batch was among them, so it's reported now
+				writeBehindBuffersMutex.Lock()
+				delete(writeBehindLost, uploadKey)
+				writeBehindBuffersMutex.Unlock()
+			} else if err != nil {
+				log.Printf("write-behind flush failed, retrying with the next: %v", err)
+				err = nil
+			}
+		}
+		buffer.mu.Unlock()
+		return uploadFilePath(uploadKey), err
+	}
+}
+
+// flushLocked writes the waiting batches. If that fails they stay waiting
+// for the next flush, unless it failed maxWriteBehindAttempts times in a
+// row: then they are dropped, their quota given back and the error, which
+// wraps errBufferedRecordsLost, kept for the next batch of the upload.
+func (b *writeBehindBuffer) flushLocked() error {
+	if len(b.batches) == 0 {
+		return nil
+	}
+
+	writeBehindFlushes.Add(1)
+	_, err := saveUploadBatches(b.uploadKey, b.userAgent, b.batches, b.extraMetadata)
+	if err == nil {
+		b.batches, b.records, b.releases, b.failures = nil, 0, nil, 0
+		return nil
+	}
+	if b.failures++; b.failures < maxWriteBehindAttempts {
+		return fmt.Errorf("write %d buffered records of upload %s (attempt %d of %d): %w", b.records, uploadKeyHash(b.uploadKey), b.failures, maxWriteBehindAttempts, err)
+	}
+
+	writeBehindLostRecords.Add(int64(b.records))
+	for _, release := range b.releases {
+		release()
+	}
+	lost := fmt.Errorf("%w: %d records could not be written: %v", errBufferedRecordsLost, b.records, err)
+	b.batches, b.records, b.releases, b.failures = nil, 0, nil, 0
+	writeBehindBuffersMutex.Lock()
+	writeBehindLost[b.uploadKey] = lost
+	writeBehindBuffersMutex.Unlock()
+	return fmt.Errorf("dropped the buffered records of upload %s: %w", uploadKeyHash(b.uploadKey), lost)
+}
+
+// FlushWriteBehind writes every batch waiting in the write-behind buffers.
+// The server calls it periodically and should call it on shutdown. Batches
+// that fail to be written stay buffered for the next call.
+func FlushWriteBehind() error {
+	writeBehindBuffersMutex.Lock()
+	buffers := make([]*writeBehindBuffer, 0, len(writeBehindBuffers))
+	for _, buffer := range writeBehindBuffers {
+		buffers = append(buffers, buffer)
+	}
+	writeBehindBuffersMutex.Unlock()
+
+	var failed int
+	for _, buffer := range buffers {
+		buffer.mu.Lock()
+		if err := buffer.flushLocked(); err != nil {
+			log.Printf("write-behind flush failed: %v", err)
+			failed++
+		}
+		if len(buffer.batches) > 0 {
+			// kept for the next flush to retry
+			buffer.mu.Unlock()
+			continue
+		}
+		// uploads that stopped don't keep a buffer; one still being written
+		// to gets a new one
+		writeBehindBuffersMutex.Lock()
+		delete(writeBehindBuffers, buffer.uploadKey)
+		writeBehindBuffersMutex.Unlock()
+		buffer.closed = true
+		buffer.mu.Unlock()
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to write the buffered records of %d uploads", failed)
+	}
+	return nil
+}
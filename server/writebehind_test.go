@@ -0,0 +1,111 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestWriteBehind(t *testing.T) {
+	chdirTemp(t)
+	defer func() { writeBehindInterval, writeBehindRecords = 0, 1000 }()
+	// the flush job only runs once jobs are started, so flushes are explicit
+	if err := SetWriteBehind(time.Hour, 4); err != nil {
+		t.Fatal(err)
+	}
+	key := newTestUploadKey(t)
+	filePath := uploadFilePath(key)
+
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+	simulateUpload(t, key, []string{`{"bpm":71}`, `{"bpm":72}`})
+	if _, err := os.Stat(filePath); !os.IsNotExist(err) {
+		t.Fatalf("buffered upload written early: %v", err)
+	}
+
+	// the fourth record fills the buffer
+	simulateUpload(t, key, []string{`{"bpm":73}`})
+	_, _, lines := readUploadFile(t, filePath)
+	assertRecords(t, lines, []string{`{"bpm":70}`, `{"bpm":71}`, `{"bpm":72}`, `{"bpm":73}`})
+
+	flushes := writeBehindFlushes.Value()
+	simulateUpload(t, key, []string{`{"bpm":74}`})
+	if err := FlushWriteBehind(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, lines = readUploadFile(t, filePath)
+	assertRecords(t, lines, []string{`{"bpm":70}`, `{"bpm":71}`, `{"bpm":72}`, `{"bpm":73}`, `{"bpm":74}`})
+	if writeBehindFlushes.Value() != flushes+1 || len(writeBehindBuffers) != 0 {
+		t.Fatalf("flushes = %d, buffers left = %d", writeBehindFlushes.Value()-flushes, len(writeBehindBuffers))
+	}
+	if entries, err := readRecordIndex(filePath); err != nil || len(entries) != 5 {
+		t.Fatalf("record index after flushes: %d entries, %v", len(entries), err)
+	}
+
+	if SetWriteBehind(-time.Second, 1) == nil || SetWriteBehind(time.Second, 0) == nil {
+		t.Fatal("invalid write-behind settings accepted")
+	}
+}
+
+func TestWriteBehindFailedFlush(t *testing.T) {
+	chdirTemp(t)
+	defer func() { writeBehindInterval, writeBehindRecords = 0, 1000 }()
+	if err := SetWriteBehind(time.Hour, 1000); err != nil {
+		t.Fatal(err)
+	}
+	key := newTestUploadKey(t)
+	filePath := uploadFilePath(key)
+
+	// a directory where the upload goes makes every write fail
+	simulateUpload(t, key, []string{`{"bpm":70}`})
+	if err := os.MkdirAll(filePath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlushWriteBehind(); err == nil {
+		t.Fatal("flush into a directory succeeded")
+	}
+
+	// the acknowledged batch is still waiting, and written once possible
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := FlushWriteBehind(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, lines := readUploadFile(t, filePath)
+	assertRecords(t, lines, []string{`{"bpm":70}`})
+
+	// batches that keep failing are dropped in the end, and the client is
+	// told with its next batch, which isn't stored either
+	simulateUpload(t, key, []string{`{"bpm":71}`})
+	if err := os.Rename(filePath, filePath+".bak"); err != nil {
+		t.Fatal(err)
+	}
+	closeIdleUploadFiles(time.Now().Add(time.Hour))
+	if err := os.MkdirAll(filePath, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	lost := writeBehindLostRecords.Value()
+	for range maxWriteBehindAttempts {
+		if err := FlushWriteBehind(); err == nil {
+			t.Fatal("flush into a directory succeeded")
+		}
+	}
+	if writeBehindLostRecords.Value() != lost+1 || len(writeBehindBuffers) != 0 {
+		t.Fatalf("lost records = %d, buffers left = %d", writeBehindLostRecords.Value()-lost, len(writeBehindBuffers))
+	}
+	if err := os.Remove(filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(filePath+".bak", filePath); err != nil {
+		t.Fatal(err)
+	}
+	if code, response := postTenantUpload(t, key, "", []string{`{"bpm":72}`}); code != 500 || response.Error.Code != errCodeBufferedRecordsLost {
+		t.Fatalf("upload after lost records: status = %d, %+v", code, response)
+	}
+	simulateUpload(t, key, []string{`{"bpm":73}`})
+	if err := FlushWriteBehind(); err != nil {
+		t.Fatal(err)
+	}
+	_, _, lines = readUploadFile(t, filePath)
+	assertRecords(t, lines, []string{`{"bpm":70}`, `{"bpm":73}`})
+}
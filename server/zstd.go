@@ -0,0 +1,197 @@
+package server
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compressed uploads are zstd (RFC 8878), compressed and decompressed by
+// github.com/klauspost/compress/zstd. What it doesn't offer is finding where
+// a frame ends without decoding the frames after it, which rebuilding the
+// seek table of a damaged upload needs, so readZstdFrame walks the frame and
+// block headers itself.
+
+const (
+	zstdFrameMagic     = 0xFD2FB528
+	zstdSkippableMagic = 0x184D2A50 // the low 4 bits are free
+
+	// zstdMaxFrameSize bounds the content of a frame the decoder accepts,
+	// which it holds in memory; batches are far smaller.
+	zstdMaxFrameSize = 1 << 30
+)
+
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// errZstdCorrupt wraps every decoding error other than data cut short.
+var errZstdCorrupt = errors.New("zstd: corrupt data")
+
+var (
+	// zstdEncoder compresses each batch as a frame that records its
+	// content size and checksum.
+	zstdEncoder, _ = zstd.NewWriter(nil,
+		zstd.WithEncoderCRC(true),
+		zstd.WithZeroFrames(true),
+		zstd.WithEncoderConcurrency(1),
+	)
+	// zstdDecoder decodes whole frames, for any number of goroutines.
+	zstdDecoder, _ = zstd.NewReader(nil,
+		zstd.WithDecoderConcurrency(0),
+		zstd.WithDecoderMaxMemory(zstdMaxFrameSize),
+	)
+)
+
+// zstdCompress compresses content as one zstd frame.
+func zstdCompress(content []byte) []byte {
+	return zstdEncoder.EncodeAll(content, nil)
+}
+
+// zstdReader decompresses a stream of zstd frames, skipping skippable
+// frames. Data cut short ends with io.ErrUnexpectedEOF, other damage with
+// errZstdCorrupt.
+type zstdReader struct {
+	decoder *zstd.Decoder
+	err     error
+}
+
+func newZstdReader(r io.Reader) *zstdReader {
+	// a single goroutine decodes in Read, so nothing is left running when
+	// the reader is dropped without Close
+	decoder, err := zstd.NewReader(r,
+		zstd.WithDecoderConcurrency(1),
+		zstd.WithDecoderMaxMemory(zstdMaxFrameSize),
+	)
+	return &zstdReader{decoder: decoder, err: err}
+}
+
+func (z *zstdReader) Read(p []byte) (int, error) {
+	if z.err != nil {
+		return 0, z.err
+	}
+	n, err := z.decoder.Read(p)
+	switch {
+	case err == nil, err == io.EOF:
+	case errors.Is(err, io.ErrUnexpectedEOF):
+		z.err = io.ErrUnexpectedEOF
+		err = z.err
+	default:
+		z.err = fmt.Errorf("%w: %w", errZstdCorrupt, err)
+		err = z.err
+	}
+	return n, err
+}
+
+// Close releases the decoder.
+func (z *zstdReader) Close() error {
+	if z.decoder != nil {
+		z.decoder.Close()
+	}
+	return nil
+}
+
+// readZstdFrame decodes the next zstd frame of r, skipping skippable
+// frames, and returns io.EOF at the end of r. It reads no further than the
+// end of the frame.
+func readZstdFrame(r *bufio.Reader) ([]byte, error) {
+	for {
+		var magic [4]byte
+		if n, err := io.ReadFull(r, magic[:]); err != nil {
+			if n == 0 && err == io.EOF {
+				return nil, io.EOF
+			}
+			return nil, io.ErrUnexpectedEOF
+		}
+		switch m := binary.LittleEndian.Uint32(magic[:]); {
+		case m == zstdFrameMagic:
+			frame, err := readZstdFrameData(r, magic[:])
+			if err != nil {
+				return nil, err
+			}
+			content, err := zstdDecoder.DecodeAll(frame, nil)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", errZstdCorrupt, err)
+			}
+			return content, nil
+		case m&^0xf == zstdSkippableMagic:
+			var size [4]byte
+			if _, err := io.ReadFull(r, size[:]); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+			if _, err := r.Discard(int(binary.LittleEndian.Uint32(size[:]))); err != nil {
+				return nil, io.ErrUnexpectedEOF
+			}
+		default:
+			return nil, fmt.Errorf("%w: bad frame magic %08x", errZstdCorrupt, m)
+		}
+	}
+}
+
+// readZstdFrameData reads the rest of a frame whose magic number was read,
+// going by its header, block headers and checksum flag, and returns the
+// whole frame.
+func readZstdFrameData(r *bufio.Reader, magic []byte) ([]byte, error) {
+	frame := append([]byte(nil), magic...)
+	read := func(n int) ([]byte, error) {
+		start := len(frame)
+		frame = append(frame, make([]byte, n)...)
+		if _, err := io.ReadFull(r, frame[start:]); err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return frame[start:], nil
+	}
+
+	descriptor, err := read(1)
+	if err != nil {
+		return nil, err
+	}
+	d := descriptor[0]
+	if d&(1<<3) != 0 {
+		return nil, fmt.Errorf("%w: reserved frame header bit set", errZstdCorrupt)
+	}
+	singleSegment := d&(1<<5) != 0
+	sizeBytes := []int{0, 2, 4, 8}[d>>6]
+	if sizeBytes == 0 && singleSegment {
+		sizeBytes = 1
+	}
+	windowBytes := 1
+	if singleSegment {
+		windowBytes = 0
+	}
+	if _, err := read(windowBytes + []int{0, 1, 2, 4}[d&3] + sizeBytes); err != nil {
+		return nil, err
+	}
+
+	for {
+		header, err := read(3)
+		if err != nil {
+			return nil, err
+		}
+		h := uint32(header[0]) | uint32(header[1])<<8 | uint32(header[2])<<16
+		size := int(h >> 3)
+		switch h >> 1 & 3 {
+		case 1: // RLE: one byte repeated size times
+			size = 1
+		case 3:
+			return nil, fmt.Errorf("%w: reserved block type", errZstdCorrupt)
+		}
+		if len(frame)+size > zstdMaxFrameSize {
+			return nil, fmt.Errorf("%w: frame larger than %d bytes", errZstdCorrupt, zstdMaxFrameSize)
+		}
+		if _, err := read(size); err != nil {
+			return nil, err
+		}
+		if h&1 != 0 {
+			break
+		}
+	}
+	if d&(1<<2) != 0 {
+		if _, err := read(4); err != nil {
+			return nil, err
+		}
+	}
+	return frame, nil
+}
@@ -0,0 +1,188 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// zstdTestInputs are contents that take the encoder's different paths:
+// empty and RLE blocks, raw and compressed literals, and frames of several
+// blocks.
+func zstdTestInputs() map[string][]byte {
+	rng := rand.New(rand.NewPCG(1, 2))
+	random := make([]byte, 70000)
+	for i := range random {
+		random[i] = byte(rng.UintN(256))
+	}
+	var records strings.Builder
+	for i := range 5000 {
+		fmt.Fprintf(&records, "%d,2026-10-16T07:%02d:%02d.%03dZ,headset,%.0f,"+`{"trackerKey":"headset","timestamp":%d,"position":{"x":%.4f,"y":%.4f,"z":%.4f}}`+"\n",
+			i+1, i/3600%60, i/60%60, i%1000, 1.7e12+float64(i)*11, 1700000000000+i*11, rng.Float64(), 1.6+rng.Float64()/10, rng.Float64())
+	}
+	return map[string][]byte{
+		"empty":    {},
+		"byte":     {'x'},
+		"run":      bytes.Repeat([]byte{'a'}, 300000),
+		"short":    []byte("3,{\"bpm\":72}\n"),
+		"text":     []byte(strings.Repeat("the quick brown fox jumps over the lazy dog. ", 20)),
+		"random":   random,
+		"binary":   append(bytes.Repeat([]byte{0xff, 0x80, 0x01}, 400), random[:500]...),
+		"records":  []byte(records.String()),
+		"literals": []byte(strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789", 40)[:1200]),
+	}
+}
+
+func TestZstdRoundTrip(t *testing.T) {
+	for name, content := range zstdTestInputs() {
+		frame := zstdCompress(content)
+		got, err := io.ReadAll(newZstdReader(bytes.NewReader(frame)))
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: round trip of %d bytes gave %d, %v", name, len(content), len(got), err)
+		}
+	}
+
+	// frames decode as one stream, skipping skippable frames
+	stream := appendSeekTable(append(zstdCompress([]byte("a,b\n")), zstdCompress([]byte("c,d\n"))...), nil)
+	if got, err := io.ReadAll(newZstdReader(bytes.NewReader(stream))); err != nil || string(got) != "a,b\nc,d\n" {
+		t.Fatalf("two frames and a seek table = %q, %v", got, err)
+	}
+}
+
+func TestZstdDamagedFrames(t *testing.T) {
+	content := zstdTestInputs()["records"]
+	frame := zstdCompress(content)
+	for _, n := range []int{1, 3, 4, 10, len(frame) / 2, len(frame) - 1} {
+		if _, err := io.ReadAll(newZstdReader(bytes.NewReader(frame[:n]))); !errors.Is(err, io.ErrUnexpectedEOF) {
+			t.Errorf("frame cut to %d bytes: %v", n, err)
+		}
+	}
+	for _, i := range []int{5, len(frame) - 2} {
+		damaged := bytes.Clone(frame)
+		damaged[i] ^= 0x10
+		if _, err := io.ReadAll(newZstdReader(bytes.NewReader(damaged))); !errors.Is(err, errZstdCorrupt) {
+			t.Errorf("frame with byte %d flipped: %v", i, err)
+		}
+	}
+
+	// no damage makes the decoder panic or return wrong content
+	content = content[:20000]
+	frame = zstdCompress(content)
+	for i := range frame {
+		for _, flip := range []byte{0x01, 0x80, 0xff} {
+			damaged := bytes.Clone(frame)
+			damaged[i] ^= flip
+			if got, err := io.ReadAll(newZstdReader(bytes.NewReader(damaged))); err == nil && !bytes.Equal(got, content) {
+				t.Fatalf("frame with byte %d xor %02x decodes to other content", i, flip)
+			}
+		}
+	}
+}
+
+func TestZstdCompressionRatio(t *testing.T) {
+	content := zstdTestInputs()["records"]
+	if n := len(zstdCompress(content)); n*6 > len(content) {
+		t.Fatalf("records compress to %d of %d bytes", n, len(content))
+	}
+}
+
+func TestReadZstdFrame(t *testing.T) {
+	// each frame is read up to its end and no further
+	var stream []byte
+	inputs := zstdTestInputs()
+	names := []string{"empty", "run", "records", "random"}
+	for _, name := range names {
+		stream = append(stream, zstdCompress(inputs[name])...)
+	}
+	stream = appendSeekTable(stream, nil)
+	reader := bufio.NewReader(bytes.NewReader(stream))
+	for _, name := range names {
+		got, err := readZstdFrame(reader)
+		if err != nil || !bytes.Equal(got, inputs[name]) {
+			t.Fatalf("%s: readZstdFrame gave %d of %d bytes, %v", name, len(got), len(inputs[name]), err)
+		}
+	}
+	if _, err := readZstdFrame(reader); err != io.EOF {
+		t.Fatalf("readZstdFrame at the end = %v", err)
+	}
+}
+
+func FuzzZstdReader(f *testing.F) {
+	for _, content := range zstdTestInputs() {
+		f.Add(zstdCompress(content[:min(len(content), 4096)]))
+	}
+	f.Add(appendSeekTable(zstdCompress([]byte("a,b\n")), nil))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := newZstdReader(bytes.NewReader(data))
+		defer reader.Close()
+		_, err := io.ReadAll(reader)
+		if err != nil && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, errZstdCorrupt) {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	})
+}
+
+func FuzzReadZstdFrame(f *testing.F) {
+	for _, content := range zstdTestInputs() {
+		f.Add(zstdCompress(content[:min(len(content), 4096)]))
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		reader := bufio.NewReader(bytes.NewReader(data))
+		for {
+			content, err := readZstdFrame(reader)
+			if err != nil {
+				if err != io.EOF && !errors.Is(err, io.ErrUnexpectedEOF) && !errors.Is(err, errZstdCorrupt) {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			// what decodes frame by frame decodes as a stream too
+			if got, err := io.ReadAll(newZstdReader(bytes.NewReader(zstdCompress(content)))); err != nil || !bytes.Equal(got, content) {
+				t.Fatalf("round trip of a decoded frame gave %d of %d bytes, %v", len(got), len(content), err)
+			}
+		}
+	})
+}
+
+// TestZstdInterop checks uploads against the reference implementation, if
+// its command line tool is installed.
+func TestZstdInterop(t *testing.T) {
+	zstd, err := exec.LookPath("zstd")
+	if err != nil {
+		t.Skip("zstd command not installed")
+	}
+	dir := t.TempDir()
+	for name, content := range zstdTestInputs() {
+		compressed := filepath.Join(dir, name+".zst")
+		if err := os.WriteFile(compressed, zstdCompress(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		got, err := exec.Command(zstd, "-d", "-c", compressed).Output()
+		if err != nil || !bytes.Equal(got, content) {
+			t.Errorf("%s: zstd -d of our frame gave %d of %d bytes, %v", name, len(got), len(content), err)
+		}
+
+		plain := filepath.Join(dir, name)
+		if err := os.WriteFile(plain, content, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		for _, level := range []string{"-1", "-19"} {
+			theirs, err := exec.Command(zstd, "-c", level, plain).Output()
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err = io.ReadAll(newZstdReader(bytes.NewReader(theirs)))
+			if err != nil || !bytes.Equal(got, content) {
+				t.Errorf("%s: decoding zstd %s frame gave %d of %d bytes, %v", name, level, len(got), len(content), err)
+			}
+		}
+	}
+}
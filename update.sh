@@ -3,7 +3,9 @@
 # Update, build & install script for server
 
 git pull
-go build -o hr-demo-app-server ./cmd/server/main.go
+go build \
+  -ldflags "-X github.com/VR-state-analysis/HR-Demo-App/server.Version=$(git describe --tags --always --dirty) -X github.com/VR-state-analysis/HR-Demo-App/server.Commit=$(git rev-parse HEAD) -X github.com/VR-state-analysis/HR-Demo-App/server.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)" \
+  -o hr-demo-app-server ./cmd/server/main.go
 sudo systemctl stop hr-demo-app-server
 sudo cp hr-demo-app-server /usr/local/bin
 sudo setcap 'cap_net_bind_service=+ep' /usr/local/bin/hr-demo-app-server
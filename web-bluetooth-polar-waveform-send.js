@@ -55,12 +55,11 @@ function uploadRecords(entries, session) {
     return;
   }
 
-  const url = '/api/upload?upload_key=' + encodeURIComponent(session.key);
-
-  return fetch(url, {
+  return fetch('/api/upload', {
     method: 'POST',
     headers: {
-      'Content-Type': 'application/x-ndjson'
+      'Content-Type': 'application/x-ndjson',
+      'X-Upload-Key': session.key
     },
     body: body
   })